@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"logit/logg"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogger logs every request logit serves, nil without -access-log
+var accessLogger *logg.Logger
+
+// newAccessLogger opens the access log, name under dir (stdout without a
+// dir), rotated by its own size, policy and backups, each "" or -1 for
+// those of the sender files
+func newAccessLogger(dir, name, size, rotate string, backups int) (*logg.Logger, error) {
+	if strings.ContainsAny(name, `/\`) || name == "logit.log" {
+		return nil, fmt.Errorf("invalid -access-log '%s' (expected a file name in -w)", name)
+	}
+
+	max := maxSize
+	if size != "" {
+		n, err := parseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("-access-log-size: %v", err)
+		}
+		max = n
+	}
+
+	policy := rotationPolicy
+	if rotate != "" {
+		p, err := parseRotationPolicy(rotate)
+		if err != nil {
+			return nil, fmt.Errorf("-access-log-rotate: %v", err)
+		}
+		policy = p
+	}
+
+	var logger *logg.Logger
+
+	if dir == "" {
+		logger = logg.NewLogger("access", os.Stdout, logg.LOG_LEVEL_INFO)
+	} else {
+		var err error
+
+		logger, err = logg.NewFileLoggerWithOptions("", filepath.Join(dir, name), logg.LOG_LEVEL_INFO, max, enableGz, fileOptions)
+		if err != nil {
+			return nil, fmt.Errorf("can't open access log: %v", err)
+		}
+
+		logger.SetRotationPolicy(policy)
+
+		setRetention(logger)
+		if backups >= 0 {
+			logger.SetMaxBackups(backups)
+		}
+	}
+
+	setLineFormat(logger)
+
+	return logger, nil
+}
+
+// accessWriter notes the status and size of a response for the access log,
+// passing on Flush and Hijack like trackingWriter
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be taken over")
+	}
+
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// countingBody counts the bytes a handler reads of a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64 // atomic, a body may be read by another goroutine
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+
+	return n, err
+}
+
+// logAccess logs every request to h once it is answered: method, path,
+// status, latency, remote address, the request id and the bytes read and
+// written. it wraps recoverPanics, so a panic shows as its 500.
+func logAccess(h http.Handler, logger *logg.Logger) http.Handler {
+	if logger == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		aw := &accessWriter{ResponseWriter: rw}
+		body := &countingBody{ReadCloser: req.Body}
+		req.Body = body
+
+		defer func() {
+			status := aw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			logger.Log(logg.LOG_LEVEL_INFO, logg.Fields{
+				"status":     status,
+				"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+				"remote":     req.RemoteAddr,
+				"request_id": rw.Header().Get(REQUEST_ID_HEADER),
+				"bytes_in":   atomic.LoadInt64(&body.n),
+				"bytes_out":  aw.size,
+			}, "%s %s %s", req.Method, accessURI(req), req.Proto)
+		}()
+
+		h.ServeHTTP(aw, req)
+	})
+}
+
+// accessURI is the request's path and query, without a ?token= credential
+func accessURI(req *http.Request) string {
+	if q := accessQuery(req); q != "" {
+		return req.URL.EscapedPath() + "?" + q
+	}
+
+	return req.URL.EscapedPath()
+}
+
+// accessQuery is the request's query, without a ?token= credential
+func accessQuery(req *http.Request) string {
+	q := req.URL.Query()
+	if q.Get(TOKEN_PARAM) == "" {
+		return req.URL.RawQuery
+	}
+
+	q.Set(TOKEN_PARAM, "REDACTED")
+
+	return q.Encode()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logit/logg"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ALERT_QUEUE     = 1024 // entries waiting to be posted; more are dropped
+	ALERT_BATCH_MAX = 20   // entries listed in one alert, the rest counted
+	ALERT_MSG_MAX   = 300  // bytes of a message shown
+	ALERT_TIMEOUT   = 10 * time.Second
+)
+
+// alertEntry is an entry to be alerted on
+type alertEntry struct {
+	time   time.Time
+	sender string
+	level  string
+	msg    string
+}
+
+// alertPolicy holds the lowest level alerted on per sender, 0 for none
+type alertPolicy struct {
+	def     logg.LogLevel
+	senders *senderValues[logg.LogLevel]
+}
+
+// parseAlertLevel parses a level name, or "off" for never
+func parseAlertLevel(s string) (logg.LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	switch s {
+	case "off", "none":
+		return 0, nil
+	case "trace", "debug", "info", "warn", "error", "fatal":
+		return logg.LogLevelFrom(s, 0), nil
+	default:
+		return 0, fmt.Errorf("invalid alert level '%s' (expected a level or off)", s)
+	}
+}
+
+// newAlertPolicy takes the default level and "sender=level,..." overrides
+// (e.g. "payments=warn,batch=off")
+func newAlertPolicy(level string, spec string) (*alertPolicy, error) {
+	def, err := parseAlertLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := parseSenderValues(spec, "alert", "level", forSender(parseAlertLevel))
+	if err != nil {
+		return nil, err
+	}
+
+	return &alertPolicy{def: def, senders: senders}, nil
+}
+
+func (p *alertPolicy) level(sender string) logg.LogLevel {
+	return p.senders.or(sender, p.def)
+}
+
+// alerter posts entries at or above their sender's alert level to a webhook
+// taking Slack's '{"text": ...}' payload. entries arriving within the batch
+// window go out as one alert, and at most perMinute alerts are posted a
+// minute; entries past that wait for the next one, which counts those it
+// can't list. it never blocks the intake path.
+type alerter struct {
+	url       string
+	policy    *alertPolicy
+	batch     time.Duration
+	perMinute int
+	host      string
+
+	queue  chan alertEntry
+	client *http.Client
+	logger *logg.Logger
+
+	posted   int64 // atomic, alerts the webhook took
+	failures int64 // atomic, alerts it didn't
+	dropped  int64 // atomic, entries lost to a full queue
+}
+
+func newAlerter(url string, policy *alertPolicy, batch time.Duration, perMinute int, logger *logg.Logger) (*alerter, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid alert url '%s'", url)
+	}
+
+	if perMinute <= 0 {
+		return nil, fmt.Errorf("invalid alert rate %d (expected alerts per minute above 0)", perMinute)
+	}
+
+	host := nodeId
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	a := &alerter{
+		url:       url,
+		policy:    policy,
+		batch:     batch,
+		perMinute: perMinute,
+		host:      host,
+		queue:     make(chan alertEntry, ALERT_QUEUE),
+		client:    &http.Client{Timeout: ALERT_TIMEOUT, Transport: outbound},
+		logger:    logger,
+	}
+
+	go a.run()
+
+	return a, nil
+}
+
+// offer alerts on an entry if its level calls for it
+func (a *alerter) offer(sender, level, msg string, t time.Time) {
+	min := a.policy.level(sender)
+	if min == 0 || logg.LogLevelFrom(level, logg.LOG_LEVEL_DEBUG) < min {
+		return
+	}
+
+	a.push(alertEntry{time: t, sender: sender, level: level, msg: msg})
+}
+
+// push queues an alert whatever its level
+func (a *alerter) push(e alertEntry) {
+	select {
+	case a.queue <- e:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+// hook alerts on the server's own messages of level and above, as sender
+// 'logit'
+func (a *alerter) hook(logger *logg.Logger, level logg.LogLevel) {
+	logger.AddHook(level, func(e logg.Entry) {
+		a.push(alertEntry{time: e.Time, sender: "logit", level: levelName(e.Level), msg: e.Msg})
+	})
+}
+
+func (a *alerter) run() {
+	var (
+		pending []alertEntry
+		more    int             // entries beyond ALERT_BATCH_MAX
+		senders map[string]bool // of pending and more
+		due     <-chan time.Time
+		posts   []time.Time // of the last minute
+	)
+
+	for {
+		select {
+		case e := <-a.queue:
+			if senders == nil {
+				senders = make(map[string]bool)
+			}
+			senders[e.sender] = true
+
+			if len(pending) < ALERT_BATCH_MAX {
+				pending = append(pending, e)
+			} else {
+				more += 1
+			}
+
+			if due == nil {
+				due = time.After(a.batch)
+			}
+
+		case now := <-due:
+			for len(posts) > 0 && now.Sub(posts[0]) >= time.Minute {
+				posts = posts[1:]
+			}
+
+			if len(posts) >= a.perMinute {
+				// over the rate; gather until the oldest post ages out
+				due = time.After(posts[0].Add(time.Minute).Sub(now))
+				continue
+			}
+
+			due = nil
+			posts = append(posts, now)
+
+			if err := a.post(pending, more, senders); err != nil {
+				atomic.AddInt64(&a.failures, 1)
+				a.logger.Warnf("posting alert failed: %v", err)
+			} else {
+				atomic.AddInt64(&a.posted, 1)
+			}
+
+			pending, more, senders = nil, 0, nil
+		}
+	}
+}
+
+// text renders an alert on entries and more of them left out, of senders,
+// for Slack
+func (a *alerter) text(entries []alertEntry, more int, senders map[string]bool) string {
+	names := make([]string, 0, len(senders))
+	for sender := range senders {
+		names = append(names, sender)
+	}
+	sort.Strings(names)
+
+	total := len(entries) + more
+
+	noun := "entries"
+	if total == 1 {
+		noun = "entry"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*logit on %s: %d %s from %s*\n", a.host, total, noun, strings.Join(names, ", "))
+
+	for _, e := range entries {
+		msg := e.msg
+		if len(msg) > ALERT_MSG_MAX {
+			n := ALERT_MSG_MAX
+			for n > 0 && !utf8.RuneStart(msg[n]) {
+				n -= 1
+			}
+			msg = msg[:n] + "…"
+		}
+		msg = strings.Replace(msg, "\n", " ", -1)
+
+		fmt.Fprintf(&b, "`%s` *%s* %s %s\n", e.time.UTC().Format(time.RFC3339), strings.ToUpper(e.level), e.sender, msg)
+	}
+
+	if more > 0 {
+		fmt.Fprintf(&b, "…and %d more\n", more)
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (a *alerter) post(entries []alertEntry, more int, senders map[string]bool) error {
+	body, err := json.Marshal(map[string]string{"text": a.text(entries, more, senders)})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
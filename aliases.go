@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ALIAS_RELOAD = 5 * time.Second
+
+// senderAliases maps incoming sender names onto canonical ones, so a renamed
+// service keeps writing to one file. the table lives in a file of lines like
+//
+//	web web-frontend frontend
+//
+// (canonical name first) which is reloaded when it changes and rewritten by
+// the admin endpoint.
+type senderAliases struct {
+	path string
+
+	lock    *sync.RWMutex
+	to      map[string]string // alias -> canonical
+	modTime time.Time
+}
+
+func loadAliases(path string) (map[string]string, error) {
+	to := make(map[string]string)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return to, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected '<canonical> <alias>...'", path, n)
+		}
+
+		for _, alias := range fields[1:] {
+			if err := checkAlias(to, alias, fields[0]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+
+			to[alias] = fields[0]
+		}
+	}
+
+	return to, scanner.Err()
+}
+
+// checkAlias refuses chains (an alias of an alias) and double mappings
+func checkAlias(to map[string]string, alias, canonical string) error {
+	switch {
+	case alias == canonical:
+		return fmt.Errorf("'%s' can't be an alias of itself", alias)
+	case to[canonical] != "":
+		return fmt.Errorf("'%s' is itself an alias of '%s'", canonical, to[canonical])
+	case to[alias] != "" && to[alias] != canonical:
+		return fmt.Errorf("'%s' is already an alias of '%s'", alias, to[alias])
+	}
+
+	for a, c := range to {
+		if c == alias {
+			return fmt.Errorf("'%s' is the canonical name of '%s'", alias, a)
+		}
+	}
+
+	for _, sender := range []string{alias, canonical} {
+		if err := checkSender(sender); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newSenderAliases(path string) (*senderAliases, error) {
+	to, err := loadAliases(path)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &senderAliases{
+		path: path,
+		lock: &sync.RWMutex{},
+		to:   to,
+	}
+
+	if fi, err := os.Stat(path); err == nil {
+		a.modTime = fi.ModTime()
+	}
+
+	go a.run()
+
+	return a, nil
+}
+
+func (a *senderAliases) run() {
+	for range time.Tick(ALIAS_RELOAD) {
+		fi, err := os.Stat(a.path)
+		if err != nil {
+			continue
+		}
+
+		a.lock.RLock()
+		unchanged := fi.ModTime().Equal(a.modTime)
+		a.lock.RUnlock()
+
+		if unchanged {
+			continue
+		}
+
+		to, err := loadAliases(a.path)
+
+		a.lock.Lock()
+		a.modTime = fi.ModTime()
+		if err == nil {
+			a.to = to
+		}
+		a.lock.Unlock()
+
+		if err != nil {
+			serverLogger.Errorf("aliases not reloaded, keeping the previous ones: %v", err)
+		} else {
+			serverLogger.Infof("aliases reloaded from '%s' (%d aliases)", a.path, len(to))
+		}
+	}
+}
+
+// resolve returns the canonical name of sender
+func (a *senderAliases) resolve(sender string) string {
+	if a == nil {
+		return sender
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if c, ok := a.to[sender]; ok {
+		return c
+	}
+
+	return sender
+}
+
+func (a *senderAliases) snapshot() map[string]string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	to := make(map[string]string, len(a.to))
+	for k, v := range a.to {
+		to[k] = v
+	}
+
+	return to
+}
+
+// set maps alias onto canonical, or removes alias when canonical is empty,
+// and saves the table
+func (a *senderAliases) set(alias, canonical string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	to := make(map[string]string, len(a.to))
+	for k, v := range a.to {
+		to[k] = v
+	}
+
+	if canonical == "" {
+		delete(to, alias)
+	} else if err := checkAlias(to, alias, canonical); err != nil {
+		return err
+	} else {
+		to[alias] = canonical
+	}
+
+	if err := a.save(to); err != nil {
+		return err
+	}
+
+	a.to = to
+	if fi, err := os.Stat(a.path); err == nil {
+		a.modTime = fi.ModTime()
+	}
+
+	return nil
+}
+
+// save writes to to the aliases file, grouped by canonical name
+func (a *senderAliases) save(to map[string]string) error {
+	groups := make(map[string][]string)
+	for alias, canonical := range to {
+		groups[canonical] = append(groups[canonical], alias)
+	}
+
+	canonicals := make([]string, 0, len(groups))
+	for c := range groups {
+		canonicals = append(canonicals, c)
+	}
+	sort.Strings(canonicals)
+
+	var b strings.Builder
+	for _, c := range canonicals {
+		sort.Strings(groups[c])
+		fmt.Fprintf(&b, "%s %s\n", c, strings.Join(groups[c], " "))
+	}
+
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.path)
+}
+
+// makeAliasAdminHandler serves GET /admin/aliases, PUT /admin/aliases/<alias>
+// with ?to=<canonical> and DELETE /admin/aliases/<alias>
+func makeAliasAdminHandler(a *senderAliases) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		alias := strings.ToLower(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/aliases"), "/"))
+
+		if alias == "" {
+			if req.Method != "GET" {
+				rw.Header().Set("Allow", "GET")
+				writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(a.snapshot())
+			return
+		}
+
+		var canonical string
+
+		switch req.Method {
+		case "PUT", "POST":
+			canonical = strings.ToLower(strings.TrimSpace(req.URL.Query().Get("to")))
+			if canonical == "" {
+				writeError(rw, ERR_BODY_INVALID, "missing 'to'")
+				return
+			}
+		case "DELETE":
+		default:
+			rw.Header().Set("Allow", "PUT, DELETE")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		if err := a.set(alias, canonical); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		}
+
+		if canonical == "" {
+			serverLogger.Infof("alias '%s' removed", alias)
+		} else {
+			serverLogger.Infof("alias '%s' now maps to '%s'", alias, canonical)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(a.snapshot())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	ANOMALY_WINDOW = time.Minute
+	ANOMALY_ALPHA  = 0.1 // weight of the newest window in the baseline
+	ANOMALY_WARMUP = 10  // windows observed before a sender may alert
+)
+
+// anomaly describes a window whose warn/error volume was unusually high
+type anomaly struct {
+	Sender string
+	Count  int64
+	Mean   float64
+	StdDev float64
+	Score  float64
+}
+
+func (a anomaly) String() string {
+	return fmt.Sprintf("sender '%s' had %d warn/error entries in the last %v (baseline %.1f ± %.1f, z=%.1f)",
+		a.Sender, a.Count, ANOMALY_WINDOW, a.Mean, a.StdDev, a.Score)
+}
+
+type anomalyBaseline struct {
+	count    int64 // warn/error entries in the current window
+	mean     float64
+	variance float64
+	windows  int
+}
+
+// anomalyDetector keeps an exponentially weighted baseline of warn/error
+// volume per sender and fires alert when a window deviates by more than
+// threshold standard deviations
+type anomalyDetector struct {
+	threshold float64
+	minCount  int64
+	alert     func(anomaly)
+
+	lock      *sync.Mutex
+	baselines map[string]*anomalyBaseline
+}
+
+func newAnomalyDetector(threshold float64, minCount int64, alert func(anomaly)) *anomalyDetector {
+	d := &anomalyDetector{
+		threshold: threshold,
+		minCount:  minCount,
+		alert:     alert,
+		lock:      &sync.Mutex{},
+		baselines: make(map[string]*anomalyBaseline),
+	}
+
+	go func() {
+		for _ = range time.Tick(ANOMALY_WINDOW) {
+			d.tick()
+		}
+	}()
+
+	return d
+}
+
+func (d *anomalyDetector) observe(sender, level string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	b := d.baselines[sender]
+	if b == nil {
+		b = new(anomalyBaseline)
+		d.baselines[sender] = b
+	}
+
+	switch level {
+	case "warn", "error", "fatal":
+		b.count += 1
+	}
+}
+
+// tick closes the current window of every sender
+func (d *anomalyDetector) tick() {
+	var fired []anomaly
+
+	d.lock.Lock()
+
+	for sender, b := range d.baselines {
+		count := float64(b.count)
+		stddev := math.Sqrt(b.variance)
+
+		if b.windows >= ANOMALY_WARMUP && b.count >= d.minCount {
+			// guard against a perfectly flat baseline
+			score := (count - b.mean) / math.Max(stddev, 1)
+
+			if score > d.threshold {
+				fired = append(fired, anomaly{sender, b.count, b.mean, stddev, score})
+			}
+		}
+
+		// update the ewma baseline (and its variance) with this window
+		diff := count - b.mean
+		incr := ANOMALY_ALPHA * diff
+		b.mean += incr
+		b.variance = (1 - ANOMALY_ALPHA) * (b.variance + diff*incr)
+
+		b.count = 0
+		b.windows += 1
+	}
+
+	d.lock.Unlock()
+
+	for _, a := range fired {
+		d.alert(a)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ARCHIVE_DIR         = "archive"
+	ARCHIVE_MAX_BACKOFF = 5 * time.Minute
+	ARCHIVE_STAMP       = "20060102T150405Z"
+)
+
+// archiver uploads rotated files to S3-compatible storage. the archive hook
+// of the file loggers links (or with -archive-delete moves) each rotated file
+// into a spool named by its object key, so neither a later rotation renaming
+// the file nor a restart loses the upload; a spooled file goes once uploaded.
+type archiver struct {
+	s3      *s3Client
+	prefix  string
+	host    string
+	logDir  string
+	spool   string
+	moveOut bool // -archive-delete
+
+	lock   *sync.Mutex
+	notify chan struct{}
+
+	paused int32 // atomic
+	marker pauseMarker
+
+	uploaded      int64 // atomic
+	uploadedBytes int64 // atomic
+	failures      int64 // atomic
+
+	lastErr    atomic.Value // string
+	lastErrAt  atomic.Value // time.Time
+	lastUpload atomic.Value // time.Time
+}
+
+// newArchiver takes 's3://bucket[/prefix]'; '{host}' in the prefix is the
+// host's name. endpoint "" is AWS in region.
+func newArchiver(to, endpoint, region, logDir string, moveOut bool) (*archiver, error) {
+	if !strings.HasPrefix(to, "s3://") {
+		return nil, fmt.Errorf("invalid archive target '%s' (expected s3://bucket[/prefix])", to)
+	}
+
+	ss := strings.SplitN(to[len("s3://"):], "/", 2)
+
+	bucket, prefix := ss[0], ""
+	if len(ss) == 2 {
+		prefix = strings.Trim(ss[1], "/")
+	}
+
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid archive target '%s' (expected s3://bucket[/prefix])", to)
+	}
+
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	c, err := newS3Client(endpoint, region, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(logDir, ARCHIVE_DIR)
+	spool := filepath.Join(dir, "pending")
+
+	if err := os.MkdirAll(spool, 0755); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+
+	a := &archiver{
+		s3:      c,
+		prefix:  prefix,
+		host:    host,
+		logDir:  logDir,
+		spool:   spool,
+		moveOut: moveOut,
+		lock:    &sync.Mutex{},
+		notify:  make(chan struct{}, 1),
+		marker:  pauseMarker(filepath.Join(dir, "paused")),
+	}
+
+	if a.marker.isSet() {
+		a.paused = 1
+	}
+
+	return a, nil
+}
+
+// keyOf makes the object key of a rotated file: the prefix, the file's
+// directory under the log directory and its name behind the time it is
+// archived at, as numbered rotated files take the same names again; n > 0
+// tells apart files archived within the same second
+func (a *archiver) keyOf(path string, now time.Time, n int) string {
+	rel, err := filepath.Rel(a.logDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+
+	rel = filepath.ToSlash(rel)
+	dir, name := "", rel
+	if i := strings.LastIndexByte(rel, '/'); i >= 0 {
+		dir, name = rel[:i+1], rel[i+1:]
+	}
+
+	stamp := now.UTC().Format(ARCHIVE_STAMP)
+	if n > 0 {
+		stamp += fmt.Sprintf("-%d", n)
+	}
+
+	key := dir + stamp + "_" + name
+	if prefix := strings.Replace(a.prefix, "{host}", a.host, -1); prefix != "" {
+		key = prefix + "/" + key
+	}
+
+	return key
+}
+
+// add is the archive hook: it spools a rotated file for upload. it runs
+// on the compression workers of logg.
+func (a *archiver) add(path string) {
+	a.lock.Lock()
+
+	now := time.Now()
+
+	var spooled string
+	for n := 0; ; n++ {
+		spooled = filepath.Join(a.spool, url.PathEscape(a.keyOf(path, now, n)))
+
+		if _, err := os.Lstat(spooled); os.IsNotExist(err) {
+			break
+		}
+	}
+
+	var err error
+	if a.moveOut {
+		if err = os.Rename(path, spooled); err != nil {
+			// another file system
+			if err = copyFile(path, spooled); err == nil {
+				err = os.Remove(path)
+			}
+		}
+	} else if err = os.Link(path, spooled); err != nil {
+		err = copyFile(path, spooled)
+	}
+
+	a.lock.Unlock()
+
+	if err != nil {
+		os.Remove(spooled)
+		serverLogger.Errorf("archiving '%s' failed: %v", path, err)
+		return
+	}
+
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+}
+
+// copyFile copies src to dst by way of a temporary file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+type archiveFile struct {
+	Key      string    `json:"key"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+
+	path string
+}
+
+// pending lists the spooled files, oldest first
+func (a *archiver) pending() []archiveFile {
+	infos, _ := ioutil.ReadDir(a.spool)
+
+	files := make([]archiveFile, 0, len(infos))
+
+	for _, fi := range infos {
+		key, err := url.PathUnescape(fi.Name())
+		if err != nil || !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+
+		files = append(files, archiveFile{key, fi.Size(), fi.ModTime(), filepath.Join(a.spool, fi.Name())})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Modified.Before(files[j].Modified)
+	})
+
+	return files
+}
+
+// start uploads spooled files in the background, those of an earlier run
+// first
+func (a *archiver) start() {
+	go a.run()
+}
+
+func (a *archiver) run() {
+	backoff := time.Second
+
+	for {
+		var files []archiveFile
+		if atomic.LoadInt32(&a.paused) == 0 {
+			files = a.pending()
+		}
+
+		if len(files) == 0 {
+			select {
+			case <-a.notify:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		f := files[0]
+
+		if err := a.s3.putFile(context.Background(), f.path, f.Key); err != nil {
+			atomic.AddInt64(&a.failures, 1)
+			a.lastErr.Store(err.Error())
+			a.lastErrAt.Store(time.Now())
+
+			serverLogger.Warnf("archive upload of '%s' failed (retrying in %v): %v", f.Key, backoff, err)
+			time.Sleep(backoff)
+
+			if backoff *= 2; backoff > ARCHIVE_MAX_BACKOFF {
+				backoff = ARCHIVE_MAX_BACKOFF
+			}
+			continue
+		}
+
+		backoff = time.Second
+
+		os.Remove(f.path)
+
+		atomic.AddInt64(&a.uploaded, 1)
+		atomic.AddInt64(&a.uploadedBytes, f.Bytes)
+		a.lastUpload.Store(time.Now())
+	}
+}
+
+func (a *archiver) pause() error {
+	if err := a.marker.set(true); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&a.paused, 1)
+	return nil
+}
+
+func (a *archiver) resume() error {
+	if err := a.marker.set(false); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&a.paused, 0)
+
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (a *archiver) status() sinkStatus {
+	st := sinkStatus{
+		Name:   "archive",
+		Paused: atomic.LoadInt32(&a.paused) != 0,
+	}
+
+	for _, f := range a.pending() {
+		st.Buffered += f.Bytes
+	}
+
+	st.Draining = !st.Paused && st.Buffered > 0
+
+	return st
+}
+
+func (a *archiver) probe(ctx context.Context) error {
+	return a.s3.headBucket(ctx)
+}
+
+type archiveStatus struct {
+	Target        string        `json:"target"`
+	Paused        bool          `json:"paused"`
+	Pending       []archiveFile `json:"pending"`
+	PendingBytes  int64         `json:"pending_bytes"`
+	Uploaded      int64         `json:"uploaded"`
+	UploadedBytes int64         `json:"uploaded_bytes"`
+	Failures      int64         `json:"failures"`
+	LastError     string        `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time    `json:"last_error_at,omitempty"`
+	LastUploadAt  *time.Time    `json:"last_upload_at,omitempty"`
+}
+
+// makeArchiveAdminHandler serves GET /admin/archive: the files waiting to be
+// uploaded and how uploads went
+func makeArchiveAdminHandler(a *archiver) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		st := archiveStatus{
+			Target:        strings.TrimSuffix("s3://"+a.s3.bucket+"/"+a.prefix, "/"),
+			Paused:        atomic.LoadInt32(&a.paused) != 0,
+			Pending:       a.pending(),
+			Uploaded:      atomic.LoadInt64(&a.uploaded),
+			UploadedBytes: atomic.LoadInt64(&a.uploadedBytes),
+			Failures:      atomic.LoadInt64(&a.failures),
+		}
+
+		for _, f := range st.Pending {
+			st.PendingBytes += f.Bytes
+		}
+
+		st.LastError, _ = a.lastErr.Load().(string)
+		if t, ok := a.lastErrAt.Load().(time.Time); ok {
+			st.LastErrorAt = &t
+		}
+		if t, ok := a.lastUpload.Load().(time.Time); ok {
+			st.LastUploadAt = &t
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(st)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// admin actions (every admin request but reads) are recorded in -audit-log,
+// a file in -w only ever appended to: a record of the request before it is
+// served, which the request fails without, and one of its outcome after.
+// records are numbered and each holds the hash of the one before it and its
+// own, an HMAC-SHA256 of that and its content under the key of -audit-key,
+// kept away from -w, so records can't be changed, removed or forged without
+// breaking the chain; verifyAuditLog finds where. <log>.head, holding the
+// number and hash of the last record under the same key, tells records cut
+// off the end; rolling back the log and its head together to an earlier
+// copy goes unnoticed, which the chain head logged at every start helps to
+// tell.
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Seq    int64           `json:"seq"`
+	Of     int64           `json:"of,omitempty"` // the record of the request an outcome is of
+	Time   time.Time       `json:"time"`
+	Caller string          `json:"caller,omitempty"` // the principal of the admin auth chain
+	Remote string          `json:"remote"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Query  string          `json:"query,omitempty"`
+	Status int             `json:"status,omitempty"` // of the outcome
+	Before json.RawMessage `json:"before,omitempty"` // state of what the action changes
+	After  json.RawMessage `json:"after,omitempty"`
+	Prev   string          `json:"prev"` // hash of the record before, "" for the first
+	Hash   string          `json:"hash,omitempty"`
+}
+
+// auditHead is the last record of the audit log, kept in <log>.head
+type auditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+	Mac  string `json:"mac"`
+}
+
+// auditLog appends records to the audit log; a nil one records nothing
+type auditLog struct {
+	key  []byte
+	path string
+
+	lock *sync.Mutex
+	f    *os.File
+	seq  int64  // of the last record
+	last string // hash of the last record
+}
+
+// auditStateFunc returns the state an admin request changes, nil if it
+// changes nothing it knows of
+type auditStateFunc func(req *http.Request) interface{}
+
+// loadAuditKey loads the key of -audit-key, or of $LOGIT_AUDIT_KEY holding
+// the key itself; nil if neither is given
+func loadAuditKey(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return readKeyFile(keyFile)
+	}
+
+	if s := os.Getenv("LOGIT_AUDIT_KEY"); s != "" {
+		return parseKey(s, "$LOGIT_AUDIT_KEY")
+	}
+
+	return nil, nil
+}
+
+// openAuditLog opens the audit log, name in dir, to append to the chain of
+// the records it has. a chain found broken is returned as an error along
+// with the log, which goes on from its last record.
+func openAuditLog(dir, name string, key []byte) (*auditLog, error) {
+	if strings.ContainsAny(name, `/\`) || name == "logit.log" {
+		return nil, fmt.Errorf("invalid -audit-log '%s' (expected a file name in -w)", name)
+	}
+
+	path := filepath.Join(dir, name)
+
+	seq, last, verr := verifyAuditLog(path, key)
+	if verr != nil && os.IsNotExist(verr) {
+		verr = nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open audit log: %v", err)
+	}
+
+	return &auditLog{key: key, path: path, lock: &sync.Mutex{}, f: f, seq: seq, last: last}, verr
+}
+
+// hashOf returns the hash of a record, chained to prev
+func (r auditRecord) hashOf(key []byte) (string, error) {
+	r.Hash = ""
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (h auditHead) macOf(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d %s", h.Seq, h.Hash)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// verifyAuditLog checks the chain of the audit log at path, and that it
+// reaches its head, and returns the number and hash of its last record; the
+// error tells the first record breaking it
+func verifyAuditLog(path string, key []byte) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	var seq int64
+	var last string
+	var broken error
+
+	// the hash of each record, to find the head in
+	hashes := make(map[int64]string)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		var r auditRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			if broken == nil {
+				broken = fmt.Errorf("audit log '%s' broken at line %d: %v", path, n, err)
+			}
+			continue
+		}
+
+		hash, err := r.hashOf(key)
+		if broken == nil {
+			switch {
+			case err != nil:
+				broken = fmt.Errorf("audit log '%s' broken at line %d: %v", path, n, err)
+			case r.Hash != hash:
+				broken = fmt.Errorf("audit log '%s' broken at line %d: the record was changed or not written under this key", path, n)
+			case r.Prev != last || r.Seq != seq+1:
+				broken = fmt.Errorf("audit log '%s' broken at line %d: the record before it is missing or changed", path, n)
+			}
+		}
+
+		// later records chain to what is there, so one break shows once
+		seq = r.Seq
+		last = r.Hash
+		hashes[seq] = last
+	}
+
+	if err := scanner.Err(); err != nil {
+		return seq, last, err
+	}
+
+	if broken != nil {
+		return seq, last, broken
+	}
+
+	var head auditHead
+	if err := readJSONFile(auditHeadPath(path), &head); err != nil {
+		if os.IsNotExist(err) && seq == 0 {
+			return seq, last, nil
+		}
+		return seq, last, fmt.Errorf("audit log '%s' has no valid head: %v", path, err)
+	}
+
+	switch {
+	case !hmac.Equal([]byte(head.Mac), []byte(head.macOf(key))):
+		return seq, last, fmt.Errorf("audit log '%s' has a head that was changed or not written under this key", path)
+	case head.Seq > seq || hashes[head.Seq] != head.Hash:
+		return seq, last, fmt.Errorf("audit log '%s' ends at record %d, before its head at record %d: records were cut off", path, seq, head.Seq)
+	}
+
+	return seq, last, nil
+}
+
+// record appends a record, filling in its number and chain, synced so it
+// outlives a crash, and moves the head to it; it returns the number given
+func (a *auditLog) record(r auditRecord) (int64, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	r.Seq = a.seq + 1
+	r.Prev = a.last
+
+	hash, err := r.hashOf(a.key)
+	if err != nil {
+		return 0, err
+	}
+	r.Hash = hash
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+
+	if err := a.f.Sync(); err != nil {
+		return 0, err
+	}
+
+	a.seq = r.Seq
+	a.last = hash
+
+	head := auditHead{Seq: r.Seq, Hash: hash}
+	head.Mac = head.macOf(a.key)
+
+	return r.Seq, writeJSONFile(auditHeadPath(a.path), head)
+}
+
+func (a *auditLog) Close() error {
+	return a.f.Close()
+}
+
+// wrap records the admin requests to h that aren't reads, with the caller
+// named by the auth chain wrapped around it and the state of state before
+// and after the request, if state is given. a request that can't be
+// recorded isn't served.
+func (a *auditLog) wrap(state auditStateFunc, h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		r := auditRecord{
+			Time:   time.Now(),
+			Caller: requestPrincipal(req),
+			Remote: req.RemoteAddr,
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  accessQuery(req),
+		}
+
+		if state != nil {
+			r.Before = auditState(state(req))
+		}
+
+		of, err := a.record(r)
+		if err != nil {
+			serverLogger.Errorf("recording %s %s in the audit log failed, not serving it: %v", r.Method, r.Path, err)
+			writeError(rw, ERR_INTERNAL, "recording the request in the audit log failed")
+			return
+		}
+
+		aw := &accessWriter{ResponseWriter: rw}
+		h.ServeHTTP(aw, req)
+
+		r.Of = of
+		r.Time = time.Now()
+		r.Before = nil
+
+		r.Status = aw.status
+		if r.Status == 0 {
+			r.Status = http.StatusOK
+		}
+
+		if state != nil {
+			r.After = auditState(state(req))
+		}
+
+		// the action is done by now, so a failure can only be told
+		if _, err := a.record(r); err != nil {
+			serverLogger.Errorf("recording the outcome of %s %s in the audit log failed: %v", r.Method, r.Path, err)
+		}
+	})
+}
+
+func auditState(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	return b
+}
+
+// auditPathPart returns the i-th part of the request's path after prefix,
+// e.g. the sender of /admin/senders/<sender>/level; "" if there is none
+func auditPathPart(req *http.Request, prefix string, i int) string {
+	ss := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/"), "/")
+	if i >= len(ss) {
+		return ""
+	}
+
+	return ss[i]
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"logit/logg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var auditTestKey = bytes.Repeat([]byte{0x42}, 32)
+
+// writeTestAudit records n admin requests to dir/audit.log and returns its
+// path
+func writeTestAudit(t *testing.T, dir string, n int) string {
+	t.Helper()
+
+	if serverLogger == nil {
+		serverLogger = logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG)
+	}
+
+	a, err := openAuditLog(dir, "audit.log", auditTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	h := a.wrap(nil, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	for i := 0; i < n; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/admin/senders/web/level", strings.NewReader("info")))
+	}
+
+	return filepath.Join(dir, "audit.log")
+}
+
+func auditTestLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestAuditLogChain(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestAudit(t, dir, 3)
+
+	seq, _, err := verifyAuditLog(path, auditTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record of each request before it is served, one of its outcome after
+	if seq != 6 {
+		t.Errorf("got %d records, expected 6", seq)
+	}
+
+	// a reopened log goes on with the chain
+	writeTestAudit(t, dir, 1)
+
+	if seq, _, err := verifyAuditLog(path, auditTestKey); err != nil || seq != 8 {
+		t.Errorf("reopened: got %d records (%v), expected 8", seq, err)
+	}
+}
+
+// changes to the log are found, unless made by one holding the key
+func TestAuditLogTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, lines []string) []string
+	}{
+		{"record changed", func(t *testing.T, lines []string) []string {
+			lines[2] = strings.Replace(lines[2], `"PUT"`, `"GET"`, 1)
+			return lines
+		}},
+		{"record removed", func(t *testing.T, lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}},
+		{"records swapped", func(t *testing.T, lines []string) []string {
+			lines[2], lines[3] = lines[3], lines[2]
+			return lines
+		}},
+		{"last record cut off", func(t *testing.T, lines []string) []string {
+			return lines[:len(lines)-1]
+		}},
+		{"last records cut off", func(t *testing.T, lines []string) []string {
+			return lines[:2]
+		}},
+		{"every record removed", func(t *testing.T, lines []string) []string {
+			return nil
+		}},
+		{"chain rewritten under another key", func(t *testing.T, lines []string) []string {
+			dir := t.TempDir()
+
+			a, err := openAuditLog(dir, "audit.log", bytes.Repeat([]byte{0x17}, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.record(auditRecord{Method: "PUT", Path: "/admin/senders/web/level"})
+			a.Close()
+
+			return auditTestLines(t, filepath.Join(dir, "audit.log"))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTestAudit(t, t.TempDir(), 3)
+
+			lines := test.tamper(t, auditTestLines(t, path))
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := verifyAuditLog(path, auditTestKey); err == nil {
+				t.Errorf("tampered log verified")
+			}
+		})
+	}
+}
+
+// a head changed to match a cut log is found
+func TestAuditLogHeadChanged(t *testing.T) {
+	path := writeTestAudit(t, t.TempDir(), 2)
+
+	var head auditHead
+	if err := readJSONFile(auditHeadPath(path), &head); err != nil {
+		t.Fatal(err)
+	}
+
+	head.Seq = 2
+	if err := writeJSONFile(auditHeadPath(path), head); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := verifyAuditLog(path, auditTestKey); err == nil {
+		t.Errorf("changed head verified")
+	}
+
+	if _, _, err := verifyAuditLog(path, bytes.Repeat([]byte{0x17}, 32)); err == nil {
+		t.Errorf("log verified under another key")
+	}
+}
+
+// a request is recorded before it is served, and not served if it can't be
+func TestAuditLogRecordsFirst(t *testing.T) {
+	if serverLogger == nil {
+		serverLogger = logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG)
+	}
+
+	dir := t.TempDir()
+
+	a, err := openAuditLog(dir, "audit.log", auditTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := 0
+	h := a.wrap(nil, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		served++
+
+		if req.Method == "GET" {
+			return
+		}
+
+		if seq, _, err := verifyAuditLog(filepath.Join(dir, "audit.log"), auditTestKey); err != nil || seq != 1 {
+			t.Errorf("served at record %d (%v), expected the request recorded first", seq, err)
+		}
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/admin/aliases/web", nil))
+
+	// reads aren't recorded
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/aliases", nil))
+	if served != 2 || a.seq != 2 {
+		t.Errorf("got %d served and %d records, expected 2 and 2", served, a.seq)
+	}
+
+	a.Close()
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("DELETE", "/admin/aliases/web", nil))
+
+	if served != 2 || rw.Code != http.StatusInternalServerError {
+		t.Errorf("audit log closed: served with %d", rw.Code)
+	}
+}
+
+// a ?token= credential isn't written to the log, which can't be redacted
+// once chained
+func TestAuditLogToken(t *testing.T) {
+	if serverLogger == nil {
+		serverLogger = logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG)
+	}
+
+	dir := t.TempDir()
+
+	a, err := openAuditLog(dir, "audit.log", auditTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := a.wrap(nil, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/admin/aliases/web?"+TOKEN_PARAM+"=s3cret&force=1", nil))
+	a.Close()
+
+	b, err := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "s3cret") || !strings.Contains(string(b), "force=1") {
+		t.Errorf("got %s, expected the token redacted and the rest of the query kept", b)
+	}
+}
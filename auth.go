@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authResult is what a mechanism makes of a request
+type authResult int
+
+const (
+	AUTH_ABSENT   authResult = iota // no credentials for this mechanism
+	AUTH_ACCEPTED                   // valid credentials
+	AUTH_REJECTED                   // credentials present but invalid
+)
+
+// authenticator is a single mechanism of an auth chain. principal names the
+// authenticated client when the mechanism knows one ("" otherwise).
+type authenticator interface {
+	name() string
+	authenticate(req *http.Request) (result authResult, principal string, reason string)
+}
+
+// scopedAuthenticator is a mechanism whose credentials may be limited to some
+// senders; scope returns them for an accepted request, nil for all
+type scopedAuthenticator interface {
+	scope(req *http.Request) []string
+}
+
+// authChain is an ordered list of groups that must all accept a request;
+// within a group any one mechanism accepting suffices. in a spec groups are
+// separated by ',' and alternatives by '|', e.g. 'mtls|jwt|apikey,ip' means
+// "a client certificate, a token or an api key, and from an allowed network".
+type authChain struct {
+	groups [][]authenticator
+}
+
+type authConfig struct {
+	jwtSecretFile string
+	apiKeyFile    string
+	allowNets     string
+	tokenFile     string
+	tokenSpec     string
+	tokens        map[string]apiToken // of the config file, by the token itself
+}
+
+type principalKey struct{}
+type senderScopeKey struct{}
+
+// requestPrincipal returns the client named by the auth chain, if any
+func requestPrincipal(req *http.Request) string {
+	p, _ := req.Context().Value(principalKey{}).(string)
+	return p
+}
+
+// senderAllowed reports whether the request's credentials may read or write
+// sender; only unrestricted ones may use '*' (every sender at once)
+func senderAllowed(req *http.Request, sender string) bool {
+	scope, ok := req.Context().Value(senderScopeKey{}).([]string)
+	if !ok {
+		return true
+	}
+
+	for _, s := range scope {
+		if s == sender {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newAuthChain(spec string, conf authConfig) (*authChain, error) {
+	chain := new(authChain)
+	made := make(map[string]authenticator)
+
+	for _, g := range strings.Split(spec, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+
+		var group []authenticator
+
+		for _, kind := range strings.Split(g, "|") {
+			kind = strings.ToLower(strings.TrimSpace(kind))
+
+			a, ok := made[kind]
+			if !ok {
+				var err error
+
+				a, err = newAuthenticator(kind, conf)
+				if err != nil {
+					return nil, err
+				}
+
+				made[kind] = a
+			}
+
+			group = append(group, a)
+		}
+
+		chain.groups = append(chain.groups, group)
+	}
+
+	return chain, nil
+}
+
+func newAuthenticator(kind string, conf authConfig) (authenticator, error) {
+	switch kind {
+	case "mtls":
+		return mtlsAuth{}, nil
+
+	case "jwt":
+		if conf.jwtSecretFile == "" {
+			return nil, fmt.Errorf("auth 'jwt' requires -auth-jwt-secret")
+		}
+
+		b, err := ioutil.ReadFile(conf.jwtSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading jwt secret failed: %v", err)
+		}
+
+		return &jwtAuth{secret: []byte(strings.TrimSpace(string(b)))}, nil
+
+	case "apikey":
+		if conf.apiKeyFile == "" {
+			return nil, fmt.Errorf("auth 'apikey' requires -auth-api-keys")
+		}
+
+		return loadApiKeys(conf.apiKeyFile)
+
+	case "ip":
+		if conf.allowNets == "" {
+			return nil, fmt.Errorf("auth 'ip' requires -auth-allow")
+		}
+
+		return newIpAllowlist(conf.allowNets)
+
+	case "token":
+		if conf.tokenFile == "" && conf.tokenSpec == "" && len(conf.tokens) == 0 {
+			return nil, fmt.Errorf("auth 'token' requires -auth-tokens, -auth-token-list or auth.tokens of -config")
+		}
+
+		a, err := newTokenAuth(conf)
+		if err == nil {
+			tokenAuths = append(tokenAuths, a)
+		}
+
+		return a, err
+
+	default:
+		return nil, fmt.Errorf("unknown auth mechanism '%s' (expected mtls, jwt, apikey, token or ip)", kind)
+	}
+}
+
+// check runs the chain, returning the principal, the senders the request is
+// limited to (nil for all) or why the request failed
+func (chain *authChain) check(req *http.Request) (string, []string, error) {
+	var principal string
+	var scope []string
+
+	for _, group := range chain.groups {
+		var reasons []string
+		accepted := false
+
+		for _, a := range group {
+			result, p, reason := a.authenticate(req)
+
+			if result == AUTH_ACCEPTED {
+				accepted = true
+
+				if principal == "" {
+					principal = p
+				}
+
+				if s, ok := a.(scopedAuthenticator); ok && scope == nil {
+					scope = s.scope(req)
+				}
+				break
+			}
+
+			if result == AUTH_REJECTED {
+				reasons = append(reasons, fmt.Sprintf("%s: %s", a.name(), reason))
+			}
+		}
+
+		if !accepted {
+			if len(reasons) == 0 {
+				names := make([]string, len(group))
+				for i, a := range group {
+					names[i] = a.name()
+				}
+
+				return "", nil, fmt.Errorf("missing credentials (%s)", strings.Join(names, " or "))
+			}
+
+			return "", nil, fmt.Errorf("%s", strings.Join(reasons, "; "))
+		}
+	}
+
+	return principal, scope, nil
+}
+
+// wrap protects h with the chain; a nil or empty chain lets everything through
+func (chain *authChain) wrap(h http.Handler) http.Handler {
+	return chain.wrapStage("", h)
+}
+
+// wrapStage is wrap timing the checks as a stage of stageStats, rejected
+// requests counting as dropped
+func (chain *authChain) wrapStage(stage string, h http.Handler) http.Handler {
+	if chain == nil || len(chain.groups) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var timer *stageTimer
+		if stage != "" {
+			timer = stageStats.timer(stage)
+		}
+
+		principal, scope, err := chain.check(req)
+		if err != nil {
+			if timer != nil {
+				timer.end(STAGE_DROPPED)
+			}
+
+			writeError(rw, ERR_UNAUTHORIZED, "%v", err)
+			return
+		}
+
+		if timer != nil {
+			timer.end(STAGE_PASSED)
+		}
+
+		if principal != "" {
+			req = req.WithContext(context.WithValue(req.Context(), principalKey{}, principal))
+		}
+
+		if scope != nil {
+			req = req.WithContext(context.WithValue(req.Context(), senderScopeKey{}, scope))
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// mtlsAuth accepts verified client certificates; the principal is the
+// certificate's common name
+type mtlsAuth struct{}
+
+func (mtlsAuth) name() string { return "mtls" }
+
+func (mtlsAuth) authenticate(req *http.Request) (authResult, string, string) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return AUTH_ABSENT, "", ""
+	}
+
+	if len(req.TLS.VerifiedChains) == 0 {
+		return AUTH_REJECTED, "", "client certificate not verified"
+	}
+
+	return AUTH_ACCEPTED, req.TLS.VerifiedChains[0][0].Subject.CommonName, ""
+}
+
+// jwtAuth accepts HS256 bearer tokens; the principal is the 'sub' claim
+type jwtAuth struct {
+	secret []byte
+}
+
+func (a *jwtAuth) name() string { return "jwt" }
+
+func (a *jwtAuth) authenticate(req *http.Request) (authResult, string, string) {
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return AUTH_ABSENT, "", ""
+	}
+
+	parts := strings.Split(strings.TrimSpace(h[len("Bearer "):]), ".")
+	if len(parts) != 3 {
+		// not a jwt; maybe a token for another mechanism
+		return AUTH_ABSENT, "", ""
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := decodeJwtPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return AUTH_REJECTED, "", "unsupported token header"
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return AUTH_REJECTED, "", "invalid token signature"
+	}
+
+	var claims struct {
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+		Nbf int64  `json:"nbf"`
+	}
+
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return AUTH_REJECTED, "", "invalid token claims"
+	}
+
+	now := time.Now().Unix()
+
+	if claims.Exp != 0 && now >= claims.Exp {
+		return AUTH_REJECTED, "", "token expired"
+	}
+
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return AUTH_REJECTED, "", "token not yet valid"
+	}
+
+	return AUTH_ACCEPTED, claims.Sub, ""
+}
+
+func decodeJwtPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// apiKeyAuth accepts keys from a file of '<key> <principal>' lines, passed in
+// X-Api-Key or as 'Authorization: ApiKey <key>'
+type apiKeyAuth struct {
+	keys map[[sha256.Size]byte]string // hashed, so lookups don't leak timing
+}
+
+func loadApiKeys(path string) (*apiKeyAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading api keys failed: %v", err)
+	}
+	defer f.Close()
+
+	a := &apiKeyAuth{keys: make(map[[sha256.Size]byte]string)}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected '<key> <principal>'", path, n)
+		}
+
+		a.keys[sha256.Sum256([]byte(fields[0]))] = fields[1]
+	}
+
+	return a, scanner.Err()
+}
+
+func (a *apiKeyAuth) name() string { return "apikey" }
+
+func (a *apiKeyAuth) authenticate(req *http.Request) (authResult, string, string) {
+	key := req.Header.Get("X-Api-Key")
+	if h := req.Header.Get("Authorization"); key == "" && strings.HasPrefix(h, "ApiKey ") {
+		key = strings.TrimSpace(h[len("ApiKey "):])
+	}
+
+	if key == "" {
+		return AUTH_ABSENT, "", ""
+	}
+
+	principal, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return AUTH_REJECTED, "", "unknown api key"
+	}
+
+	return AUTH_ACCEPTED, principal, ""
+}
+
+// apiToken is what a token of tokenAuth stands for
+type apiToken struct {
+	principal string
+	senders   []string // nil for all
+}
+
+// tokenAuth accepts static tokens passed as 'Authorization: Bearer <token>'
+// or ?token=, each possibly limited to some senders. tokens come from a file
+// of '<token> <principal> [<sender>,...]' lines and from -auth-token-list.
+type tokenAuth struct {
+	lock   *sync.RWMutex
+	tokens map[[sha256.Size]byte]apiToken // hashed like api keys
+}
+
+// tokenAuths are the token authenticators of the auth chains, reloaded
+// together
+var tokenAuths []*tokenAuth
+
+// newTokenAuth loads the tokens of -auth-tokens, -auth-token-list and the
+// config file
+func newTokenAuth(conf authConfig) (*tokenAuth, error) {
+	a, err := loadTokens(conf.tokenFile, conf.tokenSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	for token, t := range conf.tokens {
+		a.tokens[sha256.Sum256([]byte(token))] = t
+	}
+
+	return a, nil
+}
+
+// update takes the tokens of next; requests being checked see either set
+func (a *tokenAuth) update(next *tokenAuth) {
+	a.lock.Lock()
+	a.tokens = next.tokens
+	a.lock.Unlock()
+}
+
+func (a *tokenAuth) lookup(token string) (apiToken, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	t, ok := a.tokens[sha256.Sum256([]byte(token))]
+	return t, ok
+}
+
+// TOKEN_PARAM carries the token for clients that can't set headers
+const TOKEN_PARAM = "token"
+
+func parseTokenSenders(s string, sep string) ([]string, error) {
+	if s == "" || s == TAIL_ALL {
+		return nil, nil
+	}
+
+	var senders []string
+
+	for _, sender := range strings.Split(s, sep) {
+		sender, err := normalizeSender(sender)
+		if err != nil {
+			return nil, err
+		}
+
+		senders = append(senders, sender)
+	}
+
+	return senders, nil
+}
+
+// loadTokens reads the token file (if any) and the inline list, which is
+// comma separated '<principal>=<token>[@<sender>+<sender>...]'
+func loadTokens(path string, spec string) (*tokenAuth, error) {
+	a := &tokenAuth{lock: &sync.RWMutex{}, tokens: make(map[[sha256.Size]byte]apiToken)}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading tokens failed: %v", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) != 2 && len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: expected '<token> <principal> [<sender>,...]'", path, n)
+			}
+
+			var senders []string
+			if len(fields) == 3 {
+				if senders, err = parseTokenSenders(fields[2], ","); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+				}
+			}
+
+			a.tokens[sha256.Sum256([]byte(fields[0]))] = apiToken{fields[1], senders}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid token '%s' (expected '<principal>=<token>[@<sender>+...]')", item)
+		}
+
+		token, scope := kv[1], ""
+		if i := strings.Index(token, "@"); i >= 0 {
+			token, scope = token[:i], token[i+1:]
+		}
+
+		senders, err := parseTokenSenders(scope, "+")
+		if err != nil {
+			return nil, fmt.Errorf("token of '%s': %v", kv[0], err)
+		}
+
+		a.tokens[sha256.Sum256([]byte(token))] = apiToken{kv[0], senders}
+	}
+
+	return a, nil
+}
+
+func (a *tokenAuth) name() string { return "token" }
+
+// token returns the request's token and whether it looks like a jwt, which
+// is left to 'jwt' unless it is a known token
+func (a *tokenAuth) token(req *http.Request) (string, bool) {
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimSpace(h[len("Bearer "):])
+		return token, strings.Count(token, ".") == 2
+	}
+
+	return req.URL.Query().Get(TOKEN_PARAM), false
+}
+
+func (a *tokenAuth) authenticate(req *http.Request) (authResult, string, string) {
+	token, jwtLike := a.token(req)
+	if token == "" {
+		return AUTH_ABSENT, "", ""
+	}
+
+	t, ok := a.lookup(token)
+	if !ok && jwtLike {
+		return AUTH_ABSENT, "", ""
+	}
+
+	if !ok {
+		return AUTH_REJECTED, "", "unknown token"
+	}
+
+	return AUTH_ACCEPTED, t.principal, ""
+}
+
+func (a *tokenAuth) scope(req *http.Request) []string {
+	token, _ := a.token(req)
+	t, _ := a.lookup(token)
+	return t.senders
+}
+
+// ipAllowlist accepts requests from the listed networks; it never names a
+// principal and a refused address is always a rejection
+type ipAllowlist struct {
+	nets []*net.IPNet
+}
+
+func newIpAllowlist(spec string) (*ipAllowlist, error) {
+	a := new(ipAllowlist)
+
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network '%s': %v", s, err)
+		}
+
+		a.nets = append(a.nets, n)
+	}
+
+	return a, nil
+}
+
+func (a *ipAllowlist) name() string { return "ip" }
+
+func (a *ipAllowlist) authenticate(req *http.Request) (authResult, string, string) {
+	// who may use the socket is up to its file's permissions
+	if fromUnixSocket(req) {
+		return AUTH_ACCEPTED, "", ""
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	for _, n := range a.nets {
+		if ip != nil && n.Contains(ip) {
+			return AUTH_ACCEPTED, "", ""
+		}
+	}
+
+	return AUTH_REJECTED, "", fmt.Sprintf("address %s not allowed", host)
+}
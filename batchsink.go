@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BATCH_SINK_QUEUE       = 10000 // entries a sink buffers in memory
+	BATCH_SINK_SIZE        = 500   // entries shipped at once at most
+	BATCH_SINK_LINGER      = 200 * time.Millisecond
+	BATCH_SINK_MIN_BACKOFF = 250 * time.Millisecond
+	BATCH_SINK_MAX_BACKOFF = 30 * time.Second
+)
+
+// sinkEntry is an entry as batch sinks ship it
+type sinkEntry struct {
+	Time   time.Time              `json:"time"`
+	Sender string                 `json:"sender"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Retain string                 `json:"retain,omitempty"`
+	Id     string                 `json:"id,omitempty"`
+}
+
+// batchSender ships entries to a destination; on an error the whole batch
+// is sent again later, so destinations see entries at least once
+type batchSender interface {
+	send(batch []*sinkEntry) error
+}
+
+// permanentError fails a batch for good: the sink drops it rather than
+// retry, e.g. when the destination refuses it. entries tells how many of
+// the batch were lost, if the destination took the others; 0 means all.
+type permanentError struct {
+	err     error
+	entries int
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// batchSink gets every stored entry to a destination in batches, off the
+// intake path. failed batches are retried with backoff while new entries
+// queue in memory; a full queue spills to a spool under -w (entries are
+// dropped without one), which also holds entries while the sink is paused.
+type batchSink struct {
+	name   string
+	sender batchSender
+	queue  chan *sinkEntry
+
+	sent     int64 // atomic, entries the destination took
+	failures int64 // atomic, failed batches
+	dropped  int64 // atomic, entries lost to a full queue or refused
+
+	// while held (paused, spilled or draining) entries go to the spool, in
+	// order behind those there already
+	held     int32 // atomic, read without holdLock on the intake path
+	holdLock *sync.Mutex
+	paused   bool
+	draining bool
+	spool    *diskSpool
+	marker   pauseMarker
+}
+
+var batchSinks []*batchSink
+
+func newBatchSink(name string, sender batchSender) *batchSink {
+	s := &batchSink{
+		name:     name,
+		sender:   sender,
+		queue:    make(chan *sinkEntry, BATCH_SINK_QUEUE),
+		holdLock: &sync.Mutex{},
+	}
+
+	go s.run()
+
+	return s
+}
+
+// offer queues a stored entry for the destination
+func (s *batchSink) offer(e *entry) {
+	se := &sinkEntry{
+		Time:   e.time(),
+		Sender: e.sender,
+		Level:  e.level,
+		Msg:    e.msg,
+		Fields: e.fields,
+		Retain: e.retain,
+		Id:     e.id,
+	}
+
+	if atomic.LoadInt32(&s.held) != 0 && s.hold(se, false) {
+		return
+	}
+
+	select {
+	case s.queue <- se:
+	default:
+		if !s.hold(se, true) {
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+// enablePause lets the sink be paused and spill, spooling to dir. a pause
+// active when the server stopped is restored, and entries spooled before
+// are sent.
+func (s *batchSink) enablePause(dir string) error {
+	spool, err := newDiskSpool(dir, s.name)
+	if err != nil {
+		return err
+	}
+
+	s.spool = spool
+	s.marker = pauseMarker(filepath.Join(dir, SPOOL_DIR, s.name+".paused"))
+
+	if s.marker.isSet() {
+		s.paused = true
+		atomic.StoreInt32(&s.held, 1)
+	} else if spool.len() > 0 {
+		atomic.StoreInt32(&s.held, 1)
+		s.startDrain()
+	}
+
+	return nil
+}
+
+// hold spools e if the sink is held, or holds it first if spill is set
+func (s *batchSink) hold(e *sinkEntry, spill bool) bool {
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	if s.spool == nil {
+		return false
+	}
+
+	if atomic.LoadInt32(&s.held) == 0 {
+		if !spill {
+			return false
+		}
+
+		atomic.StoreInt32(&s.held, 1)
+		s.startDrain()
+	}
+
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = s.spool.write(b)
+	}
+
+	if err != nil {
+		serverLogger.Errorf("spooling entry for %s failed: %v", s.name, err)
+		atomic.AddInt64(&s.dropped, 1)
+	}
+
+	return true
+}
+
+func (s *batchSink) pause() error {
+	if s.spool == nil {
+		return fmt.Errorf("pausing needs a log directory (-w) to spool to")
+	}
+
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	if err := s.marker.set(true); err != nil {
+		return err
+	}
+
+	s.paused = true
+	atomic.StoreInt32(&s.held, 1)
+
+	return nil
+}
+
+func (s *batchSink) resume() error {
+	if s.spool == nil {
+		return nil
+	}
+
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	if !s.paused {
+		return nil
+	}
+
+	if err := s.marker.set(false); err != nil {
+		return err
+	}
+
+	s.paused = false
+	s.startDrain()
+
+	return nil
+}
+
+// startDrain starts draining unless paused or a drain is running already;
+// the caller holds holdLock (or is still alone)
+func (s *batchSink) startDrain() {
+	if !s.draining && !s.paused {
+		s.draining = true
+		go s.drain()
+	}
+}
+
+// drain moves spooled entries to the queue in order, waiting for room, and
+// releases the hold once the spool is empty
+func (s *batchSink) drain() {
+	for {
+		s.holdLock.Lock()
+
+		if s.paused {
+			// paused again meanwhile
+			s.draining = false
+			s.holdLock.Unlock()
+			return
+		}
+
+		records, err := s.spool.read(BATCH_SINK_SIZE)
+		if err == nil && len(records) == 0 {
+			atomic.StoreInt32(&s.held, 0)
+			s.draining = false
+			s.holdLock.Unlock()
+			return
+		}
+
+		s.holdLock.Unlock()
+
+		if err != nil {
+			serverLogger.Errorf("reading the spool of %s failed: %v", s.name, err)
+			time.Sleep(time.Second)
+		}
+
+		for _, record := range records {
+			e := new(sinkEntry)
+			if json.Unmarshal(record, e) == nil {
+				s.queue <- e
+			}
+		}
+	}
+}
+
+func (s *batchSink) status() sinkStatus {
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	st := sinkStatus{
+		Name:     s.name,
+		Paused:   s.paused,
+		Draining: s.draining,
+	}
+
+	if s.spool != nil {
+		st.Buffered = s.spool.len()
+	}
+
+	return st
+}
+
+// probe checks the destination, if its sender can
+func (s *batchSink) probe(ctx context.Context) error {
+	if p, ok := s.sender.(prober); ok {
+		return p.probe(ctx)
+	}
+
+	return nil
+}
+
+func (s *batchSink) progress() int64 {
+	return atomic.LoadInt64(&s.sent)
+}
+
+func (s *batchSink) pending() int {
+	return len(s.queue)
+}
+
+// run collects batches of up to BATCH_SINK_SIZE entries, waiting at most
+// BATCH_SINK_LINGER for a batch to fill, and ships them
+func (s *batchSink) run() {
+	batch := make([]*sinkEntry, 0, BATCH_SINK_SIZE)
+
+	for {
+		batch = append(batch[:0], <-s.queue)
+		linger := time.After(BATCH_SINK_LINGER)
+
+	collect:
+		for len(batch) < BATCH_SINK_SIZE {
+			select {
+			case e := <-s.queue:
+				batch = append(batch, e)
+			case <-linger:
+				break collect
+			}
+		}
+
+		s.ship(batch)
+	}
+}
+
+// ship sends a batch until the destination takes it, or refuses it for good
+func (s *batchSink) ship(batch []*sinkEntry) {
+	backoff := BATCH_SINK_MIN_BACKOFF
+	failing := false
+
+	for {
+		err := s.sender.send(batch)
+		if err == nil {
+			break
+		}
+
+		atomic.AddInt64(&s.failures, 1)
+
+		if perr, ok := err.(permanentError); ok {
+			lost := perr.entries
+			if lost == 0 || lost > len(batch) {
+				lost = len(batch)
+			}
+
+			serverLogger.Errorf("%s refuses %d entries, dropping them: %v", s.name, lost, err)
+			atomic.AddInt64(&s.dropped, int64(lost))
+			atomic.AddInt64(&s.sent, int64(len(batch)-lost))
+			return
+		}
+		if !failing {
+			failing = true
+			serverLogger.Errorf("sending %d entries to %s failed, retrying: %v", len(batch), s.name, err)
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > BATCH_SINK_MAX_BACKOFF {
+			backoff = BATCH_SINK_MAX_BACKOFF
+		}
+	}
+
+	if failing {
+		serverLogger.Infof("%s takes entries again", s.name)
+	}
+
+	atomic.AddInt64(&s.sent, int64(len(batch)))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// bulkEntry is one entry of a POST /bulk/<sender> body. msg is a string, or
+// an object standing for a structured (JSON) entry.
+type bulkEntry struct {
+	Level  string                 `json:"level"`
+	Msg    json.RawMessage        `json:"msg"`
+	Fields map[string]interface{} `json:"fields"`
+	Ts     string                 `json:"ts"`
+	Retain string                 `json:"retain"`
+	Id     string                 `json:"id"`
+}
+
+// envelopeOf reads a JSON body posted to /<sender>/<level> as an entry of
+// its own when it is an object with a msg and no keys but bulkEntry's, e.g.
+// {"level": "error", "msg": "...", "fields": {...}}; it returns nil for
+// other bodies, which are stored as structured entries as they are.
+func envelopeOf(b []byte) (*bulkEntry, error) {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(b, &keys) != nil {
+		return nil, nil
+	}
+
+	if _, ok := keys["msg"]; !ok {
+		return nil, nil
+	}
+
+	for key := range keys {
+		if !envelopeKeys[key] {
+			return nil, nil
+		}
+	}
+
+	var be bulkEntry
+	if err := json.Unmarshal(b, &be); err != nil {
+		return nil, fmt.Errorf("invalid entry: %v", err)
+	}
+
+	return &be, nil
+}
+
+var envelopeKeys = map[string]bool{"level": true, "msg": true, "fields": true, "ts": true, "retain": true, "id": true}
+
+// defaults fills what the entry leaves out from the request: the level of
+// its path, ?ts= or the timestamp header, ?retain= and the dedup header
+func (be *bulkEntry) defaults(level string, req *http.Request) {
+	q := req.URL.Query()
+
+	if be.Level == "" {
+		be.Level = level
+	}
+
+	if be.Ts == "" {
+		be.Ts = q.Get("ts")
+	}
+
+	if be.Ts == "" {
+		be.Ts = req.Header.Get(LOG_TIMESTAMP_HEADER)
+	}
+
+	if be.Retain == "" {
+		be.Retain = q.Get("retain")
+	}
+
+	if be.Id == "" {
+		be.Id = req.Header.Get(DEDUP_ID_HEADER)
+	}
+}
+
+type bulkRejection struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+type bulkResponse struct {
+	Accepted int             `json:"accepted"`
+	Dropped  int             `json:"dropped,omitempty"` // by pipeline stages
+	Rejected []bulkRejection `json:"rejected,omitempty"`
+	Entries  []echoedEntry   `json:"entries,omitempty"` // made of the body, under -dry-run
+}
+
+// makeBulkHandler serves POST /bulk/<sender>, taking newline delimited JSON
+// entries or a JSON array of them:
+// {"level": "warn", "msg": "...", "fields": {...}, "ts": "...", "retain": "...", "id": "..."}.
+// entries are taken in order; an invalid entry is reported and skipped, while
+// a body that stops parsing ends the request with the entries before it kept.
+func makeBulkHandler(logger *logg.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		sender, err := parseBulkPath(req.URL.EscapedPath())
+		if err != nil {
+			writeError(rw, ERR_SENDER_INVALID, "%v", err)
+			return
+		}
+
+		sender = aliases.resolve(sender)
+		logger := logger.WithContext(req.Context()).With("remote", req.RemoteAddr, "sender", sender)
+
+		if !senderAllowed(req, sender) {
+			writeError(rw, ERR_FORBIDDEN, "not allowed to write '%s'", sender)
+			return
+		}
+
+		if admission.refused(sender) {
+			writeError(rw, ERR_FORBIDDEN, "unknown sender '%s'", sender)
+			return
+		}
+
+		if gz := req.URL.Query().Get("gz"); gz != "" {
+			on, ok := parseSwitch(gz)
+			if !ok {
+				writeError(rw, ERR_BODY_INVALID, "invalid gz parameter '%s'", gz)
+				return
+			}
+
+			if !dryRun {
+				gzPrefs.set(sender, on)
+			}
+		}
+
+		// read body, up to -max-inflated whether compressed or not
+		if req.ContentLength > maxInflated {
+			tooLarge(rw, req, logger, maxInflated)
+			return
+		}
+
+		req.Body = http.MaxBytesReader(rw, req.Body, maxInflated)
+
+		if err := inflateBody(req, maxInflated); err != nil {
+			refuseBody(rw, req, logger, err)
+			return
+		}
+
+		body := bufio.NewReader(req.Body)
+		dec := json.NewDecoder(body)
+
+		// an array is read element by element, like NDJSON
+		if b, err := peekNonSpace(body); err == nil && b == '[' {
+			dec.Token()
+		}
+
+		var resp bulkResponse
+
+		for i := 0; ; i++ {
+			if !dec.More() {
+				break
+			}
+
+			parse := stageStats.timer("parse")
+
+			var be bulkEntry
+			err := dec.Decode(&be)
+
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				// the value was read; only this entry is wrong
+				parse.end(STAGE_DROPPED)
+				resp.Rejected = append(resp.Rejected, bulkRejection{i, err.Error()})
+				continue
+			}
+
+			if e, ok := err.(*http.MaxBytesError); ok {
+				parse.end(STAGE_DROPPED)
+				writeError(rw, ERR_BODY_TOO_LARGE, "body over %d bytes (%d entries before it were accepted)", e.Limit, resp.Accepted)
+				return
+			}
+
+			if err != nil {
+				parse.end(STAGE_DROPPED)
+				writeError(rw, ERR_BODY_INVALID, "entry %d: %v (%d entries before it were accepted)", i, err, resp.Accepted)
+				return
+			}
+
+			e, err := be.entry(sender)
+			if err != nil {
+				parse.end(STAGE_DROPPED)
+				resp.Rejected = append(resp.Rejected, bulkRejection{i, err.Error()})
+				continue
+			}
+
+			e.addTrace(req)
+			e.waitSync(req)
+			parse.end(STAGE_PASSED)
+
+			if dryRun {
+				resp.Entries = append(resp.Entries, echoOf(e))
+				resp.Accepted++
+				continue
+			}
+
+			if ok, wait := senderLimits.allow(e); !ok {
+				retryAfter(rw, wait)
+				writeError(rw, ERR_RATE_LIMITED, "sender '%s' is over its rate at entry %d, retry in %v (%d entries before it were accepted)", sender, i, wait, resp.Accepted)
+				return
+			}
+
+			if !quotas.allow(e) {
+				retryAfter(rw, quotaScan)
+				writeError(rw, ERR_QUOTA_EXCEEDED, "sender '%s' is over its disk quota at entry %d (%d entries before it were accepted)", sender, i, resp.Accepted)
+				return
+			}
+
+			if !intake.run(e) {
+				resp.Dropped++
+				continue
+			}
+
+			if err := deliver(e); err != nil {
+				dedup.forget(e)
+				logger.Errorf("storing entry failed: %v", err)
+				writeError(rw, storeError(err), "storing entry %d failed (%d entries before it were accepted)", i, resp.Accepted)
+				return
+			}
+
+			resp.Accepted++
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(resp)
+	}
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			return b[0], nil
+		}
+
+		r.ReadByte()
+	}
+}
+
+// entry makes the entry the HTTP handler would for the same message
+func (be *bulkEntry) entry(sender string) (*entry, error) {
+	var msg string
+	isJSON := false
+
+	switch {
+	case len(be.Msg) == 0:
+		return nil, fmt.Errorf("missing msg")
+
+	case be.Msg[0] == '"':
+		if err := json.Unmarshal(be.Msg, &msg); err != nil {
+			return nil, err
+		}
+
+	case be.Msg[0] == '{':
+		msg, isJSON = string(be.Msg), true
+
+	default:
+		return nil, fmt.Errorf("msg must be a string or an object")
+	}
+
+	// each entry is held to -max-body, as if sent alone
+	if maxBody > 0 && int64(len(msg)) > maxBody {
+		return nil, fmt.Errorf("msg over %d bytes", maxBody)
+	}
+
+	if strictBodies && !utf8.ValidString(msg) {
+		return nil, fmt.Errorf("msg is not valid UTF-8")
+	}
+
+	retain, err := retainClassOf(be.Retain, []byte(msg), isJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	at, err := eventTimeOf(be.Ts, "", []byte(msg), isJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := dedupIdOf(be.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptor != nil && isJSON {
+		encrypt := stageStats.timer("encrypt")
+
+		b, err := encryptor.encrypt(sender, []byte(msg))
+		if err != nil {
+			encrypt.end(STAGE_FAILED)
+			return nil, fmt.Errorf("field encryption failed")
+		}
+
+		encrypt.end(STAGE_PASSED)
+		msg = string(b)
+	}
+
+	return &entry{
+		sender:   sender,
+		level:    normalizeLevel(be.Level),
+		msg:      msg,
+		fields:   be.Fields,
+		received: time.Now(),
+		at:       at,
+		retain:   retain,
+		id:       id,
+	}, nil
+}
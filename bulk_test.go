@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"logit/logg"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// an uncompressed body is held to -max-inflated, and each entry of it to
+// -max-body
+func TestBulkHandlerLimits(t *testing.T) {
+	defer func(dry bool, body, inflated int64) { dryRun, maxBody, maxInflated = dry, body, inflated }(dryRun, maxBody, maxInflated)
+	dryRun, maxBody, maxInflated = true, 16, 256
+
+	if stageStats == nil {
+		stageStats = newPipelineMetrics()
+	}
+
+	h := makeBulkHandler(logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG))
+
+	entry := func(msg string) string {
+		return `{"level":"info","msg":"` + msg + `"}` + "\n"
+	}
+
+	tests := []struct {
+		name, body string
+		length     bool // with a Content-Length
+
+		status             int
+		accepted, rejected int
+	}{
+		{"within the limits", entry("short") + entry("also short"), true, 200, 2, 0},
+		{"entry over -max-body", entry("short") + entry(strings.Repeat("x", 17)) + entry("short"), true, 200, 2, 1},
+		{"entry at -max-body", entry(strings.Repeat("x", 16)), true, 200, 1, 0},
+		{"declared length over -max-inflated", strings.Repeat(entry("short"), 20), true, 413, 0, 0},
+		{"streamed over -max-inflated", strings.Repeat(entry("short"), 20), false, 413, 0, 0},
+		{"one entry over -max-inflated", entry(strings.Repeat("x", 300)), false, 413, 0, 0},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/bulk/web", strings.NewReader(test.body))
+		if !test.length {
+			req.ContentLength = -1
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: got %d, expected %d", test.name, rw.Code, test.status)
+			continue
+		}
+
+		if test.status != 200 {
+			continue
+		}
+
+		var resp bulkResponse
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if resp.Accepted != test.accepted || len(resp.Rejected) != test.rejected {
+			t.Errorf("%s: got %d accepted and %d rejected, expected %d and %d", test.name, resp.Accepted, len(resp.Rejected), test.accepted, test.rejected)
+		}
+	}
+}
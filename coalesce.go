@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// distinct messages tracked per sender; beyond this new ones pass through
+const COALESCE_MAX_KEYS = 1024
+
+type coalesceKey struct {
+	level string
+	msg   string
+}
+
+type coalesceState struct {
+	first      time.Time // when the stored entry was accepted
+	suppressed int64
+	sample     *entry // the stored entry, for the summary
+}
+
+// coalescer collapses bursts of identical messages (same sender, level and
+// text) within a window into the first entry plus a summary carrying the
+// repeat count. entries above maxLevel are never coalesced.
+type coalescer struct {
+	window    time.Duration
+	perSender map[string]time.Duration
+	maxLevel  string
+	emit      func(e *entry)
+
+	lock    *sync.Mutex
+	senders map[string]map[coalesceKey]*coalesceState
+}
+
+// parseDurationSpec parses "sender=duration,..." (e.g. "web=30s,audit=0")
+func parseDurationSpec(spec string) (*senderValues[time.Duration], error) {
+	return parseSenderValues(spec, "duration", "duration", func(sender, value string) (time.Duration, error) {
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s' for '%s': %v", value, sender, err)
+		}
+		return d, nil
+	})
+}
+
+func newCoalescer(window time.Duration, perSender map[string]time.Duration, maxLevel string, emit func(e *entry)) *coalescer {
+	c := &coalescer{
+		window:    window,
+		perSender: perSender,
+		maxLevel:  maxLevel,
+		emit:      emit,
+		lock:      &sync.Mutex{},
+		senders:   make(map[string]map[coalesceKey]*coalesceState),
+	}
+
+	go func() {
+		for _ = range time.Tick(time.Second) {
+			c.expire(time.Now())
+		}
+	}()
+
+	return c
+}
+
+func (c *coalescer) windowOf(sender string) time.Duration {
+	if d, ok := c.perSender[sender]; ok {
+		return d
+	}
+
+	return c.window
+}
+
+func summaryOf(st *coalesceState) *entry {
+	return &entry{
+		sender:   st.sample.sender,
+		level:    st.sample.level,
+		msg:      fmt.Sprintf("message repeated %d times: %s", st.suppressed, st.sample.msg),
+		fields:   map[string]interface{}{"repeated": st.suppressed},
+		received: time.Now(),
+	}
+}
+
+// stage is the pipeline stage dropping repeats of a recently stored message
+func (c *coalescer) stage(e *entry) bool {
+	window := c.windowOf(e.sender)
+	if window <= 0 || !levelAtLeast(c.maxLevel, e.level) {
+		return true
+	}
+
+	key := coalesceKey{e.level, e.msg}
+
+	c.lock.Lock()
+
+	states := c.senders[e.sender]
+	if states == nil {
+		states = make(map[coalesceKey]*coalesceState)
+		c.senders[e.sender] = states
+	}
+
+	st := states[key]
+	if st != nil && e.received.Sub(st.first) < window {
+		st.suppressed += 1
+		c.lock.Unlock()
+		return false
+	}
+
+	var summary *entry
+	if st != nil && st.suppressed > 0 {
+		// the previous burst ended; summarize it before the new entry
+		summary = summaryOf(st)
+	}
+
+	if st != nil || len(states) < COALESCE_MAX_KEYS {
+		states[key] = &coalesceState{first: e.received, sample: e}
+	}
+
+	c.lock.Unlock()
+
+	if summary != nil {
+		c.emit(summary)
+	}
+
+	return true
+}
+
+// expire summarizes and forgets bursts whose window has passed
+func (c *coalescer) expire(now time.Time) {
+	var summaries []*entry
+
+	c.lock.Lock()
+
+	for sender, states := range c.senders {
+		window := c.windowOf(sender)
+
+		for key, st := range states {
+			if now.Sub(st.first) < window {
+				continue
+			}
+
+			if st.suppressed > 0 {
+				summaries = append(summaries, summaryOf(st))
+			}
+
+			delete(states, key)
+		}
+
+		if len(states) == 0 {
+			delete(c.senders, sender)
+		}
+	}
+
+	c.lock.Unlock()
+
+	for _, e := range summaries {
+		c.emit(e)
+	}
+}
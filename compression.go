@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logit/logg"
+	"strings"
+)
+
+// what -z compresses rotated files with, from -z-codec and -z-level
+var (
+	compressCodecName string
+	compressCodec     logg.Codec
+	compressLevel     int
+)
+
+// parseCompression checks -z-codec and -z-level
+func parseCompression() error {
+	codec, err := logg.ParseCodec(compressCodecName)
+	if err != nil {
+		return err
+	}
+
+	w, err := codec.NewWriter(ioutil.Discard, compressLevel)
+	if err != nil {
+		return err
+	}
+	w.Close()
+
+	compressCodec = codec
+
+	return nil
+}
+
+// levelOf returns the level to compress with codec at: -z-level for the
+// codec of -z-codec, the default for the other
+func levelOf(codec logg.Codec) int {
+	if codec == compressCodec {
+		return compressLevel
+	}
+
+	return 0
+}
+
+// compressFile compresses a rotated file the way sender loggers do
+func compressFile(path string) error {
+	return logg.CompressFileWith(path, compressCodec, compressLevel)
+}
+
+// isCompressed tells whether the name of path says it is compressed or
+// encrypted
+func isCompressed(path string) bool {
+	_, ok := logg.CodecOf(path)
+	return ok || strings.HasSuffix(path, logg.ENCRYPTED_SUFFIX)
+}
+
+// decompressed reads r, the content of the file at path, decrypted and
+// decompressed as the name says
+func decompressed(path string, r io.Reader) (io.ReadCloser, error) {
+	if strings.HasSuffix(path, logg.ENCRYPTED_SUFFIX) {
+		if sealer == nil {
+			return nil, fmt.Errorf("%s is encrypted, and there's no -encrypt-rotated-key", path)
+		}
+
+		var err error
+		if r, err = sealer.open(r); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		path = strings.TrimSuffix(path, logg.ENCRYPTED_SUFFIX)
+	}
+
+	codec, ok := logg.CodecOf(path)
+	if !ok {
+		return ioutil.NopCloser(r), nil
+	}
+
+	return codec.NewReader(r)
+}
+
+// gzipPrefs holds per-sender overrides of the global -z setting, from the
+// command line or from clients passing '?gz=on|off'
+type gzipPrefs struct {
+	senders *senderValues[bool]
+}
+
+// parseSwitch parses the on/off spellings accepted in flags and parameters
+func parseSwitch(s string) (on bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "on", "true", "yes", "1":
+		return true, true
+	case "off", "false", "no", "0":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// newGzipPrefs parses "sender=on|off,..." (e.g. "media=off,backup=off")
+func newGzipPrefs(spec string) (*gzipPrefs, error) {
+	senders, err := parseSenderValues(spec, "gzip", "on|off", func(sender, value string) (bool, error) {
+		on, ok := parseSwitch(value)
+		if !ok {
+			return false, fmt.Errorf("invalid gzip setting '%s' for '%s'", value, sender)
+		}
+		return on, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &gzipPrefs{senders: senders}, nil
+}
+
+func (p *gzipPrefs) enabled(sender string) bool {
+	return p.senders.or(sender, enableGz)
+}
+
+func (p *gzipPrefs) set(sender string, on bool) {
+	p.senders.set(sender, on)
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// top level settings named unlike their flag
+var configAliases = map[string]string{
+	"port":     "p",
+	"dir":      "w",
+	"max_size": "s",
+	"gzip":     "z",
+
+	"compression.codec": "z-codec",
+	"compression.level": "z-level",
+
+	"auth.client":      "auth",
+	"auth.tokens_file": "auth-tokens",
+
+	"admission.allow":     "allow-senders",
+	"admission.deny":      "deny-senders",
+	"admission.catch_all": "catch-all",
+
+	"alerts.url":   "alert-url",
+	"alerts.level": "alert-level",
+	"alerts.batch": "alert-batch",
+	"alerts.rate":  "alert-rate",
+
+	"retention.max_backups":  "max-backups",
+	"retention.max_age_days": "max-age-days",
+	"retention.classes":      "retain-classes",
+}
+
+// flags that do one-off jobs rather than configure the server
+var configExcluded = map[string]bool{"config": true, "merge": true, "events": true}
+
+// configValue is a flag value given by the config file
+type configValue struct {
+	key   string // as written, e.g. 'tls.cert'
+	line  int
+	value string
+}
+
+// senderConfig overrides the defaults for one sender
+type senderConfig struct {
+	line    int
+	file    string // live file template
+	rotated string // rotated file template
+	maxSize int64  // 0 for -s
+
+	maxBackups string // "" for -max-backups
+	maxAgeDays string // "" for -max-age-days
+
+	level     string
+	gzip      string
+	sync      string
+	dedup     string
+	rate      string
+	sample    string
+	repeats   string
+	alert     string
+	redact    string
+	transform string
+	quota     string
+}
+
+var errUnknownSetting = fmt.Errorf("unknown setting")
+
+// set parses and takes one of the sender's settings, by its key in the
+// config file
+func (s *senderConfig) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "file":
+		s.file = value
+	case "rotated_file":
+		s.rotated = value
+	case "max_size":
+		if s.maxSize, err = parseSize(value); err == nil && s.maxSize == 0 {
+			err = fmt.Errorf("max_size can't be 0")
+		}
+	case "max_backups":
+		if n, perr := strconv.Atoi(value); perr != nil || n < 0 {
+			err = fmt.Errorf("invalid count '%s' (expected rotated files kept, 0 keeping all)", value)
+		}
+		s.maxBackups = value
+	case "max_age_days":
+		if n, perr := strconv.Atoi(value); perr != nil || n < 0 {
+			err = fmt.Errorf("invalid age '%s' (expected days rotated files are kept, 0 keeping all)", value)
+		}
+		s.maxAgeDays = value
+	case "level":
+		_, err = parseMinLevel(value)
+		s.level = value
+	case "gzip":
+		if _, ok := parseSwitch(value); !ok {
+			err = fmt.Errorf("invalid gzip setting '%s' (expected on or off)", value)
+		}
+		s.gzip = value
+	case "sync":
+		_, err = parseSyncLevel(value)
+		s.sync = value
+	case "dedup":
+		_, err = parseDedupLimits(value, dedupLimits{})
+		s.dedup = value
+	case "rate":
+		_, err = parseSenderRate(value)
+		s.rate = value
+	case "sample":
+		_, err = parseSampleRate(value)
+		s.sample = value
+	case "repeats":
+		_, err = time.ParseDuration(value)
+		s.repeats = value
+	case "alert":
+		_, err = parseAlertLevel(value)
+		s.alert = value
+	case "redact":
+		_, err = parseRedactRules(value, nil)
+		s.redact = value
+	case "transform":
+		_, err = parseTransforms(value)
+		s.transform = value
+	case "quota":
+		_, err = parseQuota(value)
+		s.quota = value
+	default:
+		err = errUnknownSetting
+	}
+
+	return err
+}
+
+// configFile is what -config loaded: settings of flags, which flags given on
+// the command line override, and what no flag can express
+type configFile struct {
+	path    string
+	flags   map[string]configValue // by flag name
+	senders map[string]*senderConfig
+	tokens  map[string]apiToken // by the token itself
+	given   map[string]bool     // flags of the command line, which win
+}
+
+// parseSize parses sizes like '512', '64k', '16m' or '1g'; -1 means unlimited
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1024
+		case 'm', 'M':
+			unit = 1024 * 1024
+		case 'g', 'G':
+			unit = 1024 * 1024 * 1024
+		}
+	}
+
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < -1 {
+		return 0, fmt.Errorf("invalid size '%s' (expected e.g. '512', '64k', '16m' or '-1')", s)
+	}
+
+	if n == -1 {
+		return -1, nil
+	}
+
+	return n * unit, nil
+}
+
+// loadConfig reads a .yaml, .yml or .toml config file and checks it names
+// known settings with valid values
+func loadConfig(path string) (*configFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *configNode
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		root, err = parseYAMLConfig(string(b))
+	case ".toml":
+		root, err = parseTOMLConfig(string(b))
+	default:
+		return nil, fmt.Errorf("%s: unknown config format (expected .yaml, .yml or .toml)", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+
+	c := &configFile{
+		path:    path,
+		flags:   make(map[string]configValue),
+		senders: make(map[string]*senderConfig),
+		tokens:  make(map[string]apiToken),
+	}
+
+	for _, key := range root.keys {
+		v := root.fields[key]
+
+		switch {
+		case key == "senders":
+			err = c.decodeSenders(v)
+
+		case v.isMap():
+			// a section: 'tls: {cert: ...}' sets -tls-cert
+			for _, sub := range v.keys {
+				if key == "auth" && sub == "tokens" {
+					err = c.decodeTokens(v.fields[sub])
+				} else {
+					err = c.setting(key+"."+sub, v.fields[sub])
+				}
+
+				if err != nil {
+					break
+				}
+			}
+
+		default:
+			err = c.setting(key, v)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *configFile) errorf(line int, format string, v ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", c.path, line, fmt.Sprintf(format, v...))
+}
+
+// scalar returns the value of v, joining a list with commas like the flags
+// take them
+func (c *configFile) scalar(key string, v *configNode) (string, error) {
+	if v.isMap() {
+		return "", c.errorf(v.line, "'%s' takes a value, not a map", key)
+	}
+
+	if !v.isList() {
+		return v.scalar, nil
+	}
+
+	ss := make([]string, 0, len(v.list))
+	for _, item := range v.list {
+		if item.isMap() || item.isList() {
+			return "", c.errorf(item.line, "'%s' takes a list of values", key)
+		}
+		ss = append(ss, item.scalar)
+	}
+
+	return strings.Join(ss, ","), nil
+}
+
+// setting records the value of the flag a key stands for: its alias, or
+// the key with '.' and '_' as '-' ('tls.client_ca' is -tls-client-ca). a
+// section's 'enabled' is the flag named like the section.
+func (c *configFile) setting(key string, v *configNode) error {
+	name, ok := configAliases[key]
+	if !ok {
+		name = strings.TrimSuffix(key, ".enabled")
+		name = strings.NewReplacer(".", "-", "_", "-").Replace(name)
+	}
+
+	f := flag.Lookup(name)
+	if f == nil || configExcluded[name] {
+		return c.errorf(v.line, "unknown setting '%s'", key)
+	}
+
+	value, err := c.scalar(key, v)
+	if err != nil {
+		return err
+	}
+
+	// check the value now, so the error can point at the file
+	if err := newFlagValue(f).Set(value); err != nil {
+		return c.errorf(v.line, "invalid %s '%s': %v", key, value, err)
+	}
+
+	c.flags[name] = configValue{key, v.line, value}
+	return nil
+}
+
+// newFlagValue returns a scratch value of f's type to check values with
+func newFlagValue(f *flag.Flag) flag.Value {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		fs.Bool("v", false, "")
+	case int:
+		fs.Int("v", 0, "")
+	case int64:
+		fs.Int64("v", 0, "")
+	case float64:
+		fs.Float64("v", 0, "")
+	case time.Duration:
+		fs.Duration("v", 0, "")
+	default:
+		fs.String("v", "", "")
+	}
+
+	return fs.Lookup("v").Value
+}
+
+func (c *configFile) decodeSenders(v *configNode) error {
+	if !v.isMap() {
+		return c.errorf(v.line, "'senders' takes a map of sender names")
+	}
+
+	for _, name := range v.keys {
+		sv := v.fields[name]
+		sender := strings.ToLower(name)
+
+		if checkSender(sender) != nil || !sv.isMap() {
+			return c.errorf(sv.line, "expected 'senders.<sender>' with file, rotated_file, max_size, max_backups, max_age_days, level, gzip, sync, dedup, rate, sample, repeats and alert")
+		}
+
+		s := &senderConfig{line: sv.line}
+
+		for _, key := range sv.keys {
+			value, err := c.scalar("senders."+name+"."+key, sv.fields[key])
+			if err != nil {
+				return err
+			}
+
+			line := sv.fields[key].line
+
+			if err = s.set(key, value); err == errUnknownSetting {
+				err = fmt.Errorf("unknown setting 'senders.%s.%s'", name, key)
+			}
+
+			if err != nil {
+				return c.errorf(line, "%v", err)
+			}
+		}
+
+		if s.rotated != "" && s.file == "" {
+			return c.errorf(sv.line, "senders.%s: rotated_file requires file", name)
+		}
+
+		if s.file != "" {
+			rotated := s.rotated
+			if rotated == "" {
+				rotated = DEFAULT_ROTATED_TEMPLATE
+			}
+
+			if _, err := parseSenderTemplates(s.file, rotated); err != nil {
+				return c.errorf(sv.line, "senders.%s: %v", name, err)
+			}
+		}
+
+		c.senders[sender] = s
+	}
+
+	return nil
+}
+
+// decodeTokens reads 'auth.tokens', a list of {token, principal, senders}
+func (c *configFile) decodeTokens(v *configNode) error {
+	if !v.isList() {
+		return c.errorf(v.line, "'auth.tokens' takes a list of {token, principal, senders}")
+	}
+
+	for _, item := range v.list {
+		if !item.isMap() {
+			return c.errorf(item.line, "expected {token, principal, senders} in 'auth.tokens'")
+		}
+
+		var token, principal, scope string
+
+		for _, key := range item.keys {
+			value, err := c.scalar("auth.tokens."+key, item.fields[key])
+			if err != nil {
+				return err
+			}
+
+			switch key {
+			case "token":
+				token = value
+			case "principal":
+				principal = value
+			case "senders":
+				scope = value
+			default:
+				return c.errorf(item.fields[key].line, "unknown setting 'auth.tokens.%s'", key)
+			}
+		}
+
+		if token == "" || principal == "" {
+			return c.errorf(item.line, "a token of 'auth.tokens' needs token and principal")
+		}
+
+		if _, ok := c.tokens[token]; ok {
+			return c.errorf(item.line, "token of '%s' given twice", principal)
+		}
+
+		senders, err := parseTokenSenders(scope, ",")
+		if err != nil {
+			return c.errorf(item.line, "token of '%s': %v", principal, err)
+		}
+
+		c.tokens[token] = apiToken{principal, senders}
+	}
+
+	return nil
+}
+
+// apply sets the flags the command line didn't
+func (c *configFile) apply() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	c.given = given
+
+	names := make([]string, 0, len(c.flags))
+	for name := range c.flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+
+		v := c.flags[name]
+		if err := flag.Set(name, v.value); err != nil {
+			return c.errorf(v.line, "invalid %s '%s': %v", v.key, v.value, err)
+		}
+	}
+
+	return nil
+}
+
+// senderSpec puts the senders' level, gzip, sync, dedup, rate, sample,
+// repeats, alert, redact, transform or quota settings before those of the
+// per-sender flag, which so override them
+func (c *configFile) senderSpec(kind string, flagSpec string) string {
+	if c == nil {
+		return flagSpec
+	}
+
+	var ss []string
+
+	for _, sender := range c.senderNames() {
+		if value := c.senders[sender].setting(kind); value != "" {
+			ss = append(ss, sender+"="+value)
+		}
+	}
+
+	return strings.Join(append(ss, flagSpec), ",")
+}
+
+// setting returns the sender's level, gzip, sync, dedup, rate, sample, repeats,
+// alert, redact, transform or quota setting
+func (s *senderConfig) setting(kind string) string {
+	switch kind {
+	case "level":
+		return s.level
+	case "gzip":
+		return s.gzip
+	case "sync":
+		return s.sync
+	case "dedup":
+		return s.dedup
+	case "rate":
+		return s.rate
+	case "sample":
+		return s.sample
+	case "repeats":
+		return s.repeats
+	case "alert":
+		return s.alert
+	case "redact":
+		return s.redact
+	case "transform":
+		return s.transform
+	case "quota":
+		return s.quota
+	default:
+		return ""
+	}
+}
+
+func (c *configFile) senderNames() []string {
+	names := make([]string, 0, len(c.senders))
+	for sender := range c.senders {
+		names = append(names, sender)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// senderOf returns the settings of a sender, nil if it has none
+func (c *configFile) senderOf(sender string) *senderConfig {
+	if c == nil {
+		return nil
+	}
+
+	return c.senders[sender]
+}
+
+// applyTemplates gives the namer the file names of the config file's
+// senders, unless -file-templates names them
+func (c *configFile) applyTemplates(n *fileNamer) {
+	if c == nil {
+		return
+	}
+
+	for _, sender := range c.senderNames() {
+		s := c.senders[sender]
+		if s.file == "" {
+			continue
+		}
+
+		if _, ok := n.perSender[sender]; ok {
+			continue
+		}
+
+		rotated := s.rotated
+		if rotated == "" {
+			rotated = rotatedTemplate
+		}
+
+		// checked when loaded
+		t, _ := parseSenderTemplates(s.file, rotated)
+		n.perSender[sender] = t
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// configNode is a value of a config file: a scalar, a list or a map. both
+// formats are read into it; only the subset logit's settings need is parsed.
+// parse errors start with the line number ('12: ...').
+type configNode struct {
+	line   int
+	scalar string
+	list   []*configNode // non-nil for lists
+	keys   []string      // of a map, in file order
+	fields map[string]*configNode
+}
+
+func newConfigMap(line int) *configNode {
+	return &configNode{line: line, fields: make(map[string]*configNode)}
+}
+
+func (n *configNode) isMap() bool  { return n.fields != nil }
+func (n *configNode) isList() bool { return n.list != nil }
+
+func (n *configNode) add(key string, v *configNode) error {
+	if _, ok := n.fields[key]; ok {
+		return fmt.Errorf("%d: duplicate key '%s'", v.line, key)
+	}
+
+	n.keys = append(n.keys, key)
+	n.fields[key] = v
+	return nil
+}
+
+// stripComment cuts a '#' comment that isn't inside quotes
+func stripComment(s string) string {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+
+		case c == '"' || c == '\'':
+			quote = c
+
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+// splitFlow splits the items of '[a, "b", c]' at commas outside quotes and
+// brackets, returning the depth left open (0 when balanced)
+func splitFlow(s string) ([]string, int) {
+	var items []string
+	var quote byte
+	depth, start := 0, 0
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+
+		case c == '"' || c == '\'':
+			quote = c
+
+		case c == '[':
+			depth++
+			if depth == 1 {
+				start = i + 1
+			}
+
+		case c == ']':
+			depth--
+			if depth == 0 {
+				items = append(items, s[start:i])
+			}
+
+		case c == ',' && depth == 1:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return items, depth
+}
+
+// parseConfigScalar parses a value written on one line
+func parseConfigScalar(s string, line int) (*configNode, error) {
+	s = strings.TrimSpace(s)
+
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("%d: invalid string %s", line, s)
+		}
+		return &configNode{line: line, scalar: v}, nil
+
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("%d: unterminated string %s", line, s)
+		}
+		return &configNode{line: line, scalar: strings.Replace(s[1:len(s)-1], "''", "'", -1)}, nil
+
+	case strings.HasPrefix(s, "["):
+		items, depth := splitFlow(s)
+		if depth != 0 || !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("%d: unterminated list %s", line, s)
+		}
+
+		n := &configNode{line: line, list: []*configNode{}}
+
+		for i, item := range items {
+			if strings.TrimSpace(item) == "" {
+				if i == len(items)-1 {
+					break // empty list or trailing comma
+				}
+				return nil, fmt.Errorf("%d: empty list item", line)
+			}
+
+			v, err := parseConfigScalar(item, line)
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, v)
+		}
+
+		return n, nil
+
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("%d: inline maps are not supported", line)
+	}
+
+	return &configNode{line: line, scalar: s}, nil
+}
+
+type yamlLine struct {
+	n      int // line number
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+func isYAMLListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits 'key: value' (or 'key:') into key and value
+func splitYAMLKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", false
+		}
+
+		return text[1 : end+1], strings.TrimSpace(text[end+3:]), true
+	}
+
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", false
+		}
+		i = len(text) - 1
+	}
+
+	key := strings.TrimSpace(text[:i])
+	if key == "" || strings.ContainsAny(key, "[]{}\"'") {
+		return "", "", false
+	}
+
+	return key, strings.TrimSpace(text[i+1:]), true
+}
+
+// parseYAMLConfig reads block maps and lists, scalars and '[a, b]' lists;
+// anchors, multi-line strings and inline maps are not supported
+func parseYAMLConfig(data string) (*configNode, error) {
+	p := &yamlParser{}
+
+	for i, raw := range strings.Split(data, "\n") {
+		text := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: tabs can't indent", i+1)
+		}
+
+		p.lines = append(p.lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+
+	if len(p.lines) == 0 {
+		return newConfigMap(1), nil
+	}
+
+	root, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.i < len(p.lines) {
+		return nil, fmt.Errorf("%d: unexpected indentation", p.lines[p.i].n)
+	}
+
+	if !root.isMap() {
+		return nil, fmt.Errorf("%d: expected 'key: value' settings", root.line)
+	}
+
+	return root, nil
+}
+
+func (p *yamlParser) block(indent int) (*configNode, error) {
+	if isYAMLListItem(p.lines[p.i].text) {
+		return p.listBlock(indent)
+	}
+
+	return p.mapBlock(indent)
+}
+
+// nested parses what follows 'key:' or '-' when nothing does on its line
+func (p *yamlParser) nested(indent int, line int) (*configNode, error) {
+	if p.i < len(p.lines) {
+		next := p.lines[p.i]
+
+		// a list may be indented like its key
+		if next.indent > indent || (next.indent == indent && isYAMLListItem(next.text)) {
+			return p.block(next.indent)
+		}
+	}
+
+	return &configNode{line: line}, nil
+}
+
+func (p *yamlParser) mapBlock(indent int) (*configNode, error) {
+	n := newConfigMap(p.lines[p.i].n)
+
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent {
+		l := p.lines[p.i]
+
+		key, rest, ok := splitYAMLKey(l.text)
+		if !ok || isYAMLListItem(l.text) {
+			return nil, fmt.Errorf("%d: expected 'key: value'", l.n)
+		}
+		p.i++
+
+		var v *configNode
+		var err error
+
+		if rest != "" {
+			v, err = parseConfigScalar(rest, l.n)
+		} else {
+			v, err = p.nested(indent, l.n)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		v.line = l.n
+		if err := n.add(key, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+		return nil, fmt.Errorf("%d: unexpected indentation", p.lines[p.i].n)
+	}
+
+	return n, nil
+}
+
+func (p *yamlParser) listBlock(indent int) (*configNode, error) {
+	n := &configNode{line: p.lines[p.i].n, list: []*configNode{}}
+
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLListItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+
+		var v *configNode
+		var err error
+
+		if rest == "" {
+			p.i++
+			v, err = p.nested(indent, l.n)
+		} else if _, _, ok := splitYAMLKey(rest); ok && !strings.HasPrefix(rest, "[") {
+			// '- key: value' starts a map indented past the dash
+			childIndent := indent + len(l.text) - len(rest)
+			p.lines[p.i] = yamlLine{l.n, childIndent, rest}
+			v, err = p.mapBlock(childIndent)
+		} else {
+			p.i++
+			v, err = parseConfigScalar(rest, l.n)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		n.list = append(n.list, v)
+	}
+
+	return n, nil
+}
+
+// splitTOMLKey splits a dotted key, whose parts may be quoted
+func splitTOMLKey(s string, line int) ([]string, error) {
+	var keys []string
+
+	for _, part := range strings.Split(s, ".") {
+		part = strings.TrimSpace(part)
+
+		if strings.HasPrefix(part, `"`) {
+			v, err := strconv.Unquote(part)
+			if err != nil {
+				return nil, fmt.Errorf("%d: invalid key %s", line, part)
+			}
+			part = v
+		} else if strings.HasPrefix(part, "'") && strings.HasSuffix(part, "'") && len(part) > 1 {
+			part = part[1 : len(part)-1]
+		}
+
+		if part == "" {
+			return nil, fmt.Errorf("%d: invalid key '%s'", line, s)
+		}
+
+		keys = append(keys, part)
+	}
+
+	return keys, nil
+}
+
+// tomlTable finds or creates the table at keys below t; a key naming an
+// array of tables means its last table
+func tomlTable(t *configNode, keys []string, line int) (*configNode, error) {
+	for _, key := range keys {
+		child := t.fields[key]
+
+		switch {
+		case child == nil:
+			child = newConfigMap(line)
+			t.add(key, child)
+
+		case child.isList() && len(child.list) > 0 && child.list[len(child.list)-1].isMap():
+			child = child.list[len(child.list)-1]
+
+		case !child.isMap():
+			return nil, fmt.Errorf("%d: '%s' is not a table", line, key)
+		}
+
+		t = child
+	}
+
+	return t, nil
+}
+
+// parseTOMLConfig reads tables, arrays of tables, dotted keys, strings,
+// numbers, booleans and arrays (which may span lines); inline tables and
+// multi-line strings are not supported
+func parseTOMLConfig(data string) (*configNode, error) {
+	root := newConfigMap(1)
+	table := root
+	headers := make(map[string]bool)
+
+	lines := strings.Split(data, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		text := strings.TrimSpace(stripComment(lines[i]))
+
+		switch {
+		case text == "":
+
+		case strings.HasPrefix(text, "[["):
+			if !strings.HasSuffix(text, "]]") {
+				return nil, fmt.Errorf("%d: unterminated table header", n)
+			}
+
+			keys, err := splitTOMLKey(text[2:len(text)-2], n)
+			if err != nil {
+				return nil, err
+			}
+
+			parent, err := tomlTable(root, keys[:len(keys)-1], n)
+			if err != nil {
+				return nil, err
+			}
+
+			key := keys[len(keys)-1]
+			list := parent.fields[key]
+
+			if list == nil {
+				list = &configNode{line: n, list: []*configNode{}}
+				parent.add(key, list)
+			} else if !list.isList() {
+				return nil, fmt.Errorf("%d: '%s' is not an array of tables", n, key)
+			}
+
+			table = newConfigMap(n)
+			list.list = append(list.list, table)
+
+		case strings.HasPrefix(text, "["):
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%d: unterminated table header", n)
+			}
+
+			keys, err := splitTOMLKey(text[1:len(text)-1], n)
+			if err != nil {
+				return nil, err
+			}
+
+			header := strings.Join(keys, ".")
+			if headers[header] {
+				return nil, fmt.Errorf("%d: table [%s] defined twice", n, header)
+			}
+			headers[header] = true
+
+			if table, err = tomlTable(root, keys, n); err != nil {
+				return nil, err
+			}
+
+		default:
+			eq := strings.IndexByte(text, '=')
+			if eq < 0 {
+				return nil, fmt.Errorf("%d: expected 'key = value'", n)
+			}
+
+			keys, err := splitTOMLKey(text[:eq], n)
+			if err != nil {
+				return nil, err
+			}
+
+			value := strings.TrimSpace(text[eq+1:])
+
+			// arrays may span lines
+			for strings.HasPrefix(value, "[") && i+1 < len(lines) {
+				if _, depth := splitFlow(value); depth == 0 {
+					break
+				}
+
+				i++
+				value += " " + strings.TrimSpace(stripComment(lines[i]))
+			}
+
+			parent, err := tomlTable(table, keys[:len(keys)-1], n)
+			if err != nil {
+				return nil, err
+			}
+
+			v, err := parseConfigScalar(value, n)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := parent.add(keys[len(keys)-1], v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return root, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"logit/logg"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEDUP_ID_HEADER    = "Idempotency-Key"
+	DEDUP_ID_MAX       = 128 // longer ids are rejected
+	DEDUP_REDIS_PREFIX = "logit:dedup:"
+	DEDUP_REDIS_WAIT   = time.Second // for a reply from redis
+)
+
+// dedupStore remembers the ids of entries taken, so a retry of one is
+// stored once. check makes the check and the remembering one step, which a
+// store shared by several nodes needs.
+type dedupStore interface {
+	// check remembers id for ttl and tells whether it was already there
+	check(sender, id string, limits dedupLimits) (bool, error)
+	// forget drops an id whose entry couldn't be stored after all
+	forget(sender, id string) error
+}
+
+// dedupLimits bound the ids remembered of a sender: at most size (memory
+// store only) and each for ttl; size 0 turns deduplication off
+type dedupLimits struct {
+	size int
+	ttl  time.Duration
+}
+
+// parseDedupLimits parses 'off', '<size>', '<ttl>' or '<size>/<ttl>',
+// taking what isn't given from def
+func parseDedupLimits(s string, def dedupLimits) (dedupLimits, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return dedupLimits{}, nil
+	}
+
+	l := def
+	size, ttl := s, ""
+
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		size, ttl = s[:i], s[i+1:]
+	} else if _, err := strconv.Atoi(s); err != nil {
+		size, ttl = "", s
+	}
+
+	if size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid dedup setting '%s' (expected e.g. '10000', '1h', '10000/1h' or 'off')", s)
+		}
+		l.size = n
+	}
+
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return l, fmt.Errorf("invalid dedup setting '%s' (expected e.g. '10000', '1h', '10000/1h' or 'off')", s)
+		}
+		l.ttl = d
+	}
+
+	return l, nil
+}
+
+// dedupPolicy holds the limits of every sender
+type dedupPolicy struct {
+	def     dedupLimits
+	senders *senderValues[dedupLimits]
+}
+
+func newDedupPolicy(def dedupLimits, spec string) (*dedupPolicy, error) {
+	senders, err := parseSenderValues(spec, "dedup", "size/ttl", func(sender, value string) (dedupLimits, error) {
+		return parseDedupLimits(value, def)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupPolicy{def: def, senders: senders}, nil
+}
+
+func (p *dedupPolicy) limits(sender string) dedupLimits {
+	return p.senders.or(sender, p.def)
+}
+
+// newDedupStore opens 'memory' or a 'redis://[:password@]host:port[/db]' url
+func newDedupStore(spec string) (dedupStore, error) {
+	if spec == "memory" {
+		return newMemoryDedup(), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid dedup store '%s' (expected 'memory' or 'redis://host:port/db')", spec)
+	}
+
+	d := &redisDedup{addr: u.Host, lock: &sync.Mutex{}}
+
+	if !strings.Contains(u.Host, ":") {
+		d.addr += ":6379"
+	}
+
+	if u.User != nil {
+		d.password, _ = u.User.Password()
+		if d.password == "" {
+			d.password = u.User.Username()
+		}
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if d.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis db '%s'", db)
+		}
+	}
+
+	return d, nil
+}
+
+// memoryDedup keeps the ids of each sender in an LRU list, newest first
+type memoryDedup struct {
+	lock    *sync.Mutex
+	senders map[string]*dedupLRU
+}
+
+type dedupLRU struct {
+	order *list.List // of *dedupId
+	ids   map[string]*list.Element
+}
+
+type dedupId struct {
+	id      string
+	expires time.Time
+}
+
+func newMemoryDedup() *memoryDedup {
+	return &memoryDedup{lock: &sync.Mutex{}, senders: make(map[string]*dedupLRU)}
+}
+
+func (d *memoryDedup) check(sender, id string, limits dedupLimits) (bool, error) {
+	now := time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c := d.senders[sender]
+	if c == nil {
+		c = &dedupLRU{order: list.New(), ids: make(map[string]*list.Element)}
+		d.senders[sender] = c
+	}
+
+	if el, ok := c.ids[id]; ok {
+		if now.Before(el.Value.(*dedupId).expires) {
+			c.order.MoveToFront(el)
+			return true, nil
+		}
+
+		c.order.Remove(el)
+		delete(c.ids, id)
+	}
+
+	c.ids[id] = c.order.PushFront(&dedupId{id, now.Add(limits.ttl)})
+
+	// drop the least recently seen beyond the size, and expired ones at the
+	// back on the way
+	for c.order.Len() > 0 {
+		back := c.order.Back()
+		if c.order.Len() <= limits.size && now.Before(back.Value.(*dedupId).expires) {
+			break
+		}
+
+		c.order.Remove(back)
+		delete(c.ids, back.Value.(*dedupId).id)
+	}
+
+	return false, nil
+}
+
+func (d *memoryDedup) forget(sender, id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if c := d.senders[sender]; c != nil {
+		if el, ok := c.ids[id]; ok {
+			c.order.Remove(el)
+			delete(c.ids, id)
+		}
+	}
+
+	return nil
+}
+
+// redisDedup keeps ids in redis, shared by the nodes behind a load
+// balancer; every id is a key expiring after its ttl, so size doesn't apply
+type redisDedup struct {
+	addr     string
+	password string
+	db       int
+
+	lock *sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (d *redisDedup) check(sender, id string, limits dedupLimits) (bool, error) {
+	ms := strconv.FormatInt(int64(limits.ttl/time.Millisecond), 10)
+
+	reply, err := d.do("SET", DEDUP_REDIS_PREFIX+sender+":"+id, "1", "NX", "PX", ms)
+	if err != nil {
+		return false, err
+	}
+
+	// NX: OK if set, nil if the key was there
+	return reply == nil, nil
+}
+
+func (d *redisDedup) forget(sender, id string) error {
+	_, err := d.do("DEL", DEDUP_REDIS_PREFIX+sender+":"+id)
+	return err
+}
+
+// do sends a command and reads its reply, connecting first if need be; the
+// connection is dropped on any error
+func (d *redisDedup) do(args ...string) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.conn == nil {
+		if err := d.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := d.roundTrip(args...)
+	if err != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+
+	return reply, err
+}
+
+func (d *redisDedup) connect() error {
+	conn, err := net.DialTimeout("tcp", d.addr, DEDUP_REDIS_WAIT)
+	if err != nil {
+		return err
+	}
+
+	d.conn, d.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if d.password != "" {
+		setup = append(setup, []string{"AUTH", d.password})
+	}
+	if d.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(d.db)})
+	}
+
+	for _, args := range setup {
+		if _, err := d.roundTrip(args...); err != nil {
+			conn.Close()
+			d.conn = nil
+			return fmt.Errorf("redis %s: %v", args[0], err)
+		}
+	}
+
+	return nil
+}
+
+func (d *redisDedup) roundTrip(args ...string) (interface{}, error) {
+	d.conn.SetDeadline(time.Now().Add(DEDUP_REDIS_WAIT))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := d.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(d.r)
+}
+
+// readRedisReply reads a RESP reply: a string, int64, nil or []interface{}
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		return string(b[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected redis reply '%s'", line)
+	}
+}
+
+// deduplicator drops entries whose id was taken before
+type deduplicator struct {
+	store  dedupStore
+	policy *dedupPolicy
+	logger *logg.Logger
+
+	errors int64 // atomic, store failures
+	failed int32 // atomic, 1 while the store fails
+}
+
+func (d *deduplicator) stage(e *entry) bool {
+	if e.id == "" {
+		return true
+	}
+
+	limits := d.policy.limits(e.sender)
+	if limits.size == 0 {
+		return true
+	}
+
+	dup, err := d.store.check(e.sender, e.id, limits)
+	if err != nil {
+		// take the entry rather than lose it; the store is down
+		atomic.AddInt64(&d.errors, 1)
+		if atomic.CompareAndSwapInt32(&d.failed, 0, 1) {
+			d.logger.Errorf("dedup store failing, taking entries unchecked: %v", err)
+		}
+		return true
+	}
+
+	if atomic.CompareAndSwapInt32(&d.failed, 1, 0) {
+		d.logger.Infof("dedup store back")
+	}
+
+	return !dup
+}
+
+// forget lets a retry of e in, after its storing failed
+func (d *deduplicator) forget(e *entry) {
+	if d == nil || e.id == "" {
+		return
+	}
+
+	if err := d.store.forget(e.sender, e.id); err != nil {
+		atomic.AddInt64(&d.errors, 1)
+	}
+}
+
+// dedupIdOf checks the id a client gave an entry
+func dedupIdOf(id string) (string, error) {
+	id = strings.TrimSpace(id)
+
+	if len(id) > DEDUP_ID_MAX || strings.ContainsAny(id, " \t\r\n") {
+		return "", fmt.Errorf("invalid entry id (at most %d characters, no spaces)", DEDUP_ID_MAX)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// the Windows errors for a full disk; syscall.ENOSPC is only invented there
+const (
+	ERROR_HANDLE_DISK_FULL syscall.Errno = 39
+	ERROR_DISK_FULL        syscall.Errno = 112
+)
+
+// diskFull reports whether err is a write refused for want of space on the
+// disk
+func diskFull(err error) bool {
+	return errors.Is(err, ERROR_DISK_FULL) || errors.Is(err, ERROR_HANDLE_DISK_FULL) || errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+var startTime = time.Now()
+
+// configHash identifies the configuration (every flag's value) without
+// revealing it, so dumps of instances can be compared
+func configHash() string {
+	h := sha256.New()
+
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value.String())
+	})
+
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// writeDump writes a diagnostic snapshot for post-incident analysis to
+// 'dump-<time>.txt' in the log directory (the temp directory without one)
+// and returns its path. it only reads state, so it works on a wedged
+// instance as long as the caller's goroutine runs.
+func writeDump(sinks map[string]pausable) (string, error) {
+	dir := logFilePath
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	now := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("dump-%s.txt", now.Format("20060102-150405.000")))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	section := func(name string) {
+		fmt.Fprintf(w, "\n== %s\n", name)
+	}
+
+	fmt.Fprintf(w, "logit diagnostic dump at %s\n", now.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "started: %s (up %v)\n", startTime.Format(time.RFC3339), now.Sub(startTime).Round(time.Second))
+	fmt.Fprintf(w, "pid: %d, go: %s, goroutines: %d\n", os.Getpid(), runtime.Version(), runtime.NumGoroutine())
+	fmt.Fprintf(w, "config hash: %s\n", configHash())
+
+	section("queues")
+	n, capacity := logg.QueueLen()
+	fmt.Fprintf(w, "logger queue: %d/%d, processed: %d\n", n, capacity, logg.Processed())
+
+	if shadow != nil {
+		fmt.Fprintf(w, "shadow queue: %d\n", shadow.pending())
+	}
+
+	section("sinks")
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		st := sinks[name].status()
+		fmt.Fprintf(w, "%s: paused=%v draining=%v buffered=%d\n", name, st.Paused, st.Draining, st.Buffered)
+	}
+
+	section("senders")
+	lock.Lock()
+	keys := make([]string, 0, len(loggerPaths))
+	paths := make(map[string]string, len(loggerPaths))
+	for key, path := range loggerPaths {
+		keys = append(keys, key)
+		paths[key] = path
+	}
+	lock.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		size := "-"
+		if fi, err := os.Stat(paths[key]); err == nil {
+			size = fmt.Sprintf("%d", fi.Size())
+		}
+
+		fmt.Fprintf(w, "%s: %s (%s bytes)\n", key, paths[key], size)
+	}
+
+	section("stages")
+	for _, st := range stageStats.snapshot() {
+		b, _ := json.Marshal(st)
+		fmt.Fprintf(w, "%s\n", b)
+	}
+
+	section("memory")
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "heap: %d bytes in use, %d objects; sys: %d bytes; gc runs: %d\n", mem.HeapInuse, mem.HeapObjects, mem.Sys, mem.NumGC)
+
+	section("goroutines")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	return path, f.Sync()
+}
+
+// makeDumpAdminHandler serves POST /admin/dump, answering with the path of
+// the dump written
+func makeDumpAdminHandler(sinks map[string]pausable) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		path, err := writeDump(sinks)
+		if err != nil {
+			serverLogger.Errorf("writing diagnostic dump failed: %v", err)
+			writeError(rw, ERR_INTERNAL, "writing diagnostic dump failed: %v", err)
+			return
+		}
+
+		serverLogger.Infof("diagnostic dump written to %s", path)
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]string{"path": path})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SYNC_HEADER asks, like ?sync=1, for the entries of a request to be on
+// disk before it is answered
+const SYNC_HEADER = "X-Logit-Sync"
+
+// SYNC_WRITE_TIMEOUT is the longest a request waits for an entry to be
+// written and fsynced, so a wedged writer doesn't hold it forever
+const SYNC_WRITE_TIMEOUT = 30 * time.Second
+
+// durabilityPolicy decides from which level on entries of a sender are written
+// synchronously and fsynced before the request is answered
+type durabilityPolicy struct {
+	def     logg.LogLevel
+	senders *senderValues[logg.LogLevel]
+}
+
+// parseSyncLevel parses a level name, or "off" for never
+func parseSyncLevel(s string) (logg.LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	switch s {
+	case "", "off", "none":
+		return 0, nil
+	case "trace", "debug", "info", "warn", "error", "fatal":
+		return logg.LogLevelFrom(s, 0), nil
+	default:
+		return 0, fmt.Errorf("invalid sync level '%s'", s)
+	}
+}
+
+// newDurabilityPolicy takes the default level and "sender=level,..." overrides
+// (e.g. "audit=info,metrics=off")
+func newDurabilityPolicy(level string, spec string) (*durabilityPolicy, error) {
+	def, err := parseSyncLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := parseSenderValues(spec, "sync", "level", forSender(parseSyncLevel))
+	if err != nil {
+		return nil, err
+	}
+
+	return &durabilityPolicy{def: def, senders: senders}, nil
+}
+
+func (p *durabilityPolicy) level(sender string) logg.LogLevel {
+	return p.senders.or(sender, p.def)
+}
+
+// syncRequested tells whether the client asked for the entries of req to be
+// written and fsynced before it is answered, whatever the sender's sync
+// level: for critical entries (e.g. audit events) that must survive a crash
+func syncRequested(req *http.Request) bool {
+	v := req.URL.Query().Get("sync")
+	if v == "" {
+		v = req.Header.Get(SYNC_HEADER)
+	}
+
+	on, _ := strconv.ParseBool(v)
+	return on
+}
+
+// waitSync has e written synchronously if the client of req asked for it,
+// for no longer than req lasts
+func (e *entry) waitSync(req *http.Request) {
+	if e.sync = syncRequested(req); e.sync {
+		e.ctx = req.Context()
+	}
+}
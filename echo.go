@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// entries posted to /echo/<sender>/<level>, and every entry under -dry-run,
+// are parsed and checked like any other but answered rather than stored:
+// nothing is written, rate limited, deduplicated or forwarded, so client
+// teams can try their integration against a live server.
+var dryRun bool
+
+// echoedEntry is an entry as logit made it of a request, before the
+// pipeline stages (redaction, transforms, sampling) run
+type echoedEntry struct {
+	Sender   string                 `json:"sender"`
+	Level    string                 `json:"level"`
+	Msg      string                 `json:"msg"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+	Time     time.Time              `json:"time"` // when it happened, by the client if it said
+	Received time.Time              `json:"received"`
+	Retain   string                 `json:"retain,omitempty"`
+	Id       string                 `json:"id,omitempty"`
+	File     string                 `json:"file,omitempty"` // the live file it would go to
+}
+
+func echoOf(e *entry) echoedEntry {
+	ee := echoedEntry{
+		Sender:   e.sender,
+		Level:    e.level,
+		Msg:      e.msg,
+		Fields:   e.fields,
+		Time:     e.time(),
+		Received: e.received,
+		Retain:   e.retain,
+		Id:       e.id,
+	}
+
+	if _, ok := store.(*fileStorage); ok && namer != nil && logFilePath != "" {
+		if live, err := namer.live(e.sender, e.time()); err == nil {
+			ee.File = areaPath(logFilePath, e.area(), live)
+		}
+	}
+
+	return ee
+}
+
+// writeEcho answers the entry a request made
+func writeEcho(rw http.ResponseWriter, e *entry) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(echoOf(e))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ES_DEFAULT_INDEX = "logit-{sender}-{yyyy.MM.dd}"
+	ES_SENDER        = "sender"
+)
+
+// esDateLayouts map the date tokens of an index pattern, as Kibana and
+// logstash write them, to Go layouts; longest first
+var esDateLayouts = []struct{ token, layout string }{
+	{"yyyy", "2006"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+}
+
+// esIndexer indexes entries with the _bulk API of Elasticsearch (or
+// OpenSearch), into an index named by a pattern of the sender and the
+// entry's day (UTC). entries are indexed with their id, or one made up
+// before the first try, so a retried batch overwrites rather than
+// duplicates what was indexed of it.
+type esIndexer struct {
+	url    string
+	index  []esIndexPart
+	auth   string // Authorization header, if any
+	client *http.Client
+}
+
+// esIndexPart is literal text, the sender, or a Go time layout
+type esIndexPart struct {
+	text   string
+	sender bool
+	layout bool
+}
+
+type esDoc struct {
+	Timestamp string                 `json:"@timestamp"`
+	Sender    string                 `json:"sender"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Retain    string                 `json:"retain,omitempty"`
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func newESIndexer(url, pattern, user, apiKey string) (*esIndexer, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid elasticsearch url '%s' (expected http:// or https://)", url)
+	}
+
+	index, err := parseESIndex(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &esIndexer{
+		url:    strings.TrimRight(url, "/"),
+		index:  index,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: outbound},
+	}
+
+	switch {
+	case apiKey != "":
+		ix.auth = "ApiKey " + apiKey
+	case user != "":
+		if !strings.Contains(user, ":") {
+			return nil, fmt.Errorf("invalid elasticsearch user '%s' (expected user:password)", user)
+		}
+		ix.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(user))
+	}
+
+	return ix, nil
+}
+
+// parseESIndex parses an index pattern like 'logit-{sender}-{yyyy.MM.dd}'
+func parseESIndex(pattern string) ([]esIndexPart, error) {
+	invalid := fmt.Errorf("invalid elasticsearch index '%s' (expected e.g. '%s')", pattern, ES_DEFAULT_INDEX)
+
+	if pattern == "" {
+		return nil, invalid
+	}
+
+	var parts []esIndexPart
+
+	for rest := pattern; rest != ""; {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			parts = append(parts, esIndexPart{text: rest})
+			break
+		}
+
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return nil, invalid
+		}
+
+		if i > 0 {
+			parts = append(parts, esIndexPart{text: rest[:i]})
+		}
+
+		name := rest[i+1 : i+j]
+		rest = rest[i+j+1:]
+
+		if name == ES_SENDER {
+			parts = append(parts, esIndexPart{sender: true})
+			continue
+		}
+
+		layout, ok := esDateLayout(name)
+		if !ok {
+			return nil, invalid
+		}
+
+		parts = append(parts, esIndexPart{text: layout, layout: true})
+	}
+
+	for _, part := range parts {
+		if !part.sender && !part.layout && (part.text != strings.ToLower(part.text) || strings.ContainsAny(part.text, ` "*\<|,>/?#:`)) {
+			return nil, invalid
+		}
+	}
+
+	return parts, nil
+}
+
+// esDateLayout turns 'yyyy.MM.dd' into '2006.01.02'; other than the date
+// tokens only separators may appear
+func esDateLayout(s string) (string, bool) {
+	var b strings.Builder
+
+	if s == "" {
+		return "", false
+	}
+
+next:
+	for s != "" {
+		for _, d := range esDateLayouts {
+			if strings.HasPrefix(s, d.token) {
+				b.WriteString(d.layout)
+				s = s[len(d.token):]
+				continue next
+			}
+		}
+
+		if !strings.ContainsRune(".-_", rune(s[0])) {
+			return "", false
+		}
+
+		b.WriteByte(s[0])
+		s = s[1:]
+	}
+
+	return b.String(), true
+}
+
+func (ix *esIndexer) indexOf(e *sinkEntry) string {
+	var b strings.Builder
+
+	for _, part := range ix.index {
+		switch {
+		case part.sender:
+			b.WriteString(e.Sender)
+		case part.layout:
+			b.WriteString(e.Time.UTC().Format(part.text))
+		default:
+			b.WriteString(part.text)
+		}
+	}
+
+	return b.String()
+}
+
+func (ix *esIndexer) send(batch []*sinkEntry) error {
+	var body bytes.Buffer
+
+	enc := json.NewEncoder(&body)
+
+	for _, e := range batch {
+		if e.Id == "" {
+			e.Id = newEntryId()
+		}
+
+		action := map[string]map[string]string{
+			"index": {"_index": ix.indexOf(e), "_id": e.Id},
+		}
+
+		doc := &esDoc{
+			Timestamp: e.Time.Format(time.RFC3339Nano),
+			Sender:    e.Sender,
+			Level:     e.Level,
+			Message:   e.Msg,
+			Fields:    e.Fields,
+			Retain:    e.Retain,
+		}
+
+		if err := enc.Encode(action); err != nil {
+			return permanentError{err: err}
+		}
+		if err := enc.Encode(doc); err != nil {
+			return permanentError{err: err}
+		}
+	}
+
+	b, err := ix.do("POST", ix.url+"/_bulk", &body)
+	if err != nil {
+		return err
+	}
+
+	var resp esBulkResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return fmt.Errorf("unexpected _bulk answer: %v", err)
+	}
+
+	if !resp.Errors {
+		return nil
+	}
+
+	// items fail one by one; a batch with any worth a retry is sent again
+	// (the ids keep that from duplicating), otherwise the refused are lost
+	rejected, retry := 0, 0
+	var reason json.RawMessage
+
+	for _, item := range resp.Items {
+		for _, r := range item {
+			switch {
+			case r.Status < 300:
+			case r.Status >= 500 || r.Status == http.StatusTooManyRequests:
+				retry++
+			default:
+				rejected++
+				if reason == nil {
+					reason = r.Error
+				}
+			}
+		}
+	}
+
+	if retry > 0 {
+		return fmt.Errorf("elasticsearch failed %d of %d entries, retrying", retry+rejected, len(batch))
+	}
+
+	if rejected > 0 {
+		return permanentError{err: fmt.Errorf("elasticsearch refused %d entries, e.g.: %s", rejected, reason), entries: rejected}
+	}
+
+	return nil
+}
+
+// do makes a request, taking any 2xx answer; 5xx and 429 answers are worth
+// a retry, other refusals are not
+func (ix *esIndexer) do(method, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, permanentError{err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if ix.auth != "" {
+		req.Header.Set("Authorization", ix.auth)
+	}
+
+	resp, err := ix.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode < 300:
+		return b, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%s answers %s", url, resp.Status)
+	default:
+		if len(b) > 512 {
+			b = b[:512]
+		}
+		return nil, permanentError{err: fmt.Errorf("%s refuses entries: %s: %s", url, resp.Status, bytes.TrimSpace(b))}
+	}
+}
+
+func (ix *esIndexer) probe(ctx context.Context) error {
+	req, err := http.NewRequest("GET", ix.url+"/", nil)
+	if err != nil {
+		return err
+	}
+
+	if ix.auth != "" {
+		req.Header.Set("Authorization", ix.auth)
+	}
+
+	resp, err := ix.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answers %s", ix.url, resp.Status)
+	}
+
+	return nil
+}
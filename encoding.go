@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"logit/logg"
+	"net/http"
+	"strings"
+)
+
+// errEncodingUnsupported is returned for a Content-Encoding logit can't undo
+type errEncodingUnsupported string
+
+func (e errEncodingUnsupported) Error() string {
+	return fmt.Sprintf("unsupported content encoding '%s' (expected gzip, deflate or identity)", string(e))
+}
+
+// inflatedReader reads what a compressed body inflates to, failing past
+// limit bytes so a small body can't blow up in memory
+type inflatedReader struct {
+	r     io.Reader // the decompressor
+	body  io.Closer // the request body under it
+	limit int64
+	read  int64
+}
+
+func (ir *inflatedReader) Read(p []byte) (int, error) {
+	if ir.read >= ir.limit {
+		// a body of exactly limit bytes is fine; look for one more
+		var one [1]byte
+		if n, _ := ir.r.Read(one[:]); n > 0 {
+			return 0, &http.MaxBytesError{Limit: ir.limit}
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > ir.limit-ir.read {
+		p = p[:ir.limit-ir.read]
+	}
+
+	n, err := ir.r.Read(p)
+	ir.read += int64(n)
+
+	return n, err
+}
+
+func (ir *inflatedReader) Close() error {
+	if c, ok := ir.r.(io.Closer); ok {
+		c.Close()
+	}
+
+	return ir.body.Close()
+}
+
+// inflateBody replaces the body of a request sent with Content-Encoding gzip
+// or deflate with what it inflates to, at most limit bytes of it; reading
+// past that fails with an *http.MaxBytesError like a body over -max-body
+func inflateBody(req *http.Request, limit int64) error {
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+
+	var (
+		r   io.Reader
+		err error
+	)
+
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(req.Body)
+	case "deflate":
+		// deflate is zlib-wrapped by the spec, but some clients send it raw
+		r, err = newDeflateReader(req.Body)
+	default:
+		return errEncodingUnsupported(encoding)
+	}
+
+	if err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return err
+		}
+		return fmt.Errorf("invalid %s body: %v", encoding, err)
+	}
+
+	req.Body = &inflatedReader{r: r, body: req.Body, limit: limit}
+	req.Header.Del("Content-Encoding")
+	req.ContentLength = -1
+
+	return nil
+}
+
+// newDeflateReader takes zlib data, or raw deflate data if it has no zlib
+// header
+func newDeflateReader(body io.Reader) (io.Reader, error) {
+	var head [2]byte
+	n, err := io.ReadFull(body, head[:])
+	if err != nil && n == 0 {
+		return nil, err
+	}
+
+	r := io.MultiReader(strings.NewReader(string(head[:n])), body)
+
+	// a zlib header is CMF FLG with CM 8 and (CMF*256 + FLG) % 31 == 0
+	if n == 2 && head[0]&0x0f == 8 && (uint(head[0])<<8|uint(head[1]))%31 == 0 {
+		return zlib.NewReader(r)
+	}
+
+	return flate.NewReader(r), nil
+}
+
+// refuseBody answers a request whose body inflateBody didn't take
+func refuseBody(rw http.ResponseWriter, req *http.Request, logger *logg.Logger, err error) {
+	switch e := err.(type) {
+	case errEncodingUnsupported:
+		writeError(rw, ERR_ENCODING_UNSUPPORTED, "%v", err)
+	case *http.MaxBytesError:
+		tooLarge(rw, req, logger, e.Limit)
+	default:
+		logger.Errorf("%v", err)
+		writeError(rw, ERR_BODY_INVALID, "%v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// entryRequest is what the path and query of a request posting an entry
+// say: [/echo]/<sender>[/<level>], and parameters like ?ts= and ?gz=
+type entryRequest struct {
+	sender string // normalized, before aliases
+	level  string // normalized, debug if not given
+	echo   bool   // posted to /echo/, answered rather than stored
+	query  url.Values
+}
+
+// parseEntryRequest parses the escaped path and the raw query of a request
+// posting an entry. parts are unescaped one at a time, so an escaped '/' is
+// part of a name rather than a separator; a trailing '/' is allowed, empty
+// parts and parts after the level are not. a query that doesn't parse is
+// refused rather than read in part. the code of an error is the one to
+// answer it with.
+func parseEntryRequest(escapedPath, rawQuery string) (entryRequest, errorCode, error) {
+	var r entryRequest
+
+	path := escapedPath
+	if strings.HasPrefix(path, "/echo/") {
+		path, r.echo = strings.TrimPrefix(path, "/echo"), true
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return r, ERR_SENDER_INVALID, fmt.Errorf("invalid path '%s'", escapedPath)
+	}
+
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/")
+	if path == "" {
+		return r, ERR_SENDER_INVALID, fmt.Errorf("no sender in path '%s' (expected /<sender>/<level>)", escapedPath)
+	}
+
+	ss := strings.Split(path, "/")
+	if len(ss) > 2 {
+		return r, ERR_SENDER_INVALID, fmt.Errorf("invalid path '%s' (expected /<sender>/<level>)", escapedPath)
+	}
+
+	for _, s := range ss {
+		if s == "" {
+			return r, ERR_SENDER_INVALID, fmt.Errorf("empty part in path '%s' (expected /<sender>/<level>)", escapedPath)
+		}
+	}
+
+	sender, err := senderOfPath(ss[0])
+	if err != nil {
+		return r, ERR_SENDER_INVALID, err
+	}
+	r.sender = sender
+
+	r.level = "debug"
+
+	if len(ss) == 2 {
+		level, err := url.PathUnescape(ss[1])
+		if err != nil {
+			return r, ERR_BODY_INVALID, fmt.Errorf("invalid level '%s'", ss[1])
+		}
+
+		r.level = normalizeLevel(level)
+	}
+
+	if r.query, err = url.ParseQuery(rawQuery); err != nil {
+		return r, ERR_BODY_INVALID, fmt.Errorf("invalid query: %v", err)
+	}
+
+	return r, "", nil
+}
+
+// parseBulkPath returns the sender of the escaped path of a request posting
+// entries in bulk, /bulk/<sender> with a trailing '/' allowed
+func parseBulkPath(escapedPath string) (string, error) {
+	path := strings.TrimSuffix(strings.TrimPrefix(escapedPath, "/bulk/"), "/")
+	if path == "" || strings.Contains(path, "/") {
+		return "", fmt.Errorf("invalid path '%s' (expected /bulk/<sender>)", escapedPath)
+	}
+
+	return senderOfPath(path)
+}
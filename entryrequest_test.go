@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEntryRequest(t *testing.T) {
+	tests := []struct {
+		path, query string
+
+		sender, level string
+		echo          bool
+		code          errorCode // "" if taken
+	}{
+		{path: "/web", sender: "web", level: "debug"},
+		{path: "/web/", sender: "web", level: "debug"},
+		{path: "/web/info", sender: "web", level: "info"},
+		{path: "/web/info/", sender: "web", level: "info"},
+		{path: "/Web/INFO", sender: "web", level: "info"},
+		{path: "/w%65b/%69nfo", sender: "web", level: "info"},
+		{path: "/W%45B/warn", sender: "web", level: "warn"},
+		{path: "/web/nonsense", sender: "web", level: "debug"},
+		{path: "/echo/web/error", sender: "web", level: "error", echo: true},
+		{path: "/echo/echo", sender: "echo", level: "debug", echo: true},
+		{path: "/api.v2_x-y/trace", sender: "api.v2_x-y", level: "trace"},
+		{path: "/web/info", query: "ts=1&gz=0", sender: "web", level: "info"},
+
+		{path: "", code: ERR_SENDER_INVALID},
+		{path: "web", code: ERR_SENDER_INVALID},
+		{path: "/", code: ERR_SENDER_INVALID},
+		{path: "//", code: ERR_SENDER_INVALID},
+		{path: "//info", code: ERR_SENDER_INVALID},
+		{path: "/web//", code: ERR_SENDER_INVALID},
+		{path: "/web//info", code: ERR_SENDER_INVALID},
+		{path: "/web/info/x", code: ERR_SENDER_INVALID},
+		{path: "/echo/", code: ERR_SENDER_INVALID},
+		{path: "/echo", sender: "echo", level: "debug"},
+		{path: "/..", code: ERR_SENDER_INVALID},
+		{path: "/%2e%2e/info", code: ERR_SENDER_INVALID},
+		{path: "/a%2fb/info", code: ERR_SENDER_INVALID},
+		{path: "/a%2Fb", code: ERR_SENDER_INVALID},
+		{path: "/%zz/info", code: ERR_SENDER_INVALID},
+		{path: "/web%00/info", code: ERR_SENDER_INVALID},
+		{path: "/logit/info", code: ERR_SENDER_INVALID},
+		{path: "/" + strings.Repeat("a", SENDER_MAX_LEN+1), code: ERR_SENDER_INVALID},
+		{path: "/web/%zz", code: ERR_BODY_INVALID},
+		{path: "/web/info", query: "ts=%zz", code: ERR_BODY_INVALID},
+		{path: "/web/info", query: "a;b", code: ERR_BODY_INVALID},
+	}
+
+	for _, test := range tests {
+		r, code, err := parseEntryRequest(test.path, test.query)
+
+		if test.code != "" {
+			if err == nil {
+				t.Errorf("%q?%q: taken as %+v, expected %s", test.path, test.query, r, test.code)
+			} else if code != test.code {
+				t.Errorf("%q?%q: refused with %s (%v), expected %s", test.path, test.query, code, err, test.code)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q?%q: refused with %s: %v", test.path, test.query, code, err)
+			continue
+		}
+
+		if r.sender != test.sender || r.level != test.level || r.echo != test.echo {
+			t.Errorf("%q?%q: got sender %q, level %q, echo %v; expected %q, %q, %v", test.path, test.query, r.sender, r.level, r.echo, test.sender, test.level, test.echo)
+		}
+
+		if r.query == nil {
+			t.Errorf("%q?%q: nil query", test.path, test.query)
+		}
+	}
+}
+
+func TestParseEntryRequestQuery(t *testing.T) {
+	r, _, err := parseEntryRequest("/web/info", "ts=2020-01-02T03:04:05Z&gz=0&retain=audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{"ts": "2020-01-02T03:04:05Z", "gz": "0", "retain": "audit"} {
+		if got := r.query.Get(k); got != v {
+			t.Errorf("%s: got %q, expected %q", k, got, v)
+		}
+	}
+}
+
+func TestParseBulkPath(t *testing.T) {
+	tests := []struct {
+		path, sender string // sender "" if refused
+	}{
+		{"/bulk/web", "web"},
+		{"/bulk/web/", "web"},
+		{"/bulk/W%45B", "web"},
+		{"/bulk/", ""},
+		{"/bulk//", ""},
+		{"/bulk//web", ""},
+		{"/bulk/web/info", ""},
+		{"/bulk/%2e%2e", ""},
+		{"/bulk/a%2fb", ""},
+		{"/web", ""},
+	}
+
+	for _, test := range tests {
+		sender, err := parseBulkPath(test.path)
+
+		switch {
+		case test.sender == "" && err == nil:
+			t.Errorf("%q: taken as %q, expected it refused", test.path, sender)
+		case test.sender != "" && err != nil:
+			t.Errorf("%q: refused: %v", test.path, err)
+		case sender != test.sender:
+			t.Errorf("%q: got %q, expected %q", test.path, sender, test.sender)
+		}
+	}
+}
+
+// FuzzParseEntryRequest checks that whatever a request's path and query are,
+// a sender taken is one checkSender takes and a level is a known one
+func FuzzParseEntryRequest(f *testing.F) {
+	for _, seed := range []string{"/web/info", "/echo/web/", "/w%65b/%69nfo", "/%2e%2e/x", "/a%2fb", "//", "/web/info/x", "/web%00"} {
+		f.Add(seed, "ts=1&gz=0")
+	}
+	f.Add("/web", "a;b")
+	f.Add("/web", "%zz")
+
+	f.Fuzz(func(t *testing.T, path, query string) {
+		r, code, err := parseEntryRequest(path, query)
+		if err != nil {
+			if code == "" {
+				t.Fatalf("%q?%q: refused without a code: %v", path, query, err)
+			}
+			return
+		}
+
+		if err := checkSender(r.sender); err != nil {
+			t.Fatalf("%q?%q: took sender %q: %v", path, query, r.sender, err)
+		}
+
+		switch r.level {
+		case "trace", "debug", "info", "warn", "error", "fatal":
+		default:
+			t.Fatalf("%q?%q: took level %q", path, query, r.level)
+		}
+
+		if r.query == nil {
+			t.Fatalf("%q?%q: nil query", path, query)
+		}
+
+		// what is taken is taken again the same from a path made of it
+		again, _, err := parseEntryRequest("/"+r.sender+"/"+r.level, "")
+		if err != nil || again.sender != r.sender || again.level != r.level {
+			t.Fatalf("%q?%q: %+v isn't taken back (%+v, %v)", path, query, r, again, err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// errorCode is a stable, machine-readable reason returned to clients in
+// JSON error bodies; clients should switch on it rather than on the message
+type errorCode string
+
+const (
+	ERR_SENDER_INVALID       errorCode = "SENDER_INVALID"
+	ERR_BODY_INVALID         errorCode = "BODY_INVALID"
+	ERR_BODY_TOO_LARGE       errorCode = "BODY_TOO_LARGE"
+	ERR_ENCODING_UNSUPPORTED errorCode = "ENCODING_UNSUPPORTED"
+	ERR_METHOD_INVALID       errorCode = "METHOD_INVALID"
+	ERR_RATE_LIMITED         errorCode = "RATE_LIMITED"
+	ERR_QUEUE_FULL           errorCode = "QUEUE_FULL"
+	ERR_UNAUTHORIZED         errorCode = "UNAUTHORIZED"
+	ERR_FORBIDDEN            errorCode = "FORBIDDEN"
+	ERR_STORAGE_FULL         errorCode = "STORAGE_FULL"
+	ERR_QUOTA_EXCEEDED       errorCode = "QUOTA_EXCEEDED"
+	ERR_INTERNAL             errorCode = "INTERNAL"
+)
+
+type errorBody struct {
+	Code      errorCode `json:"code"`
+	Message   string    `json:"message"`
+	Retryable bool      `json:"retryable"`
+}
+
+func (code errorCode) status() int {
+	switch code {
+	case ERR_SENDER_INVALID, ERR_BODY_INVALID:
+		return http.StatusBadRequest
+	case ERR_BODY_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge
+	case ERR_ENCODING_UNSUPPORTED:
+		return http.StatusUnsupportedMediaType
+	case ERR_METHOD_INVALID:
+		return http.StatusMethodNotAllowed
+	case ERR_RATE_LIMITED, ERR_QUOTA_EXCEEDED:
+		return http.StatusTooManyRequests
+	case ERR_QUEUE_FULL:
+		return http.StatusServiceUnavailable
+	case ERR_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case ERR_FORBIDDEN:
+		return http.StatusForbidden
+	case ERR_STORAGE_FULL:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// blankResponse drops the status and body a handler answers with, leaving
+// the blank 200 logit answered every entry with before error codes; failures
+// are still logged by the server
+type blankResponse struct {
+	http.ResponseWriter
+}
+
+func (b blankResponse) WriteHeader(status int) {
+	b.Header().Del("Content-Type")
+}
+
+func (b blankResponse) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// retryable reports whether resending the same request later may succeed
+func (code errorCode) retryable() bool {
+	switch code {
+	case ERR_RATE_LIMITED, ERR_QUEUE_FULL, ERR_STORAGE_FULL, ERR_QUOTA_EXCEEDED, ERR_INTERNAL:
+		return true
+	default:
+		return false
+	}
+}
+
+// storeError is the code of an entry the storage failed to write: a full
+// disk or quota is worth telling apart, as clients may back off longer
+func storeError(err error) errorCode {
+	if diskFull(err) {
+		return ERR_STORAGE_FULL
+	}
+
+	return ERR_INTERNAL
+}
+
+func writeError(rw http.ResponseWriter, code errorCode, format string, v ...interface{}) {
+	body := errorBody{
+		Code:      code,
+		Message:   fmt.Sprintf(format, v...),
+		Retryable: code.retryable(),
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code.status())
+	json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+)
+
+func TestStoreError(t *testing.T) {
+	full := &fs.PathError{Op: "write", Path: "web.log", Err: syscall.ENOSPC}
+
+	tests := []struct {
+		err  error
+		code errorCode
+	}{
+		{full, ERR_STORAGE_FULL},
+		{fmt.Errorf("appending: %w", full), ERR_STORAGE_FULL},
+		{&fs.PathError{Op: "write", Path: "web.log", Err: syscall.EIO}, ERR_INTERNAL},
+		{errors.New("closed"), ERR_INTERNAL},
+	}
+
+	for _, test := range tests {
+		if code := storeError(test.err); code != test.code {
+			t.Errorf("%q: got %s, expected %s", test.err, code, test.code)
+		}
+	}
+
+	if ERR_STORAGE_FULL.status() != 507 || !ERR_STORAGE_FULL.retryable() {
+		t.Errorf("%s: got %d, retryable %v", ERR_STORAGE_FULL, ERR_STORAGE_FULL.status(), ERR_STORAGE_FULL.retryable())
+	}
+}
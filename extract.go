@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// base grok patterns; a pattern may refer to others with %{NAME}
+var grokPatterns = map[string]string{
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d*)?|\.\d+)`,
+	"BASE16NUM":         `(?:0[xX])?[0-9A-Fa-f]+`,
+	"IPV4":              `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IPV6":              `[0-9A-Fa-f:]*:[0-9A-Fa-f:.]+`,
+	"IP":                `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z\-_.]*\b`,
+	"URIPATH":           `/[^\s?#]*`,
+	"URIPARAM":          `\?[^\s#]*`,
+	"URIPATHPARAM":      `%{URIPATH}(?:%{URIPARAM})?`,
+	"QS":                `"(?:[^"\\]|\\.)*"`,
+	"HTTPMETHOD":        `\b(?:GET|HEAD|POST|PUT|DELETE|PATCH|OPTIONS|CONNECT|TRACE)\b`,
+	"DURATION":          `[+-]?(?:\d+(?:\.\d*)?(?:ns|us|µs|ms|s|m|h))+`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|severe|emerg(?:ency)?)`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::\d{2}(?:\.\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?`,
+}
+
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::(int|float))?\}`)
+
+type extractor struct {
+	re    *regexp.Regexp
+	types map[string]string // capture name -> "int" | "float"
+}
+
+// compileGrok expands %{PATTERN:field:type} references into a regexp with
+// named captures
+func compileGrok(pattern string) (*extractor, error) {
+	types := make(map[string]string)
+
+	var expand func(s string, depth int) (string, error)
+	expand = func(s string, depth int) (string, error) {
+		if depth > 10 {
+			return "", fmt.Errorf("grok pattern nests too deeply: %s", pattern)
+		}
+
+		var err error
+
+		out := grokRef.ReplaceAllStringFunc(s, func(ref string) string {
+			m := grokRef.FindStringSubmatch(ref)
+			name, field, typ := m[1], m[2], m[3]
+
+			base, ok := grokPatterns[name]
+			if !ok {
+				err = fmt.Errorf("unknown grok pattern '%s'", name)
+				return ref
+			}
+
+			sub, e := expand(base, depth+1)
+			if e != nil {
+				err = e
+				return ref
+			}
+
+			if field == "" {
+				return "(?:" + sub + ")"
+			}
+
+			if typ != "" {
+				types[field] = typ
+			}
+
+			return "(?P<" + field + ">" + sub + ")"
+		})
+
+		return out, err
+	}
+
+	expanded, err := expand(pattern, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+	}
+
+	return &extractor{re, types}, nil
+}
+
+// extract promotes the named captures of the first matching pattern
+func (x *extractor) extract(e *entry) bool {
+	m := x.re.FindStringSubmatch(e.msg)
+	if m == nil {
+		return false
+	}
+
+	for i, name := range x.re.SubexpNames() {
+		if name == "" || m[i] == "" {
+			continue
+		}
+
+		if e.fields == nil {
+			e.fields = make(map[string]interface{})
+		}
+
+		var v interface{} = m[i]
+
+		switch x.types[name] {
+		case "int":
+			if n, err := strconv.ParseInt(m[i], 10, 64); err == nil {
+				v = n
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(m[i], 64); err == nil {
+				v = f
+			}
+		}
+
+		e.fields[name] = v
+	}
+
+	return true
+}
+
+// loadExtractors reads a patterns file where each non-empty line is
+// '<sender|*> <pattern>'. plain regexps with (?P<name>...) work as well as
+// grok references.
+func loadExtractors(path string) (map[string][]*extractor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	extractors := make(map[string][]*extractor)
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno += 1
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected '<sender> <pattern>'", path, lineno)
+		}
+
+		x, err := compileGrok(strings.TrimSpace(ss[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+
+		sender := strings.ToLower(ss[0])
+		extractors[sender] = append(extractors[sender], x)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return extractors, nil
+}
+
+// newExtractStage returns a pipeline stage trying the sender's patterns,
+// then the '*' patterns; entries that match nothing pass through unchanged
+func newExtractStage(extractors map[string][]*extractor) stage {
+	return func(e *entry) bool {
+		for _, x := range extractors[e.sender] {
+			if x.extract(e) {
+				return true
+			}
+		}
+
+		for _, x := range extractors["*"] {
+			if x.extract(e) {
+				return true
+			}
+		}
+
+		return true
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ENCRYPTED_FIELD_PREFIX    = "enc:v1:" // unversioned keys, still read
+	ENCRYPTED_FIELD_PREFIX_V2 = "enc:v2:" // followed by '<key id>:'
+	DEFAULT_TENANT_KEY        = "default"
+)
+
+// encryptedValue matches the encrypted values in a stored line, whatever its
+// format; key ids are '<tenant>.<version>' and the rest is base64
+var encryptedValue = regexp.MustCompile(`enc:v1:[A-Za-z0-9+/=]+|enc:v2:[^:"\\\s]+:[A-Za-z0-9+/=]+`)
+
+// keyring holds the key versions of one key owner (a tenant or default).
+// '<owner>.key' is version 0, '<owner>.<N>.key' version N, with the owner
+// escaped by keyFileOwner; the highest version encrypts, all of them decrypt.
+type keyring struct {
+	current  int
+	versions map[int]cipher.AEAD
+}
+
+// fieldEncryptor encrypts configured JSON field paths (e.g. "user.email") of
+// structured entries with AES-256-GCM before they are stored or forwarded.
+// keys are looked up per tenant in keyDir, falling back to the default keys
+// unless autoKeys gives every tenant a key of its own. encrypted values carry
+// the id of their key, so rotating a key leaves history readable.
+type fieldEncryptor struct {
+	paths    [][]string
+	keyDir   string
+	autoKeys bool
+
+	lock  *sync.Mutex
+	rings map[string]*keyring // by owner; nil when the owner has no keys
+}
+
+func newFieldEncryptor(fields string, keyDir string, autoKeys bool) (*fieldEncryptor, error) {
+	e := &fieldEncryptor{
+		keyDir:   keyDir,
+		autoKeys: autoKeys,
+		lock:     &sync.Mutex{},
+		rings:    make(map[string]*keyring),
+	}
+
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		e.paths = append(e.paths, strings.Split(field, "."))
+	}
+
+	// the default key must exist; tenant keys are optional
+	e.lock.Lock()
+	ring, err := e.ringOf(DEFAULT_TENANT_KEY)
+	e.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ring == nil {
+		return nil, fmt.Errorf("no default key in '%s'", keyDir)
+	}
+
+	return e, nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKey(string(b), fmt.Sprintf("key file '%s'", path))
+}
+
+// parseKey decodes a hex or base64 encoded 32 byte key; source names where
+// it came from in errors
+func parseKey(s, source string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be hex or base64 encoded", source)
+		}
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold a 32 byte key (got %d bytes)", source, len(key))
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// keyFileOwner is owner as key file names hold it: bytes other than a-z,
+// 0-9, '-' and '_' are escaped as %xx, so that the '.' of sender 'web.1'
+// can't make its keys those of 'web', version 1
+func keyFileOwner(owner string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(owner); i++ {
+		c := owner[i]
+
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02x", c)
+		}
+	}
+
+	return b.String()
+}
+
+// keyFileName is the name of the key file of version of owner
+func keyFileName(owner string, version int) string {
+	if version == 0 {
+		return keyFileOwner(owner) + ".key"
+	}
+
+	return fmt.Sprintf("%s.%d.key", keyFileOwner(owner), version)
+}
+
+// ringOf loads the keys of owner on first use. e.lock must be held.
+func (e *fieldEncryptor) ringOf(owner string) (*keyring, error) {
+	if ring, ok := e.rings[owner]; ok {
+		return ring, nil
+	}
+
+	files, err := ioutil.ReadDir(e.keyDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	prefix := keyFileOwner(owner) + "."
+	ring := &keyring{current: -1, versions: make(map[int]cipher.AEAD)}
+
+	for _, fi := range files {
+		rest := strings.TrimPrefix(fi.Name(), prefix)
+		if rest == fi.Name() || fi.IsDir() || !strings.HasSuffix(rest, "key") {
+			continue
+		}
+
+		version := 0
+
+		if rest != "key" {
+			var verr error
+
+			// '<owner>.<N>.key'; escaped owners hold no dots of their own
+			version, verr = strconv.Atoi(strings.TrimSuffix(rest, ".key"))
+			if verr != nil || version <= 0 || rest != strconv.Itoa(version)+".key" {
+				continue
+			}
+		}
+
+		key, err := readKeyFile(filepath.Join(e.keyDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		ring.versions[version] = aead
+		if version > ring.current {
+			ring.current = version
+		}
+	}
+
+	if len(ring.versions) == 0 {
+		ring = nil
+	}
+
+	e.rings[owner] = ring
+	return ring, nil
+}
+
+// addKey writes a fresh key as the next version of owner. e.lock must be held.
+func (e *fieldEncryptor) addKey(owner string) (int, error) {
+	ring, err := e.ringOf(owner)
+	if err != nil {
+		return 0, err
+	}
+
+	if ring == nil {
+		ring = &keyring{current: 0, versions: make(map[int]cipher.AEAD)}
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+
+	version := ring.current + 1
+	path := filepath.Join(e.keyDir, keyFileName(owner, version))
+
+	// O_EXCL: a key file is never overwritten
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = fmt.Fprintln(f, hex.EncodeToString(key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+
+	ring.versions[version] = aead
+	ring.current = version
+	e.rings[owner] = ring
+
+	return version, nil
+}
+
+func keyId(owner string, version int) string {
+	return fmt.Sprintf("%s.%d", owner, version)
+}
+
+// currentKey returns the key encrypting the fields of tenant and its id
+func (e *fieldEncryptor) currentKey(tenant string) (string, cipher.AEAD, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	owner := tenant
+
+	ring, err := e.ringOf(owner)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if ring == nil && e.autoKeys && tenant != DEFAULT_TENANT_KEY {
+		if _, err := e.addKey(owner); err != nil {
+			return "", nil, fmt.Errorf("creating a key for tenant '%s' failed: %v", tenant, err)
+		}
+
+		ring = e.rings[owner]
+	}
+
+	if ring == nil {
+		owner = DEFAULT_TENANT_KEY
+
+		if ring, err = e.ringOf(owner); err != nil {
+			return "", nil, err
+		}
+
+		if ring == nil {
+			return "", nil, fmt.Errorf("no key for tenant '%s'", tenant)
+		}
+	}
+
+	return keyId(owner, ring.current), ring.versions[ring.current], nil
+}
+
+// keyById returns the key of an id from an encrypted value
+func (e *fieldEncryptor) keyById(id string) (cipher.AEAD, error) {
+	i := strings.LastIndex(id, ".")
+	if i < 0 {
+		return nil, fmt.Errorf("malformed key id '%s'", id)
+	}
+
+	version, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed key id '%s'", id)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	ring, err := e.ringOf(id[:i])
+	if err != nil {
+		return nil, err
+	}
+
+	if ring == nil || ring.versions[version] == nil {
+		return nil, fmt.Errorf("unknown key '%s'", id)
+	}
+
+	return ring.versions[version], nil
+}
+
+// legacyKey returns the key of values written before keys had versions: the
+// tenant's unversioned key, else the default one
+func (e *fieldEncryptor) legacyKey(tenant string) (cipher.AEAD, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, owner := range []string{tenant, DEFAULT_TENANT_KEY} {
+		ring, err := e.ringOf(owner)
+		if err != nil {
+			return nil, err
+		}
+
+		if ring != nil && ring.versions[0] != nil {
+			return ring.versions[0], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no unversioned key for tenant '%s'", tenant)
+}
+
+// seal encrypts plain with the current key of tenant
+func (e *fieldEncryptor) seal(tenant string, plain []byte) (string, error) {
+	id, aead, err := e.currentKey(tenant)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plain, []byte(tenant))
+
+	return ENCRYPTED_FIELD_PREFIX_V2 + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value made by seal (or by the unversioned scheme); the
+// returned id is empty for unversioned values
+func (e *fieldEncryptor) open(tenant string, s string) ([]byte, string, error) {
+	var aead cipher.AEAD
+	var id, data string
+	var err error
+
+	switch {
+	case strings.HasPrefix(s, ENCRYPTED_FIELD_PREFIX_V2):
+		rest := s[len(ENCRYPTED_FIELD_PREFIX_V2):]
+
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			return nil, "", fmt.Errorf("missing key id")
+		}
+
+		id, data = rest[:i], rest[i+1:]
+		aead, err = e.keyById(id)
+
+	case strings.HasPrefix(s, ENCRYPTED_FIELD_PREFIX):
+		data = s[len(ENCRYPTED_FIELD_PREFIX):]
+		aead, err = e.legacyKey(tenant)
+
+	default:
+		return nil, "", fmt.Errorf("not an encrypted value")
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, "", fmt.Errorf("malformed value")
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(tenant))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return plain, id, nil
+}
+
+// encrypt replaces the configured fields of a JSON object body with
+// encrypted values. bodies that are not JSON objects are returned untouched.
+func (e *fieldEncryptor) encrypt(tenant string, body []byte) ([]byte, error) {
+	var obj map[string]interface{}
+
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body, nil
+	}
+
+	changed := false
+
+	for _, path := range e.paths {
+		parent, key, ok := lookupField(obj, path)
+		if !ok {
+			continue
+		}
+
+		plain, err := json.Marshal(parent[key])
+		if err != nil {
+			return nil, err
+		}
+
+		if parent[key], err = e.seal(tenant, plain); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return body, nil
+	}
+
+	return json.Marshal(obj)
+}
+
+// decrypt reverses encrypt for a stored JSON object line
+func (e *fieldEncryptor) decrypt(tenant string, body []byte) ([]byte, error) {
+	var obj map[string]interface{}
+
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body, nil
+	}
+
+	changed := false
+
+	for _, path := range e.paths {
+		parent, key, ok := lookupField(obj, path)
+		if !ok {
+			continue
+		}
+
+		s, ok := parent[key].(string)
+		if !ok || !strings.HasPrefix(s, "enc:") {
+			continue
+		}
+
+		plain, _, err := e.open(tenant, s)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting field '%s' failed: %v", strings.Join(path, "."), err)
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(plain, &v); err != nil {
+			return nil, err
+		}
+
+		parent[key] = v
+		changed = true
+	}
+
+	if !changed {
+		return body, nil
+	}
+
+	return json.Marshal(obj)
+}
+
+// rotateKey gives tenant a new current key; values encrypted before keep
+// their key until they are re-keyed
+func (e *fieldEncryptor) rotateKey(tenant string) (string, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	version, err := e.addKey(tenant)
+	if err != nil {
+		return "", err
+	}
+
+	return keyId(tenant, version), nil
+}
+
+// rekeyLine re-encrypts the values of a stored line that are not under the
+// current key of tenant
+func (e *fieldEncryptor) rekeyLine(tenant string, line string) (string, int, error) {
+	current, _, err := e.currentKey(tenant)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n := 0
+	var failed error
+
+	line = encryptedValue.ReplaceAllStringFunc(line, func(s string) string {
+		if failed != nil {
+			return s
+		}
+
+		plain, id, err := e.open(tenant, s)
+		if err != nil {
+			failed = err
+			return s
+		}
+
+		if id == current {
+			return s
+		}
+
+		sealed, err := e.seal(tenant, plain)
+		if err != nil {
+			failed = err
+			return s
+		}
+
+		n++
+		return sealed
+	})
+
+	return line, n, failed
+}
+
+// lookupField walks a dotted path and returns the map holding the last key
+func lookupField(obj map[string]interface{}, path []string) (map[string]interface{}, string, bool) {
+	cur := obj
+
+	for i, key := range path {
+		v, ok := cur[key]
+		if !ok {
+			return nil, "", false
+		}
+
+		if i == len(path)-1 {
+			return cur, key, true
+		}
+
+		next, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+
+		cur = next
+	}
+
+	return nil, "", false
+}
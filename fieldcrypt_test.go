@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestKey(t *testing.T, dir, name string, b byte) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(hex.EncodeToString(bytes.Repeat([]byte{b}, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the keys of 'web' and of 'web.1' are told apart, whichever is made first
+func TestFieldEncryptorDottedTenants(t *testing.T) {
+	for _, autoKeys := range []bool{false, true} {
+		dir := t.TempDir()
+		writeTestKey(t, dir, "default.key", 1)
+		writeTestKey(t, dir, "web.key", 2)
+		writeTestKey(t, dir, "web.1.key", 3)
+
+		e, err := newFieldEncryptor("secret", dir, autoKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id, _, err := e.currentKey("web"); err != nil || id != "web.1" {
+			t.Errorf("auto keys %v: web encrypts with %s (%v), expected web.1", autoKeys, id, err)
+		}
+
+		// web.1.key is version 1 of web, never a key of web.1
+		expected := "default.0"
+		if autoKeys {
+			expected = "web.1.1"
+		}
+
+		if id, _, err := e.currentKey("web.1"); err != nil || id != expected {
+			t.Errorf("auto keys %v: web.1 encrypts with %s (%v), expected %s", autoKeys, id, err, expected)
+		}
+
+		if _, err := e.legacyKey("web.1"); err != nil {
+			t.Errorf("auto keys %v: %v", autoKeys, err)
+		}
+
+		for _, tenant := range []string{"web", "web.1"} {
+			plain := []byte(`{"secret":"of ` + tenant + `"}`)
+
+			b, err := e.encrypt(tenant, plain)
+			if err != nil || bytes.Contains(b, []byte("of "+tenant)) {
+				t.Fatalf("auto keys %v: %s encrypted as %s (%v)", autoKeys, tenant, b, err)
+			}
+
+			if back, err := e.decrypt(tenant, b); err != nil || !bytes.Equal(back, plain) {
+				t.Errorf("auto keys %v: %s decrypted as %s (%v)", autoKeys, tenant, back, err)
+			}
+		}
+	}
+}
+
+// rotating the key of 'web.1' leaves those of 'web' as they are, on disk
+// and once loaded again
+func TestFieldEncryptorRotateDotted(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "default.key", 1)
+	writeTestKey(t, dir, "web.key", 2)
+
+	e, err := newFieldEncryptor("secret", dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"web.1.1", "web.1.2"} {
+		if id, err := e.rotateKey("web.1"); err != nil || id != expected {
+			t.Errorf("rotated web.1 to %s (%v), expected %s", id, err, expected)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "web%2e1.2.key")); err != nil {
+		t.Error(err)
+	}
+
+	reloaded, err := newFieldEncryptor("secret", dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _, err := reloaded.currentKey("web"); err != nil || id != "web.0" {
+		t.Errorf("web encrypts with %s (%v), expected web.0", id, err)
+	}
+
+	if id, _, err := reloaded.currentKey("web.1"); err != nil || id != "web.1.2" {
+		t.Errorf("web.1 encrypts with %s (%v), expected web.1.2", id, err)
+	}
+}
+
+func TestKeyFileName(t *testing.T) {
+	tests := []struct {
+		owner   string
+		version int
+
+		name string
+	}{
+		{"default", 0, "default.key"},
+		{"web", 3, "web.3.key"},
+		{"web.1", 0, "web%2e1.key"},
+		{"web.1", 1, "web%2e1.1.key"},
+		{"a-b_c", 2, "a-b_c.2.key"},
+		{"../x", 0, "%2e%2e%2fx.key"},
+	}
+
+	for _, test := range tests {
+		if name := keyFileName(test.owner, test.version); name != test.name {
+			t.Errorf("%q %d: got %s, expected %s", test.owner, test.version, name, test.name)
+		}
+	}
+}
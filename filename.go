@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DEFAULT_FILE_TEMPLATE    = "{{.Sender}}.log"
+	DEFAULT_ROTATED_TEMPLATE = "{{.Live}}.{{.N}}"
+
+	// of {{.Time}}; sorting names sorts by time
+	ROTATED_TIME_LAYOUT = "2006-01-02T15-04-05"
+)
+
+type fileNameData struct {
+	Sender string
+	Host   string
+	Date   string // 2006-01-02
+	Live   string // live file name, for rotated templates
+	N      int    // rotation index, for rotated templates
+	Time   string // rotation time, for rotated templates
+}
+
+type senderTemplates struct {
+	live    *template.Template
+	rotated *template.Template
+	dated   bool // live name changes with the date
+	timed   bool // rotated names tell the time of the rotation
+}
+
+// fileNamer renders live and rotated file names of a sender from go
+// templates, with optional per-sender overrides
+type fileNamer struct {
+	dir       string
+	host      string
+	def       *senderTemplates
+	lock      *sync.RWMutex // of perSender and overrides
+	perSender map[string]*senderTemplates
+	overrides map[string]*senderTemplates // by the admin API, over perSender
+}
+
+func parseSenderTemplates(live, rotated string) (*senderTemplates, error) {
+	lt, err := template.New("live").Option("missingkey=error").Parse(live)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file template '%s': %v", live, err)
+	}
+
+	rt, err := template.New("rotated").Option("missingkey=error").Parse(rotated)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotated file template '%s': %v", rotated, err)
+	}
+
+	return &senderTemplates{lt, rt, strings.Contains(live, ".Date"), strings.Contains(rotated, ".Time")}, nil
+}
+
+// newFileNamer builds a namer from the default templates and an optional
+// overrides file with '<sender> <live template> [<rotated template>]' lines
+// (templates are whitespace separated, so they may not contain spaces)
+func newFileNamer(dir, live, rotated, overrides string) (*fileNamer, error) {
+	host, _ := os.Hostname()
+
+	def, err := parseSenderTemplates(live, rotated)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &fileNamer{
+		dir:       dir,
+		host:      host,
+		def:       def,
+		lock:      &sync.RWMutex{},
+		perSender: make(map[string]*senderTemplates),
+		overrides: make(map[string]*senderTemplates),
+	}
+
+	if overrides == "" {
+		return n, nil
+	}
+
+	f, err := os.Open(overrides)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno += 1
+
+		ss := strings.Fields(scanner.Text())
+		if len(ss) == 0 || strings.HasPrefix(ss[0], "#") {
+			continue
+		}
+
+		if len(ss) < 2 || len(ss) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected '<sender> <template> [<rotated template>]'", overrides, lineno)
+		}
+
+		senderRotated := rotated
+		if len(ss) == 3 {
+			senderRotated = ss[2]
+		}
+
+		t, err := parseSenderTemplates(ss[1], senderRotated)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", overrides, lineno, err)
+		}
+
+		n.perSender[strings.ToLower(ss[0])] = t
+	}
+
+	return n, scanner.Err()
+}
+
+func (n *fileNamer) templatesOf(sender string) *senderTemplates {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if t, ok := n.overrides[sender]; ok {
+		return t
+	}
+
+	if t, ok := n.perSender[sender]; ok {
+		return t
+	}
+
+	return n.def
+}
+
+// override has the sender's files named by t, whatever the config says;
+// nil drops the override
+func (n *fileNamer) override(sender string, t *senderTemplates) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if t == nil {
+		delete(n.overrides, sender)
+	} else {
+		n.overrides[sender] = t
+	}
+}
+
+// update takes the per-sender templates of next, e.g. of a reloaded config,
+// keeping the overrides; open files keep their names until they are
+// reopened
+func (n *fileNamer) update(next *fileNamer) {
+	n.lock.Lock()
+	n.perSender = next.perSender
+	n.lock.Unlock()
+}
+
+func (n *fileNamer) render(t *template.Template, data fileNameData) (string, error) {
+	var buf bytes.Buffer
+
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	name := buf.String()
+
+	// names are relative to the log directory and must stay inside it
+	if name == "" || filepath.IsAbs(name) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("file name '%s' escapes the log directory", name)
+	}
+
+	return filepath.Join(n.dir, name), nil
+}
+
+// live returns the path a sender currently writes to
+func (n *fileNamer) live(sender string, t time.Time) (string, error) {
+	return n.render(n.templatesOf(sender).live, fileNameData{
+		Sender: sender,
+		Host:   n.host,
+		Date:   t.Format("2006-01-02"),
+	})
+}
+
+// dated reports whether a sender's live name must be re-evaluated over time
+func (n *fileNamer) dated(sender string) bool {
+	return n.templatesOf(sender).dated
+}
+
+// rotatedNameFunc returns the function logg uses to name the rotated files of
+// livePath opened at t; the date stays fixed so the rotation chain of one
+// live file keeps consistent names
+func (n *fileNamer) rotatedNameFunc(sender, livePath string, t time.Time) func(i int) string {
+	rt := n.templatesOf(sender).rotated
+	date := t.Format("2006-01-02")
+
+	live, err := filepath.Rel(n.dir, livePath)
+	if err != nil {
+		live = filepath.Base(livePath)
+	}
+
+	return func(i int) string {
+		path, err := n.render(rt, fileNameData{
+			Sender: sender,
+			Host:   n.host,
+			Date:   date,
+			Live:   live,
+			N:      i,
+			Time:   t.Format(ROTATED_TIME_LAYOUT),
+		})
+		if err != nil {
+			// fall back to the classic numbering rather than losing data
+			return fmt.Sprintf("%s.%d", livePath, i)
+		}
+
+		return path
+	}
+}
+
+// rotatedTimeFunc returns, for a rotated template with {{.Time}}, the
+// function naming the file of livePath rotated at a time and a glob of
+// all of them; nil if the sender's files are numbered
+func (n *fileNamer) rotatedTimeFunc(sender, livePath string, t time.Time) (func(at time.Time) string, string) {
+	tmpl := n.templatesOf(sender)
+	if !tmpl.timed {
+		return nil, ""
+	}
+
+	rt := tmpl.rotated
+	date := t.Format("2006-01-02")
+
+	live, err := filepath.Rel(n.dir, livePath)
+	if err != nil {
+		live = filepath.Base(livePath)
+	}
+
+	glob, err := n.render(rt, fileNameData{
+		Sender: sender,
+		Host:   n.host,
+		Date:   "*",
+		Live:   live,
+		Time:   "*",
+	})
+	if err != nil {
+		return nil, ""
+	}
+
+	return func(at time.Time) string {
+		path, err := n.render(rt, fileNameData{
+			Sender: sender,
+			Host:   n.host,
+			Date:   date,
+			Live:   live,
+			Time:   at.Format(ROTATED_TIME_LAYOUT),
+		})
+		if err != nil {
+			return fmt.Sprintf("%s.%s", livePath, at.Format(ROTATED_TIME_LAYOUT))
+		}
+
+		return path
+	}, glob
+}
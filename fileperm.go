@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// parseFileOptions parses -file-mode, -dir-mode and -file-owner into how
+// the log files and their directories are created
+func parseFileOptions(modeSpec, dirModeSpec, ownerSpec string) (logg.FileOptions, error) {
+	var opts logg.FileOptions
+	var err error
+
+	if opts.Mode, err = parseMode(modeSpec); err != nil {
+		return opts, fmt.Errorf("-file-mode: %v", err)
+	}
+
+	if opts.DirMode, err = parseMode(dirModeSpec); err != nil {
+		return opts, fmt.Errorf("-dir-mode: %v", err)
+	}
+
+	if ownerSpec != "" {
+		if opts.UID, opts.GID, err = parseOwner(ownerSpec); err != nil {
+			return opts, fmt.Errorf("-file-owner: %v", err)
+		}
+		opts.Chown = true
+	}
+
+	return opts, nil
+}
+
+// parseMode parses an octal permission mode like '0640'; "" is 0
+func parseMode(spec string) (os.FileMode, error) {
+	if spec == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(spec, 8, 32)
+	if err != nil || n == 0 || n > 0777 {
+		return 0, fmt.Errorf("invalid mode '%s' (expected octal permissions, e.g. '0640')", spec)
+	}
+
+	return os.FileMode(n), nil
+}
+
+// parseOwner parses 'user:group', 'user' or ':group' of names or ids; the
+// part left out is -1
+func parseOwner(spec string) (uid int, gid int, err error) {
+	name, group := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+
+	uid, gid = -1, -1
+
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, lerr := user.Lookup(name)
+			if lerr != nil {
+				return 0, 0, fmt.Errorf("unknown user '%s'", name)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, lerr := user.LookupGroup(group)
+			if lerr != nil {
+				return 0, 0, fmt.Errorf("unknown group '%s'", group)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	if uid == -1 && gid == -1 {
+		return 0, 0, fmt.Errorf("invalid owner '%s' (expected 'user:group', 'user' or ':group')", spec)
+	}
+
+	return uid, gid, nil
+}
+
+// makeLogDir creates the missing directories of dir as -dir-mode and
+// -file-owner say
+func makeLogDir(dir string) error {
+	if fileOptions.DirMode == 0 && !fileOptions.Chown {
+		return os.MkdirAll(dir, 0755)
+	}
+
+	return fileOptions.MakeDirs(dir)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	FORWARD_LOGIT  = "logit"  // POST /bulk/<sender> of an upstream logit
+	FORWARD_NDJSON = "ndjson" // POST every batch as JSON lines to the url
+)
+
+// forwarder relays entries to an upstream logit, or in ndjson format to any
+// HTTP endpoint. entries carry an id, the client's or a new one, which an
+// upstream logit with -dedup drops repeats by, so the retries of a batch
+// don't store entries twice there.
+type forwarder struct {
+	url    string
+	format string
+	token  string
+	client *http.Client
+}
+
+func newForwarder(url, format, token string) (*forwarder, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid forward url '%s' (expected http:// or https://)", url)
+	}
+
+	switch format {
+	case FORWARD_LOGIT, FORWARD_NDJSON:
+	default:
+		return nil, fmt.Errorf("unknown forward format '%s' (expected '%s' or '%s')", format, FORWARD_LOGIT, FORWARD_NDJSON)
+	}
+
+	return &forwarder{
+		url:    strings.TrimRight(url, "/"),
+		format: format,
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: outbound},
+	}, nil
+}
+
+func (f *forwarder) send(batch []*sinkEntry) error {
+	for _, e := range batch {
+		if e.Id == "" {
+			e.Id = newEntryId()
+		}
+	}
+
+	if f.format == FORWARD_NDJSON {
+		return f.post(f.url, batch, func(e *sinkEntry) interface{} { return e })
+	}
+
+	// /bulk takes one sender a request; runs of a sender keep the order
+	for i := 0; i < len(batch); {
+		j := i + 1
+		for j < len(batch) && batch[j].Sender == batch[i].Sender {
+			j++
+		}
+
+		if err := f.post(f.url+"/bulk/"+batch[i].Sender, batch[i:j], bulkEntryOf); err != nil {
+			return err
+		}
+
+		i = j
+	}
+
+	return nil
+}
+
+// bulkEntryOf turns e back into what /bulk takes; a message that is a JSON
+// object goes as one, so upstream sees it structured like here
+func bulkEntryOf(e *sinkEntry) interface{} {
+	msg := json.RawMessage(e.Msg)
+	if !strings.HasPrefix(e.Msg, "{") || !json.Valid(msg) {
+		msg, _ = json.Marshal(e.Msg)
+	}
+
+	return &bulkEntry{
+		Level:  e.Level,
+		Msg:    msg,
+		Fields: e.Fields,
+		Ts:     e.Time.Format(time.RFC3339Nano),
+		Retain: e.Retain,
+		Id:     e.Id,
+	}
+}
+
+// post sends entries as JSON lines; network errors and 5xx (and 429)
+// answers are worth a retry, other refusals are not
+func (f *forwarder) post(url string, entries []*sinkEntry, render func(e *sinkEntry) interface{}) error {
+	var body bytes.Buffer
+
+	enc := json.NewEncoder(&body)
+	for _, e := range entries {
+		if err := enc.Encode(render(e)); err != nil {
+			return permanentError{err: err}
+		}
+	}
+
+	req, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		return permanentError{err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s answers %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	default:
+		return permanentError{err: fmt.Errorf("%s refuses entries: %s: %s", url, resp.Status, bytes.TrimSpace(msg))}
+	}
+}
+
+func (f *forwarder) probe(ctx context.Context) error {
+	if f.format == FORWARD_LOGIT {
+		return probeLogit(ctx, f.client, f.url)
+	}
+
+	req, err := http.NewRequest("HEAD", f.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// newEntryId makes an id for an entry the client gave none
+func newEntryId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
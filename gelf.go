@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GELF_DEFAULT_PORT = "12201"
+	GELF_CHUNK_SIZE   = 1420 // payload of a UDP chunk, safe over most links
+	GELF_MAX_CHUNKS   = 128  // per message, by the spec
+	GELF_DIAL_TIMEOUT = 10 * time.Second
+)
+
+// gelfSender ships entries to Graylog in GELF 1.1, over UDP (compressed and
+// chunked) or TCP (messages ended by a NUL byte, uncompressed as the spec
+// wants it)
+type gelfSender struct {
+	network  string // udp or tcp
+	addr     string
+	compress string // gzip, zlib or none; udp only
+	host     string
+
+	lock *sync.Mutex
+	conn net.Conn
+}
+
+// newGelfSender takes 'udp://host[:port]' or 'tcp://host[:port]'
+func newGelfSender(url, compress string) (*gelfSender, error) {
+	var network, addr string
+
+	switch {
+	case strings.HasPrefix(url, "udp://"):
+		network, addr = "udp", url[len("udp://"):]
+	case strings.HasPrefix(url, "tcp://"):
+		network, addr = "tcp", url[len("tcp://"):]
+	default:
+		return nil, fmt.Errorf("invalid gelf address '%s' (expected udp://host[:port] or tcp://host[:port])", url)
+	}
+
+	if addr = strings.TrimRight(addr, "/"); addr == "" {
+		return nil, fmt.Errorf("invalid gelf address '%s' (expected udp://host[:port] or tcp://host[:port])", url)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, GELF_DEFAULT_PORT)
+	}
+
+	switch compress {
+	case "gzip", "zlib", "none":
+	default:
+		return nil, fmt.Errorf("unknown gelf compression '%s' (expected gzip, zlib or none)", compress)
+	}
+
+	host, _ := os.Hostname()
+
+	return &gelfSender{
+		network:  network,
+		addr:     addr,
+		compress: compress,
+		host:     host,
+		lock:     &sync.Mutex{},
+	}, nil
+}
+
+// gelfLevel maps a level to the syslog severity GELF takes
+func gelfLevel(level string) int {
+	switch level {
+	case "fatal":
+		return 2
+	case "error":
+		return 3
+	case "warn":
+		return 4
+	case "debug", "trace":
+		return 7
+	default:
+		return 6
+	}
+}
+
+// gelfMessage renders e as a GELF message: the first line of the message
+// is short_message and a message of several the full_message; fields go as
+// additional fields, '_' prefixed
+func (g *gelfSender) gelfMessage(e *sinkEntry) ([]byte, error) {
+	m := make(map[string]interface{}, len(e.Fields)+10)
+
+	for k, v := range e.Fields {
+		if k = gelfFieldName(k); k != "" {
+			m["_"+k] = v
+		}
+	}
+
+	short := e.Msg
+	if i := strings.IndexByte(short, '\n'); i >= 0 {
+		short = short[:i]
+		m["full_message"] = e.Msg
+	}
+	if short == "" {
+		short = "-" // GELF wants one
+	}
+
+	m["version"] = "1.1"
+	m["host"] = g.host
+	m["short_message"] = short
+	m["timestamp"] = float64(e.Time.UnixNano()/int64(time.Millisecond)) / 1000
+	m["level"] = gelfLevel(e.Level)
+	m["_sender"] = e.Sender
+
+	if e.Retain != "" {
+		m["_retain"] = e.Retain
+	}
+	if e.Id != "" {
+		m["_logit_id"] = e.Id
+	}
+
+	return json.Marshal(m)
+}
+
+// gelfFieldName keeps the characters GELF allows in field names ('_id' is
+// reserved), "" if nothing is left
+func gelfFieldName(k string) string {
+	b := []byte(k)
+
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == '-':
+		default:
+			b[i] = '_'
+		}
+	}
+
+	if name := strings.TrimLeft(string(b), "_"); name != "" && name != "id" {
+		return name
+	}
+
+	return ""
+}
+
+func (g *gelfSender) send(batch []*sinkEntry) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	lost := 0
+	var lastErr error
+
+	for _, e := range batch {
+		msg, err := g.gelfMessage(e)
+		if err == nil && g.network == "udp" {
+			msg, err = g.compressed(msg)
+		}
+		if err != nil {
+			lost, lastErr = lost+1, err
+			continue
+		}
+
+		if g.network == "udp" {
+			err = g.writeUDP(msg)
+		} else {
+			err = g.writeTCP(msg)
+		}
+
+		if _, ok := err.(permanentError); ok {
+			lost, lastErr = lost+1, err
+		} else if err != nil {
+			// the far side is away: the batch goes again, over a new
+			// connection
+			g.dropConn()
+			return err
+		}
+	}
+
+	if lost > 0 {
+		return permanentError{err: lastErr, entries: lost}
+	}
+
+	return nil
+}
+
+func (g *gelfSender) compressed(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch g.compress {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	default:
+		return msg, nil
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// connect dials the far side unless connected; the caller holds lock
+func (g *gelfSender) connect() error {
+	if g.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(g.network, g.addr, GELF_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	g.conn = conn
+
+	return nil
+}
+
+func (g *gelfSender) dropConn() {
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+}
+
+// writeUDP sends msg as one datagram, or in chunks when larger than
+// GELF_CHUNK_SIZE: magic 0x1e 0x0f, an 8 byte message id, the chunk's
+// number and the count of chunks, then the chunk
+func (g *gelfSender) writeUDP(msg []byte) error {
+	if err := g.connect(); err != nil {
+		return err
+	}
+
+	if len(msg) <= GELF_CHUNK_SIZE {
+		_, err := g.conn.Write(msg)
+		return err
+	}
+
+	count := (len(msg) + GELF_CHUNK_SIZE - 1) / GELF_CHUNK_SIZE
+	if count > GELF_MAX_CHUNKS {
+		return permanentError{err: fmt.Errorf("gelf message of %d bytes needs more than %d chunks", len(msg), GELF_MAX_CHUNKS)}
+	}
+
+	var id [8]byte
+	rand.Read(id[:])
+
+	chunk := make([]byte, 0, 12+GELF_CHUNK_SIZE)
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * GELF_CHUNK_SIZE
+		if end > len(msg) {
+			end = len(msg)
+		}
+
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id[:]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, msg[i*GELF_CHUNK_SIZE:end]...)
+
+		if _, err := g.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeTCP sends msg ended by a NUL byte
+func (g *gelfSender) writeTCP(msg []byte) error {
+	if bytes.IndexByte(msg, 0) >= 0 {
+		return permanentError{err: fmt.Errorf("gelf message holds a NUL byte")}
+	}
+
+	if err := g.connect(); err != nil {
+		return err
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(GELF_DIAL_TIMEOUT))
+
+	_, err := g.conn.Write(append(msg, 0))
+
+	return err
+}
+
+func (g *gelfSender) probe(ctx context.Context) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, g.network, g.addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logit/logg"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GRPC_SERVICE      = "/logit.v1.LogService/"
+	GRPC_MAX_MESSAGE  = 4 * 1024 * 1024 // the gRPC default
+	GRPC_CONTENT_TYPE = "application/grpc"
+)
+
+// gRPC status codes
+const (
+	GRPC_OK                 = 0
+	GRPC_INVALID_ARGUMENT   = 3
+	GRPC_PERMISSION_DENIED  = 7
+	GRPC_RESOURCE_EXHAUSTED = 8
+	GRPC_UNIMPLEMENTED      = 12
+	GRPC_INTERNAL           = 13
+)
+
+// Level of proto/logservice.proto, by number
+var grpcLevels = []string{"debug", "debug", "info", "warn", "error", "fatal"}
+
+// grpcServer serves LogService of proto/logservice.proto: Write and the
+// client streaming WriteStream. it speaks the gRPC framing over HTTP/2 and
+// decodes the few protobuf messages by hand. auth and rate limits wrap it
+// like the HTTP intake; their refusals reach clients as HTTP statuses,
+// which gRPC maps to UNAUTHENTICATED, UNAVAILABLE and the like.
+type grpcServer struct {
+	logger *logg.Logger
+}
+
+// listenGRPC serves h over HTTP/2 on port, with TLS if the HTTP intake
+// has it and in cleartext (prior knowledge, as gRPC clients dial) if not
+func listenGRPC(port int, h http.Handler, logger *logg.Logger) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	p := &http.Protocols{}
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(serverTLS == nil)
+
+	server := &http.Server{Handler: logAccess(recoverPanics(h, logger), accessLogger), TLSConfig: serverTLS, Protocols: p, ErrorLog: httpErrorLog(logger)}
+	addServer(server)
+
+	go func() {
+		if serverTLS != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+
+		if err != http.ErrServerClosed {
+			logger.Errorf("grpc server failed: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func (g *grpcServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || !strings.HasPrefix(req.Header.Get("Content-Type"), GRPC_CONTENT_TYPE) {
+		http.Error(rw, "expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var stream bool
+
+	switch strings.TrimPrefix(req.URL.Path, GRPC_SERVICE) {
+	case "Write":
+	case "WriteStream":
+		stream = true
+	default:
+		grpcStatus(rw, GRPC_UNIMPLEMENTED, "unknown method %s", req.URL.Path)
+		return
+	}
+
+	encoding := req.Header.Get("Grpc-Encoding")
+	body := bufio.NewReader(req.Body)
+	logger := g.logger.WithContext(req.Context()).With("remote", req.RemoteAddr)
+
+	var resp grpcWriteResponse
+
+	for i := 0; ; i++ {
+		parse := stageStats.timer("parse")
+
+		msg, err := readGRPCMessage(body, encoding)
+		if err == io.EOF && (stream || i > 0) {
+			parse.end(STAGE_PASSED)
+			break
+		}
+
+		if err == io.EOF {
+			parse.end(STAGE_DROPPED)
+			grpcStatus(rw, GRPC_INVALID_ARGUMENT, "no entry sent")
+			return
+		}
+
+		if err != nil {
+			parse.end(STAGE_DROPPED)
+			grpcStatus(rw, GRPC_INVALID_ARGUMENT, "entry %d: %v (%d entries before it were accepted)", i, err, resp.accepted)
+			return
+		}
+
+		if !stream && i > 0 {
+			parse.end(STAGE_DROPPED)
+			grpcStatus(rw, GRPC_INVALID_ARGUMENT, "Write takes one entry; use WriteStream")
+			return
+		}
+
+		sender, be, err := decodeGRPCEntry(msg)
+		code := GRPC_INVALID_ARGUMENT
+		var e *entry
+
+		switch {
+		case err != nil:
+		case !senderAllowed(req, aliases.resolve(sender)):
+			code = GRPC_PERMISSION_DENIED
+			err = fmt.Errorf("not allowed to write '%s'", aliases.resolve(sender))
+		case admission.refused(aliases.resolve(sender)):
+			code = GRPC_PERMISSION_DENIED
+			err = fmt.Errorf("unknown sender '%s'", aliases.resolve(sender))
+		default:
+			e, err = be.entry(aliases.resolve(sender))
+		}
+
+		if err != nil {
+			parse.end(STAGE_DROPPED)
+
+			if !stream {
+				grpcStatus(rw, code, "%v", err)
+				return
+			}
+
+			resp.rejected = append(resp.rejected, bulkRejection{i, err.Error()})
+			continue
+		}
+
+		e.addTrace(req)
+		e.waitSync(req)
+		parse.end(STAGE_PASSED)
+
+		if dryRun {
+			resp.accepted++
+			continue
+		}
+
+		if ok, wait := senderLimits.allow(e); !ok {
+			grpcStatus(rw, GRPC_RESOURCE_EXHAUSTED, "sender '%s' is over its rate at entry %d, retry in %v (%d entries before it were accepted)", e.sender, i, wait, resp.accepted)
+			return
+		}
+
+		if !quotas.allow(e) {
+			grpcStatus(rw, GRPC_RESOURCE_EXHAUSTED, "sender '%s' is over its disk quota at entry %d (%d entries before it were accepted)", e.sender, i, resp.accepted)
+			return
+		}
+
+		if !intake.run(e) {
+			resp.dropped++
+			continue
+		}
+
+		if err := deliver(e); err != nil {
+			dedup.forget(e)
+			logger.Errorf("storing entry of '%s' failed: %v", e.sender, err)
+			code := GRPC_INTERNAL
+			if storeError(err) == ERR_STORAGE_FULL {
+				code = GRPC_RESOURCE_EXHAUSTED
+			}
+			grpcStatus(rw, code, "storing entry %d failed (%d entries before it were accepted)", i, resp.accepted)
+			return
+		}
+
+		resp.accepted++
+	}
+
+	rw.Header().Set("Content-Type", GRPC_CONTENT_TYPE)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(grpcFrame(resp.encode()))
+
+	rw.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(GRPC_OK))
+}
+
+// grpcStatus answers with a status only (a 'trailers-only' response)
+func grpcStatus(rw http.ResponseWriter, code int, format string, args ...interface{}) {
+	h := rw.Header()
+	h.Set("Content-Type", GRPC_CONTENT_TYPE)
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", grpcPercentEncode(fmt.Sprintf(format, args...)))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// grpcPercentEncode encodes a grpc-message as the gRPC spec wants
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// readGRPCMessage reads a length prefixed message: a compressed flag, the
+// length (4 bytes, big endian) and the message
+func readGRPCMessage(r *bufio.Reader, encoding string) ([]byte, error) {
+	var head [5]byte
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated message")
+		}
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > GRPC_MAX_MESSAGE {
+		return nil, fmt.Errorf("message of %d bytes exceeds %d", n, GRPC_MAX_MESSAGE)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("truncated message")
+	}
+
+	if head[0] == 0 {
+		return msg, nil
+	}
+
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported message encoding '%s'", encoding)
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	// one byte past the limit tells an inflated message over it from one
+	// just at it
+	msg, err = ioutil.ReadAll(io.LimitReader(gr, GRPC_MAX_MESSAGE+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg) > GRPC_MAX_MESSAGE {
+		return nil, fmt.Errorf("message inflates past %d bytes", GRPC_MAX_MESSAGE)
+	}
+
+	return msg, nil
+}
+
+func grpcFrame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+
+	return append(b, msg...)
+}
+
+// decodeGRPCEntry decodes an Entry into the bulk entry it amounts to, so
+// it is checked and made an entry the same way
+func decodeGRPCEntry(msg []byte) (string, *bulkEntry, error) {
+	var sender, text string
+	be := &bulkEntry{}
+
+	err := decodeProto(msg, func(field int, r *protoReader) error {
+		var err error
+
+		switch field {
+		case 1:
+			sender, err = r.string()
+		case 2:
+			var level uint64
+			if level, err = r.varint(); err == nil && level < uint64(len(grpcLevels)) {
+				be.Level = grpcLevels[level]
+			}
+		case 3:
+			text, err = r.string()
+		case 4:
+			var k string
+			var v interface{}
+			if k, v, err = decodeGRPCField(r); err == nil {
+				if be.Fields == nil {
+					be.Fields = make(map[string]interface{})
+				}
+				be.Fields[k] = v
+			}
+		case 5:
+			var t time.Time
+			if t, err = decodeProtoTimestamp(r); err == nil {
+				be.Ts = t.Format(time.RFC3339Nano)
+			}
+		case 6:
+			be.Retain, err = r.string()
+		case 7:
+			be.Id, err = r.string()
+		default:
+			err = r.skip()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	// a JSON object is stored structured, as in /bulk
+	if strings.HasPrefix(text, "{") && json.Valid([]byte(text)) {
+		be.Msg = json.RawMessage(text)
+	} else {
+		be.Msg, _ = json.Marshal(text)
+	}
+
+	if sender, err = normalizeSender(sender); err != nil {
+		return "", nil, err
+	}
+
+	return sender, be, nil
+}
+
+// decodeGRPCField decodes an entry of map<string, Field>
+func decodeGRPCField(r *protoReader) (string, interface{}, error) {
+	b, err := r.bytes()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var key string
+	var value interface{}
+
+	err = decodeProto(b, func(field int, r *protoReader) error {
+		switch field {
+		case 1:
+			var err error
+			key, err = r.string()
+			return err
+		case 2:
+			v, err := r.bytes()
+			if err != nil {
+				return err
+			}
+
+			return decodeProto(v, func(field int, r *protoReader) error {
+				switch field {
+				case 1:
+					s, err := r.string()
+					value = s
+					return err
+				case 2:
+					n, err := r.varint()
+					value = int64(n)
+					return err
+				case 3:
+					n, err := r.fixed64()
+					value = math.Float64frombits(n)
+					return err
+				case 4:
+					n, err := r.varint()
+					value = n != 0
+					return err
+				default:
+					return r.skip()
+				}
+			})
+		default:
+			return r.skip()
+		}
+	})
+
+	return key, value, err
+}
+
+// decodeProtoTimestamp decodes a google.protobuf.Timestamp
+func decodeProtoTimestamp(r *protoReader) (time.Time, error) {
+	b, err := r.bytes()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var seconds, nanos uint64
+
+	err = decodeProto(b, func(field int, r *protoReader) error {
+		var err error
+
+		switch field {
+		case 1:
+			seconds, err = r.varint()
+		case 2:
+			nanos, err = r.varint()
+		default:
+			err = r.skip()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// the range google.protobuf.Timestamp allows: years 1 to 9999
+	if s := int64(seconds); s < PROTO_MIN_SECONDS || s > PROTO_MAX_SECONDS || nanos >= uint64(time.Second) {
+		return time.Time{}, fmt.Errorf("timestamp out of range")
+	}
+
+	return time.Unix(int64(seconds), int64(nanos)).UTC(), nil
+}
+
+type grpcWriteResponse struct {
+	accepted int
+	dropped  int
+	rejected []bulkRejection
+}
+
+func (resp *grpcWriteResponse) encode() []byte {
+	var w protoWriter
+
+	w.varint(1, uint64(resp.accepted))
+	w.varint(2, uint64(resp.dropped))
+
+	for _, r := range resp.rejected {
+		var rw protoWriter
+		rw.varint(1, uint64(r.Index))
+		rw.bytes(2, []byte(r.Message))
+
+		w.bytes(3, rw.b)
+	}
+
+	return w.b
+}
+
+// protobuf wire format: fields are a key (number << 3 | wire type) and a
+// value, a varint, 8 or 4 bytes, or a length and as many bytes
+const (
+	PROTO_VARINT  = 0
+	PROTO_FIXED64 = 1
+	PROTO_BYTES   = 2
+	PROTO_FIXED32 = 5
+
+	PROTO_MAX_FIELD = 1<<29 - 1
+
+	PROTO_MIN_SECONDS = -62135596800 // 0001-01-01T00:00:00Z
+	PROTO_MAX_SECONDS = 253402300799 // 9999-12-31T23:59:59Z
+)
+
+type protoReader struct {
+	b    []byte
+	wire int // of the field being read
+}
+
+// decodeProto calls fn for every field of msg in turn; fn reads the value
+// or skips it
+func decodeProto(msg []byte, fn func(field int, r *protoReader) error) error {
+	r := &protoReader{b: msg}
+
+	for len(r.b) > 0 {
+		r.wire = PROTO_VARINT
+
+		key, err := r.varint()
+		if err != nil {
+			return err
+		}
+
+		if key>>3 == 0 || key>>3 > PROTO_MAX_FIELD {
+			return errProtoInvalid
+		}
+
+		r.wire = int(key & 7)
+		if err := fn(int(key>>3), r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var errProtoInvalid = fmt.Errorf("invalid protobuf message")
+
+func (r *protoReader) varint() (uint64, error) {
+	if r.wire != PROTO_VARINT {
+		return 0, errProtoInvalid
+	}
+
+	n, size := binary.Uvarint(r.b)
+	if size <= 0 {
+		return 0, errProtoInvalid
+	}
+
+	r.b = r.b[size:]
+
+	return n, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if r.wire != PROTO_FIXED64 || len(r.b) < 8 {
+		return 0, errProtoInvalid
+	}
+
+	n := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+
+	return n, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	if r.wire != PROTO_BYTES {
+		return nil, errProtoInvalid
+	}
+
+	r.wire = PROTO_VARINT
+	n, err := r.varint()
+	if err != nil || n > uint64(len(r.b)) {
+		return nil, errProtoInvalid
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+
+	return b, nil
+}
+
+func (r *protoReader) string() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func (r *protoReader) skip() error {
+	var err error
+
+	switch r.wire {
+	case PROTO_VARINT:
+		_, err = r.varint()
+	case PROTO_FIXED64:
+		_, err = r.fixed64()
+	case PROTO_BYTES:
+		_, err = r.bytes()
+	case PROTO_FIXED32:
+		if len(r.b) < 4 {
+			return errProtoInvalid
+		}
+		r.b = r.b[4:]
+	default:
+		err = errProtoInvalid
+	}
+
+	return err
+}
+
+type protoWriter struct {
+	b []byte
+}
+
+func (w *protoWriter) varint(field int, n uint64) {
+	if n == 0 {
+		return // the default, left out
+	}
+
+	w.b = binary.AppendUvarint(w.b, uint64(field)<<3|PROTO_VARINT)
+	w.b = binary.AppendUvarint(w.b, n)
+}
+
+func (w *protoWriter) bytes(field int, b []byte) {
+	w.b = binary.AppendUvarint(w.b, uint64(field)<<3|PROTO_BYTES)
+	w.b = binary.AppendUvarint(w.b, uint64(len(b)))
+	w.b = append(w.b, b...)
+}
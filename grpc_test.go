@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// an Entry as a client library writes it: sender "web", level INFO, msg
+// "hi", fields {"n": 5, "s": "x", "f": 1.5, "b": true}, time
+// 2026-10-15T10:00:00.000000500Z, retain "short", id "a1"
+const grpcTestEntry = "" +
+	"\x0a\x03web" +
+	"\x10\x02" +
+	"\x1a\x02hi" +
+	"\x22\x07" + "\x0a\x01n" + "\x12\x02" + "\x10\x05" +
+	"\x22\x08" + "\x0a\x01s" + "\x12\x03" + "\x0a\x01x" +
+	"\x22\x0e" + "\x0a\x01f" + "\x12\x09" + "\x19\x00\x00\x00\x00\x00\x00\xf8\x3f" +
+	"\x22\x07" + "\x0a\x01b" + "\x12\x02" + "\x20\x01" +
+	"\x2a\x09" + "\x08\xa0\xc8\xc2\xd6\x06" + "\x10\xf4\x03" +
+	"\x32\x05short" +
+	"\x3a\x02a1"
+
+func TestDecodeGRPCEntry(t *testing.T) {
+	sender, be, err := decodeGRPCEntry([]byte(grpcTestEntry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sender != "web" || be.Level != "info" || string(be.Msg) != `"hi"` || be.Ts != "2026-10-15T10:00:00.0000005Z" || be.Retain != "short" || be.Id != "a1" {
+		t.Errorf("got %s %+v", sender, be)
+	}
+
+	fields, _ := json.Marshal(be.Fields)
+	if expected := `{"b":true,"f":1.5,"n":5,"s":"x"}`; string(fields) != expected {
+		t.Errorf("got fields %s, expected %s", fields, expected)
+	}
+}
+
+func TestDecodeGRPCEntryFields(t *testing.T) {
+	tests := []struct {
+		name, msg string
+
+		sender, level, text string
+	}{
+		{"sender only", "\x0a\x03Web", "web", "", `""`},
+		{"unspecified level", "\x0a\x03web\x10\x00", "web", "debug", `""`},
+		{"unknown level", "\x0a\x03web\x10\x09", "web", "", `""`},
+		{"json msg", "\x0a\x03web\x1a\x07{\"a\":1}", "web", "", `{"a":1}`},
+		{"invalid json msg", "\x0a\x03web\x1a\x04{\"a\"", "web", "", `"{\"a\""`},
+		{"last value wins", "\x0a\x03api\x0a\x03web\x10\x03\x10\x04", "web", "error", `""`},
+		{"unknown fields skipped", "\x0a\x03web\x40\x96\x01\x49\x01\x02\x03\x04\x05\x06\x07\x08\x52\x01z\x5d\x01\x02\x03\x04", "web", "", `""`},
+	}
+
+	for _, test := range tests {
+		sender, be, err := decodeGRPCEntry([]byte(test.msg))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if sender != test.sender || be.Level != test.level || string(be.Msg) != test.text {
+			t.Errorf("%s: got %s %q %s, expected %s %q %s", test.name, sender, be.Level, be.Msg, test.sender, test.level, test.text)
+		}
+	}
+}
+
+func TestDecodeGRPCEntryMalformed(t *testing.T) {
+	tests := []struct {
+		name, msg string
+	}{
+		{"empty", ""},
+		{"no sender", "\x10\x02"},
+		{"invalid sender", "\x0a\x02.."},
+
+		// varints
+		{"truncated key", "\x0a\x03web\x80"},
+		{"truncated value", "\x0a\x03web\x10\x80"},
+		{"truncated value at the end", "\x0a\x03web\x10\xff\xff\xff"},
+		{"overlong varint", "\x0a\x03web\x10\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"},
+		{"varint overflowing 64 bits", "\x0a\x03web\x10\xff\xff\xff\xff\xff\xff\xff\xff\xff\x02"},
+		{"overlong key", "\x0a\x03web\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"},
+
+		// length prefixes
+		{"length past the end", "\x0a\x05web"},
+		{"length of 2^32", "\x0a\x80\x80\x80\x80\x10web"},
+		{"length of 2^64-1", "\x0a\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01web"},
+		{"truncated length", "\x0a\x03web\x1a\x80"},
+		{"field length past its map entry", "\x0a\x03web\x22\x03\x0a\x05n"},
+		{"value length past its map entry", "\x0a\x03web\x22\x04\x0a\x01n\x12\x09\x10"},
+		{"timestamp length past the end", "\x0a\x03web\x2a\x7f\x08\x01"},
+
+		// keys and wire types
+		{"field 0", "\x0a\x03web\x00\x01"},
+		{"field past 2^29-1", "\x0a\x03web\x80\x80\x80\x80\x10\x01"},
+		{"start group", "\x0a\x03web\x0b"},
+		{"end group", "\x0a\x03web\x0c"},
+		{"wire type 6", "\x0a\x03web\x0e"},
+		{"sender as a varint", "\x08\x01"},
+		{"level as bytes", "\x0a\x03web\x12\x01\x02"},
+		{"truncated fixed64", "\x0a\x03web\x49\x01\x02\x03"},
+		{"truncated fixed32", "\x0a\x03web\x4d\x01\x02"},
+		{"truncated double field", "\x0a\x03web\x22\x0a\x0a\x01f\x12\x05\x19\x00\x00\xf8\x3f"},
+		{"double field as a varint", "\x0a\x03web\x22\x07\x0a\x01f\x12\x02\x18\x01"},
+
+		// timestamps
+		{"nanos of a second or more", "\x0a\x03web\x2a\x08\x08\x01\x10\x80\x94\xeb\xdc\x03"},
+		{"negative nanos", "\x0a\x03web\x2a\x0d\x08\x01\x10\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"},
+		{"after 9999", "\x0a\x03web\x2a\x07\x08\x80\x83\xd1\xff\xaf\x07"},
+		{"before year 1", "\x0a\x03web\x2a\x0b\x08\xff\x91\xb8\xc3\x98\xfe\xff\xff\xff\x01"},
+	}
+
+	for _, test := range tests {
+		if sender, be, err := decodeGRPCEntry([]byte(test.msg)); err == nil {
+			t.Errorf("%s: taken as %s %+v", test.name, sender, be)
+		}
+	}
+}
+
+// every cut of a valid entry short of the sender's end is refused, and
+// none panics
+func TestDecodeGRPCEntryTruncated(t *testing.T) {
+	for n := 0; n < len(grpcTestEntry); n++ {
+		_, _, err := decodeGRPCEntry([]byte(grpcTestEntry[:n]))
+
+		// a cut between two fields is a valid shorter entry
+		if n < 5 && err == nil {
+			t.Errorf("cut to %d bytes: taken", n)
+		}
+	}
+}
+
+func grpcGzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	compressed := grpcFrame(grpcGzip(t, []byte(grpcTestEntry)))
+	compressed[0] = 1
+
+	bomb := grpcFrame(grpcGzip(t, make([]byte, GRPC_MAX_MESSAGE+1)))
+	bomb[0] = 1
+
+	atLimit := grpcFrame(grpcGzip(t, make([]byte, GRPC_MAX_MESSAGE)))
+	atLimit[0] = 1
+
+	tests := []struct {
+		name     string
+		frame    []byte
+		encoding string
+
+		size int // -1 if refused
+	}{
+		{"plain", grpcFrame([]byte(grpcTestEntry)), "", len(grpcTestEntry)},
+		{"empty", grpcFrame(nil), "", 0},
+		{"gzip", compressed, "gzip", len(grpcTestEntry)},
+		{"gzip at the limit", atLimit, "gzip", GRPC_MAX_MESSAGE},
+
+		{"truncated prefix", []byte{0, 0, 0}, "", -1},
+		{"truncated message", grpcFrame([]byte(grpcTestEntry))[:10], "", -1},
+		{"length over the limit", []byte{0, 0, 0x40, 0, 1}, "", -1},
+		{"length of 2^32-1", []byte{0, 0xff, 0xff, 0xff, 0xff}, "", -1},
+		{"compressed without an encoding", compressed, "", -1},
+		{"compressed with an unknown encoding", compressed, "snappy", -1},
+		{"compressed but not gzip", append([]byte{1, 0, 0, 0, 3}, "abc"...), "gzip", -1},
+		{"inflating past the limit", bomb, "gzip", -1},
+	}
+
+	for _, test := range tests {
+		msg, err := readGRPCMessage(bufio.NewReader(bytes.NewReader(test.frame)), test.encoding)
+
+		switch {
+		case test.size < 0 && err == nil:
+			t.Errorf("%s: taken as %d bytes", test.name, len(msg))
+		case test.size >= 0 && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.size >= 0 && len(msg) != test.size:
+			t.Errorf("%s: got %d bytes, expected %d", test.name, len(msg), test.size)
+		}
+	}
+
+	if _, err := readGRPCMessage(bufio.NewReader(strings.NewReader("")), ""); err != io.EOF {
+		t.Errorf("no message: got %v, expected %v", err, io.EOF)
+	}
+}
+
+func FuzzDecodeGRPCEntry(f *testing.F) {
+	f.Add([]byte(grpcTestEntry))
+	f.Add([]byte("\x0a\x03web\x22\x07\x0a\x01n\x12\x02\x10\x05"))
+	f.Add([]byte("\x0a\x03web\x2a\x07\x08\x80\x83\xd1\xff\xaf\x07"))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		sender, be, err := decodeGRPCEntry(msg)
+		if err != nil {
+			return
+		}
+
+		if s, err := normalizeSender(sender); err != nil || s != sender {
+			t.Errorf("sender %q taken", sender)
+		}
+
+		if !json.Valid(be.Msg) {
+			t.Errorf("msg %q taken", be.Msg)
+		}
+	})
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KAFKA_WAIT         = 10 * time.Second // for a broker to connect or answer
+	KAFKA_PRODUCE_WAIT = 5 * time.Second  // the broker waits this long for acks
+	KAFKA_METADATA_TTL = 5 * time.Minute
+	KAFKA_SENDER_TOPIC = "{sender}"
+	KAFKA_DEFAULT_PORT = "9092"
+
+	KAFKA_API_PRODUCE  = 0 // version 3, the first with record batches
+	KAFKA_API_METADATA = 3 // version 1
+	KAFKA_NO_LEADER    = -1
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaProducer produces entries to a topic, keyed by sender so a sender's
+// entries stay in order on one partition. a topic naming {sender} gives
+// every sender its own topic. it speaks just enough of the protocol for
+// that: metadata to find partition leaders and uncompressed produce
+// requests, over plaintext connections; TLS and SASL are not supported, so
+// brokers have to take unauthenticated clients on a listener logit can
+// reach.
+type kafkaProducer struct {
+	brokers  []string
+	topic    string
+	clientId string
+	acks     int16
+
+	lock      *sync.Mutex
+	addrs     map[int32]string      // broker id -> host:port
+	leaders   map[string][]int32    // topic -> partition -> broker id
+	fetchedAt map[string]time.Time  // topic -> when its leaders were fetched
+	conns     map[string]*kafkaConn // by host:port
+	corr      int32
+}
+
+func newKafkaProducer(brokers, topic, clientId, acks string) (*kafkaProducer, error) {
+	p := &kafkaProducer{
+		topic:     topic,
+		clientId:  clientId,
+		lock:      &sync.Mutex{},
+		addrs:     make(map[int32]string),
+		leaders:   make(map[string][]int32),
+		fetchedAt: make(map[string]time.Time),
+		conns:     make(map[string]*kafkaConn),
+	}
+
+	for _, b := range strings.Split(brokers, ",") {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, KAFKA_DEFAULT_PORT)
+		}
+
+		p.brokers = append(p.brokers, b)
+	}
+
+	if len(p.brokers) == 0 {
+		return nil, fmt.Errorf("no kafka brokers given")
+	}
+
+	if topic == "" || strings.ContainsAny(strings.Replace(topic, KAFKA_SENDER_TOPIC, "", -1), "{} /") {
+		return nil, fmt.Errorf("invalid kafka topic '%s' (expected a name, or one with %s for a topic per sender)", topic, KAFKA_SENDER_TOPIC)
+	}
+
+	switch acks {
+	case "1", "":
+		p.acks = 1
+	case "all", "-1":
+		p.acks = -1
+	default:
+		return nil, fmt.Errorf("invalid kafka acks '%s' (expected 1 or all)", acks)
+	}
+
+	return p, nil
+}
+
+func (p *kafkaProducer) topicOf(sender string) string {
+	// kafka topics take [a-zA-Z0-9._-]
+	return strings.Replace(p.topic, KAFKA_SENDER_TOPIC, strings.Map(func(r rune) rune {
+		if r < 128 && (r == '.' || r == '_' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, sender), -1)
+}
+
+// kafkaBatch is what goes to one partition
+type kafkaBatch struct {
+	topic     string
+	partition int32
+	records   []kafkaRecord
+}
+
+type kafkaRecord struct {
+	at    time.Time
+	key   []byte
+	value []byte
+}
+
+// send produces the entries, each as a JSON value keyed by its sender. a
+// failure leaves it to the caller to send all of them again, partitions
+// that took theirs included.
+func (p *kafkaProducer) send(entries []*sinkEntry) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// by leader, then topic and partition
+	byLeader := make(map[int32]map[string]*kafkaBatch)
+
+	for _, e := range entries {
+		topic := p.topicOf(e.Sender)
+
+		leaders, err := p.leadersOf(topic)
+		if err != nil {
+			return err
+		}
+
+		key := []byte(e.Sender)
+		partition := int32(murmur2(key)&0x7fffffff) % int32(len(leaders))
+		leader := leaders[partition]
+
+		if leader == KAFKA_NO_LEADER {
+			delete(p.fetchedAt, topic)
+			return fmt.Errorf("partition %d of %s has no leader", partition, topic)
+		}
+
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[string]*kafkaBatch)
+		}
+
+		bk := topic + "/" + strconv.Itoa(int(partition))
+		b := byLeader[leader][bk]
+		if b == nil {
+			b = &kafkaBatch{topic: topic, partition: partition}
+			byLeader[leader][bk] = b
+		}
+
+		b.records = append(b.records, kafkaRecord{e.Time, key, value})
+	}
+
+	for leader, batches := range byLeader {
+		if err := p.produce(leader, batches); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// leadersOf returns the leaders of the partitions of topic, fetching them
+// when unknown or old
+func (p *kafkaProducer) leadersOf(topic string) ([]int32, error) {
+	if at, ok := p.fetchedAt[topic]; ok && time.Since(at) < KAFKA_METADATA_TTL {
+		return p.leaders[topic], nil
+	}
+
+	var err error
+
+	for _, broker := range p.brokers {
+		if err = p.fetchMetadata(broker, topic); err == nil {
+			return p.leaders[topic], nil
+		}
+	}
+
+	return nil, err
+}
+
+func (p *kafkaProducer) fetchMetadata(broker, topic string) error {
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(topic)
+
+	resp, err := p.roundTrip(broker, KAFKA_API_METADATA, 1, req.b)
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+
+		p.addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	d.int32() // controller
+
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // internal
+
+		var leaders []int32
+
+		count := d.int32()
+		for m := count; m > 0 && d.err == nil; m-- {
+			d.int16() // partition error
+			index := d.int32()
+			leader := d.int32()
+			d.skipInt32s() // replicas
+			d.skipInt32s() // in sync replicas
+
+			if index < 0 || index >= count {
+				d.err = fmt.Errorf("partition %d of %d", index, count)
+				break
+			}
+
+			for int32(len(leaders)) <= index {
+				leaders = append(leaders, KAFKA_NO_LEADER)
+			}
+			leaders[index] = leader
+		}
+
+		if d.err != nil {
+			break
+		}
+
+		if name != topic {
+			continue
+		}
+
+		if code != 0 || len(leaders) == 0 {
+			return fmt.Errorf("kafka topic %s not available (error %d)", topic, code)
+		}
+
+		p.leaders[topic] = leaders
+		p.fetchedAt[topic] = time.Now()
+	}
+
+	if d.err != nil {
+		return fmt.Errorf("bad kafka metadata response: %v", d.err)
+	}
+
+	if _, ok := p.fetchedAt[topic]; !ok {
+		return fmt.Errorf("kafka broker %s doesn't know topic %s", broker, topic)
+	}
+
+	return nil
+}
+
+// produce sends the batches of one leader in a single request
+func (p *kafkaProducer) produce(leader int32, batches map[string]*kafkaBatch) error {
+	addr, ok := p.addrs[leader]
+	if !ok {
+		return fmt.Errorf("unknown kafka broker %d", leader)
+	}
+
+	byTopic := make(map[string][]*kafkaBatch)
+	for _, b := range batches {
+		byTopic[b.topic] = append(byTopic[b.topic], b)
+	}
+
+	topics := make([]string, 0, len(byTopic))
+	for topic := range byTopic {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var req kafkaEncoder
+	req.int16(-1) // no transactional id
+	req.int16(p.acks)
+	req.int32(int32(KAFKA_PRODUCE_WAIT / time.Millisecond))
+	req.int32(int32(len(topics)))
+
+	for _, topic := range topics {
+		req.string(topic)
+		req.int32(int32(len(byTopic[topic])))
+
+		for _, b := range byTopic[topic] {
+			req.int32(b.partition)
+			req.bytes(encodeRecordBatch(b.records))
+		}
+	}
+
+	resp, err := p.roundTrip(addr, KAFKA_API_PRODUCE, 3, req.b)
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topic := d.string()
+
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+
+			if code != 0 && d.err == nil {
+				// the leader may have moved
+				delete(p.fetchedAt, topic)
+				return fmt.Errorf("kafka refused entries for partition %d of %s (error %d)", partition, topic, code)
+			}
+		}
+	}
+
+	if d.err != nil {
+		return fmt.Errorf("bad kafka produce response: %v", d.err)
+	}
+
+	return nil
+}
+
+// encodeRecordBatch makes a v2 (magic 2) record batch, uncompressed
+func encodeRecordBatch(records []kafkaRecord) []byte {
+	first := records[0].at
+	last := first
+
+	var body kafkaEncoder
+	for i, r := range records {
+		if r.at.After(last) {
+			last = r.at
+		}
+
+		var rec kafkaEncoder
+		rec.int8(0) // attributes
+		rec.varint(int64(r.at.Sub(first) / time.Millisecond))
+		rec.varint(int64(i))
+		rec.varint(int64(len(r.key)))
+		rec.b = append(rec.b, r.key...)
+		rec.varint(int64(len(r.value)))
+		rec.b = append(rec.b, r.value...)
+		rec.varint(0) // headers
+
+		body.varint(int64(len(rec.b)))
+		body.b = append(body.b, rec.b...)
+	}
+
+	// what the crc covers: attributes to the end
+	var crced kafkaEncoder
+	crced.int16(0) // attributes: no compression
+	crced.int32(int32(len(records) - 1))
+	crced.int64(first.UnixNano() / int64(time.Millisecond))
+	crced.int64(last.UnixNano() / int64(time.Millisecond))
+	crced.int64(-1) // producer id
+	crced.int16(-1) // producer epoch
+	crced.int32(-1) // base sequence
+	crced.int32(int32(len(records)))
+	crced.b = append(crced.b, body.b...)
+
+	var batch kafkaEncoder
+	batch.int64(0)                               // base offset
+	batch.int32(int32(4 + 1 + 4 + len(crced.b))) // length of what follows
+	batch.int32(-1)                              // partition leader epoch
+	batch.int8(2)                                // magic
+	batch.int32(int32(crc32.Checksum(crced.b, crc32c)))
+	batch.b = append(batch.b, crced.b...)
+
+	return batch.b
+}
+
+// roundTrip sends a request to broker and returns the body of its answer
+func (p *kafkaProducer) roundTrip(broker string, api, version int16, body []byte) ([]byte, error) {
+	c, err := p.connect(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	p.corr++
+	corr := p.corr
+
+	var req kafkaEncoder
+	req.int32(0) // size, set below
+	req.int16(api)
+	req.int16(version)
+	req.int32(corr)
+	req.string(p.clientId)
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+
+	resp, err := c.roundTrip(req.b, corr)
+	if err != nil {
+		c.conn.Close()
+		delete(p.conns, broker)
+		return nil, fmt.Errorf("kafka %s: %v", broker, err)
+	}
+
+	return resp, nil
+}
+
+func (p *kafkaProducer) connect(broker string) (*kafkaConn, error) {
+	if c, ok := p.conns[broker]; ok {
+		return c, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", broker, KAFKA_WAIT)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &kafkaConn{conn, bufio.NewReader(conn)}
+	p.conns[broker] = c
+
+	return c, nil
+}
+
+// probe asks the first broker that answers for the brokers and the topic;
+// a topic per sender can only be checked once senders write
+func (p *kafkaProducer) probe(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	topic := p.topic
+	if strings.Contains(topic, KAFKA_SENDER_TOPIC) {
+		topic = ""
+	}
+
+	var err error
+
+	for _, broker := range p.brokers {
+		if topic == "" {
+			_, err = p.roundTrip(broker, KAFKA_API_METADATA, 1, []byte{0, 0, 0, 0})
+		} else {
+			err = p.fetchMetadata(broker, topic)
+		}
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *kafkaConn) roundTrip(req []byte, corr int32) ([]byte, error) {
+	c.conn.SetDeadline(time.Now().Add(KAFKA_WAIT + KAFKA_PRODUCE_WAIT))
+
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var head [8]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return nil, err
+	}
+
+	size := int32(binary.BigEndian.Uint32(head[:4]))
+	if size < 4 || size > 64<<20 {
+		return nil, fmt.Errorf("bad response size %d", size)
+	}
+
+	if got := int32(binary.BigEndian.Uint32(head[4:])); got != corr {
+		return nil, fmt.Errorf("response %d to request %d", got, corr)
+	}
+
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// kafkaEncoder appends big endian protocol primitives
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// varint appends a zigzag varint, as records use
+func (e *kafkaEncoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.b = append(e.b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// kafkaDecoder reads protocol primitives; the first short read sets err and
+// makes the rest return zeros
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("response cut short")
+		return nil
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a (nullable) string
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) skipInt32s() {
+	n := d.int32()
+	d.take(int(n) * 4)
+}
+
+// murmur2 is the hash the Java client partitions keys by, so entries of a
+// sender land where other producers put that key
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+
+	n := len(data)
+	h := uint32(0x9747b28c) ^ uint32(n)
+
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[n&^3:]
+
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// murmur2 partitions as the Java client does; the values are those of its
+// own tests (UtilsTest.testMurmur2)
+func TestMurmur2(t *testing.T) {
+	tests := []struct {
+		key  string
+		hash int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	for _, test := range tests {
+		if hash := murmur2([]byte(test.key)); hash != test.hash {
+			t.Errorf("%q: got %d, expected %d", test.key, hash, test.hash)
+		}
+	}
+}
+
+func TestCrc32c(t *testing.T) {
+	if sum := crc32.Checksum([]byte("123456789"), crc32c); sum != 0xe3069283 {
+		t.Errorf("got %#x, expected %#x", sum, 0xe3069283)
+	}
+}
+
+var kafkaTestAt = time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+
+// record batches as the protocol guide lays them out (magic 2), written
+// apart from the encoder
+var (
+	// {at, "web", {"msg":"a"}}
+	kafkaBatchOne = "" +
+		"0000000000000000" + // base offset
+		"00000046" + // batch length
+		"ffffffff" + // partition leader epoch
+		"02" + // magic
+		"828a836b" + // crc32c of attributes to the end
+		"0000" + // attributes
+		"00000000" + // last offset delta
+		"000001a13f011d00" + // first timestamp
+		"000001a13f011d00" + // max timestamp
+		"ffffffffffffffff" + // producer id
+		"ffff" + // producer epoch
+		"ffffffff" + // base sequence
+		"00000001" + // records
+		"28" + "00" + "00" + "00" + // length 20, attributes, timestamp delta 0, offset delta 0
+		"06" + "776562" + // key
+		"16" + "7b226d7367223a2261227d" + // value
+		"00" // headers
+
+	// {at, "web", {"msg":"a"}}, {at+1.5s, "web", {"msg":"b"}}
+	kafkaBatchTwo = "" +
+		"0000000000000000" +
+		"0000005c" +
+		"ffffffff" +
+		"02" +
+		"7d7dfe14" +
+		"0000" +
+		"00000001" + // last offset delta
+		"000001a13f011d00" +
+		"000001a13f0122dc" + // max timestamp, 1500ms on
+		"ffffffffffffffff" +
+		"ffff" +
+		"ffffffff" +
+		"00000002" +
+		"28" + "00" + "00" + "00" + "06" + "776562" + "16" + "7b226d7367223a2261227d" + "00" +
+		"2a" + "00" + "b817" + "02" + "06" + "776562" + "16" + "7b226d7367223a2262227d" + "00" // timestamp delta 1500, offset delta 1
+)
+
+func TestEncodeRecordBatch(t *testing.T) {
+	a := kafkaRecord{kafkaTestAt, []byte("web"), []byte(`{"msg":"a"}`)}
+	b := kafkaRecord{kafkaTestAt.Add(1500 * time.Millisecond), []byte("web"), []byte(`{"msg":"b"}`)}
+
+	tests := []struct {
+		name     string
+		records  []kafkaRecord
+		expected string
+	}{
+		{"one record", []kafkaRecord{a}, kafkaBatchOne},
+		{"two records", []kafkaRecord{a, b}, kafkaBatchTwo},
+	}
+
+	for _, test := range tests {
+		if got := hex.EncodeToString(encodeRecordBatch(test.records)); got != test.expected {
+			t.Errorf("%s: got\n%s, expected\n%s", test.name, got, test.expected)
+		}
+	}
+}
+
+// kafkaTestBroker answers each request with what answer returns for it,
+// keeping the requests it was sent
+type kafkaTestBroker struct {
+	ln       net.Listener
+	requests chan []byte
+
+	lock   *sync.Mutex
+	answer func(api int16, body []byte) []byte
+}
+
+func newKafkaTestBroker(t *testing.T) *kafkaTestBroker {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	b := &kafkaTestBroker{ln: ln, requests: make(chan []byte, 1000), lock: &sync.Mutex{}}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *kafkaTestBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		b.requests <- append(size[:], req...)
+
+		// api key, version and correlation id, then the client id
+		clientId := int(binary.BigEndian.Uint16(req[8:]))
+		b.lock.Lock()
+		body := b.answer(int16(binary.BigEndian.Uint16(req)), req[10+clientId:])
+		b.lock.Unlock()
+
+		resp := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(resp, uint32(4+len(body)))
+		copy(resp[4:], req[4:8])
+		conn.Write(append(resp, body...))
+	}
+}
+
+func (b *kafkaTestBroker) answerWith(answer func(api int16, body []byte) []byte) {
+	b.lock.Lock()
+	b.answer = answer
+	b.lock.Unlock()
+}
+
+func (b *kafkaTestBroker) port() int {
+	return b.ln.Addr().(*net.TCPAddr).Port
+}
+
+// kafkaFrame lays out protocol primitives: int8/int16/int32/int64 values,
+// strings as int16-sized strings and []byte as they are
+func kafkaFrame(values ...interface{}) []byte {
+	var buf bytes.Buffer
+
+	for _, v := range values {
+		switch v := v.(type) {
+		case int8, int16, int32, int64:
+			binary.Write(&buf, binary.BigEndian, v)
+		case string:
+			binary.Write(&buf, binary.BigEndian, int16(len(v)))
+			buf.WriteString(v)
+		case []byte:
+			buf.Write(v)
+		default:
+			panic("unknown kafka primitive")
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// kafkaMetadata is a metadata v1 response: broker 1 at port leading both
+// partitions of logs
+func kafkaMetadata(port int) []byte {
+	return kafkaFrame(
+		int32(1), // brokers
+		int32(1), "127.0.0.1", int32(port), int16(-1),
+		int32(1), // controller
+		int32(1), // topics
+		int16(0), "logs", int8(0),
+		int32(2), // partitions
+		int16(0), int32(0), int32(1), int32(1), int32(1), int32(1), int32(1),
+		int16(0), int32(1), int32(1), int32(1), int32(1), int32(1), int32(1),
+	)
+}
+
+// kafkaProduced is a produce v3 response for partition of logs
+func kafkaProduced(partition int32, code int16) []byte {
+	return kafkaFrame(
+		int32(1), "logs",
+		int32(1), partition, code, int64(42), int64(-1),
+		int32(0), // throttle time
+	)
+}
+
+func TestKafkaProducerFrames(t *testing.T) {
+	broker := newKafkaTestBroker(t)
+	broker.answerWith(func(api int16, body []byte) []byte {
+		if api == KAFKA_API_METADATA {
+			return kafkaMetadata(broker.port())
+		}
+		return kafkaProduced(0, 0)
+	})
+
+	p, err := newKafkaProducer(broker.ln.Addr().String(), "logs", "logit", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaders, err := p.leadersOf("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leaders) != 2 || leaders[0] != 1 || leaders[1] != 1 {
+		t.Errorf("got leaders %v, expected [1 1]", leaders)
+	}
+
+	if addr := p.addrs[1]; addr != "127.0.0.1:"+strconv.Itoa(broker.port()) {
+		t.Errorf("got broker 1 at %s", addr)
+	}
+
+	expected := "00000019" + // size
+		"0003" + "0001" + // metadata v1
+		"00000001" + // correlation id
+		"0005" + "6c6f676974" + // client id
+		"00000001" + "0004" + "6c6f6773" // topics
+	if got := hex.EncodeToString(<-broker.requests); got != expected {
+		t.Errorf("metadata request: got\n%s, expected\n%s", got, expected)
+	}
+
+	batch := &kafkaBatch{"logs", 0, []kafkaRecord{{kafkaTestAt, []byte("web"), []byte(`{"msg":"a"}`)}}}
+	if err := p.produce(1, map[string]*kafkaBatch{"logs/0": batch}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = "0000007f" +
+		"0000" + "0003" + // produce v3
+		"00000002" +
+		"0005" + "6c6f676974" +
+		"ffff" + // transactional id
+		"ffff" + // acks: all
+		"00001388" + // timeout
+		"00000001" + "0004" + "6c6f6773" + // topics
+		"00000001" + "00000000" + // partitions
+		"00000052" + kafkaBatchOne // records
+	if got := hex.EncodeToString(<-broker.requests); got != expected {
+		t.Errorf("produce request: got\n%s, expected\n%s", got, expected)
+	}
+
+	// entries of a sender go to the partition of its key
+	if err := p.send([]*sinkEntry{{Time: kafkaTestAt, Sender: "web", Level: "info", Msg: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-broker.requests
+	if partition := int32(binary.BigEndian.Uint32(req[41:])); partition != (murmur2([]byte("web"))&0x7fffffff)%2 {
+		t.Errorf("web produced to partition %d", partition)
+	}
+}
+
+// a partition the broker refuses fails the send and has its leaders fetched
+// again
+func TestKafkaProducerRefused(t *testing.T) {
+	broker := newKafkaTestBroker(t)
+	broker.answerWith(func(api int16, body []byte) []byte {
+		if api == KAFKA_API_METADATA {
+			return kafkaMetadata(broker.port())
+		}
+		return kafkaProduced(0, 6) // NOT_LEADER_OR_FOLLOWER
+	})
+
+	p, err := newKafkaProducer(broker.ln.Addr().String(), "logs", "logit", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.leadersOf("logs"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &kafkaBatch{"logs", 0, []kafkaRecord{{kafkaTestAt, []byte("web"), []byte("{}")}}}
+	if err := p.produce(1, map[string]*kafkaBatch{"logs/0": batch}); err == nil || !strings.Contains(err.Error(), "error 6") {
+		t.Errorf("got %v, expected error 6", err)
+	}
+
+	if _, ok := p.fetchedAt["logs"]; ok {
+		t.Errorf("leaders of logs kept after a refusal")
+	}
+}
+
+// a response cut anywhere is an error, not a panic or a partial table
+func TestKafkaTruncatedResponses(t *testing.T) {
+	broker := newKafkaTestBroker(t)
+
+	p, err := newKafkaProducer(broker.ln.Addr().String(), "logs", "logit", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := kafkaMetadata(broker.port())
+
+	for n := 0; n < len(metadata); n++ {
+		broker.answerWith(func(api int16, body []byte) []byte { return metadata[:n] })
+
+		if _, err := p.leadersOf("logs"); err == nil {
+			t.Errorf("metadata cut to %d bytes: taken", n)
+		}
+	}
+
+	// counts far beyond what follows
+	for _, resp := range [][]byte{
+		kafkaFrame(int32(1 << 30)),
+		kafkaFrame(int32(0), int32(1), int32(1), int16(0), "logs", int8(0), int32(1), int16(0), int32(0), int32(1), int32(1<<30)),
+		kafkaFrame(int32(0), int32(1), int32(1), int16(0), "logs", int8(0), int32(1), int16(0), int32(-1), int32(1)),
+	} {
+		broker.answerWith(func(api int16, body []byte) []byte { return resp })
+
+		if _, err := p.leadersOf("logs"); err == nil {
+			t.Errorf("metadata %x: taken", resp)
+		}
+	}
+
+	broker.answerWith(func(api int16, body []byte) []byte { return metadata })
+	if _, err := p.leadersOf("logs"); err != nil {
+		t.Fatal(err)
+	}
+
+	produced := kafkaProduced(0, 0)
+	batch := &kafkaBatch{"logs", 0, []kafkaRecord{{kafkaTestAt, []byte("web"), []byte("{}")}}}
+
+	// the throttle time is read by no one, so cut from before it
+	for n := 0; n < len(produced)-4; n++ {
+		broker.answerWith(func(api int16, body []byte) []byte { return produced[:n] })
+
+		if err := p.produce(1, map[string]*kafkaBatch{"logs/0": batch}); err == nil {
+			t.Errorf("produce response cut to %d bytes: taken", n)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type rekeyResult struct {
+	Tenant string `json:"tenant"`
+	Key    string `json:"key"`
+	Files  int    `json:"files_rewritten"`
+	Values int    `json:"values_rekeyed"`
+}
+
+// makeKeyAdminHandler serves POST /admin/keys/<tenant>/rotate, which gives a
+// tenant a new current key, and POST /admin/keys/<tenant>/rekey, which
+// re-encrypts the tenant's stored history under its current key so older keys
+// can be retired. the live file is re-keyed once it has rotated.
+func makeKeyAdminHandler(e *fieldEncryptor) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ss := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/keys"), "/"), "/")
+
+		if len(ss) != 2 || ss[0] == "" || (ss[1] != "rotate" && ss[1] != "rekey") {
+			writeError(rw, ERR_BODY_INVALID, "expected /admin/keys/<tenant>/rotate or /rekey")
+			return
+		}
+
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		tenant := strings.ToLower(ss[0])
+		if checkSender(tenant) != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid tenant '%s'", ss[0])
+			return
+		}
+
+		result := rekeyResult{Tenant: tenant}
+
+		var err error
+
+		if ss[1] == "rotate" {
+			result.Key, err = e.rotateKey(tenant)
+		} else {
+			fs, ok := store.(*fileStorage)
+			if !ok {
+				writeError(rw, ERR_BODY_INVALID, "re-keying needs file storage")
+				return
+			}
+
+			if result.Key, _, err = e.currentKey(tenant); err == nil {
+				result.Files, result.Values, err = fs.rewrite(tenant, func(line string) (string, int, error) {
+					return e.rekeyLine(tenant, line)
+				})
+			}
+		}
+
+		if err != nil {
+			serverLogger.Errorf("key %s of tenant '%s' failed: %v", ss[1], tenant, err)
+			writeError(rw, ERR_INTERNAL, "%s failed: %v", ss[1], err)
+			return
+		}
+
+		serverLogger.Infof("key %s of tenant '%s': key '%s', %d values in %d files", ss[1], tenant, result.Key, result.Values, result.Files)
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(result)
+	}
+}
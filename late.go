@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"logit/logg"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entries reported with ?ts= older than what a sender already stored are
+// late (e.g. a batch uploaded after an outage). -late decides what happens:
+const (
+	LATE_OFF    = "off"    // written in place, carrying their own time
+	LATE_DIVERT = "divert" // written to '<dir>/late/<file>.<event day>'
+	LATE_RESORT = "resort" // written in place; rotated files are sorted by time
+)
+
+// late entries of the default layout are kept below this directory
+const LATE_DIR = "late"
+
+// LOG_TIMESTAMP_HEADER says when an entry happened, for clients that can't
+// add ?ts= to the url
+const LOG_TIMESTAMP_HEADER = "X-Log-Timestamp"
+
+// eventTimeOf returns when an entry happened by the client: ?ts=, else the
+// X-Log-Timestamp header, else the first of -ts-fields a structured body has;
+// the zero time if it said nothing
+func eventTimeOf(param, header string, body []byte, isJSON bool) (time.Time, error) {
+	if param != "" {
+		return parseEventTime(param)
+	}
+
+	if header != "" {
+		t, err := parseEventTime(header)
+		if err != nil {
+			return t, fmt.Errorf("invalid %s header '%s' (expected RFC 3339 or unix time)", LOG_TIMESTAMP_HEADER, header)
+		}
+
+		return t, nil
+	}
+
+	if !isJSON || len(timeFields) == 0 {
+		return time.Time{}, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(body, &obj) != nil {
+		return time.Time{}, nil
+	}
+
+	for _, field := range timeFields {
+		raw, ok := obj[field]
+		if !ok {
+			continue
+		}
+
+		// a string, or a number of unix seconds or milliseconds
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+
+		t, err := parseEventTime(s)
+		if err != nil {
+			return t, fmt.Errorf("invalid time field '%s': %s (expected RFC 3339 or unix time)", field, raw)
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, nil
+}
+
+// parseEventTime parses the client's ?ts=: RFC 3339, or unix seconds
+// (fractions allowed) or milliseconds. "" is the zero time.
+func parseEventTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}, fmt.Errorf("invalid ts '%s' (expected RFC 3339 or unix time)", s)
+	}
+
+	if f > 1e12 {
+		// too far out for seconds; milliseconds
+		return time.UnixMilli(int64(f)), nil
+	}
+
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+}
+
+func parseLateMode(mode string) (string, error) {
+	switch mode {
+	case "", LATE_OFF:
+		return LATE_OFF, nil
+	case LATE_DIVERT, LATE_RESORT:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode '%s' (expected 'off', 'divert' or 'resort')", mode)
+	}
+}
+
+// isLate reports whether e happened before the newest entry stored under key
+// (less -late-tolerance), and otherwise remembers it as the newest. after a
+// restart the live file's modification time stands in for the newest entry.
+func (s *fileStorage) isLate(key string, e *entry) bool {
+	t := e.time()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	newest, ok := s.newest[key]
+	if !ok {
+		if fi, err := os.Stat(loggerPaths[key]); err == nil && fi.Size() > 0 {
+			newest = fi.ModTime()
+		}
+	}
+
+	if !newest.IsZero() && t.Before(newest.Add(-lateTolerance)) {
+		return true
+	}
+
+	if t.After(newest) {
+		newest = t
+	}
+	s.newest[key] = newest
+
+	return false
+}
+
+// latePath returns the file late entries of the day go to for the live file
+func (s *fileStorage) latePath(live string, day string) string {
+	return areaPath(s.dir, LATE_DIR, live) + "." + day
+}
+
+// lateLoggerOf returns the logger of the late file of e's day, nil when the
+// sender isn't written to a file
+func (s *fileStorage) lateLoggerOf(key string, e *entry) *logg.Logger {
+	day := e.time().Local().Format("2006-01-02")
+	lateKey := LATE_DIR + "/" + day + "/" + key
+
+	if senderLogger := logg.Lookup(lateKey); senderLogger != nil {
+		return senderLogger
+	}
+
+	lock.Lock()
+	live := loggerPaths[key]
+	lock.Unlock()
+
+	if live == "" {
+		return nil
+	}
+
+	senderLogger, err := logg.GetOrCreate(lateKey, func() (*logg.Logger, error) {
+		path := s.latePath(live, day)
+
+		if err := makeLogDir(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+
+		// one file per day, however large
+		l, err := logg.NewFileLoggerWithOptions("", path, logg.LOG_LEVEL_TRACE, -1, false, fileOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		setLineFormat(l)
+
+		lock.Lock()
+		loggerPaths[lateKey] = path
+		lock.Unlock()
+
+		return l, nil
+	})
+
+	if err != nil {
+		s.logger.Errorf("can't open late file for '%s': %v", key, err)
+		return nil
+	}
+
+	return senderLogger
+}
+
+// lateFiles returns the late files of a live file, oldest day first
+func (s *fileStorage) lateFiles(live string) []string {
+	files, _ := filepath.Glob(areaPath(s.dir, LATE_DIR, live) + ".[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]")
+	sort.Strings(files)
+
+	return files
+}
+
+// closeLateLoggers closes the late files of a sender's key
+func closeLateLoggers(key string) {
+	for lateKey, l := range logg.Loggers() {
+		if strings.HasPrefix(lateKey, LATE_DIR+"/") && strings.HasSuffix(lateKey, "/"+key) &&
+			strings.Count(lateKey, "/") == strings.Count(key, "/")+2 && logg.Unregister(lateKey, l) {
+			l.Close()
+
+			lock.Lock()
+			delete(loggerPaths, lateKey)
+			lock.Unlock()
+		}
+	}
+}
+
+// resortFile orders the entries of a rotated (still uncompressed) file by
+// time, keeping the order of entries of the same time; it runs as the
+// loggers' rotate hook in LATE_RESORT mode
+func resortFile(path string) {
+	r := &rawEntryReader{files: []string{path}}
+
+	var entries []*rawEntry
+	sorted := true
+
+	for {
+		e, err := r.read()
+		if err != nil {
+			serverLogger.Errorf("re-sorting '%s' failed: %v", path, err)
+			return
+		}
+
+		if e == nil {
+			break
+		}
+
+		if n := len(entries); n > 0 && e.t.Before(entries[n-1].t) {
+			sorted = false
+		}
+		entries = append(entries, e)
+	}
+
+	if sorted {
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].t.Before(entries[j].t)
+	})
+
+	if err := writeRawEntries(path, entries); err != nil {
+		serverLogger.Errorf("re-sorting '%s' failed: %v", path, err)
+	}
+}
+
+// writeRawEntries atomically replaces path, keeping its mode and mtime
+func writeRawEntries(path string, entries []*rawEntry) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+
+	for _, e := range entries {
+		if _, err = w.WriteString(e.text + "\n"); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"logit/logg"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// levelPolicy holds the minimum level each sender's files are written at,
+// from -sender-levels and changed at runtime through /admin/senders
+type levelPolicy struct {
+	senders *senderValues[logg.LogLevel]
+}
+
+func parseMinLevel(s string) (logg.LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if !logLevels[s] {
+		return 0, fmt.Errorf("invalid level '%s' (expected trace, debug, info, warn, error or fatal)", s)
+	}
+
+	return logg.LogLevelFrom(s, logg.LOG_LEVEL_DEBUG), nil
+}
+
+// newLevelPolicy parses "sender=level,..." (e.g. "chatty=warn,debugger=debug")
+func newLevelPolicy(spec string) (*levelPolicy, error) {
+	senders, err := parseSenderValues(spec, "level", "level", forSender(parseMinLevel))
+	if err != nil {
+		return nil, err
+	}
+
+	return &levelPolicy{senders: senders}, nil
+}
+
+func (p *levelPolicy) level(sender string) logg.LogLevel {
+	// everything clients send is written unless a level says otherwise
+	return p.senders.or(sender, logg.LOG_LEVEL_TRACE)
+}
+
+// set changes the level of a sender and of its open loggers (every area and
+// late file); a zero level goes back to writing all
+func (p *levelPolicy) set(sender string, level logg.LogLevel) {
+	if level == 0 {
+		p.senders.delete(sender)
+		level = logg.LOG_LEVEL_TRACE
+	} else {
+		p.senders.set(sender, level)
+	}
+
+	for key, l := range logg.Loggers() {
+		if key == sender || strings.HasSuffix(key, "/"+sender) {
+			l.SetLevel(level)
+		}
+	}
+}
+
+// update takes the levels of next, e.g. of a reloaded config, after
+// dropping those of removed senders, changing the open loggers as set does
+func (p *levelPolicy) update(next *levelPolicy, removed []string) {
+	for _, sender := range removed {
+		p.set(sender, 0)
+	}
+
+	for sender, level := range next.senders.all() {
+		p.set(sender, level)
+	}
+}
+
+type senderLevel struct {
+	Sender string `json:"sender"`
+	Level  string `json:"level"`
+}
+
+// makeSenderAdminHandler serves the minimum levels of senders:
+// GET /admin/senders lists the senders known (open or configured) with what
+// they wrote since start (see senderStatus),
+// GET|PUT|DELETE /admin/senders/<sender>/level reads, changes (?level= or
+// the body) or resets one, /admin/senders/<sender>/config the other
+// settings of its files (see serveSenderConfig) and POST
+// /admin/senders/<sender>/rotate cuts its file right away
+func makeSenderAdminHandler(p *levelPolicy) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/senders"), "/")
+
+		if rest == "" {
+			if req.Method != "GET" {
+				rw.Header().Set("Allow", "GET")
+				writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+				return
+			}
+
+			names := make(map[string]bool)
+
+			for key := range logg.Loggers() {
+				names[key[strings.LastIndex(key, "/")+1:]] = true
+			}
+
+			for sender := range p.senders.all() {
+				names[sender] = true
+			}
+
+			overrides.lock.RLock()
+			for sender := range overrides.values {
+				names[sender] = true
+			}
+			overrides.lock.RUnlock()
+
+			list := make([]senderStatus, 0, len(names))
+			for sender := range names {
+				list = append(list, statusOf(sender, p))
+			}
+
+			sort.Slice(list, func(i, j int) bool { return list[i].Sender < list[j].Sender })
+
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(list)
+			return
+		}
+
+		ss := strings.Split(rest, "/")
+		if len(ss) != 2 || (ss[1] != "level" && ss[1] != "config" && ss[1] != "rotate") || ss[0] == "" {
+			writeError(rw, ERR_SENDER_INVALID, "expected /admin/senders/<sender>/level, /admin/senders/<sender>/config or /admin/senders/<sender>/rotate")
+			return
+		}
+
+		sender, err := normalizeSender(ss[0])
+		if err != nil {
+			writeError(rw, ERR_SENDER_INVALID, "%v", err)
+			return
+		}
+		sender = aliases.resolve(sender)
+
+		switch ss[1] {
+		case "config":
+			serveSenderConfig(rw, req, sender, p)
+			return
+		case "rotate":
+			serveRotate(rw, req, sender, p)
+			return
+		}
+
+		switch req.Method {
+		case "GET":
+
+		case "PUT", "POST":
+			s := req.URL.Query().Get("level")
+			if s == "" {
+				b, _ := ioutil.ReadAll(req.Body)
+				s = string(b)
+			}
+
+			level, err := parseMinLevel(s)
+			if err != nil {
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			}
+
+			p.set(sender, level)
+			serverLogger.Infof("level of '%s' set to %s", sender, levelName(level))
+
+		case "DELETE":
+			p.set(sender, 0)
+			serverLogger.Infof("level of '%s' reset", sender)
+
+		default:
+			rw.Header().Set("Allow", "GET, PUT, DELETE")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(senderLevel{sender, levelName(p.level(sender))})
+	}
+}
+
+// serveRotate serves POST /admin/senders/<sender>/rotate, answering with the
+// sender's status once its file is cut
+func serveRotate(rw http.ResponseWriter, req *http.Request, sender string, p *levelPolicy) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+		return
+	}
+
+	switch err := store.Rotate(sender); err {
+	case nil:
+	case errSenderNotOpen:
+		writeError(rw, ERR_SENDER_INVALID, "'%s' has no open file", sender)
+		return
+	case errStorageUnsupported:
+		writeError(rw, ERR_BODY_INVALID, "%v", err)
+		return
+	default:
+		serverLogger.Errorf("rotating '%s' failed: %v", sender, err)
+		writeError(rw, ERR_INTERNAL, "rotating failed: %v", err)
+		return
+	}
+
+	serverLogger.Infof("file of '%s' rotated on request", sender)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(statusOf(sender, p))
+}
+
+// levelName is the name logit uses for a logg level
+func levelName(level logg.LogLevel) string {
+	switch level {
+	case logg.LOG_LEVEL_TRACE:
+		return "trace"
+	case logg.LOG_LEVEL_INFO:
+		return "info"
+	case logg.LOG_LEVEL_WARN:
+		return "warn"
+	case logg.LOG_LEVEL_ERROR:
+		return "error"
+	case logg.LOG_LEVEL_FATAL:
+		return "fatal"
+	default:
+		return "debug"
+	}
+}
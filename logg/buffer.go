@@ -0,0 +1,122 @@
+package logg
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BUFFER_TICK is how often the shards look for buffers whose interval passed
+const BUFFER_TICK = 100 * time.Millisecond
+
+var buffer_start sync.Once
+
+// lineBuffer holds the lines of a logger on their way to its writer; only
+// the logger's actor touches it
+type lineBuffer struct {
+	w       *bufio.Writer
+	target  io.Writer // what w writes to
+	flushed time.Time
+}
+
+// SetBuffer has the logger gather lines in a buffer of size bytes written
+// out when it fills, after interval, before the file is rotated, synced or
+// closed and on Flush and Shutdown, saving a write per line under heavy
+// load. lines wait in memory meanwhile, so a crash loses up to interval of
+// them; synchronous messages (a sync level, Fatalf) go out right away.
+// size 0 turns it off. it may be called at any time; a logger with a spill
+// file isn't buffered.
+func (logger *Logger) SetBuffer(size int, interval time.Duration) {
+	core := logger.core()
+
+	atomic.StoreInt64(&core.bufferSize, int64(size))
+	atomic.StoreInt64(&core.bufferInterval, int64(interval))
+
+	if size > 0 && interval > 0 {
+		buffer_start.Do(func() {
+			go func() {
+				for _ = range time.Tick(BUFFER_TICK) {
+					for _, s := range shards {
+						s.in.tryPush(logToken{op: TOKEN_BUFFERS})
+					}
+				}
+			}()
+		})
+	}
+}
+
+// bufferFor returns what the logger's lines to w go through: w itself, or
+// the buffer on it if the logger is buffered
+func (logger *Logger) bufferFor(w io.Writer) io.Writer {
+	size := int(atomic.LoadInt64(&logger.bufferSize))
+
+	if buf := logger.buffer; buf != nil && (buf.target != w || buf.w.Size() != size) {
+		// the file was reopened or the size changed
+		logger.dropBuffer()
+	}
+
+	if size <= 0 || logger.spill != nil {
+		return w
+	}
+
+	if logger.buffer == nil {
+		logger.buffer = &lineBuffer{w: bufio.NewWriterSize(w, size), target: w, flushed: time.Now()}
+	}
+
+	s := logger.shardOf()
+	if s.buffered == nil {
+		s.buffered = make(map[*Logger]bool)
+	}
+	s.buffered[logger] = true
+
+	return logger.buffer.w
+}
+
+// flushBuffer writes out what the logger's buffer holds; a write failing
+// loses it
+func (logger *Logger) flushBuffer() error {
+	buf := logger.buffer
+	if buf == nil {
+		return nil
+	}
+
+	delete(logger.shardOf().buffered, logger)
+	buf.flushed = time.Now()
+
+	if buf.w.Buffered() == 0 {
+		return nil
+	}
+
+	err := buf.w.Flush()
+	if err != nil {
+		logger.countDropped()
+		logger.reportError(err)
+		buf.w.Reset(buf.target)
+	}
+
+	return err
+}
+
+// dropBuffer flushes the logger's buffer and lets go of it, when its writer
+// goes away
+func (logger *Logger) dropBuffer() {
+	logger.flushBuffer()
+	logger.buffer = nil
+}
+
+// flushBuffers writes out the buffers of the shard's loggers; with expired
+// only of those whose interval passed
+func (s *shard) flushBuffers(expired bool) {
+	now := time.Now()
+
+	for logger := range s.buffered {
+		buf := logger.buffer
+		interval := time.Duration(atomic.LoadInt64(&logger.bufferInterval))
+
+		if buf == nil || !expired || (interval > 0 && now.Sub(buf.flushed) >= interval) {
+			logger.flushBuffer()
+		}
+	}
+}
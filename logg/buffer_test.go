@@ -0,0 +1,56 @@
+package logg
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func benchmarkFileWrites(b *testing.B, size int, interval time.Duration) {
+	logger, err := NewFileLogger("", filepath.Join(b.TempDir(), "bench.log"), LOG_LEVEL_DEBUG, 0, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer logger.Close()
+
+	logger.SetBuffer(size, interval)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		logger.Infof("request %d served in %v", i, time.Millisecond)
+	}
+
+	// the lines are only written once the actor is through with them
+	Flush()
+}
+
+func BenchmarkFileWritesUnbuffered(b *testing.B) {
+	benchmarkFileWrites(b, 0, 0)
+}
+
+func BenchmarkFileWritesBuffered(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(byteSize(size), func(b *testing.B) {
+			benchmarkFileWrites(b, size, time.Second)
+		})
+	}
+}
+
+func BenchmarkFileWritesFlushInterval(b *testing.B) {
+	for _, interval := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+		b.Run(interval.String(), func(b *testing.B) {
+			benchmarkFileWrites(b, 64<<10, interval)
+		})
+	}
+}
+
+func byteSize(n int) string {
+	if n >= 1<<20 {
+		return strconv.Itoa(n>>20) + "MiB"
+	}
+
+	return strconv.Itoa(n>>10) + "KiB"
+}
@@ -0,0 +1,70 @@
+package logg
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// the function names of this package start with it, e.g.
+// 'logit/logg.(*Logger).Infof'
+var pkg_prefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+
+	slash := strings.LastIndex(name, "/")
+	return name[:slash+strings.IndexByte(name[slash:], '.')+1]
+}()
+
+// EnableCaller makes the logger note the file and line of the code that
+// logs each message, e.g. 'server.go:42: ' before the level in text lines
+// and "caller" in JSON ones. it costs a stack walk per message, which is
+// done by the logging goroutine before the message is queued.
+func (logger *Logger) EnableCaller(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+
+	atomic.StoreInt32(&logger.core().caller, v)
+}
+
+// packages whose frames callerOf passes by too, since they log through
+// NewSlogHandler and Writer
+var caller_skipped = []string{"log/slog.", "log."}
+
+// callerOf returns 'file.go:line' of the first caller outside the package
+// and the standard loggers
+func callerOf() string {
+	var pcs [32]uintptr
+
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		f, more := frames.Next()
+		if !skippedCaller(f.Function) {
+			return filepath.Base(f.File) + ":" + strconv.Itoa(f.Line)
+		}
+
+		if !more {
+			return ""
+		}
+	}
+}
+
+func skippedCaller(function string) bool {
+	if strings.HasPrefix(function, pkg_prefix) {
+		return true
+	}
+
+	for _, prefix := range caller_skipped {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package logg
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type ColorMode int
+
+const (
+	COLOR_NEVER  ColorMode = iota // plain lines, the default
+	COLOR_AUTO                    // colors if the writer is a terminal and NO_COLOR isn't set
+	COLOR_ALWAYS                  // colors whatever the writer
+)
+
+// ANSI colors of the level tags of text lines
+var level_colors = map[LogLevel]string{
+	LOG_LEVEL_TRACE: "\x1b[90m", // gray
+	LOG_LEVEL_DEBUG: "\x1b[90m",
+	LOG_LEVEL_INFO:  "\x1b[36m", // cyan
+	LOG_LEVEL_WARN:  "\x1b[33m", // yellow
+	LOG_LEVEL_ERROR: "\x1b[31m", // red
+	LOG_LEVEL_FATAL: "\x1b[1;31m",
+}
+
+const color_reset = "\x1b[0m"
+
+func ColorModeFrom(s string, defaultMode ColorMode) ColorMode {
+	switch strings.ToLower(s) {
+	case "never", "off":
+		return COLOR_NEVER
+	case "auto":
+		return COLOR_AUTO
+	case "always", "on":
+		return COLOR_ALWAYS
+	default:
+		return defaultMode
+	}
+}
+
+// SetColor makes the level tags of the logger's text lines colored on its
+// writer, e.g. '(ERRO)' red and '(WARN)' yellow; sinks and JSON lines stay
+// plain. COLOR_AUTO looks at the writer once, when it is called.
+func (logger *Logger) SetColor(mode ColorMode) {
+	core := logger.core()
+
+	var v int32
+	switch mode {
+	case COLOR_ALWAYS:
+		v = 1
+	case COLOR_AUTO:
+		if core.l != nil && isTerminal(core.l.Writer()) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" {
+			v = 1
+		}
+	}
+
+	atomic.StoreInt32(&core.colored, v)
+}
+
+// isTerminal tells whether w is a character device like a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorTag wraps the tag of a level in its color; tags of levels without
+// one stay as they are
+func colorTag(level LogLevel, tag string) string {
+	color, ok := level_colors[level]
+	if !ok || tag == "" {
+		return tag
+	}
+
+	return color + strings.TrimSuffix(tag, " ") + color_reset + " "
+}
@@ -0,0 +1,205 @@
+package logg
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Codec is what rotated files are compressed with
+type Codec int32
+
+const (
+	GZIP Codec = iota
+	ZSTD
+)
+
+// CompressedSuffixes are what the codecs' files end in
+var CompressedSuffixes = []string{".gz", ".zst"}
+
+// ParseCodec parses a codec's name: 'gzip' or 'zstd'
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "gzip", "gz":
+		return GZIP, nil
+	case "zstd", "zst":
+		return ZSTD, nil
+	default:
+		return GZIP, fmt.Errorf("invalid codec '%s' (expected gzip or zstd)", s)
+	}
+}
+
+func (c Codec) String() string {
+	if c == ZSTD {
+		return "zstd"
+	}
+	return "gzip"
+}
+
+// Suffix returns what files compressed with c end in
+func (c Codec) Suffix() string {
+	return CompressedSuffixes[c]
+}
+
+// CodecOf returns the codec a file was compressed with by its name; false
+// if it wasn't
+func CodecOf(path string) (Codec, bool) {
+	for c, suffix := range CompressedSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return Codec(c), true
+		}
+	}
+
+	return GZIP, false
+}
+
+// NewWriter returns a writer compressing to w at level: 1 (fastest) to 9
+// for gzip, 1 to 22 for zstd, 0 being the codec's default
+func (c Codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if c == ZSTD {
+		return NewZstdWriter(w, level)
+	}
+
+	if level == 0 {
+		level = gzip.DefaultCompression
+	} else if level < 1 || level > 9 {
+		return nil, fmt.Errorf("gzip: invalid level %d (expected 1 to 9)", level)
+	}
+
+	return gzip.NewWriterLevel(w, level)
+}
+
+// NewReader returns a reader decompressing r
+func (c Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if c == ZSTD {
+		return NewZstdReader(r)
+	}
+
+	return gzip.NewReader(r)
+}
+
+// compressedExists tells whether path was compressed with any codec, or
+// encrypted
+func compressedExists(path string) bool {
+	for _, suffix := range RotatedSuffixes() {
+		if _, err := os.Stat(path + suffix); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetCompression picks the codec and level (see Codec.NewWriter) of
+// rotated files; it may be called at any time and applies from the next
+// rotation. the default is gzip at its default level.
+func (logger *Logger) SetCompression(codec Codec, level int) {
+	core := logger.core()
+
+	atomic.StoreInt32(&core.compressCodec, int32(codec))
+	atomic.StoreInt32(&core.compressLevel, int32(level))
+}
+
+const (
+	COMPRESS_WORKERS = 2
+	COMPRESS_QUEUE   = 256 // rotations waiting; more run on their own goroutine
+)
+
+var (
+	compress_start sync.Once
+	compress_jobs  chan retention
+	compress_wg    sync.WaitGroup // of retentions queued or running
+
+	compress_pending int64 // atomic
+	compress_errors  int64 // atomic
+	compress_handler atomic.Value
+)
+
+// SetCompressErrorHandler has fn called, off the actors, with each rotated
+// file that couldn't be compressed (it is left uncompressed)
+func SetCompressErrorHandler(fn func(path string, err error)) {
+	compress_handler.Store(fn)
+}
+
+// PendingCompressions returns how many rotated files wait to be hooked,
+// compressed and pruned
+func PendingCompressions() int64 {
+	return atomic.LoadInt64(&compress_pending)
+}
+
+// CompressErrors returns how many rotated files couldn't be compressed
+func CompressErrors() int64 {
+	return atomic.LoadInt64(&compress_errors)
+}
+
+// WaitCompressions waits until the rotated files queued so far are done
+// with, or ctx ends
+func WaitCompressions(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		compress_wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queueRetention hands the work following a rotation to the compression
+// workers. the actor calls it, so it never blocks: with the queue full the
+// work gets a goroutine of its own.
+func queueRetention(r retention) {
+	compress_start.Do(func() {
+		compress_jobs = make(chan retention, COMPRESS_QUEUE)
+
+		for i := 0; i < COMPRESS_WORKERS; i++ {
+			go func() {
+				for r := range compress_jobs {
+					r.done()
+				}
+			}()
+		}
+	})
+
+	// a crash before it is done leaves the compression to RecoverRotations
+	if r.gz {
+		r.noted = notePending(r)
+	}
+
+	compress_wg.Add(1)
+	atomic.AddInt64(&compress_pending, 1)
+
+	select {
+	case compress_jobs <- r:
+	default:
+		go r.done()
+	}
+}
+
+// done runs r and accounts for it
+func (r retention) done() {
+	defer compress_wg.Done()
+	defer atomic.AddInt64(&compress_pending, -1)
+
+	if r.noted {
+		defer noteDone(r)
+	}
+
+	if err := r.run(); err != nil {
+		atomic.AddInt64(&compress_errors, 1)
+
+		if fn, ok := compress_handler.Load().(func(path string, err error)); ok {
+			fn(r.rotated, err)
+		}
+	}
+}
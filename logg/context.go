@@ -0,0 +1,119 @@
+package logg
+
+import (
+	"context"
+	"sync"
+)
+
+type loggerKey struct{}
+type fieldsKey struct{}
+
+var (
+	context_default      *Logger
+	context_default_once = &sync.Once{}
+)
+
+// NewContext returns a copy of ctx carrying logger, see FromContext
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger ctx carries, or a default logger writing
+// where SetDefaultLogger said; fields of ctx are attached to either
+func FromContext(ctx context.Context) *Logger {
+	logger, _ := ctx.Value(loggerKey{}).(*Logger)
+	if logger == nil {
+		context_default_once.Do(func() {
+			context_default = GetDefaultLogger("")
+		})
+		logger = context_default
+	}
+
+	return logger.WithContext(ctx)
+}
+
+// ContextWithFields returns a copy of ctx carrying fields, e.g. a request or
+// trace id, on top of those ctx carries already; the *Ctx methods and
+// WithContext add them to messages
+func ContextWithFields(ctx context.Context, fields Fields) context.Context {
+	merged := make(Fields, len(fields))
+
+	for k, v := range FieldsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FieldsFromContext returns the fields ctx carries; the map must not be
+// changed
+func FieldsFromContext(ctx context.Context) Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+// WithContext returns a logger adding the fields of ctx to every message,
+// or logger itself if ctx carries none
+func (logger *Logger) WithContext(ctx context.Context) *Logger {
+	fields := FieldsFromContext(ctx)
+	if len(fields) == 0 {
+		return logger
+	}
+
+	return logger.WithFields(fields)
+}
+
+// LogCtx is Log with the fields of ctx added; fields given override them
+func (logger *Logger) LogCtx(ctx context.Context, level LogLevel, fields Fields, format string, v ...interface{}) {
+	logger._log(level, level, level == LOG_LEVEL_FATAL, ctxFields(ctx, fields), format, v...)
+}
+
+func (logger *Logger) TraceCtx(ctx context.Context, format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_TRACE, LOG_LEVEL_TRACE, false, FieldsFromContext(ctx), format, v...)
+}
+
+func (logger *Logger) DebugCtx(ctx context.Context, format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_DEBUG, LOG_LEVEL_DEBUG, false, FieldsFromContext(ctx), format, v...)
+}
+
+func (logger *Logger) InfoCtx(ctx context.Context, format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_INFO, LOG_LEVEL_INFO, false, FieldsFromContext(ctx), format, v...)
+}
+
+func (logger *Logger) WarnCtx(ctx context.Context, format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_WARN, LOG_LEVEL_WARN, false, FieldsFromContext(ctx), format, v...)
+}
+
+func (logger *Logger) ErrorCtx(ctx context.Context, format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_ERROR, LOG_LEVEL_ERROR, false, FieldsFromContext(ctx), format, v...)
+}
+
+// FatalCtx is Fatalf with the fields of ctx added
+func (logger *Logger) FatalCtx(ctx context.Context, format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_FATAL, LOG_LEVEL_FATAL, true, FieldsFromContext(ctx), format, v...)
+	logger.afterFatal(context.Background(), format, v...)
+}
+
+// ctxFields returns the fields of ctx overridden by fields
+func ctxFields(ctx context.Context, fields Fields) Fields {
+	base := FieldsFromContext(ctx)
+	if len(base) == 0 {
+		return fields
+	} else if len(fields) == 0 {
+		return base
+	}
+
+	merged := make(Fields, len(base)+len(fields))
+
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return merged
+}
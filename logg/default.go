@@ -0,0 +1,60 @@
+package logg
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	default_lock   = &sync.Mutex{}
+	default_logger *Logger // see Default
+	default_format Format
+)
+
+// Default returns the package's default logger, which has no prefix and
+// writes as SetDefaultLogger and ConfigureFromEnv say; it is created on
+// first use
+func Default() *Logger {
+	default_lock.Lock()
+	defer default_lock.Unlock()
+
+	if default_logger == nil {
+		default_logger = NewLoggerWithFormat("", default_w, default_log_level, default_format)
+	}
+
+	return default_logger
+}
+
+// the functions below log through Default, for programs that need no more
+// than the standard log package's setup
+
+func Tracef(format string, v ...interface{}) {
+	Default().Tracef(format, v...)
+}
+
+func Debugf(format string, v ...interface{}) {
+	Default().Debugf(format, v...)
+}
+
+func Infof(format string, v ...interface{}) {
+	Default().Infof(format, v...)
+}
+
+func Warnf(format string, v ...interface{}) {
+	Default().Warnf(format, v...)
+}
+
+func Errorf(format string, v ...interface{}) {
+	Default().Errorf(format, v...)
+}
+
+// Fatalf waits until the message is written, then acts by the default
+// logger's FatalPolicy
+func Fatalf(format string, v ...interface{}) {
+	Default().Fatalf(format, v...)
+}
+
+// FatalfWait is Fatalf waiting only until ctx ends, see Logger.FatalfWait
+func FatalfWait(ctx context.Context, format string, v ...interface{}) error {
+	return Default().FatalfWait(ctx, format, v...)
+}
@@ -0,0 +1,48 @@
+package logg
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errRefused = errors.New("refused")
+
+type refusingWriter struct{}
+
+func (refusingWriter) Write(b []byte) (int, error) {
+	return 0, errRefused
+}
+
+// a message waited for isn't reported written unless it is in the file
+func TestLogDurableErrors(t *testing.T) {
+	ctx := context.Background()
+
+	refused := NewLogger("", refusingWriter{}, LOG_LEVEL_DEBUG)
+	if err := refused.LogDurable(ctx, time.Time{}, LOG_LEVEL_INFO, nil, "x"); !errors.Is(err, errRefused) {
+		t.Errorf("refused write: got %v, expected %v", err, errRefused)
+	}
+
+	if err := refused.PrintfWait(ctx, "x"); !errors.Is(err, errRefused) {
+		t.Errorf("refused PrintfWait: got %v, expected %v", err, errRefused)
+	}
+
+	logger, err := NewFileLogger("", filepath.Join(t.TempDir(), "a.log"), LOG_LEVEL_DEBUG, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := logger.LogDurable(ctx, time.Time{}, LOG_LEVEL_INFO, nil, "x"); err != nil {
+		t.Errorf("write: %v", err)
+	}
+
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := logger.LogDurable(ctx, time.Time{}, LOG_LEVEL_INFO, nil, "x"); err != ErrDropped {
+		t.Errorf("write after close: got %v, expected %v", err, ErrDropped)
+	}
+}
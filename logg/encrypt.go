@@ -0,0 +1,83 @@
+package logg
+
+import (
+	"io"
+	"os"
+)
+
+// ENCRYPTED_SUFFIX ends the names of rotated files encrypted by
+// SetEncryption, after the codec's suffix if compressed
+const ENCRYPTED_SUFFIX = ".enc"
+
+// Sealer encrypts rotated files: Seal returns a writer encrypting what is
+// written to it into w, complete once closed
+type Sealer interface {
+	Seal(w io.Writer) (io.WriteCloser, error)
+}
+
+// SetEncryption has each rotated file encrypted with s once compressed,
+// into its name plus ENCRYPTED_SUFFIX, before the archive hook sees it and
+// old files are pruned; nil turns it off. it must be called before the
+// logger rotates.
+func (logger *Logger) SetEncryption(s Sealer) {
+	logger.core().sealer = s
+}
+
+// RotatedSuffixes are what rotated files may end in after their name: the
+// codecs' suffixes, each of them encrypted, and ENCRYPTED_SUFFIX alone
+func RotatedSuffixes() []string {
+	suffixes := make([]string, 0, 2*len(CompressedSuffixes)+1)
+
+	for _, suffix := range CompressedSuffixes {
+		suffixes = append(suffixes, suffix, suffix+ENCRYPTED_SUFFIX)
+	}
+
+	return append(suffixes, ENCRYPTED_SUFFIX)
+}
+
+// EncryptFile encrypts path with s into path plus ENCRYPTED_SUFFIX and
+// removes path; like CompressFileWith it goes by way of a '.tmp' file and
+// keeps the mode and owner of path
+func EncryptFile(path string, s Sealer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp := path + ENCRYPTED_SUFFIX + ".tmp"
+
+	w, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DEFAULT_FILE_MODE)
+	if err != nil {
+		return err
+	}
+
+	if fi, serr := f.Stat(); serr == nil {
+		w.Chmod(fi.Mode().Perm())
+		chownLike(w, fi)
+	}
+
+	sw, err := s.Seal(w)
+	if err == nil {
+		_, err = io.Copy(sw, f)
+		if cerr := sw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if serr := w.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+ENCRYPTED_SUFFIX)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(path)
+}
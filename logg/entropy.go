@@ -0,0 +1,826 @@
+package logg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// fseSpread lays out the symbols of a distribution over the states the
+// way both ends of the stream do
+func fseSpread(norm []int16, tableLog uint) []uint8 {
+	size := 1 << tableLog
+	symbols := make([]uint8, size)
+
+	// below-1 symbols take the last states, the first of them the very last
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	pos := 0
+
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+
+	return symbols
+}
+
+type fseCell struct {
+	symbol uint8
+	nbBits uint8
+	base   uint16
+}
+
+type fseDecodeTable struct {
+	tableLog uint
+	cells    []fseCell
+}
+
+func newFseDecodeTable(norm []int16, tableLog uint) *fseDecodeTable {
+	size := 1 << tableLog
+	symbols := fseSpread(norm, tableLog)
+
+	next := make([]int, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = int(n)
+		}
+	}
+
+	t := &fseDecodeTable{tableLog: tableLog, cells: make([]fseCell, size)}
+
+	for u, s := range symbols {
+		state := next[s]
+		next[s]++
+
+		nb := int(tableLog) - (bits.Len(uint(state)) - 1)
+
+		t.cells[u] = fseCell{symbol: s, nbBits: uint8(nb), base: uint16(state<<uint(nb) - size)}
+	}
+
+	return t
+}
+
+// rleDecodeTable always decodes symbol, reading nothing
+func rleDecodeTable(symbol uint8) *fseDecodeTable {
+	return &fseDecodeTable{cells: []fseCell{{symbol: symbol}}}
+}
+
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+type fseEncodeTable struct {
+	tableLog   uint
+	stateTable []uint16
+	symbols    []fseSymbolTransform
+}
+
+func newFseEncodeTable(norm []int16, tableLog uint) *fseEncodeTable {
+	size := 1 << tableLog
+	symbols := fseSpread(norm, tableLog)
+
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+
+	t := &fseEncodeTable{
+		tableLog:   tableLog,
+		stateTable: make([]uint16, size),
+		symbols:    make([]fseSymbolTransform, len(norm)),
+	}
+
+	for u, s := range symbols {
+		t.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := 0
+
+	for s, n := range norm {
+		switch n {
+		case 0:
+			t.symbols[s].deltaNbBits = uint32((tableLog+1)<<16) - uint32(size)
+		case -1, 1:
+			t.symbols[s] = fseSymbolTransform{uint32(tableLog<<16) - uint32(size), int32(total - 1)}
+			total++
+		default:
+			maxBitsOut := tableLog - uint(bits.Len(uint(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+
+			t.symbols[s] = fseSymbolTransform{uint32(maxBitsOut<<16) - minStatePlus, int32(total - int(n))}
+			total += int(n)
+		}
+	}
+
+	return t
+}
+
+type fseEncoder struct {
+	t     *fseEncodeTable
+	value uint32
+}
+
+// init starts with the last symbol of the stream, which is decoded first.
+// without a table the encoder writes nothing, for a mode of one symbol.
+func (e *fseEncoder) init(t *fseEncodeTable, symbol uint8) {
+	e.t = t
+	if t == nil {
+		return
+	}
+
+	tt := t.symbols[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+
+	e.value = uint32(t.stateTable[int32(value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *fseEncoder) encode(bw *bitWriter, symbol uint8) {
+	if e.t == nil {
+		return
+	}
+
+	tt := e.t.symbols[symbol]
+	nbBitsOut := (e.value + tt.deltaNbBits) >> 16
+
+	bw.add(uint64(e.value), uint(nbBitsOut))
+	e.value = uint32(e.t.stateTable[int32(e.value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *fseEncoder) flush(bw *bitWriter) {
+	if e.t == nil {
+		return
+	}
+
+	bw.add(uint64(e.value), e.t.tableLog)
+}
+
+// bitWriter writes the little-endian bit streams that are read from the end
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+// add adds the low n bits of v, n being 32 at most
+func (bw *bitWriter) add(v uint64, n uint) {
+	bw.acc |= (v & (1<<n - 1)) << bw.n
+	bw.n += n
+
+	if bw.n >= 32 {
+		bw.out = append(bw.out, byte(bw.acc), byte(bw.acc>>8), byte(bw.acc>>16), byte(bw.acc>>24))
+		bw.acc >>= 32
+		bw.n -= 32
+	}
+}
+
+// close marks the end with a 1 bit, padding the last byte
+func (bw *bitWriter) close() []byte {
+	bw.add(1, 1)
+
+	return bw.bytes()
+}
+
+// bytes returns what was added, the last byte padded, without the end mark
+// of close
+func (bw *bitWriter) bytes() []byte {
+	for bw.n > 0 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+
+		if bw.n < 8 {
+			bw.n = 0
+		} else {
+			bw.n -= 8
+		}
+	}
+
+	return bw.out
+}
+
+// bitReader reads a stream of bitWriter backwards
+type bitReader struct {
+	b        []byte
+	pos      int  // bits left
+	overflow bool // more bits read than there were
+}
+
+func newBitReader(b []byte) (*bitReader, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+
+	return &bitReader{b: b, pos: (len(b)-1)*8 + bits.Len8(b[len(b)-1]) - 1}, nil
+}
+
+func (br *bitReader) read(n uint) uint32 {
+	v := br.peek(n)
+
+	if br.pos -= int(n); br.pos < 0 {
+		br.overflow = true
+		br.pos = 0
+	}
+
+	return v
+}
+
+// peek returns the next n bits, those past the start being 0
+func (br *bitReader) peek(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+
+	pos := br.pos - int(n)
+	if pos < 0 {
+		return br.peek(uint(br.pos)) << uint(-pos)
+	}
+
+	var word [8]byte
+	copy(word[:], br.b[pos>>3:])
+
+	return uint32(binary.LittleEndian.Uint64(word[:]) >> uint(pos&7) & (1<<n - 1))
+}
+
+// readNCount reads the description of an FSE table (RFC 8878 4.1.1) of
+// up to maxSymbols symbols and an accuracy log up to maxLog, returning
+// the distribution, its accuracy log and the bytes it took
+func readNCount(b []byte, maxSymbols int, maxLog uint) ([]int16, uint, int, error) {
+	pos := uint(0)
+
+	peek := func(n uint) int {
+		var word [8]byte
+		if int(pos>>3) < len(b) {
+			copy(word[:], b[pos>>3:])
+		}
+
+		return int(binary.LittleEndian.Uint64(word[:]) >> (pos & 7) & (1<<n - 1))
+	}
+
+	tableLog := uint(peek(4)) + 5
+	pos += 4
+
+	if tableLog > maxLog {
+		return nil, 0, 0, errZstdCorrupt
+	}
+
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbBits := tableLog + 1
+
+	var norm []int16
+	previous0 := false
+
+	zeros := func(n int) bool {
+		for ; n > 0; n-- {
+			norm = append(norm, 0)
+		}
+		return len(norm) < maxSymbols
+	}
+
+	for remaining > 1 {
+		if previous0 {
+			for peek(16) == 0xFFFF {
+				if pos += 16; !zeros(24) {
+					return nil, 0, 0, errZstdCorrupt
+				}
+			}
+
+			for peek(2) == 3 {
+				if pos += 2; !zeros(3) {
+					return nil, 0, 0, errZstdCorrupt
+				}
+			}
+
+			n := peek(2)
+			if pos += 2; !zeros(n) {
+				return nil, 0, 0, errZstdCorrupt
+			}
+		}
+
+		if len(norm) >= maxSymbols {
+			return nil, 0, 0, errZstdCorrupt
+		}
+
+		max := 2*threshold - 1 - remaining
+		count := peek(nbBits - 1)
+
+		if count < max {
+			pos += nbBits - 1
+		} else {
+			if count = peek(nbBits); count >= threshold {
+				count -= max
+			}
+			pos += nbBits
+		}
+
+		count-- // -1 is a probability below 1
+
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+
+		norm = append(norm, int16(count))
+		previous0 = count == 0
+
+		if remaining < 1 || int(pos>>3) > len(b) {
+			return nil, 0, 0, errZstdCorrupt
+		}
+
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	if remaining != 1 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+
+	return norm, tableLog, int((pos + 7) >> 3), nil
+}
+
+// writeNCount describes an FSE table the way readNCount reads it
+func writeNCount(norm []int16, tableLog uint) []byte {
+	bw := &bitWriter{}
+	bw.add(uint64(tableLog-5), 4)
+
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbBits := tableLog + 1
+	previous0 := false
+
+	for s := 0; s < len(norm) && remaining > 1; {
+		if previous0 {
+			start := s
+			for norm[s] == 0 {
+				s++
+			}
+
+			for ; s >= start+24; start += 24 {
+				bw.add(0xFFFF, 16)
+			}
+			for ; s >= start+3; start += 3 {
+				bw.add(3, 2)
+			}
+			bw.add(uint64(s-start), 2)
+		}
+
+		count := int(norm[s])
+		s++
+
+		max := 2*threshold - 1 - remaining
+
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+
+		if count++; count >= threshold {
+			count += max
+		}
+
+		n := nbBits
+		if count < max {
+			n--
+		}
+		bw.add(uint64(count), n)
+
+		previous0 = count == 1
+
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	return bw.bytes()
+}
+
+// normalizeCounts scales counts, of total, to add up to 1<<tableLog,
+// leaving none that was counted at 0; nil if that can't be done
+func normalizeCounts(counts []int, total int, tableLog uint) []int16 {
+	size := 1 << tableLog
+	norm := make([]int16, len(counts))
+
+	sum, largest := 0, 0
+
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		n := c * size / total
+		if n < 1 {
+			n = 1
+		}
+
+		norm[s] = int16(n)
+		sum += n
+
+		if norm[s] > norm[largest] {
+			largest = s
+		}
+	}
+
+	if norm[largest] += int16(size - sum); norm[largest] < 1 || int(norm[largest]) == size {
+		return nil
+	}
+
+	// up to the last symbol counted
+	last := len(norm)
+	for last > 0 && norm[last-1] == 0 {
+		last--
+	}
+
+	return norm[:last]
+}
+
+const (
+	HUFFMAN_MAX_BITS     = 11
+	huffmanMaxWeightLog  = 6
+	huffmanMinLiterals   = 64 // below this literals stay raw
+	huffmanSingleStream  = 1023
+	huffmanWeightSymbols = HUFFMAN_MAX_BITS + 2
+)
+
+// huffmanCode is a prefix code of byte values, the way zstd derives it
+// from the weights in a block
+type huffmanCode struct {
+	maxBits uint
+	lens    [256]uint8
+	codes   [256]uint16
+}
+
+// newHuffmanCode builds the code of the counted bytes, with codes of at
+// most HUFFMAN_MAX_BITS; the counts are scaled down until they fit
+func newHuffmanCode(counts *[256]int) *huffmanCode {
+	type node struct {
+		count  int
+		parent int
+	}
+
+	var symbols []int
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+
+	scaled := *counts
+
+	for {
+		sort.SliceStable(symbols, func(i, j int) bool {
+			return scaled[symbols[i]] < scaled[symbols[j]]
+		})
+
+		// two queues: the leaves sorted, the inner nodes as merged
+		n := len(symbols)
+		nodes := make([]node, n, 2*n)
+		for i, s := range symbols {
+			nodes[i] = node{scaled[s], -1}
+		}
+
+		leaf, inner := 0, n
+		pick := func() int {
+			if leaf < n && (inner >= len(nodes) || nodes[leaf].count <= nodes[inner].count) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+
+		for k := 0; k < n-1; k++ {
+			a, b := pick(), pick()
+
+			nodes = append(nodes, node{nodes[a].count + nodes[b].count, -1})
+			nodes[a].parent, nodes[b].parent = len(nodes)-1, len(nodes)-1
+		}
+
+		depths := make([]uint, len(nodes))
+		maxBits := uint(0)
+
+		for i := len(nodes) - 2; i >= 0; i-- {
+			depths[i] = depths[nodes[i].parent] + 1
+
+			if i < n && depths[i] > maxBits {
+				maxBits = depths[i]
+			}
+		}
+
+		if maxBits <= HUFFMAN_MAX_BITS {
+			h := &huffmanCode{maxBits: maxBits}
+			for i, s := range symbols {
+				h.lens[s] = uint8(depths[i])
+			}
+
+			h.assign()
+			return h
+		}
+
+		for _, s := range symbols {
+			scaled[s] = (scaled[s] + 1) / 2
+		}
+	}
+}
+
+// weight returns the zstd weight of a byte value, 0 if it has no code
+func (h *huffmanCode) weight(s int) uint8 {
+	if h.lens[s] == 0 {
+		return 0
+	}
+
+	return uint8(h.maxBits + 1 - uint(h.lens[s]))
+}
+
+// assign gives out the codes: longer ones first, each length in order of
+// byte value
+func (h *huffmanCode) assign() {
+	next := uint(0)
+
+	for w := uint(1); w <= h.maxBits; w++ {
+		for s := 0; s < 256; s++ {
+			if uint(h.weight(s)) == w {
+				h.codes[s] = uint16(next >> (w - 1))
+				next += 1 << (w - 1)
+			}
+		}
+	}
+}
+
+// description writes the weights of the code (RFC 8878 4.2.1), the last
+// one left to be deduced; false if they don't fit either way
+func (h *huffmanCode) description() ([]byte, bool) {
+	last := 255
+	for h.lens[last] == 0 {
+		last--
+	}
+
+	weights := make([]uint8, last)
+	for s := range weights {
+		weights[s] = h.weight(s)
+	}
+
+	if fse, ok := compressWeights(weights); ok && (len(fse) < (last+1)/2 || last > 128) {
+		return append([]byte{byte(len(fse))}, fse...), true
+	}
+
+	if last > 128 {
+		return nil, false
+	}
+
+	out := []byte{byte(127 + last)}
+	for i := 0; i < last; i += 2 {
+		b := weights[i] << 4
+		if i+1 < last {
+			b |= weights[i+1]
+		}
+		out = append(out, b)
+	}
+
+	return out, true
+}
+
+// compressWeights FSE codes weights with two interleaved states, checking
+// that they read back
+func compressWeights(weights []uint8) ([]byte, bool) {
+	if len(weights) < 2 {
+		return nil, false
+	}
+
+	counts := make([]int, huffmanWeightSymbols)
+	for _, w := range weights {
+		counts[w]++
+	}
+
+	norm := normalizeCounts(counts, len(weights), huffmanMaxWeightLog)
+	if norm == nil {
+		return nil, false
+	}
+
+	t := newFseEncodeTable(norm, huffmanMaxWeightLog)
+
+	bw := &bitWriter{out: writeNCount(norm, huffmanMaxWeightLog)}
+	header := len(bw.out)
+
+	// weight i is the first state's if i is even; backwards, as ever
+	var states [2]fseEncoder
+	n := len(weights)
+
+	states[(n-1)&1].init(t, weights[n-1])
+	states[(n-2)&1].init(t, weights[n-2])
+
+	for i := n - 3; i >= 0; i-- {
+		states[i&1].encode(bw, weights[i])
+	}
+
+	states[1].flush(bw)
+	states[0].flush(bw)
+
+	out := bw.close()
+
+	if len(out) >= 128 {
+		return nil, false
+	}
+
+	back, err := decompressWeights(out[:header], out[header:])
+	if err != nil || !bytes.Equal(back, weights) {
+		return nil, false
+	}
+
+	return out, true
+}
+
+// decompressWeights reads the weights compressWeights codes in stream,
+// with the table described in ncount
+func decompressWeights(ncount, stream []byte) ([]uint8, error) {
+	norm, tableLog, n, err := readNCount(ncount, huffmanWeightSymbols, huffmanMaxWeightLog)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(ncount) {
+		return nil, errZstdCorrupt
+	}
+
+	t := newFseDecodeTable(norm, tableLog)
+
+	br, err := newBitReader(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	states := [2]uint32{br.read(tableLog), br.read(tableLog)}
+	if br.overflow {
+		return nil, errZstdCorrupt
+	}
+
+	var weights []uint8
+
+	// until a state reads past the start; the other one then has the
+	// last weight
+	for i := 0; len(weights) < 255; i ^= 1 {
+		cell := t.cells[states[i]]
+		weights = append(weights, cell.symbol)
+		states[i] = uint32(cell.base) + br.read(uint(cell.nbBits))
+
+		if br.overflow {
+			return append(weights, t.cells[states[i^1]].symbol), nil
+		}
+	}
+
+	return nil, errZstdCorrupt
+}
+
+// encode appends the Huffman stream of lits, coded backwards, to out
+func (h *huffmanCode) encode(out, lits []byte) []byte {
+	bw := &bitWriter{out: out}
+
+	for i := len(lits) - 1; i >= 0; i-- {
+		s := lits[i]
+		bw.add(uint64(h.codes[s]), uint(h.lens[s]))
+	}
+
+	return bw.close()
+}
+
+type huffmanCell struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// huffmanTable decodes the code described by a block's weights
+type huffmanTable struct {
+	maxBits uint
+	cells   []huffmanCell
+}
+
+// readHuffmanTable reads the description of a Huffman code, returning
+// its decoding table and the bytes it took
+func readHuffmanTable(b []byte) (*huffmanTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	var weights []uint8
+	var n int
+
+	if header := int(b[0]); header >= 128 {
+		count := header - 127
+		n = 1 + (count+1)/2
+
+		if len(b) < n {
+			return nil, 0, errZstdCorrupt
+		}
+
+		for i := 0; i < count; i++ {
+			w := b[1+i/2]
+			if i&1 == 0 {
+				w >>= 4
+			}
+			weights = append(weights, w&0xF)
+		}
+	} else {
+		n = 1 + header
+		if len(b) < n {
+			return nil, 0, errZstdCorrupt
+		}
+
+		_, _, k, err := readNCount(b[1:n], huffmanWeightSymbols, huffmanMaxWeightLog)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if weights, err = decompressWeights(b[1:1+k], b[1+k:n]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	total := 0
+	for _, w := range weights {
+		if w > HUFFMAN_MAX_BITS+1 {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+
+	if total == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	// the last weight makes the total a power of 2
+	maxBits := uint(bits.Len(uint(total)))
+	rest := 1<<maxBits - total
+
+	if maxBits > HUFFMAN_MAX_BITS || rest&(rest-1) != 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	weights = append(weights, uint8(bits.Len(uint(rest))))
+
+	t := &huffmanTable{maxBits: maxBits, cells: make([]huffmanCell, 1<<maxBits)}
+	next := 0
+
+	for w := 1; w <= int(maxBits); w++ {
+		for s, sw := range weights {
+			if int(sw) != w {
+				continue
+			}
+
+			cell := huffmanCell{uint8(s), uint8(int(maxBits) + 1 - w)}
+			for k := 0; k < 1<<uint(w-1); k++ {
+				t.cells[next] = cell
+				next++
+			}
+		}
+	}
+
+	return t, n, nil
+}
+
+// decode appends the n bytes of a Huffman stream to out
+func (t *huffmanTable) decode(out, stream []byte, n int) ([]byte, error) {
+	br, err := newBitReader(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < n; i++ {
+		cell := t.cells[br.peek(t.maxBits)]
+		out = append(out, cell.symbol)
+
+		if br.pos -= int(cell.nbBits); br.pos < 0 {
+			return nil, errZstdCorrupt
+		}
+	}
+
+	if br.pos != 0 {
+		return nil, errZstdCorrupt
+	}
+
+	return out, nil
+}
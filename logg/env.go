@@ -0,0 +1,142 @@
+package logg
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// environment variables ConfigureFromEnv reads
+const (
+	ENV_LEVEL    = "LOGG_LEVEL"    // trace, debug, info, warn, error, fatal or a registered level
+	ENV_FORMAT   = "LOGG_FORMAT"   // text or json
+	ENV_FILE     = "LOGG_FILE"     // path of the file to write to, or stdout or stderr (the default)
+	ENV_MAX_SIZE = "LOGG_MAX_SIZE" // size the file rotates at, e.g. '64m'; 0 never rotates
+	ENV_COLOR    = "LOGG_COLOR"    // auto, always or never (the default), see SetColor
+	ENV_METRICS  = "LOGG_METRICS"  // target of ExportMetrics, e.g. statsd://localhost:8125
+)
+
+// stops the export LOGG_METRICS started, nil if none
+var env_metrics_stop func()
+
+// ConfigureFromEnv sets the default level, format and writer from LOGG_LEVEL,
+// LOGG_FORMAT and LOGG_FILE, so programs embedding logg need no flags of
+// their own for it; variables not set keep their defaults. a file in
+// LOGG_FILE is opened for the default logger, rotating at LOGG_MAX_SIZE,
+// while loggers of GetDefaultLogger take the level and format. it replaces
+// a default logger in use, closing its file if it had one. LOGG_COLOR
+// colors the default logger's level tags. LOGG_METRICS starts exporting
+// metrics there (see ExportMetrics), stopping an export of an earlier call.
+func ConfigureFromEnv() error {
+	level := default_log_level
+	format := default_format
+
+	if s := os.Getenv(ENV_LEVEL); s != "" {
+		if level = LogLevelFrom(s, 0); level == 0 {
+			return fmt.Errorf("%s: invalid level '%s' (expected trace, debug, info, warn, error, fatal or a registered level)", ENV_LEVEL, s)
+		}
+	}
+
+	if s := os.Getenv(ENV_FORMAT); s != "" {
+		if format = FormatFrom(s, -1); format == -1 {
+			return fmt.Errorf("%s: invalid format '%s' (expected text or json)", ENV_FORMAT, s)
+		}
+	}
+
+	var maxSize int64
+	if s := os.Getenv(ENV_MAX_SIZE); s != "" {
+		var err error
+		if maxSize, err = parseSize(s); err != nil {
+			return fmt.Errorf("%s: %v", ENV_MAX_SIZE, err)
+		}
+	}
+
+	color := COLOR_NEVER
+	if s := os.Getenv(ENV_COLOR); s != "" {
+		if color = ColorModeFrom(s, -1); color == -1 {
+			return fmt.Errorf("%s: invalid color mode '%s' (expected auto, always or never)", ENV_COLOR, s)
+		}
+	}
+
+	var logger *Logger
+	w := default_w
+
+	switch path := os.Getenv(ENV_FILE); path {
+	case "":
+		logger = NewLoggerWithFormat("", w, level, format)
+	case "stderr":
+		w = os.Stderr
+		logger = NewLoggerWithFormat("", w, level, format)
+	case "stdout":
+		w = os.Stdout
+		logger = NewLoggerWithFormat("", w, level, format)
+	default:
+		var err error
+		if logger, err = NewFileLogger("", path, level, maxSize, false); err != nil {
+			return fmt.Errorf("%s: %v", ENV_FILE, err)
+		}
+		logger.SetFormat(format)
+	}
+
+	logger.SetColor(color)
+
+	// started last, so that nothing before can fail and leave it running
+	var stopMetrics func()
+	if s := os.Getenv(ENV_METRICS); s != "" {
+		var err error
+		if stopMetrics, err = ExportMetrics(MetricsOptions{Target: s}); err != nil {
+			if logger.filepath != "" {
+				logger.Close()
+			}
+
+			return fmt.Errorf("%s: %v", ENV_METRICS, err)
+		}
+	}
+
+	default_lock.Lock()
+	old := default_logger
+	default_logger = logger
+	default_w = w
+	default_log_level = level
+	default_format = format
+	oldStop := env_metrics_stop
+	env_metrics_stop = stopMetrics
+	default_lock.Unlock()
+
+	if oldStop != nil {
+		oldStop()
+	}
+
+	if old != nil && old.filepath != "" {
+		old.Close()
+	}
+
+	return nil
+}
+
+// parseSize parses a size like '512k', '64m' or '1g'
+func parseSize(spec string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(spec)), "b")
+
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		unit = 1 << 30
+	}
+
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s' (e.g. '512k', '64m' or '1g')", spec)
+	}
+
+	return n * unit, nil
+}
@@ -0,0 +1,64 @@
+package logg
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// a LOGG_FILE that can't be opened leaves no export of LOGG_METRICS behind
+func TestConfigureFromEnvFileFails(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ENV_METRICS, "statsd://"+conn.LocalAddr().String())
+	t.Setenv(ENV_FILE, filepath.Join(dir, "file", "app.log"))
+
+	before := runtime.NumGoroutine()
+
+	if err := ConfigureFromEnv(); err == nil {
+		t.Fatalf("configured with a file under a file")
+	}
+
+	// an exporter would be waiting on its ticker
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+}
+
+// a LOGG_METRICS that can't be exported to closes the LOGG_FILE opened
+func TestConfigureFromEnvMetricsFail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	t.Setenv(ENV_METRICS, "carrier-pigeon://coop")
+	t.Setenv(ENV_FILE, path)
+
+	if err := ConfigureFromEnv(); err == nil {
+		t.Fatalf("configured with an invalid metrics target")
+	}
+
+	if GetDefaultLogger("").filepath == path {
+		t.Errorf("the default logger was replaced")
+	}
+
+	files_lock.Lock()
+	defer files_lock.Unlock()
+
+	for l := range files {
+		if l.filepath == path {
+			t.Errorf("%s left open", path)
+		}
+	}
+}
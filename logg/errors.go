@@ -0,0 +1,41 @@
+package logg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// the errors of messages waited for (PrintfWait, LogDurable) that aren't in
+// the file: dropped, as the logger has no file open or neither it nor the
+// spill file took the line, or kept in the spill file to be written back
+// later. lines the file refuses return its error.
+var (
+	ErrDropped = errors.New("logg: message dropped")
+	ErrSpilled = errors.New("logg: message held in the spill file")
+)
+
+// OnError has fn called with the errors the actor meets writing for the
+// logger, which are otherwise only counted or dropped: lines the file
+// refuses, buffers that fail to flush, rotations and reopens that fail
+// outside Rotate and Reopen, and failing sinks. file errors are usually
+// *os.PathError, so errors.Is(err, syscall.ENOSPC) tells a full disk. the
+// actor calls fn, one error at a time, so it should be quick and must not
+// log to the same logger; a panic in it is ignored. nil stops it; it may be
+// called at any time.
+func (logger *Logger) OnError(fn func(err error)) {
+	logger.core().onError.Store(fn)
+}
+
+// reportError hands err to the logger's OnError function, if any
+func (logger *Logger) reportError(err error) {
+	if fn, ok := logger.onError.Load().(func(err error)); ok && fn != nil && err != nil {
+		safelyDo(func() {
+			fn(err)
+		})
+	}
+}
+
+// sinkError is the error for OnError of a failing sink
+func sinkError(err error) error {
+	return fmt.Errorf("logg: sink: %w", err)
+}
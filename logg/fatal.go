@@ -0,0 +1,78 @@
+package logg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FatalPolicy is what Fatalf does once its message is written
+type FatalPolicy int32
+
+const (
+	FATAL_LOG_ONLY FatalPolicy = iota // return to the caller, the default
+	FATAL_EXIT                        // flush every logger and exit with status 1
+	FATAL_PANIC                       // panic with the message
+)
+
+func FatalPolicyFrom(s string, defaultPolicy FatalPolicy) FatalPolicy {
+	switch strings.ToLower(s) {
+	case "log":
+		return FATAL_LOG_ONLY
+	case "exit":
+		return FATAL_EXIT
+	case "panic":
+		return FATAL_PANIC
+	default:
+		return defaultPolicy
+	}
+}
+
+// SetFatalPolicy sets what Fatalf of the logger does after writing; Log and
+// LogAt at LOG_LEVEL_FATAL just write, whatever the policy
+func (logger *Logger) SetFatalPolicy(policy FatalPolicy) {
+	atomic.StoreInt32(&logger.core().fatal, int32(policy))
+}
+
+func (logger *Logger) FatalPolicy() FatalPolicy {
+	return FatalPolicy(atomic.LoadInt32(&logger.core().fatal))
+}
+
+// Fatalf writes a fatal message and waits for it to be written, then acts
+// by the logger's FatalPolicy
+func (logger *Logger) Fatalf(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_FATAL, LOG_LEVEL_FATAL, true, nil, format, v...)
+	logger.afterFatal(context.Background(), format, v...)
+}
+
+// FatalfWait is Fatalf waiting for the message, and with FATAL_EXIT for the
+// flush, only until ctx ends. the policy is acted on either way; with
+// FATAL_LOG_ONLY it returns the error writing the message or that of ctx.
+func (logger *Logger) FatalfWait(ctx context.Context, format string, v ...interface{}) error {
+	err := logger._logUntil(ctx, time.Time{}, LOG_LEVEL_FATAL, LOG_LEVEL_FATAL, true, false, nil, format, v...)
+	logger.afterFatal(ctx, format, v...)
+
+	return err
+}
+
+// afterFatal acts by the FatalPolicy once a fatal message is written
+func (logger *Logger) afterFatal(ctx context.Context, format string, v ...interface{}) {
+	switch logger.FatalPolicy() {
+	case FATAL_EXIT:
+		FlushWait(ctx)
+		os.Exit(1)
+	case FATAL_PANIC:
+		panic(fmt.Sprintf(format, v...))
+	}
+}
+
+// Panicf writes a fatal message, waits for it to be written and panics with
+// it, whatever the logger's FatalPolicy
+func (logger *Logger) Panicf(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_FATAL, LOG_LEVEL_FATAL, true, nil, format, v...)
+
+	panic(fmt.Sprintf(format, v...))
+}
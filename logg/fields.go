@@ -0,0 +1,110 @@
+package logg
+
+import (
+	"fmt"
+)
+
+// WithFields returns a logger writing through logger with fields attached to
+// every message; fields given to Log override them
+func (logger *Logger) WithFields(fields Fields) *Logger {
+	// copy, so the caller may keep using its map
+	own := make(Fields, len(fields))
+	for k, v := range fields {
+		own[k] = v
+	}
+
+	return &Logger{
+		name:   logger.name,
+		prefix: logger.prefix,
+		root:   logger.core(),
+		fields: logger.mergeFields(own),
+	}
+}
+
+// With is WithFields taking alternating keys and values, e.g.
+// With("request_id", id, "host", host)
+func (logger *Logger) With(kv ...interface{}) *Logger {
+	fields := make(Fields, (len(kv)+1)/2)
+
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprintf("%v", kv[i])
+
+		if i+1 < len(kv) {
+			fields[key] = kv[i+1]
+		} else {
+			fields[key] = "(MISSING)"
+		}
+	}
+
+	return logger.WithFields(fields)
+}
+
+// core returns the logger that owns the output
+func (logger *Logger) core() *Logger {
+	if logger.root != nil {
+		return logger.root
+	}
+
+	return logger
+}
+
+// mergeFields returns the logger's fields overridden by fields; the maps
+// themselves are left alone since tokens hold on to them
+func (logger *Logger) mergeFields(fields Fields) Fields {
+	if len(logger.fields) == 0 {
+		return fields
+	} else if len(fields) == 0 {
+		return logger.fields
+	}
+
+	merged := make(Fields, len(logger.fields)+len(fields))
+
+	for k, v := range logger.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// Named returns a logger writing through logger, with its level and fields,
+// named name after it: a dotted path like 'server.http.handler' for the
+// loggers of a program's parts
+func (logger *Logger) Named(name string) *Logger {
+	if logger.name != "" {
+		name = logger.name + "." + name
+	}
+
+	return &Logger{
+		name:   name,
+		prefix: prefixOf(name),
+		root:   logger.core(),
+		fields: logger.fields,
+	}
+}
+
+// Child is Named
+func (logger *Logger) Child(prefix string) *Logger {
+	return logger.Named(prefix)
+}
+
+// prefixOf returns the prefix of text lines of a logger named name
+func prefixOf(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("[%-10s] ", name)
+}
+
+// names returns the name and prefix of the logger the token was logged
+// through, logger being its core
+func (token *logToken) names(logger *Logger) (string, string) {
+	if token.name != "" {
+		return token.name, token.prefix
+	}
+
+	return logger.name, logger.prefix
+}
@@ -0,0 +1,102 @@
+package logg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DEFAULT_FILE_MODE is the mode files are created with when FileOptions
+// give none, less the umask
+const DEFAULT_FILE_MODE os.FileMode = 0644
+
+// FileOptions say how a file logger creates its files, see
+// NewFileLoggerWithOptions. the zero value is what NewFileLogger does.
+type FileOptions struct {
+	// Mode is set on the file and every one rotation and Reopen start,
+	// whatever the umask; 0 creates them with DEFAULT_FILE_MODE less the
+	// umask
+	Mode os.FileMode
+
+	// DirMode has missing directories of the file created with it,
+	// whatever the umask; 0 creates none
+	DirMode os.FileMode
+
+	// with Chown, the files and the directories created are given to UID
+	// and GID (-1 keeping either), on Unix only
+	Chown    bool
+	UID, GID int
+}
+
+// open opens path for appending, creating it as opts say
+func (opts FileOptions) open(path string) (*os.File, error) {
+	if opts.DirMode != 0 {
+		if err := opts.MakeDirs(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DEFAULT_FILE_MODE
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Mode != 0 {
+		err = f.Chmod(opts.Mode)
+	}
+
+	if err == nil && opts.Chown {
+		err = f.Chown(opts.UID, opts.GID)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// MakeDirs creates dir and its missing parents with DirMode (0755 if 0)
+// whatever the umask, owned as opts say
+func (opts FileOptions) MakeDirs(dir string) error {
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("'%s' is not a directory", dir)
+		}
+		return nil
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := opts.MakeDirs(parent); err != nil {
+			return err
+		}
+	}
+
+	mode := opts.DirMode
+	if mode == 0 {
+		mode = 0755
+	}
+
+	if err := os.Mkdir(dir, mode); err != nil {
+		if os.IsExist(err) {
+			return nil // made meanwhile
+		}
+		return err
+	}
+
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+
+	if opts.Chown {
+		return os.Chown(dir, opts.UID, opts.GID)
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package logg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Format int
+
+const (
+	FORMAT_TEXT Format = iota // '2006/01/02 15:04:05.000000 (INFO) message k=v', the default
+	FORMAT_JSON               // one JSON object per line
+)
+
+// the time layout of text lines unless SetTimeFormat says otherwise; the same
+// golog uses for Ldate|Lmicroseconds
+const DEFAULT_TIME_LAYOUT = "2006/01/02 15:04:05.000000"
+
+// Fields are key/value pairs attached to a single message
+type Fields map[string]interface{}
+
+func FormatFrom(s string, defaultFormat Format) Format {
+	switch strings.ToLower(s) {
+	case "text":
+		return FORMAT_TEXT
+	case "json":
+		return FORMAT_JSON
+	default:
+		return defaultFormat
+	}
+}
+
+func NewLoggerWithFormat(prefix string, w io.Writer, allowedLogLevel LogLevel, format Format) *Logger {
+	logger := NewLogger(prefix, w, allowedLogLevel)
+	logger.format = format
+
+	return logger
+}
+
+// SetFormat switches the output format; it must be called before the logger
+// is used
+func (logger *Logger) SetFormat(format Format) {
+	logger.core().format = format
+}
+
+// SetTimeFormat sets the time layout of text lines and the zone of their
+// times (nil: local time). JSON lines keep RFC 3339 times, in loc if given.
+// it must be called before the logger is used.
+func (logger *Logger) SetTimeFormat(layout string, loc *time.Location) {
+	core := logger.core()
+
+	core.timeLayout = layout
+	core.timeLoc = loc
+}
+
+// Log writes a message of level with fields; fatal messages wait like Fatalf
+func (logger *Logger) Log(level LogLevel, fields Fields, format string, v ...interface{}) {
+	logger._log(level, level, level == LOG_LEVEL_FATAL, fields, format, v...)
+}
+
+// LogAt is Log for a message that happened at t rather than now (e.g. one
+// reported late by a client); the line carries t as its time
+func (logger *Logger) LogAt(t time.Time, level LogLevel, fields Fields, format string, v ...interface{}) {
+	logger._logAt(t, level, level, level == LOG_LEVEL_FATAL, fields, format, v...)
+}
+
+// LogDurable is LogAt (a zero t being now) waiting until the message is
+// written and the file fsynced, whatever the sync level, or until ctx ends.
+// it returns the error keeping the message from the file (ErrDropped,
+// ErrSpilled, that of the file, a failed rotation or fsync) or that of ctx;
+// nil for a message the level or sampling leaves out.
+func (logger *Logger) LogDurable(ctx context.Context, t time.Time, level LogLevel, fields Fields, format string, v ...interface{}) error {
+	return logger._logUntil(ctx, t, level, level, true, true, fields, format, v...)
+}
+
+func levelName(level LogLevel) string {
+	switch level {
+	case 0:
+		return ""
+	case LOG_LEVEL_TRACE:
+		return "trace"
+	case LOG_LEVEL_DEBUG:
+		return "debug"
+	case LOG_LEVEL_INFO:
+		return "info"
+	case LOG_LEVEL_WARN:
+		return "warn"
+	case LOG_LEVEL_ERROR:
+		return "error"
+	case LOG_LEVEL_FATAL:
+		return "fatal"
+	default:
+		custom, _ := customLevel(level)
+		return custom.name
+	}
+}
+
+// write renders a token in the logger's format, writes it to the logger's
+// writer, hands it to its sinks and returns the bytes written to the former.
+// only the actor calls it.
+func (logger *Logger) write(token *logToken, msg string) (int64, error) {
+	t := token.at
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	if logger.timeLoc != nil {
+		t = t.In(logger.timeLoc)
+	}
+
+	var b, out []byte
+
+	name, prefix := token.names(logger)
+
+	if logger.format == FORMAT_JSON {
+		b = formatJSON(t, token.level, name, token.caller, msg, token.fields)
+	} else {
+		layout := logger.timeLayout
+		if layout == "" {
+			layout = DEFAULT_TIME_LAYOUT
+		}
+
+		if logger.timeLoc == nil {
+			t = t.Local()
+		}
+
+		// lines are rendered into the actor's scratch buffers, which only
+		// live until the next line; dispatch copies them for sinks
+		s := logger.shardOf()
+		tag := levelTag(token.level)
+
+		colored := atomic.LoadInt32(&logger.colored) != 0
+
+		if logger.layout != nil {
+			b = logger.layout.render(s.line[:0], name, t, layout, token.caller, token.level, false, msg, token.fields)
+			s.line = b
+
+			if colored {
+				out = logger.layout.render(s.colored[:0], name, t, layout, token.caller, token.level, true, msg, token.fields)
+				s.colored = out
+			}
+		} else {
+			b = s.renderText(s.line[:0], prefix, t, layout, token.caller, tag, msg, token.fields)
+			s.line = b
+
+			// only the writer sees colors; sinks get the plain line
+			if colored {
+				out = s.renderText(s.colored[:0], prefix, t, layout, token.caller, colorTag(token.level, tag), msg, token.fields)
+				s.colored = out
+			}
+		}
+	}
+
+	if out == nil {
+		out = b
+	}
+
+	n, err := logger.writeLine(out)
+	logger.dispatch(token, t, b)
+
+	return n, err
+}
+
+// renderText appends a text line to buf: prefix, time, the caller where
+// golog's Lshortfile puts it, tag, msg and fields
+func (s *shard) renderText(buf []byte, prefix string, t time.Time, layout, caller, tag, msg string, fields Fields) []byte {
+	buf = append(buf, prefix...)
+	buf = t.AppendFormat(buf, layout)
+	buf = append(buf, ' ')
+
+	if caller != "" {
+		buf = append(buf, caller...)
+		buf = append(buf, ": "...)
+	}
+
+	buf = append(buf, tag...)
+	buf = append(buf, msg...)
+
+	if len(fields) > 0 {
+		buf = append(buf, formatFields(fields)...)
+	}
+
+	return append(buf, '\n')
+}
+
+// formatFields renders fields as ' k=v' pairs in key order, quoting values
+// that would be ambiguous
+func formatFields(fields Fields) string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+
+	for _, k := range keys {
+		v := fmt.Sprintf("%v", fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+
+		fmt.Fprintf(&buf, " %s=%s", k, v)
+	}
+
+	return buf.String()
+}
+
+// formatJSON renders a message as a single line; fields sit next to the
+// standard keys, which they can't override
+func formatJSON(t time.Time, level LogLevel, prefix, caller, msg string, fields Fields) []byte {
+	m := make(map[string]interface{}, len(fields)+5)
+
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		m[k] = v
+	}
+
+	m["time"] = t.Format(time.RFC3339Nano)
+	m["msg"] = msg
+
+	if name := levelName(level); name != "" {
+		m["level"] = name
+	}
+
+	if prefix != "" {
+		m["prefix"] = prefix
+	}
+
+	if caller != "" {
+		m["caller"] = caller
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		// a field that can't be marshaled must not lose the message
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":         m["time"],
+			"level":        m["level"],
+			"prefix":       m["prefix"],
+			"caller":       m["caller"],
+			"msg":          msg,
+			"fields_error": err.Error(),
+		})
+	}
+
+	return append(b, '\n')
+}
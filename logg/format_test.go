@@ -0,0 +1,98 @@
+package logg
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+var benchFields = Fields{"remote": "10.0.0.1:5123", "status": 200, "path": "/web/info"}
+
+// the hot path end to end: formatting the message, queueing the token and
+// the actor rendering and writing the line
+func BenchmarkLog(b *testing.B) {
+	for _, f := range []struct {
+		name   string
+		format Format
+	}{{"text", FORMAT_TEXT}, {"json", FORMAT_JSON}} {
+		logger := NewLoggerWithFormat("", io.Discard, LOG_LEVEL_DEBUG, f.format)
+
+		b.Run(f.name+"/plain", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.Infof("request served")
+			}
+			Flush()
+		})
+
+		b.Run(f.name+"/string", func(b *testing.B) {
+			msg := "request served"
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.Infof("%s", msg)
+			}
+			Flush()
+		})
+
+		b.Run(f.name+"/formatted", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.Infof("request %d served in %v", i, time.Millisecond)
+			}
+			Flush()
+		})
+
+		b.Run(f.name+"/fields", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.Log(LOG_LEVEL_INFO, benchFields, "request served")
+			}
+			Flush()
+		})
+	}
+}
+
+// rendering alone, as the actor does it
+func BenchmarkRenderText(b *testing.B) {
+	s := &shard{}
+	t := time.Now()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.line = s.renderText(s.line[:0], "", t, DEFAULT_TIME_LAYOUT, "", "[INFO] ", "request served", nil)
+	}
+}
+
+func BenchmarkRenderTextFields(b *testing.B) {
+	s := &shard{}
+	t := time.Now()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.line = s.renderText(s.line[:0], "", t, DEFAULT_TIME_LAYOUT, "", "[INFO] ", "request served", benchFields)
+	}
+}
+
+func BenchmarkFormatJSON(b *testing.B) {
+	t := time.Now()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatJSON(t, LOG_LEVEL_INFO, "", "", "request served", benchFields)
+	}
+}
+
+// a plain text line is rendered into the shard's buffer without allocating
+func TestRenderTextAllocs(t *testing.T) {
+	s := &shard{}
+	now := time.Now()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s.line = s.renderText(s.line[:0], "", now, DEFAULT_TIME_LAYOUT, "server.go:42", "[INFO] ", "request served", nil)
+	})
+
+	if allocs != 0 {
+		t.Errorf("rendering a text line allocates %v times", allocs)
+	}
+}
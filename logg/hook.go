@@ -0,0 +1,38 @@
+package logg
+
+// hookSink calls a function with the messages of a level or above
+type hookSink struct {
+	level LogLevel
+	fn    func(e Entry)
+}
+
+// AddHook has fn called with every message of the logger at level or above
+// (0 for all, untagged ones included), once it is written, to trigger side
+// effects like paging on fatals or counting errors. the actor calls fn, so it
+// should be quick and hand slow work to a goroutine; a panic in it counts as
+// a sink error. it returns the hook as a Sink, which RemoveSink takes to
+// remove it again.
+func (logger *Logger) AddHook(level LogLevel, fn func(e Entry)) Sink {
+	h := &hookSink{level: level, fn: fn}
+	logger.AddSink(h)
+
+	return h
+}
+
+func (h *hookSink) Write(e Entry) error {
+	if e.Level < h.level {
+		return nil
+	}
+
+	return safelyDo(func() {
+		h.fn(e)
+	})
+}
+
+func (h *hookSink) Flush() error {
+	return nil
+}
+
+func (h *hookSink) Close() error {
+	return nil
+}
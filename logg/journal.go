@@ -0,0 +1,108 @@
+package logg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JOURNAL_SOCKET is where journald takes messages of its native protocol
+const JOURNAL_SOCKET = "/run/systemd/journal/socket"
+
+// journal variables JournalSink sets itself, which fields can't override
+var journalReserved = map[string]bool{
+	"MESSAGE": true, "PRIORITY": true, "SYSLOG_IDENTIFIER": true,
+	"CODE_FILE": true, "CODE_LINE": true, "LOGG_TIME": true,
+}
+
+// journalName turns a field name into a journal variable name: uppercase
+// letters, digits and '_', not starting with '_' or a digit, at most 64
+// long. "" if nothing is left of it.
+func journalName(k string) string {
+	b := make([]byte, 0, len(k))
+
+	for i := 0; i < len(k); i++ {
+		switch c := k[i]; {
+		case c >= 'a' && c <= 'z':
+			b = append(b, c-'a'+'A')
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b = append(b, c)
+		default:
+			b = append(b, '_')
+		}
+	}
+
+	name := strings.TrimLeft(string(b), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
+
+// appendJournalField appends a variable in the native protocol: NAME=value
+// on a line, or for a value with newlines the name on a line followed by
+// the value's length as 64 bit little endian, the value and a newline
+func appendJournalField(buf []byte, name, value string) []byte {
+	buf = append(buf, name...)
+
+	if strings.IndexByte(value, '\n') < 0 {
+		buf = append(buf, '=')
+		buf = append(buf, value...)
+		return append(buf, '\n')
+	}
+
+	buf = append(buf, '\n')
+
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+	buf = append(buf, n[:]...)
+	buf = append(buf, value...)
+
+	return append(buf, '\n')
+}
+
+// journalMessage renders e as a datagram of the native protocol; identifier
+// "" takes the logger's name
+func journalMessage(e Entry, identifier string) []byte {
+	if identifier == "" {
+		identifier = strings.TrimSpace(e.Prefix)
+	}
+
+	buf := make([]byte, 0, 128+len(e.Msg))
+
+	buf = appendJournalField(buf, "MESSAGE", e.Msg)
+	buf = appendJournalField(buf, "PRIORITY", fmt.Sprintf("%d", syslogSeverity(e.Level)))
+
+	if identifier != "" {
+		buf = appendJournalField(buf, "SYSLOG_IDENTIFIER", identifier)
+	}
+
+	// the message's own time; the journal stamps when it got it
+	buf = appendJournalField(buf, "LOGG_TIME", e.Time.Format(time.RFC3339Nano))
+
+	if i := strings.LastIndexByte(e.Caller, ':'); i > 0 {
+		buf = appendJournalField(buf, "CODE_FILE", e.Caller[:i])
+		buf = appendJournalField(buf, "CODE_LINE", e.Caller[i+1:])
+	}
+
+	for k, v := range e.Fields {
+		name := journalName(k)
+		if name == "" || journalReserved[name] {
+			continue
+		}
+
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		buf = appendJournalField(buf, name, fmt.Sprintf("%v", v))
+	}
+
+	return buf
+}
@@ -0,0 +1,86 @@
+package logg
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// journalSink sends messages to journald over its native protocol
+type journalSink struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+}
+
+// JournalSink returns a sink sending the messages of its loggers to the
+// systemd journal, with a priority of their level, the caller as CODE_FILE
+// and CODE_LINE, the message's time as LOGG_TIME and fields as journal
+// variables (uppercased, other characters than letters and digits turned
+// into '_'). identifier is their SYSLOG_IDENTIFIER, "" taking the logger's
+// name. it fails where journald doesn't listen; it is safe for concurrent
+// use.
+func JournalSink(identifier string) (Sink, error) {
+	addr := &net.UnixAddr{Name: JOURNAL_SOCKET, Net: "unixgram"}
+
+	if _, err := os.Stat(JOURNAL_SOCKET); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &journalSink{conn: conn, addr: addr, identifier: identifier}, nil
+}
+
+func (s *journalSink) Write(e Entry) error {
+	msg := journalMessage(e, s.identifier)
+
+	_, _, err := s.conn.WriteMsgUnix(msg, nil, s.addr)
+	if err == nil || !tooLargeForDatagram(err) {
+		return err
+	}
+
+	return s.writeLarge(msg)
+}
+
+// writeLarge passes a message too large for a datagram as a file journald
+// reads, as the protocol wants it
+func (s *journalSink) writeLarge(msg []byte) error {
+	f, err := os.CreateTemp("/dev/shm", "logg-journal-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// journald only needs the descriptor
+	os.Remove(f.Name())
+
+	if _, err := f.Write(msg); err != nil {
+		return err
+	}
+
+	_, _, err = s.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), s.addr)
+
+	return err
+}
+
+func tooLargeForDatagram(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		if se, ok := op.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.EMSGSIZE || se.Err == syscall.ENOBUFS
+		}
+	}
+
+	return false
+}
+
+func (s *journalSink) Flush() error {
+	return nil
+}
+
+func (s *journalSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package logg
+
+import (
+	"fmt"
+)
+
+// JournalSink fails: the systemd journal is Linux only
+func JournalSink(identifier string) (Sink, error) {
+	return nil, fmt.Errorf("logg: the systemd journal is not available on this platform")
+}
@@ -0,0 +1,277 @@
+package logg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout lays out text lines by a pattern, in the manner of log4j's and
+// logback's pattern layouts, for programs whose collectors parse lines of
+// their own shape. its verbs:
+//
+//	%d  the time, in the layout of SetTimeFormat
+//	%l  the level: TRACE, DEBUG, INFO, WARN, ERROR, FATAL or a registered one
+//	%p  the logger's name
+//	%c  the caller, if the logger notes callers
+//	%m  the message
+//	%f  the fields, as ' k=v' pairs
+//	%%  a '%'
+//
+// a width between '%' and the verb pads to it, on the right with '-' (e.g.
+// '%-5l'). lines end in a newline, e.g. '%d %-5l [%p] %m%f'.
+type Layout struct {
+	pattern string
+	parts   []layoutPart
+}
+
+// layoutPart is a verb, or literal text if verb is 0
+type layoutPart struct {
+	verb  byte
+	width int // padded to, on the right if negative
+	text  string
+}
+
+// ParseLayout parses a pattern of Layout
+func ParseLayout(pattern string) (*Layout, error) {
+	l := &Layout{pattern: pattern}
+
+	var text strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' {
+			text.WriteByte(c)
+			continue
+		}
+
+		j := i + 1
+		if j < len(pattern) && pattern[j] == '%' {
+			text.WriteByte('%')
+			i = j
+			continue
+		}
+
+		left := j < len(pattern) && pattern[j] == '-'
+		if left {
+			j++
+		}
+
+		start := j
+		for j < len(pattern) && pattern[j] >= '0' && pattern[j] <= '9' {
+			j++
+		}
+
+		width, _ := strconv.Atoi(pattern[start:j])
+		if left {
+			width = -width
+		}
+
+		if j >= len(pattern) {
+			return nil, fmt.Errorf("invalid layout '%s': '%%' at the end", pattern)
+		}
+
+		switch pattern[j] {
+		case 'd', 'l', 'p', 'c', 'm', 'f':
+		default:
+			return nil, fmt.Errorf("invalid layout '%s': unknown verb '%%%c' (expected %%d, %%l, %%p, %%c, %%m, %%f or %%%%)", pattern, pattern[j])
+		}
+
+		if text.Len() > 0 {
+			l.parts = append(l.parts, layoutPart{text: text.String()})
+			text.Reset()
+		}
+
+		l.parts = append(l.parts, layoutPart{verb: pattern[j], width: width})
+		i = j
+	}
+
+	if text.Len() > 0 {
+		l.parts = append(l.parts, layoutPart{text: text.String()})
+	}
+
+	return l, nil
+}
+
+func (l *Layout) String() string {
+	return l.pattern
+}
+
+// Has tells whether the layout writes verb, e.g. 'm' for the message
+func (l *Layout) Has(verb byte) bool {
+	for _, part := range l.parts {
+		if part.verb == verb {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetLayout lays text lines out by layout; nil goes back to the default
+// line. it must be called before the logger is used.
+func (logger *Logger) SetLayout(layout *Layout) {
+	logger.core().layout = layout
+}
+
+// levelWord returns the level as %l writes it, "" for untagged messages
+func levelWord(level LogLevel) string {
+	return strings.ToUpper(levelName(level))
+}
+
+// render appends a line laid out by l to buf; color colors the level as
+// colorTag does
+func (l *Layout) render(buf []byte, name string, t time.Time, timeLayout, caller string, level LogLevel, color bool, msg string, fields Fields) []byte {
+	for _, part := range l.parts {
+		var s string
+
+		switch part.verb {
+		case 0:
+			buf = append(buf, part.text...)
+			continue
+		case 'd':
+			s = t.Format(timeLayout)
+		case 'l':
+			s = levelWord(level)
+		case 'p':
+			s = name
+		case 'c':
+			s = caller
+		case 'm':
+			s = msg
+		case 'f':
+			s = formatFields(fields)
+		}
+
+		pad := 0
+		if w := part.width; w > len(s) {
+			pad = w - len(s)
+		} else if w < 0 && -w > len(s) {
+			pad = -w - len(s)
+		}
+
+		if part.width > 0 {
+			buf = appendSpaces(buf, pad)
+		}
+
+		if c, ok := level_colors[level]; ok && color && part.verb == 'l' && s != "" {
+			buf = append(buf, c...)
+			buf = append(buf, s...)
+			buf = append(buf, color_reset...)
+		} else {
+			buf = append(buf, s...)
+		}
+
+		if part.width < 0 {
+			buf = appendSpaces(buf, pad)
+		}
+	}
+
+	return append(buf, '\n')
+}
+
+func appendSpaces(buf []byte, n int) []byte {
+	for ; n > 0; n-- {
+		buf = append(buf, ' ')
+	}
+
+	return buf
+}
+
+// LayoutLine is what a parser of Layout.Parser makes of a line
+type LayoutLine struct {
+	Time   time.Time
+	Level  string // lowercase, as LogLevelFrom takes it; "" if untagged
+	Name   string
+	Caller string
+	Msg    string // the message and the fields after it, as %m%f writes them
+}
+
+// Parser returns a function parsing the lines l writes back, with times in
+// timeLayout and loc, for programs reading their own files; it can't tell
+// apart verbs that aren't set apart by text
+func (l *Layout) Parser(timeLayout string, loc *time.Location) (func(line string) (LayoutLine, bool), error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	// a time takes as many words as a rendered one
+	spaces := strings.Count(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(timeLayout), " ")
+
+	var expr strings.Builder
+	var verbs []byte
+
+	expr.WriteString("^")
+
+	for _, part := range l.parts {
+		if part.verb == 0 {
+			expr.WriteString(regexp.QuoteMeta(part.text))
+			continue
+		}
+
+		switch part.verb {
+		case 'd':
+			expr.WriteString(` *(\S+` + strings.Repeat(` +\S+`, spaces) + `) *`)
+		case 'l':
+			expr.WriteString(` *(\S*) *`)
+		case 'm':
+			expr.WriteString(`(.*)`)
+		default:
+			expr.WriteString(`(.*?)`)
+		}
+
+		verbs = append(verbs, part.verb)
+	}
+
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("layout '%s' can't be parsed: %v", l.pattern, err)
+	}
+
+	return func(line string) (LayoutLine, bool) {
+		m := re.FindStringSubmatch(strings.TrimSuffix(line, "\n"))
+		if m == nil {
+			return LayoutLine{}, false
+		}
+
+		var ll LayoutLine
+		var msg, fields string
+
+		for i, verb := range verbs {
+			v := m[i+1]
+
+			switch verb {
+			case 'd':
+				t, err := time.ParseInLocation(timeLayout, v, loc)
+				if err != nil {
+					return LayoutLine{}, false
+				}
+				ll.Time = t
+			case 'l':
+				if v != "" {
+					level := LogLevelFrom(v, 0)
+					if level == 0 {
+						return LayoutLine{}, false
+					}
+					ll.Level = levelName(level)
+				}
+			case 'p':
+				ll.Name = strings.TrimSpace(v)
+			case 'c':
+				ll.Caller = strings.TrimSpace(v)
+			case 'm':
+				msg = v
+			case 'f':
+				fields = v
+			}
+		}
+
+		ll.Msg = msg + fields
+
+		return ll, true
+	}, nil
+}
@@ -0,0 +1,68 @@
+package logg
+
+import (
+	"fmt"
+)
+
+// the methods below skip formatting: Debug and the like join their args as
+// fmt.Sprint does, DebugFn and the like call fn for the message. either
+// only builds the message once the level check passes, so arguments costly
+// to render cost nothing at levels the logger leaves out.
+
+func (logger *Logger) enabled(level LogLevel) bool {
+	return logger.Level() <= level
+}
+
+// logArgs logs v joined; "%s" of a string skips Sprintf in newLogToken
+func (logger *Logger) logArgs(level LogLevel, v []interface{}) {
+	if logger.enabled(level) {
+		logger._log(level, level, false, nil, "%s", fmt.Sprint(v...))
+	}
+}
+
+// logFn logs what fn returns
+func (logger *Logger) logFn(level LogLevel, fn func() string) {
+	if logger.enabled(level) {
+		logger._log(level, level, false, nil, "%s", fn())
+	}
+}
+
+func (logger *Logger) Trace(v ...interface{}) {
+	logger.logArgs(LOG_LEVEL_TRACE, v)
+}
+
+func (logger *Logger) Debug(v ...interface{}) {
+	logger.logArgs(LOG_LEVEL_DEBUG, v)
+}
+
+func (logger *Logger) Info(v ...interface{}) {
+	logger.logArgs(LOG_LEVEL_INFO, v)
+}
+
+func (logger *Logger) Warn(v ...interface{}) {
+	logger.logArgs(LOG_LEVEL_WARN, v)
+}
+
+func (logger *Logger) Error(v ...interface{}) {
+	logger.logArgs(LOG_LEVEL_ERROR, v)
+}
+
+func (logger *Logger) TraceFn(fn func() string) {
+	logger.logFn(LOG_LEVEL_TRACE, fn)
+}
+
+func (logger *Logger) DebugFn(fn func() string) {
+	logger.logFn(LOG_LEVEL_DEBUG, fn)
+}
+
+func (logger *Logger) InfoFn(fn func() string) {
+	logger.logFn(LOG_LEVEL_INFO, fn)
+}
+
+func (logger *Logger) WarnFn(fn func() string) {
+	logger.logFn(LOG_LEVEL_WARN, fn)
+}
+
+func (logger *Logger) ErrorFn(fn func() string) {
+	logger.logFn(LOG_LEVEL_ERROR, fn)
+}
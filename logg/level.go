@@ -0,0 +1,69 @@
+package logg
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// customLevelInfo is what RegisterLevel was given for a level
+type customLevelInfo struct {
+	name string
+	tag  string
+}
+
+var (
+	levels_lock   = &sync.RWMutex{}
+	custom_levels = make(map[LogLevel]customLevelInfo)
+	custom_names  = make(map[string]LogLevel)
+)
+
+// RegisterLevel adds a level of the given value, lowercase name (as in JSON
+// lines and LogLevelFrom) and tag (as in '(TAG) ' of text lines). levels
+// order by value, so one between LOG_LEVEL_DEBUG and LOG_LEVEL_INFO is
+// written by loggers at debug but not at info; log at it with Log. it
+// should be called before loggers use the level.
+func RegisterLevel(level LogLevel, name string, tag string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	switch {
+	case level <= 0:
+		return fmt.Errorf("invalid level %d (expected above 0)", level)
+	case name == "" || strings.ContainsAny(name, " \t()"):
+		return fmt.Errorf("invalid level name '%s'", name)
+	case tag == "" || strings.ContainsAny(tag, " \t()"):
+		return fmt.Errorf("invalid level tag '%s'", tag)
+	}
+
+	if LogLevelFrom(name, 0) != 0 {
+		return fmt.Errorf("level '%s' exists", name)
+	}
+
+	if levelName(level) != "" {
+		return fmt.Errorf("level %d exists as '%s'", level, levelName(level))
+	}
+
+	levels_lock.Lock()
+	defer levels_lock.Unlock()
+
+	custom_levels[level] = customLevelInfo{name: name, tag: tag}
+	custom_names[name] = level
+
+	return nil
+}
+
+func customLevel(level LogLevel) (customLevelInfo, bool) {
+	levels_lock.RLock()
+	defer levels_lock.RUnlock()
+
+	custom, ok := custom_levels[level]
+	return custom, ok
+}
+
+func customLevelNamed(name string) (LogLevel, bool) {
+	levels_lock.RLock()
+	defer levels_lock.RUnlock()
+
+	level, ok := custom_names[name]
+	return level, ok
+}
@@ -0,0 +1,120 @@
+package logg
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// levelPayload is the body LevelHandler reads and writes, as zap's
+// AtomicLevel handler does
+type levelPayload struct {
+	Level string `json:"level"`
+}
+
+type levelError struct {
+	Error string `json:"error"`
+}
+
+// LevelHandler returns a handler reading and changing the level of loggers
+// (the default logger, if none) at runtime, for mounting on a program's own
+// mux: GET answers {"level":"info"}; PUT takes {"level":"debug"}, or level
+// as a form or query value, sets it on every logger and answers it. level
+// names are those of LogLevelFrom, including registered ones, and
+// 'warning' and 'panic' as logrus names them.
+func LevelHandler(loggers ...*Logger) http.Handler {
+	if len(loggers) == 0 {
+		loggers = []*Logger{Default()}
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			writeLevel(rw, http.StatusOK, levelPayload{Level: levelName(loggers[0].Level())})
+
+		case "PUT":
+			name, err := requestedLevel(rw, req)
+			if err != nil {
+				writeLevel(rw, http.StatusBadRequest, levelError{Error: err.Error()})
+				return
+			}
+
+			level, err := parseLevelName(name)
+			if err != nil {
+				writeLevel(rw, http.StatusBadRequest, levelError{Error: err.Error()})
+				return
+			}
+
+			for _, logger := range loggers {
+				logger.SetLevel(level)
+			}
+
+			writeLevel(rw, http.StatusOK, levelPayload{Level: levelName(level)})
+
+		default:
+			rw.Header().Set("Allow", "GET, PUT")
+			writeLevel(rw, http.StatusMethodNotAllowed, levelError{Error: "only GET and PUT are supported"})
+		}
+	})
+}
+
+// requestedLevel returns the level name a PUT asks for: of its form if it
+// is one, else of its query, else of its JSON body
+func requestedLevel(rw http.ResponseWriter, req *http.Request) (string, error) {
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	if ct == "application/x-www-form-urlencoded" {
+		if err := req.ParseForm(); err != nil {
+			return "", fmt.Errorf("invalid form: %v", err)
+		}
+
+		if name := req.PostForm.Get("level"); name != "" {
+			return name, nil
+		}
+
+		return "", fmt.Errorf("must specify a level")
+	}
+
+	if name := req.URL.Query().Get("level"); name != "" {
+		return name, nil
+	}
+
+	var p levelPayload
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 1<<10)).Decode(&p); err != nil {
+		return "", fmt.Errorf("invalid body: %v", err)
+	}
+
+	if p.Level == "" {
+		return "", fmt.Errorf("must specify a level")
+	}
+
+	return p.Level, nil
+}
+
+// parseLevelName parses a level name, unlike LogLevelFrom failing for one
+// it doesn't know
+func parseLevelName(name string) (LogLevel, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	switch name {
+	case "warning":
+		name = "warn"
+	case "panic":
+		name = "fatal"
+	}
+
+	level := LogLevelFrom(name, 0)
+	if level == 0 {
+		return 0, fmt.Errorf("unrecognized level '%s'", name)
+	}
+
+	return level, nil
+}
+
+func writeLevel(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,828 @@
+package logg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	golog "log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LOG_LEVEL_TRACE LogLevel = 1 << iota // below debug, e.g. for protocol dumps
+	LOG_LEVEL_DEBUG
+	LOG_LEVEL_INFO
+	LOG_LEVEL_WARN
+	LOG_LEVEL_ERROR
+	LOG_LEVEL_FATAL
+)
+
+const (
+	LOG_QUEUE = 1024 // per shard
+	LOG_BATCH = 64   // tokens an actor takes off its queue at once
+)
+
+// global variable
+var (
+	default_w         io.Writer
+	default_log_level LogLevel
+
+	processed    int64 // tokens handled by the actors, for liveness checks
+	last_latency int64 // nanoseconds spent on the most recent write
+)
+
+func init() {
+	startShards()
+
+	default_w = os.Stderr
+	default_log_level = LOG_LEVEL_DEBUG
+}
+
+type Logger struct {
+	level  int32 // the minimum LogLevel, atomic; see SetLevel
+	name   string
+	prefix string
+	l      *golog.Logger
+	format Format
+
+	timeLayout string         // of text lines, "" for DEFAULT_TIME_LAYOUT
+	layout     *Layout        // of text lines, nil for the default line
+	timeLoc    *time.Location // nil for local time
+
+	multilineMode MultilineMode     // see SetMultiline
+	multiline     *strings.Replacer // nil for the shard's default indent
+
+	// log rotate related
+	closer   io.Closer
+	maxSize  int64
+	enableGz int32 // atomic, see SetGzip
+	filepath string
+	fileOpts FileOptions
+
+	rotateMethod int32 // atomic RotateMethod, see SetRotateMethod
+
+	compressCodec int32 // atomic Codec, see SetCompression
+	compressLevel int32 // atomic
+
+	rotatedName func(i int) string
+	rotatedAt   func(t time.Time) string // see SetRotatedTimeFunc
+	rotatedGlob string
+
+	// time based rotation, see SetRotationPolicy
+	policy       RotationPolicy
+	periodStart  time.Time
+	nextRotation time.Time
+
+	// retention, see SetMaxBackups and SetMaxAge (atomic)
+	maxBackups  int64
+	maxAge      int64
+	rotateHook  func(path string)
+	archiveHook func(path string) // see SetArchiveHook
+	sealer      Sealer            // see SetEncryption
+
+	spill *spill // see SetSpillFile
+
+	syncLevel int32 // atomic, see SetSyncLevel
+	overflow  int32 // OverflowPolicy, atomic; see SetOverflowPolicy
+	fatal     int32 // FatalPolicy, atomic; see SetFatalPolicy
+	caller    int32 // atomic, see EnableCaller
+	colored   int32 // atomic, see SetColor
+
+	// noise, see SetSampling and SetRepeatWindow (atomic)
+	sampleLevel  int32
+	sampleEvery  int64
+	sampleSeen   int64
+	repeatWindow int64
+	last         *lastMessage // the actor's own
+
+	// see SetBuffer
+	bufferSize     int64 // atomic
+	bufferInterval int64 // atomic
+	buffer         *lineBuffer
+
+	shard *shard // the actor writing for the logger
+
+	sinks      atomic.Value // []Sink; see AddSink
+	onError    atomic.Value // func(error); see OnError
+	redactor   atomic.Value // *Redactor; see SetRedactor
+	middleware atomic.Value // []Middleware; see Use
+
+	// loggers made by WithFields write through root with their fields added
+	root   *Logger
+	fields Fields
+
+	written     int64
+	lastLatency int64 // nanoseconds spent on the last write (atomic)
+
+	counters // atomic, see stats.go
+}
+
+type logToken struct {
+	logger *Logger
+	level  LogLevel // 0 for untagged messages (Printf)
+	msg    string
+	fields Fields
+	at     time.Time // when the message happened, zero for now
+	caller string    // 'file.go:line' logging it, if the logger notes callers
+
+	// of the derived logger it was logged through; "" for the core's
+	name, prefix string
+
+	ch chan error // receives the result once the token is handled, if set
+
+	op   tokenOp
+	sync bool // fsync the file after writing msg
+}
+
+type tokenOp int
+
+const (
+	TOKEN_WRITE    tokenOp = iota // write msg (just flush if logger is nil)
+	TOKEN_ROTATE                  // force a rotation
+	TOKEN_CLOSE                   // close the logger's file
+	TOKEN_SHUTDOWN                // close every file and stop the actor
+	TOKEN_SPILL                   // write back what the logger spilled
+	TOKEN_REOPEN                  // open the logger's path again
+	TOKEN_REPEATS                 // write the repeat counts whose window passed
+	TOKEN_BUFFERS                 // write out the buffers whose interval passed
+)
+
+func handleToken(token *logToken, replacer *strings.Replacer) {
+	var err error
+
+	logger := token.logger
+	msg := token.msg
+	ch := token.ch
+
+	if logger != nil && logger.format == FORMAT_TEXT {
+		msg = logger.multilined(msg, replacer)
+	}
+
+	if logger != nil && token.op == TOKEN_ROTATE {
+		err = logger.rotate()
+	} else if logger != nil && token.op == TOKEN_CLOSE {
+		err = logger.close()
+	} else if logger != nil && token.op == TOKEN_REOPEN {
+		err = logger.reopenFile()
+	} else if logger != nil && token.op == TOKEN_SPILL {
+		if logger.l != nil && logger.spill != nil {
+			n, _ := logger.spill.writeBack(logger.l.Writer())
+			logger.written += n
+			logger.countWritten(n)
+		}
+	} else if logger != nil {
+		start := time.Now()
+
+		s := logger.shardOf()
+		atomic.StoreInt64(&s.writeStart, start.UnixNano())
+
+		// whoever waits for the message gets the first error keeping it
+		// from the file
+		if err = logger.refresh(); err != nil {
+			logger.reportError(err)
+		}
+
+		if logger.l != nil && logger.repeated(token, msg) {
+			logger.countSuppressed()
+		} else if logger.l != nil {
+			n, werr := logger.write(token, msg)
+			logger.written += n
+			logger.countWritten(n)
+			countLevel(token.level)
+
+			if err == nil {
+				err = werr
+			}
+		} else {
+			logger.countDropped()
+
+			if err == nil {
+				err = ErrDropped
+			}
+		}
+
+		// whoever waits for the message wants it in the file
+		if token.sync || ch != nil {
+			if ferr := logger.flushBuffer(); err == nil {
+				err = ferr
+			}
+		}
+
+		if token.sync && err == nil {
+			if f, ok := logger.closer.(interface {
+				Sync() error
+			}); ok {
+				err = f.Sync()
+			}
+		}
+
+		end := time.Now()
+		latency := int64(end.Sub(start))
+		atomic.StoreInt64(&logger.lastLatency, latency)
+		atomic.StoreInt64(&last_latency, latency)
+		countWrite(latency)
+
+		atomic.StoreInt64(&s.lastLatency, latency)
+		atomic.StoreInt64(&s.writeEnd, end.UnixNano())
+		atomic.StoreInt64(&s.writeStart, 0)
+	}
+
+	atomic.AddInt64(&processed, 1)
+
+	if ch != nil {
+		ch <- err
+	}
+}
+
+func LogLevelFrom(s string, defaultLevel LogLevel) (level LogLevel) {
+	s2 := strings.ToLower(s)
+
+	switch s2 {
+	case "trace":
+		level = LOG_LEVEL_TRACE
+	case "debug":
+		level = LOG_LEVEL_DEBUG
+	case "info":
+		level = LOG_LEVEL_INFO
+	case "warn":
+		level = LOG_LEVEL_WARN
+	case "error":
+		level = LOG_LEVEL_ERROR
+	case "fatal":
+		level = LOG_LEVEL_FATAL
+	default:
+		if custom, ok := customLevelNamed(s2); ok {
+			level = custom
+		} else {
+			level = defaultLevel
+		}
+	}
+
+	return
+}
+
+func newLogger(prefix string, allowedLogLevel LogLevel) *Logger {
+	if levelName(allowedLogLevel) == "" {
+		allowedLogLevel = LOG_LEVEL_DEBUG
+	}
+
+	logger := new(Logger)
+
+	logger.level = int32(allowedLogLevel)
+	logger.name = prefix
+	logger.prefix = prefixOf(prefix)
+	logger.shard = nextShard()
+
+	return logger
+}
+
+func NewLogger(prefix string, w io.Writer, allowedLogLevel LogLevel) *Logger {
+	logger := newLogger(prefix, allowedLogLevel)
+
+	logger.l = golog.New(w, logger.prefix, golog.Ldate|golog.Lmicroseconds)
+	logger.closer = nil
+	logger.maxSize = -1
+	logger.written = 0
+	logger.enableGz = 0
+
+	return logger
+}
+
+func NewFileLogger(prefix string, filepath string, allowedLogLevel LogLevel, maxSize int64, enableGz bool) (*Logger, error) {
+	return NewFileLoggerWithOptions(prefix, filepath, allowedLogLevel, maxSize, enableGz, FileOptions{})
+}
+
+// NewFileLoggerWithOptions is NewFileLogger creating its files as opts say
+func NewFileLoggerWithOptions(prefix string, filepath string, allowedLogLevel LogLevel, maxSize int64, enableGz bool, opts FileOptions) (*Logger, error) {
+	if maxSize < 0 {
+		maxSize = -1
+	}
+
+	f, err := opts.open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	logger := newLogger(prefix, allowedLogLevel)
+
+	logger.l = golog.New(f, logger.prefix, golog.Ldate|golog.Lmicroseconds)
+	logger.closer = f
+	logger.maxSize = maxSize
+	logger.written = fi.Size()
+	logger.SetGzip(enableGz)
+	logger.filepath = filepath
+	logger.fileOpts = opts
+	logger.rotateMethod = int32(DEFAULT_ROTATE_METHOD)
+
+	registerFile(logger)
+
+	return logger, nil
+}
+
+// SetDefaultLogger sets the writer and level of loggers GetDefaultLogger
+// returns from now on, and of Default if it wasn't used yet
+func SetDefaultLogger(w io.Writer, allowedLogLevel LogLevel) {
+	default_lock.Lock()
+	defer default_lock.Unlock()
+
+	default_log_level = allowedLogLevel
+	default_w = w
+}
+
+func GetDefaultLogger(prefix string) *Logger {
+	default_lock.Lock()
+	defer default_lock.Unlock()
+
+	return NewLoggerWithFormat(prefix, default_w, default_log_level, default_format)
+}
+
+func newLogToken(logger *Logger, ch chan error, format string, v ...interface{}) (token logToken) {
+	token.logger = logger
+	token.msg = message(format, v...)
+	token.ch = ch
+
+	return
+}
+
+// message formats a message, skipping Sprintf for the common cases of a
+// plain string and a single "%s" of a string
+func message(format string, v ...interface{}) string {
+	switch {
+	case len(v) == 0 && strings.IndexByte(format, '%') < 0:
+		return format
+	case len(v) == 1 && format == "%s":
+		if s, ok := v[0].(string); ok {
+			return s
+		}
+	}
+
+	return fmt.Sprintf(format, v...)
+}
+
+// wait channels of messages logged synchronously, reused once received from
+var wait_chans = sync.Pool{New: func() interface{} { return make(chan error, 1) }}
+
+func (logger *Logger) _printf(level LogLevel, wait bool, format string, v ...interface{}) {
+	logger._log(level, 0, wait, nil, format, v...)
+}
+
+// _log queues a message of level, tagged with tag (0 for none)
+func (logger *Logger) _log(level LogLevel, tag LogLevel, wait bool, fields Fields, format string, v ...interface{}) {
+	logger._logAt(time.Time{}, level, tag, wait, fields, format, v...)
+}
+
+func (logger *Logger) _logAt(at time.Time, level LogLevel, tag LogLevel, wait bool, fields Fields, format string, v ...interface{}) {
+	logger._logUntil(context.Background(), at, level, tag, wait, false, fields, format, v...)
+}
+
+// _logUntil is _logAt giving up waiting for the message to be queued and
+// written once ctx ends, returning its error; the message may still be
+// written later. durable fsyncs the file after it whatever the sync level.
+func (logger *Logger) _logUntil(ctx context.Context, at time.Time, level LogLevel, tag LogLevel, wait bool, durable bool, fields Fields, format string, v ...interface{}) error {
+	if logger.Level() > level {
+		return nil
+	}
+
+	if atomic.LoadInt32(&shut_down) != 0 {
+		logger.core().countDropped()
+		return ErrShutdown
+	}
+
+	core := logger.core()
+
+	if core.sampled(level) {
+		core.countSuppressed()
+		return nil
+	}
+
+	syncLevel := LogLevel(atomic.LoadInt32(&core.syncLevel))
+	durable = durable || (syncLevel != 0 && level >= syncLevel)
+
+	var ch chan error
+	if wait || durable {
+		ch = wait_chans.Get().(chan error)
+	}
+
+	token := newLogToken(core, ch, format, v...)
+	token.level = tag
+	token.fields = logger.mergeFields(fields)
+	token.sync = durable
+	token.at = at
+
+	if logger.root != nil {
+		token.name, token.prefix = logger.name, logger.prefix
+	}
+
+	if atomic.LoadInt32(&core.caller) != 0 {
+		token.caller = callerOf()
+	}
+
+	core.transform(&token)
+
+	if r := core.currentRedactor(); r != nil {
+		token.msg = r.Redact(token.msg)
+		token.fields = r.RedactFields(token.fields)
+	}
+
+	if ch == nil {
+		core.enqueue(token)
+		return nil
+	}
+
+	// waiting messages block on a full queue whatever the overflow policy
+	if err := core.shardOf().in.pushUntil(ctx, token); err != nil {
+		core.countDropped()
+		wait_chans.Put(ch)
+		return err
+	}
+
+	select {
+	case err := <-ch: // wait to flush log
+		wait_chans.Put(ch)
+		return err
+	case <-ctx.Done():
+		// the actor answers on ch later, so it isn't reused
+		return ctx.Err()
+	}
+}
+
+func (logger *Logger) refresh() error {
+	if logger.policy != nil && logger.filepath != "" && !logger.nextRotation.IsZero() {
+		if now := time.Now(); !now.Before(logger.nextRotation) {
+			return logger.rotateTimed(now)
+		}
+	}
+
+	if logger.maxSize <= 0 || logger.written <= logger.maxSize {
+		return nil
+	}
+
+	return logger.rotate()
+}
+
+func (logger *Logger) rotate() error {
+	if logger.filepath == "" {
+		return fmt.Errorf("logger is not writing to a file")
+	}
+
+	if logger.rotatedAt != nil {
+		return logger.reopen(logger.moveTimed)
+	}
+
+	return logger.reopen(logger.shiftRotated)
+}
+
+// reopen closes the current file, runs move to get it out of the way and
+// starts a new one
+func (logger *Logger) reopen(move func()) error {
+	logger.writeRepeats()
+	logger.dropBuffer()
+
+	// close current stream
+	if logger.closer != nil {
+		safelyDo(func() {
+			logger.closer.Close()
+		})
+	}
+
+	move()
+
+	// new open stream
+	f, err := logger.fileOpts.open(logger.filepath)
+	if err != nil {
+		return err
+	}
+
+	logger.l = golog.New(f, logger.prefix, golog.Ldate|golog.Lmicroseconds)
+	logger.closer = f
+	logger.written = 0
+
+	logger.countRotation()
+
+	return nil
+}
+
+// shiftRotated moves every rotated file one number up and the current file to
+// .0
+func (logger *Logger) shiftRotated() {
+	// find latest file; the chain may mix plain and compressed files when
+	// compression was toggled, so look for both
+	i := 0
+	maxI := -1
+
+	for {
+		_, err := os.Stat(logger.rotatedPath(i))
+
+		if err == nil || os.IsExist(err) || compressedExists(logger.rotatedPath(i)) {
+			maxI = i
+		} else {
+			break
+		}
+
+		i += 1
+	}
+
+	for i = maxI; i >= 0; i-- {
+		os.Rename(logger.rotatedPath(i), logger.rotatedPath(i+1))
+
+		for _, suffix := range RotatedSuffixes() {
+			os.Rename(logger.rotatedPath(i)+suffix, logger.rotatedPath(i+1)+suffix)
+		}
+	}
+
+	// move current file to .0 file
+	if err := logger.moveLive(logger.rotatedPath(0)); err != nil {
+		logger.reportError(err)
+	}
+
+	// compress and prune if necessary
+	logger.afterRotate(logger.rotatedPath(0))
+}
+
+// moveTimed moves the current file to the name of the time of its rotation,
+// adding '.N' if a file of that name exists (several rotations in the time
+// the name tells apart)
+func (logger *Logger) moveTimed() {
+	base := logger.rotatedAt(time.Now())
+	path := base
+
+	for n := 1; ; n++ {
+		_, err := os.Stat(path)
+
+		if os.IsNotExist(err) && !compressedExists(path) {
+			break
+		}
+
+		path = fmt.Sprintf("%s.%d", base, n)
+	}
+
+	if err := logger.moveLive(path); err != nil {
+		logger.reportError(err)
+	}
+
+	// compress and prune if necessary
+	logger.afterRotate(path)
+}
+
+// CompressFile gzips path into path.gz and removes path; see
+// CompressFileWith
+func CompressFile(path string) error {
+	return CompressFileWith(path, GZIP, 0)
+}
+
+// CompressFileWith compresses path with codec at level (0 being the
+// codec's default) into path plus the codec's suffix and removes path.
+// the result is written as path.<suffix>.tmp and renamed once complete,
+// so an interrupted attempt never leaves a truncated file; a leftover one
+// is overwritten.
+func CompressFileWith(path string, codec Codec, level int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp := path + codec.Suffix() + ".tmp"
+
+	w, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DEFAULT_FILE_MODE)
+	if err != nil {
+		return err
+	}
+
+	// the compressed file is readable by whoever could read path
+	if fi, serr := f.Stat(); serr == nil {
+		w.Chmod(fi.Mode().Perm())
+		chownLike(w, fi)
+	}
+
+	cw, err := codec.NewWriter(w, level)
+	if err == nil {
+		_, err = io.Copy(cw, f)
+		if cerr := cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if serr := w.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+codec.Suffix())
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// SetGzip turns compression of rotated files on or off; it may be called at
+// any time and applies from the next rotation
+func (logger *Logger) SetGzip(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+
+	atomic.StoreInt32(&logger.core().enableGz, v)
+}
+
+// SetLevel changes the minimum level of messages the logger (and the loggers
+// derived from it with WithFields) writes. it may be called at any time.
+func (logger *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&logger.core().level, int32(level))
+}
+
+// Level returns the minimum level of messages the logger writes
+func (logger *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logger.core().level))
+}
+
+// SetSyncLevel makes messages at or above level synchronous: the caller waits
+// until they are written and the file is fsynced. 0 (the default) keeps every
+// level asynchronous. it may be called at any time.
+func (logger *Logger) SetSyncLevel(level LogLevel) {
+	atomic.StoreInt32(&logger.core().syncLevel, int32(level))
+}
+
+// SetRotatedNameFunc overrides the '<file>.N' naming of rotated files. name
+// gets the rotation index (0 is the newest) and returns the path without a
+// compression suffix. it must be called before the logger is used.
+func (logger *Logger) SetRotatedNameFunc(name func(i int) string) {
+	logger.core().rotatedName = name
+}
+
+// SetRotatedTimeFunc names rotated files by when they were rotated instead
+// of by number, so a rotation renames the live file only rather than every
+// rotated one: name returns the path for a rotation at t, without a
+// compression suffix, and glob matches all such paths, for SetMaxBackups.
+// it must be called before the logger is used.
+func (logger *Logger) SetRotatedTimeFunc(name func(t time.Time) string, glob string) {
+	core := logger.core()
+
+	core.rotatedAt = name
+	core.rotatedGlob = glob
+}
+
+func (logger *Logger) rotatedPath(i int) string {
+	if logger.rotatedName != nil {
+		return logger.rotatedName(i)
+	}
+
+	return fmt.Sprintf("%s.%d", logger.filepath, i)
+}
+
+// LastWriteLatency returns how long its actor spent on the logger's last write
+// (including a rotation, if one was triggered)
+func (logger *Logger) LastWriteLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&logger.core().lastLatency))
+}
+
+// LastWriteLatency returns how long an actor spent on the most recent write
+// of any logger
+func LastWriteLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&last_latency))
+}
+
+// QueueLen returns the number of tokens waiting for the actors and the
+// capacity of their queues, summed over the shards; producers block once
+// their logger's shard is full
+func QueueLen() (int, int) {
+	n, capacity := 0, 0
+	for _, s := range shards {
+		n += s.in.len()
+		capacity += s.in.cap()
+	}
+
+	return n, capacity
+}
+
+// Processed returns the number of tokens the actors have handled so far
+func Processed() int64 {
+	return atomic.LoadInt64(&processed)
+}
+
+// Rotate rotates the logger's file right away regardless of its size. it
+// runs on the logger's actor, so entries queued before the call land in the old file.
+func (logger *Logger) Rotate() error {
+	ch := make(chan error, 1)
+	if atomic.LoadInt32(&shut_down) != 0 {
+		return ErrShutdown
+	}
+
+	logger.shardOf().in.push(logToken{logger: logger.core(), ch: ch, op: TOKEN_ROTATE})
+
+	return <-ch
+}
+
+func (logger *Logger) GetCloser() io.Closer {
+	return logger.core().closer
+}
+
+// Flush waits until every shard has written what was queued before the call
+// and the files rotated meanwhile are compressed
+func Flush() {
+	FlushWait(context.Background())
+}
+
+// FlushWait is Flush giving up once ctx ends, e.g. with a file system that
+// hangs, returning its error; the shards go on with what is queued
+func FlushWait(ctx context.Context) error {
+	if atomic.LoadInt32(&shut_down) != 0 {
+		return ErrShutdown
+	}
+
+	err := broadcastUntil(ctx, func(ch chan error) logToken {
+		return logToken{logger: nil, ch: ch} // logger == nil means just time to flush
+	})
+	if err != nil {
+		return err
+	}
+
+	return WaitCompressions(ctx)
+}
+
+func (logger *Logger) Printf(wait bool, format string, v ...interface{}) {
+	logger._printf(logger.Level(), wait, format, v...)
+}
+
+// PrintfWait is Printf waiting for the message to be written until ctx
+// ends; it returns the error keeping it from the file, as LogDurable does,
+// or that of ctx
+func (logger *Logger) PrintfWait(ctx context.Context, format string, v ...interface{}) error {
+	return logger._logUntil(ctx, time.Time{}, logger.Level(), 0, true, false, nil, format, v...)
+}
+
+func (logger *Logger) Tracef(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_TRACE, LOG_LEVEL_TRACE, false, nil, format, v...)
+}
+
+func (logger *Logger) Debugf(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_DEBUG, LOG_LEVEL_DEBUG, false, nil, format, v...)
+}
+
+func (logger *Logger) Infof(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_INFO, LOG_LEVEL_INFO, false, nil, format, v...)
+}
+
+func (logger *Logger) Warnf(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_WARN, LOG_LEVEL_WARN, false, nil, format, v...)
+}
+
+func (logger *Logger) Errorf(format string, v ...interface{}) {
+	logger._log(LOG_LEVEL_ERROR, LOG_LEVEL_ERROR, false, nil, format, v...)
+}
+
+// levelTag returns the '(INFO) ' style tag text lines start with
+func levelTag(level LogLevel) string {
+	var msg_prefix string
+
+	switch level {
+	case 0:
+	case LOG_LEVEL_TRACE:
+		msg_prefix = `(TRAC) `
+	case LOG_LEVEL_DEBUG:
+		msg_prefix = `(DEBG) `
+	case LOG_LEVEL_INFO:
+		msg_prefix = `(INFO) `
+	case LOG_LEVEL_WARN:
+		msg_prefix = `(WARN) `
+	case LOG_LEVEL_ERROR:
+		msg_prefix = `(ERRO) `
+	case LOG_LEVEL_FATAL:
+		msg_prefix = `(FATL) `
+	default:
+		if custom, ok := customLevel(level); ok {
+			msg_prefix = "(" + custom.tag + ") "
+		}
+	}
+
+	return msg_prefix
+}
+
+func safelyDo(fun func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	fun()
+	return
+}
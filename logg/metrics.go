@@ -0,0 +1,460 @@
+package logg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	METRICS_DEFAULT_INTERVAL = 10 * time.Second
+	METRICS_DEFAULT_PREFIX   = "logg"
+	METRICS_TIMEOUT          = 5 * time.Second // of a send to the collector
+	METRICS_OTLP_PATH        = "/v1/metrics"   // taken by OTLP urls without a path
+	STATSD_MAX_DATAGRAM      = 1432            // fits an ethernet frame
+)
+
+var (
+	level_counts = &sync.Map{} // LogLevel to *int64, entries written at it
+
+	write_count int64 // writes of the actors
+	write_nanos int64 // time they took in all
+)
+
+// countLevel counts an entry written at level
+func countLevel(level LogLevel) {
+	n, ok := level_counts.Load(level)
+	if !ok {
+		n, _ = level_counts.LoadOrStore(level, new(int64))
+	}
+
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+func countWrite(latency int64) {
+	atomic.AddInt64(&write_count, 1)
+	atomic.AddInt64(&write_nanos, latency)
+}
+
+// LevelCounts returns how many entries all loggers wrote at each level, 0
+// being the untagged ones of Printf and the like
+func LevelCounts() map[LogLevel]int64 {
+	counts := make(map[LogLevel]int64)
+
+	level_counts.Range(func(k, v interface{}) bool {
+		counts[k.(LogLevel)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+
+	return counts
+}
+
+// MetricsOptions say where and how often ExportMetrics sends the package's
+// metrics
+type MetricsOptions struct {
+	// statsd://host:port sends them to statsd over UDP; an http:// or
+	// https:// url to an OpenTelemetry collector over OTLP/HTTP in JSON,
+	// to METRICS_OTLP_PATH if the url has no path
+	Target string
+
+	Interval time.Duration // 0 for METRICS_DEFAULT_INTERVAL
+	Prefix   string        // of metric names, "" for METRICS_DEFAULT_PREFIX
+
+	// statsd tags in the DogStatsD way ('|#key:value'), or attributes of the
+	// OTLP resource, e.g. service.name
+	Attributes map[string]string
+
+	OnError func(err error) // told of failed sends; nil ignores them
+}
+
+// metric is a value ExportMetrics sends: a counter since the export started
+// or a gauge
+type metric struct {
+	name    string
+	counter bool
+	value   float64
+	unit    string
+	labels  [][2]string
+}
+
+// metricsExporter sends snapshots of the metrics somewhere
+type metricsExporter interface {
+	export(ms []metric, now time.Time) error
+	close()
+}
+
+// ExportMetrics starts sending what loggers wrote by level, bytes written,
+// messages dropped and suppressed, rotations, queue length and saturation
+// and write latency to opts.Target every interval, until stop is called;
+// stop sends them a last time
+func ExportMetrics(opts MetricsOptions) (stop func(), err error) {
+	if opts.Interval <= 0 {
+		opts.Interval = METRICS_DEFAULT_INTERVAL
+	}
+
+	if opts.Prefix == "" {
+		opts.Prefix = METRICS_DEFAULT_PREFIX
+	}
+
+	u, err := url.Parse(opts.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics target '%s': %v", opts.Target, err)
+	}
+
+	var exp metricsExporter
+
+	switch u.Scheme {
+	case "statsd":
+		if exp, err = newStatsdExporter(u.Host, opts); err != nil {
+			return nil, err
+		}
+	case "http", "https":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = METRICS_OTLP_PATH
+		}
+
+		exp = newOtlpExporter(u.String(), opts)
+	default:
+		return nil, fmt.Errorf("invalid metrics target '%s' (expected statsd://host:port, or the http(s):// url of an OTLP collector)", opts.Target)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	window := &latencyWindow{}
+
+	send := func() {
+		if err := exp.export(snapshotMetrics(opts.Prefix, window), time.Now()); err != nil && opts.OnError != nil {
+			opts.OnError(err)
+		}
+	}
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-done:
+				send()
+				exp.close()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}, nil
+}
+
+// snapshotMetrics reads the metrics; the write latency is the average of
+// the writes since the window's last snapshot
+func snapshotMetrics(prefix string, window *latencyWindow) []metric {
+	name := func(s string) string {
+		return prefix + "." + s
+	}
+
+	counts := LevelCounts()
+	levels := make([]LogLevel, 0, len(counts))
+	for level := range counts {
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+
+	var ms []metric
+
+	for _, level := range levels {
+		lname := levelName(level)
+		if lname == "" {
+			lname = "untagged"
+		}
+
+		ms = append(ms, metric{name: name("entries"), counter: true, value: float64(counts[level]), unit: "{entry}", labels: [][2]string{{"level", lname}}})
+	}
+
+	queued, capacity := QueueLen()
+	saturation := 0.0
+	if capacity > 0 {
+		saturation = float64(queued) / float64(capacity)
+	}
+
+	ms = append(ms,
+		metric{name: name("bytes_written"), counter: true, value: float64(BytesWritten()), unit: "By"},
+		metric{name: name("dropped"), counter: true, value: float64(Dropped()), unit: "{entry}"},
+		metric{name: name("suppressed"), counter: true, value: float64(Suppressed()), unit: "{entry}"},
+		metric{name: name("rotations"), counter: true, value: float64(Rotations()), unit: "{rotation}"},
+		metric{name: name("sink_errors"), counter: true, value: float64(SinkErrors()), unit: "{error}"},
+		metric{name: name("compress_errors"), counter: true, value: float64(CompressErrors()), unit: "{file}"},
+		metric{name: name("compressions_pending"), value: float64(PendingCompressions()), unit: "{file}"},
+		metric{name: name("queue.length"), value: float64(queued), unit: "{token}"},
+		metric{name: name("queue.capacity"), value: float64(capacity), unit: "{token}"},
+		metric{name: name("queue.saturation"), value: saturation, unit: "1"},
+		metric{name: name("write.latency"), value: window.next().Seconds(), unit: "s"},
+	)
+
+	return ms
+}
+
+// latencyWindow averages the writes between snapshots of an export
+type latencyWindow struct {
+	count   int64
+	nanos   int64
+	average time.Duration
+}
+
+// next returns the average time of the writes since it was last called,
+// the last average if there were none
+func (w *latencyWindow) next() time.Duration {
+	count, nanos := atomic.LoadInt64(&write_count), atomic.LoadInt64(&write_nanos)
+
+	if count > w.count {
+		w.average = time.Duration((nanos - w.nanos) / (count - w.count))
+	}
+
+	w.count, w.nanos = count, nanos
+
+	return w.average
+}
+
+// statsdExporter sends counters as the increments since the last send
+type statsdExporter struct {
+	conn net.Conn
+	tags string
+	last map[string]float64 // counters as last sent, by name and labels
+}
+
+func newStatsdExporter(addr string, opts MetricsOptions) (*statsdExporter, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid statsd address '%s': %v", addr, err)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdExporter{conn: conn, tags: statsdTags(opts.Attributes, nil), last: make(map[string]float64)}, nil
+}
+
+// statsdTags renders attributes and labels as '|#k:v,...', "" if none
+func statsdTags(attrs map[string]string, labels [][2]string) string {
+	var tags []string
+
+	for k, v := range attrs {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+
+	for _, l := range labels {
+		tags = append(tags, l[0]+":"+l[1])
+	}
+
+	if len(tags) == 0 {
+		return ""
+	}
+
+	return "|#" + strings.Join(tags, ",")
+}
+
+func (s *statsdExporter) export(ms []metric, now time.Time) error {
+	var buf bytes.Buffer
+	var firstErr error
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+
+		if _, err := s.conn.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		buf.Reset()
+	}
+
+	for _, m := range ms {
+		tags := s.tags
+		if len(m.labels) > 0 {
+			tags = statsdTags(nil, m.labels)
+			if s.tags != "" {
+				tags = s.tags + "," + tags[2:]
+			}
+		}
+
+		var line string
+
+		switch {
+		case m.counter:
+			key := m.name + tags
+			delta := m.value - s.last[key]
+			s.last[key] = m.value
+
+			if delta <= 0 {
+				continue
+			}
+
+			line = fmt.Sprintf("%s:%s|c%s\n", m.name, strconv.FormatFloat(delta, 'f', -1, 64), tags)
+		case m.unit == "s":
+			line = fmt.Sprintf("%s:%s|ms%s\n", m.name, strconv.FormatFloat(m.value*1000, 'f', 3, 64), tags)
+		default:
+			line = fmt.Sprintf("%s:%s|g%s\n", m.name, strconv.FormatFloat(m.value, 'f', -1, 64), tags)
+		}
+
+		if buf.Len()+len(line) > STATSD_MAX_DATAGRAM {
+			flush()
+		}
+		buf.WriteString(line)
+	}
+
+	flush()
+
+	return firstErr
+}
+
+func (s *statsdExporter) close() {
+	s.conn.Close()
+}
+
+// otlpExporter posts cumulative counters and gauges in the JSON encoding
+// of OTLP's ExportMetricsServiceRequest
+type otlpExporter struct {
+	url    string
+	client *http.Client
+	attrs  []otlpAttribute
+	start  time.Time // of the counters
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpPoint struct {
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+	StartTime  string          `json:"startTimeUnixNano,omitempty"`
+	Time       string          `json:"timeUnixNano"`
+	AsDouble   float64         `json:"asDouble"`
+}
+
+type otlpSum struct {
+	Temporality int         `json:"aggregationTemporality"` // 2 is cumulative
+	Monotonic   bool        `json:"isMonotonic"`
+	DataPoints  []otlpPoint `json:"dataPoints"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Unit  string     `json:"unit,omitempty"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+}
+
+func newOtlpExporter(target string, opts MetricsOptions) *otlpExporter {
+	x := &otlpExporter{url: target, client: &http.Client{Timeout: METRICS_TIMEOUT}, attrs: []otlpAttribute{}, start: time.Now()}
+
+	keys := make([]string, 0, len(opts.Attributes))
+	for k := range opts.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		x.attrs = append(x.attrs, otlpAttribute{k, otlpValue{opts.Attributes[k]}})
+	}
+
+	return x
+}
+
+func (x *otlpExporter) export(ms []metric, now time.Time) error {
+	// points of a name go into one metric
+	var metrics []*otlpMetric
+	byName := make(map[string]*otlpMetric)
+
+	for _, m := range ms {
+		p := otlpPoint{Time: strconv.FormatInt(now.UnixNano(), 10), AsDouble: m.value}
+		for _, l := range m.labels {
+			p.Attributes = append(p.Attributes, otlpAttribute{l[0], otlpValue{l[1]}})
+		}
+
+		om := byName[m.name]
+		if om == nil {
+			om = &otlpMetric{Name: m.name, Unit: m.unit}
+			if m.counter {
+				om.Sum = &otlpSum{Temporality: 2, Monotonic: true}
+			} else {
+				om.Gauge = &otlpGauge{}
+			}
+
+			byName[m.name] = om
+			metrics = append(metrics, om)
+		}
+
+		if m.counter {
+			p.StartTime = strconv.FormatInt(x.start.UnixNano(), 10)
+			om.Sum.DataPoints = append(om.Sum.DataPoints, p)
+		} else {
+			om.Gauge.DataPoints = append(om.Gauge.DataPoints, p)
+		}
+	}
+
+	body := map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": x.attrs},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "logit/logg"},
+						"metrics": metrics,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := x.client.Post(x.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("otlp collector answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func (x *otlpExporter) close() {}
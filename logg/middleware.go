@@ -0,0 +1,84 @@
+package logg
+
+import (
+	"sync"
+	"time"
+)
+
+// Middleware changes a message on its way to be written, e.g. adding the
+// hostname to its fields or cutting a long one short; the Entry it gets has
+// no Line yet. middleware runs on the goroutine logging the message, after
+// the level and sampling let it through, so it must be safe for concurrent
+// use and should be quick.
+type Middleware func(e Entry) Entry
+
+var middleware_lock = &sync.Mutex{}
+
+// Use has every message of the logger and of those derived from it pass mw
+// in order, after those used before and before the redactor; what they
+// return is written, with its time, level, caller, message and fields
+// (the logger's name stays). it may be called at any time.
+func (logger *Logger) Use(mw ...Middleware) {
+	core := logger.core()
+
+	middleware_lock.Lock()
+	defer middleware_lock.Unlock()
+
+	old, _ := core.middleware.Load().([]Middleware)
+	core.middleware.Store(append(append([]Middleware(nil), old...), mw...))
+}
+
+// ClearMiddleware undoes Use
+func (logger *Logger) ClearMiddleware() {
+	middleware_lock.Lock()
+	defer middleware_lock.Unlock()
+
+	logger.core().middleware.Store([]Middleware(nil))
+}
+
+// transform runs a token through the logger's middleware; the fields they
+// get are a copy, never nil, as those of the token may be shared with the
+// logger
+func (logger *Logger) transform(token *logToken) {
+	mws, _ := logger.middleware.Load().([]Middleware)
+	if len(mws) == 0 {
+		return
+	}
+
+	at := token.at
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	name, _ := token.names(logger)
+
+	e := Entry{
+		Time:   at,
+		Level:  token.level,
+		Prefix: name,
+		Caller: token.caller,
+		Msg:    token.msg,
+		Fields: make(Fields, len(token.fields)),
+	}
+
+	for k, v := range token.fields {
+		e.Fields[k] = v
+	}
+
+	for _, mw := range mws {
+		e = mw(e)
+	}
+
+	if !e.Time.Equal(at) {
+		token.at = e.Time
+	}
+
+	token.level = e.Level
+	token.caller = e.Caller
+	token.msg = e.Msg
+	token.fields = e.Fields
+
+	if len(token.fields) == 0 {
+		token.fields = nil
+	}
+}
@@ -0,0 +1,79 @@
+package logg
+
+import (
+	"strings"
+)
+
+type MultilineMode int
+
+const (
+	MULTILINE_INDENT MultilineMode = iota // continuation lines start with an indent, the default
+	MULTILINE_ESCAPE                      // newlines written as '\n': a line a message, e.g. a stack trace
+)
+
+// the indent of continuation lines unless SetMultiline says otherwise; it
+// lines them up with the message after the time of the default layout
+const DEFAULT_CONTINUATION_INDENT = "             "
+
+// MULTILINE_ESCAPE writes backslashes as '\\' too, so that UnescapeMessage
+// gets the message back
+var escape_replacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+var unescape_replacer = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+
+func MultilineModeFrom(s string, defaultMode MultilineMode) MultilineMode {
+	switch strings.ToLower(s) {
+	case "indent":
+		return MULTILINE_INDENT
+	case "escape":
+		return MULTILINE_ESCAPE
+	default:
+		return defaultMode
+	}
+}
+
+// SetMultiline sets how text lines carry messages of several lines: with
+// continuation lines starting with indent ("" for
+// DEFAULT_CONTINUATION_INDENT), or escaped into one line. JSON lines escape
+// them anyway. it must be called before the logger is used.
+func (logger *Logger) SetMultiline(mode MultilineMode, indent string) {
+	core := logger.core()
+
+	core.multilineMode = mode
+	core.multiline = nil
+
+	if mode == MULTILINE_INDENT && indent != "" && indent != DEFAULT_CONTINUATION_INDENT {
+		core.multiline = strings.NewReplacer("\n", "\n"+indent)
+	}
+}
+
+// UnescapeMessage returns a message as it was before MULTILINE_ESCAPE wrote
+// it
+func UnescapeMessage(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	return unescape_replacer.Replace(s)
+}
+
+// multilined returns msg as a text line carries it; indent is the shard's
+// replacer for the default indent. only the actor calls it.
+func (logger *Logger) multilined(msg string, indent *strings.Replacer) string {
+	if logger.multilineMode == MULTILINE_ESCAPE {
+		if strings.ContainsAny(msg, "\\\n\r") {
+			return escape_replacer.Replace(msg)
+		}
+
+		return msg
+	}
+
+	if strings.IndexByte(msg, '\n') < 0 {
+		return msg
+	}
+
+	if logger.multiline != nil {
+		return logger.multiline.Replace(msg)
+	}
+
+	return indent.Replace(msg)
+}
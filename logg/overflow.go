@@ -0,0 +1,85 @@
+package logg
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// OverflowPolicy is what a logger does with a message when the queue is full
+type OverflowPolicy int32
+
+const (
+	OVERFLOW_BLOCK       OverflowPolicy = iota // wait for room
+	OVERFLOW_DROP_NEWEST                       // drop the message
+	OVERFLOW_DROP_OLDEST                       // queue it; the actor skips queued messages of such loggers to catch up
+)
+
+func OverflowPolicyFrom(s string, defaultPolicy OverflowPolicy) OverflowPolicy {
+	switch strings.ToLower(s) {
+	case "block":
+		return OVERFLOW_BLOCK
+	case "drop-newest":
+		return OVERFLOW_DROP_NEWEST
+	case "drop-oldest":
+		return OVERFLOW_DROP_OLDEST
+	default:
+		return defaultPolicy
+	}
+}
+
+// SetOverflowPolicy sets what happens to messages of the logger while the
+// queue is full; block (the default) stalls the caller. messages logged
+// with Sync or a sync level always wait. drops count in Dropped.
+func (logger *Logger) SetOverflowPolicy(policy OverflowPolicy) {
+	atomic.StoreInt32(&logger.core().overflow, int32(policy))
+}
+
+func (logger *Logger) OverflowPolicy() OverflowPolicy {
+	return OverflowPolicy(atomic.LoadInt32(&logger.core().overflow))
+}
+
+// enqueue queues a message of the logger by its policy; false if dropped
+func (logger *Logger) enqueue(token logToken) bool {
+	policy := logger.OverflowPolicy()
+	if token.ch != nil {
+		policy = OVERFLOW_BLOCK
+	}
+
+	s := logger.shardOf()
+
+	switch policy {
+	case OVERFLOW_DROP_NEWEST:
+		if !s.in.tryPush(token) {
+			logger.countDropped()
+			return false
+		}
+
+	case OVERFLOW_DROP_OLDEST:
+		if !s.in.tryPush(token) {
+			// the shard is overflowing until its actor has worked the queue
+			// down to half
+			atomic.StoreInt32(&s.overflowing, 1)
+			s.in.push(token)
+		}
+
+	default:
+		s.in.push(token)
+	}
+
+	return true
+}
+
+// shed tells the actor to skip a token to catch up with its queue: a plain
+// message of a drop-oldest logger while the queue overflows
+func (s *shard) shed(token *logToken) bool {
+	if atomic.LoadInt32(&s.overflowing) == 0 {
+		return false
+	}
+
+	if s.in.len() < s.in.cap()/2 {
+		atomic.StoreInt32(&s.overflowing, 0)
+		return false
+	}
+
+	return token.op == TOKEN_WRITE && token.logger != nil && token.ch == nil && token.logger.OverflowPolicy() == OVERFLOW_DROP_OLDEST
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package logg
+
+import (
+	"os"
+)
+
+// chownLike does nothing where files have no Unix owners
+func chownLike(f *os.File, fi os.FileInfo) {}
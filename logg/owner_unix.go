@@ -0,0 +1,16 @@
+//go:build unix
+
+package logg
+
+import (
+	"os"
+	"syscall"
+)
+
+// chownLike gives f the owner of the file fi describes, as far as the
+// process may
+func chownLike(f *os.File, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		f.Chown(int(st.Uid), int(st.Gid))
+	}
+}
@@ -0,0 +1,264 @@
+package logg
+
+import (
+	"regexp"
+	"strings"
+)
+
+// REDACTED replaces the values of fields a Redactor masks whole
+const REDACTED = "[REDACTED]"
+
+// RedactRule replaces what Pattern matches in messages and string fields
+// with Replacement, which may refer to submatches as $1 or ${name}. Verify,
+// if set, tells matches that really are what the rule is after from those
+// that only look like them (e.g. by a checksum).
+type RedactRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+	Verify      func(match string) bool
+}
+
+// the rules RedactRuleNamed knows
+var (
+	RedactEmail = RedactRule{
+		Name:        "email",
+		Pattern:     regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`),
+		Replacement: "[REDACTED:email]",
+	}
+
+	// card numbers of 13 to 19 digits, maybe grouped by spaces or dashes,
+	// passing the Luhn check
+	RedactCard = RedactRule{
+		Name:        "card",
+		Pattern:     regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		Replacement: "[REDACTED:card]",
+		Verify:      luhnValid,
+	}
+
+	// the credentials of 'Bearer ...' and 'Basic ...' authorizations
+	RedactToken = RedactRule{
+		Name:        "token",
+		Pattern:     regexp.MustCompile(`(?i)\b(bearer|basic)(\s+)[A-Za-z0-9\-._~+/]{8,}=*`),
+		Replacement: "${1}${2}[REDACTED:token]",
+	}
+
+	// JSON web tokens, wherever they appear
+	RedactJWT = RedactRule{
+		Name:        "jwt",
+		Pattern:     regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`),
+		Replacement: "[REDACTED:jwt]",
+	}
+
+	// the values of 'password=...', 'api_key: ...', '"secret": "..."' and the
+	// like, keeping their quotes
+	RedactSecret = RedactRule{
+		Name:        "secret",
+		Pattern:     regexp.MustCompile(`(?i)\b(password|passwd|pwd|secret|api[_\-]?key|access[_\-]?token|auth[_\-]?token)("?\s*[=:]\s*)(?:(")[^"]*"|[^\s,;&"}]+)`),
+		Replacement: "${1}${2}${3}[REDACTED:secret]${3}",
+	}
+)
+
+var redact_rules = []RedactRule{RedactEmail, RedactCard, RedactToken, RedactJWT, RedactSecret}
+
+// RedactRuleNamed returns the rule of the package called name: 'email',
+// 'card', 'token', 'jwt' or 'secret'
+func RedactRuleNamed(name string) (RedactRule, bool) {
+	for _, rule := range redact_rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+
+	return RedactRule{}, false
+}
+
+// luhnValid tells whether the digits of s pass the Luhn check
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+		n++
+	}
+
+	return n > 0 && sum%10 == 0
+}
+
+// apply returns s with the rule's matches replaced
+func (rule *RedactRule) apply(s string) string {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+
+	var buf []byte
+	last, replaced := 0, false
+
+	for _, m := range matches {
+		if rule.Verify != nil && !rule.Verify(s[m[0]:m[1]]) {
+			continue
+		}
+
+		buf = append(buf, s[last:m[0]]...)
+		buf = rule.Pattern.ExpandString(buf, rule.Replacement, s, m)
+		last, replaced = m[1], true
+	}
+
+	if !replaced {
+		return s
+	}
+
+	return string(append(buf, s[last:]...))
+}
+
+// Redactor scrubs messages and fields of what shouldn't reach the logs:
+// its rules apply in order to the message and every string field, and the
+// fields it masks lose their values whole. it is safe for concurrent use.
+type Redactor struct {
+	rules  []RedactRule
+	masked map[string]bool // lower cased field names
+}
+
+// NewRedactor returns a redactor applying rules and masking the fields
+// named by fields, whatever their case
+func NewRedactor(rules []RedactRule, fields ...string) *Redactor {
+	r := &Redactor{rules: rules, masked: make(map[string]bool)}
+
+	for _, name := range fields {
+		r.masked[strings.ToLower(name)] = true
+	}
+
+	return r
+}
+
+// Empty tells whether the redactor changes nothing
+func (r *Redactor) Empty() bool {
+	return r == nil || (len(r.rules) == 0 && len(r.masked) == 0)
+}
+
+// Redact returns s with the matches of the rules replaced
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+
+	for i := range r.rules {
+		s = r.rules[i].apply(s)
+	}
+
+	return s
+}
+
+// RedactFields returns fields with the masked ones replaced by REDACTED and
+// the rules applied to strings, descending into maps and lists; fields
+// themselves stay untouched, so a copy is returned if anything changed
+func (r *Redactor) RedactFields(fields Fields) Fields {
+	if r == nil {
+		return fields
+	}
+
+	out, _ := r.redactMap(fields)
+	return out
+}
+
+// redactMap is RedactFields telling whether anything changed
+func (r *Redactor) redactMap(fields map[string]interface{}) (map[string]interface{}, bool) {
+	var out map[string]interface{}
+
+	for k, v := range fields {
+		next, changed := r.redactValue(k, v)
+		if !changed {
+			continue
+		}
+
+		if out == nil {
+			out = make(map[string]interface{}, len(fields))
+			for k, v := range fields {
+				out[k] = v
+			}
+		}
+
+		out[k] = next
+	}
+
+	if out == nil {
+		return fields, false
+	}
+
+	return out, true
+}
+
+// redactValue returns the redacted value of field key and whether it
+// differs from v
+func (r *Redactor) redactValue(key string, v interface{}) (interface{}, bool) {
+	if r.masked[strings.ToLower(key)] {
+		return REDACTED, true
+	}
+
+	switch t := v.(type) {
+	case string:
+		if s := r.Redact(t); s != t {
+			return s, true
+		}
+	case error:
+		if s := r.Redact(t.Error()); s != t.Error() {
+			return s, true
+		}
+	case Fields:
+		if m, changed := r.redactMap(t); changed {
+			return Fields(m), true
+		}
+	case map[string]interface{}:
+		return r.redactMap(t)
+	case []interface{}:
+		var out []interface{}
+
+		for i, item := range t {
+			next, changed := r.redactValue("", item)
+			if !changed {
+				continue
+			}
+
+			if out == nil {
+				out = append([]interface{}(nil), t...)
+			}
+			out[i] = next
+		}
+
+		if out != nil {
+			return out, true
+		}
+	}
+
+	return v, false
+}
+
+// SetRedactor has every message of the logger and of those derived from it
+// pass r before it's queued, so neither the file nor the sinks see what r
+// scrubs; nil turns it off. it may be called at any time.
+func (logger *Logger) SetRedactor(r *Redactor) {
+	logger.core().redactor.Store(r)
+}
+
+// currentRedactor returns what SetRedactor set, nil if nothing
+func (logger *Logger) currentRedactor() *Redactor {
+	r, _ := logger.redactor.Load().(*Redactor)
+	if r.Empty() {
+		return nil
+	}
+
+	return r
+}
@@ -0,0 +1,183 @@
+package logg
+
+import (
+	"errors"
+	"sync"
+)
+
+// the registry keeps loggers by name for programs with a logger of each
+// tenant, sender or module, so they need no locked map of their own
+
+var (
+	registry_lock = &sync.Mutex{}
+	registry      = make(map[string]*registered)
+)
+
+var errNilLogger = errors.New("logg: logger factory returned no logger")
+
+// registered is a name of the registry; ready is closed once its factory
+// returned, setting logger or err
+type registered struct {
+	logger *Logger
+	err    error
+	ready  chan struct{}
+}
+
+// GetOrCreate returns the logger registered as name, calling factory to
+// make and register one if there is none. callers asking for a name while
+// its factory runs wait for it, so the factory of a name runs once; a
+// factory failing registers nothing and its error is returned to all of
+// them.
+func GetOrCreate(name string, factory func() (*Logger, error)) (*Logger, error) {
+	registry_lock.Lock()
+
+	if r, ok := registry[name]; ok {
+		registry_lock.Unlock()
+		<-r.ready
+
+		return r.logger, r.err
+	}
+
+	r := &registered{ready: make(chan struct{})}
+	registry[name] = r
+	registry_lock.Unlock()
+
+	func() {
+		// a panicking factory must not leave its name waited on for good
+		defer close(r.ready)
+
+		var err error
+		if perr := safelyDo(func() { r.logger, err = factory() }); perr != nil {
+			err = perr
+		}
+
+		if err == nil && r.logger == nil {
+			err = errNilLogger
+		}
+
+		if err != nil {
+			r.logger, r.err = nil, err
+		}
+	}()
+
+	if r.err != nil {
+		registry_lock.Lock()
+		if registry[name] == r {
+			delete(registry, name)
+		}
+		registry_lock.Unlock()
+
+		return nil, r.err
+	}
+
+	return r.logger, nil
+}
+
+// Lookup returns the logger registered as name, nil if there is none or
+// it is being made
+func Lookup(name string) *Logger {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+
+	r, ok := registry[name]
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-r.ready:
+		return r.logger
+	default:
+		return nil
+	}
+}
+
+// Register registers logger as name, replacing the one registered before,
+// which it returns (nil if none) without closing it
+func Register(name string, logger *Logger) *Logger {
+	r := &registered{logger: logger, ready: make(chan struct{})}
+	close(r.ready)
+
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+
+	old := registry[name]
+	registry[name] = r
+
+	if old == nil {
+		return nil
+	}
+
+	select {
+	case <-old.ready:
+		return old.logger
+	default:
+		return nil
+	}
+}
+
+// Unregister removes name from the registry if logger is still registered
+// as it (any logger, if nil) and tells whether it did; the logger is not
+// closed. of callers racing to replace a logger, the one it returns true
+// to closes it.
+func Unregister(name string, logger *Logger) bool {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+
+	r, ok := registry[name]
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-r.ready:
+	default:
+		// being made
+		return false
+	}
+
+	if logger != nil && r.logger != logger {
+		return false
+	}
+
+	delete(registry, name)
+	return true
+}
+
+// Loggers returns the registered loggers by name
+func Loggers() map[string]*Logger {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+
+	loggers := make(map[string]*Logger, len(registry))
+
+	for name, r := range registry {
+		select {
+		case <-r.ready:
+			if r.logger != nil {
+				loggers[name] = r.logger
+			}
+		default:
+		}
+	}
+
+	return loggers
+}
+
+// CloseAll unregisters and closes every registered logger and returns the
+// first error closing one
+func CloseAll() error {
+	var firstErr error
+
+	for name, logger := range Loggers() {
+		if !Unregister(name, logger) {
+			continue
+		}
+
+		if err := logger.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
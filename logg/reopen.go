@@ -0,0 +1,89 @@
+package logg
+
+import (
+	golog "log"
+	"sync/atomic"
+)
+
+// Reopen opens the logger's path again and then closes the file it wrote
+// to, for tools like logrotate that rename the file away and want the
+// next lines in a new one. it runs on the logger's actor, so entries
+// queued before the call land in the old file. if the path can't be
+// opened, the logger keeps the old file.
+func (logger *Logger) Reopen() error {
+	if atomic.LoadInt32(&shut_down) != 0 {
+		return ErrShutdown
+	}
+
+	ch := make(chan error, 1)
+	logger.shardOf().in.push(logToken{logger: logger.core(), ch: ch, op: TOKEN_REOPEN})
+
+	return <-ch
+}
+
+// ReopenFiles reopens the files of all file loggers, returning the first
+// error
+func ReopenFiles() error {
+	if atomic.LoadInt32(&shut_down) != 0 {
+		return ErrShutdown
+	}
+
+	files_lock.Lock()
+	open := make([]*Logger, 0, len(files))
+	for logger := range files {
+		open = append(open, logger)
+	}
+	files_lock.Unlock()
+
+	// every actor reopens its loggers' files at once
+	chs := make([]chan error, len(open))
+
+	for i, logger := range open {
+		chs[i] = make(chan error, 1)
+		logger.shardOf().in.push(logToken{logger: logger, ch: chs[i], op: TOKEN_REOPEN})
+	}
+
+	var err error
+
+	for _, ch := range chs {
+		if rerr := <-ch; err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+// reopenFile is Reopen on the actor. unlike a rotation the file may not
+// be new (e.g. after logrotate's copytruncate), so its size counts on.
+func (logger *Logger) reopenFile() error {
+	if logger.filepath == "" || logger.l == nil {
+		return nil
+	}
+
+	logger.writeRepeats()
+	logger.dropBuffer()
+
+	f, err := logger.fileOpts.open(logger.filepath)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if logger.closer != nil {
+		safelyDo(func() {
+			logger.closer.Close()
+		})
+	}
+
+	logger.l = golog.New(f, logger.prefix, golog.Ldate|golog.Lmicroseconds)
+	logger.closer = f
+	logger.written = fi.Size()
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package logg
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// REPEAT_TICK is how often the shards look for repeats whose window passed
+const REPEAT_TICK = time.Second
+
+var repeat_start sync.Once
+
+// lastMessage is the message a logger wrote last, for suppressing repeats
+// of it; only the logger's actor touches it
+type lastMessage struct {
+	level  LogLevel
+	key    string // the message and its fields
+	name   string // of the derived logger it was logged through, if one
+	prefix string
+	since  time.Time
+	count  int64 // repeats left out
+}
+
+// SetSampling has the logger write only 1 of every n messages at level or
+// below (e.g. LOG_LEVEL_DEBUG, 100); n <= 1 writes them all. it may be
+// called at any time.
+func (logger *Logger) SetSampling(level LogLevel, n int) {
+	core := logger.core()
+
+	atomic.StoreInt32(&core.sampleLevel, int32(level))
+	atomic.StoreInt64(&core.sampleEvery, int64(n))
+}
+
+// SetRepeatWindow has the logger write a message repeating the one before
+// it (same level, text and fields) within window only once, followed by
+// 'last message repeated N times' when a different one comes, the window
+// passes or the file is rotated or closed. 0 turns it off. it may be
+// called at any time.
+func (logger *Logger) SetRepeatWindow(window time.Duration) {
+	atomic.StoreInt64(&logger.core().repeatWindow, int64(window))
+
+	if window > 0 {
+		repeat_start.Do(func() {
+			go func() {
+				for _ = range time.Tick(REPEAT_TICK) {
+					for _, s := range shards {
+						s.in.tryPush(logToken{op: TOKEN_REPEATS})
+					}
+				}
+			}()
+		})
+	}
+}
+
+// sampled tells whether a message of level is left out by sampling
+func (logger *Logger) sampled(level LogLevel) bool {
+	n := atomic.LoadInt64(&logger.sampleEvery)
+	if n <= 1 || level > LogLevel(atomic.LoadInt32(&logger.sampleLevel)) {
+		return false
+	}
+
+	return (atomic.AddInt64(&logger.sampleSeen, 1)-1)%n != 0
+}
+
+// repeated tells whether the token repeats the last message and so is left
+// out; otherwise it becomes the last message
+func (logger *Logger) repeated(token *logToken, msg string) bool {
+	window := time.Duration(atomic.LoadInt64(&logger.repeatWindow))
+	if window <= 0 {
+		logger.writeRepeats()
+		return false
+	}
+
+	now := time.Now()
+	key := msg + formatFields(token.fields)
+
+	if last := logger.last; last != nil && last.level == token.level && last.key == key && last.name == token.name && now.Sub(last.since) < window {
+		if last.count == 0 {
+			s := logger.shardOf()
+			if s.repeating == nil {
+				s.repeating = make(map[*Logger]bool)
+			}
+			s.repeating[logger] = true
+		}
+
+		last.count += 1
+		return true
+	}
+
+	logger.writeRepeats()
+	logger.last = &lastMessage{level: token.level, key: key, name: token.name, prefix: token.prefix, since: now}
+
+	return false
+}
+
+// writeRepeats writes how often the last message was repeated, if it was,
+// and forgets it
+func (logger *Logger) writeRepeats() {
+	last := logger.last
+	logger.last = nil
+
+	if last == nil || last.count == 0 {
+		return
+	}
+
+	delete(logger.shardOf().repeating, logger)
+
+	if logger.l == nil {
+		return
+	}
+
+	token := logToken{logger: logger, level: last.level, name: last.name, prefix: last.prefix}
+	token.msg = fmt.Sprintf("last message repeated %d times", last.count)
+
+	n, _ := logger.write(&token, token.msg) // reported by writeLine
+	logger.written += n
+	logger.countWritten(n)
+}
+
+// writeRepeats writes the repeat counts of the shard's loggers; with
+// expired only of those whose window passed
+func (s *shard) writeRepeats(expired bool) {
+	now := time.Now()
+
+	for logger := range s.repeating {
+		window := time.Duration(atomic.LoadInt64(&logger.repeatWindow))
+
+		if !expired || now.Sub(logger.last.since) >= window {
+			logger.writeRepeats()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package logg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SetMaxBackups keeps at most n rotated files (numbered, dated and timed
+// ones together, newest first); 0 (the default) keeps all of them
+func (logger *Logger) SetMaxBackups(n int) {
+	atomic.StoreInt64(&logger.core().maxBackups, int64(n))
+}
+
+// SetRotateHook makes fn run on each rotated file off the actor, before it
+// is compressed (e.g. to re-sort or index it)
+func (logger *Logger) SetRotateHook(fn func(path string)) {
+	logger.core().rotateHook = fn
+}
+
+// SetArchiveHook makes fn run on each rotated file off the actor, once it is
+// compressed (the path it has then) and before old files are pruned, e.g.
+// to upload it; fn may move the file away
+func (logger *Logger) SetArchiveHook(fn func(path string)) {
+	logger.core().archiveHook = fn
+}
+
+// SetMaxAge removes rotated files last written more than d ago; 0 (the
+// default) keeps them regardless of age
+func (logger *Logger) SetMaxAge(d time.Duration) {
+	atomic.StoreInt64(&logger.core().maxAge, int64(d))
+}
+
+// retention is what a finished rotation leaves to the compression workers:
+// compressing the rotated file, then pruning old ones
+type retention struct {
+	rotated    string
+	hook       func(path string)
+	archive    func(path string)
+	sealer     Sealer
+	gz         bool
+	codec      Codec
+	level      int
+	maxBackups int
+	maxAge     time.Duration
+
+	filepath string
+	name     func(i int) string
+	glob     string // of files named by rotation time
+	dated    bool
+
+	noted bool // in the rotation state file, see notePending
+}
+
+// afterRotate snapshots the logger for the work following the rotation of
+// its file to rotated. only the actor calls it.
+func (logger *Logger) afterRotate(rotated string) {
+	r := retention{
+		rotated:    rotated,
+		hook:       logger.rotateHook,
+		archive:    logger.archiveHook,
+		sealer:     logger.sealer,
+		gz:         atomic.LoadInt32(&logger.enableGz) != 0,
+		codec:      Codec(atomic.LoadInt32(&logger.compressCodec)),
+		level:      int(atomic.LoadInt32(&logger.compressLevel)),
+		maxBackups: int(atomic.LoadInt64(&logger.maxBackups)),
+		maxAge:     time.Duration(atomic.LoadInt64(&logger.maxAge)),
+		filepath:   logger.filepath,
+		name:       logger.rotatedName,
+		glob:       logger.rotatedGlob,
+		dated:      logger.policy != nil,
+	}
+
+	if r.hook == nil && r.archive == nil && r.sealer == nil && !r.gz && r.maxBackups <= 0 && r.maxAge <= 0 {
+		return
+	}
+
+	if r.name == nil {
+		r.name = func(i int) string {
+			return fmt.Sprintf("%s.%d", r.filepath, i)
+		}
+	}
+
+	queueRetention(r)
+}
+
+// run returns the error compressing or encrypting the rotated file, if any;
+// old files are pruned regardless
+func (r retention) run() error {
+	var err error
+
+	if r.hook != nil {
+		r.hook(r.rotated)
+	}
+
+	if r.gz {
+		err = CompressFileWith(r.rotated, r.codec, r.level)
+	}
+
+	// a file that couldn't be compressed goes on as it is
+	path := r.rotated
+	if r.gz && err == nil {
+		path += r.codec.Suffix()
+	}
+
+	if r.sealer != nil {
+		if eerr := EncryptFile(path, r.sealer); eerr != nil {
+			// left in the clear rather than lost
+			if err == nil {
+				err = eerr
+			}
+		} else {
+			path += ENCRYPTED_SUFFIX
+		}
+	}
+
+	if r.archive != nil {
+		r.archive(path)
+	}
+
+	if r.maxBackups > 0 || r.maxAge > 0 {
+		r.prune(time.Now())
+	}
+
+	return err
+}
+
+// compressedPaths returns path with each codec's suffix, encrypted or not
+func compressedPaths(path string) []string {
+	suffixes := RotatedSuffixes()
+
+	paths := make([]string, len(suffixes))
+	for i, suffix := range suffixes {
+		paths[i] = path + suffix
+	}
+
+	return paths
+}
+
+type backup struct {
+	path    string
+	modTime time.Time
+}
+
+// backups lists the rotated files of the logger, newest first
+func (r retention) backups() []backup {
+	var found []backup
+
+	add := func(path string) bool {
+		ok := false
+
+		for _, p := range append([]string{path}, compressedPaths(path)...) {
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				found = append(found, backup{p, fi.ModTime()})
+				ok = true
+			}
+		}
+
+		return ok
+	}
+
+	if r.glob == "" {
+		for i := 0; add(r.name(i)); i++ {
+			if i > 0 && r.name(i) == r.name(0) {
+				break // a name without the number
+			}
+		}
+	} else {
+		// compressed ones and the '.N' of names taken
+		plain, _ := filepath.Glob(r.glob)
+		more, _ := filepath.Glob(r.glob + ".*")
+
+		for _, path := range append(plain, more...) {
+			if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && !strings.HasSuffix(path, ".tmp") {
+				found = append(found, backup{path, fi.ModTime()})
+			}
+		}
+	}
+
+	if r.dated {
+		matches, _ := filepath.Glob(r.filepath + ".[0-9][0-9][0-9][0-9]-*")
+
+		for _, path := range matches {
+			if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && !strings.HasSuffix(path, ".tmp") {
+				found = append(found, backup{path, fi.ModTime()})
+			}
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].modTime.After(found[j].modTime)
+	})
+
+	return found
+}
+
+func (r retention) prune(now time.Time) {
+	for i, b := range r.backups() {
+		tooMany := r.maxBackups > 0 && i >= r.maxBackups
+		tooOld := r.maxAge > 0 && now.Sub(b.modTime) > r.maxAge
+
+		if tooMany || tooOld {
+			os.Remove(b.path)
+		}
+	}
+}
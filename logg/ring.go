@@ -0,0 +1,186 @@
+package logg
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ring_spins       = 64 // Gosched rounds before a full-queue producer sleeps
+	ring_max_backoff = time.Millisecond
+)
+
+type ringSlot struct {
+	seq   uint64 // pos when writable, pos+1 once the token is published
+	token logToken
+}
+
+// ring is a bounded lock-free multi-producer / single-consumer queue of
+// tokens (a sequence numbered slot array as described by D. Vyukov). the
+// consumer parks on a doorbell channel only when the queue runs empty, so
+// producers normally never touch a channel or a mutex.
+type ring struct {
+	_    [8]uint64 // keep head and tail on their own cache lines
+	head uint64    // next position to consume; written by the consumer only
+	_    [7]uint64
+	tail uint64 // next position to claim
+	_    [7]uint64
+
+	mask  uint64
+	slots []ringSlot
+
+	sleeping int32 // consumer is (about to be) parked on doorbell
+	doorbell chan struct{}
+}
+
+func newRing(size int) *ring {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+
+	r := &ring{
+		mask:     uint64(n - 1),
+		slots:    make([]ringSlot, n),
+		doorbell: make(chan struct{}, 1),
+	}
+
+	for i := range r.slots {
+		r.slots[i].seq = uint64(i)
+	}
+
+	return r
+}
+
+// push enqueues a token, waiting while the queue is full
+func (r *ring) push(t logToken) {
+	spins := 0
+	backoff := time.Microsecond
+
+	for !r.tryPush(t) {
+		if spins < ring_spins {
+			spins += 1
+			runtime.Gosched()
+		} else {
+			time.Sleep(backoff)
+			if backoff < ring_max_backoff {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// pushUntil is push giving up once ctx ends, returning its error
+func (r *ring) pushUntil(ctx context.Context, t logToken) error {
+	spins := 0
+	backoff := time.Microsecond
+
+	for !r.tryPush(t) {
+		if spins < ring_spins {
+			spins += 1
+			runtime.Gosched()
+			continue
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff < ring_max_backoff {
+			backoff *= 2
+		}
+	}
+
+	return nil
+}
+
+// tryPush enqueues a token unless the queue is full
+func (r *ring) tryPush(t logToken) bool {
+	for {
+		pos := atomic.LoadUint64(&r.tail)
+		slot := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint64(&slot.seq)
+
+		switch diff := int64(seq) - int64(pos); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&r.tail, pos, pos+1) {
+				slot.token = t
+				atomic.StoreUint64(&slot.seq, pos+1)
+
+				if atomic.CompareAndSwapInt32(&r.sleeping, 1, 0) {
+					select {
+					case r.doorbell <- struct{}{}:
+					default:
+					}
+				}
+
+				return true
+			}
+
+		case diff < 0:
+			// full: the consumer hasn't released this slot yet
+			return false
+		}
+	}
+}
+
+// popBatch moves up to len(buf) published tokens into buf and returns how many
+// it took; it never blocks. only the actor may call it.
+func (r *ring) popBatch(buf []logToken) int {
+	pos := r.head
+	n := 0
+
+	for n < len(buf) {
+		slot := &r.slots[pos&r.mask]
+		if atomic.LoadUint64(&slot.seq) != pos+1 {
+			break
+		}
+
+		buf[n] = slot.token
+		slot.token = logToken{} // drop references for the gc
+		atomic.StoreUint64(&slot.seq, pos+r.mask+1)
+
+		pos += 1
+		n += 1
+	}
+
+	if n > 0 {
+		atomic.StoreUint64(&r.head, pos)
+	}
+
+	return n
+}
+
+// wait parks the consumer until a producer publishes something
+func (r *ring) wait() {
+	atomic.StoreInt32(&r.sleeping, 1)
+
+	// a producer may have published before it could see the flag
+	slot := &r.slots[r.head&r.mask]
+	if atomic.LoadUint64(&slot.seq) == r.head+1 {
+		atomic.StoreInt32(&r.sleeping, 0)
+		return
+	}
+
+	<-r.doorbell
+}
+
+func (r *ring) len() int {
+	n := int(atomic.LoadUint64(&r.tail) - atomic.LoadUint64(&r.head))
+
+	if n < 0 {
+		return 0
+	} else if n > len(r.slots) {
+		return len(r.slots)
+	}
+
+	return n
+}
+
+func (r *ring) cap() int {
+	return len(r.slots)
+}
@@ -0,0 +1,349 @@
+package logg
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ringTimeout is how long a test waits on the ring before calling it hung
+const ringTimeout = 30 * time.Second
+
+// newRingAt is newRing with its positions starting at start
+func newRingAt(size int, start uint64) *ring {
+	r := newRing(size)
+	r.head, r.tail = start, start
+
+	for i := uint64(0); i < uint64(len(r.slots)); i++ {
+		r.slots[(start+i)&r.mask].seq = start + i
+	}
+
+	return r
+}
+
+// ringToken is token i of producer p
+func ringToken(p, i int) logToken {
+	return logToken{level: LogLevel(p), at: time.Unix(0, int64(i))}
+}
+
+// consume pops n tokens as the actor does, parking when the ring is empty,
+// and passes each to fn; it fails the test rather than hang on a missed
+// wakeup
+func consume(t *testing.T, r *ring, n int, fn func(token logToken)) {
+	t.Helper()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		buf := make([]logToken, LOG_BATCH)
+
+		for n > 0 {
+			k := r.popBatch(buf)
+			if k == 0 {
+				r.wait()
+				continue
+			}
+
+			for _, token := range buf[:k] {
+				fn(token)
+			}
+
+			n -= k
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(ringTimeout):
+		t.Fatalf("consumer hung with %d tokens to go", n)
+	}
+}
+
+// tokens of many producers all come out once, each producer's in order
+func TestRingProducers(t *testing.T) {
+	const producers, perProducer = 16, 20000
+
+	for _, size := range []int{2, 64, 1024} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			r := newRing(size)
+
+			var start sync.WaitGroup
+			start.Add(1)
+
+			for p := 0; p < producers; p++ {
+				go func(p int) {
+					start.Wait()
+
+					for i := 0; i < perProducer; i++ {
+						if i%3 == 0 {
+							r.pushUntil(context.Background(), ringToken(p, i))
+						} else {
+							r.push(ringToken(p, i))
+						}
+					}
+				}(p)
+			}
+
+			start.Done()
+
+			next := make([]int, producers)
+
+			consume(t, r, producers*perProducer, func(token logToken) {
+				p, i := int(token.level), int(token.at.UnixNano())
+
+				if i != next[p] {
+					t.Fatalf("producer %d: got token %d, expected %d", p, i, next[p])
+				}
+				next[p] += 1
+			})
+
+			if n := r.len(); n != 0 {
+				t.Errorf("%d tokens left", n)
+			}
+		})
+	}
+}
+
+func TestRingFull(t *testing.T) {
+	r := newRing(3)
+	if r.cap() != 4 {
+		t.Fatalf("got capacity %d, expected 4", r.cap())
+	}
+
+	for i := 0; i < 4; i++ {
+		if !r.tryPush(ringToken(0, i)) {
+			t.Fatalf("token %d refused", i)
+		}
+	}
+
+	if r.tryPush(ringToken(0, 4)) || r.len() != 4 {
+		t.Fatalf("full ring took a token (%d of %d)", r.len(), r.cap())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := r.pushUntil(ctx, ringToken(0, 4)); err != context.DeadlineExceeded {
+		t.Errorf("pushUntil on a full ring: got %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	// push waits for the consumer to make room
+	pushed := make(chan struct{})
+	go func() {
+		r.push(ringToken(0, 4))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("push didn't wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	buf := make([]logToken, 1)
+	if r.popBatch(buf) != 1 || buf[0].at.UnixNano() != 0 {
+		t.Fatalf("got %v, expected token 0", buf[0])
+	}
+
+	select {
+	case <-pushed:
+	case <-time.After(ringTimeout):
+		t.Fatalf("push hung once there was room")
+	}
+
+	next := 1
+	consume(t, r, 4, func(token logToken) {
+		if i := int(token.at.UnixNano()); i != next {
+			t.Errorf("got token %d, expected %d", i, next)
+		}
+		next += 1
+	})
+}
+
+// positions wrapping past 2^64 keep the ring in order, full and empty
+func TestRingWraparound(t *testing.T) {
+	r := newRingAt(8, ^uint64(0)-20)
+
+	buf := make([]logToken, 8)
+	pushed, popped := 0, 0
+
+	for round := 0; round < 10; round++ {
+		for r.tryPush(ringToken(0, pushed)) {
+			pushed += 1
+		}
+
+		if r.len() != r.cap() {
+			t.Fatalf("round %d: full ring of %d tokens, expected %d", round, r.len(), r.cap())
+		}
+
+		n := r.popBatch(buf[:5])
+		for _, token := range buf[:n] {
+			if i := int(token.at.UnixNano()); i != popped {
+				t.Fatalf("round %d: got token %d, expected %d", round, i, popped)
+			}
+			popped += 1
+		}
+
+		if n != 5 || r.len() != 3 {
+			t.Fatalf("round %d: popped %d, %d left", round, n, r.len())
+		}
+	}
+
+	if r.tail > 100 {
+		t.Fatalf("positions didn't wrap: tail at %d", r.tail)
+	}
+
+	consume(t, r, pushed-popped, func(token logToken) {
+		if i := int(token.at.UnixNano()); i != popped {
+			t.Fatalf("got token %d, expected %d", i, popped)
+		}
+		popped += 1
+	})
+
+	if r.popBatch(buf) != 0 || r.len() != 0 {
+		t.Errorf("empty ring gave tokens")
+	}
+}
+
+// a token published while the consumer goes to sleep wakes it, however the
+// two interleave
+func TestRingWait(t *testing.T) {
+	r := newRing(4)
+
+	// parked before the push
+	woken := make(chan struct{})
+	go func() {
+		r.wait()
+		close(woken)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	r.push(ringToken(0, 0))
+
+	select {
+	case <-woken:
+	case <-time.After(ringTimeout):
+		t.Fatalf("consumer not woken")
+	}
+
+	// published before it parks: wait sees it and doesn't park
+	buf := make([]logToken, 4)
+	if n := r.popBatch(buf); n != 1 {
+		t.Fatalf("got %d tokens, expected 1", n)
+	}
+
+	if !r.tryPush(ringToken(0, 1)) {
+		t.Fatalf("token refused")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(ringTimeout):
+		t.Fatalf("consumer parked on a published token")
+	}
+
+	// racing, one token at a time
+	const n = 100000
+
+	go func() {
+		for i := 0; i < n; i++ {
+			r.push(ringToken(0, i))
+		}
+	}()
+
+	consume(t, r, n+1, func(logToken) {})
+}
+
+// a full queue makes each overflow policy block, drop the message or shed
+// older ones
+func TestRingOverflowPolicies(t *testing.T) {
+	logger := NewLogger("", io.Discard, LOG_LEVEL_DEBUG)
+	s := &shard{in: newRing(4)} // no actor: the test consumes
+	logger.shard = s
+
+	fill := func() {
+		for s.in.tryPush(logToken{logger: logger, op: TOKEN_WRITE}) {
+		}
+	}
+
+	// drop newest: refused and counted, the queue as it was
+	logger.SetOverflowPolicy(OVERFLOW_DROP_NEWEST)
+	fill()
+
+	if logger.enqueue(logToken{logger: logger, op: TOKEN_WRITE}) || logger.Dropped() != 1 || s.in.len() != 4 {
+		t.Errorf("drop newest: got %d dropped, %d queued", logger.Dropped(), s.in.len())
+	}
+
+	// a message waited on blocks whatever the policy
+	waited := make(chan bool)
+	go func() {
+		waited <- logger.enqueue(logToken{logger: logger, op: TOKEN_WRITE, ch: make(chan error, 1)})
+	}()
+
+	buf := make([]logToken, 4)
+	time.Sleep(20 * time.Millisecond)
+	s.in.popBatch(buf[:1])
+
+	if ok := <-waited; !ok {
+		t.Errorf("drop newest: waited message dropped")
+	}
+
+	// block: waits for room
+	logger.SetOverflowPolicy(OVERFLOW_BLOCK)
+	fill()
+
+	blocked := make(chan bool)
+	go func() {
+		blocked <- logger.enqueue(logToken{logger: logger, op: TOKEN_WRITE})
+	}()
+
+	select {
+	case <-blocked:
+		t.Fatalf("block: enqueued into a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.in.popBatch(buf[:1])
+	if ok := <-blocked; !ok || s.in.len() != 4 {
+		t.Errorf("block: got %v, %d queued", ok, s.in.len())
+	}
+
+	// drop oldest: the message waits for room, and the actor sheds plain
+	// messages until the queue is down to half
+	logger.SetOverflowPolicy(OVERFLOW_DROP_OLDEST)
+
+	shedding := make(chan bool)
+	go func() {
+		shedding <- logger.enqueue(logToken{logger: logger, op: TOKEN_WRITE})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	s.in.popBatch(buf[:1])
+
+	if ok := <-shedding; !ok {
+		t.Errorf("drop oldest: message dropped")
+	}
+
+	plain := logToken{logger: logger, op: TOKEN_WRITE}
+	waitedOn := logToken{logger: logger, op: TOKEN_WRITE, ch: make(chan error, 1)}
+
+	if !s.shed(&plain) || s.shed(&waitedOn) {
+		t.Errorf("drop oldest: plain message shed %v, waited one %v", s.shed(&plain), s.shed(&waitedOn))
+	}
+
+	s.in.popBatch(buf[:3])
+	if s.shed(&plain) {
+		t.Errorf("drop oldest: shedding below half the queue")
+	}
+}
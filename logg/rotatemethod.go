@@ -0,0 +1,83 @@
+package logg
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// RotateMethod is how a rotation moves the live file aside
+type RotateMethod int32
+
+const (
+	ROTATE_BY_RENAME        RotateMethod = iota // rename it and start a new file
+	ROTATE_BY_COPY_TRUNCATE                     // copy it aside and truncate it
+)
+
+func RotateMethodFrom(s string, defaultMethod RotateMethod) RotateMethod {
+	switch strings.ToLower(s) {
+	case "rename":
+		return ROTATE_BY_RENAME
+	case "copytruncate", "copy-truncate":
+		return ROTATE_BY_COPY_TRUNCATE
+	default:
+		return defaultMethod
+	}
+}
+
+// SetRotateMethod sets how rotations move the logger's file aside. renaming
+// fails on Windows while another process has the file open, e.g. a tail or
+// a virus scanner; copying and truncating it doesn't, but copies the whole
+// file and loses what others append meanwhile. file loggers start with
+// DEFAULT_ROTATE_METHOD; it may be called at any time.
+func (logger *Logger) SetRotateMethod(method RotateMethod) {
+	atomic.StoreInt32(&logger.core().rotateMethod, int32(method))
+}
+
+func (logger *Logger) RotateMethod() RotateMethod {
+	return RotateMethod(atomic.LoadInt32(&logger.core().rotateMethod))
+}
+
+// moveLive moves the live file to path the logger's RotateMethod's way;
+// the actor closed its handle before
+func (logger *Logger) moveLive(path string) error {
+	if logger.RotateMethod() != ROTATE_BY_COPY_TRUNCATE {
+		return os.Rename(logger.filepath, path)
+	}
+
+	err := copyFile(logger.filepath, path, logger.fileOpts)
+	if err == nil {
+		err = os.Truncate(logger.filepath, 0)
+	}
+
+	return err
+}
+
+// copyFile copies from to a new file to, created as opts say
+func copyFile(from, to string, opts FileOptions) error {
+	r, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := opts.open(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if serr := w.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(to)
+	}
+
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package logg
+
+// DEFAULT_ROTATE_METHOD is how file loggers rotate unless told otherwise
+const DEFAULT_ROTATE_METHOD = ROTATE_BY_RENAME
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package logg
+
+import (
+	"strings"
+	"testing"
+)
+
+// renaming a file others have open only works off Windows
+func TestRotateByRename(t *testing.T) {
+	live, rotated, same := rotateAround(t, ROTATE_BY_RENAME)
+
+	if !strings.Contains(rotated, "before rotation") || strings.Contains(rotated, "after rotation") {
+		t.Errorf("rotated file holds %q, expected the line before the rotation only", rotated)
+	}
+
+	if !strings.Contains(live, "after rotation") || strings.Contains(live, "before rotation") {
+		t.Errorf("live file holds %q, expected the line after the rotation only", live)
+	}
+
+	if same {
+		t.Errorf("live file kept, expected a new one")
+	}
+}
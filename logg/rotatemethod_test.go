@@ -0,0 +1,96 @@
+package logg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rotateAround writes a line, rotates the logger's file with method while
+// another handle has it open, writes another line and returns what the
+// live and the rotated file hold, and whether the live file is still the
+// one opened before
+func rotateAround(t *testing.T, method RotateMethod) (live, rotated string, same bool) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	logger, err := NewFileLogger("", path, LOG_LEVEL_DEBUG, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	logger.SetRotateMethod(method)
+
+	if err := logger.PrintfWait(context.Background(), "before rotation"); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. a tail, or a virus scanner on Windows
+	held, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	before, err := held.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := logger.Rotate(); err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+
+	if err := logger.PrintfWait(context.Background(), "after rotation"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.ReadFile(path + ".0")
+	if err != nil {
+		t.Fatalf("no rotated file: %v", err)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b), string(r), os.SameFile(before, after)
+}
+
+func TestRotateByCopyTruncate(t *testing.T) {
+	live, rotated, same := rotateAround(t, ROTATE_BY_COPY_TRUNCATE)
+
+	if !strings.Contains(rotated, "before rotation") || strings.Contains(rotated, "after rotation") {
+		t.Errorf("rotated file holds %q, expected the line before the rotation only", rotated)
+	}
+
+	if !strings.Contains(live, "after rotation") || strings.Contains(live, "before rotation") {
+		t.Errorf("live file holds %q, expected the line after the rotation only", live)
+	}
+
+	// readers holding the file go on reading what is written to it
+	if !same {
+		t.Errorf("live file replaced, expected it truncated in place")
+	}
+}
+
+func TestRotateMethodFrom(t *testing.T) {
+	for s, method := range map[string]RotateMethod{
+		"rename":        ROTATE_BY_RENAME,
+		"copytruncate":  ROTATE_BY_COPY_TRUNCATE,
+		"Copy-Truncate": ROTATE_BY_COPY_TRUNCATE,
+		"move":          -1,
+	} {
+		if got := RotateMethodFrom(s, -1); got != method {
+			t.Errorf("%q: got %v, expected %v", s, got, method)
+		}
+	}
+}
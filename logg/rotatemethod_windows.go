@@ -0,0 +1,5 @@
+package logg
+
+// DEFAULT_ROTATE_METHOD is how file loggers rotate unless told otherwise;
+// on Windows an open file can't be renamed
+const DEFAULT_ROTATE_METHOD = ROTATE_BY_COPY_TRUNCATE
@@ -0,0 +1,37 @@
+package logg
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// renaming a file another process has open fails on Windows, so file
+// loggers copy and truncate there unless told otherwise
+func TestRotateMethodWindows(t *testing.T) {
+	if DEFAULT_ROTATE_METHOD != ROTATE_BY_COPY_TRUNCATE {
+		t.Fatalf("default rotate method %v, expected copy-truncate", DEFAULT_ROTATE_METHOD)
+	}
+
+	logger, err := NewFileLogger("", filepath.Join(t.TempDir(), "app.log"), LOG_LEVEL_DEBUG, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	if m := logger.RotateMethod(); m != ROTATE_BY_COPY_TRUNCATE {
+		t.Errorf("file logger rotates by %v, expected copy-truncate", m)
+	}
+}
+
+// a file held open elsewhere is rotated without renaming it
+func TestRotateHeldFileWindows(t *testing.T) {
+	live, rotated, same := rotateAround(t, DEFAULT_ROTATE_METHOD)
+
+	if rotated == "" || live == "" {
+		t.Errorf("live file holds %q and rotated file %q, expected a line each", live, rotated)
+	}
+
+	if !same {
+		t.Errorf("live file replaced, expected it truncated in place")
+	}
+}
@@ -0,0 +1,241 @@
+package logg
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RotationPolicy rolls a file over at points in time, independent of its size
+type RotationPolicy interface {
+	// Next returns the first rotation point after t
+	Next(t time.Time) time.Time
+
+	// Layout formats the start of a period into the suffix of its file
+	Layout() string
+}
+
+type intervalPolicy struct {
+	d      time.Duration
+	layout string
+}
+
+var (
+	ROTATE_HOURLY RotationPolicy = intervalPolicy{time.Hour, "2006-01-02-15"}
+	ROTATE_DAILY  RotationPolicy = intervalPolicy{24 * time.Hour, "2006-01-02"}
+)
+
+func (p intervalPolicy) Next(t time.Time) time.Time {
+	y, m, d := t.Date()
+
+	if p.d == time.Hour {
+		return time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+	}
+
+	// midnight in the local zone, whatever the length of the day
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
+func (p intervalPolicy) Layout() string {
+	return p.layout
+}
+
+// cronPolicy rotates at the minutes matching a five field cron expression
+// ('minute hour day-of-month month day-of-week'; fields take '*', numbers,
+// ranges 'a-b', steps '/n' and lists 'a,b')
+type cronPolicy struct {
+	minute, hour, dom, month, dow uint64 // bit sets
+	domAny, dowAny                bool
+}
+
+func parseCronField(s string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+			lo, hi = n, n
+
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range '%s'", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' out of range %d-%d", part, min, max)
+		}
+
+		for i := lo; i <= hi; i += step {
+			set |= 1 << uint(i)
+		}
+	}
+
+	return set, nil
+}
+
+// ParseCron parses a five field cron expression into a rotation policy
+func ParseCron(expr string) (RotationPolicy, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", expr)
+	}
+
+	p := &cronPolicy{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+
+	var err error
+
+	sets := []*uint64{&p.minute, &p.hour, &p.dom, &p.month, &p.dow}
+	ranges := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+	for i, f := range fields {
+		if *sets[i], err = parseCronField(f, ranges[i][0], ranges[i][1]); err != nil {
+			return nil, fmt.Errorf("cron field %d: %v", i+1, err)
+		}
+	}
+
+	// 7 is another sunday
+	if p.dow&(1<<7) != 0 {
+		p.dow |= 1
+	}
+
+	return p, nil
+}
+
+func (p *cronPolicy) matches(t time.Time) bool {
+	if p.minute&(1<<uint(t.Minute())) == 0 || p.hour&(1<<uint(t.Hour())) == 0 || p.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := p.dom&(1<<uint(t.Day())) != 0
+	dow := p.dow&(1<<uint(t.Weekday())) != 0
+
+	// like cron: when both days are restricted either one may match
+	switch {
+	case p.domAny && p.dowAny:
+		return true
+	case p.domAny:
+		return dow
+	case p.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (p *cronPolicy) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// 4 years covers every combination including feb 29
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if p.matches(t) {
+			return t
+		}
+	}
+
+	return time.Time{} // never; the expression can't match (e.g. feb 31)
+}
+
+func (p *cronPolicy) Layout() string {
+	return "2006-01-02-1504"
+}
+
+// SetRotationPolicy makes the logger roll its file over at the points of p,
+// renaming it to '<file>.<period start>' (e.g. 'app.log.2024-05-01'); size
+// based rotation keeps working alongside. it must be called before the logger
+// is used.
+func (logger *Logger) SetRotationPolicy(p RotationPolicy) {
+	logger = logger.core()
+	logger.policy = p
+
+	// a file left from an earlier period is rolled over on the first write
+	start := time.Now()
+	if fi, err := os.Stat(logger.filepath); err == nil && fi.Size() > 0 {
+		start = fi.ModTime()
+	}
+
+	logger.periodStart = start
+	if p != nil {
+		logger.nextRotation = p.Next(start)
+	}
+}
+
+func NewFileLoggerWithRotation(prefix string, filepath string, allowedLogLevel LogLevel, maxSize int64, enableGz bool, policy RotationPolicy) (*Logger, error) {
+	logger, err := NewFileLogger(prefix, filepath, allowedLogLevel, maxSize, enableGz)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.SetRotationPolicy(policy)
+
+	return logger, nil
+}
+
+// datedPath returns the name the current period's file is moved to, avoiding
+// files already there (e.g. when the period was cut short by a restart)
+func (logger *Logger) datedPath() string {
+	path := fmt.Sprintf("%s.%s", logger.filepath, logger.periodStart.Format(logger.policy.Layout()))
+
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil || compressedExists(p)
+	}
+
+	if !exists(path) {
+		return path
+	}
+
+	for i := 1; ; i++ {
+		if p := fmt.Sprintf("%s.%d", path, i); !exists(p) {
+			return p
+		}
+	}
+}
+
+// rotateTimed moves the file of a finished period aside. only the actor calls
+// it.
+func (logger *Logger) rotateTimed(now time.Time) error {
+	dated := logger.datedPath()
+
+	err := logger.reopen(func() {
+		if err := logger.moveLive(dated); err != nil {
+			logger.reportError(err)
+		}
+	})
+
+	logger.periodStart = now
+	logger.nextRotation = logger.policy.Next(now)
+
+	if err == nil {
+		logger.afterRotate(dated)
+	}
+
+	return err
+}
@@ -0,0 +1,188 @@
+package logg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ROTATION_STATE_FILE, kept in the directory of rotated files, lists those
+// whose compression is under way, so RecoverRotations can finish them after
+// a crash; it is removed once none are
+const ROTATION_STATE_FILE = ".logg-rotations"
+
+var (
+	state_lock    sync.Mutex
+	state_pending = make(map[string]int) // compressions under way, by directory
+)
+
+// rotationRecord is a line of the state file: a rotated file queued for
+// compression, or done with
+type rotationRecord struct {
+	Path  string `json:"path"`
+	Codec string `json:"codec,omitempty"`
+	Level int    `json:"level,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+}
+
+// notePending records that r's file is to be compressed, synced so the
+// record outlives a crash; false if it couldn't
+func notePending(r retention) bool {
+	dir := filepath.Dir(r.rotated)
+
+	state_lock.Lock()
+	defer state_lock.Unlock()
+
+	if appendRotationRecord(dir, rotationRecord{Path: filepath.Base(r.rotated), Codec: r.codec.String(), Level: r.level}, true) != nil {
+		return false
+	}
+
+	state_pending[dir] += 1
+	return true
+}
+
+// noteDone records that the file of r, noted pending, was dealt with,
+// removing the state file once nothing of its directory is
+func noteDone(r retention) {
+	dir := filepath.Dir(r.rotated)
+
+	state_lock.Lock()
+	defer state_lock.Unlock()
+
+	if state_pending[dir] <= 1 {
+		delete(state_pending, dir)
+		os.Remove(filepath.Join(dir, ROTATION_STATE_FILE))
+		return
+	}
+
+	state_pending[dir] -= 1
+	appendRotationRecord(dir, rotationRecord{Path: filepath.Base(r.rotated), Done: true}, false)
+}
+
+func appendRotationRecord(dir string, rec rotationRecord, sync bool) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, ROTATION_STATE_FILE), os.O_CREATE|os.O_APPEND|os.O_WRONLY, DEFAULT_FILE_MODE)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// RotationRecovery tells what RecoverRotations did
+type RotationRecovery struct {
+	Finished int // compressions completed
+	Cleaned  int // partial outputs and plain files already compressed, removed
+	Failed   int // compressions that failed again
+}
+
+func (r RotationRecovery) String() string {
+	return fmt.Sprintf("%d compressions finished, %d leftovers removed, %d failures", r.Finished, r.Cleaned, r.Failed)
+}
+
+// RecoverRotations finishes the compressions the state file of dir says
+// were under way when a previous process stopped: a partial output is
+// removed and the rotated file compressed again, a plain file left next to
+// its complete compressed one is removed. the state file goes afterwards.
+// it must be called before loggers writing to dir rotate; the error is of
+// the first compression failing.
+func RecoverRotations(dir string) (RotationRecovery, error) {
+	var report RotationRecovery
+
+	path := filepath.Join(dir, ROTATION_STATE_FILE)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	pending := make(map[string]rotationRecord)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec rotationRecord
+
+		// a torn last line is of a record that wasn't synced
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.Path == "" || filepath.Base(rec.Path) != rec.Path {
+			continue
+		}
+
+		if rec.Done {
+			delete(pending, rec.Path)
+		} else {
+			pending[rec.Path] = rec
+		}
+	}
+	f.Close()
+
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var firstErr error
+
+	for _, name := range names {
+		rec := pending[name]
+		rotated := filepath.Join(dir, name)
+
+		codec, err := ParseCodec(rec.Codec)
+		if err != nil {
+			codec = GZIP
+		}
+
+		for _, suffix := range CompressedSuffixes {
+			if os.Remove(rotated+suffix+".tmp") == nil {
+				report.Cleaned += 1
+			}
+		}
+
+		if _, err := os.Stat(rotated); err != nil {
+			// compressed, pruned or moved on
+			continue
+		}
+
+		if _, err := os.Stat(rotated + codec.Suffix()); err == nil {
+			// renamed into place but not removed yet
+			if os.Remove(rotated) == nil {
+				report.Cleaned += 1
+			}
+			continue
+		}
+
+		if err := CompressFileWith(rotated, codec, rec.Level); err != nil {
+			report.Failed += 1
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("compressing '%s' failed: %v", rotated, err)
+			}
+			continue
+		}
+
+		report.Finished += 1
+	}
+
+	os.Remove(path)
+
+	return report, firstErr
+}
@@ -0,0 +1,201 @@
+package logg
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LOG_SHARDS is the number of actors. every logger is assigned one when made,
+// round robin, and all its tokens go through it, so the messages of a logger
+// stay in order while a slow file only holds up the loggers of its shard.
+const LOG_SHARDS = 8
+
+// shard is an actor: a queue and the goroutine handling its tokens. only that
+// goroutine touches the files and writers of the shard's loggers.
+type shard struct {
+	in *ring
+
+	overflowing int32 // see shed
+
+	// of the writes of the shard's actor, for WriteLatency; atomic
+	writeStart  int64 // UnixNano the write under way started, 0 if none
+	writeEnd    int64 // UnixNano the last write ended
+	lastLatency int64 // nanoseconds the last write took
+
+	repeating map[*Logger]bool // loggers leaving out repeats; the actor's own
+	buffered  map[*Logger]bool // loggers with lines in their buffer; likewise
+
+	// scratch buffers text lines are rendered into; likewise
+	line    []byte
+	colored []byte
+}
+
+var (
+	shards     [LOG_SHARDS]*shard
+	next_shard uint32
+)
+
+func startShards() {
+	for i := range shards {
+		shards[i] = &shard{in: newRing(LOG_QUEUE)} // when queue is full with queue size, caller would to wait sometime
+		shards[i].start()
+	}
+}
+
+// nextShard picks the shard of a new logger
+func nextShard() *shard {
+	return shards[(atomic.AddUint32(&next_shard, 1)-1)%LOG_SHARDS]
+}
+
+// QueueLen returns the number of tokens waiting for the actor of the
+// logger's shard and the capacity of its queue; the logger's producers
+// block once it is full, whatever the other shards hold
+func (logger *Logger) QueueLen() (int, int) {
+	s := logger.shardOf()
+	return s.in.len(), s.in.cap()
+}
+
+// FullestQueueLen is QueueLen of the fullest shard
+func FullestQueueLen() (int, int) {
+	n, capacity := 0, 0
+	for _, s := range shards {
+		if l := s.in.len(); capacity == 0 || l*capacity > n*s.in.cap() {
+			n, capacity = l, s.in.cap()
+		}
+	}
+
+	return n, capacity
+}
+
+// WriteLatency returns how long the writes of the logger's shard take of
+// late: the longer of the write under way, as long as it has taken so far,
+// and the last one if it ended within window. it is 0 for a shard that
+// hasn't written in window, so one written to no more isn't taken for slow
+// on the strength of its last write.
+func (logger *Logger) WriteLatency(window time.Duration) time.Duration {
+	return logger.shardOf().writeLatency(time.Now(), window)
+}
+
+// SlowestWriteLatency is WriteLatency of the slowest shard
+func SlowestWriteLatency(window time.Duration) time.Duration {
+	now := time.Now()
+
+	var slowest time.Duration
+	for _, s := range shards {
+		if l := s.writeLatency(now, window); l > slowest {
+			slowest = l
+		}
+	}
+
+	return slowest
+}
+
+func (s *shard) writeLatency(now time.Time, window time.Duration) time.Duration {
+	var latency time.Duration
+
+	if end := atomic.LoadInt64(&s.writeEnd); end != 0 && now.Sub(time.Unix(0, end)) <= window {
+		latency = time.Duration(atomic.LoadInt64(&s.lastLatency))
+	}
+
+	if start := atomic.LoadInt64(&s.writeStart); start != 0 {
+		if d := now.Sub(time.Unix(0, start)); d > latency {
+			latency = d
+		}
+	}
+
+	return latency
+}
+
+// shardOf returns the shard of the logger
+func (logger *Logger) shardOf() *shard {
+	if s := logger.core().shard; s != nil {
+		return s
+	}
+
+	return shards[0]
+}
+
+func (s *shard) start() {
+	ready := make(chan bool)
+	replacer := strings.NewReplacer("\n", "\n"+DEFAULT_CONTINUATION_INDENT)
+
+	go func() {
+		ready <- true
+
+		batch := make([]logToken, LOG_BATCH)
+
+		for {
+			n := s.in.popBatch(batch)
+			if n == 0 {
+				s.in.wait()
+				continue
+			}
+
+			for i := 0; i < n; i++ {
+				if batch[i].op == TOKEN_SHUTDOWN {
+					s.shutdown(batch[i], batch[i+1:n])
+					return
+				}
+
+				if s.shed(&batch[i]) {
+					batch[i].logger.countDropped()
+					atomic.AddInt64(&processed, 1)
+					batch[i] = logToken{}
+					continue
+				}
+
+				if op := batch[i].op; batch[i].logger == nil {
+					// a flush writes every repeat count and buffer, a tick
+					// those due
+					if op != TOKEN_BUFFERS {
+						s.writeRepeats(op == TOKEN_REPEATS)
+					}
+					if op != TOKEN_REPEATS {
+						s.flushBuffers(op == TOKEN_BUFFERS)
+					}
+				}
+
+				handleToken(&batch[i], replacer)
+				batch[i] = logToken{}
+			}
+		}
+	}()
+
+	<-ready
+}
+
+// broadcast sends a token made by mk to every shard and returns the first
+// error they answer with
+func broadcast(mk func(ch chan error) logToken) error {
+	return broadcastUntil(context.Background(), mk)
+}
+
+// broadcastUntil is broadcast giving up once ctx ends, returning its error
+func broadcastUntil(ctx context.Context, mk func(ch chan error) logToken) error {
+	chs := make([]chan error, 0, len(shards))
+
+	for _, s := range shards {
+		ch := make(chan error, 1)
+		if err := s.in.pushUntil(ctx, mk(ch)); err != nil {
+			return err
+		}
+		chs = append(chs, ch)
+	}
+
+	var err error
+
+	for _, ch := range chs {
+		select {
+		case serr := <-ch:
+			if err == nil {
+				err = serr
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,33 @@
+package logg
+
+import (
+	"testing"
+	"time"
+)
+
+// a slow write stops counting once window passes, while one under way
+// counts for as long as it takes
+func TestShardWriteLatency(t *testing.T) {
+	now := time.Now()
+	window := 5 * time.Second
+
+	s := &shard{}
+	if l := s.writeLatency(now, window); l != 0 {
+		t.Errorf("no writes: got %v", l)
+	}
+
+	s.lastLatency = int64(2 * time.Second)
+	s.writeEnd = now.Add(-time.Second).UnixNano()
+	if l := s.writeLatency(now, window); l != 2*time.Second {
+		t.Errorf("recent slow write: got %v, expected 2s", l)
+	}
+
+	if l := s.writeLatency(now.Add(window), window); l != 0 {
+		t.Errorf("slow write past the window: got %v, expected 0", l)
+	}
+
+	s.writeStart = now.Add(-time.Minute).UnixNano()
+	if l := s.writeLatency(now.Add(window), window); l != time.Minute+window {
+		t.Errorf("write under way: got %v, expected %v", l, time.Minute+window)
+	}
+}
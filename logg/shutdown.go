@@ -0,0 +1,127 @@
+package logg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrShutdown = errors.New("logg: logger actor is shut down")
+
+var (
+	shut_down int32 // set once Shutdown was called (atomic)
+
+	files_lock = &sync.Mutex{}
+	files      = make(map[*Logger]bool) // file loggers not closed yet
+)
+
+func registerFile(logger *Logger) {
+	files_lock.Lock()
+	files[logger] = true
+	files_lock.Unlock()
+}
+
+// close closes the file of a logger; later messages to it are dropped. only
+// its actor calls it.
+func (logger *Logger) close() error {
+	files_lock.Lock()
+	delete(files, logger)
+	files_lock.Unlock()
+
+	logger.writeRepeats()
+	logger.dropBuffer()
+
+	logger.l = nil
+	logger.filepath = "" // nothing to rotate anymore
+
+	logger.closeSinks()
+
+	if logger.spill != nil {
+		logger.spill.close()
+	}
+
+	if logger.closer == nil {
+		return nil
+	}
+
+	err := safelyDo(func() {
+		logger.closer.Close()
+	})
+	logger.closer = nil
+
+	return err
+}
+
+// Close writes what is queued for the logger, then closes its file
+func (logger *Logger) Close() error {
+	if atomic.LoadInt32(&shut_down) != 0 {
+		return ErrShutdown
+	}
+
+	ch := make(chan error, 1)
+	logger.shardOf().in.push(logToken{logger: logger.core(), ch: ch, op: TOKEN_CLOSE})
+
+	return <-ch
+}
+
+// Shutdown writes everything queued so far, closes every file logger, stops
+// the actors and waits for the rotated files to be compressed. messages
+// logged afterward are dropped; a caller racing with Shutdown on a waiting
+// call (Fatalf, Flush, ...) may block for good, unless it went through the
+// *Wait variants with a deadline. if ctx ends first, Shutdown
+// returns its error while the actors and compressions go on.
+func Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&shut_down, 0, 1) {
+		return ErrShutdown
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- broadcast(func(ch chan error) logToken {
+			return logToken{ch: ch, op: TOKEN_SHUTDOWN}
+		})
+	}()
+
+	select {
+	case err := <-ch:
+		if werr := WaitCompressions(ctx); err == nil {
+			err = werr
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown handles the shutdown token, closing the files of the shard's
+// loggers; rest are the tokens that were taken off the queue along with it
+// (pushed before producers saw the flag)
+func (s *shard) shutdown(token logToken, rest []logToken) {
+	for i := range rest {
+		if rest[i].ch != nil {
+			rest[i].ch <- ErrShutdown
+		}
+	}
+
+	files_lock.Lock()
+	open := make([]*Logger, 0, len(files))
+	for logger := range files {
+		if logger.shard == s {
+			open = append(open, logger)
+		}
+	}
+	files_lock.Unlock()
+
+	var err error
+
+	for _, logger := range open {
+		if cerr := logger.close(); err == nil {
+			err = cerr
+		}
+	}
+
+	atomic.AddInt64(&processed, 1)
+
+	token.ch <- err
+}
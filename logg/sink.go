@@ -0,0 +1,219 @@
+package logg
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is a message as a Sink gets it
+type Entry struct {
+	Time   time.Time
+	Level  LogLevel // 0 for untagged messages (Printf)
+	Prefix string   // the logger's name
+	Caller string   // 'file.go:line', see EnableCaller
+	Msg    string   // as logged, without the indent of continuation lines
+	Fields Fields
+	Line   []byte // the message rendered in the logger's format, with '\n'
+}
+
+// Sink is a destination a logger writes its messages to besides its own file
+// or writer, e.g. a network service. the logger's actor calls it, so a slow
+// sink holds up the loggers of the shard; a sink that talks to the network
+// should rather queue. Flush follows messages logged synchronously (Sync, a
+// sync level, Fatalf) and Close the closing of the logger.
+type Sink interface {
+	Write(e Entry) error
+	Flush() error
+	Close() error
+}
+
+var sinks_lock = &sync.Mutex{}
+
+// AddSink makes the logger hand every message to s too. loggers derived with
+// WithFields share the sinks of their root. a sink given to loggers of
+// different shards must be safe for concurrent use.
+func (logger *Logger) AddSink(s Sink) {
+	core := logger.core()
+
+	sinks_lock.Lock()
+	defer sinks_lock.Unlock()
+
+	old, _ := core.sinks.Load().([]Sink)
+	core.sinks.Store(append(append([]Sink(nil), old...), s))
+}
+
+// RemoveSink undoes AddSink for s, leaving it open
+func (logger *Logger) RemoveSink(s Sink) {
+	logger.removeSinks(func(t Sink) bool {
+		return t == s
+	})
+}
+
+func (logger *Logger) removeSinks(match func(s Sink) bool) {
+	core := logger.core()
+
+	sinks_lock.Lock()
+	defer sinks_lock.Unlock()
+
+	old, _ := core.sinks.Load().([]Sink)
+	next := make([]Sink, 0, len(old))
+
+	for _, s := range old {
+		if !match(s) {
+			next = append(next, s)
+		}
+	}
+
+	core.sinks.Store(next)
+}
+
+// AddWriter makes the logger write every line to w too, e.g. to the console
+// besides its file; it adds a WriterSink
+func (logger *Logger) AddWriter(w io.Writer) {
+	logger.AddSink(WriterSink(w))
+}
+
+// RemoveWriter undoes AddWriter for w
+func (logger *Logger) RemoveWriter(w io.Writer) {
+	logger.removeSinks(func(s Sink) bool {
+		ws, ok := s.(*writerSink)
+		return ok && ws.w == w
+	})
+}
+
+// NewMultiLogger returns a logger writing every line to each of ws
+func NewMultiLogger(prefix string, allowedLogLevel LogLevel, ws ...io.Writer) *Logger {
+	var w io.Writer = ioutil.Discard
+
+	if len(ws) > 0 {
+		w, ws = ws[0], ws[1:]
+	}
+
+	logger := NewLogger(prefix, w, allowedLogLevel)
+	for _, t := range ws {
+		logger.AddWriter(t)
+	}
+
+	return logger
+}
+
+// NewSinkLogger returns a logger writing only to sinks
+func NewSinkLogger(prefix string, allowedLogLevel LogLevel, sinks ...Sink) *Logger {
+	logger := NewLogger(prefix, ioutil.Discard, allowedLogLevel)
+	for _, s := range sinks {
+		logger.AddSink(s)
+	}
+
+	return logger
+}
+
+// dispatch hands a message to the logger's sinks; only the actor calls it
+func (logger *Logger) dispatch(token *logToken, t time.Time, line []byte) {
+	ss, _ := logger.sinks.Load().([]Sink)
+	if len(ss) == 0 {
+		return
+	}
+
+	name, _ := token.names(logger)
+
+	e := Entry{
+		Time:   t,
+		Level:  token.level,
+		Prefix: name,
+		Caller: token.caller,
+		Msg:    token.msg,
+		Fields: token.fields,
+		Line:   append([]byte(nil), line...), // the sinks' to keep
+	}
+
+	for _, s := range ss {
+		if err := s.Write(e); err != nil {
+			logger.countSinkError()
+			logger.reportError(sinkError(err))
+			continue
+		}
+
+		if token.sync || token.ch != nil {
+			if err := s.Flush(); err != nil {
+				logger.countSinkError()
+				logger.reportError(sinkError(err))
+			}
+		}
+	}
+}
+
+// closeSinks closes the logger's sinks along with it; only the actor calls it
+func (logger *Logger) closeSinks() {
+	ss, _ := logger.sinks.Load().([]Sink)
+
+	for _, s := range ss {
+		if err := s.Close(); err != nil {
+			logger.countSinkError()
+			logger.reportError(sinkError(err))
+		}
+	}
+}
+
+// writerSink writes lines to an io.Writer, which stays the caller's to close
+type writerSink struct {
+	w io.Writer
+}
+
+// WriterSink returns a sink writing the lines of its loggers to w. errors of
+// w count in SinkErrors but don't drop the message. Flush syncs w if it can
+// (an *os.File); Close leaves w open.
+func WriterSink(w io.Writer) Sink {
+	return &writerSink{w}
+}
+
+func (s *writerSink) Write(e Entry) error {
+	_, err := s.w.Write(e.Line)
+	return err
+}
+
+func (s *writerSink) Flush() error {
+	if f, ok := s.w.(interface {
+		Sync() error
+	}); ok && s.w != io.Writer(os.Stderr) && s.w != io.Writer(os.Stdout) {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// fileSink appends the lines of its loggers to a file; rotation is the
+// business of file loggers
+type fileSink struct {
+	f *os.File
+}
+
+// NewFileSink opens path for appending lines to; Flush fsyncs it and Close
+// closes it
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{f}, nil
+}
+
+func (s *fileSink) Write(e Entry) error {
+	_, err := s.f.Write(e.Line)
+	return err
+}
+
+func (s *fileSink) Flush() error {
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
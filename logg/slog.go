@@ -0,0 +1,101 @@
+package logg
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogHandler logs slog records through a logger: attributes become
+// fields, attributes of groups named 'group.key'
+type slogHandler struct {
+	logger *Logger
+	group  string // prefix of the keys of attributes, "" or 'group.'
+}
+
+// NewSlogHandler returns a slog.Handler writing to logger, so code logging
+// with log/slog gets the logger's files, rotation and sinks. slog levels
+// map to the nearest logg level at or below them.
+func NewSlogHandler(logger *Logger) slog.Handler {
+	return &slogHandler{logger: logger}
+}
+
+func levelOfSlog(level slog.Level) LogLevel {
+	switch {
+	case level < slog.LevelDebug:
+		return LOG_LEVEL_TRACE
+	case level < slog.LevelInfo:
+		return LOG_LEVEL_DEBUG
+	case level < slog.LevelWarn:
+		return LOG_LEVEL_INFO
+	case level < slog.LevelError:
+		return LOG_LEVEL_WARN
+	default:
+		return LOG_LEVEL_ERROR
+	}
+}
+
+func (h *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.logger.Level() <= levelOfSlog(level)
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var fields Fields
+
+	if r.NumAttrs() > 0 {
+		fields = make(Fields, r.NumAttrs())
+
+		r.Attrs(func(a slog.Attr) bool {
+			addSlogAttr(fields, h.group, a)
+			return true
+		})
+	}
+
+	level := levelOfSlog(r.Level)
+	h.logger._logAt(r.Time, level, level, false, fields, "%s", r.Message)
+
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	fields := make(Fields, len(attrs))
+	for _, a := range attrs {
+		addSlogAttr(fields, h.group, a)
+	}
+
+	return &slogHandler{logger: h.logger.WithFields(fields), group: h.group}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return &slogHandler{logger: h.logger, group: h.group + name + "."}
+}
+
+// addSlogAttr adds a to fields, flattening groups; empty attributes are
+// left out as slog wants
+func addSlogAttr(fields Fields, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+
+		for _, ga := range a.Value.Group() {
+			addSlogAttr(fields, prefix, ga)
+		}
+		return
+	}
+
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	fields[prefix+a.Key] = a.Value.Any()
+}
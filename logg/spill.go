@@ -0,0 +1,190 @@
+package logg
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SPILL_RETRY is how often a logger holding spilled lines tries its file
+// again when no message comes to do so
+const SPILL_RETRY = 5 * time.Second
+
+var spill_retry sync.Once
+
+// spill holds the bytes a logger's file refused, in order; only the actor
+// touches it but for held
+type spill struct {
+	f      *os.File
+	offset int64 // written back up to here
+	size   int64
+	held   int64 // size - offset, atomic
+}
+
+// SetSpillFile has the logger keep what its file refuses (a full disk, a
+// lost mount) in path, which should be on other storage, and write it to
+// the file before anything else once the file takes writes again. what
+// path already holds, e.g. of a crash, is written back first. it must be
+// called before the logger is used.
+func (logger *Logger) SetSpillFile(path string) error {
+	opts := logger.core().fileOpts
+
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DEFAULT_FILE_MODE
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return err
+	}
+
+	// it holds lines of the file, so it gets the file's mode
+	if opts.Mode != 0 {
+		f.Chmod(opts.Mode)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	logger.core().spill = &spill{f: f, size: fi.Size(), held: fi.Size()}
+
+	spill_retry.Do(func() {
+		go retrySpills()
+	})
+
+	return nil
+}
+
+// Spilled returns how many bytes the logger holds for its file
+func (logger *Logger) Spilled() int64 {
+	s := logger.core().spill
+	if s == nil {
+		return 0
+	}
+
+	return atomic.LoadInt64(&s.held)
+}
+
+// retrySpills has the actors try the files of loggers holding spilled
+// lines, so they are written back without waiting for a message
+func retrySpills() {
+	for range time.Tick(SPILL_RETRY) {
+		var spilling []*Logger
+
+		files_lock.Lock()
+		for logger := range files {
+			if logger.Spilled() > 0 {
+				spilling = append(spilling, logger)
+			}
+		}
+		files_lock.Unlock()
+
+		for _, logger := range spilling {
+			logger.shardOf().in.push(logToken{logger: logger, op: TOKEN_SPILL})
+		}
+	}
+}
+
+// hold appends b to the spill file; false if that fails too
+func (s *spill) hold(b []byte) bool {
+	n, err := s.f.WriteAt(b, s.size)
+	s.size += int64(n)
+	atomic.AddInt64(&s.held, int64(n))
+
+	return err == nil
+}
+
+// writeBack writes what is held to w, returning the bytes written and
+// whether all were
+func (s *spill) writeBack(w io.Writer) (int64, bool) {
+	var written int64
+	buf := make([]byte, 32*1024)
+
+	for s.offset < s.size {
+		k, err := s.f.ReadAt(buf, s.offset)
+		if k == 0 && err != nil {
+			return written, false
+		}
+
+		n, err := w.Write(buf[:k])
+		s.offset += int64(n)
+		written += int64(n)
+		atomic.AddInt64(&s.held, -int64(n))
+
+		if err != nil {
+			return written, false
+		}
+	}
+
+	// all written back; start over
+	if err := s.f.Truncate(0); err == nil {
+		s.offset, s.size = 0, 0
+	}
+
+	return written, true
+}
+
+// writeLine writes b to the logger's file, after what was spilled before
+// it; with a spill file, what the file refuses is held there
+func (logger *Logger) writeLine(b []byte) (int64, error) {
+	w := logger.bufferFor(logger.l.Writer())
+
+	s := logger.spill
+	if s == nil {
+		n, err := w.Write(b)
+		if err != nil {
+			logger.reportError(err)
+		}
+		return int64(n), err
+	}
+
+	var written int64
+
+	if atomic.LoadInt64(&s.held) > 0 {
+		n, ok := s.writeBack(w)
+		written += n
+
+		if !ok {
+			if !s.hold(b) {
+				logger.countDropped()
+				return written, ErrDropped
+			}
+			return written, ErrSpilled
+		}
+	}
+
+	n, err := w.Write(b)
+	written += int64(n)
+
+	if err != nil {
+		logger.reportError(err)
+
+		if !s.hold(b[n:]) {
+			logger.countDropped()
+		}
+	}
+
+	return written, err
+}
+
+// close keeps only what wasn't written back, so a later SetSpillFile of
+// the path doesn't write anything twice
+func (s *spill) close() {
+	if s.offset > 0 && s.offset < s.size {
+		rest := make([]byte, s.size-s.offset)
+
+		if _, err := s.f.ReadAt(rest, s.offset); err == nil {
+			if _, err := s.f.WriteAt(rest, 0); err == nil {
+				s.f.Truncate(int64(len(rest)))
+			}
+		}
+	}
+
+	s.f.Close()
+}
@@ -0,0 +1,94 @@
+package logg
+
+import (
+	"sync/atomic"
+)
+
+// counters a logger keeps for monitoring; the totals over all loggers are
+// kept alongside
+type counters struct {
+	bytesWritten int64
+	rotations    int64
+	dropped      int64
+	sinkErrors   int64
+	suppressed   int64
+}
+
+var totals counters
+
+func (c *counters) countWritten(n int64) {
+	atomic.AddInt64(&c.bytesWritten, n)
+	atomic.AddInt64(&totals.bytesWritten, n)
+}
+
+func (c *counters) countRotation() {
+	atomic.AddInt64(&c.rotations, 1)
+	atomic.AddInt64(&totals.rotations, 1)
+}
+
+func (c *counters) countDropped() {
+	atomic.AddInt64(&c.dropped, 1)
+	atomic.AddInt64(&totals.dropped, 1)
+}
+
+func (c *counters) countSuppressed() {
+	atomic.AddInt64(&c.suppressed, 1)
+	atomic.AddInt64(&totals.suppressed, 1)
+}
+
+func (c *counters) countSinkError() {
+	atomic.AddInt64(&c.sinkErrors, 1)
+	atomic.AddInt64(&totals.sinkErrors, 1)
+}
+
+// BytesWritten returns how many bytes the logger wrote since it was made
+func (logger *Logger) BytesWritten() int64 {
+	return atomic.LoadInt64(&logger.core().bytesWritten)
+}
+
+// Rotations returns how often the logger's file was rotated
+func (logger *Logger) Rotations() int64 {
+	return atomic.LoadInt64(&logger.core().rotations)
+}
+
+// Dropped returns how many messages to the logger were lost because it was
+// closed, logging was shut down or its overflow policy dropped them
+func (logger *Logger) Dropped() int64 {
+	return atomic.LoadInt64(&logger.core().dropped)
+}
+
+// SinkErrors returns how often the logger's sinks failed
+func (logger *Logger) SinkErrors() int64 {
+	return atomic.LoadInt64(&logger.core().sinkErrors)
+}
+
+// Suppressed returns how many messages the logger left out by sampling or
+// as repeats
+func (logger *Logger) Suppressed() int64 {
+	return atomic.LoadInt64(&logger.core().suppressed)
+}
+
+// BytesWritten returns how many bytes all loggers wrote
+func BytesWritten() int64 {
+	return atomic.LoadInt64(&totals.bytesWritten)
+}
+
+// Rotations returns how many rotations all loggers did
+func Rotations() int64 {
+	return atomic.LoadInt64(&totals.rotations)
+}
+
+// Dropped returns how many messages all loggers lost
+func Dropped() int64 {
+	return atomic.LoadInt64(&totals.dropped)
+}
+
+// SinkErrors returns how often the sinks of all loggers failed
+func SinkErrors() int64 {
+	return atomic.LoadInt64(&totals.sinkErrors)
+}
+
+// Suppressed returns how many messages all loggers left out
+func Suppressed() int64 {
+	return atomic.LoadInt64(&totals.suppressed)
+}
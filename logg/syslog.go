@@ -0,0 +1,316 @@
+package logg
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SYSLOG_DIAL_TIMEOUT = 5 * time.Second
+	SYSLOG_RETRY        = time.Second // after a failed dial, messages fail until then
+	SYSLOG_MAX_DATAGRAM = 64000       // longer messages over UDP are cut
+	SYSLOG_SD_ID        = "logg@32473"
+)
+
+// syslog severities
+const (
+	syslog_crit    = 2
+	syslog_err     = 3
+	syslog_warning = 4
+	syslog_info    = 6
+	syslog_debug   = 7
+)
+
+// syslogSeverity maps a level to a syslog severity; a registered level
+// takes that of the level below it, untagged messages are info
+func syslogSeverity(level LogLevel) int {
+	switch {
+	case level == 0:
+		return syslog_info
+	case level >= LOG_LEVEL_FATAL:
+		return syslog_crit
+	case level >= LOG_LEVEL_ERROR:
+		return syslog_err
+	case level >= LOG_LEVEL_WARN:
+		return syslog_warning
+	case level >= LOG_LEVEL_INFO:
+		return syslog_info
+	default:
+		return syslog_debug
+	}
+}
+
+// SyslogFormat is the message format of a syslog sink
+type SyslogFormat int
+
+const (
+	SYSLOG_RFC5424 SyslogFormat = iota // fields as structured data
+	SYSLOG_RFC3164                     // BSD syslog; fields as 'k=v' after the message
+)
+
+func SyslogFormatFrom(s string, defaultFormat SyslogFormat) SyslogFormat {
+	switch strings.ToLower(s) {
+	case "rfc5424", "5424":
+		return SYSLOG_RFC5424
+	case "rfc3164", "3164", "bsd":
+		return SYSLOG_RFC3164
+	default:
+		return defaultFormat
+	}
+}
+
+// SyslogOptions say where and how a syslog sink sends messages
+type SyslogOptions struct {
+	Network string // udp, tcp, tls or unixgram (e.g. /dev/log)
+	Addr    string // host:port, or the socket's path
+	Format  SyslogFormat
+
+	Facility int    // 0 to 23; 0 sends user (1), kern being no one else's
+	AppName  string // "" takes the logger's name
+	Hostname string // "" takes the host's name
+
+	TLS *tls.Config // for tls; nil verifies the server by the system roots
+}
+
+// syslogSink sends messages to a syslog server
+type syslogSink struct {
+	opts SyslogOptions
+	pid  int
+
+	lock    *sync.Mutex
+	conn    net.Conn
+	retryAt time.Time // no dialing before, after a failure
+	dialErr error
+}
+
+// SyslogSink returns a sink sending the messages of its loggers to a syslog
+// server such as rsyslog or syslog-ng. over TCP and TLS, RFC 5424 messages
+// are octet counted (RFC 6587) and RFC 3164 ones end with a newline, with
+// newlines of the message sent as '#012'. it connects on the first message
+// and again after a failure, failing messages for SYSLOG_RETRY after a dial
+// that failed so the actor isn't held up long. it is safe for concurrent
+// use.
+func SyslogSink(opts SyslogOptions) (Sink, error) {
+	switch opts.Network {
+	case "udp", "tcp", "tls":
+		if _, _, err := net.SplitHostPort(opts.Addr); err != nil {
+			return nil, fmt.Errorf("logg: invalid syslog address '%s' (expected host:port)", opts.Addr)
+		}
+	case "unixgram":
+		if opts.Addr == "" {
+			return nil, fmt.Errorf("logg: no syslog socket given")
+		}
+	default:
+		return nil, fmt.Errorf("logg: unknown syslog network '%s' (expected udp, tcp, tls or unixgram)", opts.Network)
+	}
+
+	if opts.Facility < 0 || opts.Facility > 23 {
+		return nil, fmt.Errorf("logg: invalid syslog facility %d (expected 0 to 23)", opts.Facility)
+	} else if opts.Facility == 0 {
+		opts.Facility = 1
+	}
+
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+
+	return &syslogSink{opts: opts, pid: os.Getpid(), lock: &sync.Mutex{}}, nil
+}
+
+func (s *syslogSink) Write(e Entry) error {
+	frame := s.frame(s.message(e))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.write(frame)
+	if err != nil && s.dialErr == nil {
+		// one more go over a new connection, e.g. after the server restarted
+		err = s.write(frame)
+	}
+
+	return err
+}
+
+// write sends frame, dialing if need be; the caller holds lock
+func (s *syslogSink) write(frame []byte) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if s.opts.Network == "tcp" || s.opts.Network == "tls" {
+		s.conn.SetWriteDeadline(time.Now().Add(SYSLOG_DIAL_TIMEOUT))
+	}
+
+	if _, err := s.conn.Write(frame); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// connect dials the server unless connected; the caller holds lock
+func (s *syslogSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	if time.Now().Before(s.retryAt) {
+		return s.dialErr
+	}
+
+	var conn net.Conn
+	var err error
+
+	if s.opts.Network == "tls" {
+		// without a ServerName the dialer checks the one of Addr
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: SYSLOG_DIAL_TIMEOUT}, "tcp", s.opts.Addr, s.opts.TLS)
+	} else {
+		conn, err = net.DialTimeout(s.opts.Network, s.opts.Addr, SYSLOG_DIAL_TIMEOUT)
+	}
+
+	if err != nil {
+		s.retryAt = time.Now().Add(SYSLOG_RETRY)
+		s.dialErr = err
+		return err
+	}
+
+	s.conn = conn
+	s.dialErr = nil
+
+	return nil
+}
+
+// frame wraps a message for the transport
+func (s *syslogSink) frame(msg string) []byte {
+	switch {
+	case s.opts.Network != "tcp" && s.opts.Network != "tls":
+		if len(msg) > SYSLOG_MAX_DATAGRAM {
+			msg = msg[:SYSLOG_MAX_DATAGRAM]
+		}
+		return []byte(msg)
+	case s.opts.Format == SYSLOG_RFC5424:
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	default:
+		return []byte(strings.Replace(msg, "\n", "#012", -1) + "\n")
+	}
+}
+
+// message renders e in the sink's format
+func (s *syslogSink) message(e Entry) string {
+	pri := s.opts.Facility*8 + syslogSeverity(e.Level)
+
+	app := s.opts.AppName
+	if app == "" {
+		app = strings.TrimSpace(e.Prefix)
+	}
+
+	if s.opts.Format == SYSLOG_RFC3164 {
+		tag := syslogToken(app, 32, "logg")
+		return fmt.Sprintf("<%d>%s %s %s[%d]: %s%s", pri, e.Time.Local().Format(time.Stamp), syslogToken(s.opts.Hostname, 255, "-"), tag, s.pid, e.Msg, formatFields(e.Fields))
+	}
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - %s", pri, e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), syslogToken(s.opts.Hostname, 255, "-"), syslogToken(app, 48, "-"), s.pid, structuredData(e))
+	if e.Msg != "" {
+		line += " " + e.Msg
+	}
+
+	return line
+}
+
+// syslogToken makes s a header field: printable ASCII without spaces, at
+// most max long, or nilValue when empty
+func syslogToken(s string, max int, nilValue string) string {
+	b := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s) && len(b) < max; i++ {
+		if c := s[i]; c > ' ' && c < 0x7f {
+			b = append(b, c)
+		} else {
+			b = append(b, '_')
+		}
+	}
+
+	if len(b) == 0 {
+		return nilValue
+	}
+
+	return string(b)
+}
+
+// structuredData renders the fields and caller of e as an RFC 5424 element
+// of SYSLOG_SD_ID, "-" without any
+func structuredData(e Entry) string {
+	if len(e.Fields) == 0 && e.Caller == "" {
+		return "-"
+	}
+
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("[" + SYSLOG_SD_ID)
+
+	param := func(name, value string) {
+		name = strings.Map(func(r rune) rune {
+			if r <= ' ' || r >= 0x7f || r == '=' || r == ']' || r == '"' {
+				return '_'
+			}
+			return r
+		}, name)
+		if len(name) > 32 {
+			name = name[:32]
+		}
+
+		// '"', '\' and ']' are escaped in values
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+
+		fmt.Fprintf(&b, ` %s="%s"`, name, value)
+	}
+
+	if e.Caller != "" {
+		param("caller", e.Caller)
+	}
+
+	for _, k := range keys {
+		v := e.Fields[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		param(k, fmt.Sprintf("%v", v))
+	}
+
+	b.WriteString("]")
+
+	return b.String()
+}
+
+func (s *syslogSink) Flush() error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
@@ -0,0 +1,65 @@
+package logg
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// longer partial lines are logged rather than buffered further
+const WRITER_MAX_LINE = 64 * 1024
+
+// lineWriter logs what is written to it a line at a time
+type lineWriter struct {
+	logger *Logger
+	level  LogLevel
+
+	lock    *sync.Mutex
+	partial []byte // a line not ended yet
+}
+
+// Writer returns an io.Writer logging each line written to it as a message
+// of level, for log.SetOutput, http.Server.ErrorLog and other code that
+// only takes a writer. a line not ended yet waits for the rest of it.
+func (logger *Logger) Writer(level LogLevel) io.Writer {
+	return &lineWriter{logger: logger, level: level, lock: &sync.Mutex{}}
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n := len(b)
+
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, b...)
+			if len(w.partial) >= WRITER_MAX_LINE {
+				w.log(w.partial)
+				w.partial = w.partial[:0]
+			}
+			break
+		}
+
+		line := b[:i]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = w.partial[:0]
+		}
+
+		w.log(line)
+		b = b[i+1:]
+	}
+
+	return n, nil
+}
+
+func (w *lineWriter) log(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return
+	}
+
+	w.logger._log(w.level, w.level, false, nil, "%s", line)
+}
@@ -0,0 +1,1240 @@
+package logg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// zstd (RFC 8878) as far as rotated log files need it. the writer finds
+// matches with a hash chain, Huffman codes the literals and codes the
+// sequences with the predefined tables or ones of the block's own; it
+// compresses less than the reference encoder. the reader takes single
+// frames and concatenated ones of any encoder, but no dictionaries.
+
+const (
+	ZSTD_MAGIC = 0xFD2FB528
+
+	zstdBlockMax  = 128 << 10
+	zstdWindowLog = 20 // a 1MiB window
+	zstdWindow    = 1 << zstdWindowLog
+	zstdHashLog   = 16
+	zstdHistMax   = 2*zstdWindow + zstdBlockMax
+	zstdMaxWindow = 1 << 27 // largest window the reader takes
+)
+
+var errZstdCorrupt = errors.New("zstd: corrupt input")
+
+// the symbols of literal lengths, match lengths and offsets: their
+// baselines and the extra bits read after them
+var (
+	zstdLLBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLLBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMLBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMLBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	// the predefined distributions; -1 is a probability below 1
+	zstdLLNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	zstdMLNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	zstdOFNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	zstdLLDecode = newFseDecodeTable(zstdLLNorm, 6)
+	zstdMLDecode = newFseDecodeTable(zstdMLNorm, 6)
+	zstdOFDecode = newFseDecodeTable(zstdOFNorm, 5)
+
+	zstdLLEncode = newFseEncodeTable(zstdLLNorm, 6)
+	zstdMLEncode = newFseEncodeTable(zstdMLNorm, 6)
+	zstdOFEncode = newFseEncodeTable(zstdOFNorm, 5)
+)
+
+// zstdEntry is where in hist the bytes of a hash were last seen, plus one
+// (0 being nowhere), and the first four of them
+type zstdEntry struct {
+	pos int32
+	val uint32
+}
+
+type zstdSequence struct {
+	litLen   uint32
+	offset   uint32 // the offset value: the distance back plus 3
+	matchLen uint32
+}
+
+// the codes of literal lengths below 64 and match lengths below 131,
+// past which each code doubles the range
+var zstdLLCodes, zstdMLCodes = zstdCodeTable(zstdLLBase[:], 64), zstdCodeTable(zstdMLBase[:], 131)
+
+func zstdCodeTable(base []uint32, n int) []uint8 {
+	codes := make([]uint8, n)
+	code := 0
+
+	for v := range codes {
+		for code+1 < len(base) && base[code+1] <= uint32(v) {
+			code++
+		}
+		codes[v] = uint8(code)
+	}
+
+	return codes
+}
+
+func zstdLLCode(v uint32) uint8 {
+	if v < 64 {
+		return zstdLLCodes[v]
+	}
+
+	return uint8(bits.Len32(v)) + 18
+}
+
+func zstdMLCode(v uint32) uint8 {
+	if v < 131 {
+		return zstdMLCodes[v]
+	}
+
+	return uint8(bits.Len32(v-3)) + 35
+}
+
+// zstdWriter compresses to a single zstd frame, in blocks of up to 128KiB
+// matched against the 1MiB before them
+type zstdWriter struct {
+	w        io.Writer
+	depth    int  // candidates looked at per position
+	minMatch uint // shorter matches cost more than their literals
+
+	hist  []byte // the window, then the block under way
+	start int    // where the block under way starts in hist
+	table []zstdEntry
+	chain []int32 // of hist positions, for depth > 1
+
+	sum     xxh64
+	started bool
+	closed  bool
+	err     error
+
+	seqs []zstdSequence
+	lits []byte
+	out  []byte
+}
+
+// NewZstdWriter returns a writer compressing to w in a zstd frame, which
+// Close ends. level 1 looks at a single earlier match per position, higher
+// ones (up to 22) at more, compressing better but slower; 0 is 3.
+func NewZstdWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = 3
+	}
+	if level < 1 || level > 22 {
+		return nil, fmt.Errorf("zstd: invalid level %d (expected 1 to 22)", level)
+	}
+
+	z := &zstdWriter{
+		w:        w,
+		depth:    1 << uint((level-1)/3),
+		minMatch: 6,
+		table:    make([]zstdEntry, 1<<zstdHashLog),
+	}
+	z.sum.reset()
+
+	return z, nil
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("zstd: write after close")
+	}
+
+	n := len(p)
+	z.sum.write(p)
+
+	for len(p) > 0 && z.err == nil {
+		// a full block goes out once more follows, the last one on Close
+		if len(z.hist)-z.start == zstdBlockMax {
+			z.block(false)
+		}
+
+		k := zstdBlockMax - (len(z.hist) - z.start)
+		if k > len(p) {
+			k = len(p)
+		}
+
+		z.hist = append(z.hist, p[:k]...)
+		p = p[k:]
+	}
+
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	return n, nil
+}
+
+func (z *zstdWriter) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+
+	if z.err == nil {
+		z.block(true)
+	}
+
+	if z.err == nil {
+		var sum [4]byte
+		binary.LittleEndian.PutUint32(sum[:], uint32(z.sum.sum()))
+
+		_, z.err = z.w.Write(sum[:])
+	}
+
+	return z.err
+}
+
+func (z *zstdWriter) header() []byte {
+	// a window descriptor, no content size or dictionary, a checksum
+	return []byte{0x28, 0xB5, 0x2F, 0xFD, 0x04, (zstdWindowLog - 10) << 3}
+}
+
+// block writes out hist[start:]
+func (z *zstdWriter) block(last bool) {
+	src := z.hist[z.start:]
+	z.out = z.out[:0]
+
+	if !z.started {
+		z.out = append(z.out, z.header()...)
+		z.started = true
+	}
+
+	compressed := z.compress()
+
+	var bh uint32
+	if last {
+		bh = 1
+	}
+
+	if len(compressed) >= len(src) {
+		bh |= uint32(len(src)) << 3
+		z.out = append(z.out, byte(bh), byte(bh>>8), byte(bh>>16))
+		z.out = append(z.out, src...)
+	} else {
+		bh |= 2<<1 | uint32(len(compressed))<<3
+		z.out = append(z.out, byte(bh), byte(bh>>8), byte(bh>>16))
+		z.out = append(z.out, compressed...)
+	}
+
+	_, z.err = z.w.Write(z.out)
+
+	z.start = len(z.hist)
+
+	// keep the window, moving it to the front once the next block would
+	// take hist past zstdHistMax
+	if len(z.hist)+zstdBlockMax > zstdHistMax {
+		shift := len(z.hist) - zstdWindow
+
+		copy(z.hist, z.hist[shift:])
+		z.hist = z.hist[:zstdWindow]
+		z.start = zstdWindow
+
+		for i, e := range z.table {
+			if e.pos -= int32(shift); e.pos < 0 {
+				e.pos = 0
+			}
+			z.table[i] = e
+		}
+
+		if z.chain != nil {
+			n := copy(z.chain, z.chain[shift:])
+			z.chain = z.chain[:n]
+
+			for i, p := range z.chain {
+				if p -= int32(shift); p < 0 {
+					p = 0
+				}
+				z.chain[i] = p
+			}
+		}
+	}
+}
+
+// hash hashes the first minMatch bytes of v
+func (z *zstdWriter) hash(v uint64) uint32 {
+	return uint32((v << (64 - 8*z.minMatch)) * 0xCF1BBCDCB7A56463 >> (64 - zstdHashLog))
+}
+
+// insert records hist position i
+func (z *zstdWriter) insert(i int) {
+	v := binary.LittleEndian.Uint64(z.hist[i:])
+	h := z.hash(v)
+
+	if z.depth > 1 {
+		z.chain[i] = z.table[h].pos
+	}
+	z.table[h] = zstdEntry{int32(i + 1), uint32(v)}
+}
+
+// matchLen returns how many bytes a and b (no longer than a) start with
+// in common
+func matchLen(a, b []byte) int {
+	n := 0
+
+	for ; n+8 <= len(b); n += 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)>>3
+		}
+	}
+
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+// compress codes hist[start:] as a compressed block's content
+func (z *zstdWriter) compress() []byte {
+	hist, end := z.hist, len(z.hist)
+	z.seqs, z.lits = z.seqs[:0], z.lits[:0]
+
+	anchor := z.start
+
+	if z.depth > 1 && len(z.chain) < end {
+		z.chain = append(z.chain, make([]int32, end-len(z.chain))...)
+	}
+
+	for i := z.start; i+8 <= end; {
+		bestLen, bestOff := 0, 0
+
+		cur := binary.LittleEndian.Uint64(hist[i:])
+		e := z.table[z.hash(cur)]
+
+		if cand := int(e.pos) - 1; z.depth == 1 {
+			if cand >= 0 && e.val == uint32(cur) && i-cand <= zstdWindow {
+				bestLen, bestOff = matchLen(hist[cand:], hist[i:end]), i-cand
+			}
+		} else {
+			for tries := 0; cand >= 0 && tries < z.depth && i-cand <= zstdWindow; tries++ {
+				if n := matchLen(hist[cand:], hist[i:end]); n > bestLen {
+					bestLen, bestOff = n, i-cand
+				}
+				cand = int(z.chain[cand]) - 1
+			}
+		}
+
+		z.insert(i)
+
+		if bestLen < int(z.minMatch) {
+			// the longer nothing matched, the bigger the steps
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+
+		z.seqs = append(z.seqs, zstdSequence{uint32(i - anchor), uint32(bestOff + 3), uint32(bestLen)})
+		z.lits = append(z.lits, hist[anchor:i]...)
+
+		if z.depth == 1 {
+			// the fastest levels only note the end of a match
+			if j := i + bestLen - 2; j+8 <= end {
+				z.insert(j)
+			}
+		} else {
+			for j := i + 1; j < i+bestLen && j+8 <= end; j++ {
+				z.insert(j)
+			}
+		}
+
+		i += bestLen
+		anchor = i
+	}
+
+	z.lits = append(z.lits, hist[anchor:end]...)
+
+	out := z.literals(nil)
+
+	// sequences, coded with whichever tables cost least
+	switch n := len(z.seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+
+	if len(z.seqs) == 0 {
+		return out
+	}
+
+	return append(out, z.encodeSequences()...)
+}
+
+// literals appends the literals section of the block, Huffman coded
+// unless that doesn't pay
+func (z *zstdWriter) literals(out []byte) []byte {
+	lits := z.lits
+
+	var counts [256]int
+	distinct := 0
+
+	for _, c := range lits {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+	}
+
+	raw := func(kind byte, body []byte) []byte {
+		switch n := len(lits); {
+		case n < 32:
+			out = append(out, kind|byte(n<<3))
+		case n < 4096:
+			out = append(out, kind|1<<2|byte(n&0xF)<<4, byte(n>>4))
+		default:
+			out = append(out, kind|3<<2|byte(n&0xF)<<4, byte(n>>4), byte(n>>12))
+		}
+
+		return append(out, body...)
+	}
+
+	if distinct == 1 && len(lits) > 1 {
+		return raw(1, lits[:1])
+	}
+
+	if len(lits) < huffmanMinLiterals || distinct < 2 {
+		return raw(0, lits)
+	}
+
+	h := newHuffmanCode(&counts)
+
+	desc, ok := h.description()
+	if !ok {
+		return raw(0, lits)
+	}
+
+	body := desc
+	single := len(lits) <= huffmanSingleStream
+
+	if single {
+		body = h.encode(body, lits)
+	} else {
+		// four streams, after a table of the sizes of the first three
+		seg := (len(lits) + 3) / 4
+		jump := len(body)
+		body = append(body, make([]byte, 6)...)
+
+		for k := 0; k < 4; k++ {
+			from, to := k*seg, (k+1)*seg
+			if to > len(lits) {
+				to = len(lits)
+			}
+
+			before := len(body)
+			body = h.encode(body, lits[from:to])
+
+			if k < 3 {
+				binary.LittleEndian.PutUint16(body[jump+2*k:], uint16(len(body)-before))
+			}
+		}
+	}
+
+	// what the header takes more than raw literals' does
+	if len(body)+2 >= len(lits) {
+		return raw(0, lits)
+	}
+
+	regen, comp := uint64(len(lits)), uint64(len(body))
+
+	switch {
+	case single:
+		h := 2 | regen<<4 | comp<<14
+		out = append(out, byte(h), byte(h>>8), byte(h>>16))
+	case regen < 1024 && comp < 1024:
+		h := 2 | 1<<2 | regen<<4 | comp<<14
+		out = append(out, byte(h), byte(h>>8), byte(h>>16))
+	case regen < 16384 && comp < 16384:
+		h := 2 | 2<<2 | regen<<4 | comp<<18
+		out = append(out, byte(h), byte(h>>8), byte(h>>16), byte(h>>24))
+	default:
+		h := 2 | 3<<2 | regen<<4 | comp<<22
+		out = append(out, byte(h), byte(h>>8), byte(h>>16), byte(h>>24), byte(h>>32))
+	}
+
+	return append(out, body...)
+}
+
+// seqTable picks how a block codes one kind of sequence symbol: with the
+// predefined table, a table of its own, described in the block, or as
+// the one symbol there is. it returns the mode, the description and the
+// table, nil for the one symbol.
+func seqTable(codes []uint8, predefined *fseEncodeTable, predefinedNorm []int16, maxLog uint) (byte, []byte, *fseEncodeTable) {
+	counts := make([]int, len(predefinedNorm))
+	distinct := 0
+
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+	}
+
+	if distinct == 1 && len(codes) > 1 {
+		return 1, []byte{codes[0]}, nil
+	}
+
+	// the bits the symbols take under a distribution
+	cost := func(norm []int16, tableLog uint) float64 {
+		bits := 0.0
+
+		for s, c := range counts {
+			if c == 0 {
+				continue
+			}
+			if s >= len(norm) || norm[s] == 0 {
+				return math.Inf(1)
+			}
+
+			p := float64(norm[s])
+			if p < 0 {
+				p = 1
+			}
+			bits += float64(c) * (float64(tableLog) - math.Log2(p))
+		}
+
+		return bits
+	}
+
+	tableLog := uint(bits.Len(uint(len(codes)))) - 1
+	if tableLog > maxLog {
+		tableLog = maxLog
+	}
+	if tableLog < 5 {
+		tableLog = 5
+	}
+
+	if norm := normalizeCounts(counts, len(codes), tableLog); norm != nil {
+		desc := writeNCount(norm, tableLog)
+
+		if cost(norm, tableLog)+float64(8*len(desc)) < cost(predefinedNorm, predefined.tableLog) {
+			return 2, desc, newFseEncodeTable(norm, tableLog)
+		}
+	}
+
+	return 0, nil, predefined
+}
+
+// encodeSequences returns the sequences section past the number of
+// sequences: the modes, the tables described and the bit stream
+func (z *zstdWriter) encodeSequences() []byte {
+	n := len(z.seqs)
+	llCodes, mlCodes, ofCodes := make([]uint8, n), make([]uint8, n), make([]uint8, n)
+
+	for i, s := range z.seqs {
+		llCodes[i], mlCodes[i], ofCodes[i] = zstdLLCode(s.litLen), zstdMLCode(s.matchLen), uint8(bits.Len32(s.offset)-1)
+	}
+
+	llMode, llDesc, llTable := seqTable(llCodes, zstdLLEncode, zstdLLNorm, 9)
+	ofMode, ofDesc, ofTable := seqTable(ofCodes, zstdOFEncode, zstdOFNorm, 8)
+	mlMode, mlDesc, mlTable := seqTable(mlCodes, zstdMLEncode, zstdMLNorm, 9)
+
+	out := []byte{llMode<<6 | ofMode<<4 | mlMode<<2}
+	out = append(out, llDesc...)
+	out = append(out, ofDesc...)
+	out = append(out, mlDesc...)
+
+	bw := &bitWriter{out: out}
+
+	extras := func(i int) {
+		s := z.seqs[i]
+		ll, ml, of := llCodes[i], mlCodes[i], ofCodes[i]
+
+		bw.add(uint64(s.litLen-zstdLLBase[ll]), uint(zstdLLBits[ll]))
+		bw.add(uint64(s.matchLen-zstdMLBase[ml]), uint(zstdMLBits[ml]))
+		bw.add(uint64(s.offset), uint(of))
+	}
+
+	var llState, mlState, ofState fseEncoder
+
+	// backwards, as the stream is read from the end
+	mlState.init(mlTable, mlCodes[n-1])
+	ofState.init(ofTable, ofCodes[n-1])
+	llState.init(llTable, llCodes[n-1])
+	extras(n - 1)
+
+	for i := n - 2; i >= 0; i-- {
+		ofState.encode(bw, ofCodes[i])
+		mlState.encode(bw, mlCodes[i])
+		llState.encode(bw, llCodes[i])
+		extras(i)
+	}
+
+	mlState.flush(bw)
+	ofState.flush(bw)
+	llState.flush(bw)
+
+	return bw.close()
+}
+
+// zstdReader decompresses zstd frames, one after another
+type zstdReader struct {
+	r *bufio.Reader
+
+	window   int
+	hist     []byte
+	out      []byte // decoded, not yet read
+	inFrame  bool
+	lastSeen bool // the frame's last block
+	checksum bool
+	sum      xxh64
+	rep      [3]int
+
+	ll, ml, of *fseDecodeTable // for the 'repeat' mode
+	huff       *huffmanTable   // for literals without their own
+
+	block []byte
+	lits  []byte
+	err   error
+}
+
+// NewZstdReader returns a reader decompressing the zstd frames in r, as
+// NewZstdWriter writes them
+func NewZstdReader(r io.Reader) (io.ReadCloser, error) {
+	z := &zstdReader{r: bufio.NewReader(r)}
+
+	if err := z.frame(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return z, nil
+}
+
+func (z *zstdReader) Close() error {
+	return nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.err = z.next()
+	}
+
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+
+	return n, nil
+}
+
+// next decodes a block, starting and ending frames around it
+func (z *zstdReader) next() error {
+	if !z.inFrame {
+		return z.frame()
+	}
+
+	if z.lastSeen {
+		z.inFrame = false
+
+		if z.checksum {
+			var sum [4]byte
+			if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+
+			if binary.LittleEndian.Uint32(sum[:]) != uint32(z.sum.sum()) {
+				return errors.New("zstd: checksum mismatch")
+			}
+		}
+
+		return nil
+	}
+
+	return z.decodeBlock()
+}
+
+// frame reads a frame header, skipping skippable frames; io.EOF at the
+// end of the input
+func (z *zstdReader) frame() error {
+	var b [4]byte
+
+	for {
+		if _, err := io.ReadFull(z.r, b[:]); err != nil {
+			if err == io.EOF {
+				return io.EOF
+			}
+			return io.ErrUnexpectedEOF
+		}
+
+		magic := binary.LittleEndian.Uint32(b[:])
+		if magic == ZSTD_MAGIC {
+			break
+		}
+
+		if magic&0xFFFFFFF0 != 0x184D2A50 {
+			return errors.New("zstd: not a zstd frame")
+		}
+
+		if _, err := io.ReadFull(z.r, b[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(b[:]))); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if fhd&0x08 != 0 {
+		return errZstdCorrupt
+	}
+
+	single := fhd&0x20 != 0
+	z.checksum = fhd&0x04 != 0
+
+	z.window = 0
+
+	if !single {
+		wd, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		base := 1 << (10 + uint(wd>>3))
+		z.window = base + base/8*int(wd&7)
+	}
+
+	var id [4]byte
+	idSize := []int{0, 1, 2, 4}[fhd&3]
+
+	if _, err := io.ReadFull(z.r, id[:idSize]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint32(id[:]) != 0 {
+		return errors.New("zstd: dictionaries not supported")
+	}
+
+	fcsSize := []int{0, 2, 4, 8}[fhd>>6]
+	if fcsSize == 0 && single {
+		fcsSize = 1
+	}
+
+	var fcs [8]byte
+	if _, err := io.ReadFull(z.r, fcs[:fcsSize]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if single {
+		size := binary.LittleEndian.Uint64(fcs[:])
+		if fcsSize == 2 {
+			size += 256
+		}
+
+		if size > zstdMaxWindow {
+			return errors.New("zstd: window too large")
+		}
+		z.window = int(size)
+	}
+
+	if z.window > zstdMaxWindow {
+		return errors.New("zstd: window too large")
+	}
+
+	z.inFrame, z.lastSeen = true, false
+	z.hist = z.hist[:0]
+	z.rep = [3]int{1, 4, 8}
+	z.ll, z.ml, z.of, z.huff = nil, nil, nil, nil
+	z.sum.reset()
+
+	return nil
+}
+
+func (z *zstdReader) decodeBlock() error {
+	var bh [3]byte
+	if _, err := io.ReadFull(z.r, bh[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	h := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+	z.lastSeen = h&1 != 0
+	size := int(h >> 3)
+
+	if size > zstdBlockMax {
+		return errZstdCorrupt
+	}
+
+	from := len(z.hist)
+
+	switch (h >> 1) & 3 {
+	case 0:
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[from:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	case 1:
+		c, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, c)
+		}
+	case 2:
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		if err := z.decompress(z.block); err != nil {
+			return err
+		}
+	default:
+		return errZstdCorrupt
+	}
+
+	z.out = append(z.out[:0], z.hist[from:]...)
+	z.sum.write(z.out)
+
+	// keep the window
+	if keep := z.window; keep > 0 && len(z.hist) > 2*keep+zstdBlockMax {
+		n := copy(z.hist, z.hist[len(z.hist)-keep:])
+		z.hist = z.hist[:n]
+	}
+
+	return nil
+}
+
+// decompress decodes a compressed block's content onto hist
+func (z *zstdReader) decompress(b []byte) error {
+	b, err := z.literals(b)
+	if err != nil {
+		return err
+	}
+
+	// sequences
+	if len(b) == 0 {
+		return errZstdCorrupt
+	}
+
+	var nbSeq int
+
+	switch {
+	case b[0] < 128:
+		nbSeq, b = int(b[0]), b[1:]
+	case b[0] < 255:
+		if len(b) < 2 {
+			return errZstdCorrupt
+		}
+		nbSeq, b = int(b[0]-128)<<8|int(b[1]), b[2:]
+	default:
+		if len(b) < 3 {
+			return errZstdCorrupt
+		}
+		nbSeq, b = int(b[1])|int(b[2])<<8+0x7F00, b[3:]
+	}
+
+	lits := z.lits
+
+	if nbSeq > 0 {
+		if len(b) == 0 {
+			return errZstdCorrupt
+		}
+
+		modes := b[0]
+		b = b[1:]
+
+		table := func(mode uint8, predefined, prev *fseDecodeTable, maxSymbols int, maxLog uint) (*fseDecodeTable, error) {
+			switch mode {
+			case 0:
+				return predefined, nil
+			case 1:
+				if len(b) == 0 || int(b[0]) >= maxSymbols {
+					return nil, errZstdCorrupt
+				}
+				t := rleDecodeTable(b[0])
+				b = b[1:]
+				return t, nil
+			case 2:
+				norm, tableLog, n, err := readNCount(b, maxSymbols, maxLog)
+				if err != nil {
+					return nil, err
+				}
+				b = b[n:]
+				return newFseDecodeTable(norm, tableLog), nil
+			default:
+				if prev == nil {
+					return nil, errZstdCorrupt
+				}
+				return prev, nil
+			}
+		}
+
+		if z.ll, err = table(modes>>6, zstdLLDecode, z.ll, len(zstdLLBase), 9); err != nil {
+			return err
+		}
+		if z.of, err = table(modes>>4&3, zstdOFDecode, z.of, 32, 8); err != nil {
+			return err
+		}
+		if z.ml, err = table(modes>>2&3, zstdMLDecode, z.ml, len(zstdMLBase), 9); err != nil {
+			return err
+		}
+
+		if lits, err = z.sequences(b, nbSeq, lits); err != nil {
+			return err
+		}
+	}
+
+	z.hist = append(z.hist, lits...)
+
+	return nil
+}
+
+// literals decodes the literals section at the start of b into lits,
+// returning what follows it
+func (z *zstdReader) literals(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errZstdCorrupt
+	}
+
+	kind, format := b[0]&3, b[0]>>2&3
+
+	if kind < 2 {
+		var n, hsize int
+
+		switch format {
+		case 0, 2:
+			n, hsize = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return nil, errZstdCorrupt
+			}
+			n, hsize = int(b[0]>>4)|int(b[1])<<4, 2
+		case 3:
+			if len(b) < 3 {
+				return nil, errZstdCorrupt
+			}
+			n, hsize = int(b[0]>>4)|int(b[1])<<4|int(b[2])<<12, 3
+		}
+
+		if kind == 0 {
+			if len(b) < hsize+n {
+				return nil, errZstdCorrupt
+			}
+			z.lits = append(z.lits[:0], b[hsize:hsize+n]...)
+			return b[hsize+n:], nil
+		}
+
+		if len(b) < hsize+1 || n > zstdBlockMax {
+			return nil, errZstdCorrupt
+		}
+		z.lits = z.lits[:0]
+		for i := 0; i < n; i++ {
+			z.lits = append(z.lits, b[hsize])
+		}
+		return b[hsize+1:], nil
+	}
+
+	// Huffman coded, with the code described first or the block before's
+	hsize := []int{3, 3, 4, 5}[format]
+	if len(b) < hsize {
+		return nil, errZstdCorrupt
+	}
+
+	var h uint64
+	for i := hsize - 1; i >= 0; i-- {
+		h = h<<8 | uint64(b[i])
+	}
+
+	sizeBits := []uint{10, 10, 14, 18}[format]
+	regen := int(h >> 4 & (1<<sizeBits - 1))
+	comp := int(h >> (4 + sizeBits) & (1<<sizeBits - 1))
+
+	if len(b) < hsize+comp || regen > zstdBlockMax {
+		return nil, errZstdCorrupt
+	}
+
+	body, rest := b[hsize:hsize+comp], b[hsize+comp:]
+
+	if kind == 2 {
+		t, n, err := readHuffmanTable(body)
+		if err != nil {
+			return nil, err
+		}
+
+		z.huff = t
+		body = body[n:]
+	} else if z.huff == nil {
+		return nil, errZstdCorrupt
+	}
+
+	var err error
+	z.lits = z.lits[:0]
+
+	if format == 0 {
+		if z.lits, err = z.huff.decode(z.lits, body, regen); err != nil {
+			return nil, err
+		}
+		return rest, nil
+	}
+
+	if len(body) < 6 {
+		return nil, errZstdCorrupt
+	}
+
+	sizes := []int{
+		int(binary.LittleEndian.Uint16(body)),
+		int(binary.LittleEndian.Uint16(body[2:])),
+		int(binary.LittleEndian.Uint16(body[4:])),
+	}
+
+	body = body[6:]
+	sizes = append(sizes, len(body)-sizes[0]-sizes[1]-sizes[2])
+
+	seg := (regen + 3) / 4
+
+	for k, size := range sizes {
+		n := seg
+		if k == 3 {
+			n = regen - 3*seg
+		}
+
+		if size < 0 || size > len(body) || n < 0 {
+			return nil, errZstdCorrupt
+		}
+
+		if z.lits, err = z.huff.decode(z.lits, body[:size], n); err != nil {
+			return nil, err
+		}
+		body = body[size:]
+	}
+
+	return rest, nil
+}
+
+// sequences executes the sequences of a block, returning the literals
+// left after them
+func (z *zstdReader) sequences(b []byte, nbSeq int, lits []byte) ([]byte, error) {
+	br, err := newBitReader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	llState := br.read(z.ll.tableLog)
+	ofState := br.read(z.of.tableLog)
+	mlState := br.read(z.ml.tableLog)
+
+	for i := 0; i < nbSeq; i++ {
+		llCell, ofCell, mlCell := z.ll.cells[llState], z.of.cells[ofState], z.ml.cells[mlState]
+
+		if llCell.symbol > 35 || mlCell.symbol > 52 || ofCell.symbol > 31 {
+			return nil, errZstdCorrupt
+		}
+
+		offValue := int(1)<<ofCell.symbol + int(br.read(uint(ofCell.symbol)))
+		matchLen := int(zstdMLBase[mlCell.symbol]) + int(br.read(uint(zstdMLBits[mlCell.symbol])))
+		litLen := int(zstdLLBase[llCell.symbol]) + int(br.read(uint(zstdLLBits[llCell.symbol])))
+
+		// offsets 1 to 3 repeat earlier ones
+		var offset int
+
+		if offValue > 3 {
+			offset = offValue - 3
+			z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+		} else {
+			idx := offValue - 1
+			if litLen == 0 {
+				idx++
+			}
+
+			switch idx {
+			case 0:
+				offset = z.rep[0]
+			case 3:
+				offset = z.rep[0] - 1
+			default:
+				offset = z.rep[idx]
+			}
+
+			if idx != 0 {
+				if idx != 1 {
+					z.rep[2] = z.rep[1]
+				}
+				z.rep[1] = z.rep[0]
+				z.rep[0] = offset
+			}
+		}
+
+		if litLen > len(lits) {
+			return nil, errZstdCorrupt
+		}
+
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+
+		if offset <= 0 || offset > len(z.hist) {
+			return nil, errZstdCorrupt
+		}
+
+		from := len(z.hist) - offset
+		for k := 0; k < matchLen; k++ {
+			z.hist = append(z.hist, z.hist[from+k])
+		}
+
+		if i < nbSeq-1 {
+			llState = uint32(llCell.base) + br.read(uint(llCell.nbBits))
+			mlState = uint32(mlCell.base) + br.read(uint(mlCell.nbBits))
+			ofState = uint32(ofCell.base) + br.read(uint(ofCell.nbBits))
+		}
+
+		if br.overflow {
+			return nil, errZstdCorrupt
+		}
+	}
+
+	if br.pos != 0 {
+		return nil, errZstdCorrupt
+	}
+
+	return lits, nil
+}
+
+// xxh64 is XXH64 with seed 0, whose low 32 bits are a frame's checksum
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+const (
+	xxhPrime1 uint64 = 0x9E3779B185EBCA87
+	xxhPrime2 uint64 = 0xC2B2AE3D27D4EB4F
+	xxhPrime3 uint64 = 0x165667B19E3779F9
+	xxhPrime4 uint64 = 0x85EBCA77C2B2AE63
+	xxhPrime5 uint64 = 0x27D4EB2F165667C5
+)
+
+func xxhRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxhPrime2, 31) * xxhPrime1
+}
+
+func (x *xxh64) reset() {
+	prime1 := xxhPrime1
+
+	*x = xxh64{}
+	x.v = [4]uint64{prime1 + xxhPrime2, xxhPrime2, 0, -prime1}
+}
+
+func (x *xxh64) write(p []byte) {
+	x.total += uint64(len(p))
+
+	if x.n > 0 {
+		k := copy(x.buf[x.n:], p)
+		x.n += k
+		p = p[k:]
+
+		if x.n < 32 {
+			return
+		}
+
+		x.stripe(x.buf[:])
+		x.n = 0
+	}
+
+	for ; len(p) >= 32; p = p[32:] {
+		x.stripe(p)
+	}
+
+	x.n = copy(x.buf[:], p)
+}
+
+func (x *xxh64) stripe(b []byte) {
+	for i := range x.v {
+		x.v[i] = xxhRound(x.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (x *xxh64) sum() uint64 {
+	var h uint64
+
+	if x.total >= 32 {
+		v := x.v
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+
+		for _, vi := range v {
+			h ^= xxhRound(0, vi)
+			h = h*xxhPrime1 + xxhPrime4
+		}
+	} else {
+		h = xxhPrime5
+	}
+
+	h += x.total
+
+	b := x.buf[:x.n]
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		b = b[4:]
+	}
+
+	for _, c := range b {
+		h ^= uint64(c) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+
+	return h
+}
@@ -0,0 +1,252 @@
+package logg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zstdInput returns the input of the vectors in testdata/zstd named after
+// it, made up the same on every run
+func zstdInput(name string) []byte {
+	switch name {
+	case "empty":
+		return nil
+
+	case "text":
+		var b bytes.Buffer
+		for i := 0; i < 2000; i++ {
+			fmt.Fprintf(&b, "2026/10/15 12:%02d:%02d.%06d [INFO] request %d served in %dms path=/web/info remote=10.0.%d.%d\n", i/60%60, i%60, i*997%1000000, i, i*7%300, i%256, i*31%256)
+		}
+		return b.Bytes()
+
+	case "zeros":
+		return make([]byte, 256<<10)
+
+	case "random":
+		return zstdNoise(16<<10, 1)
+
+	case "mixed":
+		var b bytes.Buffer
+		for i := 0; i < 64; i++ {
+			b.Write(zstdInput("text")[i*512 : i*512+1024])
+			b.Write(zstdNoise(i*37%512, uint64(i+2)))
+		}
+		return b.Bytes()
+
+	case "multi":
+		return append(zstdInput("text"), zstdInput("zeros")...)
+	}
+
+	panic("unknown zstd input " + name)
+}
+
+// zstdNoise returns n bytes of xorshift noise of seed
+func zstdNoise(n int, seed uint64) []byte {
+	b := make([]byte, n)
+	x := seed*0x9E3779B97F4A7C15 | 1
+
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		b[i] = byte(x >> 32)
+	}
+
+	return b
+}
+
+// the vectors of testdata/zstd are written by the reference encoder (zstd
+// 1.5.6): <input>.<level>.zst, <input>.nocheck.zst without checksums,
+// <input>.stream.zst without the content size as when compressing a pipe,
+// text.long.zst with a 16MiB window (--long=24) and multi.zst, the frames
+// of text and zeros one after the other
+func TestZstdReferenceVectors(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "zstd", "*.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) == 0 {
+		t.Fatal("no vectors in testdata/zstd")
+	}
+
+	for _, path := range paths {
+		name := filepath.Base(path)
+
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := NewZstdReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := zstdInput(strings.SplitN(name, ".", 2)[0]); !bytes.Equal(got, expected) {
+				t.Errorf("decoded %d bytes differing from the %d of the input", len(got), len(expected))
+			}
+		})
+	}
+}
+
+// a corrupted vector is refused rather than decoded into something else
+func TestZstdReferenceVectorsCorrupted(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "zstd", "text.3.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := zstdInput("text")
+
+	for _, i := range []int{len(b) / 3, len(b) / 2, len(b) - 2} {
+		c := append([]byte(nil), b...)
+		c[i] ^= 0x10
+
+		if got, err := zstdDecompress(c); err == nil && !bytes.Equal(got, expected) {
+			t.Errorf("byte %d flipped: decoded without an error into other content", i)
+		}
+	}
+
+	for _, n := range []int{3, 10, len(b) / 2, len(b) - 1} {
+		if _, err := zstdDecompress(b[:n]); err == nil {
+			t.Errorf("cut to %d bytes: decoded without an error", n)
+		}
+	}
+}
+
+func zstdCompress(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := NewZstdWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func zstdDecompress(b []byte) ([]byte, error) {
+	r, err := NewZstdReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	for _, name := range []string{"empty", "text", "zeros", "random", "mixed", "multi"} {
+		for _, level := range []int{1, 3, 9, 22} {
+			data := zstdInput(name)
+
+			b, err := zstdCompress(data, level)
+			if err != nil {
+				t.Fatalf("%s at level %d: %v", name, level, err)
+			}
+
+			got, err := zstdDecompress(b)
+			if err != nil {
+				t.Errorf("%s at level %d: %v", name, level, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s at level %d: decoded %d bytes differing from the %d written", name, level, len(got), len(data))
+			}
+		}
+	}
+}
+
+// what the writer writes, the reference decoder takes; skipped without a
+// zstd binary
+func TestZstdReferenceDecoder(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("no zstd binary to check against")
+	}
+
+	for _, name := range []string{"empty", "text", "zeros", "random", "mixed"} {
+		data := zstdInput(name)
+
+		b, err := zstdCompress(data, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(zstd, "-d", "-c", "-q")
+		cmd.Stdin = bytes.NewReader(b)
+
+		got, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%s: zstd refused the frame: %v", name, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s: zstd decoded %d bytes differing from the %d written", name, len(got), len(data))
+		}
+	}
+}
+
+func FuzzZstdRoundTrip(f *testing.F) {
+	f.Add([]byte(nil), 3)
+	f.Add([]byte("a"), 1)
+	f.Add(zstdInput("text")[:4096], 3)
+	f.Add(zstdNoise(1024, 7), 19)
+	f.Add(bytes.Repeat([]byte("abcabcabd"), 500), 9)
+
+	f.Fuzz(func(t *testing.T, data []byte, level int) {
+		if level < 1 || level > 22 {
+			level = 3
+		}
+
+		b, err := zstdCompress(data, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := zstdDecompress(b)
+		if err != nil {
+			t.Fatalf("%d bytes at level %d: %v", len(data), level, err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes at level %d: decoded %d differing bytes", len(data), level, len(got))
+		}
+	})
+}
+
+// whatever it is given, the reader returns an error rather than panic or
+// run away
+func FuzzZstdReader(f *testing.F) {
+	for _, name := range []string{"text.3.zst", "zeros.3.zst", "random.3.zst", "mixed.19.zst"} {
+		if b, err := os.ReadFile(filepath.Join("testdata", "zstd", name)); err == nil {
+			f.Add(b)
+		}
+	}
+	f.Add([]byte{0x28, 0xb5, 0x2f, 0xfd})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := NewZstdReader(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+
+		io.Copy(io.Discard, io.LimitReader(r, 64<<20))
+	})
+}
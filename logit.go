@@ -1,40 +1,439 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"github.com/scryner/logg"
 	"io"
 	"io/ioutil"
+	"log"
+	"logit/logg"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
+// how long requests under way and the logger's queue may take on exit
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 var (
 	// flags
-	listenPort  int
-	logFilePath string
+	listenPort     int
+	unixSocket     string
+	unixSocketMode string
+	logFilePath    string
 
 	enableGz   bool
 	maxSizeStr string
 	maxSize    int64
+	gzSenders  string
+
+	shadowUrl  string
+	shadowSpec string
+
+	encryptFields string
+	encryptKeyDir string
+	encryptTenant bool
+
+	encryptRotated    bool
+	encryptRotatedKey string
+
+	allowSenders   string
+	denySenders    string
+	catchAllSender string
+	admission      *senderFilter
+
+	alertUrl     string
+	alertLevel   string
+	alertSenders string
+	alertBatch   time.Duration
+	alertRate    int
+	alerts       *alerter
+
+	anomalyEnabled   bool
+	anomalyThreshold float64
+	anomalyMinCount  int64
+
+	extractPatterns string
+
+	fileTemplate     string
+	rotatedTemplate  string
+	fileTemplateFile string
+
+	storageKind string
+
+	coalesceWindow  time.Duration
+	coalesceSenders string
+	coalesceLevel   string
+
+	watchdogInterval time.Duration
+	watchdogRestart  bool
+
+	quarantineRate     int64
+	quarantineSize     int64
+	quarantineEntropy  float64
+	quarantineSample   int64
+	quarantineDuration time.Duration
+
+	replicateTo    string
+	nodeId         string
+	acceptReplicas bool
+
+	strictBodies   bool
+	blankResponses bool
+	maxBodySpec    string
+	maxBody        int64
+
+	maxInflatedSpec string
+	maxInflated     int64
+
+	shutdownTimeout time.Duration
+
+	syncLevel   string
+	syncSenders string
+
+	sampleRateSpec string
+	sampleSenders  string
+	repeatWindow   time.Duration
+	repeatSenders  string
+
+	senderLevels string
+
+	redactSpec    string
+	redactSenders string
+	redactRules   string
+	redaction     *redactPolicy
+
+	transformSpec    string
+	transformSenders string
+	transforms       *transformPolicy
+
+	dedupStoreSpec string
+	dedupSize      int
+	dedupTTL       time.Duration
+	dedupSenders   string
+	dedup          *deduplicator
+
+	senderRateSpec string
+	senderRates    string
+	senderLimits   *senderLimiter
+
+	quotaSpec    string
+	quotaSenders string
+	quotaTotal   string
+	quotaScan    time.Duration
+	quotas       *quotaPolicy // nil unless a quota is set
+
+	overflowSpec   string
+	overflowPolicy logg.OverflowPolicy
+
+	shedQueue   float64
+	shedLatency time.Duration
+
+	writeBufferSpec  string
+	writeBuffer      int
+	writeBufferFlush time.Duration
+
+	fileModeSpec  string
+	dirModeSpec   string
+	fileOwnerSpec string
+	fileOptions   logg.FileOptions
+
+	authSpec      string
+	authPeerSpec  string
+	authJwtSecret string
+	authApiKeys   string
+	authAllow     string
+	authAdminSpec string
+	authTokens    string
+	authTokenList string
+
+	outputFormat string
+	layoutSpec   string
+	timeFormat   string
+	timeZone     string
+
+	multilineSpec   string
+	multilineIndent string
+
+	rateLimits string
+
+	rotateSpec     string
+	rotationPolicy logg.RotationPolicy
+
+	rotateMethodSpec string
+	rotateMethod     logg.RotateMethod
+
+	maxBackups int
+	maxAgeDays int
+
+	aliasFile string
+	mergeSpec string
+
+	retainSpec string
+
+	syslogUDP    string
+	syslogTCP    string
+	syslogSender string
+	udpPort      int
+	grpcPort     int
+
+	warmUpSenders string
+	selfTest      string
+
+	kafkaBrokers  string
+	kafkaTopic    string
+	kafkaAcks     string
+	kafkaClientId string
+	consoleSpec   string
+	logCaller     bool
+	colorSpec     string
+	colorMode     logg.ColorMode
+
+	accessLog        string
+	accessLogSize    string
+	accessLogRotate  string
+	accessLogBackups int
+
+	auditLogName string
+	auditKeyFile string
+
+	forwardTo     string
+	forwardFormat string
+	forwardToken  string
+
+	gelfTo       string
+	gelfCompress string
+
+	syslogTo       string
+	syslogFormat   string
+	syslogFacility int
+
+	esURL    string
+	esIndex  string
+	esUser   string
+	esAPIKey string
+
+	archiveTo       string
+	archiveEndpoint string
+	archiveRegion   string
+	archiveDelete   bool
+	archive         *archiver
+
+	searchIndexed bool
+	searcher      *searchIndex // nil unless -search-index
+
+	simulateEvents string
+	simulating     bool // 'logit simulate': run the intake against sample events
+
+	configPath string
+	conf       *configFile // nil without -config
+
+	lateMode      string
+	lateTolerance time.Duration
+
+	timeFieldSpec string
+	timeFields    []string
+	receivedField string
+
+	traceFieldSpec string
+
+	tlsCert              string
+	tlsKey               string
+	tlsClientCA          string
+	tlsRequireClientCert bool
+	tlsPeerCA            string
 
 	// global variable
 	lock *sync.Mutex
 
-	loggers map[string]*logg.Logger
-	fds     []io.Closer
+	loggerPaths map[string]string // files of the sender loggers registered in logg, by key
+	fds         []io.Closer
+
+	shadow     *shadowForwarder
+	encryptor  *fieldEncryptor
+	sealer     *rotatedCipher // of rotated files, nil unless -encrypt-rotated
+	stats      *statsCollector
+	detector   *anomalyDetector
+	intake     *pipeline
+	namer      *fileNamer
+	store      Storage
+	gzPrefs    *gzipPrefs
+	syncPrefs  *durabilityPolicy
+	noisePrefs *noisePolicy
+	levelPrefs *levelPolicy
+
+	replicators []*replicator // one a peer of -replicate-to
+	aliases     *senderAliases
+	stageStats  *pipelineMetrics
+	tails       *tailHub
+
+	serverTLS *tls.Config
+	outbound  http.RoundTripper // for peers and shadow targets
+
+	serverLogger *logg.Logger
 )
 
 func init() {
 	flag.IntVar(&listenPort, "p", 8070, "listen port")
+	flag.StringVar(&unixSocket, "unix-socket", "", "also serve on a Unix domain socket at this path, for processes on the same host (a stale socket file there is removed)")
+	flag.StringVar(&unixSocketMode, "unix-socket-mode", "0660", "permissions of the -unix-socket file, deciding who may post to it")
 	flag.StringVar(&logFilePath, "w", "", "log file path")
 	flag.StringVar(&maxSizeStr, "s", "16m", "max size (-1 means no log rotation)")
 	flag.BoolVar(&enableGz, "z", true, "enable gz")
+	flag.StringVar(&configPath, "config", "", "YAML (.yaml, .yml) or TOML (.toml) file of settings and per-sender overrides; flags given override it")
+	flag.StringVar(&compressCodecName, "z-codec", "gzip", "what -z compresses rotated files with: gzip or zstd")
+	flag.IntVar(&compressLevel, "z-level", 0, "compression level of -z-codec: 1 (fastest) to 9 for gzip, 1 to 22 for zstd (0: the codec's default)")
+	flag.StringVar(&gzSenders, "gz-senders", "", "per-sender overrides of -z (e.g. 'media=off,backup=off')")
+	flag.StringVar(&shadowUrl, "shadow-url", "", "base url of a logit-compatible endpoint receiving shadow traffic")
+	flag.StringVar(&shadowSpec, "shadow", "*=100", "percent of traffic to shadow per sender (e.g. 'web=10,*=1')")
+	flag.StringVar(&encryptFields, "encrypt-fields", "", "comma separated JSON field paths to encrypt (e.g. 'user.email,card.number')")
+	flag.StringVar(&encryptKeyDir, "encrypt-key-dir", "", "directory holding '<tenant>[.<version>].key' and 'default[.<version>].key' files for field encryption, with any '.' of a tenant written %2e")
+	flag.BoolVar(&encryptTenant, "encrypt-tenant-keys", false, "create a key for each tenant without one instead of using the default key")
+	flag.BoolVar(&encryptRotated, "encrypt-rotated", false, "encrypt rotated files with AES-256-GCM once compressed, into '<file>.enc' (before -archive-to uploads them); 'logit decrypt' reads them")
+	flag.StringVar(&encryptRotatedKey, "encrypt-rotated-key", "", "file holding the hex or base64 encoded 32 byte key of -encrypt-rotated (default: $LOGIT_ROTATED_KEY holding the key itself)")
+	flag.StringVar(&allowSenders, "allow-senders", "", "names or globs of the senders that may have files (e.g. 'web,api-*'; default: all), besides those of -config")
+	flag.StringVar(&denySenders, "deny-senders", "", "names or globs of senders refused even if allowed (e.g. 'test-*')")
+	flag.StringVar(&catchAllSender, "catch-all", "", "sender taking the entries of senders not allowed, instead of refusing them with 403 (e.g. 'unknown')")
+	flag.StringVar(&alertUrl, "alert-url", "", "webhook (e.g. a Slack incoming webhook) posted entries at or above -alert-level, anomalies and the server's own errors")
+	flag.StringVar(&alertLevel, "alert-level", "error", "lowest level of a sender's entries alerted on (or 'off')")
+	flag.StringVar(&alertSenders, "alert-senders", "", "per-sender overrides of -alert-level (e.g. 'payments=warn,batch=off')")
+	flag.DurationVar(&alertBatch, "alert-batch", 10*time.Second, "how long entries gather into one alert")
+	flag.IntVar(&alertRate, "alert-rate", 6, "alerts posted a minute at most; entries past that wait for the next one")
+	flag.BoolVar(&anomalyEnabled, "anomaly", false, "enable warn/error rate anomaly detection")
+	flag.Float64Var(&anomalyThreshold, "anomaly-threshold", 3, "z-score above the rolling baseline that counts as an anomaly")
+	flag.Int64Var(&anomalyMinCount, "anomaly-min", 10, "minimum warn/error count per minute before an anomaly can fire")
+	flag.StringVar(&extractPatterns, "extract-patterns", "", "file of '<sender|*> <grok or regex>' lines promoting captures into fields")
+	flag.StringVar(&fileTemplate, "file-template", DEFAULT_FILE_TEMPLATE, "go template of live log file names ({{.Sender}}, {{.Host}}, {{.Date}})")
+	flag.StringVar(&rotatedTemplate, "rotated-template", DEFAULT_ROTATED_TEMPLATE, "go template of rotated log file names ({{.Live}}, {{.N}} and the above, or {{.Time}} of the rotation, which spares renaming every rotated file)")
+	flag.StringVar(&fileTemplateFile, "file-templates", "", "file of '<sender> <template> [<rotated template>]' per-sender overrides")
+	flag.StringVar(&storageKind, "storage", "file", "storage backend: 'file', 'memory', 'journal' (the systemd journal, on Linux) or 'db' (an embedded store of day partitions below '<-w>/db', read by /logs and /search without parsing files and pruned a day at a time by -max-age-days and retention classes)")
+	flag.DurationVar(&coalesceWindow, "coalesce", 0, "window in which identical messages of a sender are stored once plus a repeat count (0 disables)")
+	flag.StringVar(&coalesceSenders, "coalesce-senders", "", "per-sender coalesce windows (e.g. 'web=30s,audit=0')")
+	flag.StringVar(&coalesceLevel, "coalesce-level", "error", "highest level that is coalesced")
+	flag.DurationVar(&watchdogInterval, "watchdog", 0, "interval of the self-health watchdog, reported at /health behind -auth-admin (0 disables)")
+	flag.BoolVar(&watchdogRestart, "watchdog-restart", false, "let the watchdog restart stuck subsystems")
+	flag.Int64Var(&quarantineRate, "quarantine-rate", 0, "quarantine senders exceeding this many messages per minute (0 disables)")
+	flag.Int64Var(&quarantineSize, "quarantine-size", 0, "quarantine senders whose average message exceeds this many bytes (0 disables)")
+	flag.Float64Var(&quarantineEntropy, "quarantine-entropy", 0, "quarantine senders whose payload entropy exceeds this many bits per byte (0 disables)")
+	flag.Int64Var(&quarantineSample, "quarantine-sample", 100, "keep one of this many messages of a quarantined sender")
+	flag.DurationVar(&quarantineDuration, "quarantine-for", 15*time.Minute, "how long a sender stays quarantined")
+	flag.StringVar(&replicateTo, "replicate-to", "", "base urls of peer logits (comma separated) each receiving every entry accepted here exactly once; peers on -replica replicating to each other make a cluster")
+	flag.StringVar(&nodeId, "node-id", "", "name of this node towards replication peers (default: hostname)")
+	flag.BoolVar(&acceptReplicas, "replica", false, "accept replicated entries from peers at /replicate")
+	flag.BoolVar(&dryRun, "dry-run", false, "parse and check entries but store none: / and /bulk answer the entries made as JSON (as /echo/<sender>/<level> always does), gRPC, UDP and syslog entries are dropped")
+	flag.BoolVar(&strictBodies, "strict", false, "reject bodies that are not valid UTF-8")
+	flag.BoolVar(&blankResponses, "blank-responses", false, "answer entries with a blank 200 even when they fail, for old clients taking anything else as an error")
+	flag.StringVar(&spillDir, "spill-dir", "", "directory, best on other storage than -w, keeping lines sender files refuse (disk full, lost mount) until they take writes again")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", SHUTDOWN_TIMEOUT, "how long SIGTERM or SIGINT waits for requests under way and queued lines before exiting")
+	flag.StringVar(&maxBodySpec, "max-body", "1m", "largest body of an entry, bigger ones get 413 (e.g. '256k' or '-1' for unlimited)")
+	flag.StringVar(&maxInflatedSpec, "max-inflated", "64m", "largest a gzip or deflate body may inflate to, and an uncompressed /bulk body may be, 413 past it (entries are held to -max-body too)")
+	flag.StringVar(&syncLevel, "sync-level", "off", "lowest level written synchronously with fsync (e.g. 'warn', 'fatal' or 'off')")
+	flag.StringVar(&syncSenders, "sync-senders", "", "per-sender overrides of -sync-level (e.g. 'audit=info,metrics=off')")
+	flag.StringVar(&sampleRateSpec, "sample", "off", "write only 1 of every n entries of a sender at a level or below (e.g. 'debug/100' or 'off')")
+	flag.StringVar(&sampleSenders, "sample-senders", "", "per-sender overrides of -sample (e.g. 'web=debug/100,audit=off')")
+	flag.DurationVar(&repeatWindow, "repeats", 0, "write an entry repeating a sender's last one within this window once, then 'last message repeated N times' (0 writes them all)")
+	flag.StringVar(&repeatSenders, "repeats-senders", "", "per-sender overrides of -repeats (e.g. 'web=1m,audit=0')")
+	flag.StringVar(&redactSpec, "redact", "off", "rules scrubbing every entry's message and fields before it is stored or forwarded, joined by '+': email, card, token, jwt, secret, field:<name> or one of -redact-rules (e.g. 'email+card+field:password')")
+	flag.StringVar(&redactSenders, "redact-senders", "", "per-sender overrides of -redact (e.g. 'web=email+card,audit=off')")
+	flag.StringVar(&redactRules, "redact-rules", "", "file of more redaction rules, one '<name> <regexp>' a line, usable in -redact and -redact-senders")
+	flag.StringVar(&transformSpec, "transform", "off", "changes made to every entry once redacted, joined by '+': host, tag:<key>=<value>, trim, oneline or truncate:<size> (e.g. 'host+tag:env=prod+truncate:4k')")
+	flag.StringVar(&transformSenders, "transform-senders", "", "per-sender overrides of -transform (e.g. 'web=host+oneline,audit=off')")
+	flag.StringVar(&quotaSpec, "quota", "off", "disk quota of each sender's files, '<size>[:action]': past it, 'reject' refuses new entries with 429, 'prune' removes the oldest rotated files and 'errors' takes error and fatal entries only (e.g. '1g:prune'; needs -w)")
+	flag.StringVar(&quotaSenders, "quota-senders", "", "per-sender overrides of -quota (e.g. 'web=5g:prune,audit=off')")
+	flag.StringVar(&quotaTotal, "quota-total", "off", "disk quota of everything below -w, like -quota; 'prune' removes the oldest rotated files of any sender")
+	flag.DurationVar(&quotaScan, "quota-scan", QUOTA_SCAN_EVERY, "interval of measuring disk usage for -quota and -quota-total")
+	flag.StringVar(&dedupStoreSpec, "dedup", "", "drop entries whose id (Idempotency-Key, or 'id' in /bulk) was taken before, remembering ids in 'memory' or 'redis://host:port/db' shared by nodes")
+	flag.IntVar(&dedupSize, "dedup-size", 100000, "ids remembered per sender by the memory dedup store")
+	flag.DurationVar(&dedupTTL, "dedup-ttl", 10*time.Minute, "how long an id is remembered")
+	flag.StringVar(&dedupSenders, "dedup-senders", "", "per-sender dedup size and ttl (e.g. 'web=50000/1h,audit=24h,metrics=off')")
+	flag.StringVar(&senderRateSpec, "sender-rate", "off", "entries and bytes per second each sender may send, over which requests get 429 (e.g. '500:1m', '-:256k' or 'off')")
+	flag.StringVar(&senderRates, "sender-rates", "", "per-sender overrides of -sender-rate (e.g. 'chatty=100:64k,audit=off')")
+	flag.StringVar(&writeBufferSpec, "write-buffer", "0", "bytes of lines a sender's file gathers before they are written (e.g. '64k'; 0 writes each line right away)")
+	flag.DurationVar(&writeBufferFlush, "write-buffer-flush", time.Second, "longest lines wait in -write-buffer; /logs and tail -f of the files see them after it")
+	flag.StringVar(&fileModeSpec, "file-mode", "", "mode of the log files, set whatever the umask (octal, e.g. '0640'; default 0644 less the umask)")
+	flag.StringVar(&dirModeSpec, "dir-mode", "", "mode of the log directories logit creates, set whatever the umask (octal, e.g. '0750'; default 0755 less the umask)")
+	flag.StringVar(&fileOwnerSpec, "file-owner", "", "'user:group', 'user' or ':group' (names or ids) given the log files and the directories logit creates; needs the right to chown, Unix only")
+	flag.StringVar(&overflowSpec, "overflow", "block", "what sender loggers do with messages while the write queue is full: block, drop-newest or drop-oldest")
+	flag.Float64Var(&shedQueue, "shed-queue", 0, "refuse entries with 503 and Retry-After while the write queue of their sender is this full, e.g. 0.9 (0: never)")
+	flag.DurationVar(&shedLatency, "shed-latency", 0, "refuse entries with 503 and Retry-After while writes of their sender take this long, e.g. 2s (0: never)")
+	flag.StringVar(&senderLevels, "sender-levels", "", "minimum level written per sender (e.g. 'chatty=warn'); changed at runtime through /admin/senders")
+	flag.StringVar(&authSpec, "auth", "", "auth chain of the client endpoints: groups of mtls|jwt|apikey|token|ip that must all pass (e.g. 'mtls|jwt|apikey,ip')")
+	flag.StringVar(&authPeerSpec, "auth-peers", "", "auth chain of the peer endpoints (/replicate), same syntax as -auth")
+	flag.StringVar(&authJwtSecret, "auth-jwt-secret", "", "file holding the HS256 secret for 'jwt'")
+	flag.StringVar(&authApiKeys, "auth-api-keys", "", "file of '<key> <principal>' lines for 'apikey'")
+	flag.StringVar(&authAdminSpec, "auth-admin", "", "auth chain of the admin endpoints (/admin/..., /metrics, /health) and of reads with decrypt=true, same syntax as -auth (default: -auth, and no decrypting)")
+	flag.StringVar(&authTokens, "auth-tokens", "", "file of '<token> <principal> [<sender>,...]' lines for 'token' (Bearer or ?token=)")
+	flag.StringVar(&authTokenList, "auth-token-list", "", "more tokens for 'token', comma separated '<principal>=<token>[@<sender>+...]'")
+	flag.StringVar(&authAllow, "auth-allow", "", "comma separated networks for 'ip' (e.g. '10.0.0.0/8,127.0.0.1')")
+	flag.StringVar(&rateLimits, "rate-limits", "", "file of '<route|*> rate=N[/s|/m|/h] burst=N key=sender|ip|tenant' lines, reloaded on change")
+	flag.StringVar(&outputFormat, "format", "text", "format of sender log lines: 'text' or 'json'")
+	flag.StringVar(&layoutSpec, "layout", "", "pattern laying out text sender log lines, log4j style, e.g. '%d %-5l [%p] %m%f': %d time, %l level, %p logger name, %c caller, %m message, %f fields (default: logg's line)")
+	flag.StringVar(&timeFormat, "time-format", "log", "time layout of text lines: log ('2006/01/02 15:04:05.000000'), rfc3339, rfc3339nano, datetime, a strftime format or a Go layout")
+	flag.StringVar(&multilineSpec, "multiline", "indent", "how text lines carry entries of several lines, like stack traces: 'indent' (continuation lines indented) or 'escape' (newlines written as \\n, one line an entry)")
+	flag.StringVar(&multilineIndent, "multiline-indent", "13", "spaces continuation lines start with under -multiline indent, or 'tab'")
+	flag.StringVar(&timeZone, "time-zone", "Local", "zone of the times of log lines, e.g. UTC, Asia/Seoul or +09:00")
+	flag.IntVar(&maxBackups, "max-backups", 0, "rotated files kept per log file, oldest removed first (0 keeps all)")
+	flag.IntVar(&maxAgeDays, "max-age-days", 0, "remove rotated files older than this many days (0 keeps all)")
+	flag.StringVar(&aliasFile, "aliases", "", "file of '<canonical> <alias>...' lines mapping sender names, reloaded on change and editable at /admin/aliases")
+	flag.StringVar(&mergeSpec, "merge", "", "merge the stored history of senders into another and exit, e.g. 'web-frontend,frontend=web' (needs -w; stop the server first)")
+	flag.StringVar(&retainSpec, "retain-classes", "", "retention classes clients may pick with ?retain= or a 'retain' field, stored apart and expired by age (e.g. '1d,30d,7y')")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate (chain) to serve HTTPS with")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key of -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM CA bundle verifying client certificates (enables the 'mtls' auth mechanism)")
+	flag.BoolVar(&tlsRequireClientCert, "tls-require-client-cert", false, "refuse TLS connections without a verified client certificate")
+	flag.StringVar(&tlsPeerCA, "tls-peer-ca", "", "PEM CA bundle trusted, besides the system roots, for replication peers and shadow targets")
+	flag.StringVar(&lateMode, "late", "off", "entries whose ?ts= is older than what the sender stored: 'off' (write in place), 'divert' (to late/<file>.<day>) or 'resort' (sort rotated files by time)")
+	flag.StringVar(&timeFieldSpec, "ts-fields", "", "top level fields of structured entries (comma separated, first found wins) telling when they happened, for clients giving neither ?ts= nor X-Log-Timestamp (e.g. 'timestamp,@timestamp')")
+	flag.StringVar(&receivedField, "received-field", "received", "field giving entries that carry their own time the time logit received them ('' leaves it out)")
+	flag.StringVar(&traceFieldSpec, "trace-fields", "trace_id,span_id", "fields taking the trace and span id of a W3C traceparent (or gRPC grpc-trace-bin) header sent with entries, as '<trace field>,<span field>' ('off' leaves them out)")
+	flag.DurationVar(&lateTolerance, "late-tolerance", time.Minute, "how far behind the newest stored entry an entry may be before it counts as late")
+	flag.StringVar(&syslogUDP, "syslog-udp", "", "address to accept RFC 5424 syslog on over UDP (e.g. ':5514')")
+	flag.StringVar(&syslogTCP, "syslog-tcp", "", "address to accept RFC 5424 syslog on over TCP, octet counted or newline framed")
+	flag.IntVar(&grpcPort, "grpc-port", 0, "port to serve the gRPC LogService of proto/logservice.proto on, with -tls-cert if given (0: off)")
+	flag.IntVar(&udpPort, "udp-port", 0, "udp port to take plaintext 'sender level message' datagrams on, unauthenticated (0: off)")
+	flag.StringVar(&syslogSender, "syslog-sender", "app", "what names the sender of syslog messages: 'app' (APP-NAME) or 'host' (HOSTNAME)")
+	flag.StringVar(&consoleSpec, "console", "off", "also write to stderr what goes to files, for debugging: off, server (logit's own log) or all (sender files too)")
+	flag.BoolVar(&logCaller, "log-caller", false, "note the file:line logging each line of logit's own log")
+	flag.StringVar(&colorSpec, "color", "auto", "color the level tags of lines written to a terminal without -w: auto, always or never")
+	flag.StringVar(&accessLog, "access-log", "", "log every request served to this file in -w (e.g. 'access.log'), or to stdout without -w")
+	flag.StringVar(&accessLogSize, "access-log-size", "", "max size of the access log before rotation (default: -s)")
+	flag.StringVar(&accessLogRotate, "access-log-rotate", "", "time based rotation of the access log (default: -rotate)")
+	flag.IntVar(&accessLogBackups, "access-log-backups", -1, "rotated access logs kept (default: -max-backups)")
+	flag.StringVar(&auditLogName, "audit-log", "", "record admin actions, with their caller and the state before and after, in this HMAC chained file in -w (default: audit.log when an -audit-key is given; 'off' records none)")
+	flag.StringVar(&auditKeyFile, "audit-key", "", "file, away from -w, holding the hex or base64 encoded 32 byte key chaining -audit-log (default: $LOGIT_AUDIT_KEY holding the key itself)")
+	flag.StringVar(&kafkaBrokers, "kafka-brokers", "", "kafka brokers (host:port,...) to produce every stored entry to, over plaintext: TLS and SASL are not supported")
+	flag.StringVar(&kafkaTopic, "kafka-topic", "logit", "kafka topic, entries keyed by sender; '{sender}' in it makes a topic per sender (e.g. 'logs-{sender}')")
+	flag.StringVar(&kafkaAcks, "kafka-acks", "1", "acks the kafka producer waits for: 1 (the leader) or all")
+	flag.StringVar(&kafkaClientId, "kafka-client-id", "logit", "client id towards kafka")
+	flag.StringVar(&forwardTo, "forward-to", "", "url to relay every stored entry to, e.g. a central logit (relay mode)")
+	flag.StringVar(&forwardFormat, "forward-format", FORWARD_LOGIT, "how entries are relayed: logit (to its /bulk/<sender>) or ndjson (JSON lines to the url)")
+	flag.StringVar(&forwardToken, "forward-token", "", "bearer token towards -forward-to (or $LOGIT_FORWARD_TOKEN)")
+	flag.StringVar(&gelfTo, "gelf-to", "", "Graylog input to send every stored entry to in GELF: udp://host[:port] or tcp://host[:port] (port 12201 by default)")
+	flag.StringVar(&gelfCompress, "gelf-compress", "gzip", "compression of GELF messages over UDP: gzip, zlib or none")
+	flag.StringVar(&syslogTo, "syslog-to", "", "syslog server to send every stored entry to: udp://, tcp:// or tls://host[:port] (port 514 by default; tls trusts -tls-peer-ca)")
+	flag.StringVar(&syslogFormat, "syslog-format", "rfc5424", "format of messages to -syslog-to: rfc5424 (fields as structured data) or rfc3164")
+	flag.IntVar(&syslogFacility, "syslog-facility", 1, "syslog facility of messages to -syslog-to (1: user, 3: daemon, 16..23: local0..local7)")
+	flag.StringVar(&archiveTo, "archive-to", "", "upload rotated files to S3-compatible storage: s3://bucket[/prefix], '{host}' in the prefix being the host's name (needs -w; credentials from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN)")
+	flag.StringVar(&archiveEndpoint, "archive-endpoint", "", "url of the S3-compatible service, e.g. 'http://minio:9000' (default: AWS in -archive-region)")
+	flag.StringVar(&archiveRegion, "archive-region", "", "region of the archive bucket (default: $AWS_REGION, or us-east-1)")
+	flag.BoolVar(&archiveDelete, "archive-delete", false, "remove rotated files locally once archived, rather than keeping them by -max-backups and -max-age")
+	flag.BoolVar(&searchIndexed, "search-index", false, "index rotated files by time and words below '<-w>/index', so GET /search and /logs skip those holding no match (needs -w)")
+	flag.StringVar(&esURL, "es-url", "", "elasticsearch url to index every stored entry at with the _bulk API")
+	flag.StringVar(&esIndex, "es-index", ES_DEFAULT_INDEX, "elasticsearch index pattern; {sender} and date tokens like {yyyy.MM.dd} (UTC) are filled in")
+	flag.StringVar(&esUser, "es-user", "", "user:password for basic auth towards elasticsearch (or $LOGIT_ES_USER)")
+	flag.StringVar(&esAPIKey, "es-api-key", "", "api key towards elasticsearch, instead of -es-user (or $LOGIT_ES_API_KEY)")
+	flag.StringVar(&selfTest, "self-test", "warn", "check at startup that the log directory can be written, rotated and compressed in and that sinks answer: off, warn (report failures) or strict (refuse to start)")
+	flag.StringVar(&warmUpSenders, "warm-up", "", "senders whose files are opened at startup, besides those found in -w (e.g. 'web,api,retain-30d/audit'); one that can't be opened stops the server")
+	flag.StringVar(&simulateEvents, "events", "", "with 'logit simulate': NDJSON file of sample events ({sender, level, msg|json, ts, retain}) to route in memory")
+	flag.StringVar(&rotateMethodSpec, "rotate-method", "", "how rotations move files aside: 'rename', or 'copytruncate' for files others keep open, the default on Windows")
+	flag.StringVar(&rotateSpec, "rotate", "", "also roll files over by time: 'hourly', 'daily' or 'cron:<5 field expression>' (e.g. 'cron:0 */6 * * *')")
 }
 
 func safelyDo(fun func()) (err error) {
@@ -48,33 +447,231 @@ func safelyDo(fun func()) (err error) {
 	return
 }
 
-func makeHandler(logFilePath string) (http.HandlerFunc, error) {
-	var logger *logg.Logger
-
+func newServerLogger(logFilePath string) (*logg.Logger, error) {
 	if logFilePath == "" {
-		logger = logg.NewLogger("logit", os.Stdout, logg.LOG_LEVEL_DEBUG)
+		logger := logg.NewLogger("logit", os.Stdout, logg.LOG_LEVEL_DEBUG)
+		logger.EnableCaller(logCaller)
+		logger.SetColor(colorMode)
+		logger.SetTimeFormat(lineTimeLayout, lineTimeLoc)
+		logger.SetMultiline(multilineMode, continuationIndent)
 
-	} else {
-		var err error
+		return logger, nil
+	}
+
+	logger, err := logg.NewFileLoggerWithOptions("", fmt.Sprintf("%s/logit.log", logFilePath), logg.LOG_LEVEL_DEBUG, maxSize, enableGz, fileOptions)
+	if err != nil {
+		return nil, fmt.Errorf("can't open default log file: %v", err)
+	}
+
+	logger.SetRotationPolicy(rotationPolicy)
+
+	setRetention(logger)
+	logger.EnableCaller(logCaller)
+	logger.SetTimeFormat(lineTimeLayout, lineTimeLoc)
+	logger.SetMultiline(multilineMode, continuationIndent)
+
+	if consoleSpec != "off" {
+		logger.AddWriter(os.Stderr)
+	}
+
+	return logger, nil
+}
+
+// consoleWriter copies the lines of a sender's logger to stderr, marked with
+// the sender since its file lines don't name it
+type consoleWriter struct {
+	key string
+}
+
+func (w consoleWriter) Write(b []byte) (int, error) {
+	return os.Stderr.Write(append([]byte(fmt.Sprintf("[%s] ", w.key)), b...))
+}
+
+// httpErrorLog logs what an http.Server reports (TLS handshake failures,
+// bad requests) as warnings instead of to stderr
+func httpErrorLog(logger *logg.Logger) *log.Logger {
+	return log.New(logger.Writer(logg.LOG_LEVEL_WARN), "http: ", 0)
+}
+
+// setLineFormat applies -format, -time-format, -time-zone and -multiline to
+// a sender's logger
+func setLineFormat(logger *logg.Logger) {
+	logger.SetFormat(logg.FormatFrom(outputFormat, logg.FORMAT_TEXT))
+	logger.SetTimeFormat(lineTimeLayout, lineTimeLoc)
+	logger.SetMultiline(multilineMode, continuationIndent)
+	logger.SetLayout(lineLayout)
+}
+
+// setRetention applies -z-codec, -z-level, -max-backups and -max-age-days
+// to a file logger
+func setRetention(logger *logg.Logger) {
+	logger.SetRotateMethod(rotateMethod)
+	logger.SetCompression(compressCodec, compressLevel)
+	logger.SetMaxBackups(maxBackups)
+	logger.SetMaxAge(time.Duration(maxAgeDays) * 24 * time.Hour)
+
+	if sealer != nil {
+		logger.SetEncryption(sealer)
+	}
+
+	if searcher != nil || archive != nil {
+		logger.SetArchiveHook(func(path string) {
+			if searcher != nil {
+				searcher.rotated(path)
+			}
+			if archive != nil {
+				archive.add(path)
+			}
+		})
+	}
+}
+
+// runMerge carries out -merge ('<from>[,<from>...]=<into>') and returns the
+// exit code
+func runMerge(spec string) int {
+	fs, ok := store.(*fileStorage)
+	if !ok || logFilePath == "" {
+		fmt.Fprintf(os.Stderr, "-merge needs file storage and -w\n")
+		return 1
+	}
+
+	ss := strings.SplitN(strings.ToLower(spec), "=", 2)
+	if len(ss) != 2 || strings.TrimSpace(ss[1]) == "" {
+		fmt.Fprintf(os.Stderr, "invalid -merge '%s' (expected '<from>,...=<into>')\n", spec)
+		return 1
+	}
+
+	into := strings.TrimSpace(ss[1])
+
+	var from []string
+	for _, sender := range strings.Split(ss[0], ",") {
+		if sender = strings.TrimSpace(sender); sender != "" && sender != into {
+			from = append(from, sender)
+		}
+	}
+
+	if len(from) == 0 {
+		fmt.Fprintf(os.Stderr, "-merge names no sender to merge into '%s'\n", into)
+		return 1
+	}
+
+	n, err := fs.mergeSenders(from, into)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "merging into '%s' failed: %v\n", into, err)
+		return 1
+	}
+
+	fmt.Printf("merged %d entries of %s into '%s'\n", n, strings.Join(from, ", "), into)
+
+	// keep the merged names pointing at the canonical one
+	if aliasFile != "" {
+		aliases, err := newSenderAliases(aliasFile)
+		if err == nil {
+			for _, sender := range from {
+				if err = aliases.set(sender, into); err != nil {
+					break
+				}
+			}
+		}
 
-		logger, err = logg.NewFileLogger("", fmt.Sprintf("%s/logit.log", logFilePath), logg.LOG_LEVEL_DEBUG, maxSize, enableGz)
 		if err != nil {
-			return nil, fmt.Errorf("can't open default log file: %v", err)
+			fmt.Fprintf(os.Stderr, "updating aliases failed: %v\n", err)
+			return 1
 		}
+	}
 
-		fds = append(fds, logger.GetCloser())
+	logg.Flush()
+
+	return 0
+}
+
+// parseRotationPolicy parses -rotate; "" keeps rotation by size only
+func parseRotationPolicy(s string) (logg.RotationPolicy, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s == "hourly":
+		return logg.ROTATE_HOURLY, nil
+	case s == "daily":
+		return logg.ROTATE_DAILY, nil
+	case strings.HasPrefix(s, "cron:"):
+		return logg.ParseCron(strings.TrimPrefix(s, "cron:"))
+	default:
+		return nil, fmt.Errorf("unknown rotation '%s' (expected 'hourly', 'daily' or 'cron:<expression>')", s)
 	}
+}
 
+func makeHandler(logger *logg.Logger) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		defer func() {
 			// just return blank content
 			fmt.Fprintf(rw, "")
 		}()
 
-		// read body
+		logger := logger.WithContext(req.Context()).With("remote", req.RemoteAddr)
+
+		if blankResponses {
+			rw = blankResponse{rw}
+		}
+
+		// requests rejected before they make an entry count as parse drops
+		parse := stageStats.timer("parse")
+		defer parse.end(STAGE_DROPPED)
+
+		// only POST and PUT carry entries; net/http already rejects conflicting
+		// Content-Length headers and drops Content-Length from chunked requests
+		if req.Method != "POST" && req.Method != "PUT" {
+			rw.Header().Set("Allow", "POST, PUT")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] != "chunked" {
+			writeError(rw, ERR_BODY_INVALID, "unsupported transfer encoding '%s'", req.TransferEncoding[0])
+			return
+		}
+
+		// get parameters before reading the body; /echo/<sender>/<level>
+		// only answers the entry made
+		params, code, err := parseEntryRequest(req.URL.EscapedPath(), req.URL.RawQuery)
+		if err != nil {
+			logger.Errorf("wrong request: %v: %v", req.URL.EscapedPath(), err)
+			writeError(rw, code, "%v", err)
+			return
+		}
+
+		sender, logLevel, query := params.sender, params.level, params.query
+		echo := dryRun || params.echo
+
+		// read body, up to -max-body
+		if maxBody > 0 {
+			if req.ContentLength > maxBody {
+				tooLarge(rw, req, logger, maxBody)
+				return
+			}
+
+			req.Body = http.MaxBytesReader(rw, req.Body, maxBody)
+		}
+
+		// compressed bodies inflate to at most an entry's worth
+		limit := maxInflated
+		if maxBody > 0 && maxBody < limit {
+			limit = maxBody
+		}
+
+		if err := inflateBody(req, limit); err != nil {
+			refuseBody(rw, req, logger, err)
+			return
+		}
+
 		b, err := ioutil.ReadAll(req.Body)
+		if e, ok := err.(*http.MaxBytesError); ok {
+			tooLarge(rw, req, logger, e.Limit)
+			return
+		}
 		if err != nil {
 			logger.Errorf("body read failed: %v", err)
+			writeError(rw, ERR_BODY_INVALID, "body read failed: %v", err)
 			return
 		}
 		err = safelyDo(func() {
@@ -84,150 +681,1215 @@ func makeHandler(logFilePath string) (http.HandlerFunc, error) {
 			logger.Warnf("body close failed: %v", err)
 		}
 
+		if strictBodies && !utf8.Valid(b) {
+			logger.Errorf("invalid UTF-8 body: %v", req.URL.EscapedPath())
+			writeError(rw, ERR_BODY_INVALID, "body is not valid UTF-8")
+			return
+		}
+
 		content := string(b)
 
-		// get parameters
-		ss := strings.Split(req.RequestURI, "/")
+		lowerSender := aliases.resolve(strings.ToLower(sender))
+		logger = logger.With("sender", lowerSender)
 
-		if len(ss) < 2 {
-			logger.Errorf("wrong sender: %v / %s", req.RequestURI, content)
+		if !senderAllowed(req, lowerSender) && !senderAllowed(req, strings.ToLower(sender)) {
+			writeError(rw, ERR_FORBIDDEN, "not allowed to write '%s'", lowerSender)
 			return
 		}
 
-		sender := strings.TrimSpace(ss[1])
-
-		if sender == "" {
-			logger.Errorf("wrong sender: %v / %s", req.RequestURI, content)
+		if admission.refused(lowerSender) {
+			writeError(rw, ERR_FORBIDDEN, "unknown sender '%s'", lowerSender)
 			return
 		}
 
-		var logLevel string
+		// clients whose payloads are already compressed may opt out of gzip
+		if gz := query.Get("gz"); gz != "" {
+			on, ok := parseSwitch(gz)
+			if !ok {
+				writeError(rw, ERR_BODY_INVALID, "invalid gz parameter '%s'", gz)
+				return
+			}
 
-		if len(ss) < 3 {
-			logLevel = "debug"
-		} else {
-			logLevel = ss[2]
+			if !echo {
+				gzPrefs.set(lowerSender, on)
+			}
 		}
 
-		// find logger
-		lowerSender := strings.ToLower(sender)
-		senderLogger := loggers[lowerSender]
-		if senderLogger == nil {
-			// create new logger
-			if logFilePath == "" {
-				senderLogger = logg.NewLogger(lowerSender, os.Stdout, logg.LOG_LEVEL_DEBUG)
+		isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
 
-			} else {
-				senderLogger, err = logg.NewFileLogger("", fmt.Sprintf("%s/%s.log", logFilePath, lowerSender), logg.LOG_LEVEL_DEBUG, maxSize, enableGz)
+		// a JSON body may be an entry of its own, level and fields included
+		var be *bulkEntry
+
+		if isJSON {
+			if be, err = envelopeOf(b); err != nil {
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			}
+		}
+
+		var e *entry
+
+		if be != nil {
+			be.defaults(logLevel, req)
+
+			if e, err = be.entry(lowerSender); err != nil {
+				logger.Errorf("invalid entry: %v", err)
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			}
+		} else {
+			retain, err := retainClassOf(query.Get("retain"), b, isJSON)
+			if err != nil {
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			}
+
+			// clients uploading after the fact say when entries happened
+			at, err := eventTimeOf(query.Get("ts"), req.Header.Get(LOG_TIMESTAMP_HEADER), b, isJSON)
+			if err != nil {
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			}
+
+			// retries carrying the id of an entry taken before are dropped
+			id, err := dedupIdOf(req.Header.Get(DEDUP_ID_HEADER))
+			if err != nil {
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			}
+
+			// encrypt sensitive fields of structured entries
+			if encryptor != nil && isJSON {
+				parse.end(STAGE_PASSED)
+
+				encrypt := stageStats.timer("encrypt")
+				b, err = encryptor.encrypt(lowerSender, b)
 				if err != nil {
-					senderLogger = logg.NewLogger(lowerSender, os.Stdout, logg.LOG_LEVEL_DEBUG)
-				} else {
-					fds = append(fds, senderLogger.GetCloser())
+					encrypt.end(STAGE_FAILED)
+					logger.Errorf("field encryption failed: %v", err)
+					writeError(rw, ERR_INTERNAL, "field encryption failed")
+					return
 				}
+
+				encrypt.end(STAGE_PASSED)
+				content = string(b)
 			}
 
-			lock.Lock()
-			loggers[lowerSender] = senderLogger
-			lock.Unlock()
+			// log it
+			e = &entry{
+				sender:   lowerSender,
+				level:    normalizeLevel(logLevel),
+				msg:      content,
+				received: time.Now(),
+				at:       at,
+				retain:   retain,
+				id:       id,
+			}
 		}
 
-		// log it
-		logLevel = strings.TrimSpace(logLevel)
-		logLevel = strings.ToLower(logLevel)
+		// entries logged in a trace carry its ids
+		e.addTrace(req)
 
-		switch logLevel {
-		case "info":
-			senderLogger.Infof("%s", content)
+		// clients of critical entries wait until they are on disk
+		e.waitSync(req)
 
-		case "warn":
-			senderLogger.Warnf("%s", content)
+		parse.end(STAGE_PASSED)
 
-		case "error":
-			senderLogger.Errorf("%s", content)
+		if echo {
+			writeEcho(rw, e)
+			return
+		}
 
-		case "fatal":
-			senderLogger.Fatalf("%s", content)
+		if ok, wait := senderLimits.allow(e); !ok {
+			retryAfter(rw, wait)
+			writeError(rw, ERR_RATE_LIMITED, "sender '%s' is over its rate, retry in %v", lowerSender, wait)
+			return
+		}
 
-		default:
-			senderLogger.Debugf("%s", content)
+		if !quotas.allow(e) {
+			retryAfter(rw, quotaScan)
+			writeError(rw, ERR_QUOTA_EXCEEDED, "sender '%s' is over its disk quota", lowerSender)
+			return
+		}
+
+		if !intake.run(e) {
+			return
 		}
-	}, nil
+
+		if err := deliver(e); err != nil {
+			dedup.forget(e)
+			logger.Errorf("storing entry failed: %v", err)
+			writeError(rw, storeError(err), "storing entry failed")
+			return
+		}
+	}
+}
+
+// tooLarge rejects a body over -max-body, or inflating past limit
+func tooLarge(rw http.ResponseWriter, req *http.Request, logger *logg.Logger, limit int64) {
+	logger.Warnf("body of '%s' over %d bytes, rejected", req.URL.EscapedPath(), limit)
+	writeError(rw, ERR_BODY_TOO_LARGE, "body over %d bytes", limit)
+}
+
+// normalizeLevel maps the level of a request path to one logit stores;
+// anything unknown is debug
+func normalizeLevel(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+
+	switch level {
+	case "trace", "info", "warn", "error", "fatal":
+		return level
+	default:
+		return "debug"
+	}
 }
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		os.Exit(runTailClient(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "ship" {
+		os.Exit(runShip(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecrypt(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulating = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	if configPath != "" {
+		var err error
 
-	var suffix string
+		conf, err = loadConfig(configPath)
+		if err == nil {
+			err = conf.apply()
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if size, err := parseSize(maxSizeStr); err == nil {
+		maxSize = size
+	} else {
+		fmt.Fprintf(os.Stderr, "-s: %v\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Sscanf(maxSizeStr, "%d%s", &maxSize, &suffix)
+	if err := parseCompression(); err != nil {
+		fmt.Fprintf(os.Stderr, "-z-codec: %v\n", err)
+		os.Exit(1)
+	}
 
-	switch suffix {
-	case "k", "K":
-		maxSize *= 1024
+	if size, err := parseSize(maxBodySpec); err == nil && size != 0 {
+		maxBody = size
+	} else {
+		fmt.Fprintf(os.Stderr, "-max-body: invalid size '%s'\n", maxBodySpec)
+		os.Exit(1)
+	}
 
-	case "m", "M":
-		maxSize *= 1024 * 1024
+	if colorMode = logg.ColorModeFrom(colorSpec, -1); colorMode == -1 {
+		fmt.Fprintf(os.Stderr, "-color: invalid mode '%s' (expected auto, always or never)\n", colorSpec)
+		os.Exit(1)
+	}
 
-	case "g", "G":
-		maxSize *= 1024 * 1024 * 1024
+	if size, err := parseSize(maxInflatedSpec); err == nil && size > 0 {
+		maxInflated = size
+	} else {
+		fmt.Fprintf(os.Stderr, "-max-inflated: invalid size '%s'\n", maxInflatedSpec)
+		os.Exit(1)
 	}
 
 	// initialize global variables
 	lock = &sync.Mutex{}
-	loggers = make(map[string]*logg.Logger)
-
-	var err error
+	loggerPaths = make(map[string]string)
+	stats = newStatsCollector()
+	tails = newTailHub()
 
-	// sig handler
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	// stages in the order entries pass them; pipeline stages are added below
+	stageStats = newPipelineMetrics()
+	stageStats.stage("auth")
+	stageStats.stage("parse")
+	stageStats.stage("encrypt")
 
-	go func() {
-		for _ = range c {
-			logg.Flush()
+	intake = newPipeline()
 
-			for _, f := range fds {
-				f.Close()
-			}
+	var err error
 
-			os.Exit(0)
+	if allowSenders != "" || denySenders != "" {
+		if admission, err = newSenderFilter(allowSenders, denySenders, catchAllSender); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
-	}()
 
-	if logFilePath != "" {
-		finfo, err := os.Stat(logFilePath)
+		intake.add("admission", admission.stage)
+	}
+
+	if extractPatterns != "" {
+		extractors, err := loadExtractors(extractPatterns)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "log file path stat failed: %v\n", err)
+			fmt.Fprintf(os.Stderr, "extract patterns loading failed: %v\n", err)
 			os.Exit(1)
 		}
 
-		if !finfo.IsDir() {
-			fmt.Fprintf(os.Stderr, "log file path must be directory")
-			os.Exit(1)
-		}
+		intake.add("extract", newExtractStage(extractors))
+	}
 
-		logFilePath, err = filepath.Abs(logFilePath)
+	customRedactions, err := loadRedactRules(redactRules)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "redaction rules loading failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if policy, err := newRedactPolicy(redactSpec, conf.senderSpec("redact", redactSenders), customRedactions); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -redact or -redact-senders: %v\n", err)
+		os.Exit(1)
+	} else if policy.enabled() || redactRules != "" {
+		redaction = policy
+		intake.add("redact", redaction.stage)
+	}
+
+	if policy, err := newTransformPolicy(transformSpec, conf.senderSpec("transform", transformSenders)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -transform or -transform-senders: %v\n", err)
+		os.Exit(1)
+	} else if policy.enabled() {
+		transforms = policy
+		intake.add("transform", transforms.stage)
+	}
+
+	if tlsCert != "" || tlsKey != "" {
+		serverTLS, err = newServerTLSConfig(tlsCert, tlsKey, tlsClientCA, tlsRequireClientCert)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "log file path converting failed: %v\n", err)
+			fmt.Fprintf(os.Stderr, "TLS initialization failed: %v\n", err)
 			os.Exit(1)
 		}
+	} else if tlsClientCA != "" || tlsRequireClientCert {
+		fmt.Fprintf(os.Stderr, "client certificates need -tls-cert and -tls-key\n")
+		os.Exit(1)
 	}
 
-	handler, err := makeHandler(logFilePath)
+	outbound, err = outboundTransport()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "log file handler initialization failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "outbound TLS initialization failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	http.HandleFunc("/", handler)
+	// a simulation only tells what would be shadowed
+	var shadowPercents map[string]float64
 
-	fmt.Printf("logit server starting at port '%d'\n", listenPort)
+	if shadowUrl != "" && simulating {
+		shadowPercents, err = parseShadowSpec(shadowSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shadow forwarder initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	} else if shadowUrl != "" {
+		shadow, err = newShadowForwarder(shadowUrl, shadowSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shadow forwarder initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	if logFilePath != "" {
-		fmt.Printf("log file path: %s\n", logFilePath)
-		fmt.Printf("log file max size: %d\n", maxSize)
-		fmt.Printf("enable gzip: %v\n", enableGz)
+	if kafkaBrokers != "" && !simulating {
+		producer, err := newKafkaProducer(kafkaBrokers, kafkaTopic, kafkaClientId, kafkaAcks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kafka sink initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		batchSinks = append(batchSinks, newBatchSink("kafka", producer))
+	}
+
+	if forwardTo != "" && !simulating {
+		if forwardToken == "" {
+			forwardToken = os.Getenv("LOGIT_FORWARD_TOKEN")
+		}
+
+		f, err := newForwarder(forwardTo, forwardFormat, forwardToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "forwarder initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		batchSinks = append(batchSinks, newBatchSink("forward", f))
+	}
+
+	if gelfTo != "" && !simulating {
+		g, err := newGelfSender(gelfTo, gelfCompress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gelf sink initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		batchSinks = append(batchSinks, newBatchSink("gelf", g))
+	}
+
+	if syslogTo != "" && !simulating {
+		s, err := newSyslogForwarder(syslogTo, syslogFormat, syslogFacility)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "syslog sink initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		batchSinks = append(batchSinks, newBatchSink("syslog", s))
+	}
+
+	if esURL != "" && !simulating {
+		if esUser == "" {
+			esUser = os.Getenv("LOGIT_ES_USER")
+		}
+		if esAPIKey == "" {
+			esAPIKey = os.Getenv("LOGIT_ES_API_KEY")
+		}
+
+		ix, err := newESIndexer(esURL, esIndex, esUser, esAPIKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "elasticsearch sink initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		batchSinks = append(batchSinks, newBatchSink("elasticsearch", ix))
+	}
+
+	if encryptRotated || encryptRotatedKey != "" {
+		sealer, err = newRotatedCipher(encryptRotatedKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rotated file encryption initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if archiveTo != "" && !simulating {
+		if logFilePath == "" {
+			fmt.Fprintf(os.Stderr, "-archive-to requires -w\n")
+			os.Exit(1)
+		}
+
+		if archiveRegion == "" {
+			archiveRegion = os.Getenv("AWS_REGION")
+		}
+		if archiveRegion == "" {
+			archiveRegion = "us-east-1"
+		}
+
+		archive, err = newArchiver(archiveTo, archiveEndpoint, archiveRegion, logFilePath, archiveDelete)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "archive initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if searchIndexed && !simulating {
+		if logFilePath == "" {
+			fmt.Fprintf(os.Stderr, "-search-index requires -w\n")
+			os.Exit(1)
+		}
+
+		searcher = newSearchIndex(logFilePath)
+	}
+
+	if encryptFields != "" {
+		if encryptKeyDir == "" {
+			fmt.Fprintf(os.Stderr, "-encrypt-fields requires -encrypt-key-dir\n")
+			os.Exit(1)
+		}
+
+		encryptor, err = newFieldEncryptor(encryptFields, encryptKeyDir, encryptTenant && !simulating)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "field encryptor initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	gzPrefs, err = newGzipPrefs(conf.senderSpec("gzip", gzSenders))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	switch outputFormat {
+	case "text", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format '%s' (expected 'text' or 'json')\n", outputFormat)
+		os.Exit(1)
+	}
+
+	if err := parseLineTime(timeFormat, timeZone); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if err := parseLineLayout(layoutSpec); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if err := parseMultiline(multilineSpec, multilineIndent); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	switch consoleSpec {
+	case "off", "server", "all":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown console mode '%s' (expected 'off', 'server' or 'all')\n", consoleSpec)
+		os.Exit(1)
+	}
+
+	switch selfTest {
+	case "off", "warn", "strict":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown self-test mode '%s' (expected 'off', 'warn' or 'strict')\n", selfTest)
+		os.Exit(1)
+	}
+
+	syncPrefs, err = newDurabilityPolicy(syncLevel, conf.senderSpec("sync", syncSenders))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	noisePrefs, err = newNoisePolicy(sampleRateSpec, conf.senderSpec("sample", sampleSenders), repeatWindow, conf.senderSpec("repeats", repeatSenders))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if size, err := parseSize(writeBufferSpec); err == nil && size >= 0 {
+		writeBuffer = int(size)
+	} else {
+		fmt.Fprintf(os.Stderr, "-write-buffer: invalid size '%s'\n", writeBufferSpec)
+		os.Exit(1)
+	}
+
+	if fileOptions, err = parseFileOptions(fileModeSpec, dirModeSpec, fileOwnerSpec); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	overflowPolicy = logg.OverflowPolicyFrom(overflowSpec, -1)
+	if overflowPolicy < 0 {
+		fmt.Fprintf(os.Stderr, "unknown overflow policy '%s' (expected block, drop-newest or drop-oldest)\n", overflowSpec)
+		os.Exit(1)
+	}
+
+	shedder, err = newLoadShedder(shedQueue, shedLatency)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	levelPrefs, err = newLevelPolicy(conf.senderSpec("level", senderLevels))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	rotationPolicy, err = parseRotationPolicy(rotateSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if rotateMethod = logg.RotateMethodFrom(rotateMethodSpec, -1); rotateMethodSpec == "" {
+		rotateMethod = logg.DEFAULT_ROTATE_METHOD
+	} else if rotateMethod == -1 {
+		fmt.Fprintf(os.Stderr, "-rotate-method: invalid method '%s' (expected rename or copytruncate)\n", rotateMethodSpec)
+		os.Exit(1)
+	}
+
+	lateMode, err = parseLateMode(lateMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -late: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, field := range strings.Split(timeFieldSpec, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			timeFields = append(timeFields, field)
+		}
+	}
+
+	traceIdField, spanIdField, err = parseTraceFields(traceFieldSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -trace-fields: %v\n", err)
+		os.Exit(1)
+	}
+
+	socketMode, err := parseSocketMode(unixSocketMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -unix-socket-mode: %v\n", err)
+		os.Exit(1)
+	}
+
+	retainClasses, err = parseRetainClasses(retainSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -retain-classes: %v\n", err)
+		os.Exit(1)
+	}
+
+	if maxBackups < 0 || maxAgeDays < 0 {
+		fmt.Fprintf(os.Stderr, "-max-backups and -max-age-days must not be negative\n")
+		os.Exit(1)
+	}
+
+	// sig handler
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		shutdown(shutdownTimeout)
+	}()
+
+	if logFilePath != "" && !simulating {
+		finfo, err := os.Stat(logFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log file path stat failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !finfo.IsDir() {
+			fmt.Fprintf(os.Stderr, "log file path must be directory")
+			os.Exit(1)
+		}
+	}
+
+	if logFilePath != "" {
+		logFilePath, err = filepath.Abs(logFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log file path converting failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if spillDir != "" {
+		if logFilePath == "" {
+			fmt.Fprintf(os.Stderr, "-spill-dir requires -w\n")
+			os.Exit(1)
+		}
+
+		if err := os.MkdirAll(spillDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "can't make -spill-dir: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if logFilePath != "" {
+		namer, err = newFileNamer(logFilePath, fileTemplate, rotatedTemplate, fileTemplateFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "file name templates loading failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		conf.applyTemplates(namer)
+	}
+
+	if simulating {
+		// nothing of a simulation reaches the log directory
+		serverLogger = logg.NewLogger("logit", os.Stderr, logg.LOG_LEVEL_DEBUG)
+		serverLogger.SetColor(colorMode)
+		storageKind = "memory"
+	} else {
+		serverLogger, err = newServerLogger(logFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log file handler initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if spillDir != "" {
+		go watchSpills(serverLogger)
+	}
+
+	if accessLog != "" && !simulating {
+		accessLogger, err = newAccessLogger(logFilePath, accessLog, accessLogSize, accessLogRotate, accessLogBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	logg.SetCompressErrorHandler(func(path string, err error) {
+		serverLogger.Errorf("compressing rotated file '%s' failed, left uncompressed: %v", path, err)
+	})
+
+	// what packages write with the standard logger goes to logit's own log
+	log.SetFlags(0)
+	log.SetOutput(serverLogger.Writer(logg.LOG_LEVEL_INFO))
+
+	store, err = newStorage(storageKind, logFilePath, serverLogger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "storage initialization failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if mergeSpec != "" && !simulating {
+		os.Exit(runMerge(mergeSpec))
+	}
+
+	if ds, ok := store.(*dbStorage); ok {
+		go ds.run(DB_PRUNE_EVERY)
+	}
+
+	if aliasFile != "" {
+		aliases, err = newSenderAliases(aliasFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aliases loading failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// pick up where the previous run stopped
+	if fs, ok := store.(*fileStorage); ok && logFilePath != "" && !simulating {
+		serverLogger.Infof("log directory recovered: %s", fs.recover())
+
+		// open files now rather than at the first entry, failing at boot
+		if errs := fs.warmUpSenders(warmUpSenders); len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "warm-up failed: %v\n", err)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if alertUrl != "" {
+		policy, err := newAlertPolicy(alertLevel, conf.senderSpec("alert", alertSenders))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		if alerts, err = newAlerter(alertUrl, policy, alertBatch, alertRate, serverLogger); err != nil {
+			fmt.Fprintf(os.Stderr, "alerter initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		alerts.hook(serverLogger, logg.LOG_LEVEL_ERROR)
+	}
+
+	if anomalyEnabled {
+		detector = newAnomalyDetector(anomalyThreshold, anomalyMinCount, func(a anomaly) {
+			serverLogger.Warnf("anomaly: %s", a)
+
+			if alerts != nil {
+				alerts.push(alertEntry{time: time.Now(), sender: a.Sender, level: "warn", msg: "anomaly: " + a.String()})
+			}
+		})
+	}
+
+	if dedupStoreSpec != "" {
+		store, err := newDedupStore(dedupStoreSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		policy, err := newDedupPolicy(dedupLimits{dedupSize, dedupTTL}, conf.senderSpec("dedup", dedupSenders))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -dedup-senders: %v\n", err)
+			os.Exit(1)
+		}
+
+		dedup = &deduplicator{store: store, policy: policy, logger: serverLogger}
+		intake.add("dedup", dedup.stage)
+	}
+
+	defRate, err := parseSenderRate(senderRateSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -sender-rate: %v\n", err)
+		os.Exit(1)
+	}
+
+	senderLimits, err = newSenderLimiter(defRate, conf.senderSpec("rate", senderRates))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -sender-rates: %v\n", err)
+		os.Exit(1)
+	}
+
+	go senderLimits.run()
+
+	if policy, err := newQuotaPolicy(quotaSpec, quotaTotal, conf.senderSpec("quota", quotaSenders)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -quota, -quota-total or -quota-senders: %v\n", err)
+		os.Exit(1)
+	} else if policy.enabled() && !simulating {
+		fs, ok := store.(*fileStorage)
+		if !ok || logFilePath == "" {
+			fmt.Fprintf(os.Stderr, "-quota and -quota-total need file storage and -w\n")
+			os.Exit(1)
+		}
+
+		if quotaScan <= 0 {
+			fmt.Fprintf(os.Stderr, "-quota-scan must be positive\n")
+			os.Exit(1)
+		}
+
+		quotas = policy
+		intake.add("quota", quotas.stage)
+
+		go quotas.run(fs, quotaScan)
+	}
+
+	if quarantineRate > 0 || quarantineSize > 0 || quarantineEntropy > 0 {
+		q := newQuarantine(quarantineRate, quarantineSize, quarantineEntropy, quarantineSample, quarantineDuration, func(sender, reason string) {
+			serverLogger.Errorf("quarantined sender '%s' for %v: suspicious %s", sender, quarantineDuration, reason)
+		})
+
+		intake.add("quarantine", q.stage)
+	}
+
+	if coalesceWindow > 0 || coalesceSenders != "" {
+		perSender, err := parseDurationSpec(coalesceSenders)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -coalesce-senders: %v\n", err)
+			os.Exit(1)
+		}
+
+		c := newCoalescer(coalesceWindow, perSender.all(), coalesceLevel, func(e *entry) {
+			if err := deliver(e); err != nil {
+				serverLogger.Errorf("storing repeat summary of '%s' failed: %v", e.sender, err)
+			}
+		})
+
+		intake.add("coalesce", c.stage)
+	}
+
+	stageStats.stage("write")
+	stageStats.stage("forward")
+
+	if simulating {
+		os.Exit(runSimulation(simulateEvents, shadowPercents))
+	}
+
+	authConf := authConfig{
+		jwtSecretFile: authJwtSecret,
+		apiKeyFile:    authApiKeys,
+		allowNets:     authAllow,
+		tokenFile:     authTokens,
+		tokenSpec:     authTokenList,
+	}
+
+	if conf != nil {
+		authConf.tokens = conf.tokens
+	}
+
+	clientAuth, err := newAuthChain(authSpec, authConf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -auth: %v\n", err)
+		os.Exit(1)
+	}
+
+	peerAuth, err := newAuthChain(authPeerSpec, authConf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -auth-peers: %v\n", err)
+		os.Exit(1)
+	}
+
+	adminOwn := authAdminSpec != ""
+	if !adminOwn {
+		authAdminSpec = authSpec
+	}
+
+	adminAuth, err := newAuthChain(authAdminSpec, authConf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -auth-admin: %v\n", err)
+		os.Exit(1)
+	}
+
+	// decrypting fields takes admins of their own, not whoever may post
+	var decryptAuth *authChain
+	if adminOwn {
+		decryptAuth = adminAuth
+	}
+
+	var audit *auditLog
+
+	if auditLogName != "off" && logFilePath != "" && !simulating {
+		auditKey, err := loadAuditKey(auditKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit key loading failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		switch {
+		case auditKey == nil && auditLogName != "":
+			fmt.Fprintf(os.Stderr, "-audit-log requires -audit-key or $LOGIT_AUDIT_KEY\n")
+			os.Exit(1)
+		case auditKey == nil:
+			serverLogger.Warnf("admin actions aren't recorded: no -audit-key or $LOGIT_AUDIT_KEY for the audit log")
+		default:
+			name := auditLogName
+			if name == "" {
+				name = "audit.log"
+			}
+
+			audit, err = openAuditLog(logFilePath, name, auditKey)
+			if audit == nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+
+			if err != nil {
+				serverLogger.Errorf("%v", err)
+			}
+
+			// what the head is now, to tell a later rollback by
+			serverLogger.Infof("audit log '%s' at record %d (%s)", name, audit.seq, audit.last)
+
+			fds = append(fds, audit)
+		}
+	}
+
+	var limiter *rateLimiter
+
+	if rateLimits != "" {
+		limiter, err = newRateLimiter(rateLimits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rate limits loading failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if replicateTo != "" || acceptReplicas {
+		if logFilePath == "" {
+			fmt.Fprintf(os.Stderr, "replication requires -w to persist its state\n")
+			os.Exit(1)
+		}
+
+		if nodeId == "" {
+			nodeId, _ = os.Hostname()
+		}
+	}
+
+	if replicateTo != "" {
+		replicators, err = newReplicators(logFilePath, replicateTo, nodeId, serverLogger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replication initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if acceptReplicas {
+		r, err := newReplica(logFilePath, serverLogger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replica initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		http.Handle("/replicate", peerAuth.wrap(limiter.wrap("/replicate", r)))
+	}
+
+	handler := makeHandler(serverLogger)
+
+	if syslogUDP != "" || syslogTCP != "" {
+		l, err := newSyslogListener(syslogSender, serverLogger)
+		if err == nil && syslogUDP != "" {
+			err = l.listenUDP(syslogUDP)
+		}
+
+		if err == nil && syslogTCP != "" {
+			err = l.listenTCP(syslogTCP)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "syslog listener initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if grpcPort != 0 {
+		grpc := clientAuth.wrapStage("auth", limiter.wrap(GRPC_SERVICE, shedder.wrap(GRPC_SERVICE, &grpcServer{serverLogger})))
+
+		if err := listenGRPC(grpcPort, grpc, serverLogger); err != nil {
+			fmt.Fprintf(os.Stderr, "grpc server initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if udpPort != 0 {
+		if err := listenPlainUDP(udpPort, serverLogger); err != nil {
+			fmt.Fprintf(os.Stderr, "udp listener initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if watchdogInterval > 0 {
+		dog := newWatchdog(watchdogInterval, watchdogRestart, serverLogger)
+
+		dog.watch("logger actors", logg.Processed, func() int {
+			n, _ := logg.QueueLen()
+			return n
+		}, nil)
+
+		if shadow != nil {
+			dog.watch("shadow forwarder", shadow.progress, shadow.pending, shadow.restart)
+		}
+
+		for _, s := range batchSinks {
+			dog.watch(s.name+" sink", s.progress, s.pending, nil)
+		}
+
+		dog.start()
+
+		// per-sender names and queues are for operators, like /metrics
+		http.Handle("/health", adminAuth.wrap(limiter.wrap("/health", makeHealthHandler(dog))))
+	}
+
+	// outbound destinations that can be held for maintenance of the far side
+	sinks := make(map[string]pausable)
+
+	if shadow != nil {
+		if logFilePath != "" {
+			if err := shadow.enablePause(logFilePath); err != nil {
+				fmt.Fprintf(os.Stderr, "shadow spool initialization failed: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		sinks["shadow"] = shadow
+	}
+
+	for _, r := range replicators {
+		sinks[r.name] = r
+	}
+
+	if archive != nil {
+		sinks["archive"] = archive
+		archive.start()
+
+		http.Handle("/admin/archive", adminAuth.wrap(limiter.wrap("/admin/archive", audit.wrap(nil, makeArchiveAdminHandler(archive)))))
+	}
+
+	for _, s := range batchSinks {
+		if logFilePath != "" {
+			if err := s.enablePause(logFilePath); err != nil {
+				fmt.Fprintf(os.Stderr, "%s spool initialization failed: %v\n", s.name, err)
+				os.Exit(1)
+			}
+		}
+
+		sinks[s.name] = s
+	}
+
+	if selfTest != "off" && !simulating {
+		probed := make(map[string]prober)
+		for name, sink := range sinks {
+			if p, ok := sink.(prober); ok {
+				probed[name] = p
+			}
+		}
+
+		if dedup != nil {
+			if p, ok := dedup.store.(prober); ok {
+				probed["dedup store"] = p
+			}
+		}
+
+		dir := ""
+		if _, ok := store.(*fileStorage); ok {
+			dir = logFilePath
+		}
+
+		if failed := runSelfTest(dir, probed, serverLogger); failed > 0 && selfTest == "strict" {
+			fmt.Fprintf(os.Stderr, "self-test: %d checks failed, not starting (-self-test=strict)\n", failed)
+			logg.Flush()
+			os.Exit(1)
+		}
+	}
+
+	sinkState := func(req *http.Request) interface{} {
+		if sink, ok := sinks[auditPathPart(req, "/admin/sinks", 0)]; ok {
+			return sink.status()
+		}
+		return nil
+	}
+
+	sinkAdmin := adminAuth.wrap(limiter.wrap("/admin/sinks", audit.wrap(sinkState, makeSinkAdminHandler(sinks))))
+
+	http.Handle("/admin/sinks", sinkAdmin)
+	http.Handle("/admin/sinks/", sinkAdmin)
+
+	http.Handle("/metrics", adminAuth.wrap(limiter.wrap("/metrics", makeMetricsHandler(sinks))))
+	http.Handle("/admin/dump", adminAuth.wrap(limiter.wrap("/admin/dump", audit.wrap(nil, makeDumpAdminHandler(sinks)))))
+
+	senderState := func(req *http.Request) interface{} {
+		if sender := auditPathPart(req, "/admin/senders", 0); sender != "" {
+			return settingsOf(sender, levelPrefs)
+		}
+		return nil
+	}
+
+	senderAdmin := adminAuth.wrap(limiter.wrap("/admin/senders", audit.wrap(senderState, makeSenderAdminHandler(levelPrefs))))
+
+	http.Handle("/admin/senders", senderAdmin)
+	http.Handle("/admin/senders/", senderAdmin)
+
+	// SIGQUIT dumps diagnostics instead of killing the process; the result
+	// goes to stderr since the logger may be what is stuck
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+
+	go func() {
+		for range quit {
+			if path, err := writeDump(sinks); err != nil {
+				fmt.Fprintf(os.Stderr, "writing diagnostic dump failed: %v\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "diagnostic dump written to %s\n", path)
+			}
+		}
+	}()
+
+	// SIGHUP reloads the config file and tokens
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			r, err := reloadConfig()
+			logReload(serverLogger, r, err)
+		}
+	}()
+
+	// SIGUSR1 reopens the log files, after logrotate or the like moved them
+	usr1 := make(chan os.Signal, 1)
+	notifyReopen(usr1)
+
+	go func() {
+		for range usr1 {
+			if err := logg.ReopenFiles(); err != nil {
+				serverLogger.Errorf("reopening log files failed: %v", err)
+			} else {
+				serverLogger.Infof("log files reopened")
+			}
+		}
+	}()
+
+	http.Handle("/admin/reload", adminAuth.wrap(limiter.wrap("/admin/reload", audit.wrap(nil, makeReloadAdminHandler(serverLogger)))))
+
+	// the level of logit's own log, GET or PUT as in logg.LevelHandler
+	levelState := func(req *http.Request) interface{} { return levelName(serverLogger.Level()) }
+
+	http.Handle("/admin/level", adminAuth.wrap(limiter.wrap("/admin/level", audit.wrap(levelState, logg.LevelHandler(serverLogger)))))
+	http.Handle("/admin/pipeline", adminAuth.wrap(limiter.wrap("/admin/pipeline", audit.wrap(nil, makePipelineAdminHandler(stageStats)))))
+
+	if quotas != nil {
+		http.Handle("/admin/quota", adminAuth.wrap(limiter.wrap("/admin/quota", audit.wrap(nil, makeQuotaAdminHandler(quotas)))))
+	}
+
+	if aliases != nil {
+		aliasState := func(req *http.Request) interface{} { return aliases.snapshot() }
+
+		aliasAdmin := adminAuth.wrap(limiter.wrap("/admin/aliases", audit.wrap(aliasState, makeAliasAdminHandler(aliases))))
+
+		http.Handle("/admin/aliases", aliasAdmin)
+		http.Handle("/admin/aliases/", aliasAdmin)
+	}
+
+	if encryptor != nil {
+		// asking for the key of a tenant may make one, so the state is left out
+		http.Handle("/admin/keys/", adminAuth.wrap(limiter.wrap("/admin/keys", audit.wrap(nil, makeKeyAdminHandler(encryptor)))))
+	}
+	http.Handle("/", clientAuth.wrapStage("auth", limiter.wrap("/", shedder.wrap("/", handler))))
+	http.Handle("/echo/", clientAuth.wrapStage("auth", limiter.wrap("/echo", handler)))
+	http.Handle("/bulk/", clientAuth.wrapStage("auth", limiter.wrap("/bulk", shedder.wrap("/bulk", makeBulkHandler(serverLogger)))))
+	http.Handle("/stats/aggregate", clientAuth.wrap(limiter.wrap("/stats/aggregate", makeAggregateHandler(stats))))
+	http.Handle("/logs/", clientAuth.wrap(limiter.wrap("/logs", makeLogsHandler(decryptAuth))))
+	http.Handle("/search", clientAuth.wrap(limiter.wrap("/search", makeSearchHandler())))
+	http.Handle("/tail/", clientAuth.wrap(limiter.wrap("/tail", makeTailHandler(tails))))
+	http.Handle("/ping", limiter.wrap("/ping", http.HandlerFunc(pingHandler)))
+
+	fmt.Printf("logit server starting at port '%d'\n", listenPort)
+
+	if logFilePath != "" {
+		fmt.Printf("log file path: %s\n", logFilePath)
+		fmt.Printf("log file max size: %d\n", maxSize)
+		fmt.Printf("enable gzip: %v\n", enableGz)
+
+		if enableGz {
+			fmt.Printf("compressed with: %s\n", compressCodec)
+		}
+	}
+
+	if shadow != nil {
+		fmt.Printf("shadow traffic to: %s (%s)\n", shadowUrl, shadowSpec)
+	}
+
+	if alerts != nil {
+		fmt.Printf("alerting at: %s (%s and above)\n", alertUrl, alertLevel)
+	}
+
+	if len(replicators) > 0 {
+		fmt.Printf("replicating to: %s (as '%s')\n", replicateTo, nodeId)
+	}
+
+	if archive != nil {
+		fmt.Printf("archiving rotated files to: %s (delete locally: %v)\n", archiveTo, archiveDelete)
+	}
+
+	if searcher != nil {
+		fmt.Printf("indexing rotated files for search at: %s\n", filepath.Join(logFilePath, SEARCH_INDEX_DIR))
+	}
+
+	if syslogUDP != "" || syslogTCP != "" {
+		fmt.Printf("syslog on: udp '%s', tcp '%s' (sender by %s)\n", syslogUDP, syslogTCP, syslogSender)
+	}
+
+	if grpcPort != 0 {
+		fmt.Printf("grpc on port: %d\n", grpcPort)
+	}
+
+	if udpPort != 0 {
+		fmt.Printf("plaintext udp on port: %d\n", udpPort)
+	}
+
+	if serverTLS != nil {
+		fmt.Printf("tls: enabled (client certificates: %s)\n", map[tls.ClientAuthType]string{
+			tls.NoClientCert:               "not asked",
+			tls.VerifyClientCertIfGiven:    "verified if given",
+			tls.RequireAndVerifyClientCert: "required",
+		}[serverTLS.ClientAuth])
+	}
+
+	serverHandler := logAccess(recoverPanics(http.DefaultServeMux, serverLogger), accessLogger)
+
+	if unixSocket != "" {
+		if err := serveUnix(unixSocket, socketMode, serverHandler); err != nil {
+			fmt.Fprintf(os.Stderr, "unix socket listener initialization failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("unix socket: %s (mode %s)\n", unixSocket, unixSocketMode)
+	}
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", listenPort),
+		Handler:   serverHandler,
+		TLSConfig: serverTLS,
+		ErrorLog:  httpErrorLog(serverLogger),
+	}
+	addServer(server)
+
+	if serverTLS != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		// shutdown exits once done
+		select {}
 	}
 
-	http.ListenAndServe(fmt.Sprintf(":%d", listenPort), nil)
+	fmt.Fprintf(os.Stderr, "server failed: %v\n", err)
+	os.Exit(1)
 }
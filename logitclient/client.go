@@ -0,0 +1,438 @@
+// Package logitclient sends log entries to a logit server through its
+// POST /bulk/<sender> API, batching them in the background and retrying
+// what the server may take later.
+//
+//	c, err := logitclient.New("http://logs:8070", logitclient.Options{Token: "..."})
+//	...
+//	c.Log("billing", "warn", "card declined")
+//	defer c.Close(context.Background())
+package logitclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_BATCH_SIZE     = 100
+	DEFAULT_FLUSH_INTERVAL = time.Second
+	DEFAULT_QUEUE_SIZE     = 10000
+	DEFAULT_MAX_RETRIES    = 5
+	DEFAULT_TIMEOUT        = 30 * time.Second
+	DEFAULT_MAX_SKEW       = 2 * time.Second
+
+	RETRY_MIN = 200 * time.Millisecond // the first wait, doubled each retry
+	RETRY_MAX = 30 * time.Second
+)
+
+var (
+	ErrClosed    = errors.New("logitclient: client is closed")
+	ErrQueueFull = errors.New("logitclient: queue is full")
+)
+
+// Entry is one log entry; a zero Time is the time it is logged at
+type Entry struct {
+	Level  string
+	Msg    string
+	Fields map[string]interface{}
+	Time   time.Time
+	Retain string // retention class, see the server's -retain
+	Id     string // what a server with -dedup drops repeats by; "" gets a new one
+}
+
+// Options tune a Client; zero values take the defaults
+type Options struct {
+	Token string // sent as 'Authorization: Bearer <token>'
+
+	BatchSize     int           // most entries of a request, lowered by Ping while the server is busy
+	FlushInterval time.Duration // longest an entry waits in the queue
+	QueueSize     int           // entries queued at most; Log fails beyond
+	MaxRetries    int           // retries of a request; < 0: none
+	MaxSkew       time.Duration // clock skew to the server past which Ping warns; < 0: never
+
+	HTTPClient *http.Client // DEFAULT_TIMEOUT and the default transport if nil
+
+	// OnError is told of entries lost in the background: a batch refused
+	// or out of retries, or entries the server rejected. it is called from
+	// the client's goroutine, so it must not block.
+	OnError func(err error)
+}
+
+// Error is a refusal of the server, as its JSON error body gives it
+type Error struct {
+	Status    int
+	Code      string // e.g. RATE_LIMITED, see the server's errors.go
+	Message   string
+	Retryable bool
+
+	retryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("logitclient: server answers %d: %s", e.Status, e.Message)
+	}
+
+	return fmt.Sprintf("logitclient: server answers %d (%s): %s", e.Status, e.Code, e.Message)
+}
+
+// SkewError is Ping's warning that this host's clock is off the server's,
+// so the times of entries are too
+type SkewError struct {
+	Skew    time.Duration // this host's clock minus the server's
+	MaxSkew time.Duration
+}
+
+func (e *SkewError) Error() string {
+	return fmt.Sprintf("logitclient: clock %v off the server's, past %v; entry times are skewed", e.Skew, e.MaxSkew)
+}
+
+// Rejection is an entry of a request the server didn't take, e.g. invalid
+type Rejection struct {
+	Index   int    `json:"index"` // in the request
+	Message string `json:"message"`
+}
+
+// RejectedError tells of the entries of a request the server rejected; it
+// took the others
+type RejectedError struct {
+	Sender   string
+	Rejected []Rejection
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("logitclient: %d entries of '%s' rejected, the first: %s", len(e.Rejected), e.Sender, e.Rejected[0].Message)
+}
+
+// Client sends entries to a logit server; it is safe for concurrent use
+type Client struct {
+	url  string
+	opts Options
+
+	queue   chan queued
+	flushes chan chan struct{}
+	done    chan struct{}
+
+	lock   *sync.RWMutex // held for reading while queuing, writing to close
+	closed bool
+
+	dropped int64
+	batch   int64 // BatchSize as the server's backpressure has it, see Ping
+}
+
+// Pong is the server's answer to Ping
+type Pong struct {
+	ServerTime   time.Time
+	Skew         time.Duration // this host's clock minus the server's
+	Protocols    []string      // intake protocol versions
+	Backpressure string        // ok | busy | overloaded
+	BatchSize    int           // entries of a request the server asks for
+}
+
+type pingResponse struct {
+	ServerTime   time.Time `json:"server_time"`
+	SkewMillis   *int64    `json:"skew_ms"`
+	Protocols    []string  `json:"protocols"`
+	Backpressure string    `json:"backpressure"`
+	BatchSize    int       `json:"batch_size"`
+}
+
+// New returns a client of the logit server at url (e.g. 'http://host:8070')
+// and starts its goroutine; Close stops it
+func New(serverURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("logitclient: invalid server url '%s' (expected http:// or https://)", serverURL)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DEFAULT_MAX_RETRIES
+	}
+	if opts.MaxSkew == 0 {
+		opts.MaxSkew = DEFAULT_MAX_SKEW
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+
+	c := &Client{
+		url:     strings.TrimRight(serverURL, "/"),
+		opts:    opts,
+		queue:   make(chan queued, opts.QueueSize),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+		lock:    &sync.RWMutex{},
+		batch:   int64(opts.BatchSize),
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+// Send posts entries of sender right away and waits for the answer,
+// retrying like the queue does until ctx ends; a *RejectedError tells of
+// entries the server didn't take
+func (c *Client) Send(ctx context.Context, sender string, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	batch := make([]Entry, len(entries))
+	for i, e := range entries {
+		batch[i] = prepared(e)
+	}
+
+	return c.sendRetrying(ctx, sender, batch)
+}
+
+// Ping checks that the server answers and tells it this host's clock. the
+// batches sent from then on are no bigger than the server asks for, so a
+// client that pings now and then backs off while the server is busy. a
+// clock further off the server's than MaxSkew is told by a *SkewError,
+// returned with the pong.
+func (c *Client) Ping(ctx context.Context) (*Pong, error) {
+	req, err := http.NewRequest("GET", c.url+"/ping", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := time.Now()
+	req.Header.Set("X-Client-Time", strconv.FormatInt(sent.UnixNano()/int64(time.Millisecond), 10))
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+
+	resp, err := c.opts.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, errorOf(resp)
+	}
+
+	var pr pingResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&pr); err != nil {
+		return nil, fmt.Errorf("logitclient: invalid ping answer: %v", err)
+	}
+
+	pong := &Pong{
+		ServerTime:   pr.ServerTime,
+		Protocols:    pr.Protocols,
+		Backpressure: pr.Backpressure,
+		BatchSize:    pr.BatchSize,
+	}
+
+	if pr.SkewMillis != nil {
+		pong.Skew = time.Duration(*pr.SkewMillis) * time.Millisecond
+	} else if !pr.ServerTime.IsZero() {
+		// the server read its clock halfway through, give or take
+		pong.Skew = sent.Add(time.Since(sent) / 2).Sub(pr.ServerTime)
+	}
+
+	if pr.BatchSize > 0 {
+		n := c.opts.BatchSize
+		if pr.BatchSize < n {
+			n = pr.BatchSize
+		}
+
+		atomic.StoreInt64(&c.batch, int64(n))
+	}
+
+	if skew := pong.Skew; c.opts.MaxSkew > 0 && (skew > c.opts.MaxSkew || skew < -c.opts.MaxSkew) {
+		return pong, &SkewError{Skew: skew, MaxSkew: c.opts.MaxSkew}
+	}
+
+	return pong, nil
+}
+
+// batchSize is the most entries of a request
+func (c *Client) batchSize() int {
+	return int(atomic.LoadInt64(&c.batch))
+}
+
+// Dropped returns how many entries were lost: queued past a full queue,
+// refused by the server or out of retries
+func (c *Client) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// prepared fills what an entry left out
+func prepared(e Entry) Entry {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if e.Id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		e.Id = hex.EncodeToString(b)
+	}
+
+	return e
+}
+
+// sendRetrying posts batch, waiting between tries by RETRY_MIN doubled or
+// the server's Retry-After
+func (c *Client) sendRetrying(ctx context.Context, sender string, batch []Entry) error {
+	body, err := encode(batch)
+	if err != nil {
+		return err
+	}
+
+	wait := RETRY_MIN
+
+	for try := 0; ; try++ {
+		err := c.post(ctx, sender, body)
+		if err == nil || !retryable(err) || try >= c.opts.MaxRetries {
+			return err
+		}
+
+		d := wait
+		if e, ok := err.(*Error); ok && e.retryAfter > 0 {
+			d = e.retryAfter
+		}
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+
+		if wait *= 2; wait > RETRY_MAX {
+			wait = RETRY_MAX
+		}
+	}
+}
+
+// retryable tells whether posting the same batch later may succeed: network
+// errors do, and refusals the server calls retryable
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		return e.Retryable
+	case *RejectedError:
+		return false
+	default:
+		return true
+	}
+}
+
+type bulkEntry struct {
+	Level  string                 `json:"level,omitempty"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Ts     string                 `json:"ts"`
+	Retain string                 `json:"retain,omitempty"`
+	Id     string                 `json:"id"`
+}
+
+type bulkResponse struct {
+	Accepted int         `json:"accepted"`
+	Rejected []Rejection `json:"rejected"`
+}
+
+// encode renders batch as the newline delimited JSON /bulk takes
+func encode(batch []Entry) ([]byte, error) {
+	var body bytes.Buffer
+
+	enc := json.NewEncoder(&body)
+	for _, e := range batch {
+		be := bulkEntry{
+			Level:  e.Level,
+			Msg:    e.Msg,
+			Fields: e.Fields,
+			Ts:     e.Time.Format(time.RFC3339Nano),
+			Retain: e.Retain,
+			Id:     e.Id,
+		}
+
+		if err := enc.Encode(&be); err != nil {
+			return nil, fmt.Errorf("logitclient: entry not encodable: %v", err)
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+// post sends an encoded batch to /bulk/<sender>
+func (c *Client) post(ctx context.Context, sender string, body []byte) error {
+	req, err := http.NewRequest("POST", c.url+"/bulk/"+url.PathEscape(sender), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+
+	resp, err := c.opts.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errorOf(resp)
+	}
+
+	var br bulkResponse
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&br) == nil && len(br.Rejected) > 0 {
+		return &RejectedError{Sender: sender, Rejected: br.Rejected}
+	}
+
+	return nil
+}
+
+// errorOf reads the error body of a refusal; an answer without one (e.g.
+// of a proxy) is retryable if a 5xx or 429
+func errorOf(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var body struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		Retryable bool   `json:"retryable"`
+	}
+
+	e := &Error{Status: resp.StatusCode}
+
+	if json.Unmarshal(b, &body) == nil && body.Code != "" {
+		e.Code, e.Message, e.Retryable = body.Code, body.Message, body.Retryable
+	} else {
+		e.Message = strings.TrimSpace(string(b))
+		e.Retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	}
+
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		e.retryAfter = time.Duration(s) * time.Second
+	}
+
+	return e
+}
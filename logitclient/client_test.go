@@ -0,0 +1,193 @@
+package logitclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer answers /ping as a logit server whose clock is offset from
+// this host's and which asks for batches of batchSize, and counts the
+// entries of each /bulk request
+type testServer struct {
+	offset    time.Duration
+	batchSize int
+
+	lock     sync.Mutex
+	requests []int
+	times    []string // X-Client-Time of each ping
+}
+
+func (s *testServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch req.URL.Path {
+	case "/ping":
+		now := time.Now().Add(s.offset)
+		resp := map[string]interface{}{
+			"server_time":  now.UTC(),
+			"protocols":    []string{"1"},
+			"backpressure": "busy",
+			"batch_size":   s.batchSize,
+		}
+
+		clientTime := req.Header.Get("X-Client-Time")
+		s.times = append(s.times, clientTime)
+
+		if ms, err := strconv.ParseInt(clientTime, 10, 64); err == nil {
+			resp["skew_ms"] = ms - now.UnixNano()/int64(time.Millisecond)
+		}
+
+		json.NewEncoder(rw).Encode(resp)
+
+	case "/bulk/web":
+		n := 0
+		for sc := bufio.NewScanner(req.Body); sc.Scan(); n++ {
+		}
+
+		s.requests = append(s.requests, n)
+		fmt.Fprintf(rw, `{"accepted":%d}`, n)
+
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(rw, `{"code":"NOT_FOUND","message":"not found","retryable":false}`)
+	}
+}
+
+func TestPing(t *testing.T) {
+	tests := []struct {
+		offset time.Duration
+		skewed bool
+	}{
+		{0, false},
+		{time.Second, false},
+		{10 * time.Second, true},
+		{-10 * time.Second, true},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(&testServer{offset: test.offset, batchSize: 10})
+
+		c, err := New(server.URL, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pong, err := c.Ping(context.Background())
+
+		if se, ok := err.(*SkewError); ok != test.skewed || (err != nil && !ok) {
+			t.Errorf("offset %v: got %v, expected a skew error %v", test.offset, err, test.skewed)
+		} else if ok && se.Skew != pong.Skew {
+			t.Errorf("offset %v: error of skew %v, pong of %v", test.offset, se.Skew, pong.Skew)
+		}
+
+		// the skew is what the server measured, within the round trip
+		if d := pong.Skew + test.offset; d < -500*time.Millisecond || d > 500*time.Millisecond {
+			t.Errorf("offset %v: got skew %v", test.offset, pong.Skew)
+		}
+
+		if pong.Backpressure != "busy" || pong.BatchSize != 10 || len(pong.Protocols) != 1 {
+			t.Errorf("offset %v: got %+v", test.offset, pong)
+		}
+
+		c.Close(context.Background())
+		server.Close()
+	}
+}
+
+func TestPingClientTime(t *testing.T) {
+	ts := &testServer{batchSize: 10}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{MaxSkew: -1})
+	defer c.Close(context.Background())
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if ms, err := strconv.ParseInt(ts.times[0], 10, 64); err != nil || ms < before || ms > before+1000 {
+		t.Errorf("got X-Client-Time %q, expected about %d", ts.times[0], before)
+	}
+}
+
+// batches shrink to what the server asks for, and grow back to BatchSize
+// at most
+func TestPingBatchSize(t *testing.T) {
+	ts := &testServer{batchSize: 10}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{BatchSize: 50, FlushInterval: time.Hour})
+	defer c.Close(context.Background())
+
+	send := func(n int) []int {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			c.Log("web", "info", "hi")
+		}
+
+		if err := c.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+
+		requests := ts.requests
+		ts.requests = nil
+		return requests
+	}
+
+	if requests := send(25); fmt.Sprint(requests) != "[25]" {
+		t.Errorf("before a ping: got requests of %v entries, expected [25]", requests)
+	}
+
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := send(25); fmt.Sprint(requests) != "[10 10 5]" {
+		t.Errorf("busy: got requests of %v entries, expected [10 10 5]", requests)
+	}
+
+	ts.lock.Lock()
+	ts.batchSize = 1000
+	ts.lock.Unlock()
+
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := send(120); fmt.Sprint(requests) != "[50 50 20]" {
+		t.Errorf("ok: got requests of %v entries, expected [50 50 20]", requests)
+	}
+}
+
+func TestPingRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(rw, `{"code":"METHOD_INVALID","message":"method 'GET' not allowed","retryable":false}`)
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{})
+	defer c.Close(context.Background())
+
+	if _, err := c.Ping(context.Background()); err == nil {
+		t.Errorf("refusal taken")
+	} else if e, ok := err.(*Error); !ok || e.Code != "METHOD_INVALID" {
+		t.Errorf("got %v, expected METHOD_INVALID", err)
+	}
+}
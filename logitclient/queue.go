@@ -0,0 +1,168 @@
+package logitclient
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type queued struct {
+	sender string
+	entry  Entry
+}
+
+// Log queues a message of sender at level (e.g. "info"; "" is untagged)
+func (c *Client) Log(sender, level, msg string) error {
+	return c.Queue(sender, Entry{Level: level, Msg: msg})
+}
+
+// LogFields is Log with fields
+func (c *Client) LogFields(sender, level, msg string, fields map[string]interface{}) error {
+	return c.Queue(sender, Entry{Level: level, Msg: msg, Fields: fields})
+}
+
+// Queue queues e for sender without waiting: the client's goroutine sends
+// it along with others of the sender when BatchSize of them are queued or
+// FlushInterval passed. it fails with ErrQueueFull, the entry counted in
+// Dropped, if QueueSize entries wait.
+func (c *Client) Queue(sender string, e Entry) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	select {
+	case c.queue <- queued{sender, prepared(e)}:
+		return nil
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+		return ErrQueueFull
+	}
+}
+
+// Flush waits until what is queued was sent, or dropped, or ctx ends
+func (c *Client) Flush(ctx context.Context) error {
+	ch := make(chan struct{})
+
+	select {
+	case c.flushes <- ch:
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends what is queued, waiting for it up to ctx, and stops the
+// client; entries queued later fail with ErrClosed
+func (c *Client) Close(ctx context.Context) error {
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run batches queued entries by sender and sends them, one request at a
+// time so a sender's entries keep their order
+func (c *Client) run() {
+	defer close(c.done)
+
+	batches := make(map[string][]Entry)
+	var order []string // senders by their oldest entry
+	queued := 0
+
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	sendAll := func() {
+		for _, sender := range order {
+			c.sendBatch(sender, batches[sender])
+			delete(batches, sender)
+		}
+
+		order, queued = order[:0], 0
+	}
+
+	for {
+		select {
+		case q, ok := <-c.queue:
+			if !ok {
+				sendAll()
+				return
+			}
+
+			if _, ok := batches[q.sender]; !ok {
+				order = append(order, q.sender)
+			}
+			batches[q.sender] = append(batches[q.sender], q.entry)
+			queued++
+
+			if len(batches[q.sender]) >= c.batchSize() || queued >= c.opts.QueueSize {
+				sendAll()
+			}
+
+		case ch := <-c.flushes:
+			// what was queued before the flush goes with it
+			for n := len(c.queue); n > 0; n-- {
+				q, ok := <-c.queue
+				if !ok {
+					break
+				}
+
+				if _, ok := batches[q.sender]; !ok {
+					order = append(order, q.sender)
+				}
+				batches[q.sender] = append(batches[q.sender], q.entry)
+			}
+
+			sendAll()
+			close(ch)
+
+		case <-ticker.C:
+			sendAll()
+		}
+	}
+}
+
+// sendBatch sends a sender's entries in requests of BatchSize, reporting
+// what is lost to OnError
+func (c *Client) sendBatch(sender string, batch []Entry) {
+	for len(batch) > 0 {
+		n := len(batch)
+		if most := c.batchSize(); n > most {
+			n = most
+		}
+
+		if err := c.sendRetrying(context.Background(), sender, batch[:n]); err != nil {
+			if r, ok := err.(*RejectedError); ok {
+				atomic.AddInt64(&c.dropped, int64(len(r.Rejected)))
+			} else {
+				atomic.AddInt64(&c.dropped, int64(n))
+			}
+
+			if c.opts.OnError != nil {
+				c.opts.OnError(err)
+			}
+		}
+
+		batch = batch[n:]
+	}
+}
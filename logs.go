@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOGS_DEFAULT_TAIL = 100
+	LOGS_MAX_TAIL     = 10000
+	LOGS_FLUSH_EVERY  = 200 // lines written between flushes of the response
+)
+
+var logLevels = map[string]bool{"trace": true, "debug": true, "info": true, "warn": true, "error": true, "fatal": true}
+
+// logLine is a stored entry as the read API returns it in JSON
+type logLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// makeLogsHandler serves GET /logs/<sender>?tail=&level=&since=&until=, which
+// streams the newest matching entries of a sender, oldest first. output is
+// text lines, or JSON lines with format=json; tz and timefmt render the
+// times. decrypt=true decrypts encrypted fields for callers passing
+// decryptAuth, the chain of -auth-admin; it is refused if there is none.
+func makeLogsHandler(decryptAuth *authChain) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		sender, err := senderOfPath(strings.Trim(strings.TrimPrefix(req.URL.EscapedPath(), "/logs"), "/"))
+		if err != nil {
+			writeError(rw, ERR_SENDER_INVALID, "expected /logs/<sender>: %v", err)
+			return
+		}
+
+		sender = aliases.resolve(sender)
+
+		if !senderAllowed(req, sender) {
+			writeError(rw, ERR_FORBIDDEN, "not allowed to read '%s'", sender)
+			return
+		}
+
+		q := req.URL.Query()
+		query := storageQuery{limit: LOGS_DEFAULT_TAIL}
+
+		if s := q.Get("tail"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > LOGS_MAX_TAIL {
+				writeError(rw, ERR_BODY_INVALID, "tail must be between 1 and %d", LOGS_MAX_TAIL)
+				return
+			}
+			query.limit = n
+		}
+
+		if s := strings.ToLower(q.Get("level")); s != "" {
+			if !logLevels[s] {
+				writeError(rw, ERR_BODY_INVALID, "unknown level '%s'", s)
+				return
+			}
+			query.level = s
+		}
+
+		if query.since, err = parseTimeParam(q.Get("since"), time.Time{}); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'since': %v", err)
+			return
+		}
+
+		if query.until, err = parseTimeParam(q.Get("until"), time.Time{}); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'until': %v", err)
+			return
+		}
+
+		format := q.Get("format")
+		if format != "" && format != "text" && format != "json" {
+			writeError(rw, ERR_BODY_INVALID, "format must be 'text' or 'json'")
+			return
+		}
+
+		render, err := parseTimeRenderer(q)
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		}
+
+		decrypt := q.Get("decrypt") == "true"
+		if decrypt {
+			if encryptor == nil {
+				writeError(rw, ERR_BODY_INVALID, "field encryption is not enabled")
+				return
+			}
+
+			// plaintext is for admins only, so never without their chain
+			if decryptAuth == nil || len(decryptAuth.groups) == 0 {
+				writeError(rw, ERR_FORBIDDEN, "decrypting needs -auth-admin")
+				return
+			}
+
+			if _, _, err := decryptAuth.check(req); err != nil {
+				writeError(rw, ERR_FORBIDDEN, "decrypting needs admin credentials: %v", err)
+				return
+			}
+		}
+
+		entries, err := store.Query(sender, query)
+		if err == errStorageUnsupported {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		} else if err != nil {
+			serverLogger.Errorf("reading logs of '%s' failed: %v", sender, err)
+			writeError(rw, ERR_INTERNAL, "reading logs failed: %v", err)
+			return
+		}
+
+		if format == "json" {
+			rw.Header().Set("Content-Type", "application/x-ndjson")
+		} else {
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+
+		flusher, _ := rw.(http.Flusher)
+		enc := json.NewEncoder(rw)
+
+		for i, se := range entries {
+			msg := se.Msg
+
+			if decrypt && strings.HasPrefix(msg, "{") {
+				if b, err := encryptor.decrypt(sender, []byte(msg)); err == nil {
+					msg = string(b)
+				} else {
+					serverLogger.Warnf("decrypting an entry of '%s' failed: %v", sender, err)
+				}
+			}
+
+			if format == "json" {
+				err = enc.Encode(logLine{Time: render.format(se.Time), Level: se.Level, Msg: msg})
+			} else {
+				_, err = fmt.Fprintf(rw, "%s %-5s %s\n", render.format(se.Time), strings.ToUpper(se.Level), msg)
+			}
+
+			if err != nil {
+				return // client went away
+			}
+
+			if flusher != nil && (i+1)%LOGS_FLUSH_EVERY == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
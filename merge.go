@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rawEntry is an entry as written, continuation lines included
+type rawEntry struct {
+	t    time.Time
+	text string
+}
+
+// rawEntryReader reads the entries of a sender's files in order. lines that
+// don't start an entry stay with the one before, so nothing is dropped.
+type rawEntryReader struct {
+	sender string
+	files  []string
+
+	f       *os.File
+	rc      io.ReadCloser
+	scanner *bufio.Scanner
+
+	next *rawEntry // read ahead: the entry the current line starts
+}
+
+func (r *rawEntryReader) open() error {
+	r.close()
+
+	f, err := os.Open(r.files[0])
+	if err != nil {
+		return err
+	}
+	r.f = f
+
+	if r.rc, err = decompressed(r.files[0], f); err != nil {
+		return err
+	}
+
+	r.files = r.files[1:]
+	r.scanner = bufio.NewScanner(r.rc)
+	r.scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	return nil
+}
+
+func (r *rawEntryReader) close() {
+	if r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// read returns the next entry, or nil at the end
+func (r *rawEntryReader) read() (*rawEntry, error) {
+	for {
+		if r.scanner == nil || !r.scanner.Scan() {
+			if r.scanner != nil {
+				if err := r.scanner.Err(); err != nil {
+					return nil, err
+				}
+			}
+
+			if len(r.files) == 0 {
+				e := r.next
+				r.next = nil
+				r.close()
+				return e, nil
+			}
+
+			if err := r.open(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		line := r.scanner.Text()
+
+		se, ok := parseLogLine(r.sender, line)
+		if !ok || strings.HasPrefix(line, continuationIndent) {
+			if r.next == nil {
+				r.next = &rawEntry{}
+				r.next.text = line
+			} else {
+				r.next.text += "\n" + line
+			}
+			continue
+		}
+
+		e := r.next
+		r.next = &rawEntry{t: se.Time, text: line}
+
+		if e != nil {
+			return e, nil
+		}
+	}
+}
+
+// mergeSenders folds the history of the senders in from into the files of
+// into, entries ordered by time. it must not run while logit serves, since it
+// replaces files the loggers write to.
+func (s *fileStorage) mergeSenders(from []string, into string) (int, error) {
+	var readers []*rawEntryReader
+	var originals []string
+
+	for _, sender := range append([]string{into}, from...) {
+		files, err := s.files(sender)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(files) > 0 {
+			readers = append(readers, &rawEntryReader{sender: sender, files: files})
+			originals = append(originals, files...)
+		}
+	}
+
+	defer func() {
+		for _, r := range readers {
+			r.close()
+		}
+	}()
+
+	live, err := namer.live(into, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	rotatedName := namer.rotatedNameFunc(into, live, time.Now())
+	rotatedAt, _ := namer.rotatedTimeFunc(into, live, time.Now())
+
+	if err := os.MkdirAll(filepath.Dir(live), 0755); err != nil {
+		return 0, err
+	}
+
+	// write the merged stream in parts of -s bytes, oldest first
+	var parts []string
+	var ends []time.Time // of the last entry of each part
+	var out *bufio.Writer
+	var f *os.File
+	var written int64
+
+	finish := func() error {
+		if f == nil {
+			return nil
+		}
+
+		err := out.Flush()
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		f = nil
+		return err
+	}
+
+	cleanup := func() {
+		finish()
+		for _, part := range parts {
+			os.Remove(part)
+		}
+	}
+
+	heads := make([]*rawEntry, len(readers))
+	for i, r := range readers {
+		if heads[i], err = r.read(); err != nil {
+			cleanup()
+			return 0, err
+		}
+	}
+
+	entries := 0
+
+	for {
+		// the oldest head; on ties the canonical sender goes first
+		min := -1
+		for i, e := range heads {
+			if e != nil && (min < 0 || e.t.Before(heads[min].t)) {
+				min = i
+			}
+		}
+
+		if min < 0 {
+			break
+		}
+
+		if f == nil || (maxSize > 0 && written >= maxSize) {
+			if err := finish(); err != nil {
+				cleanup()
+				return 0, err
+			}
+
+			part := fmt.Sprintf("%s.merge.%d", live, len(parts))
+			if f, err = os.OpenFile(part, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+				cleanup()
+				return 0, err
+			}
+
+			parts = append(parts, part)
+			ends = append(ends, time.Time{})
+			out = bufio.NewWriter(f)
+			written = 0
+		}
+
+		n, err := out.WriteString(heads[min].text + "\n")
+		if err != nil {
+			cleanup()
+			return 0, err
+		}
+
+		written += int64(n)
+		ends[len(ends)-1] = heads[min].t
+		entries++
+
+		if heads[min], err = readers[min].read(); err != nil {
+			cleanup()
+			return 0, err
+		}
+	}
+
+	if err := finish(); err != nil {
+		cleanup()
+		return 0, err
+	}
+
+	// everything is written; swap the parts in for the originals
+	for _, path := range originals {
+		if err := os.Remove(path); err != nil {
+			return entries, fmt.Errorf("removing '%s' failed (merged files are kept as '%s.merge.N'): %v", path, live, err)
+		}
+	}
+
+	for i, part := range parts {
+		// the newest part becomes the live file, the others rotated files
+		target := live
+		if n := len(parts) - 1 - i; n > 0 {
+			target = rotatedName(n - 1)
+			if rotatedAt != nil {
+				// named as if rotated after their last entry
+				target = rotatedAt(ends[i])
+			}
+			os.MkdirAll(filepath.Dir(target), 0755)
+		}
+
+		if err := os.Rename(part, target); err != nil {
+			return entries, err
+		}
+
+		if target != live && gzPrefs.enabled(into) {
+			if err := compressFile(target); err != nil {
+				return entries, err
+			}
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// promWriter writes the Prometheus text exposition format
+type promWriter struct {
+	w    *bufio.Writer
+	seen map[string]bool
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metric writes a sample, preceded by HELP and TYPE at the first sample of
+// the name. labels are name, value pairs.
+func (p *promWriter) metric(name, kind, help string, value float64, labels ...string) {
+	if !p.seen[name] {
+		p.seen[name] = true
+		fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	p.sample(name, value, labels...)
+}
+
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], promEscaper.Replace(labels[i+1])))
+		}
+
+		fmt.Fprintf(p.w, "{%s}", strings.Join(pairs, ","))
+	}
+
+	fmt.Fprintf(p.w, " %g\n", value)
+}
+
+func sortedKeys(m map[string]*logg.Logger) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// makeMetricsHandler serves GET /metrics for Prometheus: intake volume by
+// sender and level, what loggers wrote, rotated and lost, the logger queue,
+// the latency of every intake stage and the state of outbound sinks
+func makeMetricsHandler(sinks map[string]pausable) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		p := &promWriter{w: bufio.NewWriter(rw), seen: make(map[string]bool)}
+		defer p.w.Flush()
+
+		p.metric("logit_start_time_seconds", "gauge", "Unix time the server started.", float64(startTime.Unix()))
+
+		// intake
+		counts := stats.totalCounts()
+		senders := make([]string, 0, len(counts))
+		for sender := range counts {
+			senders = append(senders, sender)
+		}
+		sort.Strings(senders)
+
+		for _, sender := range senders {
+			levels := make([]string, 0, len(counts[sender]))
+			for level := range counts[sender] {
+				levels = append(levels, level)
+			}
+			sort.Strings(levels)
+
+			for _, level := range levels {
+				p.metric("logit_entries_total", "counter", "Entries accepted, by sender and level.",
+					float64(counts[sender][level]), "sender", sender, "level", level)
+			}
+		}
+
+		// loggers, by key ('<sender>' or '<area>/<sender>')
+		open := logg.Loggers()
+
+		keys := sortedKeys(open)
+
+		for _, key := range keys {
+			p.metric("logit_bytes_written_total", "counter", "Bytes written by a sender's logger.", float64(open[key].BytesWritten()), "logger", key)
+		}
+
+		for _, key := range keys {
+			p.metric("logit_rotations_total", "counter", "Rotations of a sender's file.", float64(open[key].Rotations()), "logger", key)
+		}
+
+		for _, key := range keys {
+			p.metric("logit_dropped_messages_total", "counter", "Messages a sender's logger lost to being closed or to -overflow.", float64(open[key].Dropped()), "logger", key)
+		}
+
+		for _, key := range keys {
+			p.metric("logit_suppressed_messages_total", "counter", "Messages a sender's logger left out by -sample or -repeats.", float64(open[key].Suppressed()), "logger", key)
+		}
+
+		if spillDir != "" {
+			for _, key := range keys {
+				p.metric("logit_spilled_bytes", "gauge", "Bytes a sender's file refused, held in -spill-dir until written back.", float64(open[key].Spilled()), "logger", key)
+			}
+		}
+
+		p.metric("logit_logger_bytes_written_total", "counter", "Bytes written by all loggers, the server's own included.", float64(logg.BytesWritten()))
+		p.metric("logit_logger_rotations_total", "counter", "Rotations of all loggers.", float64(logg.Rotations()))
+		p.metric("logit_logger_dropped_total", "counter", "Messages all loggers lost.", float64(logg.Dropped()))
+		p.metric("logit_logger_suppressed_total", "counter", "Messages all loggers left out by sampling or as repeats.", float64(logg.Suppressed()))
+		p.metric("logit_logger_compressions_pending", "gauge", "Rotated files waiting to be compressed and pruned.", float64(logg.PendingCompressions()))
+		p.metric("logit_logger_compress_errors_total", "counter", "Rotated files that couldn't be compressed and were left plain.", float64(logg.CompressErrors()))
+		p.metric("logit_logger_sink_errors_total", "counter", "Failures of the extra sinks of loggers (e.g. -console).", float64(logg.SinkErrors()))
+
+		queued, capacity := logg.QueueLen()
+		p.metric("logit_logger_queue_length", "gauge", "Messages queued for the logger actors.", float64(queued))
+		p.metric("logit_logger_queue_capacity", "gauge", "Capacity of the logger actors' queues.", float64(capacity))
+		p.metric("logit_logger_processed_total", "counter", "Tokens handled by the logger actors.", float64(logg.Processed()))
+		p.metric("logit_logger_last_write_seconds", "gauge", "Time a logger actor spent on the last write.", logg.LastWriteLatency().Seconds())
+
+		if shedder != nil {
+			p.metric("logit_shed_requests_total", "counter", "Requests refused with 503 for -shed-queue or -shed-latency.", float64(shedder.shedCount()))
+		}
+
+		routes, panicCounts := panics.snapshot()
+		for _, route := range routes {
+			p.metric("logit_http_panics_total", "counter", "Handler panics recovered, by route.", float64(panicCounts[route]), "route", route)
+		}
+
+		limited, limitedCounts := senderLimits.limitedCounts()
+		for _, sender := range limited {
+			p.metric("logit_sender_rate_limited_total", "counter", "Entries refused for going over the sender's -sender-rate.", float64(limitedCounts[sender]), "sender", sender)
+		}
+
+		if quotas != nil {
+			r := quotas.report()
+
+			p.metric("logit_disk_usage_bytes_total", "gauge", "Bytes of everything below -w, as of the last quota scan.", float64(r.Total.Bytes))
+			p.metric("logit_quota_pruned_files_total", "counter", "Rotated files removed for -quota or -quota-total.", float64(r.Pruned))
+
+			for _, u := range r.Senders {
+				p.metric("logit_disk_usage_bytes", "gauge", "Bytes of a sender's files, as of the last quota scan and what it sent since.", float64(u.Bytes), "sender", u.Sender)
+			}
+
+			for _, u := range r.Senders {
+				p.metric("logit_quota_refused_total", "counter", "Entries refused or left out for being over a disk quota.", float64(u.Refused), "sender", u.Sender)
+			}
+		}
+
+		if dedup != nil {
+			p.metric("logit_dedup_store_errors_total", "counter", "Dedup store failures; the entries were taken unchecked.", float64(atomic.LoadInt64(&dedup.errors)))
+		}
+
+		// stages
+		pm := stageStats
+		pm.lock.Lock()
+		names := append([]string(nil), pm.order...)
+		pm.lock.Unlock()
+
+		for _, name := range names {
+			p.metric("logit_stage_drops_total", "counter", "Entries a stage dropped on purpose (auth: rejected requests).",
+				float64(atomic.LoadInt64(&pm.stage(name).drops)), "stage", name)
+		}
+
+		for _, name := range names {
+			p.metric("logit_stage_errors_total", "counter", "Entries a stage failed on.",
+				float64(atomic.LoadInt64(&pm.stage(name).errors)), "stage", name)
+		}
+
+		histogram := "logit_stage_duration_seconds"
+		p.seen[histogram] = true
+		fmt.Fprintf(p.w, "# HELP %s Time entries spent in a stage.\n# TYPE %s histogram\n", histogram, histogram)
+
+		for _, name := range names {
+			m := pm.stage(name)
+
+			var cumulative int64
+			for i, bound := range STAGE_BUCKETS {
+				cumulative += atomic.LoadInt64(&m.buckets[i])
+				p.sample(histogram+"_bucket", float64(cumulative), "stage", name, "le", fmt.Sprintf("%g", bound.Seconds()))
+			}
+
+			calls := atomic.LoadInt64(&m.calls)
+			p.sample(histogram+"_bucket", float64(calls), "stage", name, "le", "+Inf")
+			p.sample(histogram+"_sum", time.Duration(atomic.LoadInt64(&m.nanos)).Seconds(), "stage", name)
+			p.sample(histogram+"_count", float64(calls), "stage", name)
+		}
+
+		// outbound
+		if shadow != nil {
+			p.metric("logit_shadow_queue_length", "gauge", "Entries queued for the shadow target.", float64(shadow.pending()))
+		}
+
+		if alerts != nil {
+			p.metric("logit_alerts_posted_total", "counter", "Alerts the webhook took.", float64(atomic.LoadInt64(&alerts.posted)))
+			p.metric("logit_alert_failures_total", "counter", "Alerts that couldn't be posted.", float64(atomic.LoadInt64(&alerts.failures)))
+			p.metric("logit_alert_dropped_total", "counter", "Entries not alerted on for a full alert queue.", float64(atomic.LoadInt64(&alerts.dropped)))
+		}
+
+		sinkNames := make([]string, 0, len(sinks))
+		for name := range sinks {
+			sinkNames = append(sinkNames, name)
+		}
+		sort.Strings(sinkNames)
+
+		statuses := make([]sinkStatus, len(sinkNames))
+		for i, name := range sinkNames {
+			statuses[i] = sinks[name].status()
+		}
+
+		for i, name := range sinkNames {
+			paused := 0.0
+			if statuses[i].Paused {
+				paused = 1
+			}
+
+			p.metric("logit_sink_paused", "gauge", "Whether an outbound sink is paused.", paused, "sink", name)
+		}
+
+		for _, s := range batchSinks {
+			p.metric("logit_sink_sent_total", "counter", "Entries a batch sink's destination took.", float64(atomic.LoadInt64(&s.sent)), "sink", s.name)
+		}
+
+		for _, s := range batchSinks {
+			p.metric("logit_sink_failures_total", "counter", "Batches a batch sink failed to send and retried.", float64(atomic.LoadInt64(&s.failures)), "sink", s.name)
+		}
+
+		for _, s := range batchSinks {
+			p.metric("logit_sink_dropped_total", "counter", "Entries a batch sink lost to a full queue or the destination refusing them.", float64(atomic.LoadInt64(&s.dropped)), "sink", s.name)
+		}
+
+		for i, name := range sinkNames {
+			p.metric("logit_sink_buffered_bytes", "gauge", "Bytes spooled for a paused sink.", float64(statuses[i].Buffered), "sink", name)
+		}
+	}
+}
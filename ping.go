@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"logit/logg"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// intake protocol versions this server understands
+var protocolVersions = []string{"1"}
+
+const (
+	BACKPRESSURE_BUSY       = 0.5 // queue fill ratio
+	BACKPRESSURE_OVERLOADED = 0.9
+
+	MAX_BATCH_SIZE = 1000
+)
+
+type pingResponse struct {
+	ServerTime       time.Time `json:"server_time"`
+	ServerTimeMillis int64     `json:"server_time_ms"`
+	SkewMillis       *int64    `json:"skew_ms,omitempty"` // client minus server
+	Protocols        []string  `json:"protocols"`
+	Backpressure     string    `json:"backpressure"` // ok | busy | overloaded
+	QueueDepth       int       `json:"queue_depth"`
+	QueueCap         int       `json:"queue_cap"`
+	BatchSize        int       `json:"batch_size"` // suggested entries per batch
+}
+
+// backpressureState reports how far the logger actors lag behind and the batch
+// size clients should use accordingly
+func backpressureState() (state string, depth, capacity, batchSize int) {
+	depth, capacity = logg.QueueLen()
+
+	ratio := float64(depth) / float64(capacity)
+
+	switch {
+	case ratio >= BACKPRESSURE_OVERLOADED:
+		return "overloaded", depth, capacity, MAX_BATCH_SIZE / 100
+	case ratio >= BACKPRESSURE_BUSY:
+		return "busy", depth, capacity, MAX_BATCH_SIZE / 10
+	default:
+		return "ok", depth, capacity, MAX_BATCH_SIZE
+	}
+}
+
+// pingHandler answers client heartbeats. clients may pass their clock as
+// 'X-Client-Time' (or '?client_time=') in unix milliseconds to get the skew.
+func pingHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD")
+		writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+		return
+	}
+
+	now := time.Now()
+
+	resp := pingResponse{
+		ServerTime:       now.UTC(),
+		ServerTimeMillis: now.UnixNano() / int64(time.Millisecond),
+		Protocols:        protocolVersions,
+	}
+
+	resp.Backpressure, resp.QueueDepth, resp.QueueCap, resp.BatchSize = backpressureState()
+
+	clientTime := req.Header.Get("X-Client-Time")
+	if clientTime == "" {
+		clientTime = req.URL.Query().Get("client_time")
+	}
+
+	if clientTime != "" {
+		if ms, err := strconv.ParseInt(clientTime, 10, 64); err == nil {
+			skew := ms - resp.ServerTimeMillis
+			resp.SkewMillis = &skew
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(resp)
+}
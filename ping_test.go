@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPingHandlerMethod(t *testing.T) {
+	rw := httptest.NewRecorder()
+	pingHandler(rw, httptest.NewRequest("POST", "/ping", nil))
+
+	var body errorBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatalf("no JSON error: %v", err)
+	}
+
+	if body.Code != ERR_METHOD_INVALID || rw.Code != ERR_METHOD_INVALID.status() || rw.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("got %s (%d), expected %s (%d)", body.Code, rw.Code, ERR_METHOD_INVALID, ERR_METHOD_INVALID.status())
+	}
+}
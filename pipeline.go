@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"logit/logg"
+	"sort"
+	"strings"
+	"time"
+)
+
+// entry is a single log entry travelling through the intake pipeline
+type entry struct {
+	sender   string
+	level    string
+	msg      string
+	fields   map[string]interface{}
+	received time.Time
+	at       time.Time // when it happened by the client (?ts=), zero if not told
+
+	quarantined bool
+	retain      string // retention class, "" for the default
+	origin      string // node the entry was replicated from, "" if local
+	id          string // the client's id for deduplication, "" if none
+	sync        bool   // the client waits until it is on disk, see waitSync
+
+	ctx context.Context // of the request waiting for a sync write, nil if none
+}
+
+// time returns when the entry happened, as far as logit knows
+func (e *entry) time() time.Time {
+	if e.at.IsZero() {
+		return e.received
+	}
+
+	return e.at
+}
+
+// area returns the directory below the log directory the entry is stored in,
+// "" for the log directory itself
+func (e *entry) area() string {
+	switch {
+	case e.quarantined:
+		return QUARANTINE_DIR
+	case e.retain != "":
+		return RETAIN_DIR_PREFIX + e.retain
+	default:
+		return ""
+	}
+}
+
+// stage inspects or rewrites an entry in place; returning false drops it
+type stage func(e *entry) bool
+
+type pipeline struct {
+	names   []string
+	stages  []stage
+	metrics []*stageMetric
+}
+
+func newPipeline() *pipeline {
+	return new(pipeline)
+}
+
+func (p *pipeline) add(name string, s stage) {
+	p.names = append(p.names, name)
+	p.stages = append(p.stages, s)
+	p.metrics = append(p.metrics, stageStats.stage(name))
+}
+
+func (p *pipeline) run(e *entry) bool {
+	return p.pass(e) == ""
+}
+
+// pass runs e through the stages and returns the name of the one that
+// dropped it, "" if it passed them all
+func (p *pipeline) pass(e *entry) string {
+	for i, s := range p.stages {
+		start := time.Now()
+		ok := s(e)
+
+		if ok {
+			p.metrics[i].observe(time.Since(start), STAGE_PASSED)
+		} else {
+			p.metrics[i].observe(time.Since(start), STAGE_DROPPED)
+			return p.names[i]
+		}
+	}
+
+	return ""
+}
+
+// render returns the message followed by its fields in key=value form
+func (e *entry) render() string {
+	if len(e.fields) == 0 {
+		return e.msg
+	}
+
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ss := make([]string, 0, len(keys)+1)
+	ss = append(ss, e.msg)
+
+	for _, k := range keys {
+		v := fmt.Sprintf("%v", e.fields[k])
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+
+		ss = append(ss, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return strings.Join(ss, " ")
+}
+
+// deliver hands an entry that passed the pipeline to the storage and to
+// everything observing accepted traffic
+func deliver(e *entry) error {
+	// live tails see entries before they are on disk
+	tails.publish(e)
+
+	write := stageStats.timer("write")
+	if err := store.Append(e); err != nil {
+		write.end(STAGE_FAILED)
+		return err
+	}
+	write.end(STAGE_PASSED)
+
+	stats.record(e.sender, e.level, e.received)
+
+	if detector != nil {
+		detector.observe(e.sender, e.level)
+	}
+
+	// replicated entries were alerted on where they arrived
+	if alerts != nil && e.origin == "" {
+		alerts.offer(e.sender, e.level, e.msg, e.time())
+	}
+
+	if shadow == nil && (len(replicators) == 0 || e.origin != "") && len(batchSinks) == 0 {
+		return nil
+	}
+
+	forward := stageStats.timer("forward")
+
+	if shadow != nil {
+		shadow.offer(e.sender, e.level, e.render())
+	}
+
+	// replicated entries are not passed on again
+	if e.origin == "" {
+		for _, r := range replicators {
+			r.record(e)
+		}
+	}
+
+	for _, s := range batchSinks {
+		s.offer(e)
+	}
+
+	forward.end(STAGE_PASSED)
+
+	return nil
+}
+
+// storedFields returns the fields written with the entry: the client's, and
+// when logit received it, if the client said when it happened
+func (e *entry) storedFields() logg.Fields {
+	if e.at.IsZero() || receivedField == "" {
+		return logg.Fields(e.fields)
+	}
+
+	if _, ok := e.fields[receivedField]; ok {
+		return logg.Fields(e.fields)
+	}
+
+	fields := make(logg.Fields, len(e.fields)+1)
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	fields[receivedField] = e.received.In(lineTimeLoc).Format(time.RFC3339Nano)
+
+	return fields
+}
+
+func writeEntry(logger *logg.Logger, e *entry) error {
+	level := logg.LogLevelFrom(e.level, logg.LOG_LEVEL_DEBUG)
+
+	if e.sync {
+		fields := logg.Fields(e.fields)
+		if !e.at.IsZero() {
+			fields = e.storedFields()
+		}
+
+		ctx := e.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, SYNC_WRITE_TIMEOUT)
+		defer cancel()
+
+		return logger.LogDurable(ctx, e.at, level, fields, "%s", e.msg)
+	}
+
+	if !e.at.IsZero() {
+		logger.LogAt(e.at, level, e.storedFields(), "%s", e.msg)
+		return nil
+	}
+
+	logger.Log(level, logg.Fields(e.fields), "%s", e.msg)
+	return nil
+}
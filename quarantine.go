@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	QUARANTINE_DIR        = "quarantine"
+	QUARANTINE_WINDOW     = time.Minute
+	QUARANTINE_MIN_SAMPLE = 20 // messages in a window before size/entropy are judged
+)
+
+type quarantineWindow struct {
+	start   time.Time
+	count   int64
+	bytes   int64
+	entropy float64 // sum of per-message entropy
+}
+
+type quarantineState struct {
+	window quarantineWindow
+	until  time.Time // quarantined while before this
+	seen   int64     // messages since quarantined, for sampling
+}
+
+// quarantine diverts senders that look abusive (too many messages, huge or
+// random-looking payloads) to a separate area where only every sample-th
+// message is kept, so a compromised client can't fill the disk under a
+// legitimate name
+type quarantine struct {
+	maxRate    int64   // messages per window
+	maxSize    int64   // average bytes per message
+	maxEntropy float64 // average bits per byte
+	sample     int64
+	duration   time.Duration
+	alert      func(sender, reason string)
+
+	lock    *sync.Mutex
+	senders map[string]*quarantineState
+}
+
+func newQuarantine(maxRate, maxSize int64, maxEntropy float64, sample int64, duration time.Duration, alert func(sender, reason string)) *quarantine {
+	if sample < 1 {
+		sample = 1
+	}
+
+	return &quarantine{
+		maxRate:    maxRate,
+		maxSize:    maxSize,
+		maxEntropy: maxEntropy,
+		sample:     sample,
+		duration:   duration,
+		alert:      alert,
+		lock:       &sync.Mutex{},
+		senders:    make(map[string]*quarantineState),
+	}
+}
+
+// shannonEntropy returns the entropy of s in bits per byte (0..8)
+func shannonEntropy(s string) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	var freq [256]int
+	for i := 0; i < len(s); i++ {
+		freq[s[i]] += 1
+	}
+
+	h := 0.0
+	n := float64(len(s))
+
+	for _, f := range freq {
+		if f == 0 {
+			continue
+		}
+
+		p := float64(f) / n
+		h -= p * math.Log2(p)
+	}
+
+	return h
+}
+
+// judge returns why the window is suspicious, or "" if it looks fine
+func (q *quarantine) judge(w *quarantineWindow) string {
+	if q.maxRate > 0 && w.count > q.maxRate {
+		return "message rate"
+	}
+
+	if w.count < QUARANTINE_MIN_SAMPLE {
+		return ""
+	}
+
+	if q.maxSize > 0 && w.bytes/w.count > q.maxSize {
+		return "message size"
+	}
+
+	if q.maxEntropy > 0 && w.entropy/float64(w.count) > q.maxEntropy {
+		return "payload entropy"
+	}
+
+	return ""
+}
+
+// stage is the pipeline stage marking (and sampling) quarantined entries
+func (q *quarantine) stage(e *entry) bool {
+	q.lock.Lock()
+
+	st := q.senders[e.sender]
+	if st == nil {
+		st = new(quarantineState)
+		q.senders[e.sender] = st
+	}
+
+	now := e.received
+	if now.Sub(st.window.start) >= QUARANTINE_WINDOW {
+		st.window = quarantineWindow{start: now}
+	}
+
+	st.window.count += 1
+	st.window.bytes += int64(len(e.msg))
+	st.window.entropy += shannonEntropy(e.msg)
+
+	var reason string
+
+	if now.After(st.until) {
+		if reason = q.judge(&st.window); reason != "" {
+			st.until = now.Add(q.duration)
+			st.seen = 0
+		}
+	}
+
+	quarantined := now.Before(st.until)
+	keep := true
+
+	if quarantined {
+		st.seen += 1
+		keep = (st.seen-1)%q.sample == 0
+	}
+
+	q.lock.Unlock()
+
+	if reason != "" {
+		q.alert(e.sender, reason)
+	}
+
+	e.quarantined = quarantined
+
+	return keep
+}
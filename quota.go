@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QUOTA_SCAN_EVERY   = 10 * time.Second // default of -quota-scan
+	QUOTA_PRUNE_SETTLE = 5 * time.Second  // rotated files younger are left to their compression
+)
+
+// what a sender (or logit as a whole) over its disk quota gets
+type quotaAction int
+
+const (
+	QUOTA_REJECT quotaAction = iota // new entries are refused with 429
+	QUOTA_PRUNE                     // the oldest rotated files are removed
+	QUOTA_ERRORS                    // only error and fatal entries are taken
+)
+
+var quotaActionNames = map[quotaAction]string{QUOTA_REJECT: "reject", QUOTA_PRUNE: "prune", QUOTA_ERRORS: "errors"}
+
+func (a quotaAction) String() string {
+	return quotaActionNames[a]
+}
+
+// diskQuota bounds the bytes of files on disk; a size of 0 leaves them
+// unbounded
+type diskQuota struct {
+	size   int64
+	action quotaAction
+}
+
+// parseQuota parses 'off' or '<size>[:reject|prune|errors]', e.g.
+// '10g:prune'; the action is reject if none is given
+func parseQuota(s string) (diskQuota, error) {
+	var q diskQuota
+
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "" {
+		return q, nil
+	}
+
+	invalid := fmt.Errorf("invalid quota '%s' (expected e.g. '1g', '1g:prune', '500m:errors' or 'off')", s)
+
+	size, action := s, "reject"
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		size, action = s[:i], s[i+1:]
+	}
+
+	n, err := parseSize(size)
+	if err != nil || n <= 0 {
+		return q, invalid
+	}
+	q.size = n
+
+	found := false
+	for a, name := range quotaActionNames {
+		if name == action {
+			q.action, found = a, true
+		}
+	}
+
+	if !found {
+		return q, invalid
+	}
+
+	return q, nil
+}
+
+// quotaPolicy holds the disk quotas of every sender and of the log
+// directory as a whole, and what a scan of it found they use; between
+// scans, the entries taken are added to it
+type quotaPolicy struct {
+	lock    *sync.RWMutex
+	def     diskQuota
+	total   diskQuota
+	senders *senderValues[diskQuota]
+
+	usageLock  *sync.Mutex
+	usage      map[string]int64 // bytes by sender
+	totalUsage int64            // bytes of everything below the log directory
+	scanned    time.Time
+	refused    map[string]int64 // entries refused or left out for a quota, by sender
+	pruned     int64            // files removed for a quota
+}
+
+// newQuotaPolicy parses the default quota, the one of the log directory and
+// per-sender overrides like 'web=1g:prune,audit=off'
+func newQuotaPolicy(defSpec, totalSpec, spec string) (*quotaPolicy, error) {
+	def, err := parseQuota(defSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := parseQuota(totalSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := parseSenderValues(spec, "quota", "quota", func(sender, value string) (diskQuota, error) {
+		return parseQuota(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaPolicy{
+		lock:      &sync.RWMutex{},
+		def:       def,
+		total:     total,
+		senders:   senders,
+		usageLock: &sync.Mutex{},
+		usage:     make(map[string]int64),
+		refused:   make(map[string]int64),
+	}, nil
+}
+
+// enabled tells whether any quota is set
+func (p *quotaPolicy) enabled() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.def.size > 0 || p.total.size > 0 {
+		return true
+	}
+
+	for _, q := range p.senders.all() {
+		if q.size > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *quotaPolicy) quota(sender string) diskQuota {
+	if q, ok := p.senders.get(sender); ok {
+		return q
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.def
+}
+
+// update takes the quotas of next, e.g. of a reloaded config, after
+// dropping those of removed senders
+func (p *quotaPolicy) update(next *quotaPolicy, removed []string) {
+	p.lock.Lock()
+	p.def = next.def
+	p.total = next.total
+	p.lock.Unlock()
+
+	p.senders.update(next.senders, removed)
+}
+
+// over returns the quota a sender is over, its own before that of the log
+// directory
+func (p *quotaPolicy) over(sender string) (diskQuota, bool) {
+	q := p.quota(sender)
+
+	p.lock.RLock()
+	total := p.total
+	p.lock.RUnlock()
+
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	if q.size > 0 && p.usage[sender] > q.size {
+		return q, true
+	}
+
+	if total.size > 0 && p.totalUsage > total.size {
+		return total, true
+	}
+
+	return diskQuota{}, false
+}
+
+// allow tells whether e may be taken, which it may not if its sender is
+// over a quota rejecting entries
+func (p *quotaPolicy) allow(e *entry) bool {
+	if p == nil {
+		return true
+	}
+
+	if q, over := p.over(e.sender); over && q.action == QUOTA_REJECT {
+		p.usageLock.Lock()
+		p.refused[e.sender]++
+		p.usageLock.Unlock()
+
+		return false
+	}
+
+	return true
+}
+
+// stage is the pipeline stage leaving out all but errors of senders over a
+// quota taking errors only, and counting the bytes of the others against
+// their sender until the next scan
+func (p *quotaPolicy) stage(e *entry) bool {
+	q, over := p.over(e.sender)
+
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	if over && q.action == QUOTA_ERRORS && !levelAtLeast(e.level, "error") {
+		p.refused[e.sender]++
+		return false
+	}
+
+	size := int64(entrySize(e))
+	p.usage[e.sender] += size
+	p.totalUsage += size
+
+	return true
+}
+
+// run scans the log directory every interval
+func (p *quotaPolicy) run(s *fileStorage, interval time.Duration) {
+	p.scan(s)
+
+	for range time.Tick(interval) {
+		p.scan(s)
+	}
+}
+
+// scan measures what the senders with an open file or a quota of their own
+// and the log directory use, then prunes what is over a quota pruning files
+func (p *quotaPolicy) scan(s *fileStorage) {
+	senders := openSenders()
+
+	for sender, q := range p.senders.all() {
+		if q.size > 0 {
+			senders = append(senders, sender)
+		}
+	}
+
+	p.lock.RLock()
+	total := p.total
+	p.lock.RUnlock()
+
+	usage := make(map[string]int64)
+	files := make(map[string][]string)
+
+	for _, sender := range senders {
+		if _, ok := files[sender]; ok {
+			continue
+		}
+
+		paths, err := s.files(sender)
+		if err != nil {
+			continue
+		}
+
+		files[sender] = paths
+		usage[sender] = filesSize(paths)
+	}
+
+	totalUsage := dirSize(s.dir)
+
+	for sender, paths := range files {
+		q := p.quota(sender)
+		if q.size == 0 || q.action != QUOTA_PRUNE || usage[sender] <= q.size {
+			continue
+		}
+
+		freed := p.prune(rotatedOf(paths), usage[sender]-q.size)
+		usage[sender] -= freed
+		totalUsage -= freed
+
+		// what is left over is the live file; cut it, for the next scan to
+		// prune it
+		if live := filesSize(paths[len(paths)-1:]); usage[sender] > q.size && usage[sender]-live <= q.size {
+			if err := s.Rotate(sender); err != nil && err != errSenderNotOpen {
+				serverLogger.Errorf("rotating '%s' over its quota failed: %v", sender, err)
+			}
+		}
+
+		serverLogger.Warnf("'%s' over its disk quota of %d bytes: %d bytes of rotated files removed", sender, q.size, freed)
+	}
+
+	if total.size > 0 && total.action == QUOTA_PRUNE && totalUsage > total.size {
+		var rotated []string
+		for _, paths := range files {
+			rotated = append(rotated, rotatedOf(paths)...)
+		}
+
+		freed := p.prune(sortByModTime(rotated), totalUsage-total.size)
+		totalUsage -= freed
+
+		serverLogger.Warnf("log directory over its disk quota of %d bytes: %d bytes of rotated files removed", total.size, freed)
+	}
+
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	p.usage = usage
+	p.totalUsage = totalUsage
+	p.scanned = time.Now()
+}
+
+// prune removes files, oldest first, until need bytes are freed and
+// returns how many were; files rotated very recently may still be being
+// compressed and are left
+func (p *quotaPolicy) prune(paths []string, need int64) int64 {
+	var freed int64
+
+	for _, path := range paths {
+		if freed >= need {
+			break
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil || time.Since(fi.ModTime()) < QUOTA_PRUNE_SETTLE {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			serverLogger.Errorf("removing '%s' over a quota failed: %v", path, err)
+			continue
+		}
+
+		if searcher != nil {
+			if indexPath, ok := searcher.pathOf(path); ok {
+				os.Remove(indexPath)
+			}
+		}
+
+		freed += fi.Size()
+
+		p.usageLock.Lock()
+		p.pruned++
+		p.usageLock.Unlock()
+	}
+
+	return freed
+}
+
+// rotatedOf returns the files of a sender but the live one, which is last
+func rotatedOf(paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	return paths[:len(paths)-1]
+}
+
+func filesSize(paths []string) int64 {
+	var n int64
+
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			n += fi.Size()
+		}
+	}
+
+	return n
+}
+
+// dirSize returns the bytes of the files below dir
+func dirSize(dir string) int64 {
+	var n int64
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+
+	return n
+}
+
+// quotaUsage is a quota and what is used of it, as /admin/quota tells
+type quotaUsage struct {
+	Sender  string `json:"sender,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Quota   int64  `json:"quota"`            // 0 for none
+	Action  string `json:"action,omitempty"` // when over it
+	Over    bool   `json:"over"`
+	Refused int64  `json:"refused,omitempty"` // entries refused or left out
+}
+
+type quotaReport struct {
+	Scanned time.Time    `json:"scanned"`
+	Total   quotaUsage   `json:"total"`
+	Pruned  int64        `json:"pruned"` // files removed
+	Senders []quotaUsage `json:"senders"`
+}
+
+func (p *quotaPolicy) report() quotaReport {
+	p.lock.RLock()
+	total := p.total
+	p.lock.RUnlock()
+
+	p.usageLock.Lock()
+	usage := make(map[string]int64, len(p.usage))
+	for sender, n := range p.usage {
+		usage[sender] = n
+	}
+	refused := make(map[string]int64, len(p.refused))
+	for sender, n := range p.refused {
+		refused[sender] = n
+		if _, ok := usage[sender]; !ok {
+			usage[sender] = 0
+		}
+	}
+
+	r := quotaReport{
+		Scanned: p.scanned,
+		Total:   quotaUsage{Bytes: p.totalUsage, Quota: total.size, Over: total.size > 0 && p.totalUsage > total.size},
+		Pruned:  p.pruned,
+		Senders: make([]quotaUsage, 0, len(usage)),
+	}
+	p.usageLock.Unlock()
+
+	if total.size > 0 {
+		r.Total.Action = total.action.String()
+	}
+
+	for sender, n := range usage {
+		q := p.quota(sender)
+
+		u := quotaUsage{Sender: sender, Bytes: n, Quota: q.size, Over: q.size > 0 && n > q.size, Refused: refused[sender]}
+		if q.size > 0 {
+			u.Action = q.action.String()
+		}
+
+		r.Senders = append(r.Senders, u)
+	}
+
+	sort.Slice(r.Senders, func(i, j int) bool {
+		return r.Senders[i].Sender < r.Senders[j].Sender
+	})
+
+	return r
+}
+
+// makeQuotaAdminHandler serves GET /admin/quota, what the senders and the
+// log directory use of their disk quotas as of the last scan
+func makeQuotaAdminHandler(p *quotaPolicy) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(p.report())
+	}
+}
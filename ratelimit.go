@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_RELOAD = 5 * time.Second // how often the limits file is checked for changes
+	RATE_LIMIT_IDLE   = 10 * time.Minute
+)
+
+// routeLimit is the token bucket configuration of one route
+type routeLimit struct {
+	rate  float64 // tokens per second
+	burst float64
+	key   string // "sender", "ip" or "tenant"
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter applies token buckets per route and key. routes and their
+// limits come from a file of lines like
+//
+//	/                rate=200 burst=400 key=sender
+//	/stats/aggregate rate=5/m burst=10 key=ip
+//	*                rate=50 burst=100 key=ip
+//
+// which is reloaded when it changes; '*' applies to routes not listed.
+type rateLimiter struct {
+	path string
+
+	lock    *sync.Mutex
+	limits  map[string]routeLimit
+	buckets map[string]*bucket // route + "\x00" + key
+	modTime time.Time
+}
+
+// parseRate parses "N", "N/s", "N/m" or "N/h" into tokens per second
+func parseRate(s string) (float64, error) {
+	per := 1.0
+
+	if i := strings.Index(s, "/"); i >= 0 {
+		switch s[i+1:] {
+		case "s":
+		case "m":
+			per = 60
+		case "h":
+			per = 3600
+		default:
+			return 0, fmt.Errorf("invalid rate unit '%s'", s[i+1:])
+		}
+
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+
+	return n / per, nil
+}
+
+func loadRouteLimits(path string) (map[string]routeLimit, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limits := make(map[string]routeLimit)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		limit := routeLimit{key: "ip"}
+
+		for _, kv := range fields[1:] {
+			ss := strings.SplitN(kv, "=", 2)
+			if len(ss) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected key=value, got '%s'", path, n, kv)
+			}
+
+			switch ss[0] {
+			case "rate":
+				limit.rate, err = parseRate(ss[1])
+			case "burst":
+				limit.burst, err = strconv.ParseFloat(ss[1], 64)
+				if err == nil && limit.burst < 1 {
+					err = fmt.Errorf("burst must be at least 1")
+				}
+			case "key":
+				switch ss[1] {
+				case "sender", "ip", "tenant":
+					limit.key = ss[1]
+				default:
+					err = fmt.Errorf("unknown key '%s' (expected sender, ip or tenant)", ss[1])
+				}
+			default:
+				err = fmt.Errorf("unknown setting '%s'", ss[0])
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+
+		if limit.rate == 0 {
+			return nil, fmt.Errorf("%s:%d: missing rate", path, n)
+		}
+
+		if limit.burst == 0 {
+			limit.burst = math.Max(1, limit.rate)
+		}
+
+		limits[fields[0]] = limit
+	}
+
+	return limits, scanner.Err()
+}
+
+func newRateLimiter(path string) (*rateLimiter, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := loadRouteLimits(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rateLimiter{
+		path:    path,
+		lock:    &sync.Mutex{},
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+		modTime: fi.ModTime(),
+	}
+
+	go l.run()
+
+	return l, nil
+}
+
+// run reloads the limits file when it changes and forgets idle buckets
+func (l *rateLimiter) run() {
+	for range time.Tick(RATE_LIMIT_RELOAD) {
+		l.expire(time.Now())
+
+		fi, err := os.Stat(l.path)
+		if err != nil || fi.ModTime().Equal(l.modTime) {
+			continue
+		}
+
+		limits, err := loadRouteLimits(l.path)
+
+		l.lock.Lock()
+		l.modTime = fi.ModTime()
+		if err == nil {
+			l.limits = limits
+			// buckets refill under the new limits as they are used
+		}
+		l.lock.Unlock()
+
+		if err != nil {
+			serverLogger.Errorf("rate limits not reloaded, keeping the previous ones: %v", err)
+		} else {
+			serverLogger.Infof("rate limits reloaded from '%s' (%d routes)", l.path, len(limits))
+		}
+	}
+}
+
+func (l *rateLimiter) expire(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > RATE_LIMIT_IDLE {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// allow takes a token from the bucket of route and key, or says how long
+// until one is available
+func (l *rateLimiter) allow(route string, keyOf func(kind string) string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit, ok := l.limits[route]
+	if !ok {
+		if limit, ok = l.limits["*"]; !ok {
+			return true, 0
+		}
+	}
+
+	k := route + "\x00" + keyOf(limit.key)
+
+	b := l.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: limit.burst, last: now}
+		l.buckets[k] = b
+	}
+
+	b.tokens = math.Min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+
+	return false, wait
+}
+
+// wrap limits requests to h, which is registered as route
+func (l *rateLimiter) wrap(route string, h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ok, wait := l.allow(route, func(kind string) string {
+			return requestKey(req, route, kind)
+		}, time.Now())
+
+		if !ok {
+			retryAfter(rw, wait)
+			writeError(rw, ERR_RATE_LIMITED, "rate limit of '%s' exceeded, retry in %v", route, wait)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// requestKey returns what a request is counted against; tenants are the
+// authenticated principal, falling back to the sender. senders are those
+// the handlers write to, parsed as they parse them and resolved through
+// aliases, so no spelling of a path gets a bucket of its own; requests to
+// routes not posting to a sender in their path are counted by address.
+func requestKey(req *http.Request, route, kind string) string {
+	switch kind {
+	case "tenant":
+		if p := requestPrincipal(req); p != "" {
+			return p
+		}
+		fallthrough
+
+	case "sender":
+		if sender, ok := requestSender(req, route); ok {
+			return sender
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// requestSender returns the sender a request to route writes to
+func requestSender(req *http.Request, route string) (string, bool) {
+	var sender string
+
+	switch route {
+	case "/", "/echo":
+		params, _, err := parseEntryRequest(req.URL.EscapedPath(), "")
+		if err != nil {
+			return "", false
+		}
+		sender = params.sender
+
+	case "/bulk":
+		s, err := parseBulkPath(req.URL.EscapedPath())
+		if err != nil {
+			return "", false
+		}
+		sender = s
+
+	default:
+		return "", false
+	}
+
+	return aliases.resolve(sender), true
+}
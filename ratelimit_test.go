@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func testRateLimiter(limits map[string]routeLimit) *rateLimiter {
+	return &rateLimiter{
+		lock:    &sync.Mutex{},
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// spellings of one sender share its bucket, whatever the query says
+func TestRateLimitSenderSpellings(t *testing.T) {
+	l := testRateLimiter(map[string]routeLimit{
+		"/":     {rate: 2.0 / 60, burst: 2, key: "sender"},
+		"/bulk": {rate: 2.0 / 60, burst: 2, key: "sender"},
+	})
+
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	tests := []struct {
+		route string
+		paths []string
+	}{
+		{"/", []string{"/web/info", "/web/info", "/web/info?sender=r1", "/w%65b/", "/W%45B/", "/we%62/", "/%77eb/", "/WEB/warn?sender=r2"}},
+		{"/bulk", []string{"/bulk/web", "/bulk/web/", "/bulk/W%45B?sender=r3", "/bulk/%77eb"}},
+	}
+
+	for _, test := range tests {
+		h := l.wrap(test.route, ok)
+
+		for i, path := range test.paths {
+			req := httptest.NewRequest("POST", path, nil)
+			rw := httptest.NewRecorder()
+
+			h.ServeHTTP(rw, req)
+
+			expected := http.StatusOK
+			if i >= 2 {
+				expected = http.StatusTooManyRequests
+			}
+
+			if rw.Code != expected {
+				t.Errorf("%s (request %d): got %d, expected %d", path, i+1, rw.Code, expected)
+			}
+		}
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	tests := []struct {
+		route, path, key string
+	}{
+		{"/", "/web/info", "web"},
+		{"/", "/W%45B/info?sender=other", "web"},
+		{"/echo", "/echo/w%65b/", "web"},
+		{"/bulk", "/bulk/Web", "web"},
+
+		// no sender to count against, so the address
+		{"/", "/%2e%2e/info", "192.0.2.1"},
+		{"/", "/web/info/x?sender=web", "192.0.2.1"},
+		{"/logs", "/logs/web?sender=web", "192.0.2.1"},
+		{"/stats/aggregate", "/stats/aggregate?sender=web", "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.path, nil)
+
+		if key := requestKey(req, test.route, "sender"); key != test.key {
+			t.Errorf("%s %s: got %q, expected %q", test.route, test.path, key, test.key)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"logit/logg"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-Id"
+	REQUEST_ID_MAX    = 64 // longer ids given by clients are replaced
+)
+
+// panicCounter counts recovered handler panics by route ('/' and the first
+// path segment, which bounds the label values)
+type panicCounter struct {
+	lock   *sync.Mutex
+	routes map[string]int64
+}
+
+var panics = &panicCounter{lock: &sync.Mutex{}, routes: make(map[string]int64)}
+
+func (c *panicCounter) add(route string) {
+	c.lock.Lock()
+	c.routes[route]++
+	c.lock.Unlock()
+}
+
+func (c *panicCounter) snapshot() ([]string, map[string]int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counts := make(map[string]int64, len(c.routes))
+	routes := make([]string, 0, len(c.routes))
+
+	for route, n := range c.routes {
+		counts[route] = n
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	return routes, counts
+}
+
+func routeOf(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path = path[:i]
+	}
+
+	return "/" + path
+}
+
+// requestId returns the client's X-Request-Id if it is sane, else a new one
+func requestId(req *http.Request) string {
+	id := req.Header.Get(REQUEST_ID_HEADER)
+
+	if id != "" && len(id) <= REQUEST_ID_MAX && strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:") == "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// trackingWriter remembers whether the response was started, so a panic
+// after that isn't answered with a second header. it passes on Flush and
+// Hijack, which the tail and websocket handlers need.
+type trackingWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *trackingWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *trackingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		f.Flush()
+	}
+}
+
+func (w *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be taken over")
+	}
+
+	w.started = true
+	return h.Hijack()
+}
+
+// recoverPanics gives every request an id (answered in X-Request-Id, and in
+// its context for what handlers log) and turns a panic of h into a 500
+// naming it, logged with its stack to the server's logger instead of
+// net/http's own stderr trace
+func recoverPanics(h http.Handler, logger *logg.Logger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := requestId(req)
+		rw.Header().Set(REQUEST_ID_HEADER, id)
+
+		// so what handlers log of the request names it too
+		req = req.WithContext(logg.ContextWithFields(req.Context(), logg.Fields{"request_id": id}))
+
+		tw := &trackingWriter{ResponseWriter: rw}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+
+			if v == http.ErrAbortHandler {
+				// the handler's way of cutting a response short
+				panic(v)
+			}
+
+			route := routeOf(req.URL.Path)
+			panics.add(route)
+
+			logger.WithContext(req.Context()).With("method", req.Method, "path", req.URL.Path, "remote", req.RemoteAddr).
+				Errorf("panic serving %s: %v\n%s", route, v, debug.Stack())
+
+			if tw.started {
+				// cut the connection rather than end a partial response
+				panic(http.ErrAbortHandler)
+			}
+
+			writeError(tw, ERR_INTERNAL, "internal error (request id %s)", id)
+		}()
+
+		h.ServeHTTP(tw, req)
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a rotation chain is probed this far past its last file, so a hole left by
+// an interrupted rotation doesn't hide the files behind it
+const RECOVERY_PROBE = 16
+
+type recoveryReport struct {
+	senders    int
+	renumbered int
+	compressed int
+	cleaned    int
+	failed     int
+}
+
+func (r recoveryReport) String() string {
+	return fmt.Sprintf("%d senders, %d rotated files renumbered, %d compressions finished, %d leftovers removed, %d failures",
+		r.senders, r.renumbered, r.compressed, r.cleaned, r.failed)
+}
+
+// recover scans the log directory after a restart: it finds the live files of
+// senders and opens their loggers (which resume their size counters from the
+// files), closes holes in rotation chains left by an interrupted rotation and
+// finishes interrupted compressions, removing their partial output. the
+// compressions logg's rotation state says were under way are finished first.
+func (s *fileStorage) recover() recoveryReport {
+	var report recoveryReport
+
+	if s.dir == "" {
+		return report
+	}
+
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if fi.IsDir() {
+			if path == filepath.Join(s.dir, REPLICATION_DIR) || path == filepath.Join(s.dir, ARCHIVE_DIR) || path == filepath.Join(s.dir, SEARCH_INDEX_DIR) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// a directory's state file sorts before the files it names, so they
+		// are whole again by the time the chains are walked
+		if fi.Name() == logg.ROTATION_STATE_FILE {
+			r, err := logg.RecoverRotations(filepath.Dir(path))
+			if err != nil {
+				s.logger.Errorf("finishing interrupted rotations in '%s' failed: %v", filepath.Dir(path), err)
+			}
+
+			report.compressed += r.Finished
+			report.cleaned += r.Cleaned
+			report.failed += r.Failed
+			return nil
+		}
+
+		// a compression cut short; the plain file it read is still there
+		if strings.HasSuffix(path, ".tmp") && isCompressed(strings.TrimSuffix(path, ".tmp")) {
+			if os.Remove(path) == nil {
+				report.cleaned += 1
+			}
+			return nil
+		}
+
+		sender, area, ok := s.senderOf(path, fi)
+		if !ok {
+			return nil
+		}
+
+		rotatedName := namer.rotatedNameFunc(sender, path, fi.ModTime())
+		s.repairChain(sender, rotatedName, &report)
+
+		// only files still being written to get a logger; older dated ones
+		// merely had their chain repaired
+		current, err := namer.live(sender, time.Now())
+		if err == nil {
+			current = areaPath(s.dir, area, current)
+		}
+
+		if err == nil && current == path {
+			if _, err := s.warmUp(sender, area); err != nil {
+				report.failed += 1
+			}
+			report.senders += 1
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("log directory scan failed: %v", err)
+	}
+
+	return report
+}
+
+// warmUp opens the logger of a sender ahead of its first entry; the error
+// tells why its file can't be written (the logger then writes to stdout)
+func (s *fileStorage) warmUp(sender, area string) (string, error) {
+	key := sender
+	if area != "" {
+		key = area + "/" + sender
+	}
+
+	s.loggerOf(sender, area)
+
+	lock.Lock()
+	path := loggerPaths[key]
+	lock.Unlock()
+
+	if path == "" && s.dir != "" {
+		return "", fmt.Errorf("can't open the log file of '%s'", key)
+	}
+
+	return path, nil
+}
+
+// warmUpSenders opens the loggers of -warm-up ('<sender>' or
+// '<area>/<sender>', comma separated) and returns what failed
+func (s *fileStorage) warmUpSenders(spec string) []error {
+	var errs []error
+
+	for _, key := range strings.Split(spec, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+
+		area, sender := "", key
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			area, sender = key[:i], key[i+1:]
+		}
+
+		if sender == "" || strings.HasPrefix(sender, ".") || strings.Contains(area, "..") {
+			errs = append(errs, fmt.Errorf("invalid sender '%s'", key))
+			continue
+		}
+
+		if _, err := s.warmUp(aliases.resolve(sender), area); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// senderOf tells whether path is the live file of a sender, and in which
+// area, trying every path component as the sender name
+func (s *fileStorage) senderOf(path string, fi os.FileInfo) (string, string, bool) {
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil {
+		return "", "", false
+	}
+
+	var area string
+
+	if parts := strings.SplitN(rel, string(filepath.Separator), 2); len(parts) == 2 {
+		if parts[0] == QUARANTINE_DIR || strings.HasPrefix(parts[0], RETAIN_DIR_PREFIX) {
+			area = parts[0]
+		}
+	}
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		sender := part
+		if i := strings.Index(sender, "."); i >= 0 {
+			sender = sender[:i]
+		}
+
+		// the server's own logs are not senders
+		if sender == "" || sender == "logit" || part == accessLog || part == area {
+			continue
+		}
+
+		live, err := namer.live(sender, fi.ModTime())
+		if err != nil {
+			continue
+		}
+
+		if areaPath(s.dir, area, live) == path {
+			return sender, area, true
+		}
+	}
+
+	return "", "", false
+}
+
+// repairChain renumbers the rotated files of a live file so they are
+// contiguous from 0 again, and compresses files whose compression was
+// interrupted
+func (s *fileStorage) repairChain(sender string, rotatedName func(i int) string, report *recoveryReport) {
+	type rotated struct {
+		i      int
+		plain  bool
+		suffix string // of the compressed file, if there is one
+	}
+
+	var chain []rotated
+
+	for i, misses := 0, 0; misses < RECOVERY_PROBE; i++ {
+		if i > 0 && rotatedName(i) == rotatedName(0) {
+			// a template without {{.N}}; there is no chain to walk
+			break
+		}
+
+		_, err := os.Stat(rotatedName(i))
+		compressed, ok := compressedPath(rotatedName(i))
+
+		if err != nil && !ok {
+			misses += 1
+			continue
+		}
+
+		r := rotated{i: i, plain: err == nil}
+		if ok {
+			r.suffix = strings.TrimPrefix(compressed, rotatedName(i))
+		}
+
+		misses = 0
+		chain = append(chain, r)
+	}
+
+	for n, r := range chain {
+		if r.i != n {
+			// moving down never overwrites: n is below every index still to move
+			if r.plain {
+				os.Rename(rotatedName(r.i), rotatedName(n))
+			}
+			if r.suffix != "" {
+				os.Rename(rotatedName(r.i)+r.suffix, rotatedName(n)+r.suffix)
+			}
+
+			report.renumbered += 1
+		}
+
+		// a plain file next to a compressed one is a compression that didn't
+		// finish, and a plain newest file may not have been started on
+		if r.plain && (r.suffix != "" || (n == 0 && gzPrefs.enabled(sender))) {
+			if err := compressFile(rotatedName(n)); err != nil {
+				s.logger.Errorf("compressing '%s' failed: %v", rotatedName(n), err)
+				report.failed += 1
+			} else {
+				report.compressed += 1
+			}
+		}
+	}
+}
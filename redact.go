@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"logit/logg"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// REDACT_FIELD names a field masked whole in a rule set, e.g. 'field:password'
+const REDACT_FIELD = "field:"
+
+// loadRedactRules reads a rules file where each non-empty line is
+// '<name> <regexp>', the name then usable in rule sets besides the built-in
+// ones; matches become '[REDACTED:<name>]'
+func loadRedactRules(path string) (map[string]logg.RedactRule, error) {
+	rules := make(map[string]logg.RedactRule)
+	if path == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno += 1
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected '<name> <regexp>'", path, lineno)
+		}
+
+		name := ss[0]
+		if strings.ContainsAny(name, "+=,:") || name == "off" {
+			return nil, fmt.Errorf("%s:%d: invalid rule name '%s'", path, lineno, name)
+		}
+
+		if _, ok := rules[name]; ok {
+			return nil, fmt.Errorf("%s:%d: rule '%s' defined twice", path, lineno, name)
+		}
+
+		re, err := regexp.Compile(strings.TrimSpace(ss[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid regexp: %v", path, lineno, err)
+		}
+
+		rules[name] = logg.RedactRule{Name: name, Pattern: re, Replacement: "[REDACTED:" + name + "]"}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// parseRedactRules parses a rule set like 'email+card+field:password', of
+// rules of the rules file, the built-in email, card, token, jwt and secret,
+// and fields masked whole; 'off' redacts nothing. without custom (when a
+// config is checked before the rules file is loaded) any name passes.
+func parseRedactRules(s string, custom map[string]logg.RedactRule) (*logg.Redactor, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "" {
+		return nil, nil
+	}
+
+	var rules []logg.RedactRule
+	var fields []string
+
+	for _, name := range strings.Split(s, "+") {
+		name = strings.TrimSpace(name)
+
+		if strings.HasPrefix(name, REDACT_FIELD) {
+			field := strings.TrimSpace(name[len(REDACT_FIELD):])
+			if field == "" {
+				return nil, fmt.Errorf("invalid redaction rules '%s': field name missing", s)
+			}
+
+			fields = append(fields, field)
+			continue
+		}
+
+		rule, ok := custom[name]
+		if !ok {
+			rule, ok = logg.RedactRuleNamed(name)
+		}
+
+		if !ok && custom == nil && name != "" {
+			continue
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("invalid redaction rules '%s': unknown rule '%s' (expected email, card, token, jwt, secret, field:<name> or one of -redact-rules)", s, name)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return logg.NewRedactor(rules, fields...), nil
+}
+
+// redactPolicy holds the rule sets of every sender
+type redactPolicy struct {
+	lock    *sync.RWMutex
+	def     *logg.Redactor // nil redacts nothing
+	senders *senderValues[*logg.Redactor]
+}
+
+// newRedactPolicy parses the default rule set and per-sender overrides
+// like 'web=email+card,audit=off'
+func newRedactPolicy(defSpec, spec string, custom map[string]logg.RedactRule) (*redactPolicy, error) {
+	def, err := parseRedactRules(defSpec, custom)
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := parseSenderValues(spec, "redact", "rules", func(sender, value string) (*logg.Redactor, error) {
+		return parseRedactRules(value, custom)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &redactPolicy{lock: &sync.RWMutex{}, def: def, senders: senders}, nil
+}
+
+// enabled tells whether any sender's entries are redacted
+func (p *redactPolicy) enabled() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if !p.def.Empty() {
+		return true
+	}
+
+	for _, r := range p.senders.all() {
+		if !r.Empty() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *redactPolicy) redactor(sender string) *logg.Redactor {
+	if r, ok := p.senders.get(sender); ok {
+		return r
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.def
+}
+
+// update takes the default and overrides of next, e.g. of a reloaded
+// config, after dropping those of removed senders
+func (p *redactPolicy) update(next *redactPolicy, removed []string) {
+	p.lock.Lock()
+	p.def = next.def
+	p.lock.Unlock()
+
+	p.senders.update(next.senders, removed)
+}
+
+// stage is the pipeline stage scrubbing the message and fields of entries
+// by their sender's rules before anything stores or forwards them
+func (p *redactPolicy) stage(e *entry) bool {
+	r := p.redactor(e.sender)
+	if r.Empty() {
+		return true
+	}
+
+	e.msg = r.Redact(e.msg)
+	e.fields = r.RedactFields(e.fields)
+
+	return true
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"logit/logg"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RELOAD_CLOSE_DELAY is how long a reopened sender's old logger stays open
+// for the entries being written through it
+const RELOAD_CLOSE_DELAY = 2 * time.Second
+
+var reloadLock = &sync.Mutex{}
+
+// reloadResult tells what a reload changed
+type reloadResult struct {
+	Reopened []string `json:"reopened,omitempty"` // senders whose files are reopened
+	Restart  []string `json:"restart,omitempty"`  // settings changed that need a restart
+}
+
+// reloadConfig re-reads -config (if any) and the token file, and applies
+// what can change while running: sender levels, gzip, sync, dedup, rate,
+// sample, repeats and alert settings, file names and sizes, and tokens. other changed settings are reported.
+// nothing is applied if the config doesn't load.
+func reloadConfig() (*reloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next := conf
+	if configPath != "" {
+		var err error
+
+		if next, err = loadConfig(configPath); err != nil {
+			return nil, err
+		}
+		next.given = conf.given
+	}
+
+	levels, err := newLevelPolicy(next.senderSpec("level", senderLevels))
+	if err != nil {
+		return nil, err
+	}
+
+	gzips, err := newGzipPrefs(next.senderSpec("gzip", gzSenders))
+	if err != nil {
+		return nil, err
+	}
+
+	syncs, err := newDurabilityPolicy(syncLevel, next.senderSpec("sync", syncSenders))
+	if err != nil {
+		return nil, err
+	}
+
+	noises, err := newNoisePolicy(sampleRateSpec, next.senderSpec("sample", sampleSenders), repeatWindow, next.senderSpec("repeats", repeatSenders))
+	if err != nil {
+		return nil, err
+	}
+
+	var alertLevels *alertPolicy
+	if alerts != nil {
+		if alertLevels, err = newAlertPolicy(alertLevel, next.senderSpec("alert", alertSenders)); err != nil {
+			return nil, err
+		}
+	}
+
+	var dedups *dedupPolicy
+	if dedup != nil {
+		if dedups, err = newDedupPolicy(dedup.policy.def, next.senderSpec("dedup", dedupSenders)); err != nil {
+			return nil, err
+		}
+	}
+
+	var redactions *redactPolicy
+	if redaction != nil {
+		custom, err := loadRedactRules(redactRules)
+		if err != nil {
+			return nil, err
+		}
+
+		if redactions, err = newRedactPolicy(redactSpec, next.senderSpec("redact", redactSenders), custom); err != nil {
+			return nil, err
+		}
+	}
+
+	var transformed *transformPolicy
+	if transforms != nil {
+		if transformed, err = newTransformPolicy(transformSpec, next.senderSpec("transform", transformSenders)); err != nil {
+			return nil, err
+		}
+	}
+
+	var quotaed *quotaPolicy
+	if quotas != nil {
+		if quotaed, err = newQuotaPolicy(quotaSpec, quotaTotal, next.senderSpec("quota", quotaSenders)); err != nil {
+			return nil, err
+		}
+	}
+
+	rates, err := newSenderLimiter(senderLimits.def, next.senderSpec("rate", senderRates))
+	if err != nil {
+		return nil, err
+	}
+
+	var names *fileNamer
+	if namer != nil {
+		if names, err = newFileNamer(logFilePath, fileTemplate, rotatedTemplate, fileTemplateFile); err != nil {
+			return nil, err
+		}
+		next.applyTemplates(names)
+	}
+
+	var tokens *tokenAuth
+	if len(tokenAuths) > 0 {
+		authConf := authConfig{tokenFile: authTokens, tokenSpec: authTokenList}
+		if next != nil {
+			authConf.tokens = next.tokens
+		}
+
+		if tokens, err = newTokenAuth(authConf); err != nil {
+			return nil, err
+		}
+	}
+
+	// all loaded; apply
+	r := &reloadResult{Restart: conf.changedFlags(next)}
+
+	levelPrefs.update(levels, conf.removedSenders(next, "level"))
+	gzPrefs.senders.update(gzips.senders, conf.removedSenders(next, "gzip"))
+	syncPrefs.senders.update(syncs.senders, conf.removedSenders(next, "sync"))
+	noisePrefs.update(noises, conf.removedSenders(next, "sample"), conf.removedSenders(next, "repeats"))
+
+	senderLimits.senders.update(rates.senders, conf.removedSenders(next, "rate"))
+
+	if alertLevels != nil {
+		alerts.policy.senders.update(alertLevels.senders, conf.removedSenders(next, "alert"))
+	}
+
+	if dedups != nil {
+		dedup.policy.senders.update(dedups.senders, conf.removedSenders(next, "dedup"))
+	}
+
+	if redactions != nil {
+		redaction.update(redactions, conf.removedSenders(next, "redact"))
+	}
+
+	if transformed != nil {
+		transforms.update(transformed, conf.removedSenders(next, "transform"))
+	}
+
+	if quotaed != nil {
+		quotas.update(quotaed, conf.removedSenders(next, "quota"))
+	}
+
+	if names != nil {
+		namer.update(names)
+	}
+
+	for _, a := range tokenAuths {
+		a.update(tokens)
+	}
+
+	for _, sender := range conf.filesChanged(next) {
+		if reopenSender(sender) {
+			r.Reopened = append(r.Reopened, sender)
+		}
+	}
+
+	// the flags keep the values they started with, which later reloads
+	// compare to
+	if next != nil {
+		next.flags = conf.flags
+	}
+	conf = next
+
+	return r, nil
+}
+
+// changedFlags lists the settings of the file that differ in next and that
+// the command line doesn't override; they only apply after a restart
+func (c *configFile) changedFlags(next *configFile) []string {
+	if c == nil || next == nil {
+		return nil
+	}
+
+	var keys []string
+
+	for name, v := range next.flags {
+		if old, ok := c.flags[name]; (!ok || old.value != v.value) && !c.given[name] {
+			keys = append(keys, v.key)
+		}
+	}
+
+	for name, v := range c.flags {
+		if _, ok := next.flags[name]; !ok && !c.given[name] {
+			keys = append(keys, v.key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// removedSenders lists the senders that had a level, gzip, sync, dedup, rate,
+// sample, repeats or alert setting in c and have none in next
+func (c *configFile) removedSenders(next *configFile, kind string) []string {
+	if c == nil {
+		return nil
+	}
+
+	var removed []string
+
+	for _, sender := range c.senderNames() {
+		if c.senders[sender].setting(kind) == "" {
+			continue
+		}
+
+		if s, ok := next.senders[sender]; !ok || s.setting(kind) == "" {
+			removed = append(removed, sender)
+		}
+	}
+
+	return removed
+}
+
+// filesChanged lists the senders whose file template or size differ in next
+func (c *configFile) filesChanged(next *configFile) []string {
+	if c == nil || next == nil {
+		return nil
+	}
+
+	none := &senderConfig{}
+	senders := make(map[string]bool)
+
+	for _, cf := range []*configFile{c, next} {
+		for sender := range cf.senders {
+			senders[sender] = true
+		}
+	}
+
+	var changed []string
+
+	for sender := range senders {
+		old, ok := c.senders[sender]
+		if !ok {
+			old = none
+		}
+
+		s, ok := next.senders[sender]
+		if !ok {
+			s = none
+		}
+
+		if old.file != s.file || old.rotated != s.rotated || old.maxSize != s.maxSize ||
+			old.maxBackups != s.maxBackups || old.maxAgeDays != s.maxAgeDays {
+			changed = append(changed, sender)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
+
+// reopenSender drops the open loggers of a sender (every area, late files
+// aside) so its next entry opens them with the current settings. the old
+// ones are closed a little later, after the writes under way.
+func reopenSender(sender string) bool {
+	var old []*logg.Logger
+
+	for key, l := range logg.Loggers() {
+		if strings.HasPrefix(key, LATE_DIR+"/") {
+			continue
+		}
+
+		if (key == sender || strings.HasSuffix(key, "/"+sender)) && logg.Unregister(key, l) {
+			old = append(old, l)
+
+			lock.Lock()
+			delete(loggerPaths, key)
+			lock.Unlock()
+		}
+	}
+
+	for _, l := range old {
+		l := l
+		time.AfterFunc(RELOAD_CLOSE_DELAY, func() { l.Close() })
+	}
+
+	return len(old) > 0
+}
+
+// logReload reports a reload to the server's logger
+func logReload(logger *logg.Logger, r *reloadResult, err error) {
+	if err != nil {
+		logger.Errorf("reloading config failed, keeping the current one: %v", err)
+		return
+	}
+
+	logger.Infof("config reloaded")
+
+	if len(r.Reopened) > 0 {
+		logger.Infof("reopened the files of %s", strings.Join(r.Reopened, ", "))
+	}
+
+	if len(r.Restart) > 0 {
+		logger.Warnf("changes to %s apply after a restart", strings.Join(r.Restart, ", "))
+	}
+}
+
+// makeReloadAdminHandler serves POST /admin/reload, doing what SIGHUP does
+func makeReloadAdminHandler(logger *logg.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		r, err := reloadConfig()
+		logReload(logger, r, err)
+
+		if err != nil {
+			writeError(rw, ERR_INTERNAL, "reloading config failed: %v", err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(r)
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logit/logg"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	REPLICATION_DIR         = "replication"
+	REPLICATION_BATCH       = 256
+	REPLICATION_MAX_BACKOFF = 30 * time.Second
+	REPLICATION_MAX_BODY    = 64 * 1024 * 1024
+)
+
+// replicatedEntry is the wire and journal form of an entry
+type replicatedEntry struct {
+	Sender string    `json:"sender"`
+	Seq    uint64    `json:"seq"`
+	Level  string    `json:"level"`
+	Msg    string    `json:"msg"`
+	Time   time.Time `json:"time"`
+	Retain string    `json:"retain,omitempty"`
+	At     time.Time `json:"at,omitempty"` // client event time, if told
+
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Quarantined bool                   `json:"quarantined,omitempty"`
+	Id          string                 `json:"id,omitempty"`
+}
+
+// decodeReplicated reads JSON of replicated entries, keeping the numbers of
+// their fields as they were written
+func decodeReplicated(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+type replicationRequest struct {
+	Origin  string            `json:"origin"`
+	Entries []replicatedEntry `json:"entries"`
+}
+
+type replicationResponse struct {
+	Acks map[string]uint64 `json:"acks"` // sender -> highest applied seq
+}
+
+// writeJSONFile atomically replaces path with v
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// replicatorState is persisted by the origin: everything in the journal
+// before Offset was acknowledged by the peer, and Seqs holds the last
+// sequence number given to each sender
+type replicatorState struct {
+	Offset int64             `json:"offset"`
+	Seqs   map[string]uint64 `json:"seqs"`
+}
+
+// replicator journals every locally accepted entry with a per-sender
+// sequence number and ships the journal to a peer, advancing only on the
+// peer's cumulative acknowledgements. together with the peer's persisted
+// high-water marks, replaying after an outage neither loses nor duplicates
+// entries (short of a crash between the peer writing a batch and persisting
+// its marks).
+type replicator struct {
+	name   string // of the sink, see newReplicators
+	peer   string
+	origin string
+	logger *logg.Logger
+	client *http.Client
+
+	statePath   string
+	journalPath string
+
+	lock    *sync.Mutex
+	state   replicatorState // Seqs covers the whole journal
+	journal *os.File
+	notify  chan struct{}
+
+	paused int32 // atomic
+	marker pauseMarker
+}
+
+// newReplicators makes a replicator for each of the comma separated peers,
+// each with a journal of its own so a peer that is away holds up no other.
+// the sink of a single peer is 'replication', those of several
+// 'replication@<host:port>'.
+func newReplicators(dir, peers, origin string, logger *logg.Logger) ([]*replicator, error) {
+	var rs []*replicator
+	seen := make(map[string]bool)
+
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer == "" {
+			continue
+		}
+
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer '%s' (expected http:// or https://)", peer)
+		}
+
+		if seen[u.Host] {
+			return nil, fmt.Errorf("peer '%s' given twice", u.Host)
+		}
+		seen[u.Host] = true
+
+		r, err := newReplicator(dir, peer, origin, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		r.name = "replication@" + u.Host
+		rs = append(rs, r)
+	}
+
+	if len(rs) == 1 {
+		rs[0].name = "replication"
+	}
+
+	return rs, nil
+}
+
+func newReplicator(dir, peer, origin string, logger *logg.Logger) (*replicator, error) {
+	dir = filepath.Join(dir, REPLICATION_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := strings.NewReplacer("://", "_", "/", "_", ":", "_").Replace(peer)
+
+	r := &replicator{
+		name:        "replication",
+		peer:        strings.TrimRight(peer, "/"),
+		origin:      origin,
+		logger:      logger,
+		client:      &http.Client{Timeout: 30 * time.Second, Transport: outbound},
+		statePath:   filepath.Join(dir, name+".state"),
+		journalPath: filepath.Join(dir, name+".journal"),
+		lock:        &sync.Mutex{},
+		state:       replicatorState{Seqs: make(map[string]uint64)},
+		notify:      make(chan struct{}, 1),
+		marker:      pauseMarker(filepath.Join(dir, name+".paused")),
+	}
+
+	if r.marker.isSet() {
+		r.paused = 1
+	}
+
+	if err := readJSONFile(r.statePath, &r.state); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading replication state failed: %v", err)
+	}
+
+	if r.state.Seqs == nil {
+		r.state.Seqs = make(map[string]uint64)
+	}
+
+	// a journal cut before its state was written is shipped from its start
+	if fi, err := os.Stat(r.journalPath); err == nil && fi.Size() < r.state.Offset {
+		logger.Warnf("replication journal of '%s' is shorter than its offset %d, shipping it from the start", peer, r.state.Offset)
+		r.state.Offset = 0
+	} else if os.IsNotExist(err) {
+		r.state.Offset = 0
+	}
+
+	// entries journaled after the last persisted state still own their seqs
+	err := r.scan(r.state.Offset, func(re replicatedEntry, end int64) bool {
+		if re.Seq > r.state.Seqs[re.Sender] {
+			r.state.Seqs[re.Sender] = re.Seq
+		}
+
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading replication journal failed: %v", err)
+	}
+
+	r.journal, err = os.OpenFile(r.journalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fds = append(fds, r.journal)
+
+	go r.run()
+
+	return r, nil
+}
+
+// scan reads journal entries from offset, passing each with the offset just
+// behind it; fn returns false to stop
+func (r *replicator) scan(offset int64, fn func(re replicatedEntry, end int64) bool) error {
+	f, err := os.Open(r.journalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	pos := offset
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// an incomplete last line is read again by the next scan
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		pos += int64(len(line))
+
+		var re replicatedEntry
+		if decodeReplicated(bytes.NewReader(line), &re) != nil {
+			continue
+		}
+
+		if !fn(re, pos) {
+			return nil
+		}
+	}
+}
+
+// record journals an entry accepted on this node
+func (r *replicator) record(e *entry) {
+	r.lock.Lock()
+
+	r.state.Seqs[e.sender] += 1
+
+	b, err := json.Marshal(replicatedEntry{
+		Sender: e.sender,
+		Seq:    r.state.Seqs[e.sender],
+		Level:  e.level,
+		Msg:    e.msg,
+		Time:   e.received,
+		Retain: e.retain,
+		At:     e.at,
+
+		Fields:      e.fields,
+		Quarantined: e.quarantined,
+		Id:          e.id,
+	})
+	if err == nil {
+		_, err = r.journal.Write(append(b, '\n'))
+	}
+
+	r.lock.Unlock()
+
+	if err != nil {
+		r.logger.Errorf("replication journal write failed: %v", err)
+		return
+	}
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replicator) run() {
+	backoff := time.Second
+
+	for {
+		if atomic.LoadInt32(&r.paused) != 0 {
+			// the journal keeps everything until resumed
+			select {
+			case <-r.notify:
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+
+		sent, err := r.shipBatch()
+		if err != nil {
+			r.logger.Warnf("replication to '%s' failed (retrying in %v): %v", r.peer, backoff, err)
+			time.Sleep(backoff)
+
+			if backoff *= 2; backoff > REPLICATION_MAX_BACKOFF {
+				backoff = REPLICATION_MAX_BACKOFF
+			}
+			continue
+		}
+
+		backoff = time.Second
+
+		if sent == 0 {
+			select {
+			case <-r.notify:
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+// shipBatch sends the next unacknowledged journal entries and advances the
+// persisted offset over the acknowledged prefix
+func (r *replicator) shipBatch() (int, error) {
+	r.lock.Lock()
+	offset := r.state.Offset
+	r.lock.Unlock()
+
+	var batch []replicatedEntry
+	var ends []int64
+
+	err := r.scan(offset, func(re replicatedEntry, end int64) bool {
+		batch = append(batch, re)
+		ends = append(ends, end)
+
+		return len(batch) < REPLICATION_BATCH
+	})
+	if err != nil || len(batch) == 0 {
+		return 0, err
+	}
+
+	b, err := json.Marshal(replicationRequest{Origin: r.origin, Entries: batch})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := r.client.Post(r.peer+"/replicate", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer answered %s", resp.Status)
+	}
+
+	var ack replicationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return 0, fmt.Errorf("invalid ack: %v", err)
+	}
+
+	// advance over the prefix the peer has applied
+	acked := 0
+	for acked < len(batch) && ack.Acks[batch[acked].Sender] >= batch[acked].Seq {
+		acked += 1
+	}
+
+	if acked == 0 {
+		return 0, fmt.Errorf("peer acknowledged nothing (expects '%s' seq %d, sent %d)",
+			batch[0].Sender, ack.Acks[batch[0].Sender]+1, batch[0].Seq)
+	}
+
+	return acked, r.advance(ends[acked-1])
+}
+
+func (r *replicator) advance(offset int64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.state.Offset = offset
+
+	// once everything is acknowledged the journal can start over. the state
+	// goes first: a crash before the journal is cut ships it again, which
+	// the peer skips by seq, while a cut journal under the old offset would
+	// hide the entries written after it.
+	if fi, err := r.journal.Stat(); err == nil && fi.Size() == offset {
+		r.state.Offset = 0
+
+		if err := writeJSONFile(r.statePath, &r.state); err != nil {
+			r.state.Offset = offset
+			return err
+		}
+
+		return r.journal.Truncate(0)
+	}
+
+	return writeJSONFile(r.statePath, &r.state)
+}
+
+func (r *replicator) pause() error {
+	if err := r.marker.set(true); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&r.paused, 1)
+	return nil
+}
+
+func (r *replicator) resume() error {
+	if err := r.marker.set(false); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&r.paused, 0)
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (r *replicator) status() sinkStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	st := sinkStatus{
+		Name:   r.name,
+		Paused: atomic.LoadInt32(&r.paused) != 0,
+	}
+
+	if fi, err := r.journal.Stat(); err == nil {
+		st.Buffered = fi.Size() - r.state.Offset
+	}
+
+	st.Draining = !st.Paused && st.Buffered > 0
+
+	return st
+}
+
+// replicaState is persisted by a peer: the highest applied seq per origin
+// and sender
+type replicaState struct {
+	Applied map[string]map[string]uint64 `json:"applied"`
+}
+
+type replica struct {
+	path   string
+	logger *logg.Logger
+
+	lock  *sync.Mutex
+	state replicaState
+}
+
+func newReplica(dir string, logger *logg.Logger) (*replica, error) {
+	dir = filepath.Join(dir, REPLICATION_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &replica{
+		path:   filepath.Join(dir, "applied.state"),
+		logger: logger,
+		lock:   &sync.Mutex{},
+		state:  replicaState{Applied: make(map[string]map[string]uint64)},
+	}
+
+	if err := readJSONFile(r.path, &r.state); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading replica state failed: %v", err)
+	}
+
+	if r.state.Applied == nil {
+		r.state.Applied = make(map[string]map[string]uint64)
+	}
+
+	return r, nil
+}
+
+// ServeHTTP applies entries in sequence, skipping ones already applied and
+// stopping a sender at the first gap, then answers with the high-water marks
+func (r *replica) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+		return
+	}
+
+	var rr replicationRequest
+
+	if err := decodeReplicated(io.LimitReader(req.Body, REPLICATION_MAX_BODY), &rr); err != nil || rr.Origin == "" {
+		writeError(rw, ERR_BODY_INVALID, "invalid replication batch")
+		return
+	}
+
+	if rr.Origin == nodeId {
+		// a node among its own peers, or two nodes of one -node-id
+		writeError(rw, ERR_BODY_INVALID, "entries of '%s' replicated to itself", rr.Origin)
+		return
+	}
+
+	// batches of one origin are applied one at a time
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	applied := r.state.Applied[rr.Origin]
+	if applied == nil {
+		applied = make(map[string]uint64)
+		r.state.Applied[rr.Origin] = applied
+	}
+
+	for _, re := range rr.Entries {
+		if re.Seq != applied[re.Sender]+1 {
+			// duplicate (already applied) or gap (wait for the resend)
+			continue
+		}
+
+		if err := checkSender(re.Sender); err != nil {
+			r.logger.Warnf("replicated entry of %s skipped: %v", rr.Origin, err)
+			applied[re.Sender] = re.Seq
+			continue
+		}
+
+		e := &entry{
+			sender:   re.Sender,
+			level:    re.Level,
+			msg:      re.Msg,
+			fields:   re.Fields,
+			received: re.Time,
+			at:       re.At,
+			retain:   re.Retain,
+			origin:   rr.Origin,
+
+			quarantined: re.Quarantined,
+			id:          re.Id,
+		}
+
+		if err := deliver(e); err != nil {
+			r.logger.Errorf("applying replicated entry of '%s' failed: %v", re.Sender, err)
+			break
+		}
+
+		applied[re.Sender] = re.Seq
+	}
+
+	// marks must not get ahead of what is on disk
+	logg.Flush()
+
+	if err := writeJSONFile(r.path, &r.state); err != nil {
+		r.logger.Errorf("persisting replica state failed: %v", err)
+		writeError(rw, ERR_INTERNAL, "persisting replica state failed")
+		return
+	}
+
+	acks := make(map[string]uint64)
+	for _, re := range rr.Entries {
+		acks[re.Sender] = applied[re.Sender]
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(replicationResponse{Acks: acks})
+}
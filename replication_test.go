@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"logit/logg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicationTestPeer acknowledges every entry it is sent and keeps them
+type replicationTestPeer struct {
+	lock    sync.Mutex
+	entries []replicatedEntry
+}
+
+func (p *replicationTestPeer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var rr replicationRequest
+	if err := decodeReplicated(req.Body, &rr); err != nil {
+		writeError(rw, ERR_BODY_INVALID, "%v", err)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	acks := make(map[string]uint64)
+	for _, re := range rr.Entries {
+		p.entries = append(p.entries, re)
+		acks[re.Sender] = re.Seq
+	}
+
+	json.NewEncoder(rw).Encode(replicationResponse{Acks: acks})
+}
+
+// received waits for n entries
+func (p *replicationTestPeer) received(t *testing.T, n int) []replicatedEntry {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		p.lock.Lock()
+		entries := p.entries
+		p.lock.Unlock()
+
+		if len(entries) >= n {
+			return entries
+		}
+	}
+
+	t.Fatalf("the peer got no %d entries", n)
+	return nil
+}
+
+// journalDrained waits for the journal of r to be cut once acknowledged
+func journalDrained(t *testing.T, r *replicator) replicatorState {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var st replicatorState
+		fi, err := os.Stat(r.journalPath)
+
+		if err == nil && fi.Size() == 0 && readJSONFile(r.statePath, &st) == nil {
+			return st
+		}
+	}
+
+	t.Fatalf("the journal wasn't cut")
+	return replicatorState{}
+}
+
+// the fields of an entry are replicated as they are, not rendered into its
+// msg
+func TestReplicatorFields(t *testing.T) {
+	peer := &replicationTestPeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	r, err := newReplicator(t.TempDir(), server.URL, "a", logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.record(&entry{
+		sender:   "web",
+		level:    "info",
+		msg:      "signed in",
+		fields:   map[string]interface{}{"user": "ann", "n": int64(1) << 60},
+		received: time.Now(),
+		id:       "a1",
+	})
+
+	re := peer.received(t, 1)[0]
+
+	if re.Msg != "signed in" || re.Id != "a1" || re.Seq != 1 {
+		t.Errorf("got %+v", re)
+	}
+
+	if re.Fields["user"] != "ann" || re.Fields["n"] != json.Number("1152921504606846976") {
+		t.Errorf("got fields %#v", re.Fields)
+	}
+
+	if st := journalDrained(t, r); st.Offset != 0 || st.Seqs["web"] != 1 {
+		t.Errorf("got state %+v, expected offset 0 and seq 1", st)
+	}
+}
+
+// a state whose offset is past the end of its journal, as left by a crash
+// once the journal was cut, ships the journal from its start rather than
+// skip what was written since
+func TestReplicatorStaleOffset(t *testing.T) {
+	peer := &replicationTestPeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	dir := filepath.Join(t.TempDir(), REPLICATION_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, strings.NewReplacer("://", "_", "/", "_", ":", "_").Replace(server.URL))
+
+	b, _ := json.Marshal(replicatedEntry{Sender: "web", Seq: 1, Level: "info", Msg: "after the cut", Time: time.Now()})
+	if err := os.WriteFile(name+".journal", append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeJSONFile(name+".state", replicatorState{Offset: 4096, Seqs: map[string]uint64{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newReplicator(filepath.Dir(dir), server.URL, "a", logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if re := peer.received(t, 1)[0]; re.Msg != "after the cut" || re.Seq != 1 {
+		t.Errorf("got %+v", re)
+	}
+
+	if st := journalDrained(t, r); st.Seqs["web"] != 1 {
+		t.Errorf("got state %+v, expected seq 1", st)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entries of a retention class are stored apart, below '<dir>/retain-<class>',
+// so each class can expire on its own schedule
+const RETAIN_DIR_PREFIX = "retain-"
+
+// retainClasses are the classes clients may ask for with ?retain= or a
+// top-level "retain" field, by name
+var retainClasses map[string]time.Duration
+
+// parseRetainDuration parses Go durations plus days, weeks and years
+// ('36h', '7d', '2w', '7y')
+func parseRetainDuration(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour, 'y': 365 * 24 * time.Hour}
+
+	if s != "" {
+		if unit, ok := units[s[len(s)-1]]; ok {
+			n, err := strconv.Atoi(s[:len(s)-1])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid retention '%s'", s)
+			}
+
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention '%s'", s)
+	}
+
+	return d, nil
+}
+
+// parseRetainClasses parses -retain-classes, e.g. '1d,30d,7y'
+func parseRetainClasses(spec string) (map[string]time.Duration, error) {
+	classes := make(map[string]time.Duration)
+
+	for _, class := range strings.Split(spec, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		if class == "" {
+			continue
+		}
+
+		d, err := parseRetainDuration(class)
+		if err != nil {
+			return nil, err
+		}
+
+		classes[class] = d
+	}
+
+	return classes, nil
+}
+
+// retainClassOf returns the class an entry asked for, "" for none
+func retainClassOf(param string, body []byte, isJSON bool) (string, error) {
+	class := param
+
+	if class == "" && isJSON && len(retainClasses) > 0 {
+		var obj struct {
+			Retain string `json:"retain"`
+		}
+
+		if json.Unmarshal(body, &obj) == nil {
+			class = obj.Retain
+		}
+	}
+
+	class = strings.ToLower(strings.TrimSpace(class))
+	if class == "" {
+		return "", nil
+	}
+
+	if _, ok := retainClasses[class]; !ok {
+		names := make([]string, 0, len(retainClasses))
+		for name := range retainClasses {
+			names = append(names, name)
+		}
+
+		return "", fmt.Errorf("unknown retention class '%s' (configured: %s)", class, strings.Join(names, ", "))
+	}
+
+	return class, nil
+}
+
+// areaPath places a file of the default layout into an area (a directory
+// below the log directory, such as the quarantine or a retention class)
+func areaPath(logFilePath, area, path string) string {
+	if area == "" {
+		return path
+	}
+
+	rel, err := filepath.Rel(logFilePath, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+
+	return filepath.Join(logFilePath, area, rel)
+}
+
+// retainOfArea returns the retention of an area, false when it is not a
+// retention class
+func retainOfArea(area string) (time.Duration, bool) {
+	if !strings.HasPrefix(area, RETAIN_DIR_PREFIX) {
+		return 0, false
+	}
+
+	d, ok := retainClasses[strings.TrimPrefix(area, RETAIN_DIR_PREFIX)]
+
+	return d, ok
+}
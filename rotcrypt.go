@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"logit/logg"
+	"os"
+)
+
+const (
+	ROTATED_MAGIC = "LGTE"
+	ROTATED_CHUNK = 64 * 1024 // plaintext sealed at a time
+)
+
+// rotatedCipher encrypts rotated files with AES-256-GCM in chunks (the
+// STREAM construction): a header of ROTATED_MAGIC, version 1, the key's id
+// and a random 7 byte nonce prefix, then the chunks, each sealed under the
+// prefix, its number and a flag marking the last one, so chunks can be
+// neither reordered nor cut off unnoticed
+type rotatedCipher struct {
+	aead cipher.AEAD
+	id   [4]byte // sha256 of the key, for telling keys apart
+}
+
+// newRotatedCipher loads the key of -encrypt-rotated-key, or of
+// $LOGIT_ROTATED_KEY holding the key itself
+func newRotatedCipher(keyFile string) (*rotatedCipher, error) {
+	var key []byte
+	var err error
+
+	if keyFile != "" {
+		key, err = readKeyFile(keyFile)
+	} else {
+		key, err = parseKey(os.Getenv("LOGIT_ROTATED_KEY"), "$LOGIT_ROTATED_KEY")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rotatedCipher{aead: aead}
+
+	sum := sha256.Sum256(key)
+	copy(c.id[:], sum[:])
+
+	return c, nil
+}
+
+func (c *rotatedCipher) nonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], n)
+
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// Seal is the logg.Sealer of rotated files
+func (c *rotatedCipher) Seal(w io.Writer) (io.WriteCloser, error) {
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(ROTATED_MAGIC), 1)
+	header = append(header, c.id[:]...)
+
+	if _, err := w.Write(append(header, prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &sealWriter{c: c, w: w, prefix: prefix, buf: make([]byte, 0, ROTATED_CHUNK)}, nil
+}
+
+type sealWriter struct {
+	c      *rotatedCipher
+	w      io.Writer
+	prefix []byte
+	n      uint32
+	buf    []byte
+	sealed []byte
+}
+
+// Write seals full chunks once more follows, as the last one is sealed
+// differently
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		if len(s.buf) == ROTATED_CHUNK {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.buf[len(s.buf):ROTATED_CHUNK], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (s *sealWriter) seal(last bool) error {
+	if s.n == ^uint32(0) {
+		return fmt.Errorf("file too large to encrypt")
+	}
+
+	s.sealed = s.c.aead.Seal(s.sealed[:0], s.c.nonce(s.prefix, s.n, last), s.buf, nil)
+	s.n++
+	s.buf = s.buf[:0]
+
+	_, err := s.w.Write(s.sealed)
+
+	return err
+}
+
+// Close seals the last chunk, empty if need be; it leaves w open
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+// open returns a reader decrypting r, a file sealed by c
+func (c *rotatedCipher) open(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(ROTATED_MAGIC)+1+4+7)
+
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != ROTATED_MAGIC {
+		return nil, fmt.Errorf("not an encrypted log file")
+	}
+
+	if header[4] != 1 {
+		return nil, fmt.Errorf("unknown encryption version %d", header[4])
+	}
+
+	if !bytes.Equal(header[5:9], c.id[:]) {
+		return nil, fmt.Errorf("encrypted with another key (id %x, ours %x)", header[5:9], c.id[:])
+	}
+
+	return &openReader{c: c, r: bufio.NewReaderSize(r, ROTATED_CHUNK+64), prefix: header[9:]}, nil
+}
+
+type openReader struct {
+	c      *rotatedCipher
+	r      *bufio.Reader
+	prefix []byte
+	n      uint32
+	chunk  []byte
+	plain  []byte // what is left of the chunk opened last
+	done   bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	if o.chunk == nil {
+		o.chunk = make([]byte, ROTATED_CHUNK+o.c.aead.Overhead())
+	}
+
+	n, err := io.ReadFull(o.r, o.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			err = fmt.Errorf("encrypted log file cut short")
+		}
+		return err
+	}
+
+	// the last chunk is the one nothing follows
+	_, perr := o.r.Peek(1)
+	last := perr == io.EOF
+
+	plain, err := o.c.aead.Open(o.chunk[:0], o.c.nonce(o.prefix, o.n, last), o.chunk[:n], nil)
+	if err != nil {
+		if !last {
+			return fmt.Errorf("encrypted log file damaged (chunk %d)", o.n)
+		}
+		return fmt.Errorf("encrypted log file damaged or cut short (chunk %d)", o.n)
+	}
+
+	o.n++
+	o.plain = plain
+	o.done = last
+
+	return nil
+}
+
+// runDecrypt is 'logit decrypt [-key file] <file>': it writes the content
+// of a rotated file encrypted with -encrypt-rotated-key to stdout, still
+// compressed if it was (e.g. 'logit decrypt web.log.0.gz.enc | zcat').
+// returns the exit code.
+func runDecrypt(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+
+	keyFile := fs.String("key", "", "key file, as -encrypt-rotated-key (default: $LOGIT_ROTATED_KEY)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: logit decrypt [-key file] <file%s>\n", logg.ENCRYPTED_SUFFIX)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	c, err := newRotatedCipher(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	r, err := c.open(f)
+	if err == nil {
+		_, err = io.Copy(os.Stdout, r)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+
+	return 0
+}
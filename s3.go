@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	S3_EMPTY_SHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	S3_MAX_PUT      = 5 << 30 // larger objects need a multipart upload
+)
+
+// s3Client puts objects to an S3-compatible store (AWS, MinIO, Ceph, ...)
+// with path-style urls and Signature Version 4
+type s3Client struct {
+	endpoint string // scheme://host[:port]
+	region   string
+	bucket   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+func newS3Client(endpoint, region, bucket string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s' (expected http:// or https://)", endpoint)
+	}
+
+	c := &s3Client{
+		endpoint:     u.Scheme + "://" + u.Host,
+		region:       region,
+		bucket:       bucket,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 10 * time.Minute, Transport: outbound},
+	}
+
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("no s3 credentials ($AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY)")
+	}
+
+	return c, nil
+}
+
+// putFile uploads the file at path as key
+func (c *s3Client) putFile(ctx context.Context, path, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() > S3_MAX_PUT {
+		return fmt.Errorf("%s is larger than a single put takes (%d bytes)", path, fi.Size())
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", c.endpoint+c.objectPath(key), f)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+
+	return c.do(req.WithContext(ctx))
+}
+
+// headBucket checks that the bucket is there and ours to reach
+func (c *s3Client) headBucket(ctx context.Context) error {
+	req, err := http.NewRequest("HEAD", c.endpoint+"/"+s3Escape(c.bucket), nil)
+	if err != nil {
+		return err
+	}
+
+	c.sign(req, S3_EMPTY_SHA256, time.Now())
+
+	return c.do(req.WithContext(ctx))
+}
+
+func (c *s3Client) do(req *http.Request) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s answers %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func (c *s3Client) objectPath(key string) string {
+	return "/" + s3Escape(c.bucket) + "/" + s3Escape(key)
+}
+
+// s3Escape percent-encodes all but the unreserved characters and '/', as
+// the canonical uri of SigV4 wants it for S3
+func s3Escape(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// sign adds the Signature Version 4 headers for a request without a query
+// and a body of the given sha256
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	// the headers signed, by name in order
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if c.sessionToken != "" {
+		names = append(names, "x-amz-security-token")
+		values["x-amz-security-token"] = c.sessionToken
+	}
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), "", headers.String(), signed, payloadHash}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+
+	return m.Sum(nil)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sampleRate has a sender's logger write 1 of every n entries at level or
+// below; n <= 1 writes them all
+type sampleRate struct {
+	level logg.LogLevel
+	n     int
+}
+
+// parseSampleRate parses '<level>/<n>' (e.g. 'debug/100') or 'off'
+func parseSampleRate(s string) (sampleRate, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "off" {
+		return sampleRate{}, nil
+	}
+
+	ss := strings.SplitN(s, "/", 2)
+	if len(ss) == 2 {
+		switch ss[0] {
+		case "trace", "debug", "info", "warn", "error":
+			if n, err := strconv.Atoi(ss[1]); err == nil && n > 0 {
+				return sampleRate{logg.LogLevelFrom(ss[0], 0), n}, nil
+			}
+		}
+	}
+
+	return sampleRate{}, fmt.Errorf("invalid sample rate '%s' (expected e.g. 'debug/100' or 'off')", s)
+}
+
+// noisePolicy holds the sample rates and repeat windows of every sender
+type noisePolicy struct {
+	defRate   sampleRate
+	defWindow time.Duration
+	rates     *senderValues[sampleRate]
+	windows   *senderValues[time.Duration]
+}
+
+// newNoisePolicy takes the defaults and "sender=level/n,..." and
+// "sender=duration,..." overrides
+func newNoisePolicy(rate string, rateSpec string, window time.Duration, windowSpec string) (*noisePolicy, error) {
+	def, err := parseSampleRate(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := parseSenderValues(rateSpec, "sample", "level/n", forSender(parseSampleRate))
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := parseDurationSpec(windowSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &noisePolicy{defRate: def, defWindow: window, rates: rates, windows: windows}, nil
+}
+
+// apply sets the sample rate and repeat window of the sender's logger
+func (p *noisePolicy) apply(logger *logg.Logger, sender string) {
+	rate := p.rates.or(sender, p.defRate)
+	logger.SetSampling(rate.level, rate.n)
+	logger.SetRepeatWindow(p.windows.or(sender, p.defWindow))
+}
+
+// update takes the overrides of next, e.g. of a reloaded config, after
+// dropping those of removed senders
+func (p *noisePolicy) update(next *noisePolicy, removedRates, removedWindows []string) {
+	p.rates.update(next.rates, removedRates)
+	p.windows.update(next.windows, removedWindows)
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"logit/logg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	SEARCH_DEFAULT_LIMIT = 100
+	SEARCH_MAX_LIMIT     = 10000
+
+	SEARCH_INDEX_DIR    = "index"     // below the log directory
+	SEARCH_INDEX_SUFFIX = ".idx"      // after the name of the file indexed
+	SEARCH_INDEX_MAGIC  = "LGTI"      // starts index files, followed by the version
+	SEARCH_INDEX_SETTLE = time.Minute // files written to since are read, not indexed
+
+	SEARCH_BLOOM_BITS   = 10      // per distinct token, for about 1% false positives
+	SEARCH_BLOOM_HASHES = 7       // bits set per token
+	SEARCH_INDEX_TOKENS = 4 << 20 // distinct tokens past which a file is indexed by time only
+)
+
+// parseSearchQuery splits q into words, or phrases in double quotes: each
+// must appear in an entry, whatever the case. a word of one token (letters,
+// digits and '_') matches it as a whole token; anything else matches as a
+// substring whose tokens the entry has.
+func parseSearchQuery(s string) (terms, phrases []string, err error) {
+	var words []string
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("unterminated phrase in '%s'", s)
+			}
+
+			words = append(words, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+
+		words = append(words, s[:end])
+		s = s[end:]
+	}
+
+	seen := make(map[string]bool)
+
+	for _, word := range words {
+		word = strings.ToLower(word)
+
+		tokens := searchTokens(word)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if len(tokens) > 1 || tokens[0] != word {
+			phrases = append(phrases, word)
+		}
+
+		for _, t := range tokens {
+			if !seen[t] {
+				seen[t] = true
+				terms = append(terms, t)
+			}
+		}
+	}
+
+	return terms, phrases, nil
+}
+
+func isTokenRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// searchTokens returns the tokens of a lower cased text in order
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !isTokenRune(r)
+	})
+}
+
+// containsToken tells whether term is a whole token of the lower cased s
+func containsToken(s, term string) bool {
+	for from := 0; from < len(s); {
+		i := strings.Index(s[from:], term)
+		if i < 0 {
+			return false
+		}
+		i += from
+
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[i+len(term):])
+
+		if (i == 0 || !isTokenRune(before)) && (i+len(term) == len(s) || !isTokenRune(after)) {
+			return true
+		}
+
+		from = i + 1
+	}
+
+	return false
+}
+
+// matchesText tells whether msg has the terms and phrases of q
+func (q storageQuery) matchesText(msg string) bool {
+	if len(q.terms) == 0 && len(q.phrases) == 0 {
+		return true
+	}
+
+	lower := strings.ToLower(msg)
+
+	for _, phrase := range q.phrases {
+		if !strings.Contains(lower, phrase) {
+			return false
+		}
+	}
+
+	for _, term := range q.terms {
+		if !containsToken(lower, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func tokenHash(token string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(token))
+	return h.Sum64()
+}
+
+// fileIndex tells what a finished log file holds: the time its entries span
+// and a bloom filter of their tokens; what it says of a term is 'maybe' or
+// 'no'
+type fileIndex struct {
+	size    int64 // of the file indexed, which changed if it differs
+	modTime int64 // unix nanoseconds
+
+	entries int64
+	first   time.Time
+	last    time.Time
+
+	bits []byte // nil if the file had too many tokens
+}
+
+func (idx *fileIndex) bloomBits() uint64 {
+	return uint64(len(idx.bits)) * 8
+}
+
+func (idx *fileIndex) add(h uint64) {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+
+	for i := uint32(0); i < SEARCH_BLOOM_HASHES; i++ {
+		bit := uint64(h1+i*h2) % idx.bloomBits()
+		idx.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (idx *fileIndex) has(h uint64) bool {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+
+	for i := uint32(0); i < SEARCH_BLOOM_HASHES; i++ {
+		bit := uint64(h1+i*h2) % idx.bloomBits()
+		if idx.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mayMatch tells whether the file may hold entries matching q
+func (idx *fileIndex) mayMatch(q storageQuery) bool {
+	if idx.entries == 0 {
+		return false
+	}
+
+	if (!q.since.IsZero() && idx.last.Before(q.since)) || (!q.until.IsZero() && idx.first.After(q.until)) {
+		return false
+	}
+
+	if idx.bits == nil {
+		return true
+	}
+
+	for _, term := range q.terms {
+		if !idx.has(tokenHash(term)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildFileIndex reads the entries of path into an index
+func buildFileIndex(path string, fi os.FileInfo) (*fileIndex, error) {
+	idx := &fileIndex{size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+	hashes := make(map[uint64]bool)
+
+	err := readEntries("", path, func(se storedEntry) {
+		if idx.entries == 0 || se.Time.Before(idx.first) {
+			idx.first = se.Time
+		}
+		if idx.entries == 0 || se.Time.After(idx.last) {
+			idx.last = se.Time
+		}
+		idx.entries++
+
+		if hashes == nil {
+			return
+		}
+
+		for _, t := range searchTokens(strings.ToLower(se.Msg)) {
+			hashes[tokenHash(t)] = true
+		}
+
+		if len(hashes) > SEARCH_INDEX_TOKENS {
+			hashes = nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hashes != nil {
+		n := (len(hashes)*SEARCH_BLOOM_BITS + 7) / 8
+		if n < 8 {
+			n = 8
+		}
+
+		idx.bits = make([]byte, n)
+		for h := range hashes {
+			idx.add(h)
+		}
+	}
+
+	return idx, nil
+}
+
+func (idx *fileIndex) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString(SEARCH_INDEX_MAGIC)
+	bw.WriteByte(1)
+
+	for _, n := range []int64{idx.size, idx.modTime, idx.entries, idx.first.UnixNano(), idx.last.UnixNano(), int64(len(idx.bits))} {
+		binary.Write(bw, binary.BigEndian, n)
+	}
+	bw.Write(idx.bits)
+
+	return bw.Flush()
+}
+
+func readFileIndex(r io.Reader) (*fileIndex, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(SEARCH_INDEX_MAGIC)+1)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+
+	if string(magic[:len(SEARCH_INDEX_MAGIC)]) != SEARCH_INDEX_MAGIC || magic[len(SEARCH_INDEX_MAGIC)] != 1 {
+		return nil, fmt.Errorf("not a search index")
+	}
+
+	var ns [6]int64
+	for i := range ns {
+		if err := binary.Read(br, binary.BigEndian, &ns[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	idx := &fileIndex{size: ns[0], modTime: ns[1], entries: ns[2], first: time.Unix(0, ns[3]), last: time.Unix(0, ns[4])}
+
+	if n := ns[5]; n < 0 || n > SEARCH_INDEX_TOKENS*SEARCH_BLOOM_BITS/8+8 {
+		return nil, fmt.Errorf("invalid search index")
+	} else if n > 0 {
+		idx.bits = make([]byte, n)
+		if _, err := io.ReadFull(br, idx.bits); err != nil {
+			return nil, err
+		}
+	}
+
+	return idx, nil
+}
+
+// searchIndex keeps the indexes of finished log files below
+// '<dir>/index', named like the files; they are built on the first search
+// reading a file, or once a file is rotated
+type searchIndex struct {
+	dir  string // the log directory
+	lock *sync.Mutex
+	busy map[string]*sync.Mutex // per file indexed
+}
+
+func newSearchIndex(dir string) *searchIndex {
+	x := &searchIndex{dir: dir, lock: &sync.Mutex{}, busy: make(map[string]*sync.Mutex)}
+	go x.sweep()
+
+	return x
+}
+
+// pathOf returns where the index of a log file is kept
+func (x *searchIndex) pathOf(path string) (string, bool) {
+	rel, err := filepath.Rel(x.dir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+
+	return filepath.Join(x.dir, SEARCH_INDEX_DIR, rel+SEARCH_INDEX_SUFFIX), true
+}
+
+// of returns the index of a log file, building it if missing or stale; nil
+// for files still being written to, or that can't be indexed
+func (x *searchIndex) of(path string) *fileIndex {
+	fi, err := os.Stat(path)
+	if err != nil || time.Since(fi.ModTime()) < SEARCH_INDEX_SETTLE {
+		return nil
+	}
+
+	indexPath, ok := x.pathOf(path)
+	if !ok {
+		return nil
+	}
+
+	// a file is indexed once however many searches want it
+	x.lock.Lock()
+	l := x.busy[indexPath]
+	if l == nil {
+		l = &sync.Mutex{}
+		x.busy[indexPath] = l
+	}
+	x.lock.Unlock()
+
+	l.Lock()
+	defer func() {
+		l.Unlock()
+
+		x.lock.Lock()
+		delete(x.busy, indexPath)
+		x.lock.Unlock()
+	}()
+
+	if f, err := os.Open(indexPath); err == nil {
+		idx, err := readFileIndex(f)
+		f.Close()
+
+		if err == nil && idx.size == fi.Size() && idx.modTime == fi.ModTime().UnixNano() {
+			return idx
+		}
+	}
+
+	idx, err := buildFileIndex(path, fi)
+	if err != nil {
+		serverLogger.Warnf("indexing '%s' failed: %v", path, err)
+		return nil
+	}
+
+	if err := x.save(indexPath, idx); err != nil {
+		serverLogger.Warnf("saving the index of '%s' failed: %v", path, err)
+	}
+
+	return idx
+}
+
+func (x *searchIndex) save(indexPath string, idx *fileIndex) error {
+	if err := makeLogDir(filepath.Dir(indexPath)); err != nil {
+		return err
+	}
+
+	tmp := indexPath + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = idx.writeTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, indexPath)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// rotated indexes a file once rotation finished it, ahead of searches
+func (x *searchIndex) rotated(path string) {
+	if fi, err := os.Stat(path); err == nil {
+		if indexPath, ok := x.pathOf(path); ok {
+			if idx, err := buildFileIndex(path, fi); err == nil {
+				x.save(indexPath, idx)
+			}
+		}
+	}
+}
+
+// sweep removes the indexes of files that are gone
+func (x *searchIndex) sweep() {
+	root := filepath.Join(x.dir, SEARCH_INDEX_DIR)
+
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+
+		source := filepath.Join(x.dir, strings.TrimSuffix(rel, SEARCH_INDEX_SUFFIX))
+		if _, err := os.Stat(source); os.IsNotExist(err) || strings.HasSuffix(path, ".tmp") {
+			os.Remove(path)
+		}
+
+		return nil
+	})
+}
+
+// searchLine is a match as GET /search returns it in JSON
+type searchLine struct {
+	Time   string `json:"time"`
+	Sender string `json:"sender"`
+	Level  string `json:"level"`
+	Msg    string `json:"msg"`
+}
+
+// makeSearchHandler serves GET /search?q=&sender=&from=&to=&level=&limit=,
+// which returns the newest entries matching q of the senders (comma
+// separated; all those logit has open if none is given) the caller may
+// read, oldest first; format, tz and timefmt work like for /logs
+func makeSearchHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		q := req.URL.Query()
+		query := storageQuery{limit: SEARCH_DEFAULT_LIMIT}
+
+		var err error
+
+		if query.terms, query.phrases, err = parseSearchQuery(q.Get("q")); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'q': %v", err)
+			return
+		}
+
+		if s := q.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > SEARCH_MAX_LIMIT {
+				writeError(rw, ERR_BODY_INVALID, "limit must be between 1 and %d", SEARCH_MAX_LIMIT)
+				return
+			}
+			query.limit = n
+		}
+
+		if s := strings.ToLower(q.Get("level")); s != "" {
+			if !logLevels[s] {
+				writeError(rw, ERR_BODY_INVALID, "unknown level '%s'", s)
+				return
+			}
+			query.level = s
+		}
+
+		if query.since, err = parseTimeParam(q.Get("from"), time.Time{}); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'from': %v", err)
+			return
+		}
+
+		if query.until, err = parseTimeParam(q.Get("to"), time.Time{}); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'to': %v", err)
+			return
+		}
+
+		format := q.Get("format")
+		if format != "" && format != "text" && format != "json" {
+			writeError(rw, ERR_BODY_INVALID, "format must be 'text' or 'json'")
+			return
+		}
+
+		render, err := parseTimeRenderer(q)
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		}
+
+		var senders []string
+
+		if spec := strings.TrimSpace(q.Get("sender")); spec != "" {
+			for _, name := range strings.Split(spec, ",") {
+				sender, err := senderOfPath(strings.TrimSpace(name))
+				if err != nil {
+					writeError(rw, ERR_SENDER_INVALID, "%v", err)
+					return
+				}
+
+				sender = aliases.resolve(sender)
+				if !senderAllowed(req, sender) {
+					writeError(rw, ERR_FORBIDDEN, "not allowed to read '%s'", sender)
+					return
+				}
+
+				senders = append(senders, sender)
+			}
+		} else {
+			for _, sender := range openSenders() {
+				if senderAllowed(req, sender) {
+					senders = append(senders, sender)
+				}
+			}
+		}
+
+		var matched []storedEntry
+
+		for _, sender := range senders {
+			entries, err := store.Query(sender, query)
+			if err == errStorageUnsupported {
+				writeError(rw, ERR_BODY_INVALID, "%v", err)
+				return
+			} else if err != nil {
+				serverLogger.Errorf("searching logs of '%s' failed: %v", sender, err)
+				writeError(rw, ERR_INTERNAL, "searching logs failed: %v", err)
+				return
+			}
+
+			matched = append(matched, entries...)
+		}
+
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Time.Before(matched[j].Time)
+		})
+
+		if len(matched) > query.limit {
+			matched = matched[len(matched)-query.limit:]
+		}
+
+		if format == "json" {
+			rw.Header().Set("Content-Type", "application/x-ndjson")
+		} else {
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+
+		flusher, _ := rw.(http.Flusher)
+		enc := json.NewEncoder(rw)
+
+		for i, se := range matched {
+			if format == "json" {
+				err = enc.Encode(searchLine{Time: render.format(se.Time), Sender: se.Sender, Level: se.Level, Msg: se.Msg})
+			} else {
+				_, err = fmt.Fprintf(rw, "%s %-5s %s %s\n", render.format(se.Time), strings.ToUpper(se.Level), se.Sender, se.Msg)
+			}
+
+			if err != nil {
+				return // client went away
+			}
+
+			if flusher != nil && (i+1)%LOGS_FLUSH_EVERY == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// openSenders returns the senders with an open logger, sorted; entries of
+// areas (quarantine, retention classes) are found through their sender
+func openSenders() []string {
+	open := logg.Loggers()
+
+	senders := make([]string, 0, len(open))
+	for key := range open {
+		if !strings.Contains(key, "/") {
+			senders = append(senders, key)
+		}
+	}
+	sort.Strings(senders)
+
+	return senders
+}
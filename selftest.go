@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"logit/logg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SELFTEST_FILE    = ".logit-selftest"
+	SELFTEST_TIMEOUT = 3 * time.Second // per sink
+)
+
+// prober is a sink the self-test can check the far side of
+type prober interface {
+	probe(ctx context.Context) error
+}
+
+type selfTestResult struct {
+	name string
+	err  error
+}
+
+// runSelfTest checks at boot what logs are lost to when it doesn't work:
+// that files can be written, rotated (renamed) and compressed in dir, and
+// that every sink answers. it reports every check and returns how many
+// failed.
+func runSelfTest(dir string, sinks map[string]prober, logger *logg.Logger) int {
+	var results []selfTestResult
+
+	if dir != "" {
+		results = append(results, probeDirectory(dir)...)
+	}
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// sinks are probed at once, so boot waits for the slowest only
+	errs := make([]error, len(names))
+	wg := &sync.WaitGroup{}
+
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, p prober) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), SELFTEST_TIMEOUT)
+			defer cancel()
+
+			errs[i] = p.probe(ctx)
+		}(i, sinks[name])
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		results = append(results, selfTestResult{fmt.Sprintf("%s reachable", name), errs[i]})
+	}
+
+	failed := 0
+
+	for _, r := range results {
+		if r.err == nil {
+			logger.Infof("self-test: %s: ok", r.name)
+			continue
+		}
+
+		failed += 1
+		logger.Errorf("self-test: %s: FAILED: %v", r.name, r.err)
+		fmt.Fprintf(os.Stderr, "self-test: %s: FAILED: %v\n", r.name, r.err)
+	}
+
+	return failed
+}
+
+// probeDirectory writes, renames and compresses a scratch file the way a logger
+// rotates its file, and removes what it made
+func probeDirectory(dir string) []selfTestResult {
+	const content = "logit self-test\n"
+
+	path := filepath.Join(dir, SELFTEST_FILE)
+	rotated := path + ".0"
+
+	defer func() {
+		for _, p := range []string{path, rotated, rotated + compressCodec.Suffix()} {
+			os.Remove(p)
+		}
+	}()
+
+	write := func() error {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		if _, err = f.WriteString(content); err == nil {
+			err = f.Sync()
+		}
+
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		return err
+	}
+
+	rename := func() error {
+		return os.Rename(path, rotated)
+	}
+
+	compress := func() error {
+		if err := compressFile(rotated); err != nil {
+			return err
+		}
+
+		compressed := rotated + compressCodec.Suffix()
+
+		f, err := os.Open(compressed)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := decompressed(compressed, f)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if string(b) != content {
+			return fmt.Errorf("compressed file reads back wrong")
+		}
+
+		return nil
+	}
+
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{fmt.Sprintf("log directory %s writable", dir), write},
+		{"rotation (rename)", rename},
+		{"compression", compress},
+	}
+
+	results := make([]selfTestResult, 0, len(checks))
+
+	for i, c := range checks {
+		err := c.run()
+		results = append(results, selfTestResult{c.name, err})
+
+		if err != nil {
+			// the later checks need the file of this one
+			for _, rest := range checks[i+1:] {
+				results = append(results, selfTestResult{rest.name, fmt.Errorf("skipped, '%s' failed", c.name)})
+			}
+			break
+		}
+	}
+
+	return results
+}
+
+// probeLogit checks that a logit (or logit-compatible) server answers at
+// base; any HTTP answer will do, since auth may well refuse /ping
+func probeLogit(ctx context.Context, client *http.Client, base string) error {
+	req, err := http.NewRequest("GET", strings.TrimRight(base, "/")+"/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answers %s", base, resp.Status)
+	}
+
+	return nil
+}
+
+func (f *shadowForwarder) probe(ctx context.Context) error {
+	return probeLogit(ctx, f.client, f.url)
+}
+
+func (r *replicator) probe(ctx context.Context) error {
+	return probeLogit(ctx, r.client, r.peer)
+}
+
+func (d *redisDedup) probe(ctx context.Context) error {
+	reply, err := d.do("PING")
+	if err != nil {
+		return err
+	}
+
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected redis reply '%v' to PING", reply)
+	}
+
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settings of a sender's files /admin/senders/<sender>/config can change;
+// level and gzip are kept by their own policies
+var overridableSettings = map[string]bool{
+	"file":         true,
+	"rotated_file": true,
+	"max_size":     true,
+	"max_backups":  true,
+	"max_age_days": true,
+}
+
+// senderOverrides holds what the admin API set per sender. it goes before
+// the config file and lasts until a restart; a sender's files take it when
+// they are opened next.
+type senderOverrides struct {
+	lock    *sync.RWMutex
+	values  map[string]map[string]string // as given, by sender and key
+	senders map[string]*senderConfig     // parsed from values
+}
+
+var overrides = &senderOverrides{
+	lock:    &sync.RWMutex{},
+	values:  make(map[string]map[string]string),
+	senders: make(map[string]*senderConfig),
+}
+
+func (o *senderOverrides) of(sender string) *senderConfig {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.senders[sender]
+}
+
+// set merges values into the sender's overrides; an empty value drops one
+func (o *senderOverrides) set(sender string, values map[string]string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	merged := make(map[string]string)
+	for key, value := range o.values[sender] {
+		merged[key] = value
+	}
+
+	for key, value := range values {
+		if value == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	s := &senderConfig{}
+	for key, value := range merged {
+		if err := s.set(key, value); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	if s.rotated != "" && s.file == "" {
+		return fmt.Errorf("rotated_file requires file")
+	}
+
+	var templates *senderTemplates
+
+	if s.file != "" {
+		if namer == nil {
+			return fmt.Errorf("file needs file storage")
+		}
+
+		rotated := s.rotated
+		if rotated == "" {
+			rotated = rotatedTemplate
+		}
+
+		var err error
+		if templates, err = parseSenderTemplates(s.file, rotated); err != nil {
+			return err
+		}
+	}
+
+	if namer != nil {
+		namer.override(sender, templates)
+	}
+
+	if len(merged) == 0 {
+		delete(o.values, sender)
+		delete(o.senders, sender)
+	} else {
+		o.values[sender] = merged
+		o.senders[sender] = s
+	}
+
+	return nil
+}
+
+// maxSizeOf is the size a sender's files rotate at
+func maxSizeOf(sender string) int64 {
+	for _, s := range []*senderConfig{overrides.of(sender), conf.senderOf(sender)} {
+		if s != nil && s.maxSize != 0 {
+			return s.maxSize
+		}
+	}
+
+	return maxSize
+}
+
+// retentionOf returns how many rotated files of a sender are kept and for
+// how long, 0 keeping all
+func retentionOf(sender string) (int, time.Duration) {
+	backups, days := maxBackups, maxAgeDays
+
+	// the override goes last, over the config file
+	for _, s := range []*senderConfig{conf.senderOf(sender), overrides.of(sender)} {
+		if s == nil {
+			continue
+		}
+
+		// checked when set
+		if s.maxBackups != "" {
+			backups, _ = strconv.Atoi(s.maxBackups)
+		}
+
+		if s.maxAgeDays != "" {
+			days, _ = strconv.Atoi(s.maxAgeDays)
+		}
+	}
+
+	return backups, time.Duration(days) * 24 * time.Hour
+}
+
+// senderSettings are what a sender's files are written with
+type senderSettings struct {
+	Sender     string            `json:"sender"`
+	File       string            `json:"file,omitempty"` // the live file now
+	MaxSize    int64             `json:"max_size"`
+	MaxBackups int               `json:"max_backups"`
+	MaxAgeDays int               `json:"max_age_days"`
+	Level      string            `json:"level"`
+	Gzip       bool              `json:"gzip"`
+	Overrides  map[string]string `json:"overrides,omitempty"` // set through the admin API
+}
+
+func settingsOf(sender string, p *levelPolicy) senderSettings {
+	backups, age := retentionOf(sender)
+
+	s := senderSettings{
+		Sender:     sender,
+		MaxSize:    maxSizeOf(sender),
+		MaxBackups: backups,
+		MaxAgeDays: int(age / (24 * time.Hour)),
+		Level:      levelName(p.level(sender)),
+		Gzip:       gzPrefs.enabled(sender),
+	}
+
+	if namer != nil {
+		s.File, _ = namer.live(sender, time.Now())
+	}
+
+	overrides.lock.RLock()
+	if values := overrides.values[sender]; len(values) > 0 {
+		s.Overrides = make(map[string]string, len(values))
+		for key, value := range values {
+			s.Overrides[key] = value
+		}
+	}
+	overrides.lock.RUnlock()
+
+	return s
+}
+
+// senderStatus is what /admin/senders tells of a sender, to spot those gone
+// quiet or writing far more than they should
+type senderStatus struct {
+	Sender       string `json:"sender"`
+	File         string `json:"file,omitempty"` // the live file
+	Level        string `json:"level"`
+	Entries      int64  `json:"entries"`       // since start
+	BytesWritten int64  `json:"bytes_written"` // since start, by all its loggers
+	Rotations    int64  `json:"rotations"`
+	LastEntry    string `json:"last_entry,omitempty"`
+}
+
+func statusOf(sender string, p *levelPolicy) senderStatus {
+	s := senderStatus{
+		Sender: sender,
+		Level:  levelName(p.level(sender)),
+	}
+
+	// loggers are keyed '<sender>' or '<area>/<sender>'
+	for key, l := range logg.Loggers() {
+		if key[strings.LastIndex(key, "/")+1:] == sender {
+			s.BytesWritten += l.BytesWritten()
+			s.Rotations += l.Rotations()
+		}
+	}
+
+	lock.Lock()
+	s.File = loggerPaths[sender]
+	lock.Unlock()
+
+	if s.File == "" && namer != nil {
+		s.File, _ = namer.live(sender, time.Now())
+	}
+
+	n, last := stats.sinceStart(sender)
+	s.Entries = n
+
+	if !last.IsZero() {
+		s.LastEntry = last.UTC().Format(time.RFC3339Nano)
+	}
+
+	return s
+}
+
+// serveSenderConfig serves /admin/senders/<sender>/config: GET tells the
+// settings of the sender's files, PUT changes file, rotated_file, max_size,
+// max_backups, max_age_days, level or gzip from a JSON object (an empty
+// string or null drops an override) and DELETE drops the overrides of the
+// files. the sender's files are reopened with them.
+func serveSenderConfig(rw http.ResponseWriter, req *http.Request, sender string, p *levelPolicy) {
+	switch req.Method {
+	case "GET":
+
+	case "PUT", "POST":
+		var body map[string]interface{}
+
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+
+		if err := dec.Decode(&body); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "expected a JSON object of settings: %v", err)
+			return
+		}
+
+		values := make(map[string]string)
+		keys := make([]string, 0, len(body))
+
+		for key, v := range body {
+			value := ""
+			if v != nil {
+				value = fmt.Sprint(v)
+			}
+
+			switch {
+			case overridableSettings[key]:
+				values[key] = value
+
+			case key == "level" || key == "gzip":
+				if err := (&senderConfig{}).set(key, value); err != nil || value == "" {
+					writeError(rw, ERR_BODY_INVALID, "invalid %s '%s'", key, value)
+					return
+				}
+
+			default:
+				writeError(rw, ERR_BODY_INVALID, "setting '%s' can't be changed here", key)
+				return
+			}
+
+			keys = append(keys, key)
+		}
+
+		if err := overrides.set(sender, values); err != nil {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		}
+
+		if v, ok := body["level"]; ok {
+			level, _ := parseMinLevel(fmt.Sprint(v))
+			p.set(sender, level)
+		}
+
+		if v, ok := body["gzip"]; ok {
+			on, _ := parseSwitch(fmt.Sprint(v))
+			gzPrefs.set(sender, on)
+		}
+
+		if len(values) > 0 {
+			reopenSender(sender)
+		}
+
+		sort.Strings(keys)
+		serverLogger.Infof("settings of '%s' changed: %v", sender, keys)
+
+	case "DELETE":
+		overrides.lock.RLock()
+		values := make(map[string]string)
+		for key := range overrides.values[sender] {
+			values[key] = ""
+		}
+		overrides.lock.RUnlock()
+
+		if err := overrides.set(sender, values); err != nil {
+			writeError(rw, ERR_INTERNAL, "%v", err)
+			return
+		}
+
+		reopenSender(sender)
+		serverLogger.Infof("settings of '%s' reset", sender)
+
+	default:
+		rw.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(settingsOf(sender, p))
+}
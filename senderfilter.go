@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// senderFilter decides which senders may have files, so a client can't
+// create one per made-up path. a sender is allowed when it matches an allow
+// pattern (or no allow patterns are given) or is named in the config file,
+// and matches no deny pattern. entries of the others go to the catch-all
+// sender if there is one and are refused otherwise.
+type senderFilter struct {
+	allow    []string // names or globs
+	deny     []string
+	catchAll string
+}
+
+// parsePatterns parses "name,glob*,..." into lowercase patterns
+func parsePatterns(spec string) ([]string, error) {
+	var patterns []string
+
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+
+		if _, err := filepath.Match(p, ""); err != nil || strings.ContainsAny(p, `/\`) {
+			return nil, fmt.Errorf("invalid sender pattern '%s'", p)
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+func newSenderFilter(allowSpec, denySpec, catchAll string) (*senderFilter, error) {
+	allow, err := parsePatterns(allowSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parsePatterns(denySpec)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &senderFilter{allow: allow, deny: deny, catchAll: strings.ToLower(strings.TrimSpace(catchAll))}
+
+	if f.catchAll != "" && (checkSender(f.catchAll) != nil || matchesAny(f.deny, f.catchAll)) {
+		return nil, fmt.Errorf("invalid catch-all sender '%s'", catchAll)
+	}
+
+	return f, nil
+}
+
+func matchesAny(patterns []string, sender string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, sender); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowed tells whether the sender may have files of its own
+func (f *senderFilter) allowed(sender string) bool {
+	if sender == f.catchAll {
+		return true
+	}
+
+	if matchesAny(f.deny, sender) {
+		return false
+	}
+
+	if len(f.allow) == 0 || matchesAny(f.allow, sender) {
+		return true
+	}
+
+	return conf.senderOf(sender) != nil
+}
+
+// refused tells whether entries of the sender are turned away rather than
+// taken by the catch-all; nil-safe
+func (f *senderFilter) refused(sender string) bool {
+	return f != nil && f.catchAll == "" && !f.allowed(sender)
+}
+
+// stage is the pipeline stage routing entries of senders not allowed to the
+// catch-all, noting who sent them, or dropping them without one
+func (f *senderFilter) stage(e *entry) bool {
+	if f.allowed(e.sender) {
+		return true
+	}
+
+	if f.catchAll == "" {
+		return false
+	}
+
+	if e.fields == nil {
+		e.fields = make(map[string]interface{})
+	}
+	e.fields["sender"] = e.sender
+	e.sender = f.catchAll
+
+	return true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SENDER_RATE_BURST is how many seconds of its rate a sender may send at once
+const SENDER_RATE_BURST = 2
+
+// senderRate bounds what a sender may send per second, in entries and in
+// bytes of message and fields; 0 leaves a side unlimited
+type senderRate struct {
+	lines float64
+	bytes float64
+}
+
+func (r senderRate) off() bool {
+	return r.lines == 0 && r.bytes == 0
+}
+
+// parseSenderRate parses 'off', '<lines>', '<lines>:<bytes>' or '-:<bytes>',
+// per second, e.g. '500:1m'
+func parseSenderRate(s string) (senderRate, error) {
+	var r senderRate
+
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "" {
+		return r, nil
+	}
+
+	invalid := fmt.Errorf("invalid sender rate '%s' (expected e.g. '500', '500:1m', '-:1m' or 'off')", s)
+
+	lines, bytes := s, "-"
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		lines, bytes = s[:i], s[i+1:]
+	}
+
+	if lines != "-" {
+		n, err := strconv.ParseFloat(lines, 64)
+		if err != nil || n <= 0 {
+			return r, invalid
+		}
+		r.lines = n
+	}
+
+	if bytes != "-" {
+		n, err := parseSize(bytes)
+		if err != nil || n <= 0 {
+			return r, invalid
+		}
+		r.bytes = float64(n)
+	}
+
+	if r.off() {
+		return r, invalid
+	}
+
+	return r, nil
+}
+
+type senderBuckets struct {
+	lines bucket
+	bytes bucket
+}
+
+// senderLimiter keeps each sender to its rate with two token buckets, one
+// of entries and one of bytes, holding SENDER_RATE_BURST seconds of it. an
+// entry bigger than the whole bytes bucket is let through when it is full,
+// so it can't block the sender for good.
+type senderLimiter struct {
+	def     senderRate
+	senders *senderValues[senderRate]
+
+	bucketLock *sync.Mutex
+	buckets    map[string]*senderBuckets
+	limited    map[string]int64 // over-limit entries by sender
+}
+
+func newSenderLimiter(def senderRate, spec string) (*senderLimiter, error) {
+	senders, err := parseSenderValues(spec, "sender rate", "lines:bytes", func(sender, value string) (senderRate, error) {
+		return parseSenderRate(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &senderLimiter{
+		def:        def,
+		senders:    senders,
+		bucketLock: &sync.Mutex{},
+		buckets:    make(map[string]*senderBuckets),
+		limited:    make(map[string]int64),
+	}, nil
+}
+
+func (l *senderLimiter) rate(sender string) senderRate {
+	return l.senders.or(sender, l.def)
+}
+
+// run forgets the buckets of idle senders
+func (l *senderLimiter) run() {
+	for range time.Tick(RATE_LIMIT_RELOAD) {
+		now := time.Now()
+
+		l.bucketLock.Lock()
+		for sender, b := range l.buckets {
+			if now.Sub(b.lines.last) > RATE_LIMIT_IDLE {
+				delete(l.buckets, sender)
+			}
+		}
+		l.bucketLock.Unlock()
+	}
+}
+
+// entrySize is what an entry counts against the bytes rate: its message
+// and its fields' names and values
+func entrySize(e *entry) float64 {
+	n := len(e.msg)
+
+	for k, v := range e.fields {
+		n += len(k) + len(fmt.Sprint(v))
+	}
+
+	return float64(n)
+}
+
+// refill tops up b for the time since it was last used and takes n from it
+// if it holds that much (or is full); otherwise it says how long until it does
+func refill(b *bucket, rate, n float64, now time.Time) (bool, time.Duration) {
+	burst := rate * SENDER_RATE_BURST
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if rate == 0 {
+		return true, 0
+	}
+
+	need := math.Min(n, burst)
+	if b.tokens >= need {
+		b.tokens -= n
+		return true, 0
+	}
+
+	return false, time.Duration((need - b.tokens) / rate * float64(time.Second))
+}
+
+// allow counts e against its sender's rate, or says how long until it
+// would fit and counts it as limited
+func (l *senderLimiter) allow(e *entry) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	r := l.rate(e.sender)
+	if r.off() {
+		return true, 0
+	}
+
+	size := entrySize(e)
+	now := time.Now()
+
+	l.bucketLock.Lock()
+	defer l.bucketLock.Unlock()
+
+	b := l.buckets[e.sender]
+	if b == nil {
+		b = &senderBuckets{
+			lines: bucket{tokens: r.lines * SENDER_RATE_BURST, last: now},
+			bytes: bucket{tokens: r.bytes * SENDER_RATE_BURST, last: now},
+		}
+		l.buckets[e.sender] = b
+	}
+
+	// taken from copies, so an entry the bytes bucket refuses doesn't
+	// spend a line
+	lines, bytes := b.lines, b.bytes
+
+	ok, wait := refill(&lines, r.lines, 1, now)
+	if ok {
+		ok, wait = refill(&bytes, r.bytes, size, now)
+	}
+
+	if !ok {
+		l.limited[e.sender]++
+		return false, wait
+	}
+
+	b.lines, b.bytes = lines, bytes
+
+	return true, 0
+}
+
+// limitedCounts returns the senders that went over their rate and how often
+func (l *senderLimiter) limitedCounts() ([]string, map[string]int64) {
+	l.bucketLock.Lock()
+	defer l.bucketLock.Unlock()
+
+	counts := make(map[string]int64, len(l.limited))
+	senders := make([]string, 0, len(l.limited))
+
+	for sender, n := range l.limited {
+		counts[sender] = n
+		senders = append(senders, sender)
+	}
+
+	sort.Strings(senders)
+
+	return senders, counts
+}
+
+// retryAfter sets the Retry-After header of a 429 for wait
+func retryAfter(rw http.ResponseWriter, wait time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
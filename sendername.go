@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SENDER_MAX_LEN is the longest sender name taken
+const SENDER_MAX_LEN = 128
+
+// senders whose files would be the server's own
+var reservedSenders = map[string]bool{"logit": true}
+
+// checkSender tells why a (lowercase) sender name can't name files, nil if
+// it can: it takes a-z, 0-9, '-', '_' and '.', starts with a letter or
+// digit, has no '..' and is at most SENDER_MAX_LEN long
+func checkSender(sender string) error {
+	switch {
+	case sender == "":
+		return fmt.Errorf("empty sender")
+	case len(sender) > SENDER_MAX_LEN:
+		return fmt.Errorf("sender longer than %d characters", SENDER_MAX_LEN)
+	case strings.Contains(sender, ".."):
+		return fmt.Errorf("invalid sender '%s'", sender)
+	case reservedSenders[sender]:
+		return fmt.Errorf("sender '%s' is reserved", sender)
+	}
+
+	for i := 0; i < len(sender); i++ {
+		c := sender[i]
+
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case i > 0 && (c == '-' || c == '_' || c == '.'):
+		default:
+			return fmt.Errorf("invalid sender '%s' (expected a-z, 0-9, '-', '_' and '.', starting with a letter or digit)", sender)
+		}
+	}
+
+	return nil
+}
+
+// normalizeSender lowercases a sender name as clients write it and checks it.
+// names are refused unless ASCII, as some letters lowercase to ASCII ones
+// (e.g. the Kelvin sign to 'k').
+func normalizeSender(name string) (string, error) {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			return "", fmt.Errorf("invalid sender '%s' (expected a-z, 0-9, '-', '_' and '.', starting with a letter or digit)", name)
+		}
+	}
+
+	sender := strings.ToLower(strings.TrimSpace(name))
+
+	if err := checkSender(sender); err != nil {
+		return "", err
+	}
+
+	return sender, nil
+}
+
+// senderOfPath normalizes a sender name taken from an escaped URL path, so
+// '%2e%2e' is seen for the '..' it is
+func senderOfPath(escaped string) (string, error) {
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender '%s'", escaped)
+	}
+
+	return normalizeSender(name)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSender(t *testing.T) {
+	tests := []struct {
+		name, sender string // sender "" if refused
+	}{
+		{"web", "web"},
+		{"Web", "web"},
+		{"WEB", "web"},
+		{"  web\t", "web"},
+		{"api-v2.prod_1", "api-v2.prod_1"},
+		{"0day", "0day"},
+		{"a.b", "a.b"},
+		{strings.Repeat("a", SENDER_MAX_LEN), strings.Repeat("a", SENDER_MAX_LEN)},
+
+		// traversal and separators
+		{"..", ""},
+		{".", ""},
+		{"../etc", ""},
+		{"a..b", ""},
+		{"a/b", ""},
+		{`a\b`, ""},
+		{"/etc", ""},
+		{".hidden", ""},
+		{"-rf", ""},
+		{"_x", ""},
+
+		// control characters
+		{"web\x00", ""},
+		{"we\x00b", ""},
+		{"web\n", "web"},
+		{"we\nb", ""},
+		{"we\rb", ""},
+		{"\x1b[31mweb", ""},
+
+		// unicode, including lookalikes and what lowercases to ascii
+		{"wéb", ""},
+		{"wеb", ""}, // Cyrillic 'е'
+		{"ｗｅｂ", ""},
+		{"K", ""}, // Kelvin sign, lowercasing to 'k'
+		{"web​", ""},
+		{"İ", ""},
+
+		// empty, overlong and reserved
+		{"", ""},
+		{"   ", ""},
+		{strings.Repeat("a", SENDER_MAX_LEN+1), ""},
+		{strings.Repeat("a", 1<<16), ""},
+		{"logit", ""},
+		{"LOGIT", ""},
+		{"we b", ""},
+		{"web:80", ""},
+		{"web*", ""},
+	}
+
+	for _, test := range tests {
+		sender, err := normalizeSender(test.name)
+
+		switch {
+		case test.sender == "" && err == nil:
+			t.Errorf("%q: taken as %q, expected it refused", test.name, sender)
+		case test.sender != "" && err != nil:
+			t.Errorf("%q: refused: %v", test.name, err)
+		case sender != test.sender:
+			t.Errorf("%q: got %q, expected %q", test.name, sender, test.sender)
+		}
+	}
+}
+
+func TestSenderOfPath(t *testing.T) {
+	tests := []struct {
+		escaped, sender string // sender "" if refused
+	}{
+		{"web", "web"},
+		{"W%45B", "web"},
+		{"%77eb", "web"},
+		{"%2e%2e", ""},
+		{"%2E%2E", ""},
+		{".%2e", ""},
+		{"a%2fb", ""},
+		{"a%5cb", ""},
+		{"web%00", ""},
+		{"web%0a", "web"},
+		{"w%c3%a9b", ""},
+		{"%ff", ""},
+		{"%zz", ""},
+		{"%", ""},
+		{"logit", ""},
+	}
+
+	for _, test := range tests {
+		sender, err := senderOfPath(test.escaped)
+
+		switch {
+		case test.sender == "" && err == nil:
+			t.Errorf("%q: taken as %q, expected it refused", test.escaped, sender)
+		case test.sender != "" && err != nil:
+			t.Errorf("%q: refused: %v", test.escaped, err)
+		case sender != test.sender:
+			t.Errorf("%q: got %q, expected %q", test.escaped, sender, test.sender)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// senderValues holds values of single senders that take the place of
+// a default, as given by the -*-senders flags (e.g. "audit=info,web=off"),
+// the config file and the admin endpoints. it is safe for concurrent use.
+type senderValues[T any] struct {
+	lock *sync.RWMutex
+	m    map[string]T
+}
+
+func newSenderValues[T any]() *senderValues[T] {
+	return &senderValues[T]{
+		lock: &sync.RWMutex{},
+		m:    make(map[string]T),
+	}
+}
+
+// parseSenderValues parses "sender=value,..." with parse, which is given
+// the sender as written for its errors; what and form make the error of a
+// part that isn't sender=value, e.g. "invalid sync spec 'x': expected
+// sender=level" for "sync" and "level"
+func parseSenderValues[T any](spec, what, form string, parse func(sender, value string) (T, error)) (*senderValues[T], error) {
+	o := newSenderValues[T]()
+
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("invalid %s spec '%s': expected sender=%s", what, kv, form)
+		}
+
+		v, err := parse(ss[0], ss[1])
+		if err != nil {
+			return nil, err
+		}
+
+		o.m[strings.ToLower(strings.TrimSpace(ss[0]))] = v
+	}
+
+	return o, nil
+}
+
+// forSender makes parse, of a value alone, name the sender in its errors
+func forSender[T any](parse func(string) (T, error)) func(sender, value string) (T, error) {
+	return func(sender, value string) (T, error) {
+		v, err := parse(value)
+		if err != nil {
+			return v, fmt.Errorf("%v for '%s'", err, sender)
+		}
+
+		return v, nil
+	}
+}
+
+// get returns the setting of sender, if it has one of its own
+func (o *senderValues[T]) get(sender string) (T, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	v, ok := o.m[sender]
+	return v, ok
+}
+
+// or returns the setting of sender, def if it has none of its own
+func (o *senderValues[T]) or(sender string, def T) T {
+	if v, ok := o.get(sender); ok {
+		return v
+	}
+
+	return def
+}
+
+func (o *senderValues[T]) set(sender string, v T) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.m[sender] = v
+}
+
+func (o *senderValues[T]) delete(sender string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.m, sender)
+}
+
+// all returns a copy of the settings by sender
+func (o *senderValues[T]) all() map[string]T {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	m := make(map[string]T, len(o.m))
+	for sender, v := range o.m {
+		m[sender] = v
+	}
+
+	return m
+}
+
+// update takes the settings of next, e.g. of a reloaded config, after
+// dropping those of removed senders
+func (o *senderValues[T]) update(next *senderValues[T], removed []string) {
+	settings := next.all()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, sender := range removed {
+		delete(o.m, sender)
+	}
+
+	for sender, v := range settings {
+		o.m[sender] = v
+	}
+}
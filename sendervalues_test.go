@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseSenderValues(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected map[string]bool // nil if refused
+	}{
+		{"", map[string]bool{}},
+		{" Web =true, ,api=false", map[string]bool{"web": true, "api": false}},
+		{"web=true,web=false", map[string]bool{"web": false}},
+		{"web", nil},
+		{"web=maybe", nil},
+	}
+
+	for _, test := range tests {
+		v, err := parseSenderValues(test.spec, "gzip", "bool", forSender(strconv.ParseBool))
+
+		switch {
+		case test.expected == nil && err == nil:
+			t.Errorf("%q: taken as %v", test.spec, v.all())
+		case test.expected != nil && err != nil:
+			t.Errorf("%q: %v", test.spec, err)
+		case test.expected != nil && !reflect.DeepEqual(v.all(), test.expected):
+			t.Errorf("%q: got %v, expected %v", test.spec, v.all(), test.expected)
+		}
+	}
+}
+
+func TestSenderValuesUpdate(t *testing.T) {
+	v, _ := parseSenderValues("web=true,api=true,db=true", "gzip", "bool", forSender(strconv.ParseBool))
+	next, _ := parseSenderValues("api=false,jobs=true", "gzip", "bool", forSender(strconv.ParseBool))
+
+	v.update(next, []string{"web"})
+
+	if expected := map[string]bool{"api": false, "db": true, "jobs": true}; !reflect.DeepEqual(v.all(), expected) {
+		t.Errorf("got %v, expected %v", v.all(), expected)
+	}
+
+	if !v.or("web", true) || v.or("api", true) {
+		t.Errorf("got web %v and api %v, expected the default and its own", v.or("web", true), v.or("api", true))
+	}
+}
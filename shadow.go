@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SHADOW_QUEUE       = 1024
+	SHADOW_MAX_WORKERS = 4
+	SHADOW_DRAIN_BATCH = 256
+)
+
+type shadowEntry struct {
+	Sender string `json:"sender"`
+	Level  string `json:"level"`
+	Msg    string `json:"msg"`
+}
+
+// shadowForwarder duplicates a percentage of each sender's traffic to a second
+// logit-compatible endpoint, so a new destination can be validated against
+// production volume before cutover. it never blocks the intake path: when the
+// queue is full the copy is dropped.
+type shadowForwarder struct {
+	url      string
+	percents map[string]float64 // sender -> percent; "*" is the default
+
+	queue  chan *shadowEntry
+	client *http.Client
+
+	sent    int64 // entries handed to the destination (atomic)
+	workers int32 // running senders (atomic)
+
+	// while held (paused or draining after a pause) entries go to the spool
+	held     int32 // atomic, read without holdLock on the intake path
+	holdLock *sync.Mutex
+	paused   bool
+	draining bool
+	spool    *diskSpool
+	marker   pauseMarker
+}
+
+// parseShadowSpec parses "sender=percent,..." (e.g. "web=10,*=1")
+func parseShadowSpec(spec string) (map[string]float64, error) {
+	percents := make(map[string]float64)
+
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("invalid shadow spec '%s': expected sender=percent", kv)
+		}
+
+		percent, err := strconv.ParseFloat(strings.TrimSpace(ss[1]), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid shadow percent '%s': must be between 0 and 100", ss[1])
+		}
+
+		percents[strings.ToLower(strings.TrimSpace(ss[0]))] = percent
+	}
+
+	return percents, nil
+}
+
+func newShadowForwarder(url, spec string) (*shadowForwarder, error) {
+	percents, err := parseShadowSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &shadowForwarder{
+		url:      strings.TrimRight(url, "/"),
+		percents: percents,
+		queue:    make(chan *shadowEntry, SHADOW_QUEUE),
+		client:   &http.Client{Timeout: 5 * time.Second, Transport: outbound},
+		holdLock: &sync.Mutex{},
+	}
+
+	f.restart()
+
+	return f, nil
+}
+
+// restart starts an extra sender, up to SHADOW_MAX_WORKERS; the watchdog
+// calls it when the queue stops draining
+func (f *shadowForwarder) restart() {
+	if atomic.AddInt32(&f.workers, 1) > SHADOW_MAX_WORKERS {
+		atomic.AddInt32(&f.workers, -1)
+		return
+	}
+
+	go f.run()
+}
+
+func (f *shadowForwarder) progress() int64 {
+	return atomic.LoadInt64(&f.sent)
+}
+
+func (f *shadowForwarder) pending() int {
+	return len(f.queue)
+}
+
+func (f *shadowForwarder) percentOf(sender string) float64 {
+	if percent, ok := f.percents[sender]; ok {
+		return percent
+	}
+
+	return f.percents["*"]
+}
+
+// offer copies the entry to the shadow destination if the sender is sampled
+func (f *shadowForwarder) offer(sender, level, msg string) {
+	percent := f.percentOf(sender)
+	if percent <= 0 || rand.Float64()*100 >= percent {
+		return
+	}
+
+	e := &shadowEntry{sender, level, msg}
+
+	if atomic.LoadInt32(&f.held) != 0 && f.hold(e) {
+		return
+	}
+
+	select {
+	case f.queue <- e:
+	default:
+		// shadow traffic must never slow down the primary path
+	}
+}
+
+// enablePause lets the forwarder be paused, spooling to dir meanwhile. a
+// pause that was active when the server stopped is restored, and entries
+// spooled before are sent.
+func (f *shadowForwarder) enablePause(dir string) error {
+	spool, err := newDiskSpool(dir, "shadow")
+	if err != nil {
+		return err
+	}
+
+	f.spool = spool
+	f.marker = pauseMarker(filepath.Join(dir, SPOOL_DIR, "shadow.paused"))
+
+	if f.marker.isSet() {
+		f.paused = true
+		atomic.StoreInt32(&f.held, 1)
+	} else if spool.len() > 0 {
+		atomic.StoreInt32(&f.held, 1)
+		f.startDrain()
+	}
+
+	return nil
+}
+
+// hold spools e if the forwarder is still held
+func (f *shadowForwarder) hold(e *shadowEntry) bool {
+	f.holdLock.Lock()
+	defer f.holdLock.Unlock()
+
+	if atomic.LoadInt32(&f.held) == 0 {
+		return false
+	}
+
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = f.spool.write(b)
+	}
+
+	if err != nil {
+		serverLogger.Errorf("spooling shadow entry failed: %v", err)
+	}
+
+	return true
+}
+
+func (f *shadowForwarder) pause() error {
+	if f.spool == nil {
+		return fmt.Errorf("pausing needs a log directory (-w) to spool to")
+	}
+
+	f.holdLock.Lock()
+	defer f.holdLock.Unlock()
+
+	if err := f.marker.set(true); err != nil {
+		return err
+	}
+
+	f.paused = true
+	atomic.StoreInt32(&f.held, 1)
+
+	return nil
+}
+
+func (f *shadowForwarder) resume() error {
+	if f.spool == nil {
+		return nil
+	}
+
+	f.holdLock.Lock()
+	defer f.holdLock.Unlock()
+
+	if !f.paused {
+		return nil
+	}
+
+	if err := f.marker.set(false); err != nil {
+		return err
+	}
+
+	f.paused = false
+	f.startDrain()
+
+	return nil
+}
+
+// startDrain starts draining unless a drain is running already; the caller
+// holds holdLock (or is still alone)
+func (f *shadowForwarder) startDrain() {
+	if !f.draining {
+		f.draining = true
+		go f.drain()
+	}
+}
+
+// drain moves spooled entries to the queue in order, waiting for room, and
+// releases the hold once the spool is empty
+func (f *shadowForwarder) drain() {
+	for {
+		f.holdLock.Lock()
+
+		if f.paused {
+			// paused again meanwhile
+			f.draining = false
+			f.holdLock.Unlock()
+			return
+		}
+
+		records, err := f.spool.read(SHADOW_DRAIN_BATCH)
+		if err == nil && len(records) == 0 {
+			atomic.StoreInt32(&f.held, 0)
+			f.draining = false
+			f.holdLock.Unlock()
+			return
+		}
+
+		f.holdLock.Unlock()
+
+		if err != nil {
+			serverLogger.Errorf("reading shadow spool failed: %v", err)
+			time.Sleep(time.Second)
+		}
+
+		for _, record := range records {
+			e := new(shadowEntry)
+			if json.Unmarshal(record, e) == nil {
+				f.queue <- e
+			}
+		}
+	}
+}
+
+func (f *shadowForwarder) status() sinkStatus {
+	f.holdLock.Lock()
+	defer f.holdLock.Unlock()
+
+	st := sinkStatus{
+		Name:     "shadow",
+		Paused:   f.paused,
+		Draining: f.draining,
+	}
+
+	if f.spool != nil {
+		st.Buffered = f.spool.len()
+	}
+
+	return st
+}
+
+func (f *shadowForwarder) run() {
+	for entry := range f.queue {
+		url := fmt.Sprintf("%s/%s/%s", f.url, entry.Sender, entry.Level)
+
+		resp, err := f.client.Post(url, "text/plain", bytes.NewBufferString(entry.Msg))
+		atomic.AddInt64(&f.sent, 1)
+
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SHED_RETRY_AFTER    = time.Second     // the least a shed client is told to wait
+	SHED_LATENCY_WINDOW = 5 * time.Second // how long a slow write counts
+)
+
+// loadShedder refuses entries with a 503 while the logger actors fall
+// behind, rather than have handlers block on full queues until clients
+// time out: once the queue of the actor writing the entry's sender is
+// -shed-queue full, or its writes take -shed-latency. a slow write counts
+// for SHED_LATENCY_WINDOW, or as long as it is under way, so shedding ends
+// by itself once writes are quick again. senders not open yet, and
+// requests not naming theirs in the path, are held to the fullest queue
+// and the slowest actor, as either may be theirs. nil with neither.
+type loadShedder struct {
+	queue   float64       // fill ratio of the queue, 0 for any
+	latency time.Duration // of writes, 0 for any
+
+	shed int64 // requests refused, atomic
+}
+
+// shedder refuses entries of the intake, nil unless -shed-queue or
+// -shed-latency is given
+var shedder *loadShedder
+
+func newLoadShedder(queue float64, latency time.Duration) (*loadShedder, error) {
+	if queue < 0 || queue > 1 {
+		return nil, fmt.Errorf("invalid -shed-queue %v (expected a ratio from 0 to 1)", queue)
+	}
+
+	if latency < 0 {
+		return nil, fmt.Errorf("invalid -shed-latency %v", latency)
+	}
+
+	if queue == 0 && latency == 0 {
+		return nil, nil
+	}
+
+	return &loadShedder{queue: queue, latency: latency}, nil
+}
+
+// overloaded tells whether entries for target (nil if not known) are to be
+// refused now, why and how long clients should wait
+func (s *loadShedder) overloaded(target *logg.Logger) (bool, string, time.Duration) {
+	if s.queue > 0 {
+		var depth, capacity int
+		if target != nil {
+			depth, capacity = target.QueueLen()
+		} else {
+			depth, capacity = logg.FullestQueueLen()
+		}
+
+		if capacity > 0 && float64(depth)/float64(capacity) >= s.queue {
+			return true, fmt.Sprintf("write queue %d/%d full", depth, capacity), SHED_RETRY_AFTER
+		}
+	}
+
+	if s.latency > 0 {
+		var latency time.Duration
+		if target != nil {
+			latency = target.WriteLatency(SHED_LATENCY_WINDOW)
+		} else {
+			latency = logg.SlowestWriteLatency(SHED_LATENCY_WINDOW)
+		}
+
+		if latency >= s.latency {
+			wait := latency
+			if wait < SHED_RETRY_AFTER {
+				wait = SHED_RETRY_AFTER
+			}
+
+			return true, fmt.Sprintf("writes taking %v", latency), wait
+		}
+	}
+
+	return false, "", 0
+}
+
+// shedCount returns the requests refused so far
+func (s *loadShedder) shedCount() int64 {
+	return atomic.LoadInt64(&s.shed)
+}
+
+// wrap refuses the entries posted to h, registered as route, while
+// overloaded; reads pass
+func (s *loadShedder) wrap(route string, h http.Handler) http.Handler {
+	if s == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" && req.Method != "PUT" {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		var target *logg.Logger
+		if sender, ok := requestSender(req, route); ok {
+			target = logg.Lookup(sender)
+		}
+
+		if over, reason, wait := s.overloaded(target); over {
+			atomic.AddInt64(&s.shed, 1)
+
+			retryAfter(rw, wait)
+			writeError(rw, ERR_QUEUE_FULL, "overloaded (%s), retry in %v", reason, wait)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"logit/logitclient"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	SHIP_POLL    = 250 * time.Millisecond // how often a followed file is looked at
+	SHIP_DRAIN   = 30 * time.Second       // wait for queued lines on exit
+	SHIP_BACKOFF = 10 * time.Millisecond  // wait for room in a full queue
+
+	SHIP_GROUP_WAIT = time.Second // for more continuation lines of an entry
+	SHIP_GROUP_MAX  = 1000        // lines an entry takes at most
+)
+
+// stackContinuation matches the lines that belong to the one before them in
+// stack traces: indented ones (Java's 'at ...', Python's 'File ...') and
+// Java's 'Caused by: ...'
+var stackContinuation = regexp.MustCompile(`^(?:\s|Caused by: )`)
+
+// runShip is 'logit ship [flags] <sender>': it posts every line of stdin or
+// of a file to a server as an entry of sender, e.g. the output of a cron job
+// (job | logit ship cron). returns the exit code: 1 when lines were lost.
+func runShip(args []string) int {
+	fs := flag.NewFlagSet("ship", flag.ContinueOnError)
+
+	server := fs.String("server", "http://localhost:8070", "base url of the logit server")
+	level := fs.String("level", "info", "level of the entries")
+	token := fs.String("token", "", "token sent as Bearer (default: $LOGIT_TOKEN)")
+	file := fs.String("file", "", "file to ship instead of stdin")
+	follow := fs.Bool("f", false, "with -file, keep following it like 'tail -f', across rotation and truncation")
+	fromStart := fs.Bool("from-start", false, "with -f, ship the lines the file has already, not only new ones")
+	tee := fs.Bool("tee", false, "copy the lines to stdout too")
+	multiline := fs.String("multiline", "", "join continuation lines to the entry before them: 'stack' for stack traces (indented lines and 'Caused by:'), or a regexp matching continuation lines")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: logit ship [flags] <sender>\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	sender := fs.Arg(0)
+	if _, err := senderOfPath(sender); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	if *follow && *file == "" {
+		fmt.Fprintf(os.Stderr, "-f requires -file\n")
+		return 2
+	}
+
+	var continuation *regexp.Regexp
+
+	switch *multiline {
+	case "":
+	case "stack":
+		continuation = stackContinuation
+	default:
+		var err error
+		if continuation, err = regexp.Compile(*multiline); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -multiline: %v\n", err)
+			return 2
+		}
+	}
+
+	if *token == "" {
+		*token = os.Getenv("LOGIT_TOKEN")
+	}
+
+	c, err := logitclient.New(*server, logitclient.Options{
+		Token: *token,
+		OnError: func(err error) {
+			fmt.Fprintf(os.Stderr, "logit ship: %v\n", err)
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	send := func(msg string) {
+		// a full queue holds up reading rather than lose lines
+		for c.Log(sender, *level, msg) == logitclient.ErrQueueFull {
+			time.Sleep(SHIP_BACKOFF)
+		}
+	}
+
+	var group *lineGrouper
+	if continuation != nil {
+		group = newLineGrouper(continuation, send)
+	}
+
+	ship := func(line string) {
+		if *tee {
+			fmt.Println(line)
+		}
+
+		if group != nil {
+			group.add(line)
+		} else {
+			send(line)
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	switch {
+	case *follow:
+		err = followFile(*file, *fromStart, stop, ship)
+	case *file != "":
+		var f *os.File
+		if f, err = os.Open(*file); err == nil {
+			err = shipLines(f, stop, ship)
+			f.Close()
+		}
+	default:
+		err = shipLines(os.Stdin, stop, ship)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	if group != nil {
+		group.flush()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHIP_DRAIN)
+	defer cancel()
+
+	if err := c.Close(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "lines still queued after %v: %v\n", SHIP_DRAIN, err)
+		return 1
+	}
+
+	if n := c.Dropped(); n > 0 {
+		fmt.Fprintf(os.Stderr, "%d lines lost\n", n)
+		return 1
+	}
+
+	if err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// shipLines ships the lines of r until it ends or a signal comes; a last
+// line without a newline is shipped too
+func shipLines(r io.Reader, stop chan os.Signal, ship func(line string)) error {
+	lines := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		br := bufio.NewReader(r)
+
+		for {
+			line, err := br.ReadString('\n')
+			if line = strings.TrimRight(line, "\r\n"); line != "" || err == nil {
+				lines <- line
+			}
+
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			ship(line)
+		case err := <-errs:
+			return err
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// followFile ships the lines appended to path until a signal comes. a file
+// replaced by rotation is read to its end, then the new one from its start;
+// a truncated one is read again from its start.
+func followFile(path string, fromStart bool, stop chan os.Signal, ship func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+	}()
+
+	if !fromStart {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	br := bufio.NewReader(f)
+	var partial string // a line not ended yet
+
+	ticker := time.NewTicker(SHIP_POLL)
+	defer ticker.Stop()
+
+	drain := func() {
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				partial += line
+				return
+			}
+
+			ship(strings.TrimRight(partial+line, "\r\n"))
+			partial = ""
+		}
+	}
+
+	for {
+		drain()
+
+		select {
+		case <-stop:
+			drain()
+			if partial != "" {
+				ship(partial)
+			}
+			return nil
+		case <-ticker.C:
+		}
+
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		pos -= int64(br.Buffered())
+
+		cur, err1 := f.Stat()
+		now, err2 := os.Stat(path)
+
+		switch {
+		case err1 != nil:
+			return err1
+		case err2 != nil:
+			// rotated away and not created again yet
+		case !os.SameFile(cur, now):
+			// rotated: the old file is read to its end first
+			next, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+
+			drain()
+			if partial != "" {
+				ship(partial)
+				partial = ""
+			}
+
+			f.Close()
+			f = next
+			br.Reset(f)
+		case now.Size() < pos:
+			// truncated (e.g. copy-truncate rotation); like with tail -f,
+			// a file written past where it was read before the next look
+			// isn't noticed
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			partial = ""
+			br.Reset(f)
+		}
+	}
+}
+
+// lineGrouper joins continuation lines to the line before them into one
+// entry, sent once a line starts another one, SHIP_GROUP_WAIT passes without
+// more or it reaches SHIP_GROUP_MAX lines
+type lineGrouper struct {
+	lock         *sync.Mutex
+	continuation *regexp.Regexp
+	send         func(msg string)
+
+	lines []string
+	timer *time.Timer
+}
+
+func newLineGrouper(continuation *regexp.Regexp, send func(msg string)) *lineGrouper {
+	g := &lineGrouper{lock: &sync.Mutex{}, continuation: continuation, send: send}
+	g.timer = time.AfterFunc(time.Hour, g.flush)
+	g.timer.Stop()
+
+	return g
+}
+
+func (g *lineGrouper) add(line string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(g.lines) == 0 || len(g.lines) >= SHIP_GROUP_MAX || !g.continuation.MatchString(line) {
+		g.sendLocked()
+	}
+
+	g.lines = append(g.lines, line)
+	g.timer.Reset(SHIP_GROUP_WAIT)
+}
+
+// flush sends the entry gathered so far
+func (g *lineGrouper) flush() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.timer.Stop()
+	g.sendLocked()
+}
+
+func (g *lineGrouper) sendLocked() {
+	if len(g.lines) == 0 {
+		return
+	}
+
+	msg := strings.Join(g.lines, "\n")
+	g.lines = g.lines[:0]
+
+	g.send(msg)
+}
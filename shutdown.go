@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"logit/logg"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	serversLock = &sync.Mutex{}
+	servers     []*http.Server // shut down before the loggers
+
+	// closed once shutting down, ending streams (tails) that would
+	// otherwise keep their requests under way
+	stopping = make(chan struct{})
+)
+
+// addServer has server shut down gracefully on exit
+func addServer(server *http.Server) {
+	serversLock.Lock()
+	defer serversLock.Unlock()
+
+	servers = append(servers, server)
+}
+
+// shutdown stops taking connections, waits for the requests under way,
+// writes out what the loggers queued and closes the files, all within
+// timeout, and exits
+func shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serverLogger.Infof("shutting down, waiting up to %v for requests under way", timeout)
+	close(stopping)
+
+	serversLock.Lock()
+	var wg sync.WaitGroup
+
+	for _, server := range servers {
+		wg.Add(1)
+
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				serverLogger.Warnf("requests still under way at shutdown: %v", err)
+			}
+		}(server)
+	}
+
+	wg.Wait()
+	serversLock.Unlock()
+
+	// write what is queued and close the log files
+	if err := logg.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "logger shutdown failed: %v\n", err)
+	}
+
+	// files logit writes itself (journals, spools)
+	for _, f := range fds {
+		f.Close()
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+// notifyReopen does nothing: Windows has no SIGUSR1, and with copy-truncate
+// rotation there are no moved files to reopen
+func notifyReopen(c chan<- os.Signal) {}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// simulationEvent is a line of the -events file given to 'logit simulate':
+// what a client would send. a "json" object stands for a structured body.
+type simulationEvent struct {
+	Sender string          `json:"sender"`
+	Level  string          `json:"level"`
+	Msg    string          `json:"msg"`
+	JSON   json.RawMessage `json:"json"`
+	Ts     string          `json:"ts"`
+	Retain string          `json:"retain"`
+}
+
+// simulationResult tells where an event would have gone
+type simulationResult struct {
+	Line      int     `json:"line"`
+	Sender    string  `json:"sender,omitempty"`
+	Level     string  `json:"level,omitempty"`
+	Outcome   string  `json:"outcome"`          // stored, dropped or rejected
+	Stage     string  `json:"stage,omitempty"`  // that dropped it
+	Reason    string  `json:"reason,omitempty"` // it was rejected
+	Area      string  `json:"area,omitempty"`
+	File      string  `json:"file,omitempty"`
+	Late      bool    `json:"late,omitempty"`
+	Shadow    float64 `json:"shadow_percent,omitempty"`
+	Replicate bool    `json:"replicate,omitempty"`
+}
+
+// runSimulation feeds the events through the configured intake in memory and
+// prints a result per event as NDJSON; nothing is written, forwarded or
+// replicated. returns the exit code: 1 if the events can't be read.
+func runSimulation(path string, shadowPercents map[string]float64) int {
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "simulate requires -events\n")
+		return 1
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	// only used to find files and late entries, never written through
+	files := newFileStorage(logFilePath, serverLogger)
+
+	out := json.NewEncoder(os.Stdout)
+	counts := make(map[string]int)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		r := simulateEvent(files, line, shadowPercents)
+		r.Line = n
+
+		counts[r.Outcome]++
+		out.Encode(r)
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "reading events failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "%d stored, %d dropped, %d rejected\n", counts["stored"], counts["dropped"], counts["rejected"])
+
+	return 0
+}
+
+func simulateEvent(files *fileStorage, line string, shadowPercents map[string]float64) simulationResult {
+	rejected := func(format string, v ...interface{}) simulationResult {
+		return simulationResult{Outcome: "rejected", Reason: fmt.Sprintf(format, v...)}
+	}
+
+	var ev simulationEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return rejected("invalid event: %v", err)
+	}
+
+	sender := strings.TrimSpace(ev.Sender)
+	if sender == "" {
+		return rejected("wrong sender")
+	}
+
+	body, isJSON := []byte(ev.Msg), len(ev.JSON) > 0
+	if isJSON {
+		body = ev.JSON
+	}
+
+	retain, err := retainClassOf(ev.Retain, body, isJSON)
+	if err != nil {
+		return rejected("%v", err)
+	}
+
+	at, err := parseEventTime(ev.Ts)
+	if err != nil {
+		return rejected("%v", err)
+	}
+
+	e := &entry{
+		sender:   aliases.resolve(strings.ToLower(sender)),
+		level:    normalizeLevel(ev.Level),
+		msg:      string(body),
+		received: time.Now(),
+		at:       at,
+		retain:   retain,
+	}
+
+	r := simulationResult{Sender: e.sender, Level: e.level}
+
+	if stage := intake.pass(e); stage != "" {
+		r.Outcome, r.Stage = "dropped", stage
+		return r
+	}
+
+	r.Outcome = "stored"
+	r.Area = e.area()
+	r.File = "stdout"
+
+	if logFilePath != "" {
+		live, err := namer.live(e.sender, e.time())
+		if err != nil {
+			return rejected("%v", err)
+		}
+		live = areaPath(logFilePath, r.Area, live)
+
+		key := e.sender
+		if r.Area != "" {
+			key = r.Area + "/" + e.sender
+		}
+
+		if lateMode == LATE_DIVERT && !e.at.IsZero() && files.isLate(key, e) {
+			r.Late = true
+			live = files.latePath(live, e.time().Local().Format("2006-01-02"))
+		}
+
+		r.File = live
+	}
+
+	if shadowUrl != "" {
+		if percent, ok := shadowPercents[e.sender]; ok {
+			r.Shadow = percent
+		} else {
+			r.Shadow = shadowPercents["*"]
+		}
+	}
+
+	r.Replicate = replicateTo != ""
+
+	return r
+}
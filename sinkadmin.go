@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// pausable is an outbound destination that can be held during maintenance of
+// the far side (an index template change, a table migration, ...). while
+// paused it keeps what it would have sent, in order, and sends it on resume.
+type pausable interface {
+	pause() error
+	resume() error
+	status() sinkStatus
+}
+
+type sinkStatus struct {
+	Name     string `json:"name"`
+	Paused   bool   `json:"paused"`
+	Draining bool   `json:"draining"`
+	Buffered int64  `json:"buffered_bytes"`
+}
+
+// pauseMarker makes a pause survive restarts
+type pauseMarker string
+
+func (m pauseMarker) set(on bool) error {
+	if !on {
+		if err := os.Remove(string(m)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	f, err := os.Create(string(m))
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func (m pauseMarker) isSet() bool {
+	_, err := os.Stat(string(m))
+	return err == nil
+}
+
+// makeSinkAdminHandler serves GET /admin/sinks (status of all sinks) and
+// POST /admin/sinks/<name>/pause or /resume
+func makeSinkAdminHandler(sinks map[string]pausable) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ss := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/sinks"), "/"), "/")
+
+		if len(ss) == 1 && ss[0] == "" {
+			if req.Method != "GET" {
+				rw.Header().Set("Allow", "GET")
+				writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+				return
+			}
+
+			names := make([]string, 0, len(sinks))
+			for name := range sinks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			statuses := make([]sinkStatus, 0, len(names))
+			for _, name := range names {
+				statuses = append(statuses, sinks[name].status())
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(statuses)
+			return
+		}
+
+		if len(ss) != 2 || (ss[1] != "pause" && ss[1] != "resume") {
+			writeError(rw, ERR_BODY_INVALID, "expected /admin/sinks/<name>/pause or /resume")
+			return
+		}
+
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		sink, ok := sinks[ss[0]]
+		if !ok {
+			writeError(rw, ERR_BODY_INVALID, "unknown sink '%s'", ss[0])
+			return
+		}
+
+		var err error
+		if ss[1] == "pause" {
+			err = sink.pause()
+		} else {
+			err = sink.resume()
+		}
+
+		if err != nil {
+			serverLogger.Errorf("%s of sink '%s' failed: %v", ss[1], ss[0], err)
+			writeError(rw, ERR_INTERNAL, "%s failed: %v", ss[1], err)
+			return
+		}
+
+		serverLogger.Infof("sink '%s': %s", ss[0], ss[1])
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(sink.status())
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"logit/logg"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// spillDir keeps what sender files refuse (see logg's SetSpillFile), ""
+// without -spill-dir
+var spillDir string
+
+// setSpill has a sender's logger spill to <spillDir>/<key>.spill
+func setSpill(logger *logg.Logger, key string) error {
+	if spillDir == "" {
+		return nil
+	}
+
+	return logger.SetSpillFile(filepath.Join(spillDir, url.PathEscape(key)+".spill"))
+}
+
+// watchSpills reports senders whose files start refusing writes and those
+// whose spilled lines were all written back
+func watchSpills(logger *logg.Logger) {
+	spilling := make(map[string]bool)
+
+	for range time.Tick(logg.SPILL_RETRY) {
+		open := logg.Loggers()
+
+		for _, key := range sortedKeys(open) {
+			held := open[key].Spilled()
+
+			switch {
+			case held > 0 && !spilling[key]:
+				logger.Errorf("the file of '%s' refuses writes, spilling to %s", key, spillDir)
+				spilling[key] = true
+			case held == 0 && spilling[key]:
+				logger.Infof("the file of '%s' takes writes again, spilled lines written back", key)
+				delete(spilling, key)
+			}
+		}
+	}
+}
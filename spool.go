@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const SPOOL_DIR = "spool"
+
+// diskSpool is an append-only file of records that are read back in order.
+// the read position isn't persisted: after a crash a partly drained spool is
+// drained again from the start.
+type diskSpool struct {
+	path string
+
+	lock   *sync.Mutex
+	f      *os.File
+	offset int64
+}
+
+func newDiskSpool(dir, name string) (*diskSpool, error) {
+	dir = filepath.Join(dir, SPOOL_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, name+".spool")
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fds = append(fds, f)
+
+	return &diskSpool{
+		path: path,
+		lock: &sync.Mutex{},
+		f:    f,
+	}, nil
+}
+
+// write appends a record; records must not contain newlines
+func (s *diskSpool) write(record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.f.Write(append(record, '\n'))
+	return err
+}
+
+// len returns the number of bytes not read yet
+func (s *diskSpool) len() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fi, err := s.f.Stat()
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size() - s.offset
+}
+
+// read returns up to max unread records; once everything was read the file
+// starts over
+func (s *diskSpool) read(max int) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.offset, 1<<62))
+
+	var records [][]byte
+
+	for len(records) < max {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return records, err
+		}
+
+		s.offset += int64(len(line))
+		records = append(records, bytes.TrimSuffix(line, []byte("\n")))
+	}
+
+	if len(records) == 0 {
+		if err := s.f.Truncate(0); err != nil {
+			return nil, err
+		}
+
+		s.offset = 0
+	}
+
+	return records, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the latency histogram buckets; a last bucket takes the rest
+var STAGE_BUCKETS = []time.Duration{
+	10 * time.Microsecond, 50 * time.Microsecond, 100 * time.Microsecond,
+	500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	500 * time.Millisecond, time.Second,
+}
+
+type stageOutcome int
+
+const (
+	STAGE_PASSED  stageOutcome = iota
+	STAGE_DROPPED              // the stage dropped the entry on purpose
+	STAGE_FAILED               // the stage could not do its work
+)
+
+// stageMetric counts the calls, drops and failures of one stage and how long
+// they took. all fields are updated atomically.
+type stageMetric struct {
+	calls   int64
+	drops   int64
+	errors  int64
+	nanos   int64
+	max     int64
+	buckets []int64 // len(STAGE_BUCKETS)+1
+}
+
+func (m *stageMetric) observe(d time.Duration, outcome stageOutcome) {
+	atomic.AddInt64(&m.calls, 1)
+	atomic.AddInt64(&m.nanos, int64(d))
+
+	switch outcome {
+	case STAGE_DROPPED:
+		atomic.AddInt64(&m.drops, 1)
+	case STAGE_FAILED:
+		atomic.AddInt64(&m.errors, 1)
+	}
+
+	for {
+		max := atomic.LoadInt64(&m.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&m.max, max, int64(d)) {
+			break
+		}
+	}
+
+	i := 0
+	for i < len(STAGE_BUCKETS) && d > STAGE_BUCKETS[i] {
+		i++
+	}
+
+	atomic.AddInt64(&m.buckets[i], 1)
+}
+
+// quantile estimates the latency below which q of the calls finished, as the
+// upper bound of the bucket it falls in (or the maximum, if lower)
+func (m *stageMetric) quantile(q float64) time.Duration {
+	calls := atomic.LoadInt64(&m.calls)
+	if calls == 0 {
+		return 0
+	}
+
+	rank := int64(q * float64(calls))
+	max := time.Duration(atomic.LoadInt64(&m.max))
+
+	var seen int64
+	for i := range m.buckets {
+		seen += atomic.LoadInt64(&m.buckets[i])
+
+		if seen > rank {
+			if i < len(STAGE_BUCKETS) && STAGE_BUCKETS[i] < max {
+				return STAGE_BUCKETS[i]
+			}
+			break
+		}
+	}
+
+	return max
+}
+
+// stageTimer measures one pass through a stage; only its first end counts
+type stageTimer struct {
+	m     *stageMetric
+	start time.Time
+	done  bool
+}
+
+func (t *stageTimer) end(outcome stageOutcome) {
+	if t.done {
+		return
+	}
+
+	t.done = true
+	t.m.observe(time.Since(t.start), outcome)
+}
+
+// pipelineMetrics keeps a stageMetric per stage name, in order of first use
+type pipelineMetrics struct {
+	lock   *sync.Mutex
+	stages map[string]*stageMetric
+	order  []string
+}
+
+func newPipelineMetrics() *pipelineMetrics {
+	return &pipelineMetrics{
+		lock:   &sync.Mutex{},
+		stages: make(map[string]*stageMetric),
+	}
+}
+
+func (pm *pipelineMetrics) stage(name string) *stageMetric {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	m, ok := pm.stages[name]
+	if !ok {
+		m = &stageMetric{buckets: make([]int64, len(STAGE_BUCKETS)+1)}
+		pm.stages[name] = m
+		pm.order = append(pm.order, name)
+	}
+
+	return m
+}
+
+func (pm *pipelineMetrics) timer(name string) *stageTimer {
+	return &stageTimer{m: pm.stage(name), start: time.Now()}
+}
+
+type stageSnapshot struct {
+	Name       string  `json:"name"`
+	Calls      int64   `json:"calls"`
+	Drops      int64   `json:"drops"`
+	Errors     int64   `json:"errors"`
+	AvgLatency string  `json:"avg_latency"`
+	P50Latency string  `json:"p50_latency"`
+	P99Latency string  `json:"p99_latency"`
+	MaxLatency string  `json:"max_latency"`
+	Buckets    []int64 `json:"buckets"` // counts per STAGE_BUCKETS bound, then the rest
+}
+
+func (pm *pipelineMetrics) snapshot() []stageSnapshot {
+	pm.lock.Lock()
+	names := append([]string(nil), pm.order...)
+	pm.lock.Unlock()
+
+	snaps := make([]stageSnapshot, 0, len(names))
+
+	for _, name := range names {
+		m := pm.stage(name)
+
+		s := stageSnapshot{
+			Name:       name,
+			Calls:      atomic.LoadInt64(&m.calls),
+			Drops:      atomic.LoadInt64(&m.drops),
+			Errors:     atomic.LoadInt64(&m.errors),
+			P50Latency: m.quantile(0.5).String(),
+			P99Latency: m.quantile(0.99).String(),
+			MaxLatency: time.Duration(atomic.LoadInt64(&m.max)).String(),
+			Buckets:    make([]int64, len(m.buckets)),
+		}
+
+		var avg time.Duration
+		if s.Calls > 0 {
+			avg = time.Duration(atomic.LoadInt64(&m.nanos) / s.Calls)
+		}
+		s.AvgLatency = avg.String()
+
+		for i := range m.buckets {
+			s.Buckets[i] = atomic.LoadInt64(&m.buckets[i])
+		}
+
+		snaps = append(snaps, s)
+	}
+
+	return snaps
+}
+
+// makePipelineAdminHandler serves GET /admin/pipeline, the metrics of every
+// stage an entry passes, from parsing the request to forwarding it
+func makePipelineAdminHandler(pm *pipelineMetrics) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(pm.snapshot())
+	}
+}
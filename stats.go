@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STATS_BUCKET      = time.Minute
+	STATS_RETENTION   = 24 * time.Hour
+	STATS_MAX_BUCKETS = 10000
+)
+
+// statsCollector keeps per-minute message counts by level for every sender
+// over the last STATS_RETENTION, backing the aggregation endpoint
+type statsCollector struct {
+	lock    *sync.Mutex
+	senders map[string][]statsBucket
+	totals  map[string]map[string]int64 // entries since start by sender and level
+	last    map[string]time.Time        // of the latest entry by sender
+}
+
+type statsBucket struct {
+	minute int64 // unix time / 60 this bucket currently holds
+	counts map[string]int64
+}
+
+type aggregateBucket struct {
+	Start  time.Time        `json:"-"`
+	At     string           `json:"start"` // Start as the caller asked for it
+	Count  int64            `json:"count"`
+	Counts map[string]int64 `json:"counts,omitempty"`
+}
+
+type aggregateResponse struct {
+	Sender   string            `json:"sender,omitempty"`
+	Interval string            `json:"interval"`
+	Group    string            `json:"group,omitempty"`
+	Buckets  []aggregateBucket `json:"buckets"`
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		lock:    &sync.Mutex{},
+		senders: make(map[string][]statsBucket),
+		totals:  make(map[string]map[string]int64),
+		last:    make(map[string]time.Time),
+	}
+}
+
+func (c *statsCollector) record(sender, level string, t time.Time) {
+	minute := t.Unix() / int64(STATS_BUCKET/time.Second)
+	n := int64(STATS_RETENTION / STATS_BUCKET)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buckets := c.senders[sender]
+	if buckets == nil {
+		buckets = make([]statsBucket, n)
+		c.senders[sender] = buckets
+	}
+
+	b := &buckets[minute%n]
+	if b.minute != minute || b.counts == nil {
+		b.minute = minute
+		b.counts = make(map[string]int64)
+	}
+
+	b.counts[level] += 1
+
+	if c.totals[sender] == nil {
+		c.totals[sender] = make(map[string]int64)
+	}
+	c.totals[sender][level] += 1
+
+	if t.After(c.last[sender]) {
+		c.last[sender] = t
+	}
+}
+
+// sinceStart returns how many entries of a sender came in since start and
+// when the latest did, zero if none
+func (c *statsCollector) sinceStart(sender string) (int64, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var n int64
+	for _, count := range c.totals[sender] {
+		n += count
+	}
+
+	return n, c.last[sender]
+}
+
+// totalCounts returns a copy of the entries since start by sender and level
+func (c *statsCollector) totalCounts() map[string]map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counts := make(map[string]map[string]int64, len(c.totals))
+	for sender, levels := range c.totals {
+		counts[sender] = make(map[string]int64, len(levels))
+		for level, n := range levels {
+			counts[sender][level] = n
+		}
+	}
+
+	return counts
+}
+
+// aggregate sums the per-minute buckets of a sender (or of all senders if
+// sender is empty) into buckets of the given interval between from and to
+func (c *statsCollector) aggregate(sender string, interval time.Duration, byLevel bool, from, to time.Time) []aggregateBucket {
+	step := int64(interval / STATS_BUCKET)
+	first := from.Unix() / int64(STATS_BUCKET/time.Second)
+	last := to.Unix() / int64(STATS_BUCKET/time.Second)
+	n := int64(STATS_RETENTION / STATS_BUCKET)
+
+	first -= first % step
+
+	result := make([]aggregateBucket, 0, (last-first)/step+1)
+	for m := first; m <= last; m += step {
+		bucket := aggregateBucket{Start: time.Unix(m*int64(STATS_BUCKET/time.Second), 0).UTC()}
+		if byLevel {
+			bucket.Counts = make(map[string]int64)
+		}
+
+		result = append(result, bucket)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for name, buckets := range c.senders {
+		if sender != "" && name != sender {
+			continue
+		}
+
+		for m := first; m <= last; m++ {
+			b := buckets[m%n]
+			if b.minute != m {
+				continue
+			}
+
+			out := &result[(m-first)/step]
+			for level, count := range b.counts {
+				out.Count += count
+				if byLevel {
+					out.Counts[level] += count
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func parseTimeParam(s string, defaultTime time.Time) (time.Time, error) {
+	if s == "" {
+		return defaultTime, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		// relative to now, e.g. 'from=1h' means one hour ago
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func makeAggregateHandler(collector *statsCollector) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		q := req.URL.Query()
+		sender := ""
+		if name := strings.TrimSpace(q.Get("sender")); name != "" {
+			var err error
+
+			sender, err = normalizeSender(name)
+			if err != nil {
+				writeError(rw, ERR_SENDER_INVALID, "%v", err)
+				return
+			}
+
+			// an alias counts toward the sender it stands for
+			sender = aliases.resolve(sender)
+		}
+
+		// all senders ("") need unrestricted credentials
+		if !senderAllowed(req, sender) {
+			writeError(rw, ERR_FORBIDDEN, "not allowed to read these stats")
+			return
+		}
+
+		interval := 5 * time.Minute
+		if s := q.Get("interval"); s != "" {
+			var err error
+
+			interval, err = time.ParseDuration(s)
+			if err != nil || interval < STATS_BUCKET || interval%STATS_BUCKET != 0 {
+				writeError(rw, ERR_BODY_INVALID, "interval must be a multiple of %v", STATS_BUCKET)
+				return
+			}
+		}
+
+		group := q.Get("group")
+		if group != "" && group != "level" {
+			writeError(rw, ERR_BODY_INVALID, "group must be 'level' or empty")
+			return
+		}
+
+		render, err := parseTimeRenderer(q)
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		}
+
+		now := time.Now()
+
+		to, err := parseTimeParam(q.Get("to"), now)
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'to': %v", err)
+			return
+		}
+
+		from, err := parseTimeParam(q.Get("from"), to.Add(-time.Hour))
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'from': %v", err)
+			return
+		}
+
+		if min := now.Add(-STATS_RETENTION); from.Before(min) {
+			from = min
+		}
+
+		if !from.Before(to) || to.Sub(from)/interval > STATS_MAX_BUCKETS {
+			writeError(rw, ERR_BODY_INVALID, "invalid or too large time range")
+			return
+		}
+
+		resp := aggregateResponse{
+			Sender:   sender,
+			Interval: interval.String(),
+			Group:    group,
+			Buckets:  collector.aggregate(sender, interval, group == "level", from, to),
+		}
+
+		for i := range resp.Buckets {
+			resp.Buckets[i].At = render.format(resp.Buckets[i].Start)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(resp)
+	}
+}
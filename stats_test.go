@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAggregateHandlerErrors(t *testing.T) {
+	h := makeAggregateHandler(newStatsCollector())
+
+	tests := []struct {
+		method, path string
+		code         errorCode
+	}{
+		{"POST", "/stats/aggregate", ERR_METHOD_INVALID},
+		{"GET", "/stats/aggregate?sender=..", ERR_SENDER_INVALID},
+		{"GET", "/stats/aggregate?interval=90s", ERR_BODY_INVALID},
+		{"GET", "/stats/aggregate?group=sender", ERR_BODY_INVALID},
+		{"GET", "/stats/aggregate?to=yesterday", ERR_BODY_INVALID},
+		{"GET", "/stats/aggregate?from=yesterday", ERR_BODY_INVALID},
+		{"GET", "/stats/aggregate?from=1m&to=2m", ERR_BODY_INVALID},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(test.method, test.path, nil))
+
+		var body errorBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+			t.Errorf("%s %s: no JSON error: %v", test.method, test.path, err)
+			continue
+		}
+
+		if body.Code != test.code || rw.Code != test.code.status() {
+			t.Errorf("%s %s: got %s (%d), expected %s (%d)", test.method, test.path, body.Code, rw.Code, test.code, test.code.status())
+		}
+	}
+}
+
+// stats asked for under an alias are those of the sender it stands for
+func TestAggregateHandlerAliases(t *testing.T) {
+	defer func(a *senderAliases) { aliases = a }(aliases)
+	aliases = &senderAliases{lock: &sync.RWMutex{}, to: map[string]string{"frontend": "web"}}
+
+	collector := newStatsCollector()
+	collector.record("web", "info", time.Now())
+	collector.record("web", "info", time.Now())
+
+	h := makeAggregateHandler(collector)
+
+	for _, name := range []string{"web", "frontend", "Frontend"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/stats/aggregate?interval=1h&sender="+name, nil))
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("%q: got %d, expected %d", name, rw.Code, http.StatusOK)
+			continue
+		}
+
+		var resp aggregateResponse
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var count int64
+		for _, b := range resp.Buckets {
+			count += b.Count
+		}
+
+		if resp.Sender != "web" || count != 2 {
+			t.Errorf("%q: got %d entries of '%s', expected 2 of 'web'", name, count, resp.Sender)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"logit/logg"
+	"strings"
+	"time"
+)
+
+// Storage is where accepted entries end up; the file backend is the default
+// and others (or test fakes) are selected with -storage
+type Storage interface {
+	// Append stores an entry of e.sender
+	Append(e *entry) error
+
+	// Rotate cuts the sender's current file (or the backend's equivalent)
+	Rotate(sender string) error
+
+	// Query returns the entries of a sender matching q, oldest first
+	Query(sender string, q storageQuery) ([]storedEntry, error)
+
+	// Tail returns the last n entries of a sender, oldest first
+	Tail(sender string, n int) ([]storedEntry, error)
+
+	// Delete removes everything stored for a sender
+	Delete(sender string) error
+}
+
+// storedEntry is an entry as read back from a storage
+type storedEntry struct {
+	Sender string    `json:"sender"`
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	Msg    string    `json:"msg"`
+}
+
+type storageQuery struct {
+	level string    // minimum level, "" for all
+	since time.Time // zero for no lower bound
+	until time.Time // zero for no upper bound
+	limit int       // keep the newest limit matches, 0 for all
+
+	terms   []string // lower cased tokens the message must have, see parseSearchQuery
+	phrases []string // lower cased substrings it must have
+}
+
+var errStorageUnsupported = fmt.Errorf("operation not supported by this storage")
+
+// errSenderNotOpen is returned for a sender a storage holds nothing open of
+var errSenderNotOpen = fmt.Errorf("sender has no open file")
+
+func newStorage(kind string, logFilePath string, logger *logg.Logger) (Storage, error) {
+	switch kind {
+	case "", "file":
+		return newFileStorage(logFilePath, logger), nil
+	case "memory":
+		return newMemoryStorage(), nil
+	case "journal":
+		s, err := newJournalStorage()
+		if err != nil {
+			return nil, fmt.Errorf("can't reach the systemd journal: %v", err)
+		}
+		return s, nil
+	case "db":
+		if logFilePath == "" {
+			return nil, fmt.Errorf("db storage needs -w")
+		}
+		return newDbStorage(logFilePath, logger)
+	default:
+		return nil, fmt.Errorf("unknown storage '%s' (expected 'file', 'memory', 'journal' or 'db')", kind)
+	}
+}
+
+// levelAtLeast reports whether level is at or above min
+func levelAtLeast(level, min string) bool {
+	if min == "" {
+		return true
+	}
+
+	return logg.LogLevelFrom(level, logg.LOG_LEVEL_DEBUG) >= logg.LogLevelFrom(min, logg.LOG_LEVEL_DEBUG)
+}
+
+func (q storageQuery) matches(se *storedEntry) bool {
+	if !q.since.IsZero() && se.Time.Before(q.since) {
+		return false
+	}
+
+	if !q.until.IsZero() && se.Time.After(q.until) {
+		return false
+	}
+
+	return levelAtLeast(se.Level, q.level) && q.matchesText(se.Msg)
+}
+
+// collect appends se to matched, keeping only the newest q.limit entries
+func (q storageQuery) collect(matched []storedEntry, se storedEntry) []storedEntry {
+	matched = append(matched, se)
+
+	if q.limit > 0 && len(matched) > q.limit {
+		matched = matched[len(matched)-q.limit:]
+	}
+
+	return matched
+}
+
+var levelTags = map[string]string{
+	"(TRAC)": "trace",
+	"(DEBG)": "debug",
+	"(INFO)": "info",
+	"(WARN)": "warn",
+	"(ERRO)": "error",
+	"(FATL)": "fatal",
+}
+
+const LINE_TIME_LAYOUT = "2006/01/02 15:04:05.000000"
+
+// the time layout and zone of text lines; see -time-format and -time-zone
+var (
+	lineTimeLayout = LINE_TIME_LAYOUT
+	lineTimeLoc    = time.Local
+)
+
+// the -layout of text lines and its parser, nil for logg's default line
+var (
+	lineLayout      *logg.Layout
+	parseLayoutLine func(line string) (logg.LayoutLine, bool)
+)
+
+// parseLineLayout sets the layout of text lines from -layout, after
+// parseLineTime. logit reads its files back, so it must have the time and
+// the message.
+func parseLineLayout(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+
+	if outputFormat != "text" {
+		return fmt.Errorf("-layout needs -format text")
+	}
+
+	layout, err := logg.ParseLayout(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid -layout: %v", err)
+	}
+
+	if !layout.Has('d') || !layout.Has('m') {
+		return fmt.Errorf("-layout '%s' must have the time (%%d) and the message (%%m) for logit to read its files back", pattern)
+	}
+
+	parse, err := layout.Parser(lineTimeLayout, lineTimeLoc)
+	if err != nil {
+		return fmt.Errorf("invalid -layout: %v", err)
+	}
+
+	lineLayout, parseLayoutLine = layout, parse
+
+	return nil
+}
+
+// parseLogLine parses a line written by a logg file logger:
+// '2006/01/02 15:04:05.000000 (INFO) message' or a JSON object
+func parseLogLine(sender, line string) (storedEntry, bool) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSONLogLine(sender, line)
+	}
+
+	if parseLayoutLine != nil {
+		ll, ok := parseLayoutLine(line)
+		if !ok {
+			return storedEntry{}, false
+		}
+
+		msg := ll.Msg
+		if multilineMode == logg.MULTILINE_ESCAPE {
+			msg = logg.UnescapeMessage(msg)
+		}
+
+		return storedEntry{
+			Sender: sender,
+			Time:   ll.Time,
+			Level:  ll.Level,
+			Msg:    msg,
+		}, true
+	}
+
+	// the time ends where the level tag starts, whatever its layout
+	i := strings.Index(line, " (")
+	if i < 0 || len(line) < i+7 {
+		return storedEntry{}, false
+	}
+
+	t, err := time.ParseInLocation(lineTimeLayout, line[:i], lineTimeLoc)
+	if err != nil {
+		return storedEntry{}, false
+	}
+
+	rest := line[i+1:]
+	level, ok := levelTags[rest[:6]]
+	if !ok {
+		return storedEntry{}, false
+	}
+
+	msg := strings.TrimPrefix(rest[6:], " ")
+	if multilineMode == logg.MULTILINE_ESCAPE {
+		msg = logg.UnescapeMessage(msg)
+	}
+
+	return storedEntry{
+		Sender: sender,
+		Time:   t,
+		Level:  level,
+		Msg:    msg,
+	}, true
+}
+
+// parseJSONLogLine parses a line written in logg's JSON format; extra keys are
+// rendered after the message like fields of text lines
+func parseJSONLogLine(sender, line string) (storedEntry, bool) {
+	var m map[string]interface{}
+
+	if json.Unmarshal([]byte(line), &m) != nil {
+		return storedEntry{}, false
+	}
+
+	ts, _ := m["time"].(string)
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return storedEntry{}, false
+	}
+
+	e := entry{fields: make(map[string]interface{})}
+	e.msg, _ = m["msg"].(string)
+	e.level, _ = m["level"].(string)
+
+	for k, v := range m {
+		switch k {
+		case "time", "msg", "level", "prefix":
+		default:
+			e.fields[k] = v
+		}
+	}
+
+	return storedEntry{
+		Sender: sender,
+		Time:   t,
+		Level:  e.level,
+		Msg:    e.render(),
+	}, true
+}
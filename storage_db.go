@@ -0,0 +1,663 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"logit/logg"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the db storage keeps entries in an embedded store below '<-w>/db': a
+// directory a sender, holding a partition a day ('<day>.seg', or
+// '<day>.<area>.seg' for the quarantine and retention classes). a partition
+// is a file of checksummed records whose time range and levels are indexed
+// in memory, so queries read only the partitions that can match, and
+// retention removes whole partitions at once. a record torn by a crash is
+// cut off when its partition is loaded; a corrupt one elsewhere is skipped.
+const (
+	DB_DIR         = "db"
+	DB_SEGMENT_EXT = ".seg"
+	DB_DAY_LAYOUT  = "2006-01-02"
+	DB_PRUNE_EVERY = time.Hour
+
+	dbMagic      = "LOGITDB1"
+	dbHeaderSize = 8        // length and crc32 of a record
+	dbRecordMax  = 64 << 20 // larger lengths are taken for corruption
+	dbFileMode   = os.FileMode(0644)
+)
+
+// levels as a record stores them, by index
+var dbLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+func dbLevelIndex(level string) int {
+	for i, l := range dbLevels {
+		if l == level {
+			return i
+		}
+	}
+
+	return 1 // debug, as normalizeLevel has it
+}
+
+// dbPartition is a day of a sender in an area, and its index
+type dbPartition struct {
+	path string
+	day  time.Time // UTC midnight
+	area string
+
+	f      *os.File // open for appending once written to, else nil
+	size   int64    // of the valid records
+	count  int
+	first  time.Time // earliest entry time, zero when empty
+	last   time.Time // latest
+	levels uint8     // a bit for every level it holds
+}
+
+// holds tells whether the partition may hold entries matching q
+func (p *dbPartition) holds(q storageQuery) bool {
+	if p.count == 0 {
+		return false
+	}
+
+	if !q.since.IsZero() && p.last.Before(q.since) {
+		return false
+	}
+
+	if !q.until.IsZero() && p.first.After(q.until) {
+		return false
+	}
+
+	if q.level == "" {
+		return true
+	}
+
+	return p.levels>>uint(dbLevelIndex(normalizeLevel(q.level))) != 0
+}
+
+func (p *dbPartition) index(t time.Time, level int) {
+	if p.count == 0 || t.Before(p.first) {
+		p.first = t
+	}
+
+	if p.count == 0 || t.After(p.last) {
+		p.last = t
+	}
+
+	p.levels |= 1 << uint(level)
+	p.count++
+}
+
+// dbStorage writes entries to day partitions of every sender
+type dbStorage struct {
+	dir    string // '<-w>/db'
+	logger *logg.Logger
+
+	lock    *sync.Mutex
+	senders map[string][]*dbPartition // loaded senders, partitions by day and area
+}
+
+func newDbStorage(logFilePath string, logger *logg.Logger) (*dbStorage, error) {
+	dir := filepath.Join(logFilePath, DB_DIR)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &dbStorage{
+		dir:     dir,
+		logger:  logger,
+		lock:    &sync.Mutex{},
+		senders: make(map[string][]*dbPartition),
+	}
+
+	fds = append(fds, s)
+
+	return s, nil
+}
+
+// partitionsOf returns the partitions of a sender, indexing them on first
+// use; s.lock is held
+func (s *dbStorage) partitionsOf(sender string) ([]*dbPartition, error) {
+	if parts, ok := s.senders[sender]; ok {
+		return parts, nil
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, sender, "*"+DB_SEGMENT_EXT))
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*dbPartition
+
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), DB_SEGMENT_EXT)
+
+		dayStr, area := base, ""
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			dayStr, area = base[:i], base[i+1:]
+		}
+
+		day, err := time.Parse(DB_DAY_LAYOUT, dayStr)
+		if err != nil {
+			continue
+		}
+
+		p := &dbPartition{path: name, day: day, area: area}
+		if err := s.load(p); err != nil {
+			return nil, fmt.Errorf("can't index '%s': %v", name, err)
+		}
+
+		parts = append(parts, p)
+	}
+
+	sortPartitions(parts)
+	s.senders[sender] = parts
+
+	return parts, nil
+}
+
+func sortPartitions(parts []*dbPartition) {
+	sort.Slice(parts, func(i, j int) bool {
+		if !parts[i].day.Equal(parts[j].day) {
+			return parts[i].day.Before(parts[j].day)
+		}
+
+		return parts[i].area < parts[j].area
+	})
+}
+
+// load indexes a partition, cutting off a record left torn by a crash
+func (s *dbStorage) load(p *dbPartition) error {
+	f, err := os.OpenFile(p.path, os.O_RDWR, dbFileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size, skipped, err := scanPartition(f, fi.Size(), func(se storedEntry, level int) {
+		p.index(se.Time, level)
+	})
+	if err != nil {
+		return err
+	}
+
+	if skipped > 0 {
+		s.logger.Errorf("db partition '%s' has %d corrupt bytes, skipped to the records after them", p.path, skipped)
+	}
+
+	if fi.Size() > size {
+		s.logger.Warnf("db partition '%s' ends in a torn record, cut at %d bytes", p.path, size)
+
+		if err := f.Truncate(size); err != nil {
+			return err
+		}
+	}
+
+	p.size = size
+
+	return nil
+}
+
+// scanPartition reads the records of a partition, up to limit bytes, to fn
+// and returns where the last valid one ends. a crash only tears the last
+// record, which is left past the end, while a bad sector or a flipped bit
+// may hit any: a corrupt record is skipped up to the next valid one, and
+// skipped tells how many bytes were.
+func scanPartition(r io.ReaderAt, limit int64, fn func(se storedEntry, level int)) (end int64, skipped int64, err error) {
+	d := &dbReader{r: r, limit: limit}
+
+	magic, ok := d.at(0, len(dbMagic))
+	if !ok {
+		// a partition created but never written to
+		return 0, 0, d.err
+	}
+
+	if string(magic) != dbMagic {
+		return 0, 0, fmt.Errorf("not a db partition")
+	}
+
+	off := int64(len(dbMagic))
+	end = off
+
+	for {
+		n, ok := d.record(off, fn)
+		if d.err != nil {
+			return end, skipped, d.err
+		}
+
+		if ok {
+			off += n
+			end = off
+			continue
+		}
+
+		next := off + 1
+		for ; next+dbHeaderSize <= limit; next++ {
+			if _, ok := d.record(next, nil); ok || d.err != nil {
+				break
+			}
+		}
+
+		if d.err != nil {
+			return end, skipped, d.err
+		}
+
+		if next+dbHeaderSize > limit {
+			// nothing valid after it: a torn record, or the end
+			return end, skipped, nil
+		}
+
+		skipped += next - off
+		off = next
+	}
+}
+
+// DB_READ_BUFFER is how much of a partition is read at once
+const DB_READ_BUFFER = 64 << 10
+
+// dbReader reads a partition through a window of it
+type dbReader struct {
+	r     io.ReaderAt
+	limit int64
+
+	buf []byte
+	off int64 // of buf in the partition
+	err error // other than the end of the partition
+}
+
+// at returns the n bytes at off, which are only valid until the next call;
+// false if the partition ends before them
+func (d *dbReader) at(off int64, n int) ([]byte, bool) {
+	if off+int64(n) > d.limit {
+		return nil, false
+	}
+
+	if off >= d.off && off+int64(n) <= d.off+int64(len(d.buf)) {
+		return d.buf[off-d.off : off-d.off+int64(n)], true
+	}
+
+	size := n
+	if size < DB_READ_BUFFER {
+		size = DB_READ_BUFFER
+	}
+	if rest := d.limit - off; int64(size) > rest {
+		size = int(rest)
+	}
+
+	if cap(d.buf) < size {
+		d.buf = make([]byte, size)
+	}
+
+	m, err := d.r.ReadAt(d.buf[:size], off)
+	d.buf, d.off = d.buf[:m], off
+
+	if m < n {
+		if err != nil && err != io.EOF {
+			d.err = err
+		}
+		return nil, false
+	}
+
+	return d.buf[:n], true
+}
+
+// record reads the record at off to fn, if it is valid, and returns its
+// size
+func (d *dbReader) record(off int64, fn func(se storedEntry, level int)) (int64, bool) {
+	// the header and the level tell most garbage apart before the
+	// payload is read, which counts when looking for the next record
+	head, ok := d.at(off, dbHeaderSize+9)
+	if !ok {
+		return 0, false
+	}
+
+	n := binary.BigEndian.Uint32(head)
+	sum := binary.BigEndian.Uint32(head[4:])
+	level := int(head[dbHeaderSize+8])
+
+	if n < 9 || n > dbRecordMax || level >= len(dbLevels) {
+		return 0, false
+	}
+
+	payload, ok := d.at(off+dbHeaderSize, int(n))
+	if !ok || crc32.ChecksumIEEE(payload) != sum {
+		return 0, false
+	}
+
+	if fn != nil {
+		fn(storedEntry{
+			Time:  time.Unix(0, int64(binary.BigEndian.Uint64(payload))),
+			Level: dbLevels[level],
+			Msg:   string(payload[9:]),
+		}, level)
+	}
+
+	return int64(dbHeaderSize) + int64(n), true
+}
+
+// encodeRecord makes the record of an entry: its length and crc32, then
+// the time in unix nanoseconds, the level and the message
+func encodeRecord(t time.Time, level int, msg string) []byte {
+	b := make([]byte, dbHeaderSize+9+len(msg))
+	payload := b[dbHeaderSize:]
+
+	binary.BigEndian.PutUint64(payload, uint64(t.UnixNano()))
+	payload[8] = byte(level)
+	copy(payload[9:], msg)
+
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+
+	return b
+}
+
+// partitionOf returns the partition of a sender's day in an area, creating
+// it if it is new; s.lock is held
+func (s *dbStorage) partitionOf(sender, area string, t time.Time) (*dbPartition, error) {
+	parts, err := s.partitionsOf(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	day := t.UTC().Truncate(24 * time.Hour)
+
+	for _, p := range parts {
+		if p.day.Equal(day) && p.area == area {
+			return p, nil
+		}
+	}
+
+	name := day.Format(DB_DAY_LAYOUT)
+	if area != "" {
+		name += "." + area
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.dir, sender), 0755); err != nil {
+		return nil, err
+	}
+
+	p := &dbPartition{path: filepath.Join(s.dir, sender, name+DB_SEGMENT_EXT), day: day, area: area}
+
+	parts = append(parts, p)
+	sortPartitions(parts)
+	s.senders[sender] = parts
+
+	return p, nil
+}
+
+func (s *dbStorage) Append(e *entry) error {
+	level := logg.LogLevelFrom(e.level, logg.LOG_LEVEL_DEBUG)
+	if level < levelPrefs.level(e.sender) {
+		return nil
+	}
+
+	t := e.time()
+	index := dbLevelIndex(e.level)
+	record := encodeRecord(t, index, e.render())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p, err := s.partitionOf(e.sender, e.area(), t)
+	if err != nil {
+		return err
+	}
+
+	if p.f == nil {
+		f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, dbFileMode)
+		if err != nil {
+			return err
+		}
+
+		if p.size == 0 {
+			if _, err := f.WriteAt([]byte(dbMagic), 0); err != nil {
+				f.Close()
+				return err
+			}
+			p.size = int64(len(dbMagic))
+		}
+
+		p.f = f
+	}
+
+	// a failed write leaves a torn record past p.size, overwritten by the next
+	if _, err := p.f.WriteAt(record, p.size); err != nil {
+		return err
+	}
+
+	if sync := syncPrefs.level(e.sender); e.sync || (sync != 0 && level >= sync) {
+		if err := p.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	p.size += int64(len(record))
+	p.index(t, index)
+
+	return nil
+}
+
+// Rotate closes the files of a sender's partitions; days partition entries,
+// so there is nothing to cut
+func (s *dbStorage) Rotate(sender string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	parts, ok := s.senders[sender]
+	if !ok {
+		return errSenderNotOpen
+	}
+
+	for _, p := range parts {
+		p.close()
+	}
+
+	return nil
+}
+
+func (p *dbPartition) close() {
+	if p.f != nil {
+		p.f.Close()
+		p.f = nil
+	}
+}
+
+// read returns the entries of the sender's default area partitions that
+// may hold entries matching q, each partition's oldest first, newest
+// partitions first when backwards; fn returning false stops it
+func (s *dbStorage) read(sender string, q storageQuery, backwards bool, fn func(entries []storedEntry) bool) error {
+	s.lock.Lock()
+	parts, err := s.partitionsOf(sender)
+
+	var paths []string
+	var sizes []int64
+
+	for _, p := range parts {
+		if p.area == "" && p.holds(q) {
+			paths = append(paths, p.path)
+			sizes = append(sizes, p.size)
+		}
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for i := range paths {
+		if backwards {
+			i = len(paths) - 1 - i
+		}
+
+		f, err := os.Open(paths[i])
+		if os.IsNotExist(err) {
+			// pruned meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var entries []storedEntry
+
+		// records past the size indexed are being written
+		_, _, err = scanPartition(f, sizes[i], func(se storedEntry, level int) {
+			se.Sender = sender
+			entries = append(entries, se)
+		})
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+
+		// late entries are appended after newer ones
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+		if !fn(entries) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *dbStorage) Query(sender string, q storageQuery) ([]storedEntry, error) {
+	var matched []storedEntry
+
+	err := s.read(sender, q, false, func(entries []storedEntry) bool {
+		for _, se := range entries {
+			if q.matches(&se) {
+				matched = q.collect(matched, se)
+			}
+		}
+
+		return true
+	})
+
+	return matched, err
+}
+
+func (s *dbStorage) Tail(sender string, n int) ([]storedEntry, error) {
+	var tail []storedEntry
+
+	err := s.read(sender, storageQuery{}, true, func(entries []storedEntry) bool {
+		tail = append(entries, tail...)
+		return len(tail) < n
+	})
+
+	if len(tail) > n {
+		tail = tail[len(tail)-n:]
+	}
+
+	return tail, err
+}
+
+func (s *dbStorage) Delete(sender string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range s.senders[sender] {
+		p.close()
+	}
+	delete(s.senders, sender)
+
+	return os.RemoveAll(filepath.Join(s.dir, sender))
+}
+
+// Close closes the files of every partition
+func (s *dbStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, parts := range s.senders {
+		for _, p := range parts {
+			p.close()
+		}
+	}
+
+	return nil
+}
+
+// run prunes expired partitions every interval
+func (s *dbStorage) run(interval time.Duration) {
+	for {
+		if n, err := s.prune(time.Now()); err != nil {
+			s.logger.Errorf("pruning db partitions failed: %v", err)
+		} else if n > 0 {
+			s.logger.Infof("pruned %d expired db partitions", n)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// prune removes the partitions whose whole day is older than what their
+// sender keeps (-max-age-days and overrides) or their retention class
+// does, and returns how many it removed
+func (s *dbStorage) prune(now time.Time) (int, error) {
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pruned := 0
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		sender := d.Name()
+
+		parts, err := s.partitionsOf(sender)
+		if err != nil {
+			return pruned, err
+		}
+
+		_, age := retentionOf(sender)
+		kept := parts[:0]
+
+		for _, p := range parts {
+			keep := age
+			if d, ok := retainOfArea(p.area); ok {
+				keep = d
+			}
+
+			if keep <= 0 || now.Sub(p.day.Add(24*time.Hour)) < keep {
+				kept = append(kept, p)
+				continue
+			}
+
+			p.close()
+
+			if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+				kept = append(kept, p)
+				s.logger.Errorf("removing db partition '%s' failed: %v", p.path, err)
+				continue
+			}
+
+			pruned++
+		}
+
+		s.senders[sender] = kept
+	}
+
+	return pruned, nil
+}
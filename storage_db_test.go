@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"logit/logg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var dbTestDay = time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+
+func openTestDb(t *testing.T, dir string) *dbStorage {
+	t.Helper()
+
+	if levelPrefs == nil {
+		levelPrefs, _ = newLevelPolicy("")
+	}
+
+	if syncPrefs == nil {
+		syncPrefs, _ = newDurabilityPolicy("", "")
+	}
+
+	s, err := newDbStorage(dir, logg.NewLogger("", io.Discard, logg.LOG_LEVEL_DEBUG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func dbTestEntry(i int) *entry {
+	return &entry{
+		sender:   "web",
+		level:    "info",
+		msg:      fmt.Sprintf("entry %d", i),
+		received: dbTestDay.Add(time.Duration(i) * time.Second),
+	}
+}
+
+// writeTestDb writes entries 0 to n-1 of web, closes the storage and
+// returns the path of their partition and where each record starts
+func writeTestDb(t *testing.T, dir string, n int) (string, []int64) {
+	t.Helper()
+
+	s := openTestDb(t, dir)
+
+	offsets := []int64{int64(len(dbMagic))}
+	for i := 0; i < n; i++ {
+		e := dbTestEntry(i)
+
+		if err := s.Append(e); err != nil {
+			t.Fatal(err)
+		}
+
+		record := encodeRecord(e.time(), dbLevelIndex(e.level), e.render())
+		offsets = append(offsets, offsets[i]+int64(len(record)))
+	}
+
+	s.Close()
+
+	return filepath.Join(dir, DB_DIR, "web", "2026-10-15"+DB_SEGMENT_EXT), offsets
+}
+
+// expectTestDb reopens the storage and checks web holds the entries of ids
+func expectTestDb(t *testing.T, dir string, ids ...int) {
+	t.Helper()
+
+	s := openTestDb(t, dir)
+	defer s.Close()
+
+	entries, err := s.Tail("web", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != len(ids) {
+		t.Fatalf("got %d entries, expected %d: %v", len(entries), len(ids), entries)
+	}
+
+	for i, id := range ids {
+		if expected := dbTestEntry(id).msg; entries[i].Msg != expected {
+			t.Errorf("entry %d: got %q, expected %q", i, entries[i].Msg, expected)
+		}
+	}
+}
+
+func appendTestDb(t *testing.T, dir string, i int) {
+	t.Helper()
+
+	s := openTestDb(t, dir)
+	defer s.Close()
+
+	if err := s.Append(dbTestEntry(i)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fi.Size()
+}
+
+// a record torn by a crash is cut off when the partition is loaded, and
+// entries written after go where it was
+func TestDbStorageTornRecord(t *testing.T) {
+	e := dbTestEntry(5)
+	record := encodeRecord(e.time(), dbLevelIndex(e.level), e.render())
+
+	for _, torn := range []int{1, dbHeaderSize - 1, dbHeaderSize, dbHeaderSize + 9, len(record) - 1} {
+		t.Run(fmt.Sprintf("%d bytes", torn), func(t *testing.T) {
+			dir := t.TempDir()
+			path, offsets := writeTestDb(t, dir, 5)
+
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(record[:torn])
+			f.Close()
+
+			expectTestDb(t, dir, 0, 1, 2, 3, 4)
+
+			if size := fileSize(t, path); size != offsets[5] {
+				t.Errorf("partition of %d bytes, expected it cut to %d", size, offsets[5])
+			}
+
+			appendTestDb(t, dir, 6)
+			expectTestDb(t, dir, 0, 1, 2, 3, 4, 6)
+		})
+	}
+}
+
+// a record corrupted in the middle of a partition is skipped, while the
+// records after it are kept and read
+func TestDbStorageCorruptRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte, offsets []int64)
+	}{
+		{"payload", func(b []byte, offsets []int64) { b[offsets[2]+dbHeaderSize+10] ^= 0x01 }},
+		{"checksum", func(b []byte, offsets []int64) { b[offsets[2]+5] ^= 0x80 }},
+		{"length too large", func(b []byte, offsets []int64) { copy(b[offsets[2]:], []byte{0xff, 0xff, 0xff, 0xff}) }},
+		{"length too small", func(b []byte, offsets []int64) { copy(b[offsets[2]:], []byte{0, 0, 0, 4}) }},
+		{"length into the next record", func(b []byte, offsets []int64) { b[offsets[2]+3] += 4 }},
+		{"level", func(b []byte, offsets []int64) { b[offsets[2]+dbHeaderSize+8] = 0xff }},
+		{"zeroed", func(b []byte, offsets []int64) {
+			for i := offsets[2]; i < offsets[3]; i++ {
+				b[i] = 0
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path, offsets := writeTestDb(t, dir, 5)
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.corrupt(b, offsets)
+
+			if err := os.WriteFile(path, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			expectTestDb(t, dir, 0, 1, 3, 4)
+
+			if size := fileSize(t, path); size != offsets[5] {
+				t.Errorf("partition of %d bytes, expected it kept whole at %d", size, offsets[5])
+			}
+
+			appendTestDb(t, dir, 6)
+			expectTestDb(t, dir, 0, 1, 3, 4, 6)
+		})
+	}
+}
+
+// a corrupt last record can't be told from a torn one, so it is cut
+func TestDbStorageCorruptLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	path, offsets := writeTestDb(t, dir, 5)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[offsets[4]+dbHeaderSize+10] ^= 0x01
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTestDb(t, dir, 0, 1, 2, 3)
+
+	if size := fileSize(t, path); size != offsets[4] {
+		t.Errorf("partition of %d bytes, expected it cut to %d", size, offsets[4])
+	}
+}
+
+// a file that isn't a partition is refused rather than cut
+func TestDbStorageNotAPartition(t *testing.T) {
+	dir := t.TempDir()
+	path, offsets := writeTestDb(t, dir, 2)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[0] = 'X'
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestDb(t, dir)
+	defer s.Close()
+
+	if _, err := s.Tail("web", 10); err == nil {
+		t.Errorf("read a partition with a bad magic")
+	}
+
+	if size := fileSize(t, path); size != offsets[2] {
+		t.Errorf("partition of %d bytes, expected it left at %d", size, offsets[2])
+	}
+}
+
+// a partition created but never written to holds nothing
+func TestDbStorageEmptyPartition(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, DB_DIR, "web"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, DB_DIR, "web", "2026-10-15"+DB_SEGMENT_EXT), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTestDb(t, dir)
+
+	appendTestDb(t, dir, 0)
+	expectTestDb(t, dir, 0)
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"logit/logg"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how text lines carry messages of several lines (e.g. stack traces); see
+// -multiline and -multiline-indent
+var (
+	multilineMode      = logg.MULTILINE_INDENT
+	continuationIndent = logg.DEFAULT_CONTINUATION_INDENT
+)
+
+// parseMultiline takes -multiline, 'indent' or 'escape', and with indent
+// -multiline-indent: the spaces continuation lines start with, or 'tab'
+func parseMultiline(mode, indent string) error {
+	if multilineMode = logg.MultilineModeFrom(mode, -1); multilineMode == -1 {
+		return fmt.Errorf("unknown multiline mode '%s' (expected 'indent' or 'escape')", mode)
+	}
+
+	if indent == "tab" {
+		continuationIndent = "\t"
+		return nil
+	}
+
+	n, err := strconv.Atoi(indent)
+	if err != nil || n < 1 || n > 64 {
+		return fmt.Errorf("invalid multiline indent '%s' (expected 1 to 64 spaces or 'tab')", indent)
+	}
+
+	continuationIndent = strings.Repeat(" ", n)
+	return nil
+}
+
+// WRITE_ERROR_EVERY is how often errors writing a sender's files are logged
+// at most
+const WRITE_ERROR_EVERY = time.Minute
+
+// fileStorage writes through per-sender logg file loggers (or stdout when no
+// log directory is set), which is how logit always stored entries
+type fileStorage struct {
+	dir    string
+	logger *logg.Logger // server logger, for errors
+
+	rotatedNames map[string]func(i int) string // guarded by lock
+	newest       map[string]time.Time          // of each logger key, guarded by lock
+}
+
+func newFileStorage(dir string, logger *logg.Logger) *fileStorage {
+	return &fileStorage{
+		dir:          dir,
+		logger:       logger,
+		rotatedNames: make(map[string]func(i int) string),
+		newest:       make(map[string]time.Time),
+	}
+}
+
+func (s *fileStorage) Append(e *entry) error {
+	senderLogger := s.loggerOf(e.sender, e.area())
+
+	if lateMode == LATE_DIVERT && !e.at.IsZero() {
+		key := e.sender
+		if e.area() != "" {
+			key = e.area() + "/" + e.sender
+		}
+
+		if s.isLate(key, e) {
+			if lateLogger := s.lateLoggerOf(key, e); lateLogger != nil {
+				lateLogger.SetLevel(levelPrefs.level(e.sender))
+				lateLogger.SetOverflowPolicy(overflowPolicy)
+				lateLogger.SetBuffer(writeBuffer, writeBufferFlush)
+				return writeEntry(lateLogger, e)
+			}
+		}
+	}
+
+	senderLogger.SetGzip(gzPrefs.enabled(e.sender))
+	senderLogger.SetSyncLevel(syncPrefs.level(e.sender))
+	noisePrefs.apply(senderLogger, e.sender)
+	senderLogger.SetLevel(levelPrefs.level(e.sender))
+	senderLogger.SetOverflowPolicy(overflowPolicy)
+	senderLogger.SetBuffer(writeBuffer, writeBufferFlush)
+
+	return writeEntry(senderLogger, e)
+}
+
+func (s *fileStorage) Rotate(sender string) error {
+	senderLogger := logg.Lookup(sender)
+	if senderLogger == nil {
+		return errSenderNotOpen
+	}
+
+	return senderLogger.Rotate()
+}
+
+// loggerOf returns the logger of a sender, creating it on first use.
+// entries of an area (quarantine, retention classes) get their own files
+// below the area's directory.
+func (s *fileStorage) loggerOf(sender string, area string) *logg.Logger {
+	key := sender
+	if area != "" {
+		key = area + "/" + sender
+	}
+
+	senderLogger := logg.Lookup(key)
+
+	lock.Lock()
+	current := loggerPaths[key]
+	lock.Unlock()
+
+	if senderLogger != nil && namer != nil && namer.dated(sender) {
+		// a date in the file name rolls the sender over to a new file
+		path, err := namer.live(sender, time.Now())
+		if err == nil {
+			path = areaPath(s.dir, area, path)
+		}
+
+		// of entries racing over the date, one closes the old file
+		if err == nil && path != current && logg.Unregister(key, senderLogger) {
+			senderLogger.Close()
+		}
+	}
+
+	// the logger of a key is made once, however many entries ask for it
+	senderLogger, _ = logg.GetOrCreate(key, func() (*logg.Logger, error) {
+		return s.newLogger(sender, area, key), nil
+	})
+
+	return senderLogger
+}
+
+// newLogger opens the logger of a sender in an area, registered as key, and
+// notes where it writes
+func (s *fileStorage) newLogger(sender, area, key string) *logg.Logger {
+	var senderLogger *logg.Logger
+	var path string
+	var rotatedName func(i int) string
+
+	if s.dir == "" {
+		senderLogger = logg.NewLogger(key, os.Stdout, logg.LOG_LEVEL_TRACE)
+		senderLogger.SetColor(colorMode)
+
+	} else {
+		now := time.Now()
+
+		var err error
+
+		path, err = namer.live(sender, now)
+		if err == nil {
+			path = areaPath(s.dir, area, path)
+		}
+
+		if err == nil {
+			err = makeLogDir(filepath.Dir(path))
+		}
+
+		if err == nil {
+			senderLogger, err = logg.NewFileLoggerWithOptions("", path, logg.LOG_LEVEL_TRACE, maxSizeOf(sender), enableGz, fileOptions)
+		}
+
+		if err == nil {
+			senderLogger.SetRotationPolicy(rotationPolicy)
+		}
+
+		if err != nil {
+			s.logger.Errorf("can't open log file for '%s': %v", key, err)
+			senderLogger = logg.NewLogger(key, os.Stdout, logg.LOG_LEVEL_TRACE)
+			senderLogger.SetColor(colorMode)
+			path = ""
+		} else {
+			rotatedName = namer.rotatedNameFunc(sender, path, now)
+			makeLogDir(filepath.Dir(rotatedName(0)))
+
+			senderLogger.SetRotatedNameFunc(rotatedName)
+			if rotatedAt, glob := namer.rotatedTimeFunc(sender, path, now); rotatedAt != nil {
+				senderLogger.SetRotatedTimeFunc(rotatedAt, glob)
+				makeLogDir(filepath.Dir(rotatedAt(now)))
+			}
+			setRetention(senderLogger)
+
+			backups, age := retentionOf(sender)
+			senderLogger.SetMaxBackups(backups)
+			senderLogger.SetMaxAge(age)
+
+			if err := setSpill(senderLogger, key); err != nil {
+				s.logger.Errorf("can't open spill file for '%s': %v", key, err)
+			}
+
+			senderLogger.OnError(s.writeErrorsOf(key))
+
+			if consoleSpec == "all" {
+				senderLogger.AddWriter(consoleWriter{key})
+			}
+
+			if lateMode == LATE_RESORT {
+				senderLogger.SetRotateHook(resortFile)
+			}
+
+			// a retention class expires by age, so its files roll over by time
+			if retain, ok := retainOfArea(area); ok {
+				senderLogger.SetMaxAge(retain)
+
+				if rotationPolicy == nil && retain >= 2*24*time.Hour {
+					senderLogger.SetRotationPolicy(logg.ROTATE_DAILY)
+				} else if rotationPolicy == nil {
+					senderLogger.SetRotationPolicy(logg.ROTATE_HOURLY)
+				}
+			}
+		}
+	}
+
+	setLineFormat(senderLogger)
+
+	lock.Lock()
+	loggerPaths[key] = path
+	s.rotatedNames[key] = rotatedName
+	lock.Unlock()
+
+	return senderLogger
+}
+
+// writeErrorsOf returns what reports the errors writing the logs of key
+// (a full disk, lost permissions, a failing sink) to the server log, one per
+// WRITE_ERROR_EVERY at most; only the logger's actor calls it
+func (s *fileStorage) writeErrorsOf(key string) func(err error) {
+	var (
+		last    time.Time
+		skipped int
+	)
+
+	return func(err error) {
+		now := time.Now()
+		if now.Sub(last) < WRITE_ERROR_EVERY {
+			skipped += 1
+			return
+		}
+		last = now
+
+		if skipped > 0 {
+			s.logger.Errorf("writing logs of '%s' failed: %v (%d more errors since the last report)", key, err, skipped)
+		} else {
+			s.logger.Errorf("writing logs of '%s' failed: %v", key, err)
+		}
+
+		skipped = 0
+	}
+}
+
+// files returns the existing files of a sender, oldest first
+func (s *fileStorage) files(sender string) ([]string, error) {
+	if s.dir == "" {
+		return nil, errStorageUnsupported
+	}
+
+	lock.Lock()
+	live := loggerPaths[sender]
+	rotatedName := s.rotatedNames[sender]
+	lock.Unlock()
+
+	if live == "" {
+		// not written since start; look where it would be written
+		var err error
+
+		live, err = namer.live(sender, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		rotatedName = namer.rotatedNameFunc(sender, live, time.Now())
+	}
+
+	var files []string
+
+	if _, glob := namer.rotatedTimeFunc(sender, live, time.Now()); glob != "" {
+		// files named by the time they were rotated at, with the '.N' of
+		// names taken; they were last written in order
+		plain, _ := filepath.Glob(glob)
+		more, _ := filepath.Glob(glob + ".*")
+
+		files = sortByModTime(append(plain, more...))
+	} else {
+		for i := 0; ; i++ {
+			path := rotatedName(i)
+			if i > 0 && path == rotatedName(0) {
+				break // a name without the number
+			}
+
+			if compressed, ok := compressedPath(path); ok {
+				files = append(files, compressed)
+			} else if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+			} else {
+				break
+			}
+		}
+
+		// rotated files are numbered newest first
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+
+	// files rolled over by time ('<live>.2024-05-01[.N][.gz|.zst]') sort by
+	// name
+	dated, _ := filepath.Glob(live + ".[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]*")
+	sort.Slice(dated, func(i, j int) bool {
+		return trimCompressed(dated[i]) < trimCompressed(dated[j])
+	})
+	files = append(dated, files...)
+
+	// diverted late entries are older than anything else
+	files = append(s.lateFiles(live), files...)
+
+	if _, err := os.Stat(live); err == nil {
+		files = append(files, live)
+	}
+
+	return files, nil
+}
+
+// sortByModTime sorts paths oldest first, leaving out those gone
+func sortByModTime(paths []string) []string {
+	modTimes := make(map[string]time.Time, len(paths))
+	var sorted []string
+
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && !strings.HasSuffix(path, ".tmp") {
+			modTimes[path] = fi.ModTime()
+			sorted = append(sorted, path)
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return modTimes[sorted[i]].Before(modTimes[sorted[j]])
+	})
+
+	return sorted
+}
+
+// compressedPath returns the name path has compressed, if it is
+func compressedPath(path string) (string, bool) {
+	for _, suffix := range logg.RotatedSuffixes() {
+		if _, err := os.Stat(path + suffix); err == nil {
+			return path + suffix, true
+		}
+	}
+
+	return path, false
+}
+
+// trimCompressed returns path without a compression or encryption suffix
+func trimCompressed(path string) string {
+	path = strings.TrimSuffix(path, logg.ENCRYPTED_SUFFIX)
+
+	if codec, ok := logg.CodecOf(path); ok {
+		return strings.TrimSuffix(path, codec.Suffix())
+	}
+
+	return path
+}
+
+// readEntries parses a (possibly compressed) log file, calling fn for each
+// entry
+func readEntries(sender, path string, fn func(se storedEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompressed(path, f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var pending *storedEntry
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if pending != nil && strings.HasPrefix(line, continuationIndent) {
+			pending.Msg += "\n" + line[len(continuationIndent):]
+			continue
+		}
+
+		se, ok := parseLogLine(sender, line)
+		if !ok {
+			continue
+		}
+
+		if pending != nil {
+			fn(*pending)
+		}
+		pending = &se
+	}
+
+	if pending != nil {
+		fn(*pending)
+	}
+
+	return scanner.Err()
+}
+
+func (s *fileStorage) Query(sender string, q storageQuery) ([]storedEntry, error) {
+	files, err := s.files(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure queued entries are on disk
+	logg.Flush()
+
+	var matched []storedEntry
+
+	// late entries make files overlap in time, so matches are ordered by
+	// time before the newest q.limit are kept
+	trim := func(n int) {
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Time.Before(matched[j].Time)
+		})
+
+		if len(matched) > n {
+			matched = matched[len(matched)-n:]
+		}
+	}
+
+	for _, path := range files {
+		if searcher != nil {
+			// skip files whose index tells they hold no match
+			if idx := searcher.of(path); idx != nil && !idx.mayMatch(q) {
+				continue
+			}
+		}
+
+		if !q.since.IsZero() {
+			// skip files that were finished before the range starts
+			if fi, err := os.Stat(path); err == nil && fi.ModTime().Before(q.since) {
+				continue
+			}
+		}
+
+		err := readEntries(sender, path, func(se storedEntry) {
+			if !q.matches(&se) {
+				return
+			}
+
+			matched = append(matched, se)
+			if q.limit > 0 && len(matched) >= 2*q.limit {
+				trim(q.limit)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if q.limit > 0 {
+		trim(q.limit)
+	} else {
+		trim(len(matched))
+	}
+
+	return matched, nil
+}
+
+func (s *fileStorage) Tail(sender string, n int) ([]storedEntry, error) {
+	files, err := s.files(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	logg.Flush()
+
+	q := storageQuery{limit: n}
+	var matched []storedEntry
+
+	// read newest files first until there are enough lines
+	for i := len(files) - 1; i >= 0 && len(matched) < n; i-- {
+		var part []storedEntry
+
+		err := readEntries(sender, files[i], func(se storedEntry) {
+			part = q.collect(part, se)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		matched = append(part, matched...)
+	}
+
+	if len(matched) > n {
+		matched = matched[len(matched)-n:]
+	}
+
+	return matched, nil
+}
+
+func (s *fileStorage) Delete(sender string) error {
+	files, err := s.files(sender)
+	if err != nil {
+		return err
+	}
+
+	logg.Flush()
+
+	senderLogger := logg.Lookup(sender)
+	if senderLogger != nil && !logg.Unregister(sender, senderLogger) {
+		senderLogger = nil
+	}
+
+	lock.Lock()
+	delete(loggerPaths, sender)
+	delete(s.rotatedNames, sender)
+	delete(s.newest, sender)
+	lock.Unlock()
+
+	if senderLogger != nil {
+		senderLogger.Close()
+	}
+
+	closeLateLoggers(sender)
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrite passes every line of the sender's finished files through fn and
+// replaces the files that changed. files a logger appends to (the live file,
+// open late files) are left alone, and so is a file compressed or pruned
+// while it was read.
+func (s *fileStorage) rewrite(sender string, fn func(line string) (string, int, error)) (int, int, error) {
+	files, err := s.files(sender)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// files loggers append to: the live one, and late files of the sender
+	open := make(map[string]bool)
+
+	lock.Lock()
+	live := loggerPaths[sender]
+	for _, path := range loggerPaths {
+		open[path] = true
+	}
+	lock.Unlock()
+
+	if live == "" {
+		live, _ = namer.live(sender, time.Now())
+	}
+	open[live] = true
+
+	rewritten, changes := 0, 0
+
+	for _, path := range files {
+		if open[path] {
+			continue
+		}
+
+		n, err := rewriteFile(path, fn)
+		if err != nil {
+			return rewritten, changes, fmt.Errorf("%s: %v", path, err)
+		}
+
+		if n > 0 {
+			rewritten++
+			changes += n
+		}
+	}
+
+	return rewritten, changes, nil
+}
+
+// rewriteFile atomically replaces a (possibly compressed) file with its lines
+// passed through fn, unless nothing changed
+func rewriteFile(path string, fn func(line string) (string, int, error)) (int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := decompressed(path, in)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	tmp := path + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = out
+	var sw, cw io.WriteCloser
+
+	// decompressed opened an encrypted file, so there is a sealer
+	name := path
+	if strings.HasSuffix(name, logg.ENCRYPTED_SUFFIX) {
+		if sw, err = sealer.Seal(out); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+		w = sw
+		name = strings.TrimSuffix(name, logg.ENCRYPTED_SUFFIX)
+	}
+
+	if codec, ok := logg.CodecOf(name); ok {
+		if cw, err = codec.NewWriter(out, levelOf(codec)); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+		w = cw
+	}
+
+	bw := bufio.NewWriter(w)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	changes := 0
+
+	for scanner.Scan() && err == nil {
+		var line string
+		var n int
+
+		if line, n, err = fn(scanner.Text()); err == nil {
+			changes += n
+			_, err = bw.WriteString(line + "\n")
+		}
+	}
+
+	if err == nil {
+		err = scanner.Err()
+	}
+
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if err == nil && cw != nil {
+		err = cw.Close()
+	}
+
+	if err == nil && sw != nil {
+		err = sw.Close()
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if _, serr := os.Stat(path); err == nil && serr != nil {
+		// compressed or pruned meanwhile; its successor is seen next time
+		changes = 0
+	}
+
+	if err != nil || changes == 0 {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+
+	return changes, os.Rename(tmp, path)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"logit/logg"
+)
+
+// journalStorage hands entries to the systemd journal, for hosts where
+// journald keeps the logs, each sender being a SYSLOG_IDENTIFIER of its
+// own. nothing stays to be read back, so /logs, tail and rotations answer
+// that the storage doesn't support them; journalctl reads the entries.
+type journalStorage struct {
+	sink logg.Sink
+}
+
+func newJournalStorage() (*journalStorage, error) {
+	sink, err := logg.JournalSink("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &journalStorage{sink: sink}, nil
+}
+
+func (s *journalStorage) Append(e *entry) error {
+	fields := make(logg.Fields, len(e.fields)+5)
+	for k, v := range e.storedFields() {
+		fields[k] = v
+	}
+
+	// what logit knows of the entry besides the client's fields
+	fields["logit_sender"] = e.sender
+	if e.retain != "" {
+		fields["logit_retain"] = e.retain
+	}
+	if e.id != "" {
+		fields["logit_id"] = e.id
+	}
+	if e.quarantined {
+		fields["logit_quarantined"] = true
+	}
+
+	return s.sink.Write(logg.Entry{
+		Time:   e.time(),
+		Level:  logg.LogLevelFrom(e.level, logg.LOG_LEVEL_INFO),
+		Prefix: e.sender,
+		Msg:    e.msg,
+		Fields: fields,
+	})
+}
+
+func (s *journalStorage) Rotate(sender string) error {
+	return errStorageUnsupported
+}
+
+func (s *journalStorage) Query(sender string, q storageQuery) ([]storedEntry, error) {
+	return nil, errStorageUnsupported
+}
+
+func (s *journalStorage) Tail(sender string, n int) ([]storedEntry, error) {
+	return nil, errStorageUnsupported
+}
+
+func (s *journalStorage) Delete(sender string) error {
+	return errStorageUnsupported
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+)
+
+// entries kept per sender by the memory storage
+const MEMORY_STORAGE_MAX = 10000
+
+// memoryStorage keeps the newest entries of every sender in memory; it backs
+// tests, simulations and throwaway instances
+type memoryStorage struct {
+	lock    *sync.Mutex
+	senders map[string][]storedEntry
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		lock:    &sync.Mutex{},
+		senders: make(map[string][]storedEntry),
+	}
+}
+
+func (s *memoryStorage) Append(e *entry) error {
+	se := storedEntry{
+		Sender: e.sender,
+		Time:   e.time(),
+		Level:  e.level,
+		Msg:    e.render(),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := append(s.senders[e.sender], se)
+	if len(entries) > MEMORY_STORAGE_MAX {
+		entries = entries[len(entries)-MEMORY_STORAGE_MAX:]
+	}
+
+	s.senders[e.sender] = entries
+
+	return nil
+}
+
+func (s *memoryStorage) Rotate(sender string) error {
+	// nothing to cut in memory
+	return nil
+}
+
+func (s *memoryStorage) Query(sender string, q storageQuery) ([]storedEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var matched []storedEntry
+
+	for _, se := range s.senders[sender] {
+		if q.matches(&se) {
+			matched = q.collect(matched, se)
+		}
+	}
+
+	return matched, nil
+}
+
+func (s *memoryStorage) Tail(sender string, n int) ([]storedEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := s.senders[sender]
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+
+	return append([]storedEntry(nil), entries...), nil
+}
+
+func (s *memoryStorage) Delete(sender string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.senders, sender)
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"logit/logg"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SYSLOG_MAX_MESSAGE = 64 * 1024       // larger messages are cut
+	SYSLOG_TCP_IDLE    = 5 * time.Minute // connections silent that long are closed
+	SYSLOG_NIL         = "-"             // the NILVALUE of RFC 5424
+)
+
+// syslog severities 0 (emergency) .. 7 (debug) as logit levels
+var syslogLevels = [8]string{"fatal", "fatal", "fatal", "error", "warn", "info", "info", "debug"}
+
+// syslogMessage is the part of an RFC 5424 message logit keeps
+type syslogMessage struct {
+	severity int
+	time     time.Time // zero if not given
+	hostname string
+	appName  string
+	procId   string
+	msgId    string
+	data     string // structured data, as sent
+	msg      string
+}
+
+// parseSyslog parses an RFC 5424 message:
+// '<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]'
+func parseSyslog(line string) (*syslogMessage, error) {
+	if !strings.HasPrefix(line, "<") {
+		return nil, fmt.Errorf("missing priority")
+	}
+
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return nil, fmt.Errorf("invalid priority")
+	}
+
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, fmt.Errorf("invalid priority '%s'", line[1:end])
+	}
+
+	rest := line[end+1:]
+	if !strings.HasPrefix(rest, "1 ") {
+		return nil, fmt.Errorf("not an RFC 5424 message (version 1)")
+	}
+	rest = rest[2:]
+
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	header := strings.SplitN(rest, " ", 6)
+	if len(header) < 6 {
+		return nil, fmt.Errorf("truncated header")
+	}
+
+	m := &syslogMessage{
+		severity: pri % 8,
+		hostname: header[1],
+		appName:  header[2],
+		procId:   header[3],
+		msgId:    header[4],
+	}
+
+	if header[0] != SYSLOG_NIL {
+		if m.time, err = time.Parse(time.RFC3339Nano, header[0]); err != nil {
+			return nil, fmt.Errorf("invalid timestamp '%s'", header[0])
+		}
+	}
+
+	m.data, m.msg, err = splitStructuredData(header[5])
+	if err != nil {
+		return nil, err
+	}
+
+	// a BOM marks UTF-8 messages
+	m.msg = strings.TrimPrefix(m.msg, "\ufeff")
+
+	return m, nil
+}
+
+// splitStructuredData separates '-' or '[id k="v" ...]...' from the message
+func splitStructuredData(s string) (string, string, error) {
+	if strings.HasPrefix(s, SYSLOG_NIL) {
+		return "", strings.TrimPrefix(s[1:], " "), nil
+	}
+
+	i, inValue := 0, false
+
+	for i < len(s) && s[i] == '[' {
+		for i++; i < len(s); i++ {
+			c := s[i]
+
+			if inValue && c == '\\' {
+				i++ // escaped '"', '\' or ']'
+			} else if c == '"' {
+				inValue = !inValue
+			} else if c == ']' && !inValue {
+				break
+			}
+		}
+
+		if i >= len(s) {
+			return "", "", fmt.Errorf("unterminated structured data")
+		}
+		i++
+	}
+
+	if i == 0 {
+		return "", "", fmt.Errorf("missing structured data")
+	}
+
+	return s[:i], strings.TrimPrefix(s[i:], " "), nil
+}
+
+// senderOf picks the sender of a message by -syslog-sender, falling back to
+// the other name when the chosen one is absent
+func (m *syslogMessage) senderOf(by string) string {
+	names := []string{m.appName, m.hostname}
+	if by == "host" {
+		names = []string{m.hostname, m.appName}
+	}
+
+	for _, name := range names {
+		if sender, err := normalizeSender(name); name != SYSLOG_NIL && err == nil {
+			return sender
+		}
+	}
+
+	return ""
+}
+
+// syslogListener accepts syslog over UDP (a message per datagram) and TCP
+// (octet counted or newline delimited framing, RFC 6587) and hands the
+// messages to the intake like the HTTP handler does
+type syslogListener struct {
+	senderBy string // 'app' or 'host'
+	logger   *logg.Logger
+}
+
+func newSyslogListener(senderBy string, logger *logg.Logger) (*syslogListener, error) {
+	switch senderBy {
+	case "app", "host":
+	default:
+		return nil, fmt.Errorf("unknown -syslog-sender '%s' (expected 'app' or 'host')", senderBy)
+	}
+
+	return &syslogListener{senderBy: senderBy, logger: logger}, nil
+}
+
+func (l *syslogListener) listenUDP(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, SYSLOG_MAX_MESSAGE)
+
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				l.logger.Errorf("syslog udp read failed: %v", err)
+				return
+			}
+
+			l.accept(string(buf[:n]), from.String())
+		}
+	}()
+
+	return nil
+}
+
+func (l *syslogListener) listenTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				l.logger.Errorf("syslog tcp accept failed: %v", err)
+				return
+			}
+
+			go l.serveTCP(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (l *syslogListener) serveTCP(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, SYSLOG_MAX_MESSAGE)
+	remote := conn.RemoteAddr().String()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(SYSLOG_TCP_IDLE))
+
+		line, err := readSyslogFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				l.logger.Warnf("syslog connection from %s: %v", remote, err)
+			}
+			return
+		}
+
+		if line != "" {
+			l.accept(line, remote)
+		}
+	}
+}
+
+// readSyslogFrame reads one message: '<length> <message>' when it starts
+// with a digit, else up to the next newline
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if b[0] < '0' || b[0] > '9' {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	s, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n <= 0 || n > SYSLOG_MAX_MESSAGE {
+		return "", fmt.Errorf("invalid frame length '%s'", strings.TrimSpace(s))
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(msg), "\r\n"), nil
+}
+
+func (l *syslogListener) accept(line, remote string) {
+	parse := stageStats.timer("parse")
+
+	m, err := parseSyslog(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		parse.end(STAGE_DROPPED)
+		l.logger.Warnf("invalid syslog message from %s: %v", remote, err)
+		return
+	}
+
+	sender := aliases.resolve(m.senderOf(l.senderBy))
+	if sender == "" {
+		parse.end(STAGE_DROPPED)
+		l.logger.Warnf("syslog message from %s names no sender", remote)
+		return
+	}
+
+	fields := make(map[string]interface{})
+
+	for k, v := range map[string]string{"host": m.hostname, "app": m.appName, "procid": m.procId, "msgid": m.msgId} {
+		if v != SYSLOG_NIL && v != "" {
+			fields[k] = v
+		}
+	}
+
+	if m.data != "" {
+		fields["sd"] = m.data
+	}
+
+	e := &entry{
+		sender:   sender,
+		level:    syslogLevels[m.severity],
+		msg:      m.msg,
+		fields:   fields,
+		received: time.Now(),
+		at:       m.time,
+	}
+
+	parse.end(STAGE_PASSED)
+
+	if dryRun {
+		return
+	}
+
+	// there is no one to tell; the entry is counted and dropped
+	if ok, _ := senderLimits.allow(e); !ok || !quotas.allow(e) {
+		return
+	}
+
+	if !intake.run(e) {
+		return
+	}
+
+	if err := deliver(e); err != nil {
+		l.logger.Errorf("storing syslog entry of '%s' failed: %v", sender, err)
+	}
+}
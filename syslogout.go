@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"logit/logg"
+	"net"
+	"strings"
+	"sync"
+)
+
+const SYSLOG_DEFAULT_PORT = "514"
+
+// syslogForwarder relays entries to a syslog server (rsyslog, syslog-ng)
+// through a logg syslog sink, each entry named by its sender
+type syslogForwarder struct {
+	network string
+	addr    string
+	tls     *tls.Config
+
+	lock *sync.Mutex
+	sink logg.Sink
+}
+
+// newSyslogForwarder takes 'udp://host[:port]', 'tcp://host[:port]' or
+// 'tls://host[:port]', the format (rfc5424 or rfc3164) and the facility
+// (1 to 23)
+func newSyslogForwarder(url, format string, facility int) (*syslogForwarder, error) {
+	var network, addr string
+
+	for _, n := range []string{"udp", "tcp", "tls"} {
+		if strings.HasPrefix(url, n+"://") {
+			network, addr = n, strings.TrimRight(url[len(n)+3:], "/")
+		}
+	}
+
+	if network == "" || addr == "" {
+		return nil, fmt.Errorf("invalid syslog address '%s' (expected udp://, tcp:// or tls://host[:port])", url)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, SYSLOG_DEFAULT_PORT)
+	}
+
+	f := logg.SyslogFormatFrom(format, -1)
+	if f < 0 {
+		return nil, fmt.Errorf("unknown syslog format '%s' (expected rfc5424 or rfc3164)", format)
+	}
+
+	opts := logg.SyslogOptions{
+		Network:  network,
+		Addr:     addr,
+		Format:   f,
+		Facility: facility,
+	}
+
+	if network == "tls" {
+		conf, err := outboundTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, _ := net.SplitHostPort(addr)
+		conf.ServerName = host
+		opts.TLS = conf
+	}
+
+	sink, err := logg.SyslogSink(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogForwarder{
+		network: network,
+		addr:    addr,
+		tls:     opts.TLS,
+		lock:    &sync.Mutex{},
+		sink:    sink,
+	}, nil
+}
+
+func (s *syslogForwarder) send(batch []*sinkEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, e := range batch {
+		fields := logg.Fields(e.Fields)
+		if e.Retain != "" || e.Id != "" {
+			fields = make(logg.Fields, len(e.Fields)+2)
+			for k, v := range e.Fields {
+				fields[k] = v
+			}
+
+			if e.Retain != "" {
+				fields["retain"] = e.Retain
+			}
+			if e.Id != "" {
+				fields["logit_id"] = e.Id
+			}
+		}
+
+		err := s.sink.Write(logg.Entry{
+			Time:   e.Time,
+			Level:  logg.LogLevelFrom(e.Level, logg.LOG_LEVEL_INFO),
+			Prefix: e.Sender,
+			Msg:    e.Msg,
+			Fields: fields,
+		})
+		if err != nil {
+			// the server is away: the batch goes again, the entries it
+			// took before included
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *syslogForwarder) probe(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+
+	if s.network == "tls" {
+		d := &tls.Dialer{Config: s.tls}
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, s.network, s.addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
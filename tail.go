@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TAIL_BUFFER    = 256 // entries queued per client before they are dropped
+	TAIL_HEARTBEAT = 15 * time.Second
+	TAIL_ALL       = "*"   // subscribes to every sender
+	TAIL_HISTORY   = 4096  // recent entries kept for clients resuming at a seq
+	TAIL_BACKLOG   = 10000 // entries of a ?since= backlog at most, the newest
+)
+
+// tailEntry is an entry as published, numbered in publishing order. a seq
+// of 0 marks an entry read back from storage.
+type tailEntry struct {
+	storedEntry
+	seq uint64
+}
+
+// tailSub is one connected live tail client
+type tailSub struct {
+	sender  string
+	level   string
+	ch      chan tailEntry
+	dropped int64 // entries lost to a full buffer since the last notice (atomic)
+}
+
+func (sub *tailSub) wants(te *tailEntry) bool {
+	return (sub.sender == TAIL_ALL || sub.sender == te.Sender) && levelAtLeast(te.Level, sub.level)
+}
+
+// tailHub fans accepted entries out to live tail clients. publishing never
+// blocks: a client that falls behind loses entries and is told how many.
+// the last TAIL_HISTORY entries are kept, so a client that reconnects with
+// the seq it got last misses nothing.
+type tailHub struct {
+	lock    *sync.Mutex
+	subs    map[string]map[*tailSub]bool // by sender, TAIL_ALL for all
+	seq     uint64                       // of the last entry published
+	history []tailEntry                  // ring, oldest at next once full
+	next    int
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{
+		lock: &sync.Mutex{},
+		subs: make(map[string]map[*tailSub]bool),
+	}
+}
+
+// subscribeAfter subscribes and, if resume, returns the entries after seq
+// still in history. gap tells that some are no longer held, or that seq
+// isn't of this run of the server.
+func (h *tailHub) subscribeAfter(sender, level string, seq uint64, resume bool) (*tailSub, []tailEntry, bool) {
+	sub := &tailSub{
+		sender: sender,
+		level:  level,
+		ch:     make(chan tailEntry, TAIL_BUFFER),
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.subs[sender] == nil {
+		h.subs[sender] = make(map[*tailSub]bool)
+	}
+	h.subs[sender][sub] = true
+
+	if !resume {
+		return sub, nil, false
+	}
+
+	oldest := h.seq - uint64(len(h.history)) + 1
+	gap := seq > h.seq || seq+1 < oldest
+
+	var backlog []tailEntry
+
+	for i := range h.history {
+		te := h.history[(h.next+i)%len(h.history)]
+
+		if te.seq > seq && sub.wants(&te) {
+			backlog = append(backlog, te)
+		}
+	}
+
+	return sub, backlog, gap
+}
+
+func (h *tailHub) unsubscribe(sub *tailSub) {
+	h.lock.Lock()
+	delete(h.subs[sub.sender], sub)
+	if len(h.subs[sub.sender]) == 0 {
+		delete(h.subs, sub.sender)
+	}
+	h.lock.Unlock()
+}
+
+func (h *tailHub) publish(e *entry) {
+	if h == nil {
+		return
+	}
+
+	te := tailEntry{storedEntry{Sender: e.sender, Time: e.time(), Level: e.level, Msg: e.render()}, 0}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.seq++
+	te.seq = h.seq
+
+	if len(h.history) < TAIL_HISTORY {
+		h.history = append(h.history, te)
+	} else {
+		h.history[h.next] = te
+		h.next = (h.next + 1) % TAIL_HISTORY
+	}
+
+	for _, sender := range []string{e.sender, TAIL_ALL} {
+		for sub := range h.subs[sender] {
+			if !levelAtLeast(te.Level, sub.level) {
+				continue
+			}
+
+			select {
+			case sub.ch <- te:
+			default:
+				atomic.AddInt64(&sub.dropped, 1)
+			}
+		}
+	}
+}
+
+// tailMessage is what clients receive: an entry, or a notice of lost ones.
+// severity (0 trace, 1 debug .. 5 fatal) and tag ('ERRO' as in the files) let clients
+// color and filter entries without parsing the message. seq numbers live
+// entries for resuming; a gap tells that entries before the backlog are lost.
+type tailMessage struct {
+	Seq      uint64 `json:"seq,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Level    string `json:"level,omitempty"`
+	Severity int    `json:"severity,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Msg      string `json:"msg,omitempty"`
+	Dropped  int64  `json:"dropped,omitempty"`
+	Gap      bool   `json:"gap,omitempty"`
+}
+
+var tailLevels = map[string]struct {
+	severity int
+	tag      string
+}{
+	"trace": {0, "TRAC"},
+	"debug": {1, "DEBG"},
+	"info":  {2, "INFO"},
+	"warn":  {3, "WARN"},
+	"error": {4, "ERRO"},
+	"fatal": {5, "FATL"},
+}
+
+// tailStream is what a client is sent: a backlog, then live entries
+type tailStream struct {
+	sub     *tailSub
+	backlog []tailEntry
+	gap     bool
+	seen    map[string]bool // backlog entries live ones may repeat
+	message func(tailEntry) tailMessage
+}
+
+func tailKey(te *tailEntry) string {
+	// not the time: files have when the entry was written
+	return te.Sender + "\x00" + te.Level + "\x00" + te.Msg
+}
+
+// live tells whether a live entry is to be sent, not being in the backlog
+func (ts *tailStream) live(te *tailEntry) bool {
+	if len(ts.seen) == 0 || !ts.seen[tailKey(te)] {
+		return true
+	}
+
+	delete(ts.seen, tailKey(te))
+	return false
+}
+
+// makeTailHandler serves GET /tail/<sender>?level=, which pushes new entries
+// of a sender ('*' for all) as they are accepted, before they reach storage.
+// WebSocket clients get a JSON text message per entry, others a Server-Sent
+// Events stream of 'entry' and 'dropped' events. tz and timefmt render times.
+// a backlog comes first with ?seq= (or Last-Event-ID), the entries after that
+// seq still held in memory, or with ?since=, those stored since then.
+func makeTailHandler(hub *tailHub) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		sender := strings.Trim(strings.TrimPrefix(req.URL.EscapedPath(), "/tail"), "/")
+		if sender != TAIL_ALL {
+			var err error
+			if sender, err = senderOfPath(sender); err != nil {
+				writeError(rw, ERR_SENDER_INVALID, "expected /tail/<sender> or /tail/*: %v", err)
+				return
+			}
+		}
+
+		if sender != TAIL_ALL {
+			sender = aliases.resolve(sender)
+		}
+
+		if !senderAllowed(req, sender) {
+			writeError(rw, ERR_FORBIDDEN, "not allowed to read '%s'", sender)
+			return
+		}
+
+		q := req.URL.Query()
+
+		level := strings.ToLower(q.Get("level"))
+		if level != "" && !logLevels[level] {
+			writeError(rw, ERR_BODY_INVALID, "unknown level '%s'", level)
+			return
+		}
+
+		render, err := parseTimeRenderer(q)
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "%v", err)
+			return
+		}
+
+		seqParam := q.Get("seq")
+		if seqParam == "" {
+			seqParam = req.Header.Get("Last-Event-ID")
+		}
+
+		var seq uint64
+		if seqParam != "" {
+			if seq, err = strconv.ParseUint(seqParam, 10, 64); err != nil {
+				writeError(rw, ERR_BODY_INVALID, "invalid seq '%s'", seqParam)
+				return
+			}
+		}
+
+		since, err := parseTimeParam(q.Get("since"), time.Time{})
+		if err != nil {
+			writeError(rw, ERR_BODY_INVALID, "invalid 'since': %v", err)
+			return
+		}
+
+		if !since.IsZero() && seqParam == "" && sender == TAIL_ALL {
+			writeError(rw, ERR_SENDER_INVALID, "since needs a sender")
+			return
+		}
+
+		ts := &tailStream{
+			message: func(te tailEntry) tailMessage {
+				meta := tailLevels[te.Level]
+				return tailMessage{Seq: te.seq, Sender: te.Sender, Time: render.format(te.Time), Level: te.Level, Severity: meta.severity, Tag: meta.tag, Msg: te.Msg}
+			},
+		}
+
+		ts.sub, ts.backlog, ts.gap = hub.subscribeAfter(sender, level, seq, seqParam != "")
+		defer hub.unsubscribe(ts.sub)
+
+		if !since.IsZero() && seqParam == "" {
+			// subscribed first, so nothing falls between backlog and live
+			now := time.Now()
+
+			stored, err := store.Query(sender, storageQuery{level: level, since: since, until: now, limit: TAIL_BACKLOG + 1})
+			if err == errStorageUnsupported {
+				writeError(rw, ERR_BODY_INVALID, "the storage can't be read back")
+				return
+			}
+			if err != nil {
+				writeError(rw, ERR_INTERNAL, "reading the backlog failed: %v", err)
+				return
+			}
+
+			if len(stored) > TAIL_BACKLOG {
+				stored, ts.gap = stored[1:], true
+			}
+
+			ts.seen = make(map[string]bool)
+
+			for _, se := range stored {
+				te := tailEntry{se, 0}
+				ts.backlog = append(ts.backlog, te)
+
+				// live entries published while reading may be stored too
+				if now.Sub(se.Time) < time.Second {
+					ts.seen[tailKey(&te)] = true
+				}
+			}
+		}
+
+		if isWebSocketRequest(req) {
+			serveTailWebSocket(rw, req, ts)
+		} else {
+			serveTailEvents(rw, req, ts)
+		}
+	}
+}
+
+func serveTailEvents(rw http.ResponseWriter, req *http.Request, ts *tailStream) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, ERR_INTERNAL, "streaming is not supported")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(TAIL_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	send := func(event string, v interface{}) bool {
+		b, _ := json.Marshal(v)
+		_, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, b)
+		return err == nil
+	}
+
+	// entries carry their seq as the event id, which EventSource sends
+	// back as Last-Event-ID when it reconnects
+	sendEntry := func(te tailEntry) bool {
+		if te.seq > 0 {
+			if _, err := fmt.Fprintf(rw, "id: %d\n", te.seq); err != nil {
+				return false
+			}
+		}
+
+		return send("entry", ts.message(te))
+	}
+
+	if ts.gap && !send("gap", tailMessage{Gap: true}) {
+		return
+	}
+
+	for _, te := range ts.backlog {
+		if !sendEntry(te) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-stopping:
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(rw, ": ping\n\n"); err != nil {
+				return
+			}
+
+		case te := <-ts.sub.ch:
+			if n := atomic.SwapInt64(&ts.sub.dropped, 0); n > 0 && !send("dropped", tailMessage{Dropped: n}) {
+				return
+			}
+
+			if ts.live(&te) && !sendEntry(te) {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+func serveTailWebSocket(rw http.ResponseWriter, req *http.Request, ts *tailStream) {
+	conn, brw, err := wsAccept(rw, req)
+	if err != nil {
+		writeError(rw, ERR_BODY_INVALID, "%v", err)
+		return
+	}
+	defer conn.Close()
+
+	// the client only closes or pings; answers are sent by the loop below
+	closed := make(chan struct{})
+	pings := make(chan []byte, 1)
+
+	go func() {
+		defer close(closed)
+
+		for {
+			op, payload, err := wsReadFrame(brw.Reader)
+			if err != nil || op == WS_OP_CLOSE {
+				return
+			}
+
+			if op == WS_OP_PING {
+				select {
+				case pings <- payload:
+				default:
+				}
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(TAIL_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	send := func(v interface{}) error {
+		b, _ := json.Marshal(v)
+		return wsWriteFrame(brw.Writer, WS_OP_TEXT, b)
+	}
+
+	if ts.gap {
+		err = send(tailMessage{Gap: true})
+	}
+
+	for _, te := range ts.backlog {
+		if err == nil {
+			err = send(ts.message(te))
+		}
+	}
+
+	for err == nil {
+		select {
+		case <-closed:
+			wsWriteFrame(brw.Writer, WS_OP_CLOSE, nil)
+			return
+
+		case payload := <-pings:
+			err = wsWriteFrame(brw.Writer, WS_OP_PONG, payload)
+
+		case <-heartbeat.C:
+			err = wsWriteFrame(brw.Writer, WS_OP_PING, nil)
+
+		case te := <-ts.sub.ch:
+			if n := atomic.SwapInt64(&ts.sub.dropped, 0); n > 0 {
+				err = send(tailMessage{Dropped: n})
+			}
+
+			if err == nil && ts.live(&te) {
+				err = send(ts.message(te))
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TAIL_RECONNECT = 2 * time.Second // wait before reconnecting a dropped stream
+
+// ANSI styles of the levels, by severity; warn and above are emphasized
+var tailStyles = map[int]string{
+	1: "\x1b[2m",    // debug: dim
+	2: "",           // info: plain
+	3: "\x1b[33m",   // warn: yellow
+	4: "\x1b[1;31m", // error: bold red
+	5: "\x1b[1;41m", // fatal: bold on red
+}
+
+const (
+	ANSI_RESET     = "\x1b[0m"
+	ANSI_HIGHLIGHT = "\x1b[1;7m" // bold reverse video
+)
+
+// tailPrinter writes tail messages as lines like the files have them
+type tailPrinter struct {
+	w         io.Writer
+	color     bool
+	highlight *regexp.Regexp // nil highlights nothing
+	only      bool           // print only entries matching highlight
+}
+
+func (p *tailPrinter) print(m *tailMessage) {
+	if m.Dropped > 0 {
+		fmt.Fprintf(p.w, "-- %d entries dropped\n", m.Dropped)
+		return
+	}
+
+	if m.Gap {
+		fmt.Fprintf(p.w, "-- entries missed before here\n")
+		return
+	}
+
+	if m.Severity == 0 {
+		// a server from before level metadata
+		meta := tailLevels[m.Level]
+		m.Severity, m.Tag = meta.severity, meta.tag
+	}
+
+	msg := m.Msg
+	matched := p.highlight != nil && p.highlight.MatchString(msg)
+
+	if p.only && !matched {
+		return
+	}
+
+	style := tailStyles[m.Severity]
+	if !p.color {
+		style = ""
+	}
+
+	if matched && p.color {
+		// restore the level style after each match
+		msg = p.highlight.ReplaceAllStringFunc(msg, func(s string) string {
+			return ANSI_HIGHLIGHT + s + ANSI_RESET + style
+		})
+	} else if matched {
+		msg = "** " + msg
+	}
+
+	line := fmt.Sprintf("%s %s (%s) %s", m.Time, m.Sender, m.Tag, msg)
+
+	if style != "" {
+		line = style + line + ANSI_RESET
+	}
+
+	fmt.Fprintln(p.w, line)
+}
+
+// isTerminal tells whether f is a character device, i.e. (likely) a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// runTailClient is 'logit tail [flags] <sender|*>': it follows the live tail
+// of a server and prints entries colored by level. returns the exit code.
+func runTailClient(args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+
+	server := fs.String("server", "http://localhost:8070", "base url of the logit server")
+	level := fs.String("level", "", "lowest level shown")
+	highlight := fs.String("highlight", "", "regex whose matches are highlighted")
+	only := fs.Bool("only", false, "show only entries matching -highlight")
+	color := fs.String("color", "auto", "color by level: 'auto' (on a terminal), 'always' or 'never'")
+	token := fs.String("token", "", "token sent as Bearer (default: $LOGIT_TOKEN)")
+	tz := fs.String("tz", "", "time zone times are shown in (default: the server's)")
+	since := fs.String("since", "", "start with the entries stored since then (e.g. '15m' or an RFC 3339 time)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: logit tail [flags] <sender|*>\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	p := &tailPrinter{w: os.Stdout, only: *only}
+
+	switch *color {
+	case "auto":
+		p.color = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	case "always":
+		p.color = true
+	case "never":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -color '%s' (expected 'auto', 'always' or 'never')\n", *color)
+		return 2
+	}
+
+	if *highlight != "" {
+		re, err := regexp.Compile(*highlight)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -highlight: %v\n", err)
+			return 2
+		}
+		p.highlight = re
+	} else if *only {
+		fmt.Fprintf(os.Stderr, "-only requires -highlight\n")
+		return 2
+	}
+
+	q := url.Values{}
+	if *level != "" {
+		q.Set("level", *level)
+	}
+	if *tz != "" {
+		q.Set("tz", *tz)
+	}
+
+	base := strings.TrimRight(*server, "/") + "/tail/" + url.PathEscape(fs.Arg(0))
+
+	if *token == "" {
+		*token = os.Getenv("LOGIT_TOKEN")
+	}
+
+	// once following, a server restart is waited out; reconnecting resumes
+	// after the last entry seen
+	var seq uint64
+
+	for following := false; ; {
+		q.Del("since")
+		q.Del("seq")
+
+		if seq > 0 {
+			q.Set("seq", strconv.FormatUint(seq, 10))
+		} else if *since != "" {
+			q.Set("since", *since)
+		}
+
+		connected, err := followTail(base+"?"+q.Encode(), *token, p, &seq)
+		if !connected && !following {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		following = true
+
+		fmt.Fprintf(os.Stderr, "tail stream lost (%v), reconnecting\n", err)
+		time.Sleep(TAIL_RECONNECT)
+	}
+}
+
+// followTail prints the Server-Sent Events of u until the stream ends,
+// keeping the seq of the last entry. connected tells whether the server
+// accepted the request at all.
+func followTail(u, token string, p *tailPrinter, seq *uint64) (connected bool, err error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body errorBody
+		json.NewDecoder(resp.Body).Decode(&body)
+		return false, fmt.Errorf("%s: %s", resp.Status, body.Message)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	var data string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return true, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "data: "):
+			data += strings.TrimPrefix(line, "data: ")
+
+		case line == "" && data != "":
+			var m tailMessage
+			if err := json.Unmarshal([]byte(data), &m); err == nil {
+				p.print(&m)
+
+				if m.Seq > 0 {
+					*seq = m.Seq
+				}
+			}
+			data = ""
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// named layouts accepted by ?timefmt=
+var timeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123Z,
+	"log":         LINE_TIME_LAYOUT,
+	"datetime":    "2006-01-02 15:04:05",
+	"kitchen":     time.Kitchen,
+}
+
+// strftime directives understood in ?timefmt=, mapped to Go layout parts
+var strftimeDirectives = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'H': "15", 'I': "03",
+	'M': "04", 'S': "05", 'p': "PM", 'b': "Jan", 'B': "January",
+	'a': "Mon", 'A': "Monday", 'z': "-0700", 'Z': "MST", 'f': "000000",
+	'F': "2006-01-02", 'T': "15:04:05", '%': "%",
+}
+
+// timeRenderer renders timestamps of API responses in the zone and format a
+// caller asked for; stored times stay as they are
+type timeRenderer struct {
+	loc    *time.Location // nil keeps the time's own zone
+	layout string         // "unix" and "unixms" give epoch numbers
+}
+
+var defaultTimeRenderer = timeRenderer{layout: time.RFC3339Nano}
+
+// parseZone accepts IANA names ('Asia/Seoul'), 'UTC', 'Local' and fixed
+// offsets ('+09:00', '-0530')
+func parseZone(s string) (*time.Location, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	if s[0] == ' ' {
+		// an unescaped '+' in a query string arrives as a space
+		s = "+" + s[1:]
+	}
+
+	if s[0] == '+' || s[0] == '-' {
+		digits := strings.Replace(s[1:], ":", "", 1)
+
+		if len(digits) == 2 {
+			digits += "00"
+		}
+
+		if len(digits) != 4 {
+			return nil, fmt.Errorf("invalid offset '%s'", s)
+		}
+
+		h, herr := strconv.Atoi(digits[:2])
+		m, merr := strconv.Atoi(digits[2:])
+		if herr != nil || merr != nil || h > 14 || m > 59 {
+			return nil, fmt.Errorf("invalid offset '%s'", s)
+		}
+
+		offset := h*3600 + m*60
+		if s[0] == '-' {
+			offset = -offset
+		}
+
+		return time.FixedZone(s, offset), nil
+	}
+
+	return time.LoadLocation(s)
+}
+
+// strftimeLayout converts '%Y-%m-%d %H:%M' style formats to a Go layout
+func strftimeLayout(s string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+1 == len(s) {
+			return "", fmt.Errorf("dangling '%%' in '%s'", s)
+		}
+
+		part, ok := strftimeDirectives[s[i+1]]
+		if !ok {
+			return "", fmt.Errorf("unsupported directive '%%%c'", s[i+1])
+		}
+
+		b.WriteString(part)
+		i++
+	}
+
+	return b.String(), nil
+}
+
+// parseLineTime sets the time layout and zone of text lines from
+// -time-format and -time-zone. logit reads its files back, so the layout
+// must keep the date and the time to the second.
+func parseLineTime(format, zone string) error {
+	layout, err := parseTimeLayout(format)
+	if err != nil {
+		return fmt.Errorf("invalid -time-format: %v", err)
+	}
+
+	loc, err := parseZone(zone)
+	if err != nil {
+		return fmt.Errorf("invalid -time-zone: %v", err)
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	ref := time.Date(2024, 11, 28, 21, 34, 56, 0, loc)
+	if t, err := time.ParseInLocation(layout, ref.Format(layout), loc); err != nil || !t.Equal(ref) {
+		return fmt.Errorf("-time-format '%s' can't be read back to the second", format)
+	}
+
+	if strings.Contains(layout, " (") {
+		return fmt.Errorf("-time-format '%s' can't contain ' ('", format)
+	}
+
+	lineTimeLayout, lineTimeLoc = layout, loc
+
+	return nil
+}
+
+// parseTimeRenderer reads ?tz= and ?timefmt=. timefmt is a name (rfc3339,
+// rfc3339nano, rfc1123, log, datetime, kitchen, unix, unixms), a strftime
+// format ('%Y-%m-%d %H:%M:%S') or a Go layout ('2006-01-02 15:04').
+func parseTimeRenderer(q url.Values) (timeRenderer, error) {
+	r := defaultTimeRenderer
+
+	loc, err := parseZone(q.Get("tz"))
+	if err != nil {
+		return r, fmt.Errorf("invalid tz: %v", err)
+	}
+	r.loc = loc
+
+	f := q.Get("timefmt")
+
+	switch {
+	case f == "":
+	case f == "unix" || f == "unixms":
+		r.layout = f
+	default:
+		if r.layout, err = parseTimeLayout(f); err != nil {
+			return r, fmt.Errorf("invalid timefmt: %v", err)
+		}
+	}
+
+	return r, nil
+}
+
+// parseTimeLayout reads a layout name of timeLayouts, a strftime format or
+// a Go layout
+func parseTimeLayout(f string) (string, error) {
+	switch {
+	case timeLayouts[strings.ToLower(f)] != "":
+		return timeLayouts[strings.ToLower(f)], nil
+	case strings.Contains(f, "%"):
+		return strftimeLayout(f)
+	default:
+		// a Go layout must render the reference time differently from itself
+		if ref := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC); ref.Format(f) == f {
+			return "", fmt.Errorf("invalid layout '%s'", f)
+		}
+		return f, nil
+	}
+}
+
+func (r timeRenderer) format(t time.Time) string {
+	if r.loc != nil {
+		t = t.In(r.loc)
+	}
+
+	switch r.layout {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixms":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	default:
+		return t.Format(r.layout)
+	}
+}
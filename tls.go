@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// serverCert is the certificate of -tls-cert, also presented to peers
+var serverCert *tls.Certificate
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates in '%s'", path)
+	}
+
+	return pool, nil
+}
+
+// newServerTLSConfig builds the listener's TLS configuration. with a client
+// CA, client certificates are verified against it (and the 'mtls' auth
+// mechanism can accept them); requireClientCert refuses handshakes without one.
+func newServerTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the certificate failed: %v", err)
+	}
+	serverCert = &cert
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		if conf.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if requireClientCert {
+		return nil, fmt.Errorf("-tls-require-client-cert needs -tls-client-ca")
+	}
+
+	return conf, nil
+}
+
+// outboundTransport is used for requests to peers and shadow targets: it
+// trusts -tls-peer-ca on top of the system roots and presents the server
+// certificate, so peers requiring 'mtls' accept us
+func outboundTransport() (http.RoundTripper, error) {
+	if tlsPeerCA == "" && serverCert == nil {
+		return http.DefaultTransport, nil
+	}
+
+	conf, err := outboundTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = conf
+
+	return t, nil
+}
+
+// outboundTLSConfig is the client side of outboundTransport, for other
+// connections to the outside such as syslog over TLS
+func outboundTLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tlsPeerCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		b, err := ioutil.ReadFile(tlsPeerCA)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no PEM certificates in '%s'", tlsPeerCA)
+		}
+
+		conf.RootCAs = pool
+	}
+
+	if serverCert != nil {
+		conf.Certificates = []tls.Certificate{*serverCert}
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headers clients propagate the trace an entry was logged in with: the W3C
+// trace context, or the binary one of OpenCensus gRPC clients
+const (
+	TRACEPARENT_HEADER    = "Traceparent"
+	GRPC_TRACE_BIN_HEADER = "Grpc-Trace-Bin"
+)
+
+// fields the trace and span ids of -trace-fields go in, "" if turned off
+var traceIdField, spanIdField string
+
+// parseTraceFields parses -trace-fields: '<trace field>,<span field>', or
+// 'off' (or nothing) storing no ids
+func parseTraceFields(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		return "", "", nil
+	}
+
+	ss := strings.Split(s, ",")
+	if len(ss) != 2 || strings.TrimSpace(ss[0]) == "" || strings.TrimSpace(ss[1]) == "" {
+		return "", "", fmt.Errorf("invalid trace fields '%s' (expected '<trace field>,<span field>', e.g. 'trace_id,span_id', or 'off')", s)
+	}
+
+	return strings.TrimSpace(ss[0]), strings.TrimSpace(ss[1]), nil
+}
+
+// traceOf returns the trace and span id of the request's traceparent header,
+// else of its grpc-trace-bin header, as lowercase hex; "" if it has neither
+// or they are invalid, which the trace context spec says to ignore
+func traceOf(req *http.Request) (traceId, spanId string) {
+	if h := req.Header.Get(TRACEPARENT_HEADER); h != "" {
+		if traceId, spanId, ok := parseTraceparent(h); ok {
+			return traceId, spanId
+		}
+	}
+
+	if h := req.Header.Get(GRPC_TRACE_BIN_HEADER); h != "" {
+		if traceId, spanId, ok := parseGRPCTraceBin(h); ok {
+			return traceId, spanId
+		}
+	}
+
+	return "", ""
+}
+
+// parseTraceparent parses '<version>-<trace id>-<parent id>-<flags>'; later
+// versions may add to it, version ff is invalid
+func parseTraceparent(s string) (string, string, bool) {
+	ss := strings.Split(strings.TrimSpace(s), "-")
+	if len(ss) < 4 || !isTraceHex(ss[0], 2) || ss[0] == "ff" || (ss[0] == "00" && len(ss) != 4) {
+		return "", "", false
+	}
+
+	traceId, spanId := ss[1], ss[2]
+
+	if !isTraceHex(traceId, 32) || !isTraceHex(spanId, 16) || !isTraceHex(ss[3], 2) {
+		return "", "", false
+	}
+
+	if strings.Trim(traceId, "0") == "" || strings.Trim(spanId, "0") == "" {
+		return "", "", false
+	}
+
+	return traceId, spanId, true
+}
+
+// isTraceHex tells whether s is n lowercase hex digits
+func isTraceHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseGRPCTraceBin parses the base64 of OpenCensus' binary trace context:
+// version 0, then fields of an id byte and a value: 0 the 16 byte trace id,
+// 1 the 8 byte span id, 2 the 1 byte trace options
+func parseGRPCTraceBin(s string) (string, string, bool) {
+	s = strings.TrimSpace(s)
+
+	// metadata ending in -bin is sent padded or not
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(b) == 0 || b[0] != 0 {
+		return "", "", false
+	}
+
+	var traceId, spanId string
+
+	for i := 1; i < len(b); {
+		var size int
+
+		switch b[i] {
+		case 0:
+			size = 16
+		case 1:
+			size = 8
+		case 2:
+			size = 1
+		default:
+			// fields of later versions come after the known ones
+			i = len(b)
+			continue
+		}
+
+		if i+1+size > len(b) {
+			return "", "", false
+		}
+
+		v := fmt.Sprintf("%x", b[i+1:i+1+size])
+
+		switch b[i] {
+		case 0:
+			traceId = v
+		case 1:
+			spanId = v
+		}
+
+		i += 1 + size
+	}
+
+	if traceId == "" || spanId == "" || strings.Trim(traceId, "0") == "" || strings.Trim(spanId, "0") == "" {
+		return "", "", false
+	}
+
+	return traceId, spanId, true
+}
+
+// addTrace puts the request's trace and span ids in the entry's fields,
+// keeping ids the client gave as fields itself
+func (e *entry) addTrace(req *http.Request) {
+	if traceIdField == "" {
+		return
+	}
+
+	traceId, spanId := traceOf(req)
+	if traceId == "" {
+		return
+	}
+
+	if e.fields == nil {
+		e.fields = make(map[string]interface{})
+	}
+
+	if _, ok := e.fields[traceIdField]; !ok {
+		e.fields[traceIdField] = traceId
+	}
+
+	if _, ok := e.fields[spanIdField]; !ok {
+		e.fields[spanIdField] = spanId
+	}
+}
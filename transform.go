@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// TRUNCATED_FIELD tells the length in bytes of a message 'truncate' cut
+const TRUNCATED_FIELD = "truncated"
+
+// parseTransforms parses a chain like 'host+tag:env=prod+truncate:4k' of
+//
+//	host              adds the host name as field 'host'
+//	tag:<key>=<value> adds field key
+//	trim              strips the white space around the message
+//	oneline           joins the lines of the message with spaces
+//	truncate:<size>   cuts the message to size bytes
+//
+// fields an entry has already are kept; 'off' changes nothing
+func parseTransforms(s string) ([]logg.Middleware, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "" {
+		return nil, nil
+	}
+
+	var chain []logg.Middleware
+
+	for _, t := range strings.Split(s, "+") {
+		t = strings.TrimSpace(t)
+
+		name, arg := t, ""
+		if i := strings.IndexByte(t, ':'); i >= 0 {
+			name, arg = t[:i], t[i+1:]
+		}
+
+		switch name {
+		case "host":
+			host, _ := os.Hostname()
+			chain = append(chain, addField("host", host))
+		case "tag":
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid transform '%s' (expected tag:<key>=<value>)", t)
+			}
+			chain = append(chain, addField(kv[0], kv[1]))
+		case "trim":
+			chain = append(chain, trimMessage)
+		case "oneline":
+			chain = append(chain, joinLines)
+		case "truncate":
+			size, err := parseSize(arg)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid transform '%s' (expected truncate:<size>, e.g. 'truncate:4k')", t)
+			}
+			chain = append(chain, truncateMessage(int(size)))
+		default:
+			return nil, fmt.Errorf("unknown transform '%s' (expected host, tag:<key>=<value>, trim, oneline or truncate:<size>)", t)
+		}
+	}
+
+	return chain, nil
+}
+
+// addField returns a transform giving entries field key unless they have it
+func addField(key string, value interface{}) logg.Middleware {
+	return func(e logg.Entry) logg.Entry {
+		if _, ok := e.Fields[key]; ok {
+			return e
+		}
+
+		if e.Fields == nil {
+			e.Fields = make(logg.Fields, 1)
+		}
+
+		e.Fields[key] = value
+		return e
+	}
+}
+
+func trimMessage(e logg.Entry) logg.Entry {
+	e.Msg = strings.TrimSpace(e.Msg)
+	return e
+}
+
+func joinLines(e logg.Entry) logg.Entry {
+	if strings.IndexByte(e.Msg, '\n') < 0 {
+		return e
+	}
+
+	lines := strings.Split(strings.Replace(e.Msg, "\r\n", "\n", -1), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	e.Msg = strings.Join(lines, " ")
+	return e
+}
+
+// truncateMessage returns a transform cutting messages to size bytes,
+// without splitting a character, and noting their length in TRUNCATED_FIELD
+func truncateMessage(size int) logg.Middleware {
+	return func(e logg.Entry) logg.Entry {
+		if len(e.Msg) <= size {
+			return e
+		}
+
+		n := size
+		for n > 0 && !utf8.RuneStart(e.Msg[n]) {
+			n--
+		}
+
+		if e.Fields == nil {
+			e.Fields = make(logg.Fields, 1)
+		}
+
+		e.Fields[TRUNCATED_FIELD] = len(e.Msg)
+		e.Msg = e.Msg[:n]
+
+		return e
+	}
+}
+
+// transformPolicy holds the transform chains of every sender
+type transformPolicy struct {
+	lock    *sync.RWMutex
+	def     []logg.Middleware
+	senders *senderValues[[]logg.Middleware]
+}
+
+// newTransformPolicy parses the default chain and per-sender overrides like
+// 'web=host+truncate:4k,audit=off'
+func newTransformPolicy(defSpec, spec string) (*transformPolicy, error) {
+	def, err := parseTransforms(defSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := parseSenderValues(spec, "transform", "transforms", func(sender, value string) ([]logg.Middleware, error) {
+		return parseTransforms(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &transformPolicy{lock: &sync.RWMutex{}, def: def, senders: senders}, nil
+}
+
+// enabled tells whether any sender's entries are transformed
+func (p *transformPolicy) enabled() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if len(p.def) > 0 {
+		return true
+	}
+
+	for _, chain := range p.senders.all() {
+		if len(chain) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *transformPolicy) chain(sender string) []logg.Middleware {
+	if chain, ok := p.senders.get(sender); ok {
+		return chain
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.def
+}
+
+// update takes the default and overrides of next, e.g. of a reloaded
+// config, after dropping those of removed senders
+func (p *transformPolicy) update(next *transformPolicy, removed []string) {
+	p.lock.Lock()
+	p.def = next.def
+	p.lock.Unlock()
+
+	p.senders.update(next.senders, removed)
+}
+
+// stage is the pipeline stage passing entries through their sender's chain;
+// their level stays
+func (p *transformPolicy) stage(e *entry) bool {
+	chain := p.chain(e.sender)
+	if len(chain) == 0 {
+		return true
+	}
+
+	t := logg.Entry{
+		Time:   e.time(),
+		Level:  logg.LogLevelFrom(e.level, logg.LOG_LEVEL_DEBUG),
+		Prefix: e.sender,
+		Msg:    e.msg,
+		Fields: e.fields,
+	}
+
+	for _, mw := range chain {
+		t = mw(t)
+	}
+
+	if !t.Time.Equal(e.time()) {
+		e.at = t.Time
+	}
+
+	e.msg = t.Msg
+	e.fields = t.Fields
+
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"logit/logg"
+	"net"
+	"strings"
+	"time"
+)
+
+const UDP_MAX_DATAGRAM = 64 * 1024
+
+// udpListener takes plaintext entries a datagram each, for clients that
+// can't afford an HTTP round trip: 'sender level message'. there is no
+// answer and no auth, so anything reaching the port can write any sender.
+type udpListener struct {
+	logger *logg.Logger
+}
+
+func listenPlainUDP(port int, logger *logg.Logger) error {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	l := &udpListener{logger: logger}
+
+	go func() {
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				l.logger.Errorf("udp read failed: %v", err)
+				return
+			}
+
+			l.accept(string(buf[:n]), from.String())
+		}
+	}()
+
+	return nil
+}
+
+// parsePlainEntry splits 'sender level message'; the message may be empty
+func parsePlainEntry(line string) (sender, level, msg string, err error) {
+	ss := strings.SplitN(strings.TrimLeft(line, " "), " ", 3)
+	if len(ss) < 2 || ss[0] == "" || ss[1] == "" {
+		return "", "", "", fmt.Errorf("expected 'sender level message'")
+	}
+
+	if sender, err = normalizeSender(ss[0]); err != nil {
+		return "", "", "", err
+	}
+
+	if len(ss) == 3 {
+		msg = ss[2]
+	}
+
+	return sender, normalizeLevel(ss[1]), msg, nil
+}
+
+func (l *udpListener) accept(datagram, remote string) {
+	line := strings.TrimRight(datagram, "\r\n")
+	parse := stageStats.timer("parse")
+
+	sender, level, msg, err := parsePlainEntry(line)
+	if err != nil {
+		parse.end(STAGE_DROPPED)
+		l.logger.Warnf("invalid udp entry from %s: %v", remote, err)
+		return
+	}
+
+	sender = aliases.resolve(sender)
+
+	e := &entry{
+		sender:   sender,
+		level:    level,
+		msg:      msg,
+		received: time.Now(),
+	}
+
+	parse.end(STAGE_PASSED)
+
+	if dryRun {
+		return
+	}
+
+	// there is no one to tell; the entry is counted and dropped
+	if ok, _ := senderLimits.allow(e); !ok || !quotas.allow(e) {
+		return
+	}
+
+	if !intake.run(e) {
+		return
+	}
+
+	if err := deliver(e); err != nil {
+		l.logger.Errorf("storing udp entry of '%s' failed: %v", sender, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// -unix-socket serves what the port does on a Unix domain socket, for
+// processes on the same host: who may post is up to the socket file's
+// permissions rather than to whoever reaches the port. the server removes
+// the file when shut down; one left by a process that died is removed on
+// start.
+
+type unixSocketKey struct{}
+
+// fromUnixSocket tells whether the request came through -unix-socket
+func fromUnixSocket(req *http.Request) bool {
+	on, _ := req.Context().Value(unixSocketKey{}).(bool)
+	return on
+}
+
+// parseSocketMode parses -unix-socket-mode, an octal permission like '0660'
+func parseSocketMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("invalid mode '%s' (expected octal permissions, e.g. '0660')", s)
+	}
+
+	return os.FileMode(n), nil
+}
+
+// listenUnix listens on the socket at path with mode, removing a socket
+// file of the path nothing listens on any more. the socket is made in a
+// directory of its own only the server may enter, and moved to path once
+// it has its mode, so no one connects while it has the umask's.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and is not a socket", path)
+		}
+
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("'%s' is in use by another process", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("can't remove stale socket '%s': %v", path, err)
+		}
+	}
+
+	// beside path, so it is moved within the file system; a short name as
+	// socket paths are limited to about a hundred bytes
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".s")
+	if err != nil {
+		return nil, fmt.Errorf("can't make a directory for '%s': %v", path, err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	// it is removed from path, not from where it was made
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("can't set the mode of '%s': %v", path, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("can't move the socket to '%s': %v", path, err)
+	}
+
+	return &unixListener{ln, path}, nil
+}
+
+// unixListener removes the socket file when closed (the server shut down)
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+
+	return err
+}
+
+// serveUnix serves handler on the socket at path until shut down
+func serveUnix(path string, mode os.FileMode, handler http.Handler) error {
+	ln, err := listenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: httpErrorLog(serverLogger),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, unixSocketKey{}, true)
+		},
+	}
+	addServer(server)
+
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			serverLogger.Errorf("unix socket server failed: %v", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logit.sock")
+
+	ln, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("got %v, expected a socket of mode 0600", fi.Mode())
+	}
+
+	// nothing is left of where it was made
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d files in the directory, expected the socket only", len(entries))
+	}
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		t.Fatalf("can't connect: %v", err)
+	}
+	conn.Close()
+
+	// in use
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Errorf("listened on a socket in use")
+	}
+
+	ln.Close()
+
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left after close: %v", err)
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logit.sock")
+
+	// a socket of a process that died
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ln.Close()
+
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listenUnix(path, 0660); err == nil {
+		t.Errorf("listened over a file that isn't a socket")
+	}
+}
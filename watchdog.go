@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"logit/logg"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a subsystem is wedged when it has pending work but made no progress for
+// this many consecutive watchdog checks
+const WATCHDOG_STALLS = 2
+
+type watchedSubsystem struct {
+	name     string
+	progress func() int64
+	pending  func() int
+	restart  func() // optional
+
+	lastProgress int64
+	stalls       int
+}
+
+type healthSnapshot struct {
+	Time             time.Time `json:"time"`
+	QueueDepth       int       `json:"queue_depth"`
+	QueueCap         int       `json:"queue_cap"`
+	Goroutines       int       `json:"goroutines"`
+	OpenFDs          int       `json:"open_fds"`
+	Senders          int       `json:"senders"`
+	SlowestSender    string    `json:"slowest_sender,omitempty"`
+	SlowestLatency   string    `json:"slowest_latency,omitempty"`
+	LastWriteLatency string    `json:"last_write_latency"`
+	Stuck            []string  `json:"stuck,omitempty"`
+}
+
+// watchdog periodically samples the health of the server, logs it and keeps
+// the latest snapshot for the health endpoint. subsystems that stop making
+// progress are reported and, if enabled, restarted.
+type watchdog struct {
+	interval time.Duration
+	restart  bool
+	logger   *logg.Logger
+
+	lock       *sync.Mutex
+	last       healthSnapshot
+	subsystems []*watchedSubsystem
+}
+
+func newWatchdog(interval time.Duration, restart bool, logger *logg.Logger) *watchdog {
+	return &watchdog{
+		interval: interval,
+		restart:  restart,
+		logger:   logger,
+		lock:     &sync.Mutex{},
+	}
+}
+
+func (w *watchdog) watch(name string, progress func() int64, pending func() int, restart func()) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.subsystems = append(w.subsystems, &watchedSubsystem{
+		name:     name,
+		progress: progress,
+		pending:  pending,
+		restart:  restart,
+	})
+}
+
+func (w *watchdog) start() {
+	w.check()
+
+	go func() {
+		for _ = range time.Tick(w.interval) {
+			w.check()
+		}
+	}()
+}
+
+// countOpenFDs returns the number of open descriptors, or -1 where /proc is
+// not available
+func countOpenFDs() int {
+	fis, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	return len(fis)
+}
+
+func (w *watchdog) check() {
+	snap := healthSnapshot{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		OpenFDs:    countOpenFDs(),
+	}
+
+	snap.QueueDepth, snap.QueueCap = logg.QueueLen()
+
+	// find the slowest writer
+	var slowest time.Duration
+
+	open := logg.Loggers()
+
+	snap.Senders = len(open)
+	for sender, l := range open {
+		latency := l.LastWriteLatency()
+		if latency > slowest {
+			slowest = latency
+			snap.SlowestSender = sender
+		}
+	}
+
+	if snap.SlowestSender != "" {
+		snap.SlowestLatency = slowest.String()
+	}
+
+	snap.LastWriteLatency = logg.LastWriteLatency().String()
+
+	// detect wedged subsystems
+	w.lock.Lock()
+	for _, sub := range w.subsystems {
+		progress := sub.progress()
+
+		if sub.pending() > 0 && progress == sub.lastProgress {
+			sub.stalls += 1
+		} else {
+			sub.stalls = 0
+		}
+		sub.lastProgress = progress
+
+		if sub.stalls < WATCHDOG_STALLS {
+			continue
+		}
+
+		snap.Stuck = append(snap.Stuck, sub.name)
+
+		if w.restart && sub.restart != nil {
+			w.logger.Warnf("watchdog: restarting stuck subsystem '%s'", sub.name)
+			sub.restart()
+			sub.stalls = 0
+		}
+	}
+	w.last = snap
+	w.lock.Unlock()
+
+	if len(snap.Stuck) > 0 {
+		w.logger.Errorf("watchdog: stuck subsystems: %s", strings.Join(snap.Stuck, ", "))
+	}
+
+	w.logger.Infof("watchdog: queue %d/%d, goroutines %d, fds %d, senders %d, slowest '%s' (%s), last write %s",
+		snap.QueueDepth, snap.QueueCap, snap.Goroutines, snap.OpenFDs, snap.Senders,
+		snap.SlowestSender, snap.SlowestLatency, snap.LastWriteLatency)
+}
+
+func (w *watchdog) snapshot() healthSnapshot {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.last
+}
+
+func makeHealthHandler(w *watchdog) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, ERR_METHOD_INVALID, "method '%s' not allowed", req.Method)
+			return
+		}
+
+		snap := w.snapshot()
+
+		rw.Header().Set("Content-Type", "application/json")
+		if len(snap.Stuck) > 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(rw).Encode(snap)
+	}
+}